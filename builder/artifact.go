@@ -0,0 +1,383 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ArtifactConfigMediaType is the media type of the config of an artifact uploaded by a step,
+	// which identifies the manifest as a step artifact rather than an image.
+	ArtifactConfigMediaType = "application/vnd.acb.artifact.config.v1+json"
+
+	// ArtifactFileMediaType is the media type of the single layer of an artifact, the uploaded file.
+	ArtifactFileMediaType = "application/vnd.acb.artifact.file.v1"
+
+	// ArtifactFileModeAnnotation is the annotation of an artifact's layer recording the permissions of the uploaded
+	// file in octal, e.g. 755, which the downloaded file is given.
+	ArtifactFileModeAnnotation = "vnd.acb.artifact.file.mode"
+
+	// artifactTimeoutInSec is how long uploading or downloading each artifact may take.
+	artifactTimeoutInSec = 600
+)
+
+// artifactConfig is the config of every artifact, which has no properties.
+var artifactConfig = []byte("{}")
+
+// downloadArtifacts downloads the step's artifacts into its working directory.
+func (b *Builder) downloadArtifacts(ctx context.Context, step *graph.Step, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) error {
+	if len(step.DownloadArtifacts) == 0 {
+		return nil
+	}
+	if runtime.GOOS == util.WindowsOS {
+		return errors.New("downloadArtifacts are only supported on Linux")
+	}
+	store, err := b.newArtifactStore(registryCreds, credentials)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range step.DownloadArtifacts {
+		if err := b.downloadArtifact(ctx, store, step, artifact); err != nil {
+			return errors.Wrapf(err, "failed to download the artifact %s to %s for step ID: %s", artifact.Ref, artifact.Path, step.ID)
+		}
+	}
+	return nil
+}
+
+func (b *Builder) downloadArtifact(ctx context.Context, store *remoteDigest, step *graph.Step, artifact *graph.Artifact) error {
+	tmp, err := ioutil.TempFile("", "acb_artifact_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	artifactCtx, cancel := context.WithTimeout(ctx, time.Duration(artifactTimeoutInSec)*time.Second)
+	defer cancel()
+	dgst, mode, err := pullArtifact(artifactCtx, store, artifact.Ref, tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	file := path.Join(normalizeWorkDir(step.WorkingDirectory), artifact.Path)
+	write := "cat > " + shellQuote(file)
+	if mode != 0 {
+		write = writeFileCommand(file, mode)
+	}
+	args := []string{"docker", "run", "--rm", "-i", "--volume", b.workspaceDir + ":" + containerWorkspaceDir, configImageName, "-c",
+		"mkdir -p " + shellQuote(path.Dir(file)) + " && " + write}
+	var buf bytes.Buffer
+	if err := b.procManager.Run(artifactCtx, args, tmp, &buf, &buf, ""); err != nil {
+		return errors.Wrapf(err, "failed to write %s, %s", file, buf.String())
+	}
+	util.Infof("Downloaded the artifact %s (digest: %s) to %s\n", artifact.Ref, dgst, file)
+	return nil
+}
+
+// uploadArtifacts uploads the step's artifacts from its working directory.
+func (b *Builder) uploadArtifacts(ctx context.Context, step *graph.Step, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) error {
+	if len(step.UploadArtifacts) == 0 {
+		return nil
+	}
+	if runtime.GOOS == util.WindowsOS {
+		return errors.New("uploadArtifacts are only supported on Linux")
+	}
+	store, err := b.newArtifactStore(registryCreds, credentials)
+	if err != nil {
+		return err
+	}
+	for _, artifact := range step.UploadArtifacts {
+		if err := b.uploadArtifact(ctx, store, step, artifact); err != nil {
+			return errors.Wrapf(err, "failed to upload %s as the artifact %s for step ID: %s", artifact.Path, artifact.Ref, step.ID)
+		}
+	}
+	return nil
+}
+
+func (b *Builder) uploadArtifact(ctx context.Context, store *remoteDigest, step *graph.Step, artifact *graph.Artifact) error {
+	tmp, err := ioutil.TempFile("", "acb_artifact_")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	artifactCtx, cancel := context.WithTimeout(ctx, time.Duration(artifactTimeoutInSec)*time.Second)
+	defer cancel()
+	file := path.Join(normalizeWorkDir(step.WorkingDirectory), artifact.Path)
+	args := []string{"docker", "run", "--rm", "--volume", b.workspaceDir + ":" + containerWorkspaceDir, configImageName, "-c", "cat " + shellQuote(file)}
+	var buf bytes.Buffer
+	if err := b.procManager.Run(artifactCtx, args, nil, tmp, &buf, ""); err != nil {
+		return errors.Wrapf(err, "failed to read %s, %s", file, buf.String())
+	}
+	var modeOut bytes.Buffer
+	buf.Reset()
+	args = []string{"docker", "run", "--rm", "--volume", b.workspaceDir + ":" + containerWorkspaceDir, configImageName, "-c", "stat -c %a " + shellQuote(file)}
+	if err := b.procManager.Run(artifactCtx, args, nil, &modeOut, &buf, ""); err != nil {
+		return errors.Wrapf(err, "failed to get the mode of %s, %s", file, buf.String())
+	}
+	mode, err := parseArtifactFileMode(strings.TrimSpace(modeOut.String()))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the mode of %s", file)
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	dgst, err := pushArtifact(artifactCtx, store, artifact.Ref, path.Base(file), mode, tmp)
+	if err != nil {
+		return err
+	}
+	util.Infof("Uploaded %s as the artifact %s (digest: %s)\n", file, artifact.Ref, dgst)
+	return nil
+}
+
+// newArtifactStore creates the remoteDigest used to access the registries artifacts are stored in,
+// which authenticates using the Task's credentials.
+func (b *Builder) newArtifactStore(registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) (*remoteDigest, error) {
+	return NewRemoteDigestWithOptions(registryCreds, b.registryDigestOptions(credentials))
+}
+
+// parseArtifactFileMode parses the mode of a file in octal, e.g. 755, keeping only its permissions, so special bits
+// like setuid aren't carried between steps. An empty mode isn't recorded, and parses as 0.
+func parseArtifactFileMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm > 07777 {
+		return 0, fmt.Errorf("invalid file mode '%s'", mode)
+	}
+	return os.FileMode(perm).Perm(), nil
+}
+
+// pushArtifact pushes the file as an OCI artifact tagged ref and returns the digest of its manifest.
+// The artifact is an OCI image manifest whose config has the ArtifactConfigMediaType and whose single
+// layer is the file, with the ArtifactFileMediaType, the file's name as its title and its mode, if not 0.
+func pushArtifact(ctx context.Context, d *remoteDigest, ref string, name string, mode os.FileMode, file io.ReadSeeker) (digest.Digest, error) {
+	imgRef, imageRef, err := parseArtifactRef(ref)
+	if err != nil {
+		return "", err
+	}
+	if err := d.registryAllowlist.Check(imgRef.Registry); err != nil {
+		return "", err
+	}
+	release, err := d.limiter.acquire(ctx, imgRef.Registry)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	resolver, err := d.artifactResolver(ctx, imgRef)
+	if err != nil {
+		return "", err
+	}
+	pusher, err := resolver.Pusher(ctx, imageRef)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create a pusher")
+	}
+
+	verifier := digest.Canonical.Digester()
+	size, err := io.Copy(verifier.Hash(), file)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to digest the file")
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	layer := ocispec.Descriptor{
+		MediaType:   ArtifactFileMediaType,
+		Digest:      verifier.Digest(),
+		Size:        size,
+		Annotations: map[string]string{ocispec.AnnotationTitle: name},
+	}
+	if mode != 0 {
+		layer.Annotations[ArtifactFileModeAnnotation] = fmt.Sprintf("%o", mode.Perm())
+	}
+	config := ocispec.Descriptor{
+		MediaType: ArtifactConfigMediaType,
+		Digest:    digest.FromBytes(artifactConfig),
+		Size:      int64(len(artifactConfig)),
+	}
+	manifest, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{layer},
+	})
+	if err != nil {
+		return "", err
+	}
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+
+	// The blobs are pushed before the manifest referencing them.
+	if err := pushContent(ctx, pusher, config, bytes.NewReader(artifactConfig)); err != nil {
+		return "", errors.Wrap(err, "failed to push the artifact's config")
+	}
+	if err := pushContent(ctx, pusher, layer, file); err != nil {
+		return "", errors.Wrapf(err, "failed to push the file %s", name)
+	}
+	if err := pushContent(ctx, pusher, manifestDesc, bytes.NewReader(manifest)); err != nil {
+		return "", errors.Wrap(err, "failed to push the artifact's manifest")
+	}
+	return manifestDesc.Digest, nil
+}
+
+// pushContent pushes the content described by desc, unless the registry already has it.
+func pushContent(ctx context.Context, pusher remotes.Pusher, desc ocispec.Descriptor, r io.Reader) error {
+	w, err := pusher.Push(ctx, desc)
+	if err != nil {
+		if errdefs.IsAlreadyExists(err) {
+			return nil
+		}
+		return err
+	}
+	defer w.Close()
+	return content.Copy(ctx, w, r, desc.Size, desc.Digest)
+}
+
+// pullArtifact pulls the file of the artifact ref into w and returns the digest of the artifact's manifest
+// and the file's mode, which is 0 if it wasn't recorded.
+// References which aren't artifacts uploaded by a step, e.g. images, fail rather than being written to w.
+func pullArtifact(ctx context.Context, d *remoteDigest, ref string, w io.Writer) (digest.Digest, os.FileMode, error) {
+	imgRef, imageRef, err := parseArtifactRef(ref)
+	if err != nil {
+		return "", 0, err
+	}
+	if err := d.registryAllowlist.Check(imgRef.Registry); err != nil {
+		return "", 0, err
+	}
+	release, err := d.limiter.acquire(ctx, imgRef.Registry)
+	if err != nil {
+		return "", 0, err
+	}
+	defer release()
+
+	resolver, name, desc, err := d.resolve(ctx, imgRef, imageRef)
+	if err != nil {
+		return "", 0, err
+	}
+	if desc.MediaType != ocispec.MediaTypeImageManifest {
+		return "", 0, fmt.Errorf("%s isn't an artifact, its media type is %s", ref, desc.MediaType)
+	}
+	if desc.Size > d.maxManifestSize {
+		return "", 0, fmt.Errorf("the manifest %s is %d bytes, which exceeds the maximum manifest size of %d bytes", desc.Digest, desc.Size, d.maxManifestSize)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return "", 0, errors.Wrap(err, "failed to create a fetcher")
+	}
+
+	var data bytes.Buffer
+	if err := fetchContent(ctx, fetcher, desc, &data); err != nil {
+		return "", 0, errors.Wrapf(err, "failed to fetch the manifest %s", desc.Digest)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data.Bytes(), &manifest); err != nil {
+		return "", 0, errors.Wrapf(err, "failed to decode the manifest %s", desc.Digest)
+	}
+	if manifest.Config.MediaType != ArtifactConfigMediaType || len(manifest.Layers) != 1 || manifest.Layers[0].MediaType != ArtifactFileMediaType {
+		return "", 0, fmt.Errorf("%s isn't an artifact uploaded by a step, its config media type is %s", ref, manifest.Config.MediaType)
+	}
+	mode, err := parseArtifactFileMode(manifest.Layers[0].Annotations[ArtifactFileModeAnnotation])
+	if err != nil {
+		return "", 0, errors.Wrapf(err, "%s has an invalid file mode", ref)
+	}
+	if err := fetchContent(ctx, fetcher, manifest.Layers[0], w); err != nil {
+		return "", 0, errors.Wrapf(err, "failed to fetch the file %s", manifest.Layers[0].Digest)
+	}
+	return desc.Digest, mode, nil
+}
+
+// fetchContent fetches the content described by desc into w, verifying its size and digest.
+func fetchContent(ctx context.Context, fetcher remotes.Fetcher, desc ocispec.Descriptor, w io.Writer) error {
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	verifier := desc.Digest.Verifier()
+	n, err := io.Copy(io.MultiWriter(w, verifier), io.LimitReader(rc, desc.Size+1))
+	if err != nil {
+		return err
+	}
+	if n != desc.Size {
+		return fmt.Errorf("expected %d bytes, but got %d", desc.Size, n)
+	}
+	if !verifier.Verified() {
+		return fmt.Errorf("the content doesn't match the digest %s", desc.Digest)
+	}
+	return nil
+}
+
+// parseArtifactRef parses the artifact reference and returns it along with the path it's resolved by,
+// which includes its digest, if any.
+func parseArtifactRef(ref string) (*image.Reference, string, error) {
+	imgRef, err := scan.NewImageReference(util.NormalizeImageTag(ref))
+	if err != nil {
+		return nil, "", errors.Wrapf(err, "failed to parse the artifact reference %s", ref)
+	}
+	imageRef, err := getReferencePath(imgRef)
+	if err != nil {
+		return nil, "", err
+	}
+	if imgRef.Digest != "" {
+		imageRef += "@" + imgRef.Digest
+	}
+	return imgRef, imageRef, nil
+}
+
+// artifactResolver creates a resolver which pushes to the reference's registry. It authenticates using
+// the first of the registry's credential sources, if any, or the credentials configured for the registry.
+func (d *remoteDigest) artifactResolver(ctx context.Context, ref *image.Reference) (remotes.Resolver, error) {
+	var credentials func(string) (string, string, error)
+	if registry, ok := d.matchCredentialSources(ref.Registry); ok && len(d.credentialSources[registry]) > 0 {
+		source := d.credentialSources[registry][0]
+		username, password, err := source.Credentials(ctx)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to get credentials from %s", source.Name)
+		}
+		credentials = staticCredentials(username, password)
+	} else if cred, ok := d.registryCreds.GetCredential(ref.Registry); ok {
+		var err error
+		if credentials, err = resolvedCredentials(ref.Registry, cred); err != nil {
+			return nil, err
+		}
+	} else {
+		util.Debugf("Pushing '%s' anonymously, no credentials are configured for %s\n", ref.Reference, ref.Registry)
+	}
+	return d.newResolver(ref.Registry, credentials), nil
+}
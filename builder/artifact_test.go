@@ -0,0 +1,110 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestPushAndPullArtifact(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "pass"
+	host, stop := registry.start()
+	defer stop()
+
+	store := NewRemoteDigest(graph.RegistryLoginCredentials{
+		host: {Username: &secretmgmt.Secret{ResolvedValue: "user"}, Password: &secretmgmt.Secret{ResolvedValue: "pass"}},
+	})
+	ref := host + "/acb-artifacts/app:v1"
+	file := []byte("compiled output")
+	dgst, err := pushArtifact(context.Background(), store, ref, "app", 0755, bytes.NewReader(file))
+	if err != nil {
+		t.Fatalf("Unexpected error pushing the artifact: %v", err)
+	}
+
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(registry.manifests["acb-artifacts/app:v1"].content, &manifest); err != nil {
+		t.Fatalf("Failed to decode the pushed manifest: %v", err)
+	}
+	if manifest.Config.MediaType != ArtifactConfigMediaType || len(manifest.Layers) != 1 ||
+		manifest.Layers[0].MediaType != ArtifactFileMediaType || manifest.Layers[0].Annotations[ocispec.AnnotationTitle] != "app" ||
+		manifest.Layers[0].Annotations[ArtifactFileModeAnnotation] != "755" {
+		t.Errorf("Unexpected artifact manifest: %+v", manifest)
+	}
+
+	// Pushing the same file again is a no-op for the blobs which already exist.
+	if again, err := pushArtifact(context.Background(), store, ref, "app", 0755, bytes.NewReader(file)); err != nil || again != dgst {
+		t.Errorf("Expected pushing the artifact again to return %s, but got %s and error %v", dgst, again, err)
+	}
+
+	for _, pullRef := range []string{ref, host + "/acb-artifacts/app@" + dgst.String()} {
+		var buf bytes.Buffer
+		pulled, mode, err := pullArtifact(context.Background(), store, pullRef, &buf)
+		if err != nil {
+			t.Fatalf("Unexpected error pulling %s: %v", pullRef, err)
+		}
+		if pulled != dgst || mode != 0755 || buf.String() != string(file) {
+			t.Errorf("Expected %s to pull %q with digest %s and mode 755, but got %q with digest %s and mode %o", pullRef, file, dgst, buf.String(), pulled, mode)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, _, err := pullArtifact(context.Background(), NewRemoteDigest(nil), ref, &buf); err == nil {
+		t.Error("Expected an error pulling the artifact anonymously")
+	}
+	if _, err := pushArtifact(context.Background(), NewRemoteDigest(nil), host+"/acb-artifacts/app:v2", "app", 0755, bytes.NewReader(file)); err == nil {
+		t.Error("Expected an error pushing the artifact anonymously")
+	}
+}
+
+func TestParseArtifactFileMode(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected os.FileMode
+		err      bool
+	}{
+		{"", 0, false},
+		{"755", 0755, false},
+		{"0644", 0644, false},
+		{"4755", 0755, false},
+		{"17777", 0, true},
+		{"rwx", 0, true},
+		{"-1", 0, true},
+	}
+	for _, test := range tests {
+		mode, err := parseArtifactFileMode(test.mode)
+		if (err != nil) != test.err || mode != test.expected {
+			t.Errorf("Expected %q to parse as %o (error: %v), but got %o and %v", test.mode, test.expected, test.err, mode, err)
+		}
+	}
+}
+
+func TestPullArtifact_NotAnArtifact(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	registry.addManifest("library/image", "v1", ocispec.MediaTypeImageManifest,
+		[]byte(`{"schemaVersion":2,"config":{"mediaType":"`+ocispec.MediaTypeImageConfig+`","digest":"sha256:44136fa355b3678a1146ad16f7e8649e94fb4fc21fe77e8310c060f61caaff8a","size":2},"layers":[]}`))
+	host, stop := registry.start()
+	defer stop()
+
+	for _, ref := range []string{host + "/library/hello:v1", host + "/library/image:v1"} {
+		var buf bytes.Buffer
+		if _, _, err := pullArtifact(context.Background(), NewRemoteDigest(nil), ref, &buf); err == nil || !strings.Contains(err.Error(), "isn't an artifact") {
+			t.Errorf("Expected pulling %s to fail because it isn't an artifact, but got %v", ref, err)
+		}
+		if buf.Len() != 0 {
+			t.Errorf("Expected nothing to be written pulling %s, but got %q", ref, buf.String())
+		}
+	}
+}
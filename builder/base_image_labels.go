@@ -0,0 +1,115 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+// BaseImageLabelPrefix prefixes the labels recording the base images of the images built by a build step,
+// e.g. base.image.0=registry.hub.docker.com/library/alpine:3.18@sha256:..., see SetBaseImageLabels.
+const BaseImageLabelPrefix = "base.image."
+
+// SetBaseImageLabels sets whether the digests of the base images of each build step are resolved before
+// building, and recorded by labeling the images built. The labels are numbered from 0, starting with the
+// runtime image, i.e. the base image of the final stage, followed by the base images of the other stages in
+// the order they're declared, and each records the base image's canonical name pinned to its digest.
+// Base images without a digest, e.g. scratch, aren't labeled.
+func (b *Builder) SetBaseImageLabels(enabled bool) {
+	b.baseImageLabels = enabled
+}
+
+// labelBaseImages adds the labels recording the base images of the build step's dependencies to the step's
+// build command. Their digests are those the step's Dockerfile was pinned to, see populatePinnedBaseImages,
+// so they aren't resolved again.
+func (b *Builder) labelBaseImages(ctx context.Context, step *graph.Step, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) error {
+	if b.skipDigests {
+		log.Printf("WARNING: the images built by step ID: %s aren't labeled with their base images since digest resolution is disabled\n", step.ID)
+		return nil
+	}
+	helper, err := b.newBaseImageDigester(NewDockerStoreDigest(b.procManager, b.debug), true, registryCreds, credentials)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(digestsTimeoutInSec) * time.Second
+	digestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	labels, err := baseImageLabels(digestCtx, step.ImageDependencies, helper)
+	if err != nil {
+		return errors.Wrapf(err, "failed to label the images built by step ID: %s with their base images", step.ID)
+	}
+	var flags strings.Builder
+	for _, label := range labels {
+		util.Infof("Labeling the images built by step ID: %s with %s\n", step.ID, label)
+		flags.WriteString("--label " + label + " ")
+	}
+	step.Build = flags.String() + step.Build
+	return nil
+}
+
+// baseImageLabels returns the labels recording the distinct base images of the dependencies, pinned to the
+// digests populated by helper, see SetBaseImageLabels.
+func baseImageLabels(ctx context.Context, dependencies []*image.Dependencies, helper DigestHelper) ([]string, error) {
+	baseImages, names, err := distinctBaseImages(dependencies)
+	if err != nil {
+		return nil, err
+	}
+
+	var labels []string
+	for i, baseImage := range baseImages {
+		resolved := *baseImage
+		if err := helper.PopulateDigest(ctx, &resolved); err != nil {
+			return nil, err
+		}
+		if resolved.Digest == "" {
+			util.Debugf("Not labeling the base image %s, which has no digest\n", names[i])
+			continue
+		}
+		pinned := (&ResolvedReference{Name: names[i], Digest: resolved.Digest}).Pinned()
+		labels = append(labels, fmt.Sprintf("%s%d=%s", BaseImageLabelPrefix, len(labels), pinned))
+	}
+	return labels, nil
+}
+
+// distinctBaseImages returns the distinct base images of the dependencies, other than scratch, along with their
+// canonical names, starting with the runtime image followed by the base images of the other stages.
+func distinctBaseImages(dependencies []*image.Dependencies) ([]*image.Reference, []string, error) {
+	var baseImages []*image.Reference
+	for _, deps := range dependencies {
+		if deps.Runtime != nil {
+			baseImages = append(baseImages, deps.Runtime)
+		}
+		baseImages = append(baseImages, deps.Buildtime...)
+	}
+
+	var distinct []*image.Reference
+	var names []string
+	seen := make(map[string]bool)
+	for _, baseImage := range baseImages {
+		if IsNoBaseImage(baseImage) {
+			continue
+		}
+		name, err := CanonicalName(baseImage)
+		if err != nil {
+			return nil, nil, err
+		}
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		distinct = append(distinct, baseImage)
+		names = append(names, name)
+	}
+	return distinct, names, nil
+}
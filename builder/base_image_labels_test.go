@@ -0,0 +1,84 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/containerd/containerd/images"
+)
+
+// referenceDigest is a DigestHelper which populates references with the digests they're mapped to.
+type referenceDigest map[string]string
+
+func (d referenceDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	ref.Digest = d[ref.Reference]
+	return nil
+}
+
+func TestBaseImageLabels(t *testing.T) {
+	alpine := &image.Reference{Registry: DockerHubRegistry, Repository: "library/alpine", Tag: "3.18", Reference: "alpine:3.18"}
+	golang := &image.Reference{Registry: DockerHubRegistry, Repository: "library/golang", Tag: "1.21", Reference: "golang:1.21"}
+	scratch := &image.Reference{Registry: DockerHubRegistry, Repository: "library/scratch", Reference: "scratch"}
+	unresolved := &image.Reference{Registry: "myregistry.azurecr.io", Repository: "local", Tag: "v1", Reference: "myregistry.azurecr.io/local:v1"}
+	deps := []*image.Dependencies{
+		{Runtime: alpine, Buildtime: []*image.Reference{golang, scratch, unresolved}},
+		// The dependencies of each tag built share the same base images, which are only labeled once.
+		{Runtime: alpine, Buildtime: []*image.Reference{golang}},
+	}
+	helper := referenceDigest{"alpine:3.18": testRuntimeDigest, "golang:1.21": testBuildDigest}
+
+	labels, err := baseImageLabels(context.Background(), deps, helper)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{
+		"base.image.0=registry.hub.docker.com/library/alpine:3.18@" + testRuntimeDigest,
+		"base.image.1=registry.hub.docker.com/library/golang:1.21@" + testBuildDigest,
+	}
+	if !reflect.DeepEqual(labels, expected) {
+		t.Errorf("Expected labels %v, but got %v", expected, labels)
+	}
+	if alpine.Digest != "" || golang.Digest != "" {
+		t.Error("Expected the dependencies not to be modified")
+	}
+}
+
+func TestLabelBaseImages(t *testing.T) {
+	registry := newFakeRegistry()
+	dgst := registry.addManifest("base", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	step := &graph.Step{
+		ID:    "build",
+		Build: "-t app:v1 .",
+		ImageDependencies: []*image.Dependencies{
+			{Runtime: &image.Reference{Registry: host, Repository: "base", Tag: "v1", Reference: host + "/base:v1"}},
+		},
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetBaseImageLabels(true)
+	if err := b.labelBaseImages(context.Background(), step, nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "--label base.image.0=" + host + "/base:v1@" + dgst.String() + " -t app:v1 ."; step.Build != expected {
+		t.Errorf("Expected the build %q, but got %q", expected, step.Build)
+	}
+
+	// Without digest resolution, the images built aren't labeled.
+	step.Build = "-t app:v1 ."
+	b.SetSkipDigests(true)
+	if err := b.labelBaseImages(context.Background(), step, nil, nil); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if step.Build != "-t app:v1 ." {
+		t.Errorf("Expected the build not to be labeled, but got %q", step.Build)
+	}
+}
@@ -9,18 +9,22 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"runtime"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/Azure/acr-builder/graph"
 	"github.com/Azure/acr-builder/pkg/image"
 	"github.com/Azure/acr-builder/pkg/procmanager"
 	"github.com/Azure/acr-builder/pkg/volume"
+	"github.com/Azure/acr-builder/secretmgmt"
 	"github.com/Azure/acr-builder/util"
 	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
@@ -30,9 +34,47 @@ const (
 
 // Builder builds images.
 type Builder struct {
-	procManager  *procmanager.ProcManager
-	workspaceDir string
-	debug        bool
+	procManager         *procmanager.ProcManager
+	workspaceDir        string
+	debug               bool
+	remoteDigestOptions *RemoteDigestOptions
+	digestAllowlist     *DigestAllowlist
+	mutableTagPolicy    MutableTagPolicy
+	rewriter            *ReferenceRewriter
+	lockFileOutput      string
+	lockFile            *LockFile
+	skipDigests         bool
+	tracer              *Tracer
+	summaryFormatter    SummaryFormatter
+	summaryOutput       string
+	stepOutput          *StepOutput
+	logStreamer         *LogStreamer
+	lazySecrets         *secretmgmt.LazySecretResolver
+	provenance          *ProvenanceOptions
+	containerdAddress   string
+	containerdNamespace string
+	containerdOnce      sync.Once
+	containerdDigester  *containerdDigest
+	containerdErr       error
+	stepsMu             sync.Mutex
+	runningSteps        map[string]*runningStep
+	activeSteps         int
+	stepsTimedOut       bool
+	stepSlots           *semaphore.Weighted
+	groupsMu            sync.Mutex
+	concurrencyGroups   map[string]*semaphore.Weighted
+	keepGoing           bool
+	baseImageLabels     bool
+	signaturePolicy     *SignaturePolicy
+	blockedMu           sync.Mutex
+	blockedSteps        map[string]string
+	digestHelpers       map[string]DigestHelper
+	tarballDigest       DigestHelper
+	printCommands       bool
+	commandSecrets      []string
+	fallbackDigests     map[string]string
+	pushConcurrency     int
+	warmRegistries      []string
 }
 
 // NewBuilder creates a new Builder.
@@ -44,49 +86,231 @@ func NewBuilder(pm *procmanager.ProcManager, debug bool, workspaceDir string) *B
 	}
 }
 
-// RunTask executes a Task.
+// SetRemoteDigestOptions sets the options used to resolve digests from remote registries.
+func (b *Builder) SetRemoteDigestOptions(opts *RemoteDigestOptions) {
+	b.remoteDigestOptions = opts
+}
+
+// SetWarmRegistries sets the registries whose connections are established right before the Task's steps
+// start resolving base image digests, see WarmRegistryConnections. The connections are only reused if the
+// remote digest options have a ConnectionPool.
+func (b *Builder) SetWarmRegistries(registries []string) {
+	b.warmRegistries = registries
+}
+
+// SetDigestAllowlist sets the allowlist which all base image digests must be in.
+func (b *Builder) SetDigestAllowlist(allowlist *DigestAllowlist) {
+	b.digestAllowlist = allowlist
+}
+
+// SetMutableTagPolicy sets the policy applied to base images referenced by a mutable tag without a digest.
+func (b *Builder) SetMutableTagPolicy(policy MutableTagPolicy) {
+	b.mutableTagPolicy = policy
+}
+
+// SetReferenceRewriter sets the rewriter applied to base image references before their digests are populated.
+func (b *Builder) SetReferenceRewriter(rewriter *ReferenceRewriter) {
+	b.rewriter = rewriter
+}
+
+// SetLockFileOutput sets the path to write a lock file pinning the base images of the Task to.
+func (b *Builder) SetLockFileOutput(path string) {
+	b.lockFileOutput = path
+}
+
+// SetLockFile sets the lock file which base image digests are read from instead of resolving them.
+func (b *Builder) SetLockFile(lock *LockFile) {
+	b.lockFile = lock
+}
+
+// RegisterDigestHelper registers the DigestHelper which populates the digests of the base images of the
+// registry, instead of resolving them from a Docker registry, see NewRegistryDigest. The registry can be a
+// pattern, e.g. *.example.com. Registering a nil helper for a registry removes its helper.
+func (b *Builder) RegisterDigestHelper(registry string, helper DigestHelper) {
+	registry = strings.ToLower(registry)
+	if helper == nil {
+		delete(b.digestHelpers, registry)
+		return
+	}
+	if b.digestHelpers == nil {
+		b.digestHelpers = make(map[string]DigestHelper)
+	}
+	b.digestHelpers[registry] = helper
+}
+
+// SetSkipDigests sets whether resolving base image digests is skipped, in which case the dependencies
+// of the images built don't record digests and steps which pin their images run them unpinned.
+func (b *Builder) SetSkipDigests(skip bool) {
+	b.skipDigests = skip
+}
+
+// SetTracer sets the Tracer which records the execution of each step, its attempts and the resolution of its digests.
+func (b *Builder) SetTracer(tracer *Tracer) {
+	b.tracer = tracer
+	if tracer != nil {
+		b.procManager.SetAttemptObserver(tracer.ObserveAttempt)
+	}
+}
+
+// SetSummaryFormatter sets the formatter of the summary written once the Task's steps complete.
+func (b *Builder) SetSummaryFormatter(formatter SummaryFormatter) {
+	b.summaryFormatter = formatter
+}
+
+// SetSummaryOutput sets the path to write the summary to instead of the log.
+func (b *Builder) SetSummaryOutput(path string) {
+	b.summaryOutput = path
+}
+
+// SetStepOutput sets how the output of each step is written. A nil StepOutput writes the raw output.
+func (b *Builder) SetStepOutput(output *StepOutput) {
+	b.stepOutput = output
+}
+
+// SetLogStreamer sets the LogStreamer which the output of each step is streamed to, with the Task's secrets scrubbed.
+func (b *Builder) SetLogStreamer(streamer *LogStreamer) {
+	b.logStreamer = streamer
+}
+
+// SetContainerdImageStore sets the address and namespace of the containerd whose local image store
+// base image digests are populated from first, so base images which are already present aren't resolved
+// from their registries. An empty address doesn't use containerd.
+func (b *Builder) SetContainerdImageStore(address string, namespace string) {
+	b.containerdAddress = address
+	b.containerdNamespace = namespace
+}
+
+// SetImageTarballDigest sets the DigestHelper which populates base image digests from image tarballs, see
+// NewTarballDigest, before any other, so the base images which were saved aren't resolved over the network.
+// A nil DigestHelper doesn't use image tarballs.
+func (b *Builder) SetImageTarballDigest(helper DigestHelper) {
+	b.tarballDigest = helper
+}
+
+// SetMaxParallel sets the maximum number of steps run at once, regardless of how many the Task's
+// dependencies allow. Steps wait for a running step to complete once the limit is reached.
+// A limit of 0 or less runs every step as soon as its dependencies complete.
+func (b *Builder) SetMaxParallel(n int) {
+	if n <= 0 {
+		b.stepSlots = nil
+		return
+	}
+	b.stepSlots = semaphore.NewWeighted(int64(n))
+}
+
+// SetKeepGoing sets whether the Task keeps running after a step fails, like make -k. By default, the Task
+// fails fast, i.e. it fails as soon as a step fails, and the steps which are still running are cancelled
+// when the Task is cleaned up. When keeping going, the steps which don't depend on the failed step keep
+// running, while the steps which depend on it, directly or transitively, are skipped, and the Task fails
+// with all of its failures once no more steps can run. Steps which ignore errors or are allowed to fail
+// don't fail the Task either way, so their dependents run.
+func (b *Builder) SetKeepGoing(keepGoing bool) {
+	b.keepGoing = keepGoing
+}
+
+// SetPrintCommands sets whether steps print the commands they'd run, with the Task's secrets redacted,
+// instead of running them, in which case they're marked as skipped. Unlike a dry run of the ProcManager,
+// which runs no command at all, the rest of the Task is evaluated as usual, e.g. the dependencies of build
+// steps are scanned and base image digests are resolved, so the commands printed are the exact ones which
+// would run, including pinned images. The two can be combined to print the commands without running anything.
+func (b *Builder) SetPrintCommands(print bool) {
+	b.printCommands = print
+}
+
+// DefaultMaxParallel returns the default maximum number of steps run at once, the number of CPUs
+// but at least 2, so a step can always run alongside another it communicates with.
+func DefaultMaxParallel() int {
+	if n := runtime.NumCPU(); n > 2 {
+		return n
+	}
+	return 2
+}
+
+// acquireStepSlot blocks until the step can run without exceeding the maximum number of parallel
+// steps, and returns a function which must be called once the step completes.
+func (b *Builder) acquireStepSlot(ctx context.Context, id string) (func(), error) {
+	if b.stepSlots == nil {
+		return func() {}, nil
+	}
+	if !b.stepSlots.TryAcquire(1) {
+		util.Infof("Step ID: %s is queued until fewer steps are running\n", id)
+		if err := b.stepSlots.Acquire(ctx, 1); err != nil {
+			return nil, errors.Wrapf(err, "step ID: %s timed out waiting for other steps to complete", id)
+		}
+	}
+	return func() { b.stepSlots.Release(1) }, nil
+}
+
+// acquireConcurrencyGroup blocks until no other step of the step's concurrency group is running, and returns
+// a function which must be called once the step completes. Steps without a group don't wait.
+func (b *Builder) acquireConcurrencyGroup(ctx context.Context, step *graph.Step) (func(), error) {
+	if step.ConcurrencyGroup == "" {
+		return func() {}, nil
+	}
+	b.groupsMu.Lock()
+	if b.concurrencyGroups == nil {
+		b.concurrencyGroups = make(map[string]*semaphore.Weighted)
+	}
+	group, ok := b.concurrencyGroups[step.ConcurrencyGroup]
+	if !ok {
+		group = semaphore.NewWeighted(1)
+		b.concurrencyGroups[step.ConcurrencyGroup] = group
+	}
+	b.groupsMu.Unlock()
+
+	if !group.TryAcquire(1) {
+		util.Infof("Step ID: %s is queued until the running step of concurrency group %s completes\n", step.ID, step.ConcurrencyGroup)
+		if err := group.Acquire(ctx, 1); err != nil {
+			return nil, errors.Wrapf(err, "step ID: %s timed out waiting for concurrency group %s", step.ID, step.ConcurrencyGroup)
+		}
+	}
+	return func() { group.Release(1) }, nil
+}
+
+// RunTask executes a Task. If the Task has a total timeout, the Task fails once it's exceeded,
+// killing the steps which are running and marking them as timed out.
 func (b *Builder) RunTask(ctx context.Context, task *graph.Task) error {
+	if task.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(task.TotalTimeout)*time.Second)
+		defer cancel()
+	}
+
 	for _, network := range task.Networks {
 		if network.SkipCreation {
-			log.Printf("Skip creating network: %s\n", network.Name)
+			util.Infof("Skip creating network: %s\n", network.Name)
 			continue
 		}
-		log.Printf("Creating Docker network: %s, driver: '%s'\n", network.Name, network.Driver)
+		util.Infof("Creating Docker network: %s, driver: '%s'\n", network.Name, network.Driver)
 		if msg, err := network.Create(ctx, b.procManager); err != nil {
 			return fmt.Errorf("failed to create network: %s, err: %v, msg: %s", network.Name, err, msg)
 		}
-		log.Printf("Successfully set up Docker network: %s\n", network.Name)
+		util.Infof("Successfully set up Docker network: %s\n", network.Name)
 	}
 
-	log.Println("Setting up Docker configuration...")
-	timeout := time.Duration(configTimeoutInSec) * time.Second
-	configCtx, cancel := context.WithTimeout(ctx, timeout)
-	defer cancel()
-	if err := b.setupConfig(configCtx); err != nil {
-		return err
+	b.logStreamer.SetSecrets(taskSecrets(task))
+	if b.printCommands {
+		b.commandSecrets = taskSecrets(task)
 	}
-	log.Println("Successfully set up Docker configuration")
-	if task.UsingRegistryCreds() {
-		timeout := time.Duration(loginTimeoutInSec) * time.Second
-		for registry, cred := range task.RegistryLoginCredentials {
-			loginCtx, cancel := context.WithTimeout(ctx, timeout)
-			defer cancel()
-			log.Printf("Logging in to registry: %s\n", registry)
-			if err := b.dockerLoginWithRetries(loginCtx, registry, cred.Username.ResolvedValue, cred.Password.ResolvedValue, 0); err != nil {
-				return err
-			}
-			log.Printf("Successfully logged into %s\n", registry)
-		}
+	b.fallbackDigests = task.FallbackDigests
+
+	if b.skipDigests {
+		log.Printf("WARNING: digest resolution is disabled, so the dependencies of the images built won't record their base images' digests\n")
+	}
+
+	if err := b.setupDockerConfig(ctx, task); err != nil {
+		return err
 	}
 
 	var completedChans []chan bool
 	errorChan := make(chan error)
+	// The steps which run on failure aren't part of the graph, see runOnFailureSteps.
 	for _, node := range task.Dag.Nodes {
 		completedChans = append(completedChans, node.Value.CompletedChan)
 	}
 
 	if task.InitBuildkitContainer {
-		log.Println("Task will use build cache, initializing buildkitd container")
+		util.Infof("Task will use build cache, initializing buildkitd container\n")
 		// --workdir = /workspace
 		args := b.getDockerRunArgs(
 			make(map[string]string),
@@ -104,6 +328,7 @@ func (b *Builder) RunTask(ctx context.Context, task *graph.Task) error {
 			"",
 			"",
 			"",
+			"",
 			buildkitdContainerName,
 			buildxImg+" create --use",
 		)
@@ -124,6 +349,7 @@ func (b *Builder) RunTask(ctx context.Context, task *graph.Task) error {
 			"",
 			buildkitdContainerInitRetries,
 			nil,
+			nil,
 			buildkitdContainerInitRetryDelay,
 			buildkitdContainerName,
 			buildkitdContainerInitRepeat,
@@ -140,45 +366,67 @@ func (b *Builder) RunTask(ctx context.Context, task *graph.Task) error {
 		}
 	}
 
+	b.warmRegistryConnections(ctx)
+
 	for _, child := range task.Dag.Root.Children() {
 		go b.processVertex(ctx, task, task.Dag.Root, child, errorChan)
 	}
 
 	// Block until either:
 	// - The global context expires
-	// - A step has an error
+	// - A step has an error, unless the Task keeps going or the step was cancelled
 	// - All steps have been processed
+	var failures []error
 	for _, ch := range completedChans {
-		select {
-		case <-ctx.Done():
-			return ctx.Err()
-		case <-ch:
-			continue
-		case err := <-errorChan:
-			return err
+		for completed := false; !completed; {
+			select {
+			case <-ctx.Done():
+				if totalTimeoutExceeded(ctx, task) {
+					return b.timeOutTask(task, time.Duration(timedOutStepsGracePeriodInSec)*time.Second, time.Duration(onFailureStepsGracePeriodInSec)*time.Second)
+				}
+				return ctx.Err()
+			case <-ch:
+				completed = true
+			case err := <-errorChan:
+				if !b.keepGoing && !isStepCancelled(err) {
+					b.runOnFailureSteps(ctx, task)
+					b.writeSummary(task)
+					return err
+				}
+				failures = append(failures, err)
+			}
 		}
 	}
 
+	if len(failures) > 0 {
+		b.runOnFailureSteps(ctx, task)
+	}
+	b.writeSummary(task)
+	if len(failures) > 0 {
+		return joinStepFailures(failures)
+	}
+
 	var deps []*image.Dependencies
 	for _, step := range task.Steps {
-		log.Printf("Step ID: %v marked as %v (elapsed time in seconds: %f)\n", step.ID, step.StepStatus, step.EndTime.Sub(step.StartTime).Seconds())
-
 		if len(step.ImageDependencies) > 0 {
-			log.Printf("Populating digests for step ID: %s...\n", step.ID)
+			util.Infof("Populating digests for step ID: %s...\n", step.ID)
 			timeout := time.Duration(digestsTimeoutInSec) * time.Second
 			digestCtx, cancel := context.WithTimeout(ctx, timeout)
 			defer cancel()
 
 			usingBuildkit := false
 			if (step.UseBuildCacheForBuildStep() && runtime.GOOS == util.LinuxOS) || step.UsesBuildkit {
-				log.Printf("Image was built using buildkit, fetching Digest from remote...")
+				util.Infof("Image was built using buildkit, fetching Digest from remote...")
 				usingBuildkit = true
 			}
 
-			if err := b.getPopulateDigests(digestCtx, step.ImageDependencies, usingBuildkit, task.RegistryLoginCredentials); err != nil {
+			digestStart := time.Now()
+			err := b.getPopulateDigests(digestCtx, step.ID, step.ImageDependencies, usingBuildkit, task.RegistryLoginCredentials, task.Credentials)
+			b.tracer.Span(step.ID, "populate digests", traceCategoryDigest, digestStart, nil)
+			if err != nil {
 				return err
 			}
-			log.Printf("Successfully populated digests for step ID: %s\n", step.ID)
+			util.Infof("Successfully populated digests for step ID: %s\n", step.ID)
 			deps = append(deps, step.ImageDependencies...)
 		}
 	}
@@ -192,16 +440,46 @@ func (b *Builder) RunTask(ctx context.Context, task *graph.Task) error {
 		log.Println("\n" + string(depBytes))
 	}
 
+	if b.lockFileOutput != "" {
+		if err := NewLockFile(deps).Write(b.lockFileOutput); err != nil {
+			return err
+		}
+		log.Printf("Wrote lock file to %s\n", b.lockFileOutput)
+	}
+
+	if err := b.writeProvenance(ctx, task, deps); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// warmRegistryConnections warms the connections to the warm registries, logging those which couldn't be
+// connected to. It's done as late as possible, so the connections aren't closed as idle before they're used.
+func (b *Builder) warmRegistryConnections(ctx context.Context) {
+	if len(b.warmRegistries) == 0 || b.skipDigests {
+		return
+	}
+	warmCtx, cancel := context.WithTimeout(ctx, time.Duration(warmConnsTimeoutInSec)*time.Second)
+	defer cancel()
+	for registry, err := range WarmRegistryConnections(warmCtx, b.remoteDigestOptions, b.warmRegistries) {
+		log.Printf("WARNING: failed to warm the connection to registry %s: %v\n", registry, err)
+	}
+}
+
 // CleanTask iterates through all build steps and removes
 // their corresponding containers.
 func (b *Builder) CleanTask(ctx context.Context, task *graph.Task) {
+	// Cleaning up is bounded, so a hung Docker daemon can't keep a timed out Task from exiting.
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(cleanupTimeoutInSec)*time.Second)
+	defer cancel()
 	args := []string{"docker", "rm", "-f"}
+	steps := task.OnFailureSteps()
 	for _, n := range task.Dag.Nodes {
-		step := n.Value
-		if step.StepStatus != graph.Skipped {
+		steps = append(steps, n.Value)
+	}
+	for _, step := range steps {
+		if b.stepStatus(step) != graph.Skipped {
 			killArgs := append(args, step.ID)
 			_ = b.procManager.Run(ctx, killArgs, nil, nil, nil, "")
 		}
@@ -209,7 +487,7 @@ func (b *Builder) CleanTask(ctx context.Context, task *graph.Task) {
 
 	for _, network := range task.Networks {
 		if network.SkipCreation {
-			log.Printf("Skip deleting network: %s\n", network.Name)
+			util.Infof("Skip deleting network: %s\n", network.Name)
 			continue
 		}
 		if msg, err := network.Delete(ctx, b.procManager); err != nil {
@@ -229,67 +507,231 @@ func (b *Builder) processVertex(ctx context.Context, task *graph.Task, parent *g
 
 	degree := child.GetDegree()
 	if degree == 0 {
+		// No more steps are started once the Task has timed out.
+		if totalTimeoutExceeded(ctx, task) {
+			return
+		}
 		step := child.Value
-		err := b.runStep(ctx, step, task.Credentials)
-		if err != nil && step.IgnoreErrors {
-			log.Printf("Step ID: %s encountered an error: %v, but is set to ignore errors. Continuing...\n", step.ID, err)
-			step.StepStatus = graph.Successful
-			for _, c := range child.Children() {
-				go b.processVertex(ctx, task, child, c, errorChan)
+		if failedID, blocked := b.blockingStep(step.ID); blocked {
+			util.Infof("Skipping step ID: %s, it depends on step ID: %s which failed\n", step.ID, failedID)
+			b.blockDependents(ctx, task, child, failedID, errorChan)
+			step.CompletedChan <- true
+			return
+		}
+		b.addActiveSteps(1)
+		// The step's group is acquired first, so a step waiting for its group doesn't take the slot of a step which could run.
+		releaseGroup, err := b.acquireConcurrencyGroup(ctx, step)
+		if err != nil {
+			b.updateStep(step, func() {
+				step.StepStatus = graph.Failed
+				step.FailureMessage = err.Error()
+			})
+			b.addActiveSteps(-1)
+			errorChan <- err
+			step.CompletedChan <- true
+			return
+		}
+		release, err := b.acquireStepSlot(ctx, step.ID)
+		if err != nil {
+			releaseGroup()
+			b.updateStep(step, func() {
+				step.StepStatus = graph.Failed
+				step.FailureMessage = err.Error()
+			})
+			b.addActiveSteps(-1)
+			errorChan <- err
+			step.CompletedChan <- true
+			return
+		}
+		start := time.Now()
+		stepCtx, done := b.startStep(ctx, step.ID)
+		err = b.runStep(stepCtx, step, task.RegistryLoginCredentials, task.Credentials)
+		release()
+		releaseGroup()
+		cancelled := done()
+		if cancelled && err != nil {
+			err = errors.Wrap(err, "step was cancelled")
+		}
+		b.updateStep(step, func() {
+			if err != nil && totalTimeoutExceeded(ctx, task) {
+				err = timeOutStep(step, task, err)
+			} else {
+				err = completeStep(step, err)
+			}
+		})
+		b.addActiveSteps(-1)
+		if err != nil {
+			// A cancelled step doesn't stop the rest of the Task, as if it kept going, see CancelStep.
+			if cancelled {
+				err = &stepCancelledError{err: err}
+			}
+			errorChan <- err
+			if b.keepGoing || cancelled {
+				b.blockDependents(ctx, task, child, step.ID, errorChan)
 			}
-		} else if err != nil {
-			step.StepStatus = graph.Failed
-			errorChan <- errors.Wrapf(err, "failed to run step ID: %s", step.ID)
 		} else {
-			step.StepStatus = graph.Successful
 			for _, c := range child.Children() {
 				go b.processVertex(ctx, task, child, c, errorChan)
 			}
 		}
+		b.tracer.Span(step.ID, step.ID, traceCategoryStep, start, map[string]interface{}{"status": b.stepStatus(step), "retries": step.Retries})
 		// Step must always be marked as complete.
 		step.CompletedChan <- true
 	}
 }
 
-func (b *Builder) runStep(ctx context.Context, step *graph.Step, credentials []*graph.RegistryCredential) error {
-	log.Printf("Executing step ID: %s. Timeout(sec): %d, Working directory: '%s', Network: '%s'\n", step.ID, step.Timeout, step.WorkingDirectory, step.Network)
+// blockDependents keeps the dependents of the node from running because the step with failedID failed,
+// processing them so they're skipped once none of their dependencies are left to complete.
+func (b *Builder) blockDependents(ctx context.Context, task *graph.Task, node *graph.Node, failedID string, errorChan chan error) {
+	children := node.Children()
+	b.blockedMu.Lock()
+	if b.blockedSteps == nil {
+		b.blockedSteps = make(map[string]string)
+	}
+	for _, c := range children {
+		if _, blocked := b.blockedSteps[c.Name]; !blocked {
+			b.blockedSteps[c.Name] = failedID
+		}
+	}
+	b.blockedMu.Unlock()
+	for _, c := range children {
+		go b.processVertex(ctx, task, node, c, errorChan)
+	}
+}
+
+// blockingStep returns the ID of the failed step which keeps the step from running, if any.
+func (b *Builder) blockingStep(id string) (string, bool) {
+	b.blockedMu.Lock()
+	defer b.blockedMu.Unlock()
+	failedID, blocked := b.blockedSteps[id]
+	return failedID, blocked
+}
+
+// joinStepFailures combines the failures of the steps of a Task which kept going after a step failed.
+func joinStepFailures(failures []error) error {
+	if len(failures) == 1 {
+		return failures[0]
+	}
+	msgs := make([]string, 0, len(failures))
+	for _, failure := range failures {
+		msgs = append(msgs, failure.Error())
+	}
+	return fmt.Errorf("%d steps failed:\n%s", len(failures), strings.Join(msgs, "\n"))
+}
+
+// completeStep marks the step's status after it ran with the specified error, and returns
+// the error which fails the task, or nil if the step's dependents can run.
+func completeStep(step *graph.Step, err error) error {
+	switch {
+	case err == nil && step.StepStatus == graph.Skipped:
+		// The step printed its commands instead of running them, see SetPrintCommands.
+	case err == nil:
+		step.StepStatus = graph.Successful
+	case step.IgnoreErrors:
+		log.Printf("Step ID: %s encountered an error: %v, but is set to ignore errors. Continuing...\n", step.ID, err)
+		step.StepStatus = graph.Successful
+	case step.AllowFailure:
+		log.Printf("Step ID: %s failed: %v, but is allowed to fail. Continuing...\n", step.ID, err)
+		step.StepStatus = graph.AllowedFailure
+		step.FailureMessage = err.Error()
+	default:
+		step.StepStatus = graph.Failed
+		step.FailureMessage = err.Error()
+		return errors.Wrapf(err, "failed to run step ID: %s", step.ID)
+	}
+	return nil
+}
+
+func (b *Builder) runStep(ctx context.Context, step *graph.Step, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) error {
+	util.Infof("Executing step ID: %s. Timeout(sec): %d, Working directory: '%s', Network: '%s'\n", step.ID, step.Timeout, step.WorkingDirectory, step.Network)
 	if step.StartDelay > 0 {
-		log.Printf("Waiting %d seconds before executing step ID: %s\n", step.StartDelay, step.ID)
+		util.Infof("Waiting %d seconds before executing step ID: %s\n", step.StartDelay, step.ID)
 		time.Sleep(time.Duration(step.StartDelay) * time.Second)
 	}
 
-	if step.IsCmdStep() && step.Pull {
-		log.Printf("Step specified pull. Performing an explicit pull...\n")
-		if err := b.pullImageBeforeRun(ctx, step.Cmd, step.CmdDownloadRetries, step.CmdDownloadRetryDelayInSeconds); err != nil {
+	stdout, stderr, flush := b.stepOutput.writers(step.ID)
+	defer flush()
+	stdout, flushStdout := b.logStreamer.Writer(step.ID, LogStreamStdout, stdout)
+	defer flushStdout()
+	stderr, flushStderr := b.logStreamer.Writer(step.ID, LogStreamStderr, stderr)
+	defer flushStderr()
+
+	if err := b.resolveStepSecrets(ctx, step); err != nil {
+		return err
+	}
+	if err := b.checkStepRegistries(step); err != nil {
+		return err
+	}
+
+	pin := b.shouldPinImage(step)
+	if step.IsCmdStep() && pin {
+		if err := b.pinStepImage(ctx, step, registryCreds, credentials); err != nil {
+			return err
+		}
+	}
+
+	if step.IsCmdStep() && step.Pull && !b.printCommands {
+		util.Infof("Step specified pull. Performing an explicit pull...\n")
+		if err := b.pullImageBeforeRun(ctx, step.Cmd, step.CmdDownloadRetries, step.CmdDownloadRetryDelayInSeconds, stdout); err != nil {
 			return err
 		}
 	}
 
-	step.StepStatus = graph.InProgress
-	step.StartTime = time.Now()
-	defer func() {
+	if !b.printCommands {
+		if err := b.downloadArtifacts(ctx, step, registryCreds, credentials); err != nil {
+			return err
+		}
+	}
+
+	b.updateStep(step, func() {
+		step.StepStatus = graph.InProgress
+		step.StartTime = time.Now()
+	})
+	defer b.updateStep(step, func() {
 		step.EndTime = time.Now()
-	}()
+	})
 
-	var args []string
+	// runArgs returns the args to run the step's container, with runArgsStep being the step as it's run.
+	var runArgs func(s *graph.Step) []string
+	runArgsStep := step
 
 	if step.IsBuildStep() {
+		pin = pin || b.requiresPinnedBaseImages()
 		dockerfile, target, dockerContext := parseDockerBuildCmd(step.Build)
 		volName := b.workspaceDir
 
 		// Print out a warning message if a remote context doesn't appear to be valid, i.e. doesn't end with .git.
 		validateDockerContext(dockerContext)
 
-		log.Println("Scanning for dependencies...")
+		util.Infof("Scanning for dependencies...\n")
 		timeout := time.Duration(scrapeTimeoutInSec) * time.Second
 		scrapeCtx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
-		deps, err := b.scrapeDependencies(scrapeCtx, volName, step.WorkingDirectory, step.ID, dockerfile, dockerContext, step.Tags, step.BuildArgs, target, credentials)
+		deps, pinned, err := b.scrapeDependencies(scrapeCtx, volName, step.WorkingDirectory, step.ID, dockerfile, dockerContext, step.Tags, step.BuildArgs, target, pin, credentials)
 		if err != nil {
 			return errors.Wrap(err, "failed to scan dependencies")
 		}
-		log.Println("Successfully scanned dependencies")
+		util.Infof("Successfully scanned dependencies\n")
 		step.ImageDependencies = deps
+		if err := b.checkDependencyRegistries(step); err != nil {
+			return err
+		}
+		if pin {
+			if err := b.populatePinnedBaseImages(ctx, step, pinned); err != nil {
+				return err
+			}
+		}
+		if err := b.verifyBaseImageSignatures(ctx, step, registryCreds, credentials); err != nil {
+			return err
+		}
+		if b.baseImageLabels {
+			if err := b.labelBaseImages(ctx, step, registryCreds, credentials); err != nil {
+				return err
+			}
+		}
+		if pin {
+			step.Build = replaceDockerfile(step.Build, pinnedDockerfile(dockerfile, dockerContext))
+		}
 
 		workingDirectory := step.WorkingDirectory
 		// Modify the Run command if it's a tar or a git URL.
@@ -307,58 +749,167 @@ func (b *Builder) runStep(ctx context.Context, step *graph.Step, credentials []*
 		}
 		step.UpdateBuildStepWithDefaults()
 
+		build := getBuildArgFlags(step.FileBuildArgs) + step.Build
+		buildCmd := dockerImg + " build " + build
 		if step.UseBuildCacheForBuildStep() {
-			args = b.getDockerRunArgsForStep(volName, workingDirectory, step, "", buildxImg+" build "+step.Build)
-		} else {
-			args = b.getDockerRunArgsForStep(volName, workingDirectory, step, "", dockerImg+" build "+step.Build)
+			buildCmd = buildxImg + " build " + build
+		}
+		runArgs = func(s *graph.Step) []string {
+			return b.getDockerRunArgsForStep(volName, workingDirectory, s, "", buildCmd)
 		}
 	} else if step.IsPushStep() {
 		timeout := time.Duration(step.Timeout) * time.Second
 		pushCtx, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
-		return b.pushWithRetries(pushCtx, step.Push)
+		images, err := b.checkExistingTags(pushCtx, step, registryCreds, credentials)
+		if err != nil {
+			return err
+		}
+		if b.printCommands {
+			commands := make([][]string, 0, len(images))
+			for _, img := range images {
+				commands = append(commands, pushArgs(img))
+			}
+			b.printStepCommands(step, commands...)
+			return nil
+		}
+		if err := b.pushWithRetries(pushCtx, images, stdout, stderr); err != nil {
+			return err
+		}
+		if step.VerifyAfter {
+			return b.verifyPushedImages(pushCtx, images, registryCreds, credentials)
+		}
+		return nil
 	} else {
-		args = b.getDockerRunArgsForStep(b.workspaceDir, step.WorkingDirectory, step, step.EntryPoint, step.Cmd)
+		runStep := step
+		// The volumes holding secrets aren't created when only printing the commands, which mount placeholders instead.
+		if step.HasSecretFiles() {
+			volName := placeholderVolumeName(secretFilesVolumePrefix)
+			if !b.printCommands {
+				var err error
+				if volName, err = b.createSecretFilesVolume(ctx, step); err != nil {
+					return err
+				}
+				defer b.deleteFilesVolume(ctx, volName)
+			}
+			runStep = withSecretFiles(step, volName)
+		}
+		if len(runStep.CACertificates) > 0 {
+			volName := placeholderVolumeName(caCertificatesVolumePrefix)
+			if !b.printCommands {
+				var err error
+				if volName, err = b.createCACertificatesVolume(ctx, runStep); err != nil {
+					return err
+				}
+				defer b.deleteFilesVolume(ctx, volName)
+			}
+			runStep = withCACertificates(runStep, volName)
+		}
+		entryPoint, cmd := runStep.EntryPoint, runStep.Cmd
+		if runStep.IsScriptStep() {
+			var err error
+			if entryPoint, cmd, err = getScriptEntryPointAndCmd(runStep); err != nil {
+				return err
+			}
+		}
+		runArgs = func(s *graph.Step) []string {
+			return b.getDockerRunArgsForStep(b.workspaceDir, s.WorkingDirectory, s, entryPoint, cmd)
+		}
+		runArgsStep = runStep
 	}
+	args := runArgs(runArgsStep)
 
 	if b.debug {
 		log.Printf("Step args: %v\n", strings.Join(args, ", "))
 	}
+	if b.printCommands {
+		b.printStepCommands(step, args)
+		return nil
+	}
 
 	timeout := time.Duration(step.Timeout) * time.Second
 	stepCtx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	return b.procManager.RunRepeatWithRetries(
+	exitCodePolicy := step.ExitCodeRetryPolicy()
+	if step.RetryOnOOM {
+		exitCodePolicy.InspectRun = b.inspectOOMRun(step)
+	}
+	if step.OOMMemoryFactor != 0 {
+		// The factor is only valid with retryOnOOM, so the policy is never nil here.
+		exitCodePolicy.OOMArgs = func(oomKills int) []string {
+			memory := step.OOMRetryMemory(oomKills)
+			log.Printf("Retrying step %s with a memory limit of %s bytes\n", step.ID, memory)
+			return runArgs(withMemory(runArgsStep, memory))
+		}
+	}
+
+	if err := b.procManager.RunRepeatWithRetries(
 		stepCtx,
 		args,
 		nil,
-		os.Stdout,
-		os.Stderr,
+		stdout,
+		stderr,
 		"",
 		step.Retries,
 		step.RetryOnErrors,
+		exitCodePolicy,
 		step.RetryDelayInSeconds,
 		step.ID,
 		step.Repeat,
-		step.IgnoreErrors)
+		step.IgnoreErrors); err != nil {
+		return err
+	}
+	return b.uploadArtifacts(ctx, step, registryCreds, credentials)
+}
+
+// inspectOOMRun returns the InspectRun of the retry policy of a step retried when it runs out of memory, whose
+// container isn't removed on exit so that Docker can be asked whether it was OOM killed. The container is then
+// removed, unless the step keeps it, so it can be run again with the same name.
+func (b *Builder) inspectOOMRun(step *graph.Step) func(err error) bool {
+	return func(err error) bool {
+		// The step's context may be done, e.g. if it timed out, but its container is still inspected and removed.
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(inspectTimeoutInSec)*time.Second)
+		defer cancel()
+
+		oomKilled := false
+		if procmanager.IsOOM(err) {
+			var stdout, stderr bytes.Buffer
+			args := []string{"docker", "inspect", "--format", "{{.State.OOMKilled}}", step.ID}
+			if inspectErr := b.procManager.Run(ctx, args, nil, &stdout, &stderr, ""); inspectErr != nil {
+				log.Printf("WARNING: failed to check whether the container %s ran out of memory: %v, %s\n", step.ID, inspectErr, stderr.String())
+			} else {
+				oomKilled = strings.TrimSpace(stdout.String()) == "true"
+			}
+		}
+		if !step.Keep {
+			var buf bytes.Buffer
+			if rmErr := b.procManager.Run(ctx, []string{"docker", "rm", "--force", step.ID}, nil, &buf, &buf, ""); rmErr != nil {
+				log.Printf("WARNING: failed to remove the container %s: %v, %s\n", step.ID, rmErr, buf.String())
+			}
+		}
+		return oomKilled
+	}
 }
 
 // getPopulateDigests populates digests on dependencies
-func (b *Builder) getPopulateDigests(ctx context.Context, dependencies []*image.Dependencies, usingBuildkit bool, registryCreds graph.RegistryLoginCredentials) error {
+func (b *Builder) getPopulateDigests(ctx context.Context, stepID string, dependencies []*image.Dependencies, usingBuildkit bool, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) error {
 	dockerStoreDigester := NewDockerStoreDigest(b.procManager, b.debug)
 
-	var baseImgDigester DigestHelper
-	baseImgDigester = dockerStoreDigester
-	if usingBuildkit {
-		baseImgDigester = NewRemoteDigest(registryCreds)
+	baseImgDigester, err := b.newBaseImageDigester(dockerStoreDigester, usingBuildkit, registryCreds, credentials)
+	if err != nil {
+		return err
 	}
+	baseImgDigester = NewTraceDigest(baseImgDigester, b.tracer, stepID)
 
 	for _, entry := range dependencies {
 		// Always check 'entry.Image' in the Docker store,
 		// If it was pushed, 'docker inspect' will return a Digest, if not, it will return empty.
-		if err := dockerStoreDigester.PopulateDigest(ctx, entry.Image); err != nil {
-			return err
+		// The image wasn't built if the commands were only printed, so there's nothing to inspect.
+		if !b.printCommands {
+			if err := dockerStoreDigester.PopulateDigest(ctx, entry.Image); err != nil {
+				return err
+			}
 		}
 
 		if err := baseImgDigester.PopulateDigest(ctx, entry.Runtime); err != nil {
@@ -373,6 +924,147 @@ func (b *Builder) getPopulateDigests(ctx context.Context, dependencies []*image.
 	return nil
 }
 
+// registryDigestOptions returns the options of the remoteDigests which resolve references other than base
+// images, e.g. pushed images, the images of cmd steps and artifacts, using the Task's credentials. They're
+// resolved as is, in the registry they name, so only how registries are accessed is taken from the builder's
+// options: the credentials, TLS and proxy settings, limits and policies. Options which change what's resolved,
+// like the ReferenceMutator, ProxyCaches, PreferOCIMediaTypes and the preferred platforms, only apply to base
+// images, and options added later aren't inherited unless they're listed here.
+func (b *Builder) registryDigestOptions(credentials []*graph.RegistryCredential) *RemoteDigestOptions {
+	base := b.remoteDigestOptions
+	if base == nil {
+		base = &RemoteDigestOptions{}
+	}
+	return &RemoteDigestOptions{
+		CredentialSources:       mergeCredentialSources(base.CredentialSources, NewCredentialSources(credentials)),
+		Client:                  base.Client,
+		RequireCredentials:      base.RequireCredentials,
+		PublicRegistries:        base.PublicRegistries,
+		AnonymousFirst:          base.AnonymousFirst,
+		DisableHTTP2:            base.DisableHTTP2,
+		ProxyCredentials:        base.ProxyCredentials,
+		ClientCertificates:      base.ClientCertificates,
+		Limiter:                 base.Limiter,
+		MaxManifestSize:         base.MaxManifestSize,
+		ResolvePolicy:           base.ResolvePolicy,
+		RegistryResolvePolicies: base.RegistryResolvePolicies,
+		RegistryAllowlist:       base.RegistryAllowlist,
+		ConnectionPool:          base.ConnectionPool,
+		RateLimitObserver:       base.RateLimitObserver,
+	}
+}
+
+// BaseImageDigester returns the DigestHelper which populates the digests of base images from registries,
+// like the base images of a Task's build steps, using the Builder's lock file, rewrite rules, proxy caches and policies.
+func (b *Builder) BaseImageDigester(registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) (DigestHelper, error) {
+	return b.newBaseImageDigester(nil, true, registryCreds, credentials)
+}
+
+// newBaseImageDigester creates the DigestHelper used to populate the digests of base images.
+func (b *Builder) newBaseImageDigester(dockerStoreDigester DigestHelper, usingBuildkit bool, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) (DigestHelper, error) {
+	opts := RemoteDigestOptions{}
+	if b.remoteDigestOptions != nil {
+		opts = *b.remoteDigestOptions
+	}
+
+	if b.skipDigests {
+		return NewNoopDigest(), nil
+	}
+
+	if b.lockFile != nil {
+		// Digests come from the lock file instead of being resolved, but are still subject to the same policies.
+		lockDigester, err := NewLockDigest(b.lockFile, opts.platformPreference())
+		if err != nil {
+			return nil, err
+		}
+		return b.withBaseImagePolicies(lockDigester), nil
+	}
+
+	baseImgDigester := dockerStoreDigester
+	if usingBuildkit {
+		opts.CredentialSources = mergeCredentialSources(opts.CredentialSources, NewCredentialSources(credentials))
+		if b.tracer != nil {
+			opts.RateLimitObserver = chainRateLimitObservers(opts.RateLimitObserver, b.tracer.ObserveRateLimit)
+		}
+		remoteDigester, err := NewRemoteDigestWithOptions(registryCreds, &opts)
+		if err != nil {
+			return nil, err
+		}
+		baseImgDigester = remoteDigester
+	}
+	if b.containerdAddress != "" {
+		// The containerd digester is shared by the steps.
+		b.containerdOnce.Do(func() {
+			b.containerdDigester, b.containerdErr = NewContainerdDigest(b.procManager, b.containerdAddress, b.containerdNamespace, opts.platformPreference())
+		})
+		if b.containerdErr != nil {
+			return nil, b.containerdErr
+		}
+		baseImgDigester = NewFallbackDigest(b.containerdDigester, baseImgDigester)
+	}
+	if len(b.digestHelpers) > 0 {
+		baseImgDigester = NewRegistryDigest(b.digestHelpers, baseImgDigester)
+	}
+	if b.tarballDigest != nil {
+		baseImgDigester = NewFallbackDigest(b.tarballDigest, baseImgDigester)
+	}
+	return b.withBaseImagePolicies(baseImgDigester), nil
+}
+
+// withBaseImagePolicies wraps the DigestHelper which is the source of base image digests with the Builder's
+// mutable tag policy, digest allowlist, rewrite rules and known digests, whatever the source.
+func (b *Builder) withBaseImagePolicies(baseImgDigester DigestHelper) DigestHelper {
+	mutableTagPolicy := b.mutableTagPolicy
+	if mutableTagPolicy == "" {
+		mutableTagPolicy = MutableTagPolicyWarn
+	}
+	baseImgDigester = NewMutableTagDigest(baseImgDigester, mutableTagPolicy, nil)
+	if b.digestAllowlist != nil {
+		baseImgDigester = NewAllowlistDigest(baseImgDigester, b.digestAllowlist)
+	}
+	if b.rewriter != nil {
+		baseImgDigester = NewRewriteDigest(baseImgDigester, b.rewriter)
+	}
+	return NewKnownDigestsDigest(baseImgDigester, b.fallbackDigests)
+}
+
+// setupDockerConfig sets up the Docker configuration in the home volume and logs in to the Task's
+// registries, so the containers using the home volume can access them.
+func (b *Builder) setupDockerConfig(ctx context.Context, task *graph.Task) error {
+	util.Infof("Setting up Docker configuration...\n")
+	timeout := time.Duration(configTimeoutInSec) * time.Second
+	configCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := b.setupConfig(configCtx); err != nil {
+		return err
+	}
+	util.Infof("Successfully set up Docker configuration\n")
+	if task.UsingRegistryCreds() {
+		timeout := time.Duration(loginTimeoutInSec) * time.Second
+		for registry, cred := range task.RegistryLoginCredentials {
+			if graph.IsRegistryPattern(registry) {
+				util.Infof("Skipping login to registry pattern: %s, it's only used to resolve digests\n", registry)
+				continue
+			}
+			if cred.BearerToken {
+				util.Infof("Skipping login to registry: %s, its bearer token is only used to resolve digests\n", registry)
+				continue
+			}
+			if err := b.registryAllowlist().Check(registry); err != nil {
+				return errors.Wrap(err, "failed to log in")
+			}
+			loginCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			util.Infof("Logging in to registry: %s\n", registry)
+			if err := b.dockerLoginWithRetries(loginCtx, registry, cred.Username.ResolvedValue, cred.Password.ResolvedValue, 0); err != nil {
+				return err
+			}
+			util.Infof("Successfully logged into %s\n", registry)
+		}
+	}
+	return nil
+}
+
 func validateDockerContext(sourceContext string) {
 	sourceContext = strings.ToLower(sourceContext)
 	if strings.Contains(sourceContext, "github") && !strings.Contains(sourceContext, ".git") {
@@ -380,8 +1072,8 @@ func validateDockerContext(sourceContext string) {
 	}
 }
 
-func (b *Builder) pullImageBeforeRun(ctx context.Context, cmdArgs string, retries, retryDelayInSeconds int) error {
-	imageName := parseImageNameFromArgs(cmdArgs)
+func (b *Builder) pullImageBeforeRun(ctx context.Context, cmdArgs string, retries, retryDelayInSeconds int, out io.Writer) error {
+	imageName := util.ParseImageName(cmdArgs)
 	args := []string{
 		"docker",
 		"run",
@@ -394,16 +1086,7 @@ func (b *Builder) pullImageBeforeRun(ctx context.Context, cmdArgs string, retrie
 	if b.debug {
 		log.Printf("pull image args: %v\n", args)
 	}
-	return b.procManager.RunWithRetries(ctx, args, nil, os.Stdout, os.Stdout, "", retries, nil, retryDelayInSeconds, "")
-}
-
-// parseImageNameFromArgs parses an image's name from a command step's arguments.
-func parseImageNameFromArgs(cmdArgs string) string {
-	idx := strings.Index(cmdArgs, " ")
-	if idx < 0 {
-		return cmdArgs
-	}
-	return cmdArgs[:idx]
+	return b.procManager.RunWithRetries(ctx, args, nil, out, out, "", retries, nil, nil, retryDelayInSeconds, "")
 }
 
 // prepareVolumeSource creates and populates the host file and volume for the specified source type
@@ -416,7 +1099,7 @@ func (b *Builder) prepareVolumeSource(ctx context.Context, volMount *volume.Volu
 		if err := b.populateSecretVolume(ctx, volMount); err != nil {
 			return err
 		}
-		log.Println("Volume source " + volMount.Name + " successfully created")
+		util.Infof("Volume source %s successfully created\n", volMount.Name)
 		return nil
 	default:
 		return errors.New("volume source type not supported yet")
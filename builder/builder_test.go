@@ -5,9 +5,13 @@ package builder
 
 import (
 	"context"
+	"errors"
 	"runtime"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/Azure/acr-builder/graph"
 	"github.com/Azure/acr-builder/pkg/image"
 	"github.com/Azure/acr-builder/pkg/procmanager"
 	"github.com/Azure/acr-builder/pkg/volume"
@@ -71,24 +75,6 @@ func TestGetRepoDigest(t *testing.T) {
 	}
 }
 
-func TestParseImageNameFromArgs(t *testing.T) {
-	tests := []struct {
-		args     string
-		expected string
-	}{
-		{"bash", "bash"},
-		{"", ""},
-		{"bash echo hello world", "bash"},
-		{"foo bar > qux &", "foo"},
-		{"foo    ", "foo"},
-	}
-	for _, test := range tests {
-		if actual := parseImageNameFromArgs(test.args); actual != test.expected {
-			t.Errorf("Expected %s but got %s", test.expected, actual)
-		}
-	}
-}
-
 func TestCreateFilesForVolume(t *testing.T) {
 	pm := procmanager.NewProcManager(false)
 	builder := NewBuilder(pm, false, "")
@@ -140,3 +126,256 @@ func TestCreateFilesForVolume(t *testing.T) {
 		}
 	}
 }
+
+func TestCompleteStep(t *testing.T) {
+	stepErr := errors.New("exit status 1")
+	tests := []struct {
+		step           *graph.Step
+		err            error
+		expectedStatus graph.StepStatus
+		shouldFail     bool
+	}{
+		{&graph.Step{ID: "a"}, nil, graph.Successful, false},
+		{&graph.Step{ID: "a"}, stepErr, graph.Failed, true},
+		{&graph.Step{ID: "a", IgnoreErrors: true}, stepErr, graph.Successful, false},
+		{&graph.Step{ID: "a", AllowFailure: true}, stepErr, graph.AllowedFailure, false},
+		{&graph.Step{ID: "a", AllowFailure: true}, nil, graph.Successful, false},
+		{&graph.Step{ID: "a", StepStatus: graph.Skipped}, nil, graph.Skipped, false},
+	}
+
+	for _, test := range tests {
+		err := completeStep(test.step, test.err)
+		if test.shouldFail != (err != nil) {
+			t.Errorf("Expected the step %+v to fail the task: %v, but got error: %v", test.step, test.shouldFail, err)
+		}
+		if test.step.StepStatus != test.expectedStatus {
+			t.Errorf("Expected status %s but got %s", test.expectedStatus, test.step.StepStatus)
+		}
+		if test.expectedStatus == graph.AllowedFailure && test.step.FailureMessage != stepErr.Error() {
+			t.Errorf("Expected the failure of the step allowed to fail to be recorded, but got %q", test.step.FailureMessage)
+		}
+	}
+}
+
+func TestRunTask_KeepGoing(t *testing.T) {
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `
+steps:
+  - id: fails
+    cmd: blocked.azurecr.io/app
+  - id: dependent
+    cmd: allowed.azurecr.io/app
+    when: ["fails"]
+  - id: transitive
+    cmd: allowed.azurecr.io/app
+    when: ["dependent"]
+  - id: independent
+    cmd: allowed.azurecr.io/app
+    when: ["-"]
+  - id: after-independent
+    cmd: allowed.azurecr.io/app
+    when: ["independent"]
+  - id: allowed-failure
+    cmd: blocked.azurecr.io/app
+    allowFailure: true
+    when: ["-"]
+  - id: after-allowed-failure
+    cmd: allowed.azurecr.io/app
+    when: ["allowed-failure"]
+`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	allowlist, err := NewRegistryAllowlist([]string{"allowed.azurecr.io"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetRemoteDigestOptions(&RemoteDigestOptions{RegistryAllowlist: allowlist})
+	b.SetKeepGoing(true)
+
+	if err := b.RunTask(context.Background(), task); err == nil || !strings.Contains(err.Error(), "fails") {
+		t.Fatalf("Expected the task to fail with the failure of step ID: fails, but got %v", err)
+	}
+	expected := map[string]graph.StepStatus{
+		"fails":                 graph.Failed,
+		"dependent":             graph.Skipped,
+		"transitive":            graph.Skipped,
+		"independent":           graph.Successful,
+		"after-independent":     graph.Successful,
+		"allowed-failure":       graph.AllowedFailure,
+		"after-allowed-failure": graph.Successful,
+	}
+	for _, step := range task.Steps {
+		if step.StepStatus != expected[step.ID] {
+			t.Errorf("Expected step ID: %s to be %s, but got %s", step.ID, expected[step.ID], step.StepStatus)
+		}
+	}
+}
+
+func TestRunTask_OnFailure(t *testing.T) {
+	tests := []struct {
+		name           string
+		cmd            string
+		keepGoing      bool
+		expectedStatus graph.StepStatus
+	}{
+		{"fails", "blocked.azurecr.io/app", false, graph.Successful},
+		{"fails and keeps going", "blocked.azurecr.io/app", true, graph.Successful},
+		{"succeeds", "allowed.azurecr.io/app", false, graph.Skipped},
+	}
+	for _, test := range tests {
+		task, err := graph.UnmarshalTaskFromString(context.Background(), `
+steps:
+  - id: cleanup
+    cmd: allowed.azurecr.io/cleanup
+    onFailure: true
+  - id: build
+    cmd: `+test.cmd+`
+  - id: test
+    cmd: allowed.azurecr.io/app
+`, &graph.TaskOptions{})
+		if err != nil {
+			t.Fatalf("%s: failed to create task. Err: %v", test.name, err)
+		}
+		allowlist, err := NewRegistryAllowlist([]string{"allowed.azurecr.io"})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		b := NewBuilder(procmanager.NewProcManager(true), false, "")
+		b.SetRemoteDigestOptions(&RemoteDigestOptions{RegistryAllowlist: allowlist})
+		b.SetKeepGoing(test.keepGoing)
+
+		err = b.RunTask(context.Background(), task)
+		if (err != nil) != (test.expectedStatus == graph.Successful) {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if status := task.Steps[0].StepStatus; status != test.expectedStatus {
+			t.Errorf("%s: expected the step which runs on failure to be %s, but got %s", test.name, test.expectedStatus, status)
+		}
+	}
+}
+
+func TestAcquireStepSlot(t *testing.T) {
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetMaxParallel(2)
+
+	releaseA, err := b.acquireStepSlot(context.Background(), "a")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	releaseB, err := b.acquireStepSlot(context.Background(), "b")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.acquireStepSlot(ctx, "c"); err == nil {
+		t.Fatal("Expected step c to be queued until its context expired")
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		if releaseC, err := b.acquireStepSlot(context.Background(), "c"); err == nil {
+			releaseC()
+		}
+		close(acquired)
+	}()
+	releaseA()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected step c to run once step a completed")
+	}
+	releaseB()
+
+	b.SetMaxParallel(0)
+	for i := 0; i < 3; i++ {
+		if _, err := b.acquireStepSlot(context.Background(), "d"); err != nil {
+			t.Fatalf("Unexpected error without a limit: %v", err)
+		}
+	}
+	if DefaultMaxParallel() < 2 {
+		t.Errorf("Expected the default limit to be at least 2, got %d", DefaultMaxParallel())
+	}
+}
+
+func TestAcquireConcurrencyGroup(t *testing.T) {
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+
+	releaseA, err := b.acquireConcurrencyGroup(context.Background(), &graph.Step{ID: "a", ConcurrencyGroup: "db"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Steps of other groups, or without a group, don't wait.
+	for _, step := range []*graph.Step{{ID: "b", ConcurrencyGroup: "cache"}, {ID: "c"}, {ID: "d"}} {
+		if _, err := b.acquireConcurrencyGroup(context.Background(), step); err != nil {
+			t.Fatalf("Expected step %s not to wait, but got %v", step.ID, err)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := b.acquireConcurrencyGroup(ctx, &graph.Step{ID: "e", ConcurrencyGroup: "db"}); err == nil {
+		t.Fatal("Expected step e to be queued until its context expired")
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		if releaseE, err := b.acquireConcurrencyGroup(context.Background(), &graph.Step{ID: "e", ConcurrencyGroup: "db"}); err == nil {
+			releaseE()
+		}
+		close(acquired)
+	}()
+	releaseA()
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("Expected step e to run once step a completed")
+	}
+}
+
+func TestRunTask_ConcurrencyGroup(t *testing.T) {
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `
+steps:
+  - id: a
+    cmd: app
+    startDelay: 1
+    concurrencyGroup: db
+    when: ["-"]
+  - id: b
+    cmd: app
+    startDelay: 1
+    concurrencyGroup: db
+    when: ["-"]
+  - id: c
+    cmd: app
+    startDelay: 1
+    when: ["-"]
+`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	tracer := NewTracer()
+	b.SetTracer(tracer)
+	if err := b.RunTask(context.Background(), task); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	spans := make(map[string]traceEvent)
+	for _, event := range tracer.events {
+		if event.Category == traceCategoryStep {
+			spans[event.Name] = event
+		}
+	}
+	overlap := func(x, y traceEvent) bool {
+		return x.Time < y.Time+y.Duration && y.Time < x.Time+x.Duration
+	}
+	if overlap(spans["a"], spans["b"]) {
+		t.Errorf("Expected the steps of concurrency group db not to overlap, but got %+v and %+v", spans["a"], spans["b"])
+	}
+	if !overlap(spans["c"], spans["a"]) && !overlap(spans["c"], spans["b"]) {
+		t.Errorf("Expected step c to run alongside the steps of concurrency group db, but got %+v", spans)
+	}
+}
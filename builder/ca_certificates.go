@@ -0,0 +1,166 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/volume"
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// caCertificatesMountPath is where a step's CA certificates are mounted.
+	caCertificatesMountPath = "/run/acb/ca-certificates"
+
+	// caCertificatesVolumePrefix prefixes the names of the volumes holding CA certificates.
+	caCertificatesVolumePrefix = "acb_ca_certificates"
+
+	// caBundleName is the name of the file containing all of a step's CA certificates.
+	caBundleName = "ca-certificates.crt"
+
+	// caCertificatesEnv is the environment variable containing the path of the bundle of a step's CA certificates.
+	caCertificatesEnv = "ACB_CA_CERTIFICATES"
+
+	// caCertificateFileMode is the mode of the CA certificate files, which anyone can read, like a trust store.
+	caCertificateFileMode os.FileMode = 0444
+
+	// pemCertificateType is the type of the PEM blocks of certificates.
+	pemCertificateType = "CERTIFICATE"
+)
+
+// updateTrustStoreScript adds the CA certificates mounted at caCertificatesMountPath to the trust store of
+// Debian, Ubuntu and Alpine based images using update-ca-certificates, or of Fedora, RHEL and CentOS based
+// images using update-ca-trust, failing if neither is available.
+var updateTrustStoreScript = strings.Join([]string{
+	"if command -v update-ca-certificates >/dev/null 2>&1; then",
+	"  mkdir -p /usr/local/share/ca-certificates && cp " + caCertificatesMountPath + "/acb-ca-*.crt /usr/local/share/ca-certificates/ && update-ca-certificates >/dev/null",
+	"elif command -v update-ca-trust >/dev/null 2>&1; then",
+	"  cp " + caCertificatesMountPath + "/acb-ca-*.crt /etc/pki/ca-trust/source/anchors/ && update-ca-trust extract",
+	"else",
+	"  echo 'acb: failed to update the trust store, neither update-ca-certificates nor update-ca-trust is available' >&2; exit 1",
+	"fi",
+}, "\n") + "\n"
+
+// loadCACertificates returns the PEM encoded certificates of the step's CA certificates, in order. Each
+// is either PEM encoded, e.g. a rendered secret, or the path of a file containing PEM encoded certificates,
+// relative to the step's working directory, which is read from the workspace volume.
+func (b *Builder) loadCACertificates(ctx context.Context, step *graph.Step) ([][]byte, error) {
+	var certs [][]byte
+	for i, source := range step.CACertificates {
+		data := []byte(source)
+		name := fmt.Sprintf("CA certificate %d", i)
+		if !strings.Contains(source, "-----BEGIN") {
+			file := path.Join(normalizeWorkDir(step.WorkingDirectory), source)
+			readCtx, cancel := context.WithTimeout(ctx, time.Duration(artifactTimeoutInSec)*time.Second)
+			args := []string{"docker", "run", "--rm", "--volume", b.workspaceDir + ":" + containerWorkspaceDir, configImageName, "-c", "cat " + shellQuote(file)}
+			var stdout, stderr bytes.Buffer
+			err := b.procManager.Run(readCtx, args, nil, &stdout, &stderr, "")
+			cancel()
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to read the CA certificates %s, %s", file, stderr.String())
+			}
+			if b.procManager.DryRun {
+				// Nothing is read during a dry run, so the file can't be validated.
+				continue
+			}
+			data, name = stdout.Bytes(), file
+		}
+		parsed, err := parseCACertificates(data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid %s", name)
+		}
+		certs = append(certs, parsed...)
+	}
+	return certs, nil
+}
+
+// parseCACertificates returns each of the PEM encoded certificates in data, which must contain at least one,
+// re-encoded so that anything around them is dropped.
+func parseCACertificates(data []byte) ([][]byte, error) {
+	var certs [][]byte
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != pemCertificateType {
+			return nil, fmt.Errorf("found a PEM block of type %s, expected %s", block.Type, pemCertificateType)
+		}
+		if _, err := x509.ParseCertificate(block.Bytes); err != nil {
+			return nil, errors.Wrap(err, "failed to parse the certificate")
+		}
+		certs = append(certs, pem.EncodeToMemory(block))
+	}
+	if len(certs) == 0 {
+		return nil, errors.New("no PEM encoded certificates were found")
+	}
+	return certs, nil
+}
+
+// caCertificateFiles returns the files mounted into a step for its certificates: a file per certificate,
+// acb-ca-0.crt, acb-ca-1.crt and so on, which can be added to trust stores, and a bundle of all of them.
+func caCertificateFiles(certs [][]byte) map[string]string {
+	files := make(map[string]string, len(certs)+1)
+	var bundle strings.Builder
+	for i, cert := range certs {
+		files[fmt.Sprintf("acb-ca-%d.crt", i)] = string(cert)
+		bundle.Write(cert)
+	}
+	files[caBundleName] = bundle.String()
+	return files
+}
+
+// createCACertificatesVolume creates an in-memory tmpfs volume containing the step's CA certificates,
+// see caCertificateFiles, and returns the name of the volume.
+func (b *Builder) createCACertificatesVolume(ctx context.Context, step *graph.Step) (string, error) {
+	if runtime.GOOS == util.WindowsOS {
+		return "", errors.New("caCertificates require a tmpfs volume and are only supported on Linux")
+	}
+	certs, err := b.loadCACertificates(ctx, step)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to load the CA certificates of step ID: %s", step.ID)
+	}
+	util.Infof("Mounting %d CA certificates into step ID: %s\n", len(certs), step.ID)
+	return b.createFilesVolume(ctx, caCertificatesVolumePrefix, "CA certificate", caCertificatesMountPath, caCertificateFileMode, caCertificateFiles(certs))
+}
+
+// withCACertificates returns a copy of the step which mounts the CA certificates volume read-only and
+// exposes the path of the bundle of its certificates through ACB_CA_CERTIFICATES. If the step updates
+// its trust store, the certificates are added to it before the step's command, or script, runs.
+func withCACertificates(step *graph.Step, volName string) *graph.Step {
+	s := *step
+	s.Mounts = append(append([]*volume.Mount{}, step.Mounts...), &volume.Mount{Name: volName, MountPath: caCertificatesMountPath + ":ro"})
+	s.Envs = append(append([]string{}, step.Envs...), caCertificatesEnv+"="+path.Join(caCertificatesMountPath, caBundleName))
+	if !step.UpdateTrustStore {
+		return &s
+	}
+	if s.IsScriptStep() {
+		s.Script = updateTrustStoreScript + s.Script
+		return &s
+	}
+	// The command runs through a shell updating the trust store first, which then runs the command's
+	// arguments with the entrypoint of the step. The image's own entrypoint is replaced by the shell, which is
+	// why the step must specify one, see graph.Step.Validate. Any docker run flags before the image are kept.
+	start, end := util.ImageNameIndex(s.Cmd)
+	if start < 0 {
+		return &s
+	}
+	run := "exec " + shellQuote(s.EntryPoint) + ` "$@"`
+	s.EntryPoint = "sh"
+	s.Cmd = s.Cmd[:end] + " -c " + shellQuote(updateTrustStoreScript+run) + " acb" + s.Cmd[end:]
+	return &s
+}
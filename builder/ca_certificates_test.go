@@ -0,0 +1,148 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/Azure/acr-builder/pkg/volume"
+)
+
+func TestParseCACertificates(t *testing.T) {
+	cert, key := newTestClientCertificate(t)
+	other, _ := newTestClientCertificate(t)
+
+	tests := []struct {
+		name     string
+		data     string
+		expected int
+		errorMsg string
+	}{
+		{"single", string(cert), 1, ""},
+		{"bundle with comments", "# corporate CA\n" + string(cert) + "\n# intermediate\n" + string(other), 2, ""},
+		{"empty", "", 0, "no PEM encoded certificates were found"},
+		{"private key", string(key), 0, "found a PEM block of type EC PRIVATE KEY"},
+		{"malformed", "-----BEGIN CERTIFICATE-----\nbm90IGEgY2VydA==\n-----END CERTIFICATE-----\n", 0, "failed to parse the certificate"},
+	}
+
+	for _, test := range tests {
+		certs, err := parseCACertificates([]byte(test.data))
+		if test.errorMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+				t.Errorf("%s: expected an error containing %q, but got %v", test.name, test.errorMsg, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if len(certs) != test.expected {
+			t.Errorf("%s: expected %d certificates, but got %d", test.name, test.expected, len(certs))
+		}
+	}
+}
+
+func TestCACertificateFiles(t *testing.T) {
+	files := caCertificateFiles([][]byte{[]byte("a\n"), []byte("b\n")})
+	expected := map[string]string{
+		"acb-ca-0.crt":        "a\n",
+		"acb-ca-1.crt":        "b\n",
+		"ca-certificates.crt": "a\nb\n",
+	}
+	if !reflect.DeepEqual(files, expected) {
+		t.Errorf("Expected files %v, but got %v", expected, files)
+	}
+}
+
+func TestLoadCACertificates(t *testing.T) {
+	cert, _ := newTestClientCertificate(t)
+	b := NewBuilder(procmanager.NewProcManager(true), false, "workspace")
+
+	// Files can't be read during a dry run, so only the inline certificates are loaded.
+	step := &graph.Step{ID: "a", Cmd: "ubuntu", CACertificates: []string{"certs/ca.pem", string(cert)}}
+	certs, err := b.loadCACertificates(context.Background(), step)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(certs) != 1 || string(certs[0]) != string(cert) {
+		t.Errorf("Expected the inline certificate to be loaded, but got %q", certs)
+	}
+
+	step.CACertificates = []string{"-----BEGIN CERTIFICATE-----\n"}
+	if _, err := b.loadCACertificates(context.Background(), step); err == nil || !strings.Contains(err.Error(), "invalid CA certificate 0") {
+		t.Errorf("Expected an invalid inline certificate to fail, but got %v", err)
+	}
+}
+
+func TestWithCACertificates(t *testing.T) {
+	mounts := []*volume.Mount{{Name: "data", MountPath: "/data"}}
+	tests := []struct {
+		name       string
+		step       *graph.Step
+		entryPoint string
+		cmd        string
+		script     string
+	}{
+		{
+			"mounted only",
+			&graph.Step{ID: "a", Cmd: "ubuntu curl https://internal"},
+			"",
+			"ubuntu curl https://internal",
+			"",
+		},
+		{
+			"trust store updated",
+			&graph.Step{ID: "a", Cmd: "ubuntu https://internal", EntryPoint: "curl", UpdateTrustStore: true},
+			"sh",
+			"ubuntu -c " + shellQuote(updateTrustStoreScript+`exec 'curl' "$@"`) + " acb https://internal",
+			"",
+		},
+		{
+			"trust store updated with docker run flags",
+			&graph.Step{ID: "a", Cmd: "--user root -e FOO=bar ubuntu https://internal", EntryPoint: "curl", UpdateTrustStore: true},
+			"sh",
+			"--user root -e FOO=bar ubuntu -c " + shellQuote(updateTrustStoreScript+`exec 'curl' "$@"`) + " acb https://internal",
+			"",
+		},
+		{
+			"trust store updated by script",
+			&graph.Step{ID: "a", Cmd: "ubuntu", Script: "curl https://internal", UpdateTrustStore: true},
+			"",
+			"ubuntu",
+			updateTrustStoreScript + "curl https://internal",
+		},
+	}
+
+	for _, test := range tests {
+		test.step.Envs = []string{"FOO=bar"}
+		test.step.Mounts = mounts
+		test.step.CACertificates = []string{"certs/ca.pem"}
+		actual := withCACertificates(test.step, "acb_ca_certificates_1")
+
+		expectedEnvs := []string{"FOO=bar", "ACB_CA_CERTIFICATES=/run/acb/ca-certificates/ca-certificates.crt"}
+		if !reflect.DeepEqual(actual.Envs, expectedEnvs) {
+			t.Errorf("%s: expected envs %v but got %v", test.name, expectedEnvs, actual.Envs)
+		}
+		expectedMounts := []*volume.Mount{
+			{Name: "data", MountPath: "/data"},
+			{Name: "acb_ca_certificates_1", MountPath: "/run/acb/ca-certificates:ro"},
+		}
+		if !reflect.DeepEqual(actual.Mounts, expectedMounts) {
+			t.Errorf("%s: expected mounts %v but got %v", test.name, expectedMounts, actual.Mounts)
+		}
+		if actual.EntryPoint != test.entryPoint || actual.Cmd != test.cmd || actual.Script != test.script {
+			t.Errorf("%s: expected entrypoint %q, cmd %q and script %q, but got %q, %q and %q",
+				test.name, test.entryPoint, test.cmd, test.script, actual.EntryPoint, actual.Cmd, actual.Script)
+		}
+		// The original step must be left untouched, since it's shared with the task.
+		if len(test.step.Envs) != 1 || len(test.step.Mounts) != 1 {
+			t.Errorf("%s: expected the original step to be unchanged but got envs %v and mounts %v", test.name, test.step.Envs, test.step.Mounts)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// cancelStepTimeoutInSec limits how long removing a cancelled step's container takes.
+const cancelStepTimeoutInSec = 30
+
+// runningStep is a step which is in flight and can be cancelled.
+type runningStep struct {
+	cancel    context.CancelFunc
+	cancelled bool
+}
+
+// startStep makes the step cancellable by CancelStep until the returned function is called,
+// which reports whether the step was cancelled.
+func (b *Builder) startStep(ctx context.Context, id string) (context.Context, func() bool) {
+	stepCtx, cancel := context.WithCancel(ctx)
+	step := &runningStep{cancel: cancel}
+	b.stepsMu.Lock()
+	if b.runningSteps == nil {
+		b.runningSteps = make(map[string]*runningStep)
+	}
+	b.runningSteps[id] = step
+	b.stepsMu.Unlock()
+
+	return stepCtx, func() bool {
+		b.stepsMu.Lock()
+		defer b.stepsMu.Unlock()
+		delete(b.runningSteps, id)
+		cancel()
+		return step.cancelled
+	}
+}
+
+// CancelStep cancels the in-flight step, killing its process group and removing its container.
+// The step is marked as failed, so the steps which depend on it only run if it ignores errors or is
+// allowed to fail, while the rest of the Task carries on even if it doesn't keep going, see SetKeepGoing.
+// The Task then fails with the step's failure, after running its steps which run on failure.
+func (b *Builder) CancelStep(id string) error {
+	b.stepsMu.Lock()
+	step, ok := b.runningSteps[id]
+	if ok {
+		step.cancelled = true
+		step.cancel()
+	}
+	b.stepsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("step ID: %s isn't running", id)
+	}
+
+	// The container may outlive the docker CLI which ran it, so it's removed as well.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cancelStepTimeoutInSec)*time.Second)
+	defer cancel()
+	if err := b.procManager.Run(ctx, []string{"docker", "rm", "-f", id}, nil, nil, nil, ""); err != nil {
+		return errors.Wrapf(err, "cancelled step ID: %s, but failed to remove its container", id)
+	}
+	return nil
+}
+
+// stepCancelledError is the failure of a step which was cancelled by CancelStep.
+type stepCancelledError struct {
+	err error
+}
+
+func (e *stepCancelledError) Error() string {
+	return e.err.Error()
+}
+
+func (e *stepCancelledError) Unwrap() error {
+	return e.err
+}
+
+// isStepCancelled returns whether err is the failure of a step which was cancelled by CancelStep.
+func isStepCancelled(err error) bool {
+	var cancelled *stepCancelledError
+	return errors.As(err, &cancelled)
+}
+
+// CancelStepsFromFile cancels each in-flight step whose ID is listed in the file at path, one per line.
+func (b *Builder) CancelStepsFromFile(path string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Printf("Failed to read the steps to cancel: %v\n", err)
+		return
+	}
+	for _, id := range strings.Split(string(data), "\n") {
+		if id = strings.TrimSpace(id); id == "" {
+			continue
+		}
+		log.Printf("Cancelling step ID: %s\n", id)
+		if err := b.CancelStep(id); err != nil {
+			log.Printf("Failed to cancel step ID: %s: %v\n", id, err)
+		}
+	}
+}
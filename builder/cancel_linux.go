@@ -0,0 +1,32 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// WatchCancelSignal cancels the steps listed in the file at path each time the process receives SIGUSR1,
+// until the returned function is called.
+func (b *Builder) WatchCancelSignal(path string) (func(), error) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR1)
+	done := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-signals:
+				b.CancelStepsFromFile(path)
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}, nil
+}
@@ -0,0 +1,148 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+)
+
+func TestCancelStep(t *testing.T) {
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	if err := b.CancelStep("test"); err == nil {
+		t.Error("Expected an error cancelling a step which isn't running")
+	}
+
+	ctx, done := b.startStep(context.Background(), "test")
+	otherCtx, otherDone := b.startStep(context.Background(), "other")
+	if err := b.CancelStep("test"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ctx.Err() != context.Canceled {
+		t.Errorf("Expected the step's context to be cancelled, but got %v", ctx.Err())
+	}
+	if otherCtx.Err() != nil {
+		t.Errorf("Expected the other step's context not to be cancelled, but got %v", otherCtx.Err())
+	}
+	if !done() {
+		t.Error("Expected the step to be reported as cancelled")
+	}
+	if otherDone() {
+		t.Error("Expected the other step not to be reported as cancelled")
+	}
+	if err := b.CancelStep("test"); err == nil {
+		t.Error("Expected an error cancelling a step which finished")
+	}
+}
+
+func TestCancelStepsFromFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cancel")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cancel.txt")
+	if err := ioutil.WriteFile(path, []byte("a\n\n  c  \nmissing\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the file: %v", err)
+	}
+
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	a, _ := b.startStep(context.Background(), "a")
+	bCtx, _ := b.startStep(context.Background(), "b")
+	c, _ := b.startStep(context.Background(), "c")
+	b.CancelStepsFromFile(path)
+	if a.Err() == nil || c.Err() == nil {
+		t.Error("Expected the listed steps to be cancelled")
+	}
+	if bCtx.Err() != nil {
+		t.Error("Expected the unlisted step not to be cancelled")
+	}
+}
+
+// fakeDocker is a docker CLI whose containers named hangs run until they're killed and whose containers
+// named independent run for a while, while every other command succeeds.
+const fakeDocker = `#!/bin/sh
+if [ "$1" = run ]; then
+	for arg in "$@"; do
+		case "$arg" in
+		hangs) sleep 60 ;;
+		independent) sleep 0.5 ;;
+		esac
+	done
+fi
+`
+
+func TestRunTask_CancelStep(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("Cancelling steps kills their process group, which is only tested on Linux")
+	}
+	dir, err := ioutil.TempDir("", "docker")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "docker"), []byte(fakeDocker), 0700); err != nil {
+		t.Fatalf("Failed to write the fake docker CLI: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `
+steps:
+  - id: cleanup
+    cmd: cleanup
+    onFailure: true
+  - id: hangs
+    cmd: app
+    when: ["-"]
+  - id: dependent
+    cmd: app
+    when: ["hangs"]
+  - id: independent
+    cmd: app
+    when: ["-"]
+  - id: after-independent
+    cmd: app
+    when: ["independent"]
+`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	pm := procmanager.NewProcManager(false)
+	pm.SetProcessGroups(true)
+	b := NewBuilder(pm, false, "")
+
+	go func() {
+		for b.CancelStep("hangs") != nil {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}()
+	// The Task doesn't keep going, but cancelling the step doesn't stop the independent steps which are
+	// still running, nor keep their dependents from running.
+	if err := b.RunTask(context.Background(), task); err == nil || !strings.Contains(err.Error(), "step was cancelled") {
+		t.Fatalf("Expected the task to fail with the cancelled step's failure, but got %v", err)
+	}
+	expected := map[string]graph.StepStatus{
+		"hangs":             graph.Failed,
+		"dependent":         graph.Skipped,
+		"independent":       graph.Successful,
+		"after-independent": graph.Successful,
+	}
+	for _, step := range task.Steps {
+		if status, ok := expected[step.ID]; ok && step.StepStatus != status {
+			t.Errorf("Expected step ID: %s to be %s, but got %s", step.ID, status, step.StepStatus)
+		}
+	}
+	if status := task.OnFailureSteps()[0].StepStatus; status != graph.Successful {
+		t.Errorf("Expected the step which runs on failure to run, but got %s", status)
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import "errors"
+
+// WatchCancelSignal isn't supported on Windows, which has no SIGUSR1.
+func (b *Builder) WatchCancelSignal(path string) (func(), error) {
+	return nil, errors.New("cancelling steps via signal isn't supported on Windows")
+}
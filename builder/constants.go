@@ -3,6 +3,8 @@
 
 package builder
 
+import "github.com/Azure/acr-builder/pkg/image"
+
 const (
 	// NoBaseImageSpecifierLatest is the empty base image
 	// Note that :latest is not valid in the FROM clause, but we're
@@ -10,11 +12,14 @@ const (
 	NoBaseImageSpecifierLatest = "scratch:latest"
 
 	// DockerHubRegistry is the docker hub registry
-	DockerHubRegistry = "registry.hub.docker.com"
+	DockerHubRegistry = image.DockerHubRegistry
 
 	// homeVol is the volume to manage $HOME
 	homeVol = "home"
 
+	// defaultDockerfile is the Dockerfile built when a build step doesn't specify one
+	defaultDockerfile = "Dockerfile"
+
 	scannerImageName   = "acb"
 	dockerCLIImageName = "docker"
 
@@ -22,6 +27,19 @@ const (
 	loginTimeoutInSec   = 60 * 5  // 5 minutes
 	digestsTimeoutInSec = 60 * 5  // 5 minutes
 	scrapeTimeoutInSec  = 60 * 15 // 15 minutes
+	cleanupTimeoutInSec = 60 * 2  // 2 minutes
+	inspectTimeoutInSec = 60      // 1 minute
+
+	// warmConnsTimeoutInSec limits how long the connections to the warm registries are established for.
+	warmConnsTimeoutInSec = 10
+
+	// timedOutStepsGracePeriodInSec limits how long the steps killed by the Task's total timeout
+	// are waited for before the Task fails.
+	timedOutStepsGracePeriodInSec = 30
+
+	// onFailureStepsGracePeriodInSec limits how long the steps which run on failure can run for
+	// after the Task exceeded its total timeout.
+	onFailureStepsGracePeriodInSec = 60
 
 	// build cache constants
 	buildkitdContainerRunTimeoutInSeconds = 60 * 2 // 2 minutes
@@ -22,7 +22,8 @@ import (
 )
 
 var (
-	dependenciesRE = regexp.MustCompile(`(\[{"image.*?\])$`)
+	dependenciesRE     = regexp.MustCompile(`(\[{"image.*?\])$`)
+	pinnedBaseImagesRE = regexp.MustCompile(regexp.QuoteMeta(PinnedBaseImagesPrefix) + `(\{.*\})$`)
 )
 
 // getDockerRunArgs populates the args for running a Docker container.
@@ -41,6 +42,7 @@ func (b *Builder) getDockerRunArgs(
 	network string,
 	isolation string,
 	cpus string,
+	memory string,
 	entrypoint string,
 	containerName string,
 	cmd string) []string {
@@ -82,6 +84,9 @@ func (b *Builder) getDockerRunArgs(
 	if cpus != "" {
 		sb.WriteString(" --cpus " + cpus)
 	}
+	if memory != "" {
+		sb.WriteString(" --memory " + memory)
+	}
 	if entrypoint != "" {
 		sb.WriteString(" --entrypoint " + entrypoint)
 	}
@@ -143,7 +148,8 @@ func (b *Builder) getDockerRunArgsForStep(
 		volName,
 		stepWorkDir,
 		step.DisableWorkingDirectoryOverride,
-		!step.Keep,
+		// The containers of steps retried when they run out of memory are removed once they've been inspected.
+		!step.Keep && !step.RetryOnOOM,
 		step.Detach,
 		step.Envs,
 		step.Ports,
@@ -153,12 +159,20 @@ func (b *Builder) getDockerRunArgsForStep(
 		step.Network,
 		step.Isolation,
 		step.CPUS,
+		step.Memory,
 		entrypoint,
 		step.ID,
 		cmd,
 	)
 }
 
+// withMemory returns a copy of the step with the memory limit.
+func withMemory(step *graph.Step, memory string) *graph.Step {
+	s := *step
+	s.Memory = memory
+	return &s
+}
+
 func (b *Builder) scrapeDependencies(
 	ctx context.Context,
 	volName string,
@@ -169,7 +183,8 @@ func (b *Builder) scrapeDependencies(
 	tags []string,
 	buildArgs []string,
 	target string,
-	credentials []*graph.RegistryCredential) ([]*image.Dependencies, error) {
+	pinBaseImages bool,
+	credentials []*graph.RegistryCredential) ([]*image.Dependencies, *LockFile, error) {
 	containerName := fmt.Sprintf("acb_dep_scanner_%s", uuid.New())
 
 	args, censoredArgs, err := getScanArgs(
@@ -182,11 +197,13 @@ func (b *Builder) scrapeDependencies(
 		tags,
 		buildArgs,
 		target,
+		pinBaseImages,
+		b.scanPinArgs(),
 		sourceContext,
 		credentials)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
 	if b.debug {
@@ -198,10 +215,69 @@ func (b *Builder) scrapeDependencies(
 	output := strings.TrimSpace(buf.String())
 	if err != nil {
 		log.Printf("Output from dependency scanning: %s\n", output)
-		return nil, err
+		return nil, nil, err
 	}
 
-	return getImageDependencies(output)
+	deps, err := getImageDependencies(output)
+	if err != nil {
+		return nil, nil, err
+	}
+	var pinned *LockFile
+	if pinBaseImages {
+		if pinned, err = getPinnedBaseImages(output); err != nil {
+			return nil, nil, err
+		}
+	}
+	return deps, pinned, nil
+}
+
+// scanPinArgs returns the flags which make the scanner pin base images to the digests the Builder would resolve
+// for them: the options which change the digests resolved or the registries which may be contacted, the rewrite
+// rules and the lock file. The Builder applies its mutable tag policy and digest allowlist to the pinned digests itself.
+func (b *Builder) scanPinArgs() []string {
+	args := []string{"--mutable-tag-policy", string(MutableTagPolicyOff)}
+	if opts := b.remoteDigestOptions; opts != nil {
+		for _, platform := range opts.PreferredPlatforms {
+			args = append(args, "--platform-preference", platform)
+		}
+		if opts.DefaultToHostPlatform {
+			args = append(args, "--prefer-host-platform")
+		}
+		if opts.PreferOCIMediaTypes {
+			args = append(args, "--prefer-oci-media-types")
+		}
+		if opts.DefaultTag != "" {
+			args = append(args, "--default-tag", opts.DefaultTag)
+		}
+		if opts.RequireCredentials {
+			args = append(args, "--require-credentials")
+		}
+		for _, registry := range opts.PublicRegistries {
+			args = append(args, "--public-registry", registry)
+		}
+		if opts.AnonymousFirst {
+			args = append(args, "--anonymous-first")
+		}
+		if opts.RegistryAllowlist != nil {
+			for _, pattern := range opts.RegistryAllowlist.patterns {
+				args = append(args, "--allowed-registry", pattern)
+			}
+		}
+		for _, cache := range opts.ProxyCaches {
+			args = append(args, "--proxy-cache", cache.String())
+		}
+	}
+	if b.rewriter != nil {
+		for _, rule := range b.rewriter.rules {
+			args = append(args, "--rewrite-rule", rule.String())
+		}
+	}
+	if b.lockFile != nil {
+		for _, entry := range b.lockFile.Images {
+			args = append(args, "--lock-entry", entry.String())
+		}
+	}
+	return args
 }
 
 func getScanArgs(
@@ -214,6 +290,8 @@ func getScanArgs(
 	tags []string,
 	buildArgs []string,
 	target string,
+	pinBaseImages bool,
+	pinArgs []string,
 	sourceContext string,
 	credentials []*graph.RegistryCredential) ([]string, []string, error) {
 	args := []string{
@@ -259,6 +337,13 @@ func getScanArgs(
 		args = append(args, "--target", target)
 	}
 
+	if pinBaseImages {
+		censoredArgs = append(censoredArgs, "--pin-base-images")
+		args = append(args, "--pin-base-images")
+		censoredArgs = append(censoredArgs, pinArgs...)
+		args = append(args, pinArgs...)
+	}
+
 	// Positional context must appear last
 	censoredArgs = append(censoredArgs, sourceContext)
 	args = append(args, sourceContext)
@@ -281,6 +366,21 @@ func getImageDependencies(s string) ([]*image.Dependencies, error) {
 	return deps, nil
 }
 
+// getPinnedBaseImages returns the digests the scanner reported pinning the Dockerfile's base images to,
+// which are empty if it didn't report any, e.g. if it didn't run.
+func getPinnedBaseImages(s string) (*LockFile, error) {
+	pinned := &LockFile{Version: lockFileVersion, Images: []*LockEntry{}}
+	for _, line := range strings.Split(s, "\n") {
+		if matches := pinnedBaseImagesRE.FindStringSubmatch(line); len(matches) == 2 {
+			if err := json.Unmarshal([]byte(matches[1]), pinned); err != nil {
+				return nil, errors.Wrap(err, "failed to parse the pinned base images")
+			}
+			break
+		}
+	}
+	return pinned, nil
+}
+
 // normalizeWorkDir normalizes a working directory.
 func normalizeWorkDir(workDir string) string {
 	// If the directory is absolute, use it instead of /workspace
@@ -4,6 +4,7 @@
 package builder
 
 import (
+	"context"
 	"reflect"
 	"runtime"
 	"strings"
@@ -11,6 +12,7 @@ import (
 
 	"github.com/Azure/acr-builder/graph"
 	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
 	"github.com/Azure/acr-builder/util"
 )
 
@@ -139,6 +141,8 @@ func TestGetScanArgs(t *testing.T) {
 		tags                  []string
 		buildArgs             []string
 		target                string
+		pinBaseImages         bool
+		pinArgs               []string
 		context               string
 		creds                 []string
 		expected              string
@@ -153,6 +157,8 @@ func TestGetScanArgs(t *testing.T) {
 			[]string{"tag1", "tag2"},
 			[]string{"arg1=a", "arg2=b"},
 			"build",
+			false,
+			[]string{"--mutable-tag-policy", "off"},
 			"someContext",
 			[]string{`{"registry":"foo.azurecr.io","username":"user","userNameProviderType":"opaque","password":"pw","passwordProviderType":"opaque"}`},
 			"docker run --rm " +
@@ -166,6 +172,30 @@ func TestGetScanArgs(t *testing.T) {
 				"--credential {\"registry\":\"foo.azurecr.io\",\"username\":\"user\",\"userNameProviderType\":\"opaque\",\"password\":\"pw\",\"passwordProviderType\":\"opaque\"} " +
 				"--target build someContext",
 		},
+		{
+			"containerName",
+			"volumeName",
+			"workspaceDir",
+			"workingDirectory",
+			"Dockerfile",
+			"OutputDirectory",
+			nil,
+			nil,
+			"",
+			true,
+			[]string{"--mutable-tag-policy", "off"},
+			"someContext",
+			[]string{`{"registry":"foo.azurecr.io","username":"user","userNameProviderType":"opaque","password":"pw","passwordProviderType":"opaque"}`},
+			"docker run --rm " +
+				"--name containerName " +
+				"--volume volumeName" + ":workspaceDir " +
+				"--workdir " + normalizeWorkDir("workingDirectory") + " " +
+				"--volume " + homeVol + ":" + homeWorkDir + " " +
+				"--env " + homeEnv + " " +
+				"acb scan -f Dockerfile --destination OutputDirectory " +
+				"--credential {\"registry\":\"foo.azurecr.io\",\"username\":\"user\",\"userNameProviderType\":\"opaque\",\"password\":\"pw\",\"passwordProviderType\":\"opaque\"} " +
+				"--pin-base-images --mutable-tag-policy off someContext",
+		},
 	}
 
 	for _, test := range tests {
@@ -179,6 +209,8 @@ func TestGetScanArgs(t *testing.T) {
 			test.tags,
 			test.buildArgs,
 			test.target,
+			test.pinBaseImages,
+			test.pinArgs,
 			test.context,
 			[]*graph.RegistryCredential{
 				{
@@ -198,3 +230,112 @@ func TestGetScanArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestScanPinArgs(t *testing.T) {
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	if actual := strings.Join(b.scanPinArgs(), " "); actual != "--mutable-tag-policy off" {
+		t.Errorf("Expected only the mutable tag policy by default, but got %s", actual)
+	}
+
+	allowlist, err := NewRegistryAllowlist([]string{"docker.io", "*.azurecr.io"})
+	if err != nil {
+		t.Fatalf("Failed to create the allowlist: %v", err)
+	}
+	rewriter, err := NewReferenceRewriter([]RewriteRule{{Type: RewriteRulePrefix, From: "docker.io/", To: "mirror.azurecr.io/"}})
+	if err != nil {
+		t.Fatalf("Failed to create the rewriter: %v", err)
+	}
+	b.SetRemoteDigestOptions(&RemoteDigestOptions{
+		PreferredPlatforms:  []string{"linux/arm64"},
+		PreferOCIMediaTypes: true,
+		DefaultTag:          "stable",
+		RegistryAllowlist:   allowlist,
+		ProxyCaches:         []*ProxyCache{{Upstream: "docker.io", Registry: "mycache.azurecr.io", Prefix: "dockerhub"}},
+	})
+	b.SetReferenceRewriter(rewriter)
+	b.SetLockFile(&LockFile{Images: []*LockEntry{{Reference: "golang:1.19", Platform: "linux/arm64", Digest: lockTestDigest1}}})
+	expected := "--mutable-tag-policy off --platform-preference linux/arm64 --prefer-oci-media-types --default-tag stable " +
+		"--allowed-registry registry.hub.docker.com --allowed-registry *.azurecr.io --proxy-cache docker.io;mycache.azurecr.io/dockerhub " +
+		"--rewrite-rule prefix;docker.io/;mirror.azurecr.io/ --lock-entry golang:1.19;linux/arm64;" + lockTestDigest1
+	if actual := strings.Join(b.scanPinArgs(), " "); actual != expected {
+		t.Errorf("Expected\n%s\nbut got\n%s", expected, actual)
+	}
+}
+
+func TestGetPinnedBaseImages(t *testing.T) {
+	output := `2026/10/14 08:00:00 Pinned the base image golang:1.19 to ` + lockTestDigest1 + `
+2026/10/14 08:00:00 ` + PinnedBaseImagesPrefix + `{"version":"v1","images":[{"reference":"golang:1.19","digest":"` + lockTestDigest1 + `","platform":"linux/amd64"}]}
+2026/10/14 08:00:00 Dependencies:`
+	pinned, err := getPinnedBaseImages(output)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(pinned.Images) != 1 || pinned.Images[0].Reference != "golang:1.19" || pinned.Images[0].Digest != lockTestDigest1 {
+		t.Errorf("Unexpected pinned base images: %+v", pinned.Images)
+	}
+
+	// No base images are pinned if the scanner didn't report any.
+	if pinned, err = getPinnedBaseImages(""); err != nil || len(pinned.Images) != 0 {
+		t.Errorf("Expected no pinned base images, but got %+v, %v", pinned, err)
+	}
+}
+
+func TestGetDockerRunArgsForStep_IsolatesEnvs(t *testing.T) {
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `
+env: ["SHARED=1"]
+steps:
+  - id: a
+    cmd: alpine echo a
+    env: ["TOKEN=s3cr3t"]
+  - id: b
+    cmd: alpine echo b
+`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	a, b := task.Steps[0], task.Steps[1]
+
+	builder := &Builder{}
+	argsA := strings.Join(builder.getDockerRunArgsForStep("volName", "stepWorkDir", a, "", "alpine echo a"), " ")
+	argsB := strings.Join(builder.getDockerRunArgsForStep("volName", "stepWorkDir", b, "", "alpine echo b"), " ")
+	if !strings.Contains(argsA, "--env TOKEN=s3cr3t") || !strings.Contains(argsA, "--env SHARED=1") {
+		t.Errorf("Expected step a to have its own and the task's environment variables, but got %s", argsA)
+	}
+	if strings.Contains(argsB, "TOKEN") {
+		t.Errorf("Expected the secret of step a to be absent from step b, but got %s", argsB)
+	}
+	if !strings.Contains(argsB, "--env SHARED=1") {
+		t.Errorf("Expected step b to inherit the task's environment variables, but got %s", argsB)
+	}
+}
+
+func TestGetDockerRunArgs_Memory(t *testing.T) {
+	builder := &Builder{}
+	step := &graph.Step{ID: "id", Cmd: "hello-world", Memory: "512m"}
+
+	args := builder.getDockerRunArgsForStep("volName", "stepWorkDir", step, "", "hello-world")
+	if !strings.Contains(args[len(args)-1], " --memory 512m ") {
+		t.Errorf("Expected the memory limit to be passed to docker run, but got %v", args)
+	}
+	args = builder.getDockerRunArgsForStep("volName", "stepWorkDir", withMemory(step, "1073741824"), "", "hello-world")
+	if !strings.Contains(args[len(args)-1], " --memory 1073741824 ") {
+		t.Errorf("Expected the bumped memory limit to be passed to docker run, but got %v", args)
+	}
+	if step.Memory != "512m" {
+		t.Errorf("Expected the step's memory limit not to change, but got %s", step.Memory)
+	}
+}
+
+func TestGetDockerRunArgs_RetryOnOOM(t *testing.T) {
+	builder := &Builder{}
+	for _, step := range []*graph.Step{
+		{ID: "id", Cmd: "hello-world"},
+		{ID: "id", Cmd: "hello-world", RetryOnOOM: true},
+	} {
+		args := builder.getDockerRunArgsForStep("volName", "stepWorkDir", step, "", "hello-world")
+		// The containers of steps retried when they run out of memory are kept to be inspected.
+		if removed := strings.Contains(args[len(args)-1], " --rm "); removed == step.RetryOnOOM {
+			t.Errorf("Expected the container to be removed on exit: %t, but got %v", !step.RetryOnOOM, args)
+		}
+	}
+}
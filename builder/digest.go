@@ -2,10 +2,33 @@ package builder
 
 import (
 	"context"
+	"strings"
 
 	"github.com/Azure/acr-builder/pkg/image"
 )
 
+// noBaseImageReferences are the references to scratch, i.e. no base image, as written in a Dockerfile,
+// after the default tag is appended, and fully qualified.
+var noBaseImageReferences = map[string]bool{
+	"scratch":                                     true,
+	NoBaseImageSpecifierLatest:                    true,
+	DockerHubRegistry + "/library/scratch":        true,
+	DockerHubRegistry + "/library/scratch:latest": true,
+}
+
 type DigestHelper interface {
 	PopulateDigest(ctx context.Context, reference *image.Reference) error
 }
+
+// IsNoBaseImage returns true if ref is scratch, i.e. no base image, whose digest isn't resolved.
+// These are the only references which bypass digest resolution: scratch and NoBaseImageSpecifierLatest,
+// as well as Docker Hub's library/scratch, untagged or tagged latest, without a digest.
+func IsNoBaseImage(ref *image.Reference) bool {
+	if ref == nil || ref.Digest != "" {
+		return false
+	}
+	if noBaseImageReferences[strings.ToLower(ref.Reference)] {
+		return true
+	}
+	return image.IsDockerHubRegistry(ref.Registry) && ref.Repository == "library/scratch" && (ref.Tag == "" || ref.Tag == DefaultTag)
+}
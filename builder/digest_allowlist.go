@@ -0,0 +1,145 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/util"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+const (
+	allowlistDownloadTimeout = 30 * time.Second
+)
+
+// DigestAllowlist is a set of approved base image digests.
+type DigestAllowlist struct {
+	digests map[string]struct{}
+}
+
+// NewDigestAllowlist creates a DigestAllowlist from the specified digests.
+// Each entry can either be a digest, i.e. sha256:abc..., or a pinned reference, i.e. foo@sha256:abc...
+func NewDigestAllowlist(entries []string) (*DigestAllowlist, error) {
+	a := &DigestAllowlist{digests: make(map[string]struct{}, len(entries))}
+	for _, entry := range entries {
+		if idx := strings.LastIndex(entry, "@"); idx >= 0 {
+			entry = entry[idx+1:]
+		}
+		dgst, err := digest.Parse(entry)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid digest in allowlist: %s", entry)
+		}
+		a.digests[dgst.String()] = struct{}{}
+	}
+	return a, nil
+}
+
+// LoadDigestAllowlist loads a DigestAllowlist from a file path or an http(s) URL.
+// The allowlist contains one entry per line, blank lines and lines starting with # are ignored.
+func LoadDigestAllowlist(ctx context.Context, source string) (*DigestAllowlist, error) {
+	var data []byte
+	var err error
+	if util.IsURL(source) {
+		data, err = downloadAllowlist(ctx, source)
+	} else {
+		data, err = ioutil.ReadFile(source)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load digest allowlist from %s", source)
+	}
+	return parseDigestAllowlist(bytes.NewReader(data))
+}
+
+// Contains determines whether or not the specified digest is allowed.
+func (a *DigestAllowlist) Contains(dgst string) bool {
+	if a == nil {
+		return true
+	}
+	_, ok := a.digests[dgst]
+	return ok
+}
+
+// Verify returns an error if the reference's digest isn't in the allowlist.
+func (a *DigestAllowlist) Verify(ref *image.Reference) error {
+	if a == nil || ref == nil || IsNoBaseImage(ref) {
+		return nil
+	}
+	if ref.Digest == "" {
+		return fmt.Errorf("base image %s could not be resolved to a digest and cannot be verified against the allowlist", ref.Reference)
+	}
+	if !a.Contains(ref.Digest) {
+		return fmt.Errorf("base image %s with digest %s is not in the allowlist", ref.Reference, ref.Digest)
+	}
+	return nil
+}
+
+func parseDigestAllowlist(r io.Reader) (*DigestAllowlist, error) {
+	var entries []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return NewDigestAllowlist(entries)
+}
+
+func downloadAllowlist(ctx context.Context, url string) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, allowlistDownloadTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// allowlistDigest is a DigestHelper which verifies the digests populated by another
+// DigestHelper against an allowlist.
+type allowlistDigest struct {
+	helper    DigestHelper
+	allowlist *DigestAllowlist
+}
+
+// NewAllowlistDigest creates a DigestHelper which fails if the digest populated by helper
+// isn't in the allowlist.
+func NewAllowlistDigest(helper DigestHelper, allowlist *DigestAllowlist) DigestHelper {
+	return &allowlistDigest{
+		helper:    helper,
+		allowlist: allowlist,
+	}
+}
+
+var _ DigestHelper = &allowlistDigest{}
+
+func (d *allowlistDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	if err := d.helper.PopulateDigest(ctx, ref); err != nil {
+		return err
+	}
+	return d.allowlist.Verify(ref)
+}
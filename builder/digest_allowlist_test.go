@@ -0,0 +1,103 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+)
+
+const (
+	allowedDigest  = "sha256:69d6b9a450c69bde2005885fb4f850ded96596b9dd1949f4313b376e7518841d"
+	rejectedDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	allowlistFile  = `# approved base images
+sha256:69d6b9a450c69bde2005885fb4f850ded96596b9dd1949f4313b376e7518841d
+
+mcr.microsoft.com/acr/acb@sha256:2222222222222222222222222222222222222222222222222222222222222222
+`
+)
+
+type staticDigest struct {
+	digest string
+}
+
+func (d *staticDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	ref.Digest = d.digest
+	return nil
+}
+
+func TestLoadDigestAllowlist(t *testing.T) {
+	dir, err := ioutil.TempDir("", "allowlist")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "allowlist.txt")
+	if err := ioutil.WriteFile(path, []byte(allowlistFile), 0600); err != nil {
+		t.Fatalf("Failed to write allowlist: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(allowlistFile))
+	}))
+	defer server.Close()
+
+	for _, source := range []string{path, server.URL} {
+		allowlist, err := LoadDigestAllowlist(context.Background(), source)
+		if err != nil {
+			t.Fatalf("Failed to load allowlist from %s: %v", source, err)
+		}
+		if !allowlist.Contains(allowedDigest) {
+			t.Errorf("Expected allowlist from %s to contain %s", source, allowedDigest)
+		}
+		if !allowlist.Contains("sha256:2222222222222222222222222222222222222222222222222222222222222222") {
+			t.Errorf("Expected allowlist from %s to contain the pinned reference's digest", source)
+		}
+		if allowlist.Contains(rejectedDigest) {
+			t.Errorf("Expected allowlist from %s to not contain %s", source, rejectedDigest)
+		}
+	}
+}
+
+func TestNewDigestAllowlist_Invalid(t *testing.T) {
+	if _, err := NewDigestAllowlist([]string{"not-a-digest"}); err == nil {
+		t.Error("Expected an error for an invalid digest, but got none")
+	}
+}
+
+func TestAllowlistDigest(t *testing.T) {
+	allowlist, err := NewDigestAllowlist([]string{allowedDigest})
+	if err != nil {
+		t.Fatalf("Failed to create allowlist: %v", err)
+	}
+
+	tests := []struct {
+		digest    string
+		reference string
+		ok        bool
+	}{
+		{allowedDigest, "foo:latest", true},
+		{rejectedDigest, "foo:latest", false},
+		{"", "foo:latest", false},
+		{"", NoBaseImageSpecifierLatest, true},
+	}
+
+	for _, test := range tests {
+		helper := NewAllowlistDigest(&staticDigest{digest: test.digest}, allowlist)
+		err := helper.PopulateDigest(context.Background(), &image.Reference{Reference: test.reference})
+		if test.ok && err != nil {
+			t.Errorf("Expected %s with digest %s to be allowed, but got %v", test.reference, test.digest, err)
+		}
+		if !test.ok && err == nil {
+			t.Errorf("Expected %s with digest %s to be rejected, but it wasn't", test.reference, test.digest)
+		}
+	}
+}
@@ -0,0 +1,350 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+)
+
+// bearerTokenUsername is the username of credentials whose password is a bearer token, which is sent
+// as is instead of being exchanged for a token. It can't be the username of a registry credential.
+const bearerTokenUsername = "<bearer>"
+
+// bearerCredentials returns credentials which authorize requests using the bearer token.
+func bearerCredentials(token string) func(string) (string, string, error) {
+	return staticCredentials(bearerTokenUsername, token)
+}
+
+// authorizerKey identifies the credentials an authorizer authenticates to a registry with.
+type authorizerKey struct {
+	registry string
+	username string
+	password string
+}
+
+// authorizerCache shares authorizers between the resolvers created for a registry during a run,
+// so the tokens fetched for each scope are reused instead of being fetched for every reference.
+// Tokens are additionally shared between registries advertising the same auth service, see tokenCache.
+type authorizerCache struct {
+	mu          sync.Mutex
+	authorizers map[authorizerKey]*scopedAuthorizer
+	tokens      *tokenCache
+}
+
+func newAuthorizerCache() *authorizerCache {
+	return &authorizerCache{
+		authorizers: make(map[authorizerKey]*scopedAuthorizer),
+		tokens:      newTokenCache(),
+	}
+}
+
+// get returns the authorizer for the registry and credentials, creating it using client if needed.
+// Tokens are fetched from the realm, service and scope of each challenge, and the registry's credentials
+// are sent to the realm even if it's on another host, e.g. a split auth service or the auth service of
+// a host the registry redirects to.
+func (c *authorizerCache) get(registry string, client *http.Client, credentials func(string) (string, string, error)) (docker.Authorizer, error) {
+	key := authorizerKey{registry: registry}
+	if credentials != nil {
+		username, password, err := credentials(registry)
+		if err != nil {
+			return nil, err
+		}
+		key.username, key.password = username, password
+		if username == bearerTokenUsername {
+			return &bearerAuthorizer{token: password}, nil
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if a, ok := c.authorizers[key]; ok {
+		return a, nil
+	}
+	authorizerOpts := []docker.AuthorizerOpt{docker.WithAuthClient(c.tokens.client(client))}
+	if credentials != nil {
+		authorizerOpts = append(authorizerOpts, docker.WithAuthCreds(staticCredentials(key.username, key.password)))
+	}
+	a := &scopedAuthorizer{
+		newAuthorizer: func() docker.Authorizer { return docker.NewDockerAuthorizer(authorizerOpts...) },
+		authorizers:   make(map[string]docker.Authorizer),
+		tokens:        c.tokens,
+	}
+	c.authorizers[key] = a
+	return a, nil
+}
+
+// scopedAuthorizer is a docker.Authorizer which authorizes the requests for each token scope, e.g. the
+// repository being resolved, separately. The docker authorizer remembers the scope of the first challenge
+// from a registry and requests it along with the scope of every later request, which registries issuing
+// tokens scoped to a single repository reject, so each scope is given its own authorizer instead.
+// The docker authorizer also keeps the tokens it fetched for the run, so when a registry rejects one,
+// e.g. because it expired, the token is evicted from the tokens and the scope's authorizer is replaced.
+type scopedAuthorizer struct {
+	mu            sync.Mutex
+	newAuthorizer func() docker.Authorizer
+	authorizers   map[string]docker.Authorizer
+	tokens        *tokenCache
+}
+
+var _ docker.Authorizer = &scopedAuthorizer{}
+
+// forScope returns the authorizer for the scopes of ctx.
+func (a *scopedAuthorizer) forScope(ctx context.Context) docker.Authorizer {
+	scope := strings.Join(docker.GetTokenScopes(ctx, nil), " ")
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	authorizer, ok := a.authorizers[scope]
+	if !ok {
+		authorizer = a.newAuthorizer()
+		a.authorizers[scope] = authorizer
+	}
+	return authorizer
+}
+
+func (a *scopedAuthorizer) Authorize(ctx context.Context, req *http.Request) error {
+	return a.forScope(ctx).Authorize(ctx, req)
+}
+
+func (a *scopedAuthorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	last := responses[len(responses)-1]
+	// A cached token is only refreshed once per request, so a registry rejecting every token fails it.
+	if a.tokens != nil && rejectedBearerTokens(responses) == 1 && a.tokens.evict(bearerToken(last.Request)) {
+		scope := strings.Join(docker.GetTokenScopes(ctx, nil), " ")
+		authorizer := a.newAuthorizer()
+		a.mu.Lock()
+		a.authorizers[scope] = authorizer
+		a.mu.Unlock()
+		// The new authorizer only sees the last challenge, since the rejection was of the evicted token.
+		return authorizer.AddResponses(ctx, responses[len(responses)-1:])
+	}
+	return a.forScope(ctx).AddResponses(ctx, responses)
+}
+
+// rejectedBearerTokens returns the number of responses which rejected the bearer token of their request.
+func rejectedBearerTokens(responses []*http.Response) int {
+	rejected := 0
+	for _, resp := range responses {
+		if resp.StatusCode == http.StatusUnauthorized && resp.Request != nil && bearerToken(resp.Request) != "" {
+			rejected++
+		}
+	}
+	return rejected
+}
+
+// bearerToken returns the bearer token req is authorized with, or an empty string if it has none.
+func bearerToken(req *http.Request) string {
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return token
+}
+
+// bearerAuthorizer is a docker.Authorizer which authorizes every request using a pre-fetched bearer token.
+// A registry rejecting the token fails the request, since there's no token exchange to retry.
+type bearerAuthorizer struct {
+	token string
+}
+
+var _ docker.Authorizer = &bearerAuthorizer{}
+
+func (a *bearerAuthorizer) Authorize(ctx context.Context, req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+func (a *bearerAuthorizer) AddResponses(ctx context.Context, responses []*http.Response) error {
+	return errdefs.ErrNotImplemented
+}
+
+// tokenCache caches the tokens issued by auth services for the run, keyed by the token request, i.e. the
+// realm, service and scopes of the challenge and the credentials presented, rather than by the registry
+// which issued the challenge. Registries sharing an auth service, e.g. the geo-replicas of a registry,
+// therefore reuse each other's tokens instead of each fetching their own. Tokens are reused until
+// tokenExpiryMargin before they expire, and evicted when a registry rejects them.
+type tokenCache struct {
+	mu     sync.Mutex
+	tokens map[string]*cachedToken
+}
+
+const (
+	// tokenExpiryMargin is how long before they expire cached tokens stop being reused, so they don't expire in flight.
+	tokenExpiryMargin = 10 * time.Second
+
+	// defaultTokenLifetime is the lifetime of tokens issued without an expires_in, as per the token specification.
+	defaultTokenLifetime = 60 * time.Second
+)
+
+// cachedToken is a successful response of an auth service.
+type cachedToken struct {
+	header  http.Header
+	body    []byte
+	token   string
+	expires time.Time
+}
+
+// tokenResponse is the part of an auth service's response which tells the token issued and when it expires.
+type tokenResponse struct {
+	Token       string    `json:"token"`
+	AccessToken string    `json:"access_token"`
+	ExpiresIn   int       `json:"expires_in"`
+	IssuedAt    time.Time `json:"issued_at"`
+}
+
+// newCachedToken returns the token of an auth service's response received at the time, or nil if the
+// response can't be parsed. Tokens expire expires_in seconds after they were issued, or after they were
+// received if that's earlier, since the auth service's clock may be ahead.
+func newCachedToken(header http.Header, body []byte, received time.Time) *cachedToken {
+	var resp tokenResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil
+	}
+	token := resp.Token
+	if token == "" {
+		token = resp.AccessToken
+	}
+	lifetime := defaultTokenLifetime
+	if resp.ExpiresIn > 0 {
+		lifetime = time.Duration(resp.ExpiresIn) * time.Second
+	}
+	issued := received
+	if !resp.IssuedAt.IsZero() && resp.IssuedAt.Before(received) {
+		issued = resp.IssuedAt
+	}
+	return &cachedToken{header: header, body: body, token: token, expires: issued.Add(lifetime)}
+}
+
+// valid returns whether the token can still be reused at the time.
+func (t *cachedToken) valid(now time.Time) bool {
+	return now.Before(t.expires.Add(-tokenExpiryMargin))
+}
+
+// evict removes the cached responses which issued the token, returning whether there were any.
+func (c *tokenCache) evict(token string) bool {
+	if token == "" {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	evicted := false
+	for key, cached := range c.tokens {
+		if cached.token == token {
+			delete(c.tokens, key)
+			evicted = true
+		}
+	}
+	return evicted
+}
+
+func newTokenCache() *tokenCache {
+	return &tokenCache{tokens: make(map[string]*cachedToken)}
+}
+
+// client returns a copy of client whose token requests are served from the cache when possible.
+func (c *tokenCache) client(client *http.Client) *http.Client {
+	transport := client.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	cachingClient := *client
+	cachingClient.Transport = &tokenCachingTransport{cache: c, next: transport}
+	return &cachingClient
+}
+
+// tokenCachingTransport serves the token requests of an authorizer from its cache, forwarding the
+// requests which miss it to next.
+type tokenCachingTransport struct {
+	cache *tokenCache
+	next  http.RoundTripper
+}
+
+func (t *tokenCachingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	key, ok, err := tokenRequestKey(req)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+	t.cache.mu.Lock()
+	token, cached := t.cache.tokens[key]
+	if cached && !token.valid(time.Now()) {
+		delete(t.cache.tokens, key)
+		cached = false
+	}
+	t.cache.mu.Unlock()
+	if cached {
+		return token.response(req), nil
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		return resp, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	header := resp.Header.Clone()
+	if token = newCachedToken(header, body, time.Now()); token == nil {
+		// Responses which can't be parsed aren't cached, the authorizer reports the error.
+		return (&cachedToken{header: header, body: body}).response(req), nil
+	}
+	t.cache.mu.Lock()
+	t.cache.tokens[key] = token
+	t.cache.mu.Unlock()
+	return token.response(req), nil
+}
+
+// response returns a new response to req with the token.
+func (t *cachedToken) response(req *http.Request) *http.Response {
+	return &http.Response{
+		Status:        "200 OK",
+		StatusCode:    http.StatusOK,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        t.header.Clone(),
+		Body:          io.NopCloser(bytes.NewReader(t.body)),
+		ContentLength: int64(len(t.body)),
+		Request:       req,
+	}
+}
+
+// tokenRequestKey returns the key of a token request: a digest of its method, URL, which includes the
+// realm along with the service and scopes of GET requests, its Authorization header and its form, which
+// includes the service, scopes and credentials of POST requests. Requests whose body can't be read
+// without consuming it have no key, so they aren't cached.
+func tokenRequestKey(req *http.Request) (string, bool, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %s\n%s\n", req.Method, req.URL.String(), req.Header.Get("Authorization"))
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return "", false, nil
+		}
+		body, err := req.GetBody()
+		if err != nil {
+			return "", false, err
+		}
+		defer body.Close()
+		if _, err := io.Copy(h, body); err != nil {
+			return "", false, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), true, nil
+}
@@ -0,0 +1,519 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/containerd/containerd/images"
+)
+
+// scopedTokenRegistry wraps a fakeRegistry with token authentication which, like some registries,
+// only grants the first scope requested, so each token is restricted to a single repository.
+type scopedTokenRegistry struct {
+	registry *fakeRegistry
+	host     string
+
+	mu          sync.Mutex
+	tokenCounts map[string]int
+}
+
+func (r *scopedTokenRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		scopes := req.URL.Query()["scope"]
+		if len(scopes) == 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.mu.Lock()
+		r.tokenCounts[scopes[0]]++
+		r.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": scopes[0]})
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	i := strings.LastIndex(path, "/manifests/")
+	if i < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	scope := fmt.Sprintf("repository:%s:pull", path[:i])
+	if req.Header.Get("Authorization") != "Bearer "+scope {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake",scope="%s"`, r.host, scope))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.registry.ServeHTTP(w, req)
+}
+
+func TestRemoteDigest_ScopedTokens(t *testing.T) {
+	registry := newFakeRegistry()
+	digests := map[string]string{
+		"app":   registry.addManifest("app", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"app":true}`)).String(),
+		"tools": registry.addManifest("tools", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"tools":true}`)).String(),
+	}
+	tokenRegistry := &scopedTokenRegistry{registry: registry, tokenCounts: make(map[string]int)}
+	server := httptest.NewServer(tokenRegistry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	tokenRegistry.host = host
+
+	d := NewRemoteDigest(nil)
+	for _, repository := range []string{"app", "tools", "app", "tools"} {
+		ref := &image.Reference{Registry: host, Repository: repository, Tag: "v1", Reference: host + "/" + repository + ":v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error resolving %s: %v", ref.Reference, err)
+		}
+		if ref.Digest != digests[repository] {
+			t.Errorf("Expected %s to resolve to %s, but got %s", ref.Reference, digests[repository], ref.Digest)
+		}
+	}
+
+	expected := map[string]int{"repository:app:pull": 1, "repository:tools:pull": 1}
+	for scope, count := range expected {
+		if tokenRegistry.tokenCounts[scope] != count {
+			t.Errorf("Expected %d token fetches for %s, but got %d", count, scope, tokenRegistry.tokenCounts[scope])
+		}
+	}
+	if len(tokenRegistry.tokenCounts) != len(expected) {
+		t.Errorf("Expected tokens to only be fetched for %v, but got %v", expected, tokenRegistry.tokenCounts)
+	}
+}
+
+// ecrPublicRegistry wraps a fakeRegistry with the token authentication of ECR Public, i.e. public.ecr.aws.
+// Its challenges request the "aws" scope from the /token/ endpoint, which issues tokens to anonymous clients
+// and to clients authenticating as the AWS user using GET, and responds with only a "token" field.
+type ecrPublicRegistry struct {
+	registry *fakeRegistry
+	host     string
+	password string
+
+	mu     sync.Mutex
+	tokens []string
+}
+
+func (r *ecrPublicRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token/" {
+		if req.Method != http.MethodGet {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		query := req.URL.Query()
+		if query.Get("service") != "public.ecr.aws" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		token := "anonymous"
+		if username, password, ok := req.BasicAuth(); ok {
+			if username != "AWS" || password != r.password {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			token = "authenticated"
+		}
+		r.mu.Lock()
+		r.tokens = append(r.tokens, token+" "+strings.Join(query["scope"], " "))
+		r.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": token})
+		return
+	}
+
+	if auth := req.Header.Get("Authorization"); auth != "Bearer anonymous" && auth != "Bearer authenticated" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token/",service="public.ecr.aws",scope="aws"`, r.host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.registry.ServeHTTP(w, req)
+}
+
+func TestRemoteDigest_ECRPublic(t *testing.T) {
+	registry := newFakeRegistry()
+	dgst := registry.addManifest("docker/library/node", "18", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	ecrPublic := &ecrPublicRegistry{registry: registry, password: "secret"}
+	server := httptest.NewServer(ecrPublic)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+	ecrPublic.host = host
+
+	credentials := func(password string) graph.RegistryLoginCredentials {
+		return graph.RegistryLoginCredentials{
+			host: {
+				Username: &secretmgmt.Secret{ResolvedValue: "AWS"},
+				Password: &secretmgmt.Secret{ResolvedValue: password},
+			},
+		}
+	}
+
+	tests := []struct {
+		name          string
+		creds         graph.CredentialProvider
+		expectedToken string
+		shouldError   bool
+	}{
+		{"anonymous", nil, "anonymous aws repository:docker/library/node:pull", false},
+		{"authenticated", credentials("secret"), "authenticated aws repository:docker/library/node:pull", false},
+		{"rejected", credentials("wrong"), "", true},
+	}
+
+	for _, test := range tests {
+		ecrPublic.tokens = nil
+		ref := &image.Reference{Registry: host, Repository: "docker/library/node", Tag: "18", Reference: host + "/docker/library/node:18"}
+		err := NewRemoteDigest(test.creds).PopulateDigest(context.Background(), ref)
+		if test.shouldError {
+			if err == nil || !isAuthFailure(err) {
+				t.Errorf("%s: expected the credentials to be rejected, but got %v", test.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if ref.Digest != dgst.String() {
+			t.Errorf("%s: expected digest %s but got %s", test.name, dgst, ref.Digest)
+		}
+		if len(ecrPublic.tokens) != 1 || ecrPublic.tokens[0] != test.expectedToken {
+			t.Errorf("%s: expected a single token request for %q, but got %v", test.name, test.expectedToken, ecrPublic.tokens)
+		}
+	}
+}
+
+// splitAuthRegistry wraps a fakeRegistry with token authentication whose challenges point at a separate
+// auth server, like registries which delegate authentication to a split auth service.
+type splitAuthRegistry struct {
+	registry *fakeRegistry
+	realm    string
+}
+
+func (r *splitAuthRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Header.Get("Authorization") != "Bearer split-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s",service="split.registry",scope="repository:library/hello:pull"`, r.realm))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.registry.ServeHTTP(w, req)
+}
+
+// splitAuthServer issues tokens to the credentials, for the challenge's service and scope only. It
+// records the service and scopes of each token request, including any parameters of the realm.
+type splitAuthServer struct {
+	username string
+	password string
+
+	mu       sync.Mutex
+	requests []string
+}
+
+func (s *splitAuthServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := req.ParseForm(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	username, password, ok := req.BasicAuth()
+	if req.Method == http.MethodPost {
+		username, password, ok = req.PostForm.Get("username"), req.PostForm.Get("password"), req.PostForm.Get("grant_type") == "password"
+	}
+	s.mu.Lock()
+	s.requests = append(s.requests, fmt.Sprintf("%s %s %s %s", req.URL.Path, req.Form.Get("account"), req.Form.Get("service"), strings.Join(req.Form["scope"], " ")))
+	s.mu.Unlock()
+	if !ok || username != s.username || password != s.password {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.Form.Get("service") != "split.registry" || strings.Join(req.Form["scope"], " ") != "repository:library/hello:pull" {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"token": "split-token", "access_token": "split-token"})
+}
+
+func TestRemoteDigest_SplitAuthService(t *testing.T) {
+	registry := newFakeRegistry()
+	dgst := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	auth := &splitAuthServer{username: "user", password: "secret"}
+	authServer := httptest.NewServer(auth)
+	defer authServer.Close()
+	splitRegistry := &splitAuthRegistry{registry: registry, realm: authServer.URL + "/oauth2/token?account=builder"}
+	server := httptest.NewServer(splitRegistry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	credentials := func(password string) graph.RegistryLoginCredentials {
+		return graph.RegistryLoginCredentials{
+			host: {
+				Username: &secretmgmt.Secret{ResolvedValue: "user"},
+				Password: &secretmgmt.Secret{ResolvedValue: password},
+			},
+		}
+	}
+
+	tests := []struct {
+		name        string
+		creds       graph.CredentialProvider
+		shouldError bool
+	}{
+		{"authenticated", credentials("secret"), false},
+		{"rejected", credentials("wrong"), true},
+		{"anonymous", nil, true},
+	}
+
+	for _, test := range tests {
+		auth.requests = nil
+		ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+		err := NewRemoteDigest(test.creds).PopulateDigest(context.Background(), ref)
+		if len(auth.requests) == 0 {
+			t.Errorf("%s: expected tokens to be requested from the auth server", test.name)
+		}
+		for _, request := range auth.requests {
+			if expected := "/oauth2/token builder split.registry repository:library/hello:pull"; request != expected {
+				t.Errorf("%s: expected the token request %q, but got %q", test.name, expected, request)
+			}
+		}
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("%s: expected an error", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if ref.Digest != dgst.String() {
+			t.Errorf("%s: expected digest %s but got %s", test.name, dgst, ref.Digest)
+		}
+	}
+}
+
+func TestRemoteDigest_RedirectedAuthRealm(t *testing.T) {
+	registry := newFakeRegistry()
+	dgst := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	auth := &splitAuthServer{username: "user", password: "secret"}
+	authServer := httptest.NewServer(auth)
+	defer authServer.Close()
+	// The registry the reference names redirects to another host, whose challenges use a different realm.
+	target := httptest.NewServer(&splitAuthRegistry{registry: registry, realm: authServer.URL + "/token"})
+	defer target.Close()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		http.Redirect(w, req, target.URL+req.URL.RequestURI(), http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	creds := graph.RegistryLoginCredentials{
+		host: {
+			Username: &secretmgmt.Secret{ResolvedValue: "user"},
+			Password: &secretmgmt.Secret{ResolvedValue: "secret"},
+		},
+	}
+	ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+	if err := NewRemoteDigest(creds).PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != dgst.String() {
+		t.Errorf("Expected digest %s but got %s", dgst, ref.Digest)
+	}
+	if len(auth.requests) != 1 || auth.requests[0] != "/token  split.registry repository:library/hello:pull" {
+		t.Errorf("Expected a single token request to the redirected realm, but got %v", auth.requests)
+	}
+}
+
+func TestRemoteDigest_SharedAuthService(t *testing.T) {
+	registry := newFakeRegistry()
+	dgst := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	auth := &splitAuthServer{username: "user", password: "secret"}
+	authServer := httptest.NewServer(auth)
+	defer authServer.Close()
+
+	// Both hosts advertise the same auth service, like the geo-replicas of a registry.
+	var hosts []string
+	for i := 0; i < 2; i++ {
+		server := httptest.NewServer(&splitAuthRegistry{registry: registry, realm: authServer.URL + "/token"})
+		defer server.Close()
+		hosts = append(hosts, strings.TrimPrefix(server.URL, "http://"))
+	}
+	credentials := func(passwords ...string) graph.RegistryLoginCredentials {
+		creds := graph.RegistryLoginCredentials{}
+		for i, host := range hosts {
+			creds[host] = &graph.ResolvedRegistryCred{
+				Username: &secretmgmt.Secret{ResolvedValue: "user"},
+				Password: &secretmgmt.Secret{ResolvedValue: passwords[i]},
+			}
+		}
+		return creds
+	}
+
+	tests := []struct {
+		name          string
+		creds         graph.CredentialProvider
+		shouldError   []bool
+		tokenRequests int
+	}{
+		{"same credentials", credentials("secret", "secret"), []bool{false, false}, 1},
+		// The token of the first host's credentials isn't reused by the second host's credentials, whose
+		// rejected token request the resolver makes again before failing.
+		{"different credentials", credentials("secret", "wrong"), []bool{false, true}, 3},
+	}
+
+	for _, test := range tests {
+		auth.requests = nil
+		d := NewRemoteDigest(test.creds)
+		for i, host := range hosts {
+			ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+			err := d.PopulateDigest(context.Background(), ref)
+			if test.shouldError[i] {
+				if err == nil {
+					t.Errorf("%s: expected an error resolving %s", test.name, ref.Reference)
+				}
+				continue
+			}
+			if err != nil {
+				t.Fatalf("%s: unexpected error resolving %s: %v", test.name, ref.Reference, err)
+			}
+			if ref.Digest != dgst.String() {
+				t.Errorf("%s: expected digest %s but got %s", test.name, dgst, ref.Digest)
+			}
+		}
+		if len(auth.requests) != test.tokenRequests {
+			t.Errorf("%s: expected %d token requests for both hosts, but got %v", test.name, test.tokenRequests, auth.requests)
+		}
+	}
+}
+
+// rotatingTokenRegistry wraps a fakeRegistry with token authentication which issues a new token to
+// each token request, with the expires_in and issued_at configured, and rejects the tokens revoked.
+type rotatingTokenRegistry struct {
+	registry  *fakeRegistry
+	host      string
+	expiresIn int
+	issuedAt  time.Time
+
+	mu      sync.Mutex
+	issued  int
+	revoked map[string]bool
+}
+
+func (r *rotatingTokenRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if req.URL.Path == "/token" {
+		r.issued++
+		resp := map[string]interface{}{"token": fmt.Sprintf("token-%d", r.issued)}
+		if r.expiresIn > 0 {
+			resp["expires_in"] = r.expiresIn
+		}
+		if !r.issuedAt.IsZero() {
+			resp["issued_at"] = r.issuedAt.Format(time.RFC3339)
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+		return
+	}
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	if !strings.HasPrefix(token, "token-") || r.revoked[token] {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="http://%s/token",service="fake",scope="repository:library/hello:pull",error="invalid_token"`, r.host))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	r.registry.ServeHTTP(w, req)
+}
+
+func TestRemoteDigest_TokenExpiry(t *testing.T) {
+	tests := []struct {
+		name          string
+		expiresIn     int
+		issuedAt      time.Time
+		tokenRequests int
+	}{
+		{"valid", 300, time.Time{}, 1},
+		{"default lifetime", 0, time.Time{}, 1},
+		// Tokens aren't reused within the margin of their expiry.
+		{"expiring", 5, time.Time{}, 2},
+		{"issued earlier", 300, time.Now().Add(-299 * time.Second), 2},
+		// The auth service's clock being ahead doesn't extend the token's lifetime.
+		{"issued later", 300, time.Now().Add(time.Hour), 1},
+	}
+	for _, test := range tests {
+		registry := newFakeRegistry()
+		dgst := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+		tokens := &rotatingTokenRegistry{registry: registry, expiresIn: test.expiresIn, issuedAt: test.issuedAt, revoked: map[string]bool{}}
+		// Both hosts share the first host's auth service.
+		var hosts []string
+		for i := 0; i < 2; i++ {
+			server := httptest.NewServer(tokens)
+			defer server.Close()
+			hosts = append(hosts, strings.TrimPrefix(server.URL, "http://"))
+		}
+		tokens.host = hosts[0]
+
+		d := NewRemoteDigest(nil)
+		for _, host := range hosts {
+			ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+			if err := d.PopulateDigest(context.Background(), ref); err != nil {
+				t.Fatalf("%s: unexpected error resolving %s: %v", test.name, ref.Reference, err)
+			}
+			if ref.Digest != dgst.String() {
+				t.Errorf("%s: expected digest %s but got %s", test.name, dgst, ref.Digest)
+			}
+		}
+		if tokens.issued != test.tokenRequests {
+			t.Errorf("%s: expected %d token requests, but got %d", test.name, test.tokenRequests, tokens.issued)
+		}
+	}
+}
+
+func TestRemoteDigest_RejectedTokenEvicted(t *testing.T) {
+	registry := newFakeRegistry()
+	dgst := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	tokens := &rotatingTokenRegistry{registry: registry, expiresIn: 300, revoked: map[string]bool{}}
+	server := httptest.NewServer(tokens)
+	defer server.Close()
+	tokens.host = strings.TrimPrefix(server.URL, "http://")
+
+	d := NewRemoteDigest(nil)
+	resolve := func() error {
+		ref := &image.Reference{Registry: tokens.host, Repository: "library/hello", Tag: "v1", Reference: tokens.host + "/library/hello:v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			return err
+		}
+		if ref.Digest != dgst.String() {
+			t.Errorf("Expected digest %s but got %s", dgst, ref.Digest)
+		}
+		return nil
+	}
+	if err := resolve(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// The registry rejecting the cached token, e.g. because it was revoked early, fetches a new one.
+	tokens.mu.Lock()
+	tokens.revoked["token-1"] = true
+	tokens.mu.Unlock()
+	if err := resolve(); err != nil {
+		t.Fatalf("Expected the rejected token to be replaced, but got %v", err)
+	}
+	if tokens.issued != 2 {
+		t.Errorf("Expected a single new token to be requested, but got %d tokens", tokens.issued)
+	}
+
+	// A registry rejecting the new token as well fails the request instead of fetching tokens again and again.
+	tokens.mu.Lock()
+	tokens.revoked["token-2"], tokens.revoked["token-3"] = true, true
+	tokens.mu.Unlock()
+	if err := resolve(); err == nil {
+		t.Error("Expected the rejected tokens to fail the request")
+	}
+	if tokens.issued != 3 {
+		t.Errorf("Expected the token to be refreshed once, but got %d tokens", tokens.issued)
+	}
+}
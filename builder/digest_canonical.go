@@ -0,0 +1,98 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/docker/distribution/reference"
+	"github.com/pkg/errors"
+)
+
+// ResolvedReference is a reference resolved to a digest, along with its canonical name.
+type ResolvedReference struct {
+	// Name is the canonical name of the reference, with its registry, repository and tag normalized,
+	// e.g. registry.hub.docker.com/library/alpine:latest for alpine, see CanonicalName.
+	Name string
+
+	// Digest is the digest the reference resolved to.
+	Digest string
+
+	// Platform is the platform, e.g. linux/amd64, whose manifest the digest was selected for, if any.
+	Platform string
+}
+
+// Pinned returns the canonical name pinned to the digest, e.g.
+// registry.hub.docker.com/library/alpine:latest@sha256:..., which keeps the tag for readability.
+func (r *ResolvedReference) Pinned() string {
+	if strings.HasSuffix(r.Name, "@"+r.Digest) {
+		return r.Name
+	}
+	return r.Name + "@" + r.Digest
+}
+
+// CanonicalName returns the canonical name of the reference, with its registry, repository and tag
+// normalized. References without a tag are given DefaultTag, unless they're pinned to a digest,
+// in which case they keep the digest and are only tagged if they're tagged.
+func CanonicalName(ref *image.Reference) (string, error) {
+	return canonicalName(ref, DefaultTag)
+}
+
+// canonicalName is like CanonicalName, giving references without a tag or digest defaultTag.
+func canonicalName(ref *image.Reference, defaultTag string) (string, error) {
+	tag := ref.Tag
+	if tag == "" && ref.Digest == "" {
+		tag = defaultTag
+	}
+	repository, err := normalizeRepository(ref.Repository)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to canonicalize the reference %s", ref.Reference)
+	}
+	canonical, err := image.NewReference(ref.Registry, repository, tag, ref.Digest)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to canonicalize the reference %s", ref.Reference)
+	}
+	return canonical.Reference, nil
+}
+
+// ResolveCanonical resolves the reference to its digest and returns it along with the reference's
+// canonical name. The canonical name is always that of the reference itself, even if it's resolved
+// through a proxy cache, and references without a tag or digest are given the configured DefaultTag
+// they're resolved with. The reference isn't modified. A reference which already specifies a digest
+// isn't resolved, and is returned with its digest. References which have no digest, e.g. scratch, fail.
+func (d *remoteDigest) ResolveCanonical(ctx context.Context, ref *image.Reference) (*ResolvedReference, error) {
+	name, err := canonicalName(ref, d.defaultTag)
+	if err != nil {
+		return nil, err
+	}
+	resolved := *ref
+	if err := d.PopulateDigest(ctx, &resolved); err != nil {
+		return nil, err
+	}
+	if resolved.Digest == "" {
+		return nil, fmt.Errorf("the reference '%s' has no digest", ref.Reference)
+	}
+	return &ResolvedReference{Name: name, Digest: resolved.Digest, Platform: resolved.Platform}, nil
+}
+
+// CanonicalizeReference parses the reference and returns its CanonicalName, e.g. registry.hub.docker.com/library/alpine:latest
+// for alpine, without contacting any registry. Docker Hub's aliases, e.g. docker.io, are replaced by its registry and its
+// official images are prefixed with library/, the registry is lowercased and keeps its port, e.g. localhost:5000, and
+// references without a tag or digest are given defaultTag, or DefaultTag if it's empty.
+func CanonicalizeReference(ref string, defaultTag string) (string, error) {
+	if defaultTag == "" {
+		defaultTag = DefaultTag
+	} else if _, err := reference.Parse("image:" + defaultTag); err != nil {
+		return "", errors.Wrapf(err, "invalid default tag '%s'", defaultTag)
+	}
+	parsed, err := scan.NewImageReference(strings.TrimSpace(ref))
+	if err != nil {
+		return "", err
+	}
+	return canonicalName(parsed, defaultTag)
+}
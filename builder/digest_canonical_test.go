@@ -0,0 +1,165 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/containerd/containerd/images"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestCanonicalName(t *testing.T) {
+	tests := []struct {
+		img      string
+		expected string
+	}{
+		{"alpine", scan.DockerHubRegistry + "/library/alpine:latest"},
+		{"org/app:v1", scan.DockerHubRegistry + "/org/app:v1"},
+		{"myregistry.azurecr.io/org/app:v1", "myregistry.azurecr.io/org/app:v1"},
+		{"myregistry.azurecr.io/org/app@sha256:0000000000000000000000000000000000000000000000000000000000000000", "myregistry.azurecr.io/org/app@sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+		{"org/app:v1@sha256:0000000000000000000000000000000000000000000000000000000000000000", scan.DockerHubRegistry + "/org/app:v1@sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+	}
+
+	for _, test := range tests {
+		ref, err := scan.NewImageReference(test.img)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", test.img, err)
+		}
+		actual, err := CanonicalName(ref)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.img, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %s for %s, but got %s", test.expected, test.img, actual)
+		}
+	}
+}
+
+func TestRemoteDigest_ResolveCanonical(t *testing.T) {
+	registry := newFakeRegistry()
+	manifestDigest := registry.addManifest("library/hello", "latest", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	_, platformDigests := registry.addIndex(t, "library/multi", "v1", ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	host, stop := registry.start()
+	defer stop()
+
+	ref := &image.Reference{Registry: host, Repository: "library/hello", Reference: host + "/library/hello"}
+	resolved, err := NewRemoteDigest(nil).ResolveCanonical(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := host + "/library/hello:latest@" + manifestDigest.String(); resolved.Pinned() != expected {
+		t.Errorf("Expected %s, but got %s", expected, resolved.Pinned())
+	}
+	if ref.Digest != "" {
+		t.Errorf("Expected the reference not to be modified, but got digest %s", ref.Digest)
+	}
+
+	// References pinned to a digest keep it, without being given a tag.
+	ref = &image.Reference{Registry: host, Repository: "library/hello", Digest: manifestDigest.String(), Reference: host + "/library/hello@" + manifestDigest.String()}
+	if resolved, err = NewRemoteDigest(nil).ResolveCanonical(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := host + "/library/hello@" + manifestDigest.String(); resolved.Name != expected || resolved.Pinned() != expected {
+		t.Errorf("Expected %s, but got %s and %s", expected, resolved.Name, resolved.Pinned())
+	}
+
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{PreferredPlatforms: []string{"linux/amd64"}})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	ref = &image.Reference{Registry: host, Repository: "library/multi", Tag: "v1", Reference: host + "/library/multi:v1"}
+	resolved, err = d.ResolveCanonical(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resolved.Name != host+"/library/multi:v1" || resolved.Digest != platformDigests["linux/amd64"].String() || resolved.Platform != "linux/amd64" {
+		t.Errorf("Unexpected resolved reference: %+v", resolved)
+	}
+
+	// The canonical name of a reference without a tag is given the tag it's resolved with.
+	stableDigest := registry.addManifest("library/hello", "stable", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"tag":"stable"}`))
+	if d, err = NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{DefaultTag: "stable"}); err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	ref = &image.Reference{Registry: host, Repository: "library/hello", Reference: host + "/library/hello"}
+	if resolved, err = d.ResolveCanonical(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := host + "/library/hello:stable@" + stableDigest.String(); resolved.Pinned() != expected {
+		t.Errorf("Expected %s, but got %s", expected, resolved.Pinned())
+	}
+
+	if _, err := NewRemoteDigest(nil).ResolveCanonical(context.Background(), &image.Reference{Reference: NoBaseImageSpecifierLatest, Repository: NoBaseImageSpecifierLatest}); err == nil {
+		t.Error("Expected an error for a reference without a digest")
+	}
+}
+
+func TestCanonicalizeReference(t *testing.T) {
+	const dgst = "sha256:2557e3c07ed1e38f26e389462d03ed943586f744621577a99efb77324b0fe535"
+	tests := []struct {
+		ref         string
+		defaultTag  string
+		expected    string
+		shouldError bool
+	}{
+		{"alpine", "", "registry.hub.docker.com/library/alpine:latest", false},
+		{"alpine:3.18", "", "registry.hub.docker.com/library/alpine:3.18", false},
+		{"library/alpine", "", "registry.hub.docker.com/library/alpine:latest", false},
+		{"docker.io/alpine", "", "registry.hub.docker.com/library/alpine:latest", false},
+		{"index.docker.io/myuser/app:1", "", "registry.hub.docker.com/myuser/app:1", false},
+		{" myuser/app ", "stable", "registry.hub.docker.com/myuser/app:stable", false},
+		{"MyRegistry.azurecr.io/app", "", "myregistry.azurecr.io/app:latest", false},
+		{"localhost:5000/app", "", "localhost:5000/app:latest", false},
+		{"myregistry.azurecr.io:443/team/app:v1", "", "myregistry.azurecr.io:443/team/app:v1", false},
+		{"[::1]:5000/app:v1", "", "[::1]:5000/app:v1", false},
+		{"alpine@" + dgst, "", "registry.hub.docker.com/library/alpine@" + dgst, false},
+		{"alpine:3.18@" + dgst, "", "registry.hub.docker.com/library/alpine:3.18@" + dgst, false},
+		{"Alpine", "", "", true},
+		{"alpine", "in valid", "", true},
+		{"", "", "", true},
+	}
+
+	for _, test := range tests {
+		actual, err := CanonicalizeReference(test.ref, test.defaultTag)
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error canonicalizing %q, but got %s", test.ref, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error canonicalizing %q: %v", test.ref, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %q to be canonicalized as %s, but got %s", test.ref, test.expected, actual)
+		}
+	}
+}
+
+func TestCanonicalizeReference_AgreesWithCanonicalName(t *testing.T) {
+	const dgst = "sha256:2557e3c07ed1e38f26e389462d03ed943586f744621577a99efb77324b0fe535"
+	for _, img := range []string{"alpine", "docker.io/library/alpine:3.18", "MyRegistry.azurecr.io/app", "localhost:5000/app:v1", "alpine@" + dgst, "org/app:v1@" + dgst} {
+		ref, err := scan.NewImageReference(img)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", img, err)
+		}
+		name, err := CanonicalName(ref)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", img, err)
+		}
+		canonical, err := CanonicalizeReference(img, "")
+		if err != nil {
+			t.Fatalf("Unexpected error canonicalizing %s: %v", img, err)
+		}
+		if canonical != name {
+			t.Errorf("Expected %s to be canonicalized as its canonical name %s, but got %s", img, name, canonical)
+		}
+	}
+}
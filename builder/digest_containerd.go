@@ -0,0 +1,256 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"strings"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultContainerdAddress is the default address of containerd's socket.
+	DefaultContainerdAddress = "/run/containerd/containerd.sock"
+
+	// DefaultContainerdNamespace is the default namespace of containerd's images.
+	// Images pulled by Docker using containerd are in the moby namespace instead.
+	DefaultContainerdNamespace = "default"
+
+	// ctrCLI is containerd's CLI, which the image and content stores are queried with.
+	ctrCLI = "ctr"
+
+	// containerdDockerHubRegistry is the registry containerd names Docker Hub images with.
+	containerdDockerHubRegistry = "docker.io"
+)
+
+// containerdImageStore gets images from containerd's image store by name.
+type containerdImageStore interface {
+	Get(ctx context.Context, name string) (images.Image, error)
+}
+
+// containerdDigest is a DigestHelper which populates the digests of the images in containerd's
+// local image store, so the images already present don't need to be resolved from their registries.
+// Images which aren't in the store fail with an error matching errdefs.ErrNotFound, so it can be
+// chained with another DigestHelper using NewFallbackDigest.
+type containerdDigest struct {
+	images             containerdImageStore
+	content            content.Provider
+	preferredPlatforms []ocispec.Platform
+	maxManifestSize    int64
+}
+
+var _ DigestHelper = &containerdDigest{}
+
+// NewContainerdDigest creates a DigestHelper which populates digests from the image store of the
+// containerd listening at address, in the namespace, which is queried with containerd's ctr CLI, like
+// NewDockerStoreDigest queries Docker's with the docker CLI. If there are preferred platforms, a manifest
+// list in the store resolves to the manifest of the first preferred platform, like NewRemoteDigestWithOptions.
+func NewContainerdDigest(procManager *procmanager.ProcManager, address string, namespace string, preferredPlatforms []string) (*containerdDigest, error) {
+	if address == "" {
+		address = DefaultContainerdAddress
+	}
+	if namespace == "" {
+		namespace = DefaultContainerdNamespace
+	}
+	parsed, err := parsePlatforms(preferredPlatforms)
+	if err != nil {
+		return nil, err
+	}
+	// containerd is only contacted when an image is looked up, so a missing containerd falls back
+	// to the next DigestHelper instead of failing here.
+	ctr := &ctrStore{procManager: procManager, address: strings.TrimPrefix(address, "unix://"), namespace: namespace}
+	return newContainerdDigest(ctr, ctr, parsed), nil
+}
+
+func newContainerdDigest(store containerdImageStore, provider content.Provider, preferredPlatforms []ocispec.Platform) *containerdDigest {
+	return &containerdDigest{
+		images:             store,
+		content:            provider,
+		preferredPlatforms: preferredPlatforms,
+		maxManifestSize:    DefaultMaxManifestSize,
+	}
+}
+
+// PopulateDigest populates the reference's digest if its image is in containerd's image store.
+func (d *containerdDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	if ref == nil || ref.Digest != "" || IsNoBaseImage(ref) {
+		return nil
+	}
+	name, err := containerdImageName(ref)
+	if err != nil {
+		return err
+	}
+
+	img, err := d.images.Get(ctx, name)
+	if err != nil {
+		if errdefs.IsNotFound(err) || errdefs.IsUnavailable(err) {
+			util.Debugf("The image %s isn't available in containerd: %v\n", name, err)
+			return errors.Wrapf(errdefs.ErrNotFound, "the image %s isn't in containerd's image store", name)
+		}
+		return errors.Wrapf(err, "failed to get the image %s from containerd", name)
+	}
+
+	desc := img.Target
+	if isIndexMediaType(desc.MediaType) && len(d.preferredPlatforms) > 0 {
+		index, err := d.readIndex(ctx, desc)
+		if err != nil {
+			return err
+		}
+		if desc, err = selectPlatform(index, d.preferredPlatforms); err != nil {
+			return errors.Wrapf(err, "failed to select a platform for the image %s", name)
+		}
+	}
+
+	ref.Digest = desc.Digest.String()
+	if desc.Platform != nil {
+		ref.Platform = platforms.Format(*desc.Platform)
+	}
+	ref.Provenance = image.NewProvenance(image.SourceContainerd)
+	util.Debugf("Resolved '%s' to %s from containerd's image store\n", ref.Reference, ref.Digest)
+	return nil
+}
+
+// readIndex reads the manifest list described by desc from containerd's content store. A manifest list
+// which isn't in the store, e.g. because only a single platform's image was pulled, isn't found.
+func (d *containerdDigest) readIndex(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Index, error) {
+	if desc.Size > d.maxManifestSize {
+		return nil, fmt.Errorf("the manifest list %s is %d bytes, which exceeds the maximum manifest size of %d bytes", desc.Digest, desc.Size, d.maxManifestSize)
+	}
+	data, err := content.ReadBlob(ctx, d.content, desc)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, errors.Wrapf(errdefs.ErrNotFound, "the manifest list %s isn't in containerd's content store", desc.Digest)
+		}
+		return nil, errors.Wrapf(err, "failed to read the manifest list %s from containerd", desc.Digest)
+	}
+	if int64(len(data)) > d.maxManifestSize {
+		return nil, fmt.Errorf("the manifest list %s is %d bytes, which exceeds the maximum manifest size of %d bytes", desc.Digest, len(data), d.maxManifestSize)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal the manifest list %s", desc.Digest)
+	}
+	return &index, nil
+}
+
+// containerdImageName returns the name containerd stores the reference's image with, e.g.
+// docker.io/library/alpine:latest, whose registry is docker.io rather than registry.hub.docker.com.
+func containerdImageName(ref *image.Reference) (string, error) {
+	name, err := getReferencePath(ref)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(name, DockerHubRegistry+"/") {
+		name = containerdDockerHubRegistry + strings.TrimPrefix(name, DockerHubRegistry)
+	}
+	return name, nil
+}
+
+// ctrStore is a containerdImageStore and content.Provider which queries the image and content stores of
+// the namespace of the containerd listening at address using the ctr CLI.
+type ctrStore struct {
+	procManager *procmanager.ProcManager
+	address     string
+	namespace   string
+}
+
+// run runs the ctr command with the args, returning its output.
+func (s *ctrStore) run(ctx context.Context, args ...string) ([]byte, error) {
+	args = append([]string{ctrCLI, "--address", s.address, "--namespace", s.namespace}, args...)
+	var stdout, stderr bytes.Buffer
+	if err := s.procManager.Run(ctx, args, nil, &stdout, &stderr, ""); err != nil {
+		return nil, ctrError(err, strings.TrimSpace(stderr.String()))
+	}
+	return stdout.Bytes(), nil
+}
+
+// ctrError returns the error of a ctr command which failed with err and the message, matching errdefs.ErrNotFound
+// if what it queried doesn't exist, and errdefs.ErrUnavailable if ctr or containerd isn't available.
+func ctrError(err error, msg string) error {
+	switch {
+	case errors.Is(err, exec.ErrNotFound):
+		return errors.Wrapf(errdefs.ErrUnavailable, "%s isn't installed", ctrCLI)
+	case strings.Contains(msg, "not found"):
+		return errors.Wrap(errdefs.ErrNotFound, msg)
+	case strings.Contains(msg, "failed to dial") || strings.Contains(msg, "connection refused") || strings.Contains(msg, "no such file or directory"):
+		return errors.Wrap(errdefs.ErrUnavailable, msg)
+	case msg != "":
+		return errors.Wrap(err, msg)
+	}
+	return err
+}
+
+// Get gets the image from the output of ctr images ls, whose columns are the name, the media type and
+// the digest of the image's target, followed by the image's size and platforms.
+func (s *ctrStore) Get(ctx context.Context, name string) (images.Image, error) {
+	out, err := s.run(ctx, "images", "ls", "name=="+name)
+	if err != nil {
+		return images.Image{}, err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || fields[0] != name {
+			continue
+		}
+		dgst, err := digest.Parse(fields[2])
+		if err != nil {
+			return images.Image{}, errors.Wrapf(err, "failed to parse the digest of the image %s", name)
+		}
+		return images.Image{Name: name, Target: ocispec.Descriptor{MediaType: fields[1], Digest: dgst}}, nil
+	}
+	return images.Image{}, errdefs.ErrNotFound
+}
+
+// ReaderAt reads the blob described by desc with ctr content get.
+func (s *ctrStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	out, err := s.run(ctx, "content", "get", desc.Digest.String())
+	if err != nil {
+		return nil, err
+	}
+	return &blobReaderAt{Reader: bytes.NewReader(out)}, nil
+}
+
+// blobReaderAt is a content.ReaderAt of a blob read into memory.
+type blobReaderAt struct {
+	*bytes.Reader
+}
+
+func (r *blobReaderAt) Close() error {
+	return nil
+}
+
+// fallbackDigest is a DigestHelper which populates digests using a DigestHelper, falling back to another for
+// the references the first doesn't find.
+type fallbackDigest struct {
+	helper   DigestHelper
+	fallback DigestHelper
+}
+
+// NewFallbackDigest creates a DigestHelper which populates digests using helper, and using fallback
+// for the references helper fails to find, i.e. fails with an error matching errdefs.ErrNotFound.
+func NewFallbackDigest(helper DigestHelper, fallback DigestHelper) DigestHelper {
+	return &fallbackDigest{helper: helper, fallback: fallback}
+}
+
+func (d *fallbackDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	err := d.helper.PopulateDigest(ctx, ref)
+	if err != nil && errdefs.IsNotFound(err) {
+		return d.fallback.PopulateDigest(ctx, ref)
+	}
+	return err
+}
@@ -0,0 +1,305 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeContainerdStore is an in-memory containerd image and content store.
+type fakeContainerdStore struct {
+	images map[string]images.Image
+	blobs  map[digest.Digest][]byte
+	err    error
+	gets   []string
+}
+
+func newFakeContainerdStore() *fakeContainerdStore {
+	return &fakeContainerdStore{images: make(map[string]images.Image), blobs: make(map[digest.Digest][]byte)}
+}
+
+// addImage adds an image named name whose target is the content.
+func (s *fakeContainerdStore) addImage(name string, mediaType string, data []byte, withContent bool) ocispec.Descriptor {
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	s.images[name] = images.Image{Name: name, Target: desc}
+	if withContent {
+		s.blobs[desc.Digest] = data
+	}
+	return desc
+}
+
+func (s *fakeContainerdStore) Get(ctx context.Context, name string) (images.Image, error) {
+	s.gets = append(s.gets, name)
+	if s.err != nil {
+		return images.Image{}, s.err
+	}
+	img, ok := s.images[name]
+	if !ok {
+		return images.Image{}, errdefs.ErrNotFound
+	}
+	return img, nil
+}
+
+func (s *fakeContainerdStore) ReaderAt(ctx context.Context, desc ocispec.Descriptor) (content.ReaderAt, error) {
+	data, ok := s.blobs[desc.Digest]
+	if !ok {
+		return nil, errdefs.ErrNotFound
+	}
+	return &blobReaderAt{Reader: bytes.NewReader(data)}, nil
+}
+
+// fixedDigest is a DigestHelper which populates every reference with its digest.
+type fixedDigest struct {
+	digest string
+	called bool
+}
+
+func (d *fixedDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	d.called = true
+	ref.Digest = d.digest
+	return nil
+}
+
+func TestContainerdDigest(t *testing.T) {
+	store := newFakeContainerdStore()
+	hello := store.addImage("docker.io/library/hello-world:latest", ocispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2}`), false)
+	app := store.addImage("myregistry.azurecr.io/app:v1", ocispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2,"app":true}`), false)
+	d := newContainerdDigest(store, store, nil)
+
+	tests := []struct {
+		ref      *image.Reference
+		expected string
+	}{
+		{&image.Reference{Registry: DockerHubRegistry, Repository: "library/hello-world", Reference: "hello-world"}, hello.Digest.String()},
+		{&image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: "v1", Reference: "myregistry.azurecr.io/app:v1"}, app.Digest.String()},
+		{&image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: "v1", Digest: "sha256:pinned", Reference: "myregistry.azurecr.io/app:v1"}, "sha256:pinned"},
+		{&image.Reference{Reference: NoBaseImageSpecifierLatest}, ""},
+	}
+
+	for _, test := range tests {
+		if err := d.PopulateDigest(context.Background(), test.ref); err != nil {
+			t.Fatalf("Unexpected error populating %s: %v", test.ref.Reference, err)
+		}
+		if test.ref.Digest != test.expected {
+			t.Errorf("Expected %s to resolve to %s, but got %s", test.ref.Reference, test.expected, test.ref.Digest)
+		}
+	}
+	if len(store.gets) != 2 {
+		t.Errorf("Expected references with a digest and scratch not to be looked up, but got %v", store.gets)
+	}
+}
+
+func TestContainerdDigest_NotFound(t *testing.T) {
+	store := newFakeContainerdStore()
+	d := newContainerdDigest(store, store, nil)
+	newRef := func() *image.Reference {
+		return &image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: "v1", Reference: "myregistry.azurecr.io/app:v1"}
+	}
+
+	tests := []struct {
+		storeErr error
+		notFound bool
+	}{
+		{nil, true},
+		{errdefs.ErrUnavailable, true},
+		{errors.New("permission denied"), false},
+	}
+
+	for _, test := range tests {
+		store.err = test.storeErr
+		err := d.PopulateDigest(context.Background(), newRef())
+		if err == nil || errdefs.IsNotFound(err) != test.notFound {
+			t.Errorf("Expected an error which is not found (%t) for %v, but got %v", test.notFound, test.storeErr, err)
+		}
+
+		fallback := &fixedDigest{digest: "sha256:remote"}
+		ref := newRef()
+		err = NewFallbackDigest(d, fallback).PopulateDigest(context.Background(), ref)
+		if fallback.called != test.notFound {
+			t.Errorf("Expected the fallback to be used (%t) for %v", test.notFound, test.storeErr)
+		}
+		if test.notFound && (err != nil || ref.Digest != "sha256:remote") {
+			t.Errorf("Expected the fallback to populate the digest for %v, but got %s, %v", test.storeErr, ref.Digest, err)
+		}
+		if !test.notFound && err == nil {
+			t.Errorf("Expected the error for %v to be returned", test.storeErr)
+		}
+	}
+
+	app := store.addImage("myregistry.azurecr.io/app:v1", ocispec.MediaTypeImageManifest, []byte(`{"schemaVersion":2}`), false)
+	store.err = nil
+	fallback := &fixedDigest{digest: "sha256:remote"}
+	ref := newRef()
+	if err := NewFallbackDigest(d, fallback).PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if fallback.called || ref.Digest != app.Digest.String() {
+		t.Errorf("Expected the image in containerd's store to resolve to %s without the fallback, but got %s", app.Digest, ref.Digest)
+	}
+}
+
+func TestContainerdDigest_PreferredPlatforms(t *testing.T) {
+	amd64 := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("amd64"), Size: 6, Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}}
+	arm64 := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("arm64"), Size: 6, Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}}
+	index, err := json.Marshal(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{amd64, arm64}})
+	if err != nil {
+		t.Fatalf("Failed to marshal the index: %v", err)
+	}
+	store := newFakeContainerdStore()
+	indexDesc := store.addImage("myregistry.azurecr.io/app:v1", ocispec.MediaTypeImageIndex, index, true)
+	otherIndex, err := json.Marshal(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{arm64}})
+	if err != nil {
+		t.Fatalf("Failed to marshal the index: %v", err)
+	}
+	store.addImage("myregistry.azurecr.io/app:v2", ocispec.MediaTypeImageIndex, otherIndex, false)
+	newRef := func(tag string) *image.Reference {
+		return &image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: tag, Reference: "myregistry.azurecr.io/app:" + tag}
+	}
+
+	ref := newRef("v1")
+	if err := newContainerdDigest(store, store, nil).PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != indexDesc.Digest.String() {
+		t.Errorf("Expected the digest of the index %s without preferred platforms, but got %s", indexDesc.Digest, ref.Digest)
+	}
+
+	preferred, err := parsePlatforms([]string{"linux/arm64"})
+	if err != nil {
+		t.Fatalf("Failed to parse the platforms: %v", err)
+	}
+	d := newContainerdDigest(store, store, preferred)
+	ref = newRef("v1")
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != arm64.Digest.String() || ref.Platform != "linux/arm64" {
+		t.Errorf("Expected the linux/arm64 manifest %s, but got %s (%s)", arm64.Digest, ref.Digest, ref.Platform)
+	}
+
+	// The index of v2 isn't in the content store, so the remote helper has to select the platform instead.
+	if err := d.PopulateDigest(context.Background(), newRef("v2")); err == nil || !errdefs.IsNotFound(err) {
+		t.Errorf("Expected an index without content not to be found, but got %v", err)
+	}
+}
+
+// fakeCtr is a ctr CLI serving the images of a containerd listening at %[1]s, in the moby namespace, where
+// myregistry.azurecr.io/app:v1 is a manifest whose digest is %[2]s and myregistry.azurecr.io/app:v2 is
+// a manifest list whose digest is %[3]s, with the content %[4]s.
+const fakeCtr = `#!/bin/sh
+if [ "$2" != "%[1]s" ]; then
+	echo "ctr: failed to dial \"$2\": context deadline exceeded" >&2
+	exit 1
+fi
+namespace=$4
+shift 4
+case "$1 $2" in
+"images ls")
+	echo "REF TYPE DIGEST SIZE PLATFORMS LABELS"
+	if [ "$namespace" = moby ]; then
+		case "$3" in
+		name==myregistry.azurecr.io/app:v1) echo "myregistry.azurecr.io/app:v1 application/vnd.oci.image.manifest.v1+json %[2]s 3.0 B linux/amd64 -" ;;
+		name==myregistry.azurecr.io/app:v2) echo "myregistry.azurecr.io/app:v2 application/vnd.oci.image.index.v1+json %[3]s 1.2 KiB linux/amd64,linux/arm64 -" ;;
+		esac
+	fi
+	;;
+"content get")
+	if [ "$namespace" = moby ] && [ "$3" = "%[3]s" ]; then
+		echo '%[4]s'
+	else
+		echo "ctr: content digest $3: not found" >&2
+		exit 1
+	fi
+	;;
+esac
+`
+
+func TestNewContainerdDigest(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("The fake ctr CLI is a shell script, which is only tested on Linux")
+	}
+	address := filepath.Join(t.TempDir(), "containerd.sock")
+	manifest := digest.FromString("app")
+	arm64 := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("arm64"), Size: 6, Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}}
+	index, err := json.Marshal(ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: []ocispec.Descriptor{arm64}})
+	if err != nil {
+		t.Fatalf("Failed to marshal the index: %v", err)
+	}
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, ctrCLI), []byte(fmt.Sprintf(fakeCtr, address, manifest, digest.FromBytes(index), index)), 0700); err != nil {
+		t.Fatalf("Failed to write the fake ctr CLI: %v", err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	pm := procmanager.NewProcManager(false)
+
+	tests := []struct {
+		address   string
+		namespace string
+		platforms []string
+		tag       string
+		expected  string
+	}{
+		{address, "moby", nil, "v1", manifest.String()},
+		{"unix://" + address, "moby", nil, "v1", manifest.String()},
+		{address, "moby", nil, "v2", digest.FromBytes(index).String()},
+		{address, "moby", []string{"linux/arm64"}, "v2", arm64.Digest.String()},
+		// Missing images, images in other namespaces and containerd not running aren't found.
+		{address, "moby", nil, "v3", ""},
+		{address, "", nil, "v1", ""},
+		{filepath.Join(t.TempDir(), "missing.sock"), "moby", nil, "v1", ""},
+	}
+
+	for _, test := range tests {
+		d, err := NewContainerdDigest(pm, test.address, test.namespace, test.platforms)
+		if err != nil {
+			t.Fatalf("Failed to create the containerd digest for %s: %v", test.address, err)
+		}
+		ref := &image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: test.tag, Reference: "myregistry.azurecr.io/app:" + test.tag}
+		err = d.PopulateDigest(context.Background(), ref)
+		if test.expected == "" {
+			if err == nil || !errdefs.IsNotFound(err) {
+				t.Errorf("Expected %s not to be found at %s in namespace %q, but got %v", ref.Reference, test.address, test.namespace, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", ref.Reference, err)
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("Expected %s to resolve to %s, but got %s", ref.Reference, test.expected, ref.Digest)
+		}
+	}
+
+	// Without ctr, images aren't found either.
+	t.Setenv("PATH", t.TempDir())
+	d, err := NewContainerdDigest(pm, address, "moby", nil)
+	if err != nil {
+		t.Fatalf("Failed to create the containerd digest: %v", err)
+	}
+	ref := &image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: "v1", Reference: "myregistry.azurecr.io/app:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err == nil || !errdefs.IsNotFound(err) {
+		t.Errorf("Expected the image not to be found without ctr, but got %v", err)
+	}
+
+	if _, err := NewContainerdDigest(pm, address, "moby", []string{"linux/"}); err == nil {
+		t.Error("Expected an invalid preferred platform to fail")
+	}
+}
@@ -34,10 +34,8 @@ func (d *dockerStoreDigest) PopulateDigest(ctx context.Context, reference *image
 	if reference.Digest != "" {
 		return nil
 	}
-	// refString will always have the tag specified at this point.
-	// For "scratch", we have to compare it against "scratch:latest" even though
-	// scratch:latest isn't valid in a FROM clause.
-	if reference.Reference == NoBaseImageSpecifierLatest {
+	// scratch isn't an image, so it has no digest to resolve.
+	if IsNoBaseImage(reference) {
 		return nil
 	}
 	args := []string{
@@ -67,6 +65,9 @@ func (d *dockerStoreDigest) PopulateDigest(ctx context.Context, reference *image
 		return c == '\n' || c == '\r' || c == '"' || c == '\t'
 	}
 	reference.Digest = getRepoDigest(strings.TrimFunc(buf.String(), trimCharPredicate), reference)
+	if reference.Digest != "" {
+		reference.Provenance = image.NewProvenance(image.SourceDocker)
+	}
 	return nil
 }
 
@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"syscall"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+)
+
+// unavailableStatuses are the statuses with which a registry reports it's temporarily unable to serve a request.
+var unavailableStatuses = []int{
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// knownDigestsDigest is a DigestHelper which sets the fallback digests of references before populating them.
+type knownDigestsDigest struct {
+	helper  DigestHelper
+	digests map[string]string
+}
+
+// NewKnownDigestsDigest creates a DigestHelper which populates digests using helper, after setting the
+// FallbackDigest of each reference which digests has a previously known digest for, keyed by the reference
+// as it's written, e.g. mcr.microsoft.com/dotnet/sdk:6.0. helper then uses the fallback digest, instead of
+// failing, if the reference's registry is unavailable, see isRegistryUnavailable.
+func NewKnownDigestsDigest(helper DigestHelper, digests map[string]string) DigestHelper {
+	if len(digests) == 0 {
+		return helper
+	}
+	return &knownDigestsDigest{helper: helper, digests: digests}
+}
+
+func (d *knownDigestsDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	if ref != nil && ref.FallbackDigest == "" {
+		ref.FallbackDigest = d.digests[ref.Reference]
+	}
+	return d.helper.PopulateDigest(ctx, ref)
+}
+
+// isRegistryUnavailable determines whether the error returned when resolving a reference was caused by its
+// registry being unreachable or temporarily unable to serve the request, i.e. a connection which is refused,
+// reset or times out, or a 429 or 5xx, as opposed to a hard error such as the reference not existing, the
+// registry rejecting the credentials, its host not existing or its certificate not being trusted, which would
+// fail the same way if tried again.
+func isRegistryUnavailable(err error) bool {
+	if err == nil || errdefs.IsNotFound(err) || isAuthFailure(err) || isCertificateError(err) {
+		return false
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return false
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	status := registryStatusCode(err)
+	for _, unavailable := range unavailableStatuses {
+		if status == unavailable {
+			return true
+		}
+	}
+	return false
+}
+
+// isCertificateError determines whether err was caused by the registry's TLS certificate failing verification.
+func isCertificateError(err error) bool {
+	var unknownAuthority x509.UnknownAuthorityError
+	var invalid x509.CertificateInvalidError
+	var hostname x509.HostnameError
+	return errors.As(err, &unknownAuthority) || errors.As(err, &invalid) || errors.As(err, &hostname)
+}
@@ -0,0 +1,133 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/images"
+)
+
+const knownDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+
+func TestRemoteDigest_FallbackDigest(t *testing.T) {
+	registry := newFakeRegistry()
+	liveDigest := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+	registry.username, registry.password = "user", "password"
+
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+	unavailableHost := strings.TrimPrefix(unavailable.URL, "http://")
+
+	unreachable := httptest.NewServer(http.NotFoundHandler())
+	unreachableHost := strings.TrimPrefix(unreachable.URL, "http://")
+	unreachable.Close()
+
+	tests := []struct {
+		name       string
+		host       string
+		repository string
+		expected   string
+		shouldFail bool
+	}{
+		{"live digest", host, "library/hello", liveDigest.String(), false},
+		{"unavailable", unavailableHost, "library/hello", knownDigest, false},
+		{"unreachable", unreachableHost, "library/hello", knownDigest, false},
+		{"not found", host, "library/missing", "", true},
+	}
+	creds := &fakeCredentialProvider{username: "user", password: "password"}
+	for _, test := range tests {
+		ref := &image.Reference{Registry: test.host, Repository: test.repository, Tag: "v1", Reference: test.host + "/" + test.repository + ":v1", FallbackDigest: knownDigest}
+		err := NewRemoteDigest(creds).PopulateDigest(context.Background(), ref)
+		if test.shouldFail != (err != nil) {
+			t.Fatalf("%s: expected failure: %v, but got error: %v", test.name, test.shouldFail, err)
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("%s: expected digest %s, but got %s", test.name, test.expected, ref.Digest)
+		}
+		if fellBack := test.expected == knownDigest; ref.Digest != "" && (ref.Provenance == nil || ref.Provenance.Fallback != fellBack) {
+			t.Errorf("%s: expected the provenance to record the fallback: %v, but got %+v", test.name, fellBack, ref.Provenance)
+		}
+	}
+
+	// Registries rejecting the credentials don't fall back.
+	ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1", FallbackDigest: knownDigest}
+	if err := NewRemoteDigest(nil).PopulateDigest(context.Background(), ref); err == nil || ref.Digest != "" {
+		t.Errorf("Expected an auth failure not to fall back, but got digest %s (%v)", ref.Digest, err)
+	}
+	// References without a fallback digest fail.
+	ref = &image.Reference{Registry: unavailableHost, Repository: "library/hello", Tag: "v1", Reference: unavailableHost + "/library/hello:v1"}
+	if err := NewRemoteDigest(nil).PopulateDigest(context.Background(), ref); err == nil {
+		t.Error("Expected a reference without a fallback digest to fail, but got none")
+	}
+}
+
+// fallbackRecorder records the fallback digest of each reference it populates.
+type fallbackRecorder struct {
+	fallbacks []string
+}
+
+func (d *fallbackRecorder) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	d.fallbacks = append(d.fallbacks, ref.FallbackDigest)
+	return nil
+}
+
+func TestKnownDigestsDigest(t *testing.T) {
+	helper := &fallbackRecorder{}
+	d := NewKnownDigestsDigest(helper, map[string]string{"mcr.microsoft.com/dotnet/sdk:6.0": knownDigest})
+	for _, reference := range []string{"mcr.microsoft.com/dotnet/sdk:6.0", "mcr.microsoft.com/dotnet/sdk:7.0"} {
+		if err := d.PopulateDigest(context.Background(), &image.Reference{Reference: reference}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if len(helper.fallbacks) != 2 || helper.fallbacks[0] != knownDigest || helper.fallbacks[1] != "" {
+		t.Errorf("Expected only the known reference to have a fallback digest, but got %v", helper.fallbacks)
+	}
+}
+
+func TestIsRegistryUnavailable(t *testing.T) {
+	const manifestURL = "https://myregistry.azurecr.io/v2/hello/manifests/v1"
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{&registryStatusError{StatusCode: http.StatusServiceUnavailable, err: errors.New("503 Service Unavailable")}, true},
+		{&registryStatusError{StatusCode: http.StatusTooManyRequests, err: errors.New("429 Too Many Requests")}, true},
+		{&registryStatusError{StatusCode: http.StatusUnauthorized, err: errors.New("401 Unauthorized")}, false},
+		{&registryStatusError{StatusCode: http.StatusBadRequest, err: errors.New("400 Bad Request")}, false},
+		{context.DeadlineExceeded, true},
+		{&url.Error{Op: "Head", URL: manifestURL, Err: &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}}, true},
+		{&url.Error{Op: "Head", URL: manifestURL, Err: &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}}, true},
+		{&url.Error{Op: "Head", URL: manifestURL, Err: &net.DNSError{Err: "i/o timeout", Name: "myregistry.azurecr.io", IsTimeout: true}}, true},
+		// Hosts which don't exist and untrusted certificates fail the same way when tried again.
+		{&url.Error{Op: "Head", URL: manifestURL, Err: &net.OpError{Op: "dial", Net: "tcp", Err: &net.DNSError{Err: "no such host", Name: "myregistry.azurecr.io", IsNotFound: true}}}, false},
+		{&url.Error{Op: "Head", URL: manifestURL, Err: x509.UnknownAuthorityError{}}, false},
+		{&url.Error{Op: "Head", URL: manifestURL, Err: x509.HostnameError{Certificate: &x509.Certificate{}, Host: "myregistry.azurecr.io"}}, false},
+		// Other failures to request the registry aren't transient.
+		{&url.Error{Op: "Head", URL: manifestURL, Err: errors.New("malformed HTTP response")}, false},
+		{errors.New("unexpected status code https://myregistry.azurecr.io/v2/hello/manifests/v1: 503 Service Unavailable"), false},
+		{errors.New("myregistry.azurecr.io/hello:v1: not found"), false},
+		{errors.New("invalid reference"), false},
+	}
+	for _, test := range tests {
+		if actual := isRegistryUnavailable(test.err); actual != test.expected {
+			t.Errorf("Expected %v to be unavailable: %v, but got %v", test.err, test.expected, actual)
+		}
+	}
+}
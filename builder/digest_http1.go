@@ -0,0 +1,39 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+)
+
+// newHTTP1Client creates a copy of client whose transport only speaks HTTP/1.1 to registries and
+// proxies. It neither offers HTTP/2 during the TLS handshake nor upgrades connections to it, for
+// intermediaries which negotiate HTTP/2 but break under it.
+func newHTTP1Client(client *http.Client) (*http.Client, error) {
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("disabling HTTP/2 requires an *http.Transport, but the client uses %T", client.Transport)
+	}
+	transport.ForceAttemptHTTP2 = false
+	// A non-nil, empty TLSNextProto disables the transport's HTTP/2 support.
+	transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.NextProtos = []string{"http/1.1"}
+
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}, nil
+}
@@ -0,0 +1,62 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestRemoteDigest_DisableHTTP2(t *testing.T) {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Proto", req.Proto)
+	}))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+
+	tests := []struct {
+		disableHTTP2  bool
+		expectedProto string
+	}{
+		{false, "HTTP/2.0"},
+		{true, "HTTP/1.1"},
+	}
+	for _, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{Client: server.Client(), DisableHTTP2: test.disableHTTP2})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if test.disableHTTP2 {
+			transport := d.client.Transport.(*http.Transport)
+			if transport.ForceAttemptHTTP2 || transport.TLSNextProto == nil || len(transport.TLSNextProto) != 0 {
+				t.Errorf("Expected the transport's HTTP/2 support to be disabled, but got ForceAttemptHTTP2: %v, TLSNextProto: %v", transport.ForceAttemptHTTP2, transport.TLSNextProto)
+			}
+			if !reflect.DeepEqual(transport.TLSClientConfig.NextProtos, []string{"http/1.1"}) {
+				t.Errorf("Expected only HTTP/1.1 to be negotiated, but got %v", transport.TLSClientConfig.NextProtos)
+			}
+			if _, ok := server.Client().Transport.(*http.Transport).TLSNextProto["h2"]; !ok {
+				t.Error("Expected the client passed in not to be modified")
+			}
+		}
+
+		resp, err := d.client.Get(server.URL)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		resp.Body.Close()
+		if proto := resp.Header.Get("X-Proto"); proto != test.expectedProto {
+			t.Errorf("Expected a request over %s when DisableHTTP2 is %v, but got %s", test.expectedProto, test.disableHTTP2, proto)
+		}
+	}
+}
+
+func TestRemoteDigest_DisableHTTP2_UnsupportedTransport(t *testing.T) {
+	client := &http.Client{Transport: &countingTransport{}}
+	if _, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{Client: client, DisableHTTP2: true}); err == nil {
+		t.Error("Expected an error disabling HTTP/2 of a transport which isn't an *http.Transport")
+	}
+}
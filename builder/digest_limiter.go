@@ -0,0 +1,119 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+	"golang.org/x/time/rate"
+)
+
+// RegistryLimits configures how resolves against a single registry are throttled.
+// Zero values disable the corresponding limit.
+type RegistryLimits struct {
+	// RequestsPerSecond is the maximum rate of resolves against a registry.
+	RequestsPerSecond float64
+
+	// Burst is the number of resolves allowed to exceed RequestsPerSecond at once. Defaults to 1.
+	Burst int
+
+	// MaxConcurrency is the maximum number of resolves in flight against a registry.
+	MaxConcurrency int
+}
+
+// RegistryLimiter throttles resolves per registry, so that resolves against the same registry
+// are limited while resolves against different registries proceed independently.
+// It's safe for concurrent use and is meant to be shared by all the remoteDigests of a builder,
+// which also applies the rate limit of its RemoteDigestOptions' limiter to the push attempts of push steps.
+// Pushes don't take a concurrency slot, since a push lasts far longer than a resolve and would hold the slot
+// the whole time, starving resolves; their concurrency is limited by the builder's push concurrency instead.
+type RegistryLimiter struct {
+	limits RegistryLimits
+
+	mu       sync.Mutex
+	limiters map[string]*registryLimiter
+}
+
+type registryLimiter struct {
+	rate        *rate.Limiter
+	concurrency *semaphore.Weighted
+}
+
+// NewRegistryLimiter creates a RegistryLimiter which applies the limits to each registry.
+func NewRegistryLimiter(limits RegistryLimits) (*RegistryLimiter, error) {
+	if limits.RequestsPerSecond < 0 || limits.Burst < 0 || limits.MaxConcurrency < 0 {
+		return nil, errors.New("registry limits can't be negative")
+	}
+	if limits.Burst == 0 {
+		limits.Burst = 1
+	}
+	return &RegistryLimiter{
+		limits:   limits,
+		limiters: make(map[string]*registryLimiter),
+	}, nil
+}
+
+// acquire blocks until a resolve against the registry is allowed and returns a function
+// which must be called once the resolve completes.
+func (l *RegistryLimiter) acquire(ctx context.Context, registry string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	limiter := l.get(registry)
+
+	if limiter.concurrency != nil {
+		if err := limiter.concurrency.Acquire(ctx, 1); err != nil {
+			return nil, errors.Wrapf(err, "timed out waiting to resolve against '%s'", registry)
+		}
+	}
+	release := func() {
+		if limiter.concurrency != nil {
+			limiter.concurrency.Release(1)
+		}
+	}
+
+	if limiter.rate != nil {
+		if err := limiter.rate.Wait(ctx); err != nil {
+			release()
+			return nil, errors.Wrapf(err, "rate limit exceeded while waiting to resolve against '%s'", registry)
+		}
+	}
+	return release, nil
+}
+
+// wait blocks until another request to the registry is allowed by the rate limit, without taking a concurrency slot.
+func (l *RegistryLimiter) wait(ctx context.Context, registry string) error {
+	if l == nil {
+		return nil
+	}
+	if limiter := l.get(registry); limiter.rate != nil {
+		if err := limiter.rate.Wait(ctx); err != nil {
+			return errors.Wrapf(err, "rate limit exceeded while waiting to push to '%s'", registry)
+		}
+	}
+	return nil
+}
+
+func (l *RegistryLimiter) get(registry string) *registryLimiter {
+	registry = strings.ToLower(registry)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limiter, ok := l.limiters[registry]; ok {
+		return limiter
+	}
+	limiter := &registryLimiter{}
+	if l.limits.RequestsPerSecond > 0 {
+		limiter.rate = rate.NewLimiter(rate.Limit(l.limits.RequestsPerSecond), l.limits.Burst)
+	}
+	if l.limits.MaxConcurrency > 0 {
+		limiter.concurrency = semaphore.NewWeighted(int64(l.limits.MaxConcurrency))
+	}
+	l.limiters[registry] = limiter
+	return limiter
+}
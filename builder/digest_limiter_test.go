@@ -0,0 +1,108 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRegistryLimiter_MaxConcurrency(t *testing.T) {
+	limiter, err := NewRegistryLimiter(RegistryLimits{MaxConcurrency: 2})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var inFlight, maxInFlight int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			release, err := limiter.acquire(context.Background(), "myregistry.azurecr.io")
+			if err != nil {
+				t.Errorf("Unexpected error: %v", err)
+				return
+			}
+			defer release()
+			current := atomic.AddInt32(&inFlight, 1)
+			for {
+				max := atomic.LoadInt32(&maxInFlight)
+				if current <= max || atomic.CompareAndSwapInt32(&maxInFlight, max, current) {
+					break
+				}
+			}
+			time.Sleep(5 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+		}()
+	}
+	wg.Wait()
+
+	if maxInFlight > 2 {
+		t.Errorf("Expected at most 2 concurrent resolves, but got %d", maxInFlight)
+	}
+}
+
+func TestRegistryLimiter_PerRegistry(t *testing.T) {
+	limiter, err := NewRegistryLimiter(RegistryLimits{MaxConcurrency: 1})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	release, err := limiter.acquire(context.Background(), "a.azurecr.io")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer release()
+
+	// A different registry isn't blocked.
+	otherRelease, err := limiter.acquire(context.Background(), "b.azurecr.io")
+	if err != nil {
+		t.Fatalf("Expected resolving against another registry to proceed, but got %v", err)
+	}
+	otherRelease()
+
+	// The same registry is blocked until released.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := limiter.acquire(ctx, "A.azurecr.io"); err == nil {
+		t.Error("Expected resolving against the same registry to be blocked, but it wasn't")
+	}
+}
+
+func TestRegistryLimiter_Rate(t *testing.T) {
+	limiter, err := NewRegistryLimiter(RegistryLimits{RequestsPerSecond: 50})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		release, err := limiter.acquire(context.Background(), "myregistry.azurecr.io")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		release()
+	}
+	// The first resolve uses the burst, the remaining 4 wait 20ms each.
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Expected resolves to be throttled, but 5 completed in %v", elapsed)
+	}
+}
+
+func TestNewRegistryLimiter_Invalid(t *testing.T) {
+	if _, err := NewRegistryLimiter(RegistryLimits{RequestsPerSecond: -1}); err == nil {
+		t.Error("Expected negative limits to be invalid, but they weren't")
+	}
+}
+
+func TestRegistryLimiter_Nil(t *testing.T) {
+	var limiter *RegistryLimiter
+	release, err := limiter.acquire(context.Background(), "myregistry.azurecr.io")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	release()
+}
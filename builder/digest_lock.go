@@ -0,0 +1,79 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/platforms"
+	"github.com/pkg/errors"
+)
+
+// lockDigest is a DigestHelper which populates digests from a lock file instead of contacting registries.
+type lockDigest struct {
+	entries   map[string][]*LockEntry
+	platforms []string
+}
+
+// NewLockDigest creates a DigestHelper which populates digests from the lock file, failing if a reference
+// isn't in it. The entry for the first of the preferred platforms is used, falling back to the platform of the host.
+func NewLockDigest(lock *LockFile, preferredPlatforms []string) (DigestHelper, error) {
+	d := &lockDigest{entries: make(map[string][]*LockEntry)}
+	for _, entry := range lock.Images {
+		d.entries[entry.Reference] = append(d.entries[entry.Reference], entry)
+	}
+	for _, p := range preferredPlatforms {
+		platform, err := platforms.Parse(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid preferred platform '%s'", p)
+		}
+		d.platforms = append(d.platforms, platforms.Format(platform))
+	}
+	d.platforms = append(d.platforms, platforms.DefaultString())
+	return d, nil
+}
+
+var _ DigestHelper = &lockDigest{}
+
+func (d *lockDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	if ref == nil || ref.Digest != "" || IsNoBaseImage(ref) {
+		return nil
+	}
+
+	// Rewritten references are locked by the reference they were rewritten from, see NewLockFile.
+	key := ref.Reference
+	if ref.OriginalReference != "" {
+		key = ref.OriginalReference
+	}
+	entries := d.entries[key]
+	for _, platform := range d.platforms {
+		for _, entry := range entries {
+			if entry.Platform == platform {
+				ref.Digest = entry.Digest
+				ref.Platform = entry.Platform
+				// The entry's provenance is kept, so a lock file written from this one still describes how its digests were resolved.
+				if entry.Provenance != nil {
+					provenance := *entry.Provenance
+					ref.Provenance = &provenance
+				} else {
+					ref.Provenance = image.NewProvenance(image.SourceLockFile)
+				}
+				return nil
+			}
+		}
+	}
+
+	if len(entries) == 0 {
+		return fmt.Errorf("'%s' isn't in the lock file, use --update-lock to refresh it", key)
+	}
+	var locked []string
+	for _, entry := range entries {
+		locked = append(locked, entry.Platform)
+	}
+	return fmt.Errorf("'%s' is only locked for the platforms [%s] but [%s] is required, use --update-lock to refresh it",
+		key, strings.Join(locked, ", "), strings.Join(d.platforms, ", "))
+}
@@ -0,0 +1,130 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/containerd/containerd/platforms"
+)
+
+func TestLockDigest_PopulateDigest(t *testing.T) {
+	lock := &LockFile{
+		Version: lockFileVersion,
+		Images: []*LockEntry{
+			{Reference: "golang:1.19", Digest: lockTestDigest1, Platform: platforms.DefaultString(), Provenance: &image.Provenance{Source: image.SourceRegistry, Credential: "msi"}},
+			{Reference: "alpine:3.17", Digest: lockTestDigest1, Platform: "linux/amd64"},
+			{Reference: "alpine:3.17", Digest: lockTestDigest2, Platform: "linux/arm64"},
+			{Reference: "node:18", Digest: lockTestDigest2, Platform: "plan9/386"},
+		},
+	}
+
+	tests := []struct {
+		preferred     []string
+		reference     string
+		expected      string
+		expectedError string
+	}{
+		// Present
+		{nil, "golang:1.19", lockTestDigest1, ""},
+		{[]string{"linux/arm64", "linux/amd64"}, "alpine:3.17", lockTestDigest2, ""},
+		{[]string{"windows/amd64", "linux/amd64"}, "alpine:3.17", lockTestDigest1, ""},
+		// Missing
+		{nil, "ubuntu:22.04", "", "isn't in the lock file"},
+		// Stale, locked for a platform which isn't used anymore
+		{nil, "node:18", "", "is only locked for the platforms [plan9/386]"},
+	}
+
+	for _, test := range tests {
+		d, err := NewLockDigest(lock, test.preferred)
+		if err != nil {
+			t.Fatalf("Failed to create lock digest: %v", err)
+		}
+		ref := &image.Reference{Reference: test.reference}
+		err = d.PopulateDigest(context.Background(), ref)
+		if test.expectedError != "" {
+			if err == nil || !strings.Contains(err.Error(), test.expectedError) || !strings.Contains(err.Error(), "--update-lock") {
+				t.Errorf("Expected an error containing %q for %s, but got %v", test.expectedError, test.reference, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.reference, err)
+			continue
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("Expected digest %s for %s with %v, but got %s", test.expected, test.reference, test.preferred, ref.Digest)
+		}
+		// Entries keep the provenance they were locked with, and are otherwise attributed to the lock file.
+		expectedProvenance := &image.Provenance{Source: image.SourceLockFile}
+		if test.reference == "golang:1.19" {
+			expectedProvenance = &image.Provenance{Source: image.SourceRegistry, Credential: "msi"}
+		}
+		if ref.Provenance == nil || ref.Provenance.Source != expectedProvenance.Source || ref.Provenance.Credential != expectedProvenance.Credential {
+			t.Errorf("Expected the provenance %+v for %s, but got %+v", expectedProvenance, test.reference, ref.Provenance)
+		}
+	}
+}
+
+func TestLockDigest_SkipsPinnedReferences(t *testing.T) {
+	d, err := NewLockDigest(&LockFile{Version: lockFileVersion}, nil)
+	if err != nil {
+		t.Fatalf("Failed to create lock digest: %v", err)
+	}
+	refs := []*image.Reference{
+		{Reference: "golang:1.19@" + lockTestDigest1, Digest: lockTestDigest1},
+		{Reference: NoBaseImageSpecifierLatest},
+		nil,
+	}
+	for _, ref := range refs {
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Errorf("Unexpected error for %v: %v", ref, err)
+		}
+	}
+}
+
+func TestLockDigest_RewrittenReferences(t *testing.T) {
+	lock := &LockFile{Version: lockFileVersion, Images: []*LockEntry{{Reference: "golang:1.19", Digest: lockTestDigest1, Platform: platforms.DefaultString()}}}
+	d, err := NewLockDigest(lock, nil)
+	if err != nil {
+		t.Fatalf("Failed to create lock digest: %v", err)
+	}
+	// Rewritten references are locked by the reference they were rewritten from.
+	ref := &image.Reference{Reference: "mirror.azurecr.io/golang:1.19", OriginalReference: "golang:1.19"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != lockTestDigest1 {
+		t.Errorf("Expected digest %s, but got %s", lockTestDigest1, ref.Digest)
+	}
+}
+
+func TestNewBaseImageDigester_LockFilePolicies(t *testing.T) {
+	rewriter, err := NewReferenceRewriter([]RewriteRule{{Type: RewriteRulePrefix, From: "golang:", To: "mirror.azurecr.io/golang:"}})
+	if err != nil {
+		t.Fatalf("Failed to create the rewriter: %v", err)
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetLockFile(&LockFile{Images: []*LockEntry{{Reference: "golang:1.19", Digest: "sha256:locked", Platform: platforms.DefaultString()}}})
+	b.SetReferenceRewriter(rewriter)
+	b.SetMutableTagPolicy(MutableTagPolicyError)
+	helper, err := b.newBaseImageDigester(&staticDigest{digest: "sha256:docker"}, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create the base image digester: %v", err)
+	}
+
+	// Locked references are still rewritten, and subject to the mutable tag policy.
+	ref := &image.Reference{Registry: DockerHubRegistry, Repository: "library/golang", Tag: "1.19", Reference: "golang:1.19"}
+	err = helper.PopulateDigest(context.Background(), ref)
+	if err == nil || !strings.Contains(err.Error(), "mutable tag") {
+		t.Errorf("Expected the mutable tag policy to apply, but got %v", err)
+	}
+	if ref.OriginalReference != "golang:1.19" {
+		t.Errorf("Expected the reference to be rewritten, but got %+v", ref)
+	}
+}
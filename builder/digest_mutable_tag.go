@@ -0,0 +1,81 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/pkg/errors"
+)
+
+// MutableTagPolicy determines what happens when a base image is referenced by a mutable tag
+// without a pinned digest.
+type MutableTagPolicy string
+
+const (
+	// MutableTagPolicyWarn logs a warning naming the reference and the digest it resolved to.
+	MutableTagPolicyWarn MutableTagPolicy = "warn"
+	// MutableTagPolicyError fails the build.
+	MutableTagPolicyError MutableTagPolicy = "error"
+	// MutableTagPolicyOff disables the check.
+	MutableTagPolicyOff MutableTagPolicy = "off"
+)
+
+// ParseMutableTagPolicy parses a MutableTagPolicy. An empty string defaults to MutableTagPolicyWarn.
+func ParseMutableTagPolicy(policy string) (MutableTagPolicy, error) {
+	switch p := MutableTagPolicy(strings.ToLower(policy)); p {
+	case "":
+		return MutableTagPolicyWarn, nil
+	case MutableTagPolicyWarn, MutableTagPolicyError, MutableTagPolicyOff:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid mutable tag policy '%s', expected one of: %s, %s, %s", policy, MutableTagPolicyWarn, MutableTagPolicyError, MutableTagPolicyOff)
+	}
+}
+
+// mutableTagDigest is a DigestHelper which applies a MutableTagPolicy to the references
+// whose digests are populated by another DigestHelper.
+type mutableTagDigest struct {
+	helper      DigestHelper
+	policy      MutableTagPolicy
+	diagnostics func(format string, v ...interface{})
+}
+
+// NewMutableTagDigest creates a DigestHelper which applies the policy to references that only specify a tag.
+// Warnings are reported to diagnostics, which defaults to log.Printf if nil.
+func NewMutableTagDigest(helper DigestHelper, policy MutableTagPolicy, diagnostics func(format string, v ...interface{})) DigestHelper {
+	if diagnostics == nil {
+		diagnostics = log.Printf
+	}
+	return &mutableTagDigest{
+		helper:      helper,
+		policy:      policy,
+		diagnostics: diagnostics,
+	}
+}
+
+var _ DigestHelper = &mutableTagDigest{}
+
+func (d *mutableTagDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	if ref == nil || ref.Digest != "" || IsNoBaseImage(ref) || d.policy == MutableTagPolicyOff {
+		return d.helper.PopulateDigest(ctx, ref)
+	}
+	if err := d.helper.PopulateDigest(ctx, ref); err != nil {
+		return err
+	}
+	if ref.Digest == "" {
+		return nil
+	}
+
+	msg := fmt.Sprintf("base image '%s' uses a mutable tag and resolved to '%s', pin it as '%s@%s' for reproducible builds", ref.Reference, ref.Digest, strings.TrimSuffix(ref.Reference, ":"+ref.Tag), ref.Digest)
+	if d.policy == MutableTagPolicyError {
+		return errors.New(msg)
+	}
+	d.diagnostics("WARNING: %s\n", msg)
+	return nil
+}
@@ -0,0 +1,77 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+)
+
+const mutableTagTestDigest = "sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7"
+
+func TestParseMutableTagPolicy(t *testing.T) {
+	tests := []struct {
+		policy   string
+		expected MutableTagPolicy
+		ok       bool
+	}{
+		{"", MutableTagPolicyWarn, true},
+		{"warn", MutableTagPolicyWarn, true},
+		{"ERROR", MutableTagPolicyError, true},
+		{"off", MutableTagPolicyOff, true},
+		{"fail", "", false},
+	}
+
+	for _, test := range tests {
+		actual, err := ParseMutableTagPolicy(test.policy)
+		if test.ok != (err == nil) {
+			t.Errorf("Expected ok to be %v for %s, but got err: %v", test.ok, test.policy, err)
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %s for %s, but got %s", test.expected, test.policy, actual)
+		}
+	}
+}
+
+func TestMutableTagDigest_PopulateDigest(t *testing.T) {
+	tests := []struct {
+		policy    MutableTagPolicy
+		ref       *image.Reference
+		ok        bool
+		warnCount int
+	}{
+		{MutableTagPolicyWarn, &image.Reference{Tag: "latest", Reference: "golang:latest"}, true, 1},
+		{MutableTagPolicyError, &image.Reference{Tag: "latest", Reference: "golang:latest"}, false, 0},
+		{MutableTagPolicyOff, &image.Reference{Tag: "latest", Reference: "golang:latest"}, true, 0},
+		{MutableTagPolicyError, &image.Reference{Tag: "latest", Digest: mutableTagTestDigest, Reference: "golang:latest@" + mutableTagTestDigest}, true, 0},
+		{MutableTagPolicyError, &image.Reference{Reference: NoBaseImageSpecifierLatest}, true, 0},
+	}
+
+	for _, test := range tests {
+		var warnings []string
+		diagnostics := func(format string, v ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, v...))
+		}
+		helper := NewMutableTagDigest(&staticDigest{digest: mutableTagTestDigest}, test.policy, diagnostics)
+		err := helper.PopulateDigest(context.Background(), test.ref)
+		if test.ok && err != nil {
+			t.Errorf("Expected %s to succeed with policy %s, but got %v", test.ref.Reference, test.policy, err)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), "golang@"+mutableTagTestDigest)) {
+			t.Errorf("Expected %s to fail with policy %s naming the pinned reference, but got %v", test.ref.Reference, test.policy, err)
+		}
+		if len(warnings) != test.warnCount {
+			t.Errorf("Expected %d warnings for %s with policy %s, but got %v", test.warnCount, test.ref.Reference, test.policy, warnings)
+		}
+		for _, w := range warnings {
+			if !strings.Contains(w, mutableTagTestDigest) {
+				t.Errorf("Expected warning to name the resolved digest, but got %s", w)
+			}
+		}
+	}
+}
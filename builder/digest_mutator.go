@@ -0,0 +1,30 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/util"
+)
+
+// ReferenceMutator adjusts a reference before its digest is resolved, e.g. to add a team prefix to its
+// repository or route it to a cache, for organization-specific reference policies. It's called with a copy
+// of the reference, so the original is kept for logs and errors and the resolved digest is populated into it.
+// Only the copy's Registry, Repository and Tag are used to resolve the digest.
+type ReferenceMutator func(ref *image.Reference)
+
+// mutateReference returns the reference to resolve in place of ref, a copy of ref adjusted by the
+// remoteDigest's ReferenceMutator. If there's no mutator, ref itself is returned.
+func (d *remoteDigest) mutateReference(ref *image.Reference) *image.Reference {
+	if d.referenceMutator == nil {
+		return ref
+	}
+	mutated := *ref
+	d.referenceMutator(&mutated)
+	if mutated.Registry != ref.Registry || mutated.Repository != ref.Repository || mutated.Tag != ref.Tag {
+		util.Debugf("Mutated the reference '%s' to resolve it as registry: %s, repository: %s, tag: %s\n",
+			ref.Reference, mutated.Registry, mutated.Repository, mutated.Tag)
+	}
+	return &mutated
+}
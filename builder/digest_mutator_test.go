@@ -0,0 +1,106 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/images"
+)
+
+func TestRemoteDigest_ReferenceMutator(t *testing.T) {
+	registry := newFakeRegistry()
+	expected := registry.addManifest("team/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	var mutated []string
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		ReferenceMutator: func(ref *image.Reference) {
+			mutated = append(mutated, ref.Reference)
+			ref.Registry = host
+			ref.Repository = "team/" + ref.Repository
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+
+	ref := &image.Reference{Registry: "unused.example.com", Repository: "hello", Tag: "v1", Reference: "unused.example.com/hello:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != expected.String() {
+		t.Errorf("Expected digest %s, but got %s", expected, ref.Digest)
+	}
+	if ref.Registry != "unused.example.com" || ref.Repository != "hello" || ref.Reference != "unused.example.com/hello:v1" {
+		t.Errorf("Expected the original reference to be kept, but got %+v", ref)
+	}
+	if len(mutated) != 1 || mutated[0] != "unused.example.com/hello:v1" {
+		t.Errorf("Expected the mutator to be called once with the original reference, but got %v", mutated)
+	}
+	// The mutated registry isn't a mirror, since the reference isn't resolved through a proxy cache.
+	if ref.Provenance == nil || ref.Provenance.Mirror != "" {
+		t.Errorf("Expected no mirror to be recorded, but got %+v", ref.Provenance)
+	}
+}
+
+func TestRemoteDigest_ReferenceMutatorBeforeProxyCache(t *testing.T) {
+	registry := newFakeRegistry()
+	expected := registry.addManifest("cache/team/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	// The allowlist applies to the mutated reference's registry, not the proxy cache it's resolved through.
+	allowlist, err := NewRegistryAllowlist([]string{"upstream.example.com"})
+	if err != nil {
+		t.Fatalf("Failed to create the allowlist: %v", err)
+	}
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		ReferenceMutator: func(ref *image.Reference) {
+			ref.Registry = "upstream.example.com"
+			ref.Repository = "team/" + ref.Repository
+		},
+		ProxyCaches:       []*ProxyCache{{Upstream: "upstream.example.com", Registry: host, Prefix: "cache"}},
+		RegistryAllowlist: allowlist,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+
+	ref := &image.Reference{Registry: "original.example.com", Repository: "hello", Tag: "v1", Reference: "original.example.com/hello:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != expected.String() {
+		t.Errorf("Expected the mutated reference to be routed through the proxy cache and resolve to %s, but got %s", expected, ref.Digest)
+	}
+	if ref.Provenance == nil || ref.Provenance.Mirror != host {
+		t.Errorf("Expected the proxy cache %s to be recorded as the mirror, but got %+v", host, ref.Provenance)
+	}
+}
+
+func TestRemoteDigest_ReferenceMutatorNotCalled(t *testing.T) {
+	called := false
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		ReferenceMutator: func(ref *image.Reference) { called = true },
+	})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	refs := []*image.Reference{
+		{Registry: "example.com", Repository: "hello", Tag: "v1", Digest: "sha256:0123456789012345678901234567890123456789012345678901234567890123", Reference: "example.com/hello:v1"},
+		{Reference: NoBaseImageSpecifierLatest},
+	}
+	for _, ref := range refs {
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Errorf("Unexpected error for %s: %v", ref.Reference, err)
+		}
+	}
+	if called {
+		t.Error("Expected the mutator not to be called for references which aren't resolved")
+	}
+}
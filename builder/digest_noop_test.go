@@ -0,0 +1,45 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+)
+
+func TestNoopDigest(t *testing.T) {
+	ref := &image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: "v1", Reference: "myregistry.azurecr.io/app:v1"}
+	if err := NewNoopDigest().PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != "" {
+		t.Errorf("Expected the reference to be left untouched, but got the digest %s", ref.Digest)
+	}
+}
+
+func TestSkipDigests(t *testing.T) {
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetSkipDigests(true)
+	b.SetLockFile(&LockFile{})
+	helper, err := b.newBaseImageDigester(NewDockerStoreDigest(b.procManager, false), true, nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := helper.(*noopDigest); !ok {
+		t.Errorf("Expected base image digests not to be resolved, but got %T", helper)
+	}
+
+	step := &graph.Step{ID: "build", Build: "-t app .", PinImage: true}
+	if b.shouldPinImage(step) {
+		t.Error("Expected the images of a step not to be pinned when digest resolution is disabled")
+	}
+	b.SetSkipDigests(false)
+	if !b.shouldPinImage(step) {
+		t.Error("Expected the images of a step which sets pinImage to be pinned")
+	}
+}
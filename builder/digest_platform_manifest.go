@@ -0,0 +1,58 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
+	"github.com/docker/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// PlatformManifestUnavailableError is returned when the manifest list of a reference has an entry for the
+// selected platform, but the registry doesn't have the manifest the entry references, which usually means
+// a multi-arch image was pushed incompletely.
+type PlatformManifestUnavailableError struct {
+	// Platform is the platform of the manifest list entry, e.g. linux/arm64.
+	Platform string
+
+	// Digest is the digest of the manifest which isn't available.
+	Digest digest.Digest
+}
+
+func (e *PlatformManifestUnavailableError) Error() string {
+	return fmt.Sprintf("the manifest list has an entry for platform %s, but its manifest %s isn't available in the registry, "+
+		"which usually means the multi-arch image was pushed incompletely; push the image's %s manifest again or prefer another platform",
+		e.Platform, e.Digest, e.Platform)
+}
+
+// verifyPlatformManifest verifies the registry has the platform manifest described by desc, which was selected
+// from the manifest list of name. It returns a PlatformManifestUnavailableError if the registry doesn't.
+func verifyPlatformManifest(ctx context.Context, resolver remotes.Resolver, name string, desc ocispec.Descriptor) error {
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return errors.Wrapf(err, "failed to parse the reference '%s'", name)
+	}
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), desc.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "failed to pin the reference '%s' to %s", name, desc.Digest)
+	}
+	if _, _, err := resolver.Resolve(ctx, pinned.String()); err != nil {
+		if errdefs.IsNotFound(err) {
+			platform := "unknown"
+			if desc.Platform != nil {
+				platform = platforms.Format(*desc.Platform)
+			}
+			return &PlatformManifestUnavailableError{Platform: platform, Digest: desc.Digest}
+		}
+		return errors.Wrapf(err, "failed to verify the platform manifest %s is available", desc.Digest)
+	}
+	return nil
+}
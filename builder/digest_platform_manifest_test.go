@@ -0,0 +1,65 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+func TestRemoteDigest_PlatformManifestUnavailable(t *testing.T) {
+	registry := newFakeRegistry()
+	_, platformDigests := registry.addIndex(t, "library/multi", "v1",
+		ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		ocispec.Platform{OS: "linux", Architecture: "arm64"})
+	// Simulates a broken push, which pushed the manifest list without the arm64 manifest.
+	delete(registry.manifests, "library/multi@"+platformDigests["linux/arm64"].String())
+	host, stop := registry.start()
+	defer stop()
+
+	tests := []struct {
+		preferred []string
+		missing   bool
+	}{
+		{[]string{"linux/amd64"}, false},
+		{[]string{"linux/arm64"}, true},
+		{[]string{"linux/arm64", "linux/amd64"}, true},
+	}
+
+	for _, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{PreferredPlatforms: test.preferred})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/multi", Tag: "v1", Reference: host + "/library/multi:v1"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if !test.missing {
+			if err != nil {
+				t.Fatalf("Unexpected error for %v: %v", test.preferred, err)
+			}
+			if ref.Digest != platformDigests["linux/amd64"].String() {
+				t.Errorf("Expected digest %s for %v, but got %s", platformDigests["linux/amd64"], test.preferred, ref.Digest)
+			}
+			continue
+		}
+		var unavailable *PlatformManifestUnavailableError
+		if !errors.As(err, &unavailable) {
+			t.Fatalf("Expected a PlatformManifestUnavailableError for %v, but got %v", test.preferred, err)
+		}
+		if unavailable.Platform != "linux/arm64" || unavailable.Digest != platformDigests["linux/arm64"] {
+			t.Errorf("Expected the missing manifest %s of linux/arm64 for %v, but got %s of %s", platformDigests["linux/arm64"], test.preferred, unavailable.Digest, unavailable.Platform)
+		}
+		if msg := err.Error(); !strings.Contains(msg, "linux/arm64") || !strings.Contains(msg, platformDigests["linux/arm64"].String()) {
+			t.Errorf("Expected the error to name the platform and the missing manifest, but got %s", msg)
+		}
+		if ref.Digest != "" {
+			t.Errorf("Expected no digest to be populated for %v, but got %s", test.preferred, ref.Digest)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/remotes/docker/auth"
+	"github.com/pkg/errors"
+)
+
+// RegistryConnectionPool shares the HTTP clients, and so the connections, which remoteDigests derive
+// from the same client and settings, so that connections to registries are established once and reused
+// by every step instead of per remoteDigest. It's safe for concurrent use and is meant to be shared by all
+// the remoteDigests of a builder, see RemoteDigestOptions.ConnectionPool.
+type RegistryConnectionPool struct {
+	mu      sync.Mutex
+	clients map[connectionPoolKey]*http.Client
+}
+
+// connectionPoolKey identifies a client by what it's derived from, so registries with different
+// HTTP/2, proxy or client certificate settings never share connections.
+type connectionPoolKey struct {
+	base              *http.Client
+	disableHTTP2      bool
+	proxyCredentials  *ProxyCredentials
+	clientCertificate *ClientCertificate
+}
+
+// NewRegistryConnectionPool creates an empty RegistryConnectionPool.
+func NewRegistryConnectionPool() *RegistryConnectionPool {
+	return &RegistryConnectionPool{clients: make(map[connectionPoolKey]*http.Client)}
+}
+
+// get returns the pooled client for the key, creating it with create if there's none yet.
+// A nil pool always creates a new client.
+func (p *RegistryConnectionPool) get(key connectionPoolKey, create func() (*http.Client, error)) (*http.Client, error) {
+	if p == nil {
+		return create()
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if client, ok := p.clients[key]; ok {
+		return client, nil
+	}
+	client, err := create()
+	if err != nil {
+		return nil, err
+	}
+	p.clients[key] = client
+	return client, nil
+}
+
+// WarmRegistryConnections establishes a connection to each of the registries ahead of the first resolve,
+// by requesting the registry's /v2/ endpoint as a resolve would, so the connections are kept alive and reused
+// by the remoteDigests created with the same opts. The connections respect the registries' plain HTTP,
+// client certificate and proxy settings, and need opts.ConnectionPool to be reused by other remoteDigests.
+// A registry refusing the anonymous request, e.g. with a 401, is still warmed, along with the host of the
+// auth service its challenge points at, if it's another host. Idle connections are closed after a while,
+// see RemoteDigestClientOptions.IdleConnTimeout, so the connections should be warmed right before they're
+// used. It returns the registries which couldn't be connected to, keyed by registry.
+func WarmRegistryConnections(ctx context.Context, opts *RemoteDigestOptions, registries []string) map[string]error {
+	failures := make(map[string]error)
+	d, err := NewRemoteDigestWithOptions(nil, opts)
+	if err != nil {
+		for _, registry := range registries {
+			failures[registry] = err
+		}
+		return failures
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, registry := range registries {
+		registry := strings.ToLower(registry)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := d.warmRegistryConnection(ctx, registry); err != nil {
+				mu.Lock()
+				failures[registry] = err
+				mu.Unlock()
+				return
+			}
+			util.Debugf("Warmed the connection to registry %s\n", registry)
+		}()
+	}
+	wg.Wait()
+	return failures
+}
+
+// warmRegistryConnection requests the /v2/ endpoint of the registry's first host, and the realm of its
+// bearer challenge, if any, when the realm is on another host.
+func (d *remoteDigest) warmRegistryConnection(ctx context.Context, registry string) error {
+	if err := d.registryAllowlist.Check(registry); err != nil {
+		return err
+	}
+	hosts, err := d.registryHosts(registry, nil)(registry)
+	if err != nil {
+		return err
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("no hosts are configured for registry %s", registry)
+	}
+	host := hosts[0]
+	req, err := http.NewRequest(http.MethodGet, host.Scheme+"://"+host.Host+host.Path+"/", nil)
+	if err != nil {
+		return errors.Wrapf(err, "failed to create a request to registry %s", registry)
+	}
+	resp, err := warmConnection(ctx, host.Client, req)
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to registry %s", registry)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return nil
+	}
+	for _, c := range auth.ParseAuthHeader(resp.Header) {
+		if c.Scheme != auth.BearerAuth {
+			continue
+		}
+		realm, err := url.Parse(c.Parameters["realm"])
+		if err != nil || realm.Host == "" || realm.Host == req.URL.Host {
+			return nil
+		}
+		realmReq, err := http.NewRequest(http.MethodGet, realm.String(), nil)
+		if err != nil {
+			return nil
+		}
+		// The auth service accepts the token requests of its registries, so failing to warm it isn't a failure of the registry.
+		if _, err := warmConnection(ctx, host.Client, realmReq); err != nil {
+			util.Debugf("Failed to warm the connection to the auth service %s of registry %s: %v\n", realm.Host, registry, err)
+		} else {
+			util.Debugf("Warmed the connection to the auth service %s of registry %s\n", realm.Host, registry)
+		}
+		return nil
+	}
+	return nil
+}
+
+// warmConnection sends the request, draining its response so the connection is returned to the pool and kept alive.
+func warmConnection(ctx context.Context, client *http.Client, req *http.Request) (*http.Response, error) {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, DefaultMaxManifestSize))
+	resp.Body.Close()
+	return resp, nil
+}
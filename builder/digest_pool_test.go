@@ -0,0 +1,271 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/containerd/containerd/images"
+)
+
+// startCountingRegistry starts the registry, counting the connections made to it.
+func startCountingRegistry(r *fakeRegistry) (string, *int32, func()) {
+	var conns int32
+	server := httptest.NewUnstartedServer(r)
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	server.Start()
+	return strings.TrimPrefix(server.URL, "http://"), &conns, server.Close
+}
+
+func TestWarmRegistryConnections_ReusesConnections(t *testing.T) {
+	registry := newFakeRegistry()
+	expected := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, conns, stop := startCountingRegistry(registry)
+	defer stop()
+
+	tests := []struct {
+		name          string
+		pool          *RegistryConnectionPool
+		expectedConns int32
+	}{
+		{"pooled", NewRegistryConnectionPool(), 1},
+		{"not pooled", nil, 3},
+	}
+	for _, test := range tests {
+		atomic.StoreInt32(conns, 0)
+		// DisableHTTP2 derives a client with its own transport, and so its own connections, per remoteDigest.
+		opts := &RemoteDigestOptions{
+			Client:         &http.Client{Transport: &http.Transport{}},
+			DisableHTTP2:   true,
+			ConnectionPool: test.pool,
+		}
+		if failures := WarmRegistryConnections(context.Background(), opts, []string{host}); len(failures) != 0 {
+			t.Fatalf("%s: failed to warm the connections: %v", test.name, failures)
+		}
+		for i := 0; i < 2; i++ {
+			d, err := NewRemoteDigestWithOptions(nil, opts)
+			if err != nil {
+				t.Fatalf("%s: failed to create remote digest: %v", test.name, err)
+			}
+			ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+			if err := d.PopulateDigest(context.Background(), ref); err != nil {
+				t.Fatalf("%s: unexpected error: %v", test.name, err)
+			}
+			if ref.Digest != expected.String() {
+				t.Errorf("%s: expected digest %s, but got %s", test.name, expected, ref.Digest)
+			}
+		}
+		if actual := atomic.LoadInt32(conns); actual != test.expectedConns {
+			t.Errorf("%s: expected %d connections to the registry, but got %d", test.name, test.expectedConns, actual)
+		}
+	}
+}
+
+func TestWarmRegistryConnections_Unauthorized(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "secret"
+	host, conns, stop := startCountingRegistry(registry)
+	defer stop()
+
+	opts := &RemoteDigestOptions{ConnectionPool: NewRegistryConnectionPool()}
+	if failures := WarmRegistryConnections(context.Background(), opts, []string{host}); len(failures) != 0 {
+		t.Errorf("Expected a registry refusing anonymous requests to be warmed, but got %v", failures)
+	}
+	if actual := atomic.LoadInt32(conns); actual != 1 {
+		t.Errorf("Expected a connection to the registry, but got %d", actual)
+	}
+}
+
+func TestWarmRegistryConnections_AuthService(t *testing.T) {
+	registry := newFakeRegistry()
+	expected := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	authServer := httptest.NewUnstartedServer(&splitAuthServer{username: "user", password: "secret"})
+	var authConns int32
+	authServer.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&authConns, 1)
+		}
+	}
+	authServer.Start()
+	defer authServer.Close()
+	server := httptest.NewServer(&splitAuthRegistry{registry: registry, realm: authServer.URL + "/token"})
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	opts := &RemoteDigestOptions{
+		Client:         &http.Client{Transport: &http.Transport{}},
+		DisableHTTP2:   true,
+		ConnectionPool: NewRegistryConnectionPool(),
+	}
+	if failures := WarmRegistryConnections(context.Background(), opts, []string{host}); len(failures) != 0 {
+		t.Fatalf("Failed to warm the connections: %v", failures)
+	}
+	if actual := atomic.LoadInt32(&authConns); actual != 1 {
+		t.Fatalf("Expected the auth service to be connected to, but got %d connections", actual)
+	}
+
+	creds := graph.RegistryLoginCredentials{
+		host: {
+			Username: &secretmgmt.Secret{ResolvedValue: "user"},
+			Password: &secretmgmt.Secret{ResolvedValue: "secret"},
+		},
+	}
+	d, err := NewRemoteDigestWithOptions(creds, opts)
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != expected.String() {
+		t.Errorf("Expected digest %s, but got %s", expected, ref.Digest)
+	}
+	// The token is requested over the warmed connection.
+	if actual := atomic.LoadInt32(&authConns); actual != 1 {
+		t.Errorf("Expected the connection to the auth service to be reused, but got %d connections", actual)
+	}
+}
+
+func TestRunTask_WarmRegistries(t *testing.T) {
+	host, conns, stop := startCountingRegistry(newFakeRegistry())
+	defer stop()
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `
+steps:
+  - cmd: hello-world
+`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetRemoteDigestOptions(&RemoteDigestOptions{ConnectionPool: NewRegistryConnectionPool()})
+	b.SetWarmRegistries([]string{host})
+	if atomic.LoadInt32(conns) != 0 {
+		t.Fatal("Expected the registry not to be connected to before the task runs")
+	}
+	if err := b.RunTask(context.Background(), task); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if actual := atomic.LoadInt32(conns); actual != 1 {
+		t.Errorf("Expected the registry to be warmed when the task runs, but got %d connections", actual)
+	}
+}
+
+func TestWarmRegistryConnections_Failures(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	unreachable := listener.Addr().String()
+	listener.Close()
+
+	allowlist, err := NewRegistryAllowlist([]string{unreachable})
+	if err != nil {
+		t.Fatalf("Failed to create the allowlist: %v", err)
+	}
+	opts := &RemoteDigestOptions{ConnectionPool: NewRegistryConnectionPool(), RegistryAllowlist: allowlist}
+	failures := WarmRegistryConnections(context.Background(), opts, []string{unreachable, "forbidden.example.com"})
+	if len(failures) != 2 {
+		t.Fatalf("Expected both registries to fail, but got %v", failures)
+	}
+	if !strings.Contains(failures[unreachable].Error(), "failed to connect to registry") {
+		t.Errorf("Expected a connection failure for %s, but got %v", unreachable, failures[unreachable])
+	}
+	if !strings.Contains(failures["forbidden.example.com"].Error(), "policy violation") {
+		t.Errorf("Expected a policy violation for a registry which isn't allowed, but got %v", failures["forbidden.example.com"])
+	}
+}
+
+func TestRegistryConnectionPool_Settings(t *testing.T) {
+	client := &http.Client{Transport: &http.Transport{}}
+	pool := NewRegistryConnectionPool()
+	proxy := &ProxyCredentials{Username: "user", Password: "secret"}
+
+	newClient := func(opts *RemoteDigestOptions) *http.Client {
+		opts.Client, opts.ConnectionPool = client, pool
+		d, err := NewRemoteDigestWithOptions(nil, opts)
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		return d.client
+	}
+
+	http1 := newClient(&RemoteDigestOptions{DisableHTTP2: true})
+	if newClient(&RemoteDigestOptions{DisableHTTP2: true}) != http1 {
+		t.Error("Expected remoteDigests with the same settings to share a client")
+	}
+	if newClient(&RemoteDigestOptions{}) == http1 {
+		t.Error("Expected HTTP/2 and HTTP/1.1 only not to share a client")
+	}
+	proxied := newClient(&RemoteDigestOptions{DisableHTTP2: true, ProxyCredentials: proxy})
+	if proxied == http1 {
+		t.Error("Expected a client authenticating to the proxy not to be shared with one which doesn't")
+	}
+	if newClient(&RemoteDigestOptions{DisableHTTP2: true, ProxyCredentials: proxy}) != proxied {
+		t.Error("Expected remoteDigests with the same proxy credentials to share a client")
+	}
+}
+
+// BenchmarkRemoteDigest_FirstResolve measures the latency of the first resolve of a remoteDigest over TLS,
+// without and with the connection to the registry warmed beforehand.
+func BenchmarkRemoteDigest_FirstResolve(b *testing.B) {
+	registry := newFakeRegistry()
+	registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	server := httptest.NewTLSServer(registry)
+	defer server.Close()
+
+	// The test server's certificate is valid for example.com, which is dialed at the server's address.
+	addr := server.Listener.Addr().String()
+	newOpts := func() *RemoteDigestOptions {
+		transport := server.Client().Transport.(*http.Transport).Clone()
+		transport.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		}
+		return &RemoteDigestOptions{
+			Client:         &http.Client{Transport: transport},
+			ConnectionPool: NewRegistryConnectionPool(),
+		}
+	}
+	resolve := func(b *testing.B, opts *RemoteDigestOptions) {
+		d, err := NewRemoteDigestWithOptions(nil, opts)
+		if err != nil {
+			b.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: "example.com", Repository: "library/hello", Tag: "v1", Reference: "example.com/library/hello:v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			b.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	b.Run("cold", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			resolve(b, newOpts())
+		}
+	})
+	b.Run("warm", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			opts := newOpts()
+			if failures := WarmRegistryConnections(context.Background(), opts, []string{"example.com"}); len(failures) != 0 {
+				b.Fatalf("Failed to warm the connections: %v", failures)
+			}
+			b.StartTimer()
+			resolve(b, opts)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+)
+
+// ProxyCache routes the resolution of references to an upstream registry through a pull-through cache.
+// A reference such as registry.hub.docker.com/library/node:18 is resolved as <Registry>/<Prefix>/library/node:18,
+// authenticating with the credentials configured for the cache's registry instead of the upstream's.
+type ProxyCache struct {
+	// Upstream is the registry whose references are resolved through the cache. It can be a
+	// wildcard such as *.example.com or *, which use the same precedence as registry credentials.
+	Upstream string
+
+	// Registry is the cache's registry, e.g. mycache.azurecr.io.
+	Registry string
+
+	// Prefix, if set, is prepended to the repository of the upstream reference, e.g. when the cache
+	// serves each upstream under its own namespace.
+	Prefix string
+}
+
+// ParseProxyCaches parses proxy caches in the format of 'upstream;cacheRegistry[/prefix]',
+// e.g. 'docker.io;mycache.azurecr.io/dockerhub'.
+func ParseProxyCaches(values []string) ([]*ProxyCache, error) {
+	var caches []*ProxyCache
+	for _, value := range values {
+		parts := strings.Split(value, ";")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid proxy cache '%s', expected the format 'upstream;cacheRegistry[/prefix]'", value)
+		}
+		cache := &ProxyCache{Upstream: parts[0]}
+		cache.Registry, cache.Prefix = splitProxyCacheLocation(parts[1])
+		if cache.Registry == "" {
+			return nil, fmt.Errorf("invalid proxy cache '%s', the cache registry can't be empty", value)
+		}
+		caches = append(caches, cache)
+	}
+	return caches, nil
+}
+
+// String returns the proxy cache in the format parsed by ParseProxyCaches.
+func (c *ProxyCache) String() string {
+	if c.Prefix == "" {
+		return c.Upstream + ";" + c.Registry
+	}
+	return c.Upstream + ";" + c.Registry + "/" + c.Prefix
+}
+
+// splitProxyCacheLocation splits a cache location such as mycache.azurecr.io/dockerhub into its registry and prefix.
+func splitProxyCacheLocation(location string) (string, string) {
+	location = strings.TrimRight(location, "/")
+	if i := strings.Index(location, "/"); i >= 0 {
+		return location[:i], strings.Trim(location[i+1:], "/")
+	}
+	return location, ""
+}
+
+// newProxyCaches indexes the proxy caches by their upstream registry. The Docker Hub aliases
+// docker.io and index.docker.io are normalized to the registry used by image references.
+func newProxyCaches(caches []*ProxyCache) (map[string]*ProxyCache, error) {
+	indexed := make(map[string]*ProxyCache, len(caches))
+	for _, cache := range caches {
+		if cache == nil || cache.Upstream == "" || cache.Registry == "" {
+			return nil, fmt.Errorf("proxy caches require both an upstream and a cache registry")
+		}
+		upstream := strings.ToLower(cache.Upstream)
+		if upstream == "docker.io" || upstream == "index.docker.io" {
+			upstream = scan.DockerHubRegistry
+		}
+		if _, ok := indexed[upstream]; ok {
+			return nil, fmt.Errorf("multiple proxy caches are configured for the upstream registry '%s'", cache.Upstream)
+		}
+		indexed[upstream] = cache
+	}
+	return indexed, nil
+}
+
+// throughProxyCache returns the reference to resolve in place of ref. If ref's registry is routed
+// through a proxy cache, a copy of ref pointing at the cache's registry and repository is returned,
+// keeping the original Reference so that logs and errors still refer to the upstream image.
+// Otherwise, ref itself is returned.
+func (d *remoteDigest) throughProxyCache(ref *image.Reference) *image.Reference {
+	cache := d.proxyCache(ref.Registry)
+	if cache == nil {
+		return ref
+	}
+
+	cached := *ref
+	cached.Registry = cache.Registry
+	if cache.Prefix != "" {
+		cached.Repository = cache.Prefix + "/" + ref.Repository
+	}
+	return &cached
+}
+
+// proxyCache returns the proxy cache the registry is routed through, or nil if it isn't routed through one.
+func (d *remoteDigest) proxyCache(registry string) *ProxyCache {
+	if len(d.proxyCaches) == 0 {
+		return nil
+	}
+	upstreams := make([]string, 0, len(d.proxyCaches))
+	for upstream := range d.proxyCaches {
+		upstreams = append(upstreams, upstream)
+	}
+	upstream, ok := graph.MatchRegistry(registry, upstreams)
+	if !ok {
+		return nil
+	}
+	return d.proxyCaches[upstream]
+}
+
+// accessedRegistry returns the registry which is accessed in place of registry, i.e. its proxy cache's registry
+// if it's routed through one, and registry itself otherwise.
+func (d *remoteDigest) accessedRegistry(registry string) string {
+	if cache := d.proxyCache(registry); cache != nil {
+		return cache.Registry
+	}
+	return registry
+}
@@ -0,0 +1,67 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+// ProxyCredentials are the Basic authentication credentials of the forward proxy which requests
+// to registries are sent through, which are separate from the credentials of the registries.
+type ProxyCredentials struct {
+	Username string
+	Password string
+}
+
+// String describes the credentials without their password, so they can be logged.
+func (c *ProxyCredentials) String() string {
+	return fmt.Sprintf("username: %s, password: %s", c.Username, util.Redact(c.Password))
+}
+
+// newProxyAuthClient creates a copy of client which authenticates to the proxy its transport
+// selects for each request using the credentials. The credentials are sent in the
+// Proxy-Authorization header of each request sent through the proxy, or of the CONNECT request
+// tunneling a TLS connection through it, and are never sent to the registry. Requests which
+// aren't sent through a proxy, e.g. those to hosts in NO_PROXY, aren't affected.
+func newProxyAuthClient(client *http.Client, creds *ProxyCredentials) (*http.Client, error) {
+	if creds.Username == "" {
+		return nil, errors.New("the username of the proxy credentials can't be empty")
+	}
+
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("proxy credentials require an *http.Transport, but the client uses %T", client.Transport)
+	}
+	proxy := transport.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	transport.Proxy = func(req *http.Request) (*url.URL, error) {
+		proxyURL, err := proxy(req)
+		if err != nil || proxyURL == nil {
+			return proxyURL, err
+		}
+		// The transport sends the credentials of the proxy's URL in the Proxy-Authorization header.
+		authenticated := *proxyURL
+		authenticated.User = url.UserPassword(creds.Username, creds.Password)
+		return &authenticated, nil
+	}
+
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}, nil
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/images"
+)
+
+// authenticatingProxy is a forward proxy for plain HTTP requests which challenges requests without
+// the expected Basic credentials in their Proxy-Authorization header, and strips the header from the
+// requests it forwards.
+type authenticatingProxy struct {
+	username string
+	password string
+}
+
+func (p *authenticatingProxy) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	auth := req.Header.Get("Proxy-Authorization")
+	r := &http.Request{Header: http.Header{"Authorization": []string{auth}}}
+	if username, password, ok := r.BasicAuth(); !ok || username != p.username || password != p.password {
+		w.Header().Set("Proxy-Authenticate", `Basic realm="proxy"`)
+		w.WriteHeader(http.StatusProxyAuthRequired)
+		return
+	}
+
+	outReq, err := http.NewRequest(req.Method, req.URL.String(), req.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	for key, values := range req.Header {
+		if key != "Proxy-Authorization" {
+			outReq.Header[key] = values
+		}
+	}
+	resp, err := (&http.Transport{}).RoundTrip(outReq)
+	if err != nil {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for key, values := range resp.Header {
+		w.Header()[key] = values
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func TestRemoteDigest_ProxyCredentials(t *testing.T) {
+	registry := newFakeRegistry()
+	manifestDigest := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	proxy := &authenticatingProxy{username: "proxyuser", password: "proxysecret"}
+	proxyServer := httptest.NewServer(proxy)
+	defer proxyServer.Close()
+	proxyURL, err := url.Parse(proxyServer.URL)
+	if err != nil {
+		t.Fatalf("Failed to parse the proxy URL: %v", err)
+	}
+	// Requests to localhost aren't proxied by default, so the client always uses the proxy.
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+
+	tests := []struct {
+		creds *ProxyCredentials
+		ok    bool
+	}{
+		{&ProxyCredentials{Username: "proxyuser", Password: "proxysecret"}, true},
+		{&ProxyCredentials{Username: "proxyuser", Password: "wrongsecret"}, false},
+		{nil, false},
+	}
+
+	for _, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{Client: client, ProxyCredentials: test.creds})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Expected the proxy to reject %v", test.creds)
+			} else if test.creds != nil && strings.Contains(err.Error(), test.creds.Password) {
+				t.Errorf("Expected the error not to contain the proxy password, but got %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %v", test.creds, err)
+		}
+		if ref.Digest != manifestDigest.String() {
+			t.Errorf("Expected digest %s, but got %s", manifestDigest, ref.Digest)
+		}
+	}
+	if stringer := (&ProxyCredentials{Username: "proxyuser", Password: "proxysecret"}).String(); strings.Contains(stringer, "proxysecret") {
+		t.Errorf("Expected the described credentials to redact the password, but got %s", stringer)
+	}
+
+	if _, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{ProxyCredentials: &ProxyCredentials{Password: "proxysecret"}}); err == nil {
+		t.Error("Expected an error for proxy credentials without a username")
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/containerd/containerd/images"
+)
+
+func TestParseProxyCaches(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected *ProxyCache
+		ok       bool
+	}{
+		{"docker.io;mycache.azurecr.io", &ProxyCache{Upstream: "docker.io", Registry: "mycache.azurecr.io"}, true},
+		{"docker.io;mycache.azurecr.io/dockerhub/", &ProxyCache{Upstream: "docker.io", Registry: "mycache.azurecr.io", Prefix: "dockerhub"}, true},
+		{"*.example.com;harbor.contoso.com/proxy/example", &ProxyCache{Upstream: "*.example.com", Registry: "harbor.contoso.com", Prefix: "proxy/example"}, true},
+		{"docker.io", nil, false},
+		{"docker.io;", nil, false},
+		{";mycache.azurecr.io", nil, false},
+		{"docker.io;/dockerhub", nil, false},
+	}
+
+	for _, test := range tests {
+		caches, err := ParseProxyCaches([]string{test.value})
+		if test.ok != (err == nil) {
+			t.Errorf("Expected ok: %v for %s, but got err: %v", test.ok, test.value, err)
+			continue
+		}
+		if test.ok && !reflect.DeepEqual(caches, []*ProxyCache{test.expected}) {
+			t.Errorf("Expected %+v for %s, but got %+v", test.expected, test.value, caches[0])
+		}
+	}
+}
+
+func TestNewProxyCaches(t *testing.T) {
+	caches, err := newProxyCaches([]*ProxyCache{{Upstream: "Docker.io", Registry: "mycache.azurecr.io"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := caches[scan.DockerHubRegistry]; !ok {
+		t.Errorf("Expected docker.io to be normalized to %s, but got %v", scan.DockerHubRegistry, caches)
+	}
+
+	if _, err := newProxyCaches([]*ProxyCache{
+		{Upstream: "docker.io", Registry: "mycache.azurecr.io"},
+		{Upstream: "index.docker.io", Registry: "othercache.azurecr.io"},
+	}); err == nil {
+		t.Error("Expected an error for multiple caches of the same upstream")
+	}
+}
+
+func TestRemoteDigest_ProxyCache(t *testing.T) {
+	cache := newFakeRegistry()
+	cache.username, cache.password = "cacheuser", "cachesecret"
+	manifestDigest := cache.addManifest("dockerhub/library/node", "18", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := cache.start()
+	defer stop()
+
+	creds := graph.RegistryLoginCredentials{
+		host: {
+			Username: &secretmgmt.Secret{ResolvedValue: "cacheuser"},
+			Password: &secretmgmt.Secret{ResolvedValue: "cachesecret"},
+		},
+		scan.DockerHubRegistry: {
+			Username: &secretmgmt.Secret{ResolvedValue: "upstreamuser"},
+			Password: &secretmgmt.Secret{ResolvedValue: "upstreamsecret"},
+		},
+	}
+	d, err := NewRemoteDigestWithOptions(creds, &RemoteDigestOptions{
+		ProxyCaches: []*ProxyCache{{Upstream: "docker.io", Registry: host, Prefix: "dockerhub"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	ref := &image.Reference{Registry: scan.DockerHubRegistry, Repository: "library/node", Tag: "18", Reference: "node:18"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &image.Reference{Registry: scan.DockerHubRegistry, Repository: "library/node", Tag: "18", Reference: "node:18", Digest: manifestDigest.String()}
+	if !image.Equals(ref, expected) {
+		t.Errorf("Expected %v, but got %v", expected, ref)
+	}
+	if ref.Provenance == nil || ref.Provenance.Mirror != host || ref.Provenance.Source != image.SourceRegistry {
+		t.Errorf("Expected the provenance to record the proxy cache %s, but got %+v", host, ref.Provenance)
+	}
+
+	// Errors refer to the upstream reference.
+	ref = &image.Reference{Registry: scan.DockerHubRegistry, Repository: "library/missing", Tag: "1", Reference: "missing:1"}
+	err = d.PopulateDigest(context.Background(), ref)
+	if err == nil || !strings.Contains(err.Error(), "'missing:1'") {
+		t.Errorf("Expected an error referring to missing:1, but got %v", err)
+	}
+}
+
+func TestRemoteDigest_ProxyCacheAllowlist(t *testing.T) {
+	cache := newFakeRegistry()
+	cache.addManifest("dockerhub/library/node", "18", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := cache.start()
+	defer stop()
+
+	tests := []struct {
+		name       string
+		allowed    string
+		shouldFail bool
+	}{
+		// The allowlist applies to the upstream registry the reference names, not the cache it's resolved through.
+		{"upstream allowed", "docker.io", false},
+		{"only the cache allowed", host, true},
+	}
+	for _, test := range tests {
+		allowlist, err := NewRegistryAllowlist([]string{test.allowed})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+			ProxyCaches:       []*ProxyCache{{Upstream: "docker.io", Registry: host, Prefix: "dockerhub"}},
+			RegistryAllowlist: allowlist,
+		})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		ref := &image.Reference{Registry: scan.DockerHubRegistry, Repository: "library/node", Tag: "18", Reference: "node:18"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if test.shouldFail && (err == nil || !strings.Contains(err.Error(), "policy violation")) {
+			t.Errorf("%s: expected a policy violation, but got %v", test.name, err)
+		} else if !test.shouldFail && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+	}
+}
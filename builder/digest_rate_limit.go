@@ -0,0 +1,151 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/util"
+)
+
+// rateLimitHeaderPrefixes are the prefixes of the headers registries report rate limits with, in order
+// of precedence, e.g. RateLimit-Remaining as reported by Docker Hub and X-RateLimit-Remaining.
+var rateLimitHeaderPrefixes = []string{"RateLimit-", "X-RateLimit-", "Docker-RateLimit-"}
+
+// rateLimitSourceHeader is the header Docker Hub reports what the rate limit applies to with,
+// i.e. the client's IP address or the authenticated user's ID.
+const rateLimitSourceHeader = "Docker-RateLimit-Source"
+
+// RateLimit is the rate limit a registry reported in response to resolving a reference.
+type RateLimit struct {
+	// Registry is the registry which reported the rate limit.
+	Registry string
+
+	// Limit is the number of requests allowed per Window, 0 if unreported.
+	Limit int
+
+	// Remaining is the number of requests remaining in the current Window.
+	Remaining int
+
+	// Window is the period the limit applies to, e.g. 6h for Docker Hub, 0 if unreported.
+	Window time.Duration
+
+	// Reset is when the current window ends, relative to the response, 0 if unreported.
+	Reset time.Duration
+
+	// Source is what the limit applies to, e.g. an IP address, empty if unreported.
+	Source string
+}
+
+// RateLimitObserver is notified of each rate limit reported by a registry while resolving references.
+type RateLimitObserver func(limit *RateLimit)
+
+// parseRateLimit parses the rate limit reported by the headers of a registry's response.
+// It returns false if the response doesn't report how many requests remain.
+func parseRateLimit(registry string, header http.Header) (*RateLimit, bool) {
+	for _, prefix := range rateLimitHeaderPrefixes {
+		remaining, _, ok := parseRateLimitValue(header.Get(prefix + "Remaining"))
+		if !ok {
+			continue
+		}
+		limit := &RateLimit{
+			Registry:  registry,
+			Remaining: remaining,
+			Source:    header.Get(rateLimitSourceHeader),
+		}
+		if value, window, ok := parseRateLimitValue(header.Get(prefix + "Limit")); ok {
+			limit.Limit, limit.Window = value, window
+		}
+		if reset, _, ok := parseRateLimitValue(header.Get(prefix + "Reset")); ok {
+			limit.Reset = time.Duration(reset) * time.Second
+		}
+		return limit, true
+	}
+	return nil, false
+}
+
+// parseRateLimitValue parses a rate limit header's value, e.g. 100;w=21600, into the value and the
+// window of its w parameter, in seconds. Only the first policy of values listing several is parsed,
+// and malformed values are ignored.
+func parseRateLimitValue(value string) (int, time.Duration, bool) {
+	if i := strings.Index(value, ","); i >= 0 {
+		value = value[:i]
+	}
+	params := strings.Split(value, ";")
+	n, err := strconv.Atoi(strings.TrimSpace(params[0]))
+	if err != nil || n < 0 {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, param := range params[1:] {
+		param = strings.TrimSpace(param)
+		if strings.HasPrefix(param, "w=") {
+			if seconds, err := strconv.Atoi(param[len("w="):]); err == nil && seconds > 0 {
+				window = time.Duration(seconds) * time.Second
+			}
+		}
+	}
+	return n, window, true
+}
+
+// rateLimitTransport reports the rate limits in the responses of a registry to an observer,
+// and logs them when the verbosity is debug.
+type rateLimitTransport struct {
+	registry string
+	observer RateLimitObserver
+	next     http.RoundTripper
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if limit, ok := parseRateLimit(t.registry, resp.Header); ok {
+		util.Debugf("Registry rate limit: %s has %d of %d requests remaining\n", limit.Registry, limit.Remaining, limit.Limit)
+		if t.observer != nil {
+			t.observer(limit)
+		}
+	}
+	return resp, nil
+}
+
+// withRateLimitReporting returns a copy of client which reports the rate limits of the registry to the
+// observer, if not nil, and logs them if the verbosity is debug.
+func withRateLimitReporting(client *http.Client, registry string, observer RateLimitObserver) *http.Client {
+	if observer == nil && util.GetVerbosity() < util.VerbosityDebug {
+		return client
+	}
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	reporting := *client
+	reporting.Transport = &rateLimitTransport{registry: registry, observer: observer, next: next}
+	return &reporting
+}
+
+// chainRateLimitObservers returns an observer notifying each of the observers which isn't nil.
+func chainRateLimitObservers(observers ...RateLimitObserver) RateLimitObserver {
+	var chained []RateLimitObserver
+	for _, observer := range observers {
+		if observer != nil {
+			chained = append(chained, observer)
+		}
+	}
+	switch len(chained) {
+	case 0:
+		return nil
+	case 1:
+		return chained[0]
+	}
+	return func(limit *RateLimit) {
+		for _, observer := range chained {
+			observer(limit)
+		}
+	}
+}
@@ -0,0 +1,147 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/images"
+)
+
+func TestParseRateLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected *RateLimit
+	}{
+		{
+			"docker hub",
+			http.Header{
+				"Ratelimit-Limit":         []string{"100;w=21600"},
+				"Ratelimit-Remaining":     []string{"76;w=21600"},
+				"Docker-Ratelimit-Source": []string{"192.0.2.1"},
+			},
+			&RateLimit{Registry: "docker.io", Limit: 100, Remaining: 76, Window: 6 * time.Hour, Source: "192.0.2.1"},
+		},
+		{
+			"x- prefixed with reset",
+			http.Header{
+				"X-Ratelimit-Limit":     []string{"5000"},
+				"X-Ratelimit-Remaining": []string{"4999"},
+				"X-Ratelimit-Reset":     []string{"60"},
+			},
+			&RateLimit{Registry: "docker.io", Limit: 5000, Remaining: 4999, Reset: time.Minute},
+		},
+		{
+			"docker prefixed",
+			http.Header{"Docker-Ratelimit-Remaining": []string{"10"}},
+			&RateLimit{Registry: "docker.io", Remaining: 10},
+		},
+		{
+			"several policies",
+			http.Header{
+				"Ratelimit-Limit":     []string{"10, 10;w=1, 1000;w=3600"},
+				"Ratelimit-Remaining": []string{"9"},
+			},
+			&RateLimit{Registry: "docker.io", Limit: 10, Remaining: 9},
+		},
+		{
+			"malformed limit",
+			http.Header{
+				"Ratelimit-Limit":     []string{"lots"},
+				"Ratelimit-Remaining": []string{"9;w=abc"},
+			},
+			&RateLimit{Registry: "docker.io", Remaining: 9},
+		},
+		{"no remaining", http.Header{"Ratelimit-Limit": []string{"100;w=21600"}}, nil},
+		{"malformed remaining", http.Header{"Ratelimit-Remaining": []string{"-1"}}, nil},
+		{"none", http.Header{}, nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			actual, ok := parseRateLimit("docker.io", test.header)
+			if ok != (test.expected != nil) {
+				t.Fatalf("Expected a rate limit to be parsed: %v, but got %v", test.expected != nil, ok)
+			}
+			if !reflect.DeepEqual(actual, test.expected) {
+				t.Errorf("Expected %+v, but got %+v", test.expected, actual)
+			}
+		})
+	}
+}
+
+func TestRemoteDigest_RateLimitObserver(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	remaining := 10
+	var mu sync.Mutex
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Path, "/manifests/") {
+			mu.Lock()
+			w.Header().Set("RateLimit-Limit", "100;w=21600")
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining)+";w=21600")
+			remaining--
+			mu.Unlock()
+		}
+		registry.ServeHTTP(w, req)
+	}))
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	var observed []*RateLimit
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		RateLimitObserver: func(limit *RateLimit) {
+			mu.Lock()
+			defer mu.Unlock()
+			observed = append(observed, limit)
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(observed) != 2 {
+		t.Fatalf("Expected a rate limit for each resolve, but got %d", len(observed))
+	}
+	for i, limit := range observed {
+		expected := &RateLimit{Registry: host, Limit: 100, Remaining: 10 - i, Window: 6 * time.Hour}
+		if !reflect.DeepEqual(limit, expected) {
+			t.Errorf("Expected the rate limit %+v, but got %+v", expected, limit)
+		}
+	}
+}
+
+func TestChainRateLimitObservers(t *testing.T) {
+	if chainRateLimitObservers(nil, nil) != nil {
+		t.Error("Expected no observer when chaining only nil observers")
+	}
+	var calls []string
+	observer := chainRateLimitObservers(
+		func(*RateLimit) { calls = append(calls, "a") },
+		nil,
+		func(*RateLimit) { calls = append(calls, "b") },
+	)
+	observer(&RateLimit{})
+	if !reflect.DeepEqual(calls, []string{"a", "b"}) {
+		t.Errorf("Expected both observers to be notified in order, but got %v", calls)
+	}
+}
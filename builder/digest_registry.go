@@ -0,0 +1,50 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"strings"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/util"
+)
+
+// registryDigest populates the digests of references using the DigestHelper registered for their registry,
+// and using a fallback for the references of other registries.
+type registryDigest struct {
+	helpers  map[string]DigestHelper
+	patterns []string
+	fallback DigestHelper
+}
+
+// NewRegistryDigest creates a DigestHelper which populates the digests of references using the helper registered
+// for their registry, e.g. a content-addressed store which isn't a Docker registry, and using fallback otherwise.
+// Helpers are registered by registry name, or by a pattern with the same precedence as registry credentials:
+// the registry itself, followed by the longest matching wildcard, e.g. *.example.com, followed by *.
+// Registries are compared case-insensitively.
+func NewRegistryDigest(helpers map[string]DigestHelper, fallback DigestHelper) DigestHelper {
+	d := &registryDigest{helpers: make(map[string]DigestHelper, len(helpers)), fallback: fallback}
+	for registry, helper := range helpers {
+		if helper == nil {
+			continue
+		}
+		registry = strings.ToLower(registry)
+		d.helpers[registry] = helper
+		d.patterns = append(d.patterns, registry)
+	}
+	return d
+}
+
+func (d *registryDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	if ref == nil {
+		return nil
+	}
+	if pattern, ok := graph.MatchRegistry(ref.Registry, d.patterns); ok {
+		util.Debugf("Resolving '%s' using the digest helper registered for %s\n", ref.Reference, pattern)
+		return d.helpers[pattern].PopulateDigest(ctx, ref)
+	}
+	return d.fallback.PopulateDigest(ctx, ref)
+}
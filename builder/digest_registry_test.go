@@ -0,0 +1,83 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+)
+
+func TestRegistryDigest_PopulateDigest(t *testing.T) {
+	helpers := map[string]DigestHelper{
+		"store.example.com":    &staticDigest{digest: "sha256:store"},
+		"*.Example.com":        &staticDigest{digest: "sha256:wildcard"},
+		"*.mirror.example.com": &staticDigest{digest: "sha256:mirror"},
+		"nil.example.com":      nil,
+	}
+	d := NewRegistryDigest(helpers, &staticDigest{digest: "sha256:fallback"})
+
+	tests := []struct {
+		registry string
+		expected string
+	}{
+		{"store.example.com", "sha256:store"},
+		{"STORE.example.com", "sha256:store"},
+		{"other.example.com", "sha256:wildcard"},
+		{"eu.mirror.example.com", "sha256:mirror"},
+		{"nil.example.com", "sha256:wildcard"},
+		{"myregistry.azurecr.io", "sha256:fallback"},
+	}
+
+	for _, test := range tests {
+		ref := &image.Reference{Registry: test.registry, Repository: "app", Tag: "v1", Reference: test.registry + "/app:v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error for %s: %v", test.registry, err)
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("Expected digest %s for %s, but got %s", test.expected, test.registry, ref.Digest)
+		}
+	}
+}
+
+func TestRegistryDigest_Default(t *testing.T) {
+	d := NewRegistryDigest(map[string]DigestHelper{"*": &staticDigest{digest: "sha256:default"}}, &staticDigest{digest: "sha256:fallback"})
+	ref := &image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Reference: "myregistry.azurecr.io/app"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != "sha256:default" {
+		t.Errorf("Expected the helper registered for * to be used, but got %s", ref.Digest)
+	}
+}
+
+func TestBuilder_RegisterDigestHelper(t *testing.T) {
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.RegisterDigestHelper("Store.example.com", &staticDigest{digest: "sha256:store"})
+
+	helper, err := b.newBaseImageDigester(&staticDigest{digest: "sha256:docker"}, false, nil, nil)
+	if err != nil {
+		t.Fatalf("Failed to create the base image digester: %v", err)
+	}
+	store := &image.Reference{Registry: "store.example.com", Repository: "app", Tag: "v1", Reference: "store.example.com/app:v1"}
+	other := &image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: "v1", Reference: "myregistry.azurecr.io/app:v1"}
+	for _, ref := range []*image.Reference{store, other} {
+		if err := helper.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error for %s: %v", ref.Reference, err)
+		}
+	}
+	if store.Digest != "sha256:store" {
+		t.Errorf("Expected the registered helper to populate %s, but got %s", store.Reference, store.Digest)
+	}
+	if other.Digest != "sha256:docker" {
+		t.Errorf("Expected the default helper to populate %s, but got %s", other.Reference, other.Digest)
+	}
+
+	b.RegisterDigestHelper("store.example.com", nil)
+	if len(b.digestHelpers) != 0 {
+		t.Errorf("Expected registering a nil helper to remove the registry's helper, but got %v", b.digestHelpers)
+	}
+}
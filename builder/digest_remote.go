@@ -2,24 +2,421 @@ package builder
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"strings"
+	"time"
 
 	"github.com/Azure/acr-builder/graph"
 	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/tokenutil"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/containerd/containerd/remotes"
 	"github.com/containerd/containerd/remotes/docker"
 	"github.com/docker/distribution/reference"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/pkg/errors"
 )
 
+const (
+	// maxNestedIndexDepth limits how deeply image indexes are walked looking for platform manifests.
+	maxNestedIndexDepth = 5
+
+	// attestationReferenceTypeAnnotation marks the attestation manifests which buildkit adds to image indexes.
+	attestationReferenceTypeAnnotation = "vnd.docker.reference.type"
+
+	// DefaultMaxManifestSize is the default maximum size of a manifest list fetched to select a platform.
+	// It's the 4 MiB limit which registries commonly enforce on manifests.
+	DefaultMaxManifestSize = 4 << 20
+
+	// DefaultTag is the default tag resolved for references which don't specify a tag.
+	DefaultTag = "latest"
+
+	// ociFirstAccept is the Accept header of resolves which prefer OCI media types.
+	ociFirstAccept = ocispec.MediaTypeImageIndex + ", " + ocispec.MediaTypeImageManifest + ", " +
+		images.MediaTypeDockerSchema2ManifestList + ";q=0.9, " + images.MediaTypeDockerSchema2Manifest + ";q=0.9, */*;q=0.8"
+
+	// unknownCredential is the credential type recorded in the provenance of digests resolved
+	// with a credential whose class isn't known.
+	unknownCredential = "unknown"
+)
+
+// RemoteDigestOptions configures how a remoteDigest resolves references.
+type RemoteDigestOptions struct {
+	// PreferredPlatforms is an ordered list of platforms, e.g. linux/amd64, used to select
+	// a manifest when a reference resolves to a manifest list. The first platform with a
+	// matching manifest wins. If empty, the digest of the manifest list itself is used.
+	PreferredPlatforms []string
+
+	// DefaultToHostPlatform selects the platform of the host, e.g. linux/amd64, when a reference resolves
+	// to a manifest list and no PreferredPlatforms are specified, instead of using the manifest list's digest.
+	DefaultToHostPlatform bool
+
+	// CredentialSources maps a registry to an ordered list of credential sources. When a
+	// registry has credential sources, each one is tried in order until a reference resolves,
+	// moving on to the next one if acquiring the credentials or authenticating fails.
+	// Registries without credential sources use the resolved registry login credentials.
+	CredentialSources map[string][]*CredentialSource
+
+	// Client is the HTTP client used to communicate with registries. It can be shared across
+	// remoteDigests to reuse connections, see NewRemoteDigestClient. If nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// RequireCredentials fails resolving a reference whose registry has no configured credentials
+	// instead of falling back to an anonymous pull, unless the registry is in PublicRegistries.
+	RequireCredentials bool
+
+	// PublicRegistries are the registries which can be accessed anonymously when RequireCredentials is set.
+	PublicRegistries []string
+
+	// AnonymousFirst resolves references anonymously first, even if their registry has credentials, and only
+	// resolves them using the credentials if the registry refuses the anonymous request, e.g. with a 401, so
+	// public images don't consume the credentials' token quota. With RequireCredentials, only the references of
+	// PublicRegistries are resolved anonymously first. By default, references are resolved using credentials.
+	AnonymousFirst bool
+
+	// DisableHTTP2 only speaks HTTP/1.1 to registries and proxies, instead of negotiating HTTP/2 when
+	// they support it, as a workaround for intermediaries which break under HTTP/2. It applies to
+	// Client, or http.DefaultClient, which must use an *http.Transport.
+	DisableHTTP2 bool
+
+	// ProxyCredentials authenticate to the forward proxy which requests to registries are sent through,
+	// e.g. the proxy configured by HTTPS_PROXY, using Basic authentication. If nil, the proxy isn't authenticated to.
+	ProxyCredentials *ProxyCredentials
+
+	// ClientCertificates maps a registry to the TLS client certificate presented when connecting to it.
+	// Registries with a client certificate are always accessed over TLS, including localhost.
+	ClientCertificates map[string]*ClientCertificate
+
+	// Limiter throttles resolves per registry. It should be shared across remoteDigests,
+	// see NewRegistryLimiter. If nil, resolves aren't throttled.
+	Limiter *RegistryLimiter
+
+	// MaxManifestSize is the maximum size in bytes of a manifest list fetched to select a platform or
+	// get the digest of each platform. Larger manifest lists fail instead of being read. If zero,
+	// DefaultMaxManifestSize is used.
+	MaxManifestSize int64
+
+	// ProxyCaches route the resolution of references to upstream registries through pull-through caches,
+	// using the credentials and client certificates configured for each cache's registry. They only apply to
+	// resolving digests: images are still pulled from the upstream registry, by the resolved digest.
+	ProxyCaches []*ProxyCache
+
+	// DefaultTag is the tag resolved for references which don't specify a tag, e.g. stable. If empty,
+	// latest is used for backward compatibility. It only affects the resolution of untagged references, i.e. whose Tag is empty,
+	// while references parsed from an image name which is normalized, like the base images of a build,
+	// are already tagged latest if they don't specify a tag.
+	DefaultTag string
+
+	// ResolvePolicy is the timeout and retries of resolving references against registries without a
+	// policy in RegistryResolvePolicies. If zero, each reference is resolved once, limited by the context.
+	ResolvePolicy ResolvePolicy
+
+	// RegistryResolvePolicies override ResolvePolicy for the registries they're keyed by, which may be
+	// wildcards such as *.azurecr.io, matched like the registries of credentials, see ParseResolvePolicies.
+	RegistryResolvePolicies map[string]*ResolvePolicy
+
+	// RegistryAllowlist is the set of registries which may be contacted. References to any other registry
+	// fail with a policy violation before a connection is made. If nil, every registry may be contacted.
+	RegistryAllowlist *RegistryAllowlist
+
+	// ConnectionPool shares the HTTP clients derived from Client, e.g. to disable HTTP/2, authenticate to the proxy
+	// or present client certificates, across remoteDigests, so their connections to registries are reused, including
+	// the connections established by WarmRegistryConnections. If nil, each remoteDigest derives its own clients.
+	ConnectionPool *RegistryConnectionPool
+
+	// ReferenceMutator adjusts each reference before its digest is resolved, after the rewrite rules of
+	// NewRewriteDigest, which wrap the remoteDigest, and before ProxyCaches. If nil, references aren't adjusted.
+	ReferenceMutator ReferenceMutator
+
+	// RateLimitObserver is notified of the rate limits registries report via headers such as RateLimit-Remaining,
+	// e.g. Docker Hub's pull quota, while resolving references. Responses without them aren't reported.
+	RateLimitObserver RateLimitObserver
+
+	// PreferOCIMediaTypes lists the OCI manifest and index media types before Docker's in the Accept header
+	// of resolves, with a higher quality value, so registries which serve both variants of an image return
+	// the OCI one and its digest is resolved. This can change the digest resolved for such dual-published
+	// images. By default, Docker's media types are listed first, like containerd does.
+	PreferOCIMediaTypes bool
+}
+
+// platformPreference returns the platforms used to select a manifest from a manifest list,
+// which default to the host's platform if DefaultToHostPlatform is set.
+func (opts *RemoteDigestOptions) platformPreference() []string {
+	if len(opts.PreferredPlatforms) == 0 && opts.DefaultToHostPlatform {
+		return []string{HostPlatform()}
+	}
+	return opts.PreferredPlatforms
+}
+
+// parsePlatforms parses preferred platforms, e.g. linux/amd64.
+func parsePlatforms(values []string) ([]ocispec.Platform, error) {
+	var parsed []ocispec.Platform
+	for _, p := range values {
+		platform, err := platforms.Parse(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid preferred platform '%s'", p)
+		}
+		parsed = append(parsed, platform)
+	}
+	return parsed, nil
+}
+
+// HostPlatform returns the platform acb is running on, e.g. linux/amd64 or linux/arm64/v8.
+func HostPlatform() string {
+	return platforms.Format(platforms.DefaultSpec())
+}
+
+// RemoteDigestClientOptions configures the connection pooling of a client created by NewRemoteDigestClient.
+// Zero values use the defaults of http.DefaultTransport.
+type RemoteDigestClientOptions struct {
+	// MaxIdleConns is the maximum number of idle connections across all registries.
+	MaxIdleConns int
+
+	// MaxIdleConnsPerHost is the maximum number of idle connections kept per registry.
+	MaxIdleConnsPerHost int
+
+	// IdleConnTimeout is how long an idle connection is kept before it's closed.
+	IdleConnTimeout time.Duration
+
+	// Timeout limits the time taken by each request, including reading the response body.
+	Timeout time.Duration
+}
+
+// NewRemoteDigestClient creates an HTTP client for resolving digests which is safe to share across
+// remoteDigests and tasks, so that connections to registries are pooled and reused.
+func NewRemoteDigestClient(opts *RemoteDigestClientOptions) *http.Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	client := &http.Client{Transport: transport}
+	if opts == nil {
+		return client
+	}
+	if opts.MaxIdleConns > 0 {
+		transport.MaxIdleConns = opts.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		transport.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	if opts.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	client.Timeout = opts.Timeout
+	return client
+}
+
+// CredentialSource is a named source of registry credentials, e.g. an MSI identity or a service principal.
+type CredentialSource struct {
+	// Name identifies the source in error messages.
+	Name string
+
+	// Type is the class of the credential, e.g. msi, recorded in the provenance of the digests resolved
+	// using the source. If empty, Name is recorded.
+	Type string
+
+	// Credentials returns the username and password to authenticate with.
+	Credentials func(ctx context.Context) (string, string, error)
+
+	// Invalidate, if not nil, discards the cached credentials, so Credentials returns fresh ones.
+	// It's called when the registry rejects the credentials with a 401.
+	Invalidate func()
+}
+
+// NewCredentialSources creates credential sources for each registry with more than one credential,
+// in the order the credentials were specified. Each credential is resolved when it's first needed.
+func NewCredentialSources(credentials []*graph.RegistryCredential) map[string][]*CredentialSource {
+	credsByRegistry := make(map[string][]*graph.RegistryCredential)
+	for _, cred := range credentials {
+		if cred != nil {
+			credsByRegistry[cred.Registry] = append(credsByRegistry[cred.Registry], cred)
+		}
+	}
+
+	sources := make(map[string][]*CredentialSource)
+	for registry, creds := range credsByRegistry {
+		if len(creds) < 2 {
+			continue
+		}
+		for _, cred := range creds {
+			cred := cred
+			source := &CredentialSource{
+				Name: cred.ProviderName(),
+				Type: cred.Type(),
+				Credentials: func(ctx context.Context) (string, string, error) {
+					resolved, err := graph.ResolveCustomRegistryCredentials(ctx, []*graph.RegistryCredential{cred})
+					if err != nil {
+						return "", "", err
+					}
+					resolvedCred := resolved[cred.Registry]
+					if resolvedCred.BearerToken {
+						return bearerTokenUsername, resolvedCred.Password.ResolvedValue, nil
+					}
+					return resolvedCred.Username.ResolvedValue, resolvedCred.Password.ResolvedValue, nil
+				},
+			}
+			if cred.Type() == graph.MSI {
+				// MSI credentials are resolved with tokens cached for their lifetime.
+				source.Invalidate = func() {
+					tokenutil.DefaultRegistryTokenCache.Invalidate(cred.Registry, cred.AadResourceID, cred.Identity)
+				}
+			}
+			sources[registry] = append(sources[registry], source)
+		}
+	}
+	return sources
+}
+
+// mergeCredentialSources returns the union of both sets of credential sources,
+// preferring the explicitly configured sources when both specify a registry.
+func mergeCredentialSources(configured map[string][]*CredentialSource, other map[string][]*CredentialSource) map[string][]*CredentialSource {
+	merged := make(map[string][]*CredentialSource, len(configured)+len(other))
+	for registry, sources := range other {
+		merged[registry] = sources
+	}
+	for registry, sources := range configured {
+		merged[registry] = sources
+	}
+	return merged
+}
+
 type remoteDigest struct {
-	registryCreds graph.RegistryLoginCredentials
+	registryCreds        graph.CredentialProvider
+	preferredPlatforms   []ocispec.Platform
+	credentialSources    map[string][]*CredentialSource
+	client               *http.Client
+	requireCredentials   bool
+	publicRegistries     map[string]bool
+	anonymousFirst       bool
+	tlsClients           map[string]*http.Client
+	limiter              *RegistryLimiter
+	proxyCaches          map[string]*ProxyCache
+	maxManifestSize      int64
+	defaultTag           string
+	defaultResolvePolicy ResolvePolicy
+	resolvePolicies      map[string]*ResolvePolicy
+	registryAllowlist    *RegistryAllowlist
+	rateLimitObserver    RateLimitObserver
+	preferOCIMediaTypes  bool
+	referenceMutator     ReferenceMutator
+	authorizers          *authorizerCache
+}
+
+// newTransportClient returns the client which requests to registries are sent with, derived from client to
+// disable HTTP/2 and authenticate to the proxy as configured by opts.
+func newTransportClient(client *http.Client, opts *RemoteDigestOptions) (*http.Client, error) {
+	if opts.DisableHTTP2 {
+		http1, err := newHTTP1Client(client)
+		if err != nil {
+			return nil, err
+		}
+		util.Debugf("Resolving digests over HTTP/1.1 only\n")
+		client = http1
+	}
+	if opts.ProxyCredentials != nil {
+		proxied, err := newProxyAuthClient(client, opts.ProxyCredentials)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid proxy credentials")
+		}
+		util.Debugf("Authenticating to the proxy with %s\n", opts.ProxyCredentials)
+		client = proxied
+	}
+	return client, nil
 }
 
-func NewRemoteDigest(creds graph.RegistryLoginCredentials) *remoteDigest {
+// NewRemoteDigest creates a remoteDigest which authenticates using the credentials from creds,
+// e.g. graph.RegistryLoginCredentials. If creds is nil, references are resolved anonymously.
+func NewRemoteDigest(creds graph.CredentialProvider) *remoteDigest {
+	if creds == nil {
+		creds = graph.RegistryLoginCredentials{}
+	}
 	return &remoteDigest{
-		registryCreds: creds,
+		registryCreds:   creds,
+		client:          http.DefaultClient,
+		maxManifestSize: DefaultMaxManifestSize,
+		defaultTag:      DefaultTag,
+		authorizers:     newAuthorizerCache(),
+	}
+}
+
+// NewRemoteDigestWithOptions creates a remoteDigest configured with the specified options.
+func NewRemoteDigestWithOptions(creds graph.CredentialProvider, opts *RemoteDigestOptions) (*remoteDigest, error) {
+	d := NewRemoteDigest(creds)
+	if opts == nil {
+		return d, nil
+	}
+	preferredPlatforms, err := parsePlatforms(opts.platformPreference())
+	if err != nil {
+		return nil, err
+	}
+	d.preferredPlatforms = preferredPlatforms
+	d.credentialSources = opts.CredentialSources
+	if opts.Client != nil {
+		d.client = opts.Client
+	}
+	key := connectionPoolKey{base: d.client, disableHTTP2: opts.DisableHTTP2, proxyCredentials: opts.ProxyCredentials}
+	client, err := opts.ConnectionPool.get(key, func() (*http.Client, error) {
+		return newTransportClient(key.base, opts)
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.client = client
+	d.requireCredentials = opts.RequireCredentials
+	d.publicRegistries = make(map[string]bool, len(opts.PublicRegistries))
+	for _, registry := range opts.PublicRegistries {
+		d.publicRegistries[strings.ToLower(registry)] = true
+	}
+	d.anonymousFirst = opts.AnonymousFirst
+	d.limiter = opts.Limiter
+	proxyCaches, err := newProxyCaches(opts.ProxyCaches)
+	if err != nil {
+		return nil, err
+	}
+	d.proxyCaches = proxyCaches
+	if opts.MaxManifestSize < 0 {
+		return nil, fmt.Errorf("invalid maximum manifest size %d, it can't be negative", opts.MaxManifestSize)
+	}
+	if opts.MaxManifestSize > 0 {
+		d.maxManifestSize = opts.MaxManifestSize
+	}
+	if opts.DefaultTag != "" {
+		if _, err := reference.Parse("image:" + opts.DefaultTag); err != nil {
+			return nil, errors.Wrapf(err, "invalid default tag '%s'", opts.DefaultTag)
+		}
+		d.defaultTag = opts.DefaultTag
+	}
+	if err := opts.ResolvePolicy.validate(); err != nil {
+		return nil, err
+	}
+	d.defaultResolvePolicy = opts.ResolvePolicy
+	for registry, policy := range opts.RegistryResolvePolicies {
+		if err := policy.validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid resolve policy for registry '%s'", registry)
+		}
+	}
+	d.resolvePolicies = opts.RegistryResolvePolicies
+	d.registryAllowlist = opts.RegistryAllowlist
+	d.rateLimitObserver = opts.RateLimitObserver
+	d.referenceMutator = opts.ReferenceMutator
+	d.preferOCIMediaTypes = opts.PreferOCIMediaTypes
+	d.tlsClients = make(map[string]*http.Client, len(opts.ClientCertificates))
+	for registry, cert := range opts.ClientCertificates {
+		certKey := key
+		certKey.clientCertificate = cert
+		client, err := opts.ConnectionPool.get(certKey, func() (*http.Client, error) {
+			return newClientCertificateClient(d.client, cert)
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid client certificate for registry '%s'", registry)
+		}
+		d.tlsClients[registry] = client
 	}
+	return d, nil
 }
 
 var _ DigestHelper = &remoteDigest{}
@@ -31,48 +428,507 @@ func (d *remoteDigest) PopulateDigest(ctx context.Context, ref *image.Reference)
 	if ref.Digest != "" {
 		return nil
 	}
-	if ref.Reference == NoBaseImageSpecifierLatest {
+	if IsNoBaseImage(ref) {
 		return nil
 	}
-	client := http.DefaultClient
+	// The allowlist applies to the registry referenced, not the proxy cache it's resolved through.
+	mutated := d.mutateReference(ref)
+	if err := d.registryAllowlist.Check(mutated.Registry); err != nil {
+		return errors.Wrapf(err, "failed to resolve the reference '%s'", ref.Reference)
+	}
+	resolveRef := d.throughProxyCache(mutated)
+	imageRef, err := getReferencePathWithDefaultTag(resolveRef, d.defaultTag)
+	if err != nil {
+		return err
+	}
+	if resolveRef.Registry != mutated.Registry {
+		util.Debugf("Resolving '%s' through the proxy cache as '%s'\n", ref.Reference, imageRef)
+	}
+
+	release, err := d.limiter.acquire(ctx, resolveRef.Registry)
+	if err != nil {
+		return errors.Wrapf(err, "Failed to Resolve the reference '%s'", ref.Reference)
+	}
+	defer release()
+
+	provenance := image.NewProvenance(image.SourceRegistry)
+	// Only a proxy cache is a mirror, a registry the ReferenceMutator points the reference at is resolved from as is.
+	if resolveRef.Registry != mutated.Registry {
+		provenance.Mirror = resolveRef.Registry
+	}
+	resolver, name, desc, credential, err := d.resolveWithCredential(ctx, resolveRef, imageRef)
+	if err != nil {
+		if ref.FallbackDigest != "" && isRegistryUnavailable(err) {
+			log.Printf("WARNING: failed to resolve '%s', using its fallback digest %s since the registry is unavailable: %v\n", ref.Reference, ref.FallbackDigest, err)
+			ref.Digest = ref.FallbackDigest
+			provenance.Fallback = true
+			ref.Provenance = provenance
+			return nil
+		}
+		return err
+	}
+	provenance.Credential = credential
+
+	if isIndexMediaType(desc.MediaType) && len(d.preferredPlatforms) > 0 {
+		desc, err = d.selectPlatformManifest(ctx, resolver, name, desc)
+		if err != nil {
+			return errors.Wrapf(err, "Failed to select a platform for the reference '%s'", ref.Reference)
+		}
+	}
+
+	ref.Digest = desc.Digest.String()
+	if desc.Platform != nil {
+		ref.Platform = platforms.Format(*desc.Platform)
+	}
+	ref.Provenance = provenance
+	util.Debugf("Resolved '%s' to %s (media type: %s)\n", ref.Reference, ref.Digest, desc.MediaType)
+	return nil
+}
+
+// resolve resolves imageRef using the credentials configured for the reference's registry.
+// If the registry has credential sources, they are tried in order and the first one which
+// successfully authenticates is used.
+func (d *remoteDigest) resolve(ctx context.Context, ref *image.Reference, imageRef string) (remotes.Resolver, string, ocispec.Descriptor, error) {
+	resolver, name, desc, _, err := d.resolveWithCredential(ctx, ref, imageRef)
+	return resolver, name, desc, err
+}
+
+// resolveWithCredential resolves imageRef like resolve, also returning the class of the credential
+// which was used, e.g. msi, or anonymous if none was.
+func (d *remoteDigest) resolveWithCredential(ctx context.Context, ref *image.Reference, imageRef string) (remotes.Resolver, string, ocispec.Descriptor, string, error) {
+	var sources []*CredentialSource
+	if registry, ok := d.matchCredentialSources(ref.Registry); ok {
+		sources = d.credentialSources[registry]
+	}
+	if d.anonymousFirst {
+		resolver, name, desc, resolved, err := d.resolveAnonymouslyFirst(ctx, ref, imageRef, len(sources) > 0)
+		if resolved || err != nil {
+			return resolver, name, desc, anonymousCredential, err
+		}
+	}
+	if len(sources) == 0 {
+		var credentials func(string) (string, string, error)
+		credential := anonymousCredential
+		if cred, ok := d.registryCreds.GetCredential(ref.Registry); ok {
+			util.Debugf("Resolving '%s' with the credentials configured for %s (username: %s, password: %s)\n",
+				ref.Reference, ref.Registry, util.Redact(cred.Username.ResolvedValue), util.Redact(cred.Password.ResolvedValue))
+			// Adds credential resolver if private registry
+			var err error
+			if credentials, err = resolvedCredentials(ref.Registry, cred); err != nil {
+				return nil, "", ocispec.Descriptor{}, "", err
+			}
+			credential = resolvedCredentialType(cred)
+		} else if d.requireCredentials && !d.publicRegistries[strings.ToLower(ref.Registry)] {
+			return nil, "", ocispec.Descriptor{}, "", fmt.Errorf("no credentials are configured for registry '%s' to resolve '%s', and anonymous access is only allowed for public registries", ref.Registry, ref.Reference)
+		} else {
+			util.Debugf("Resolving '%s' anonymously, no credentials are configured for %s\n", ref.Reference, ref.Registry)
+		}
+
+		resolver := d.newResolver(ref.Registry, credentials)
+		name, desc, err := d.resolveWithPolicy(ctx, resolver, ref.Registry, imageRef)
+		if err != nil {
+			return nil, "", ocispec.Descriptor{}, "", errors.Wrapf(err, "Failed to Resolve the reference '%s'", ref.Reference)
+		}
+		return resolver, name, desc, credential, nil
+	}
+
+	var failures []string
+	for _, source := range sources {
+		util.Debugf("Resolving '%s' using the credential source %s\n", ref.Reference, source.Name)
+		resolver, name, desc, err := d.resolveWithSource(ctx, ref, imageRef, source)
+		if err != nil && source.Invalidate != nil && isUnauthorized(err) {
+			// The cached credentials may have been revoked, so they're retried once anew.
+			util.Debugf("%s rejected the cached credentials of %s, retrying with fresh ones: %v\n", ref.Registry, source.Name, err)
+			source.Invalidate()
+			resolver, name, desc, err = d.resolveWithSource(ctx, ref, imageRef, source)
+		}
+		if errors.Is(err, errCredentialSource) {
+			failures = append(failures, fmt.Sprintf("%s: %v", source.Name, err))
+			continue
+		}
+		if err == nil {
+			credential := source.Type
+			if credential == "" {
+				credential = source.Name
+			}
+			return resolver, name, desc, credential, nil
+		}
+		if !isAuthFailure(err) {
+			return nil, "", ocispec.Descriptor{}, "", errors.Wrapf(err, "Failed to Resolve the reference '%s' using %s", ref.Reference, source.Name)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", source.Name, err))
+	}
+	return nil, "", ocispec.Descriptor{}, "", fmt.Errorf("Failed to Resolve the reference '%s' using any of the %d credential sources: [%s]", ref.Reference, len(sources), strings.Join(failures, "; "))
+}
+
+// resolvedCredentialType returns the class of the resolved credential, e.g. msi.
+func resolvedCredentialType(cred *graph.ResolvedRegistryCred) string {
+	switch {
+	case cred.Type != "":
+		return cred.Type
+	case cred.BearerToken:
+		return graph.Bearer
+	default:
+		return unknownCredential
+	}
+}
+
+// errCredentialSource is wrapped by the errors of credential sources which failed to get credentials.
+var errCredentialSource = errors.New("failed to get credentials")
+
+// resolveWithSource resolves imageRef using the credentials of the credential source.
+func (d *remoteDigest) resolveWithSource(ctx context.Context, ref *image.Reference, imageRef string, source *CredentialSource) (remotes.Resolver, string, ocispec.Descriptor, error) {
+	username, password, err := source.Credentials(ctx)
+	if err != nil {
+		return nil, "", ocispec.Descriptor{}, fmt.Errorf("%w: %v", errCredentialSource, err)
+	}
+	resolver := d.newResolver(ref.Registry, staticCredentials(username, password))
+	name, desc, err := d.resolveWithPolicy(ctx, resolver, ref.Registry, imageRef)
+	return resolver, name, desc, err
+}
+
+// resolveAnonymouslyFirst resolves imageRef anonymously if the reference's registry has credentials, which may
+// be credential sources, and can be accessed anonymously. It returns false without an error if the reference
+// wasn't resolved, either because it isn't attempted or because the registry refused the anonymous request,
+// in which case the reference is resolved using the credentials.
+func (d *remoteDigest) resolveAnonymouslyFirst(ctx context.Context, ref *image.Reference, imageRef string, hasSources bool) (remotes.Resolver, string, ocispec.Descriptor, bool, error) {
+	if _, hasCredential := d.registryCreds.GetCredential(ref.Registry); !hasSources && !hasCredential {
+		// The reference is resolved anonymously regardless.
+		return nil, "", ocispec.Descriptor{}, false, nil
+	}
+	if d.requireCredentials && !d.publicRegistries[strings.ToLower(ref.Registry)] {
+		return nil, "", ocispec.Descriptor{}, false, nil
+	}
+	util.Debugf("Resolving '%s' anonymously first, before using the credentials configured for %s\n", ref.Reference, ref.Registry)
+	resolver := d.newResolver(ref.Registry, nil)
+	name, desc, err := d.resolveWithPolicy(ctx, resolver, ref.Registry, imageRef)
+	if err == nil {
+		return resolver, name, desc, true, nil
+	}
+	if isAuthFailure(err) {
+		util.Debugf("%s refused to resolve '%s' anonymously, using its credentials: %v\n", ref.Registry, ref.Reference, err)
+		return nil, "", ocispec.Descriptor{}, false, nil
+	}
+	return nil, "", ocispec.Descriptor{}, false, errors.Wrapf(err, "Failed to Resolve the reference '%s' anonymously", ref.Reference)
+}
+
+// registryMatcher is implemented by credential providers which can report the registry pattern
+// of the credential used for a registry, e.g. graph.RegistryLoginCredentials.
+type registryMatcher interface {
+	MatchRegistry(registry string) (string, bool)
+}
+
+// matchCredentialSources returns the key of the credential sources which apply to the registry,
+// using the same precedence as graph.RegistryLoginCredentials: exact, wildcard, then default.
+// A more specific credential from the credential provider takes precedence over the sources.
+func (d *remoteDigest) matchCredentialSources(registry string) (string, bool) {
+	if _, ok := d.credentialSources[registry]; ok {
+		return registry, true
+	}
+	patterns := make([]string, 0, len(d.credentialSources))
+	for pattern := range d.credentialSources {
+		patterns = append(patterns, pattern)
+	}
+	pattern, ok := graph.MatchRegistry(registry, patterns)
+	if !ok {
+		return "", false
+	}
+	if matcher, isMatcher := d.registryCreds.(registryMatcher); isMatcher {
+		if credPattern, found := matcher.MatchRegistry(registry); found && credPattern != pattern {
+			if best, _ := graph.MatchRegistry(registry, []string{pattern, credPattern}); best == credPattern {
+				return "", false
+			}
+		}
+	}
+	return pattern, true
+}
+
+// newResolver creates a resolver for the registry which authenticates using credentials, if not nil.
+func (d *remoteDigest) newResolver(registry string, credentials func(string) (string, string, error)) remotes.Resolver {
 	opts := docker.ResolverOptions{
-		Client: client,
+		Hosts: d.registryHosts(registry, credentials),
+	}
+	if d.preferOCIMediaTypes {
+		opts.Headers = http.Header{"Accept": []string{ociFirstAccept}}
+	}
+	return docker.NewResolver(opts)
+}
+
+// registryHosts configures how the registry is accessed, authenticating using credentials, if not nil.
+// Registries with a client certificate are always accessed over TLS, while localhost is otherwise
+// accessed over plain HTTP.
+func (d *remoteDigest) registryHosts(registry string, credentials func(string) (string, string, error)) docker.RegistryHosts {
+	client, hasClientCertificate := d.tlsClients[registry]
+	if !hasClientCertificate {
+		client = d.client
 	}
-	if cred, ok := d.registryCreds[ref.Registry]; ok {
-		if cred.Username.ResolvedValue == "" || cred.Password.ResolvedValue == "" {
-			return fmt.Errorf("error fetching credentials for '%s'", ref.Registry)
+	client = withRequestLogging(withRegistryStatusRecording(withRateLimitReporting(client, registry, d.rateLimitObserver)))
+
+	return func(host string) ([]docker.RegistryHost, error) {
+		// Authorizers are shared by the resolvers of a registry, so tokens are cached per scope for the run.
+		authorizer, err := d.authorizers.get(registry, client, credentials)
+		if err != nil {
+			return nil, err
+		}
+		hostOpts := []docker.RegistryOpt{
+			docker.WithClient(client),
+			docker.WithAuthorizer(authorizer),
 		}
-		// Adds credential resolver if private registry
-		opts.Credentials = func(hostName string) (string, string, error) {
-			return cred.Username.ResolvedValue, cred.Password.ResolvedValue, nil
+		if !hasClientCertificate {
+			hostOpts = append(hostOpts, docker.WithPlainHTTP(docker.MatchLocalhost))
 		}
+		return docker.ConfigureDefaultRegistries(hostOpts...)(host)
 	}
+}
+
+// requestLoggingTransport logs the requests made to registries when the verbosity is debug.
+// Only the method, the URL without its query, which may contain tokens, and the response status are logged.
+type requestLoggingTransport struct {
+	next http.RoundTripper
+}
 
-	resolver := docker.NewResolver(opts)
-	imageRef, err := getReferencePath(ref)
+func (t *requestLoggingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	target := req.URL.Scheme + "://" + req.URL.Host + req.URL.Path
+	resp, err := t.next.RoundTrip(req)
 	if err != nil {
-		return err
+		util.Debugf("Registry request: %s %s failed: %v\n", req.Method, target, err)
+		return resp, err
 	}
+	util.Debugf("Registry request: %s %s -> %s\n", req.Method, target, resp.Status)
+	return resp, nil
+}
 
-	_, desc, err := resolver.Resolve(ctx, imageRef)
+// withRequestLogging returns a copy of client which logs its requests if the verbosity is debug.
+func withRequestLogging(client *http.Client) *http.Client {
+	if util.GetVerbosity() < util.VerbosityDebug {
+		return client
+	}
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	logged := *client
+	logged.Transport = &requestLoggingTransport{next: next}
+	return &logged
+}
+
+// resolvedCredentials returns the credentials to authenticate to the registry with using the resolved credential,
+// which are a bearer token if the credential is one.
+func resolvedCredentials(registry string, cred *graph.ResolvedRegistryCred) (func(string) (string, string, error), error) {
+	if cred.BearerToken {
+		if cred.Password.ResolvedValue == "" {
+			return nil, fmt.Errorf("the bearer token for '%s' is empty", registry)
+		}
+		return bearerCredentials(cred.Password.ResolvedValue), nil
+	}
+	if cred.Username.ResolvedValue == "" || cred.Password.ResolvedValue == "" {
+		return nil, fmt.Errorf("error fetching credentials for '%s'", registry)
+	}
+	return staticCredentials(cred.Username.ResolvedValue, cred.Password.ResolvedValue), nil
+}
+
+func staticCredentials(username string, password string) func(string) (string, string, error) {
+	return func(hostName string) (string, string, error) {
+		return username, password, nil
+	}
+}
+
+// isAuthFailure determines whether the error returned when resolving a reference was caused by
+// the registry rejecting the credentials, with a 401 or a 403.
+func isAuthFailure(err error) bool {
+	return isUnauthorized(err) || registryStatusCode(err) == http.StatusForbidden
+}
+
+// isUnauthorized determines whether the error returned when resolving a reference was caused by
+// the registry rejecting the credentials with a 401.
+func isUnauthorized(err error) bool {
+	return errors.Is(err, docker.ErrInvalidAuthorization) || registryStatusCode(err) == http.StatusUnauthorized
+}
+
+// selectPlatformManifest fetches the manifest list described by desc and returns the descriptor
+// of the manifest matching the first preferred platform, after verifying the registry has the manifest.
+func (d *remoteDigest) selectPlatformManifest(ctx context.Context, resolver remotes.Resolver, name string, desc ocispec.Descriptor) (ocispec.Descriptor, error) {
+	index, err := d.fetchIndex(ctx, resolver, name, desc)
 	if err != nil {
-		return errors.Wrapf(err, "Failed to Resolve the reference '%s'", ref.Reference)
+		return ocispec.Descriptor{}, err
 	}
+	selected, err := selectPlatform(index, d.preferredPlatforms)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	if err := verifyPlatformManifest(ctx, resolver, name, selected); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	return selected, nil
+}
 
-	ref.Digest = desc.Digest.String()
+// selectPlatform returns the descriptor of the manifest in the index matching the first preferred platform.
+func selectPlatform(index *ocispec.Index, preferredPlatforms []ocispec.Platform) (ocispec.Descriptor, error) {
+	for _, preferred := range preferredPlatforms {
+		matcher := platforms.NewMatcher(preferred)
+		for _, m := range index.Manifests {
+			if m.Platform != nil && matcher.Match(*m.Platform) {
+				return m, nil
+			}
+		}
+	}
+
+	var available []string
+	for _, m := range index.Manifests {
+		if m.Platform != nil {
+			available = append(available, platforms.Format(*m.Platform))
+		}
+	}
+	var preferred []string
+	for _, p := range preferredPlatforms {
+		preferred = append(preferred, platforms.Format(p))
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("none of the preferred platforms [%s] are available, available platforms: [%s]", strings.Join(preferred, ", "), strings.Join(available, ", "))
+}
+
+// PlatformDigests returns the digest of each platform's manifest in the image index referenced by ref,
+// keyed by the normalized platform, e.g. linux/arm/v7. Nested indexes are walked, with the first
+// manifest found for a platform taking precedence, and entries which don't describe a platform, such as
+// attestation manifests, are excluded.
+func (d *remoteDigest) PlatformDigests(ctx context.Context, ref *image.Reference) (map[string]string, error) {
+	mutated := d.mutateReference(ref)
+	if err := d.registryAllowlist.Check(mutated.Registry); err != nil {
+		return nil, errors.Wrapf(err, "failed to get the platform digests of '%s'", ref.Reference)
+	}
+	resolveRef := d.throughProxyCache(mutated)
+	imageRef, err := getReferencePathWithDefaultTag(resolveRef, d.defaultTag)
+	if err != nil {
+		return nil, err
+	}
+
+	release, err := d.limiter.acquire(ctx, resolveRef.Registry)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Failed to Resolve the reference '%s'", ref.Reference)
+	}
+	defer release()
+
+	resolver, name, desc, err := d.resolve(ctx, resolveRef, imageRef)
+	if err != nil {
+		return nil, err
+	}
+	if !isIndexMediaType(desc.MediaType) {
+		return nil, fmt.Errorf("'%s' isn't an image index, its media type is %s", ref.Reference, desc.MediaType)
+	}
+
+	digests := make(map[string]string)
+	if err := d.collectPlatformDigests(ctx, resolver, name, desc, digests, 0); err != nil {
+		return nil, errors.Wrapf(err, "Failed to get the platform digests of '%s'", ref.Reference)
+	}
+	return digests, nil
+}
+
+// collectPlatformDigests adds the digest of each platform's manifest in the index described by desc to digests.
+func (d *remoteDigest) collectPlatformDigests(ctx context.Context, resolver remotes.Resolver, name string, desc ocispec.Descriptor, digests map[string]string, depth int) error {
+	if depth >= maxNestedIndexDepth {
+		return fmt.Errorf("the manifest list %s is nested more than %d levels deep", desc.Digest, maxNestedIndexDepth)
+	}
+	index, err := d.fetchIndex(ctx, resolver, name, desc)
+	if err != nil {
+		return err
+	}
+	for _, m := range index.Manifests {
+		if isIndexMediaType(m.MediaType) {
+			if err := d.collectPlatformDigests(ctx, resolver, name, m, digests, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if !describesPlatform(m) {
+			continue
+		}
+		platform := platforms.Format(platforms.Normalize(*m.Platform))
+		if _, ok := digests[platform]; !ok {
+			digests[platform] = m.Digest.String()
+		}
+	}
 	return nil
 }
 
+// describesPlatform returns true if the index entry is an image for a platform, rather than
+// e.g. a buildkit attestation manifest, which uses the platform unknown/unknown.
+func describesPlatform(desc ocispec.Descriptor) bool {
+	if desc.Platform == nil || desc.Platform.OS == "" || desc.Platform.OS == "unknown" || desc.Platform.Architecture == "unknown" {
+		return false
+	}
+	_, isAttestation := desc.Annotations[attestationReferenceTypeAnnotation]
+	return !isAttestation
+}
+
+// fetchIndex fetches and decodes the manifest list described by desc. Manifest lists larger than
+// the maximum manifest size fail without being read, whether their descriptor or the registry's
+// response reports their size accurately or not.
+func (d *remoteDigest) fetchIndex(ctx context.Context, resolver remotes.Resolver, name string, desc ocispec.Descriptor) (*ocispec.Index, error) {
+	if desc.Size > d.maxManifestSize {
+		return nil, fmt.Errorf("the manifest list %s is %d bytes, which exceeds the maximum manifest size of %d bytes", desc.Digest, desc.Size, d.maxManifestSize)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create a fetcher")
+	}
+	rc, err := fetcher.Fetch(ctx, desc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch the manifest list %s", desc.Digest)
+	}
+	defer rc.Close()
+
+	data, err := ioutil.ReadAll(io.LimitReader(rc, d.maxManifestSize+1))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read the manifest list %s", desc.Digest)
+	}
+	if int64(len(data)) > d.maxManifestSize {
+		return nil, fmt.Errorf("the manifest list %s exceeds the maximum manifest size of %d bytes", desc.Digest, d.maxManifestSize)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(data, &index); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the manifest list %s", desc.Digest)
+	}
+	return &index, nil
+}
+
+func isIndexMediaType(mediaType string) bool {
+	return mediaType == images.MediaTypeDockerSchema2ManifestList || mediaType == ocispec.MediaTypeImageIndex
+}
+
+// getReferencePath returns the reference's registry, repository and tag, e.g. myregistry.azurecr.io/app:v1,
+// using DefaultTag if the reference doesn't specify a tag.
 func getReferencePath(ref *image.Reference) (string, error) {
-	fullRefPath := fmt.Sprintf("%s/%s", ref.Registry, ref.Repository)
-	tag := "latest"
+	return getReferencePathWithDefaultTag(ref, DefaultTag)
+}
+
+// getReferencePathWithDefaultTag is like getReferencePath, using defaultTag if the reference doesn't specify a tag.
+func getReferencePathWithDefaultTag(ref *image.Reference, defaultTag string) (string, error) {
+	tag := defaultTag
 	if ref.Tag != "" {
 		tag = ref.Tag
 	}
-	fullRefPath = fmt.Sprintf("%s:%s", fullRefPath, tag)
-	fullRef, err := reference.Parse(fullRefPath)
+	repository, err := normalizeRepository(ref.Repository)
 	if err != nil {
 		return "", errors.Wrapf(err, "Failed to parse the reference %s", ref.Reference)
 	}
-	return fullRef.String(), nil
+	fullRef, err := image.NewReference(ref.Registry, repository, tag, "")
+	if err != nil {
+		return "", errors.Wrapf(err, "Failed to parse the reference %s", ref.Reference)
+	}
+	return fullRef.Reference, nil
+}
+
+// normalizeRepository lowercases a repository containing uppercase characters, which registries reject,
+// warning about the normalized form it's resolved as. It fails naming the first character which isn't valid
+// in a repository even when lowercased.
+func normalizeRepository(repository string) (string, error) {
+	for _, c := range repository {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("._-/", c)) {
+			return "", fmt.Errorf("invalid character '%c' in repository '%s', repositories may only contain lowercase letters, digits, separators ('.', '_' and '-') and '/'", c, repository)
+		}
+	}
+	normalized := strings.ToLower(repository)
+	if normalized != repository {
+		log.Printf("WARNING: repository '%s' contains uppercase characters, which registries don't allow, resolving it as '%s'\n", repository, normalized)
+	}
+	return normalized, nil
 }
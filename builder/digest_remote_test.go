@@ -0,0 +1,1171 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/platforms"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// fakeManifest is a manifest served by a fakeRegistry.
+type fakeManifest struct {
+	mediaType string
+	content   []byte
+}
+
+// fakeRegistry is a minimal Docker registry serving manifests and blobs, which can also be pushed to it.
+type fakeRegistry struct {
+	mu sync.Mutex
+
+	// manifests maps "<repository>:<tag>" and "<repository>@<digest>" to a manifest.
+	manifests map[string]*fakeManifest
+
+	// blobs maps "<repository>@<digest>" to a blob.
+	blobs map[string][]byte
+
+	// username and password, if set, are required using basic authentication.
+	username string
+	password string
+
+	// token, if set, is required as a bearer token.
+	token string
+}
+
+func newFakeRegistry() *fakeRegistry {
+	return &fakeRegistry{manifests: make(map[string]*fakeManifest), blobs: make(map[string][]byte)}
+}
+
+// addManifest adds the manifest to the registry under the specified tag and returns its digest.
+func (r *fakeRegistry) addManifest(repository string, tag string, mediaType string, content []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := &fakeManifest{mediaType: mediaType, content: content}
+	dgst := digest.FromBytes(content)
+	r.manifests[repository+"@"+dgst.String()] = m
+	if tag != "" {
+		r.manifests[repository+":"+tag] = m
+	}
+	return dgst
+}
+
+// addIndex adds a manifest list pointing to a manifest for each of the specified platforms.
+func (r *fakeRegistry) addIndex(t *testing.T, repository string, tag string, platforms ...ocispec.Platform) (digest.Digest, map[string]digest.Digest) {
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex}
+	index.SchemaVersion = 2
+	platformDigests := make(map[string]digest.Digest)
+	for _, p := range platforms {
+		p := p
+		content := []byte(`{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `","platform":"` + p.OS + "/" + p.Architecture + `"}`)
+		dgst := r.addManifest(repository, "", ocispec.MediaTypeImageManifest, content)
+		index.Manifests = append(index.Manifests, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageManifest,
+			Digest:    dgst,
+			Size:      int64(len(content)),
+			Platform:  &p,
+		})
+		platformDigests[p.OS+"/"+p.Architecture] = dgst
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("failed to marshal index: %v", err)
+	}
+	return r.addManifest(repository, tag, ocispec.MediaTypeImageIndex, content), platformDigests
+}
+
+func (r *fakeRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if r.username != "" {
+		if username, password, ok := req.BasicAuth(); !ok || username != r.username || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+	if r.token != "" && req.Header.Get("Authorization") != "Bearer "+r.token {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="fake"`)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if req.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if idx := strings.LastIndex(path, "/blobs/uploads/"); idx >= 0 {
+		r.serveUpload(w, req, path[:idx])
+		return
+	}
+	if idx := strings.LastIndex(path, "/blobs/"); idx >= 0 {
+		blob, ok := r.blobs[path[:idx]+"@"+path[idx+len("/blobs/"):]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(blob)))
+		w.WriteHeader(http.StatusOK)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(blob)
+		}
+		return
+	}
+	idx := strings.LastIndex(path, "/manifests/")
+	if idx < 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	repository, ref := path[:idx], path[idx+len("/manifests/"):]
+	sep := ":"
+	if strings.Contains(ref, ":") {
+		sep = "@"
+	}
+	if req.Method == http.MethodPut {
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		m := &fakeManifest{mediaType: req.Header.Get("Content-Type"), content: content}
+		dgst := digest.FromBytes(content)
+		r.manifests[repository+"@"+dgst.String()] = m
+		r.manifests[repository+sep+ref] = m
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+		return
+	}
+	m, ok := r.manifests[repository+sep+ref]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", m.mediaType)
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(m.content).String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(m.content)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(m.content)
+	}
+}
+
+// serveUpload serves a monolithic blob upload to the repository: a POST starting the upload followed
+// by a PUT of the whole blob.
+func (r *fakeRegistry) serveUpload(w http.ResponseWriter, req *http.Request, repository string) {
+	switch req.Method {
+	case http.MethodPost:
+		w.Header().Set("Location", "/v2/"+repository+"/blobs/uploads/"+strconv.Itoa(len(r.blobs)))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		content, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		dgst := digest.FromBytes(content)
+		if expected := req.URL.Query().Get("digest"); expected != dgst.String() {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.blobs[repository+"@"+dgst.String()] = content
+		w.Header().Set("Docker-Content-Digest", dgst.String())
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// start starts serving the registry and returns its host and a function to stop it.
+func (r *fakeRegistry) start() (string, func()) {
+	server := httptest.NewServer(r)
+	return strings.TrimPrefix(server.URL, "http://"), server.Close
+}
+
+func TestRemoteDigest_PopulateDigest(t *testing.T) {
+	registry := newFakeRegistry()
+	manifestDigest := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+	if err := NewRemoteDigest(nil).PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != manifestDigest.String() {
+		t.Errorf("Expected digest %s, but got %s", manifestDigest, ref.Digest)
+	}
+}
+
+func TestRemoteDigest_DefaultTag(t *testing.T) {
+	registry := newFakeRegistry()
+	latestDigest := registry.addManifest("library/hello", "latest", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"tag":"latest"}`))
+	stableDigest := registry.addManifest("library/hello", "stable", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"tag":"stable"}`))
+	v1Digest := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"tag":"v1"}`))
+	host, stop := registry.start()
+	defer stop()
+
+	tests := []struct {
+		defaultTag string
+		tag        string
+		expected   string
+	}{
+		{"", "", latestDigest.String()},
+		{"stable", "", stableDigest.String()},
+		// References which specify a tag aren't affected by the default tag.
+		{"stable", "v1", v1Digest.String()},
+		{"stable", "latest", latestDigest.String()},
+	}
+
+	for _, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{DefaultTag: test.defaultTag})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: test.tag, Reference: host + "/library/hello"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error for the default tag %q and tag %q: %v", test.defaultTag, test.tag, err)
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("Expected digest %s for the default tag %q and tag %q, but got %s", test.expected, test.defaultTag, test.tag, ref.Digest)
+		}
+	}
+
+	if _, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{DefaultTag: "not a tag"}); err == nil {
+		t.Error("Expected an error for an invalid default tag")
+	}
+}
+
+func TestRemoteDigest_PreferredPlatforms(t *testing.T) {
+	registry := newFakeRegistry()
+	indexDigest, platformDigests := registry.addIndex(t, "library/multi", "v1",
+		ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		ocispec.Platform{OS: "linux", Architecture: "arm64"})
+	host, stop := registry.start()
+	defer stop()
+
+	tests := []struct {
+		preferred []string
+		ok        bool
+		expected  string
+	}{
+		{nil, true, indexDigest.String()},
+		{[]string{"linux/arm64", "linux/amd64"}, true, platformDigests["linux/arm64"].String()},
+		{[]string{"windows/amd64", "linux/amd64"}, true, platformDigests["linux/amd64"].String()},
+		{[]string{"windows/amd64"}, false, ""},
+	}
+
+	for _, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{PreferredPlatforms: test.preferred})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/multi", Tag: "v1", Reference: host + "/library/multi:v1"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if !test.ok {
+			if err == nil || !strings.Contains(err.Error(), "linux/amd64") {
+				t.Errorf("Expected an error listing the available platforms for %v, but got %v", test.preferred, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %v: %v", test.preferred, err)
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("Expected digest %s for %v, but got %s", test.expected, test.preferred, ref.Digest)
+		}
+		if len(test.preferred) > 0 && platformDigests[ref.Platform].String() != ref.Digest {
+			t.Errorf("Expected the platform of digest %s to be recorded for %v, but got %s", ref.Digest, test.preferred, ref.Platform)
+		}
+	}
+}
+
+func TestRemoteDigest_DefaultToHostPlatform(t *testing.T) {
+	registry := newFakeRegistry()
+	indexDigest, platformDigests := registry.addIndex(t, "library/multi", "v1",
+		platforms.DefaultSpec(),
+		ocispec.Platform{OS: "plan9", Architecture: "386"})
+	host, stop := registry.start()
+	defer stop()
+	hostDigest := platformDigests[platforms.DefaultSpec().OS+"/"+platforms.DefaultSpec().Architecture]
+
+	tests := []struct {
+		opts     *RemoteDigestOptions
+		expected string
+	}{
+		// The host's platform is only the default when opted into.
+		{&RemoteDigestOptions{}, indexDigest.String()},
+		{&RemoteDigestOptions{DefaultToHostPlatform: true}, hostDigest.String()},
+		// Preferred platforms override the host's platform.
+		{&RemoteDigestOptions{DefaultToHostPlatform: true, PreferredPlatforms: []string{"plan9/386"}}, platformDigests["plan9/386"].String()},
+	}
+
+	for _, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, test.opts)
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/multi", Tag: "v1", Reference: host + "/library/multi:v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error for %+v: %v", test.opts, err)
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("Expected digest %s for %+v, but got %s", test.expected, test.opts, ref.Digest)
+		}
+	}
+}
+
+func TestRemoteDigest_MaxManifestSize(t *testing.T) {
+	registry := newFakeRegistry()
+	var platforms []ocispec.Platform
+	for i := 0; i < 100; i++ {
+		platforms = append(platforms, ocispec.Platform{OS: "linux", Architecture: "amd64", Variant: "v" + strconv.Itoa(i)})
+	}
+	indexDigest, _ := registry.addIndex(t, "library/huge", "v1", platforms...)
+	indexSize := int64(len(registry.manifests["library/huge:v1"].content))
+	host, stop := registry.start()
+	defer stop()
+
+	newRef := func() *image.Reference {
+		return &image.Reference{Registry: host, Repository: "library/huge", Tag: "v1", Reference: host + "/library/huge:v1"}
+	}
+	tests := []struct {
+		maxSize int64
+		ok      bool
+	}{
+		{0, true},
+		{indexSize, true},
+		{indexSize - 1, false},
+		{512, false},
+	}
+
+	for _, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{PreferredPlatforms: []string{"linux/amd64"}, MaxManifestSize: test.maxSize})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		errPopulate := d.PopulateDigest(context.Background(), newRef())
+		_, errPlatforms := d.PlatformDigests(context.Background(), newRef())
+		for _, err := range []error{errPopulate, errPlatforms} {
+			if test.ok && err != nil {
+				t.Errorf("Unexpected error with a maximum size of %d: %v", test.maxSize, err)
+			}
+			if !test.ok && (err == nil || !strings.Contains(err.Error(), "exceeds the maximum manifest size")) {
+				t.Errorf("Expected the %d byte manifest list to exceed the maximum size of %d, but got %v", indexSize, test.maxSize, err)
+			}
+		}
+	}
+
+	// The size of the manifest list which is read is limited even if its descriptor understates it.
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{MaxManifestSize: 512})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	resolver := d.newResolver(host, nil)
+	desc := ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: indexDigest, Size: 100}
+	if _, err := d.fetchIndex(context.Background(), resolver, host+"/library/huge:v1", desc); err == nil || !strings.Contains(err.Error(), "exceeds the maximum manifest size") {
+		t.Errorf("Expected reading the manifest list to be limited, but got %v", err)
+	}
+
+	if _, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{MaxManifestSize: -1}); err == nil {
+		t.Error("Expected an error for a negative maximum manifest size")
+	}
+}
+
+func TestNewRemoteDigestWithOptions_InvalidPlatform(t *testing.T) {
+	if _, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{PreferredPlatforms: []string{"not/a/valid/platform"}}); err == nil {
+		t.Error("Expected an error for an invalid platform, but got none")
+	}
+}
+
+func TestRemoteDigest_CredentialSources_Invalidate(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "msi", "fresh"
+	manifestDigest := registry.addManifest("library/private", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	tests := []struct {
+		name          string
+		invalidatable bool
+		ok            bool
+	}{
+		{"retried with fresh credentials once invalidated", true, true},
+		{"not retried without invalidation", false, false},
+	}
+	for _, test := range tests {
+		// The source returns a revoked cached token until it's invalidated.
+		password, invalidations := "revoked", 0
+		source := &CredentialSource{
+			Name: "msi",
+			Credentials: func(ctx context.Context) (string, string, error) {
+				return "msi", password, nil
+			},
+		}
+		if test.invalidatable {
+			source.Invalidate = func() {
+				invalidations++
+				password = "fresh"
+			}
+		}
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+			CredentialSources: map[string][]*CredentialSource{host: {source}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("%s: expected an error, but got none", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if ref.Digest != manifestDigest.String() {
+			t.Errorf("%s: expected digest %s, but got %s", test.name, manifestDigest, ref.Digest)
+		}
+		if invalidations != 1 {
+			t.Errorf("%s: expected the credentials to be invalidated once, but got %d", test.name, invalidations)
+		}
+	}
+}
+
+func TestRemoteDigest_CredentialSources(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "sp", "secret"
+	manifestDigest := registry.addManifest("library/private", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	failingSource := &CredentialSource{
+		Name: "msi",
+		Credentials: func(ctx context.Context) (string, string, error) {
+			return "", "", errors.New("token acquisition failed")
+		},
+	}
+	staticSource := func(name string, username string, password string) *CredentialSource {
+		return &CredentialSource{
+			Name: name,
+			Credentials: func(ctx context.Context) (string, string, error) {
+				return username, password, nil
+			},
+		}
+	}
+
+	tests := []struct {
+		sources []*CredentialSource
+		ok      bool
+	}{
+		{[]*CredentialSource{staticSource("sp", "sp", "secret")}, true},
+		{[]*CredentialSource{failingSource, staticSource("sp", "sp", "secret")}, true},
+		{[]*CredentialSource{staticSource("stale-sp", "sp", "expired"), staticSource("sp", "sp", "secret")}, true},
+		{[]*CredentialSource{failingSource, staticSource("stale-sp", "sp", "expired")}, false},
+	}
+
+	for i, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+			CredentialSources: map[string][]*CredentialSource{host: test.sources},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if !test.ok {
+			if err == nil {
+				t.Fatalf("Test %d: expected an error, but got none", i)
+			}
+			for _, expected := range []string{"msi: failed to get credentials: token acquisition failed", "stale-sp:"} {
+				if !strings.Contains(err.Error(), expected) {
+					t.Errorf("Test %d: expected error to contain %q, but got %v", i, expected, err)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error: %v", i, err)
+		}
+		if ref.Digest != manifestDigest.String() {
+			t.Errorf("Test %d: expected digest %s, but got %s", i, manifestDigest, ref.Digest)
+		}
+	}
+}
+
+// countingTransport counts the requests sent through it, and records their methods and paths in order.
+type countingTransport struct {
+	mu       sync.Mutex
+	requests int
+	sent     []string
+}
+
+func (c *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.Lock()
+	c.requests++
+	c.sent = append(c.sent, req.Method+" "+req.URL.Path)
+	c.mu.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestRemoteDigest_SharedClient(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	transport := &countingTransport{}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{Client: client})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	// Each remote digest resolves the tag with a single request of its own through the shared client.
+	expected := []string{"HEAD /v2/library/hello/manifests/v1", "HEAD /v2/library/hello/manifests/v1"}
+	if !reflect.DeepEqual(transport.sent, expected) {
+		t.Errorf("Expected both remote digests to send %v through the shared client, but it sent %v", expected, transport.sent)
+	}
+}
+
+func TestNewRemoteDigestClient(t *testing.T) {
+	client := NewRemoteDigestClient(&RemoteDigestClientOptions{MaxIdleConnsPerHost: 32, IdleConnTimeout: time.Minute, Timeout: time.Second})
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok {
+		t.Fatalf("Expected an *http.Transport, but got %T", client.Transport)
+	}
+	if transport.MaxIdleConnsPerHost != 32 {
+		t.Errorf("Expected MaxIdleConnsPerHost to be 32, but got %d", transport.MaxIdleConnsPerHost)
+	}
+	if transport.IdleConnTimeout != time.Minute {
+		t.Errorf("Expected IdleConnTimeout to be 1m, but got %v", transport.IdleConnTimeout)
+	}
+	if transport.MaxIdleConns != http.DefaultTransport.(*http.Transport).MaxIdleConns {
+		t.Errorf("Expected MaxIdleConns to keep its default, but got %d", transport.MaxIdleConns)
+	}
+	if client.Timeout != time.Second {
+		t.Errorf("Expected Timeout to be 1s, but got %v", client.Timeout)
+	}
+}
+
+func TestGetReferencePath(t *testing.T) {
+	tests := []struct {
+		ref      *image.Reference
+		expected string
+	}{
+		{&image.Reference{Registry: "myregistry.azurecr.io", Repository: "org/app", Tag: "v1"}, "myregistry.azurecr.io/org/app:v1"},
+		{&image.Reference{Registry: "localhost:5000", Repository: "app"}, "localhost:5000/app:latest"},
+		{&image.Reference{Registry: "myregistry.azurecr.io:443", Repository: "app", Tag: "v1"}, "myregistry.azurecr.io:443/app:v1"},
+		{&image.Reference{Registry: "[::1]:5000", Repository: "app", Tag: "v1"}, "[::1]:5000/app:v1"},
+		{&image.Reference{Registry: "[fd00::1]", Repository: "org/app", Tag: "v1"}, "[fd00::1]/org/app:v1"},
+		{&image.Reference{Registry: "myregistry.azurecr.io", Repository: "Org/MyApp", Tag: "V1"}, "myregistry.azurecr.io/org/myapp:V1"},
+		{&image.Reference{Registry: "MyRegistry.azurecr.io", Repository: "APP", Tag: "v1"}, "myregistry.azurecr.io/app:v1"},
+	}
+
+	for _, test := range tests {
+		actual, err := getReferencePath(test.ref)
+		if err != nil {
+			t.Errorf("Unexpected error for %v: %v", test.ref, err)
+			continue
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %s, but got %s", test.expected, actual)
+		}
+	}
+}
+
+func TestGetReferencePath_InvalidRepository(t *testing.T) {
+	tests := []struct {
+		repository string
+		expected   string
+	}{
+		{"org/my app", "invalid character ' ' in repository 'org/my app'"},
+		{"My$App", "invalid character '$' in repository 'My$App'"},
+		{"org//app", "invalid repository 'org//app'"},
+	}
+
+	for _, test := range tests {
+		ref := &image.Reference{Registry: "myregistry.azurecr.io", Repository: test.repository, Tag: "v1", Reference: "myregistry.azurecr.io/" + test.repository + ":v1"}
+		_, err := getReferencePath(ref)
+		if err == nil {
+			t.Errorf("Expected an error for the repository '%s'", test.repository)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("Expected an error containing %q for the repository '%s', but got %v", test.expected, test.repository, err)
+		}
+	}
+}
+
+func TestRemoteDigest_MixedCaseRepository(t *testing.T) {
+	registry := newFakeRegistry()
+	expected := registry.addManifest("org/myapp", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	for _, repository := range []string{"Org/MyApp", "ORG/MYAPP", "org/myapp"} {
+		ref := &image.Reference{Registry: host, Repository: repository, Tag: "v1", Reference: host + "/" + repository + ":v1"}
+		if err := NewRemoteDigest(nil).PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error resolving the repository '%s': %v", repository, err)
+		}
+		if ref.Digest != expected.String() {
+			t.Errorf("Expected the repository '%s' to resolve to %s, but got %s", repository, expected, ref.Digest)
+		}
+		if ref.Repository != repository {
+			t.Errorf("Expected the reference's repository to be kept as '%s', but got '%s'", repository, ref.Repository)
+		}
+	}
+}
+
+func TestRemoteDigest_RequireCredentials(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	tests := []struct {
+		opts *RemoteDigestOptions
+		ok   bool
+	}{
+		{&RemoteDigestOptions{}, true},
+		{&RemoteDigestOptions{RequireCredentials: true}, false},
+		{&RemoteDigestOptions{RequireCredentials: true, PublicRegistries: []string{host}}, true},
+		{&RemoteDigestOptions{RequireCredentials: true, PublicRegistries: []string{"mcr.microsoft.com"}}, false},
+	}
+
+	for i, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, test.opts)
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if test.ok && err != nil {
+			t.Errorf("Test %d: unexpected error: %v", i, err)
+		}
+		if !test.ok && (err == nil || !strings.Contains(err.Error(), "no credentials are configured")) {
+			t.Errorf("Test %d: expected resolving anonymously to fail, but got %v", i, err)
+		}
+	}
+}
+
+// fakeCredentialProvider provides the same credential for every registry and records the lookups.
+type fakeCredentialProvider struct {
+	username string
+	password string
+	lookups  []string
+}
+
+func (p *fakeCredentialProvider) GetCredential(registry string) (*graph.ResolvedRegistryCred, bool) {
+	p.lookups = append(p.lookups, registry)
+	return &graph.ResolvedRegistryCred{
+		Username: &secretmgmt.Secret{ResolvedValue: p.username},
+		Password: &secretmgmt.Secret{ResolvedValue: p.password},
+	}, true
+}
+
+func TestRemoteDigest_CredentialProvider(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "secret"
+	manifestDigest := registry.addManifest("library/private", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	provider := &fakeCredentialProvider{username: "user", password: "secret"}
+	ref := &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+	if err := NewRemoteDigest(provider).PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != manifestDigest.String() {
+		t.Errorf("Expected digest %s, but got %s", manifestDigest, ref.Digest)
+	}
+	if len(provider.lookups) != 1 || provider.lookups[0] != host {
+		t.Errorf("Expected the provider to be asked for %s, but got %v", host, provider.lookups)
+	}
+	if ref.Provenance == nil || ref.Provenance.Credential != unknownCredential || ref.Provenance.ResolvedAt.IsZero() {
+		t.Errorf("Expected the provenance to record an unknown credential, but got %+v", ref.Provenance)
+	}
+
+	// The map based credentials still work.
+	creds := graph.RegistryLoginCredentials{
+		host: {
+			Username: &secretmgmt.Secret{ResolvedValue: "user"},
+			Password: &secretmgmt.Secret{ResolvedValue: "secret"},
+			Type:     graph.Opaque,
+		},
+	}
+	ref = &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+	if err := NewRemoteDigest(creds).PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != manifestDigest.String() {
+		t.Errorf("Expected digest %s, but got %s", manifestDigest, ref.Digest)
+	}
+	if ref.Provenance == nil || ref.Provenance.Credential != graph.Opaque || ref.Provenance.Mirror != "" || ref.Provenance.Fallback {
+		t.Errorf("Expected the provenance to record the opaque credential, but got %+v", ref.Provenance)
+	}
+}
+
+func TestRemoteDigest_DefaultCredential(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "secret"
+	manifestDigest := registry.addManifest("library/private", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	cred := func(username string, password string) *graph.ResolvedRegistryCred {
+		return &graph.ResolvedRegistryCred{
+			Username: &secretmgmt.Secret{ResolvedValue: username},
+			Password: &secretmgmt.Secret{ResolvedValue: password},
+		}
+	}
+	staleSource := &CredentialSource{
+		Name: "stale-sp",
+		Credentials: func(ctx context.Context) (string, string, error) {
+			return "user", "expired", nil
+		},
+	}
+
+	tests := []struct {
+		creds   graph.RegistryLoginCredentials
+		sources map[string][]*CredentialSource
+	}{
+		// The default credential is used when the registry has no specific credential.
+		{graph.RegistryLoginCredentials{graph.DefaultRegistry: cred("user", "secret"), "other.azurecr.io": cred("other", "other")}, nil},
+		// An exact credential takes precedence over the default credential.
+		{graph.RegistryLoginCredentials{graph.DefaultRegistry: cred("user", "expired"), host: cred("user", "secret")}, nil},
+		// Including the default credential sources.
+		{
+			graph.RegistryLoginCredentials{graph.DefaultRegistry: cred("user", "expired"), host: cred("user", "secret")},
+			map[string][]*CredentialSource{graph.DefaultRegistry: {staleSource}},
+		},
+	}
+
+	for i, test := range tests {
+		d, err := NewRemoteDigestWithOptions(test.creds, &RemoteDigestOptions{CredentialSources: test.sources})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Test %d: unexpected error: %v", i, err)
+		}
+		if ref.Digest != manifestDigest.String() {
+			t.Errorf("Test %d: expected digest %s, but got %s", i, manifestDigest, ref.Digest)
+		}
+	}
+}
+
+func TestRemoteDigest_PlatformDigests(t *testing.T) {
+	registry := newFakeRegistry()
+	_, outerDigests := registry.addIndex(t, "library/multi", "outer-only",
+		ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"})
+	nestedDigest, nestedDigests := registry.addIndex(t, "library/multi", "",
+		ocispec.Platform{OS: "linux", Architecture: "s390x"},
+		ocispec.Platform{OS: "windows", Architecture: "amd64"})
+	attestation := []byte(`{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `","attestation":true}`)
+	attestationDigest := registry.addManifest("library/multi", "", ocispec.MediaTypeImageManifest, attestation)
+
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex}
+	index.SchemaVersion = 2
+	outer := registry.manifests["library/multi:outer-only"]
+	var outerIndex ocispec.Index
+	if err := json.Unmarshal(outer.content, &outerIndex); err != nil {
+		t.Fatalf("failed to unmarshal index: %v", err)
+	}
+	index.Manifests = append(outerIndex.Manifests,
+		ocispec.Descriptor{MediaType: ocispec.MediaTypeImageIndex, Digest: nestedDigest, Size: int64(len(registry.manifests["library/multi@"+nestedDigest.String()].content))},
+		ocispec.Descriptor{
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Digest:      attestationDigest,
+			Size:        int64(len(attestation)),
+			Platform:    &ocispec.Platform{OS: "unknown", Architecture: "unknown"},
+			Annotations: map[string]string{attestationReferenceTypeAnnotation: "attestation-manifest"},
+		})
+	content, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("failed to marshal index: %v", err)
+	}
+	registry.addManifest("library/multi", "v1", ocispec.MediaTypeImageIndex, content)
+	registry.addManifest("library/single", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	d := NewRemoteDigest(nil)
+	ref := &image.Reference{Registry: host, Repository: "library/multi", Tag: "v1", Reference: host + "/library/multi:v1"}
+	actual, err := d.PlatformDigests(context.Background(), ref)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := map[string]string{
+		"linux/amd64":   outerDigests["linux/amd64"].String(),
+		"linux/arm64":   outerDigests["linux/arm64"].String(),
+		"linux/s390x":   nestedDigests["linux/s390x"].String(),
+		"windows/amd64": nestedDigests["windows/amd64"].String(),
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, but got %v", expected, actual)
+	}
+
+	ref = &image.Reference{Registry: host, Repository: "library/single", Tag: "v1", Reference: host + "/library/single:v1"}
+	if _, err := d.PlatformDigests(context.Background(), ref); err == nil || !strings.Contains(err.Error(), "isn't an image index") {
+		t.Errorf("Expected an error for a reference which isn't an index, but got %v", err)
+	}
+}
+
+func TestRemoteDigest_PlatformDigestsAllowlist(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addIndex(t, "library/multi", "v1", ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	host, conns, stop := startCountingRegistry(registry)
+	defer stop()
+
+	allowlist, err := NewRegistryAllowlist([]string{"allowed.azurecr.io"})
+	if err != nil {
+		t.Fatalf("Failed to create the allowlist: %v", err)
+	}
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{RegistryAllowlist: allowlist})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	ref := &image.Reference{Registry: host, Repository: "library/multi", Tag: "v1", Reference: host + "/library/multi:v1"}
+	if _, err := d.PlatformDigests(context.Background(), ref); err == nil || !strings.Contains(err.Error(), "policy violation") {
+		t.Errorf("Expected a policy violation for a registry which isn't allowed, but got %v", err)
+	}
+	if actual := atomic.LoadInt32(conns); actual != 0 {
+		t.Errorf("Expected the registry which isn't allowed not to be contacted, but got %d connections", actual)
+	}
+}
+
+func TestRemoteDigest_DebugLoggingRedactsSecrets(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "s3cr3t-value"
+	registry.addManifest("library/private", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	defer util.SetVerbosity(util.GetVerbosity())
+	util.SetVerbosity(util.VerbosityDebug)
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	creds := graph.RegistryLoginCredentials{
+		host: {
+			Username: &secretmgmt.Secret{ResolvedValue: "user"},
+			Password: &secretmgmt.Secret{ResolvedValue: "s3cr3t-value"},
+		},
+	}
+	ref := &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+	if err := NewRemoteDigest(creds).PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	logged := buf.String()
+	for _, expected := range []string{"password: <redacted>", "Registry request: HEAD http://" + host + "/v2/library/private/manifests/v1 -> 401 Unauthorized", "Resolved '" + ref.Reference + "'"} {
+		if !strings.Contains(logged, expected) {
+			t.Errorf("Expected the debug logs to contain %q, but got %s", expected, logged)
+		}
+	}
+	if strings.Contains(logged, "s3cr3t-value") {
+		t.Errorf("Expected the debug logs not to contain the password, but got %s", logged)
+	}
+}
+
+func TestRemoteDigest_BearerToken(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.token = "token"
+	manifestDigest := registry.addManifest("library/private", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	credentials := func(token string) graph.RegistryLoginCredentials {
+		return graph.RegistryLoginCredentials{
+			host: {
+				Username:    &secretmgmt.Secret{},
+				Password:    &secretmgmt.Secret{ResolvedValue: token},
+				BearerToken: true,
+			},
+		}
+	}
+
+	ref := &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+	if err := NewRemoteDigest(credentials("token")).PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != manifestDigest.String() {
+		t.Errorf("Expected digest %s but got %s", manifestDigest, ref.Digest)
+	}
+
+	for _, token := range []string{"wrong", ""} {
+		ref := &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+		if err := NewRemoteDigest(credentials(token)).PopulateDigest(context.Background(), ref); err == nil {
+			t.Errorf("Expected an error resolving with the bearer token %q", token)
+		}
+	}
+
+	if err := NewRemoteDigest(credentials("token")).CheckRegistryAuth(context.Background(), host); err != nil {
+		t.Errorf("Unexpected error checking access with the bearer token: %v", err)
+	}
+	if err := NewRemoteDigest(credentials("wrong")).CheckRegistryAuth(context.Background(), host); err == nil || !strings.Contains(err.Error(), "rejected the credentials") {
+		t.Errorf("Expected the registry to reject the bearer token, but got %v", err)
+	}
+}
+
+func TestRemoteDigest_AnonymousFirst(t *testing.T) {
+	public := newFakeRegistry()
+	publicDigest := public.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	publicHost, stopPublic := public.start()
+	defer stopPublic()
+
+	private := newFakeRegistry()
+	private.username, private.password = "user", "secret"
+	privateDigest := private.addManifest("library/private", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	privateHost, stopPrivate := private.start()
+	defer stopPrivate()
+
+	tests := []struct {
+		name           string
+		host           string
+		repository     string
+		anonymousFirst bool
+		expected       string
+		usesSource     bool
+	}{
+		{"credentials first by default", publicHost, "library/hello", false, publicDigest.String(), true},
+		{"public resolves anonymously", publicHost, "library/hello", true, publicDigest.String(), false},
+		{"private falls back to credentials", privateHost, "library/private", true, privateDigest.String(), true},
+	}
+
+	for _, test := range tests {
+		var acquired int
+		source := &CredentialSource{
+			Name: "sp",
+			Credentials: func(ctx context.Context) (string, string, error) {
+				acquired++
+				return "user", "secret", nil
+			},
+		}
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+			AnonymousFirst:    test.anonymousFirst,
+			CredentialSources: map[string][]*CredentialSource{test.host: {source}},
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to create remote digest: %v", test.name, err)
+		}
+		ref := &image.Reference{Registry: test.host, Repository: test.repository, Tag: "v1", Reference: test.host + "/" + test.repository + ":v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("%s: expected digest %s, but got %s", test.name, test.expected, ref.Digest)
+		}
+		if (acquired > 0) != test.usesSource {
+			t.Errorf("%s: expected the credentials to be used: %v, but they were acquired %d times", test.name, test.usesSource, acquired)
+		}
+	}
+}
+
+func TestRemoteDigest_AnonymousFirstCredentialProvider(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "secret"
+	manifestDigest := registry.addManifest("library/private", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	provider := &fakeCredentialProvider{username: "user", password: "secret"}
+	d, err := NewRemoteDigestWithOptions(provider, &RemoteDigestOptions{AnonymousFirst: true})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	ref := &image.Reference{Registry: host, Repository: "library/private", Tag: "v1", Reference: host + "/library/private:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != manifestDigest.String() {
+		t.Errorf("Expected digest %s, but got %s", manifestDigest, ref.Digest)
+	}
+}
+
+func TestRemoteDigest_AnonymousFirstNotFound(t *testing.T) {
+	registry := newFakeRegistry()
+	host, stop := registry.start()
+	defer stop()
+
+	var acquired int
+	source := &CredentialSource{
+		Name: "sp",
+		Credentials: func(ctx context.Context) (string, string, error) {
+			acquired++
+			return "user", "secret", nil
+		},
+	}
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		AnonymousFirst:    true,
+		CredentialSources: map[string][]*CredentialSource{host: {source}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	// Only refusals fall back to the credentials, a reference which isn't found anonymously fails.
+	ref := &image.Reference{Registry: host, Repository: "library/missing", Tag: "v1", Reference: host + "/library/missing:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err == nil || !errdefs.IsNotFound(err) {
+		t.Errorf("Expected a not found error, but got %v", err)
+	}
+	if acquired > 0 {
+		t.Errorf("Expected the credentials not to be used, but they were acquired %d times", acquired)
+	}
+}
+
+func TestRemoteDigest_AnonymousFirstRequireCredentials(t *testing.T) {
+	registry := newFakeRegistry()
+	manifestDigest := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	tests := []struct {
+		publicRegistries []string
+		usesSource       bool
+	}{
+		{nil, true},
+		{[]string{host}, false},
+	}
+
+	for _, test := range tests {
+		var acquired int
+		source := &CredentialSource{
+			Name: "sp",
+			Credentials: func(ctx context.Context) (string, string, error) {
+				acquired++
+				return "user", "secret", nil
+			},
+		}
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+			AnonymousFirst:     true,
+			RequireCredentials: true,
+			PublicRegistries:   test.publicRegistries,
+			CredentialSources:  map[string][]*CredentialSource{host: {source}},
+		})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error for %v: %v", test.publicRegistries, err)
+		}
+		if ref.Digest != manifestDigest.String() {
+			t.Errorf("Expected digest %s, but got %s", manifestDigest, ref.Digest)
+		}
+		if (acquired > 0) != test.usesSource {
+			t.Errorf("Expected the credentials to be used for %v: %v, but they were acquired %d times", test.publicRegistries, test.usesSource, acquired)
+		}
+	}
+}
+
+// dualPublishedRegistry serves library/app:v1 as both a Docker and an OCI manifest, negotiating the
+// variant like registries which honor the order and quality values of the Accept header.
+type dualPublishedRegistry struct {
+	manifests map[string][]byte
+	accepts   []string
+}
+
+func (r *dualPublishedRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/v2/" {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if req.URL.Path != "/v2/library/app/manifests/v1" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	r.accepts = append(r.accepts, req.Header.Get("Accept"))
+	mediaType := ""
+	bestQuality := -1.0
+	for _, accepted := range strings.Split(req.Header.Get("Accept"), ",") {
+		parts := strings.Split(strings.TrimSpace(accepted), ";")
+		quality := 1.0
+		for _, param := range parts[1:] {
+			if q := strings.TrimPrefix(strings.TrimSpace(param), "q="); q != param {
+				quality, _ = strconv.ParseFloat(q, 64)
+			}
+		}
+		if _, ok := r.manifests[parts[0]]; ok && quality > bestQuality {
+			mediaType, bestQuality = parts[0], quality
+		}
+	}
+	content, ok := r.manifests[mediaType]
+	if !ok {
+		w.WriteHeader(http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", mediaType)
+	w.Header().Set("Docker-Content-Digest", digest.FromBytes(content).String())
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	w.WriteHeader(http.StatusOK)
+	if req.Method == http.MethodGet {
+		_, _ = w.Write(content)
+	}
+}
+
+func TestRemoteDigest_PreferOCIMediaTypes(t *testing.T) {
+	registry := &dualPublishedRegistry{manifests: map[string][]byte{
+		images.MediaTypeDockerSchema2Manifest: []byte(`{"schemaVersion":2,"mediaType":"` + images.MediaTypeDockerSchema2Manifest + `"}`),
+		ocispec.MediaTypeImageManifest:        []byte(`{"schemaVersion":2,"mediaType":"` + ocispec.MediaTypeImageManifest + `"}`),
+	}}
+	server := httptest.NewServer(registry)
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "http://")
+
+	tests := []struct {
+		preferOCI bool
+		expected  string
+	}{
+		{false, images.MediaTypeDockerSchema2Manifest},
+		{true, ocispec.MediaTypeImageManifest},
+	}
+	for _, test := range tests {
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{PreferOCIMediaTypes: test.preferOCI})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/app", Tag: "v1", Reference: host + "/library/app:v1"}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if expected := digest.FromBytes(registry.manifests[test.expected]).String(); ref.Digest != expected {
+			t.Errorf("Expected the digest of the %s manifest %s when preferring OCI: %v, but got %s", test.expected, expected, test.preferOCI, ref.Digest)
+		}
+	}
+	if len(registry.accepts) == 0 || !strings.HasPrefix(registry.accepts[len(registry.accepts)-1], ocispec.MediaTypeImageIndex+", "+ocispec.MediaTypeImageManifest+", ") {
+		t.Errorf("Expected the OCI media types to be accepted first, but got %v", registry.accepts)
+	}
+}
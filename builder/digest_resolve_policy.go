@@ -0,0 +1,115 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+// DefaultResolveRetryDelay is the delay between the attempts to resolve a reference when a ResolvePolicy doesn't set one.
+const DefaultResolveRetryDelay = time.Second
+
+// ResolvePolicy configures how patient resolving references against a registry is.
+type ResolvePolicy struct {
+	// Timeout limits the time taken by each attempt to resolve a reference. If zero, attempts are only
+	// limited by the context they're made with.
+	Timeout time.Duration
+
+	// Retries is the number of times resolving a reference is retried after it fails. References which
+	// don't exist, and requests which fail to authenticate, aren't retried.
+	Retries int
+
+	// RetryDelay is the delay between attempts. If zero, DefaultResolveRetryDelay is used.
+	RetryDelay time.Duration
+}
+
+// ParseResolvePolicies parses per-registry resolve policies in the format of 'registry;timeout;retries',
+// e.g. '*.docker.io;30s;3', keyed by the registry, which may be a wildcard such as *.azurecr.io, or * for
+// all registries without a more specific policy.
+func ParseResolvePolicies(values []string) (map[string]*ResolvePolicy, error) {
+	policies := make(map[string]*ResolvePolicy, len(values))
+	for _, value := range values {
+		parts := strings.Split(value, ";")
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("invalid resolve policy '%s', expected the format 'registry;timeout;retries'", value)
+		}
+		timeout, err := time.ParseDuration(parts[1])
+		if err != nil || timeout < 0 {
+			return nil, fmt.Errorf("invalid timeout '%s' in the resolve policy for registry '%s'", parts[1], parts[0])
+		}
+		retries, err := strconv.Atoi(parts[2])
+		if err != nil || retries < 0 {
+			return nil, fmt.Errorf("invalid number of retries '%s' in the resolve policy for registry '%s'", parts[2], parts[0])
+		}
+		policies[parts[0]] = &ResolvePolicy{Timeout: timeout, Retries: retries}
+	}
+	return policies, nil
+}
+
+// validate validates that the policy's timeout, retries and retry delay aren't negative.
+func (p *ResolvePolicy) validate() error {
+	if p.Timeout < 0 || p.Retries < 0 || p.RetryDelay < 0 {
+		return fmt.Errorf("invalid resolve policy, its timeout (%v), retries (%d) and retry delay (%v) can't be negative", p.Timeout, p.Retries, p.RetryDelay)
+	}
+	return nil
+}
+
+// resolvePolicy returns the policy which applies to the registry, using the same precedence as
+// graph.RegistryLoginCredentials: exact, wildcard, then default, and falling back to the global policy.
+func (d *remoteDigest) resolvePolicy(registry string) ResolvePolicy {
+	patterns := make([]string, 0, len(d.resolvePolicies))
+	for pattern := range d.resolvePolicies {
+		patterns = append(patterns, pattern)
+	}
+	if pattern, ok := graph.MatchRegistry(registry, patterns); ok {
+		return *d.resolvePolicies[pattern]
+	}
+	return d.defaultResolvePolicy
+}
+
+// resolveWithPolicy resolves imageRef against the registry using the resolver, limiting each attempt to
+// the timeout of the registry's policy and retrying failed attempts as many times as the policy allows.
+func (d *remoteDigest) resolveWithPolicy(ctx context.Context, resolver remotes.Resolver, registry string, imageRef string) (string, ocispec.Descriptor, error) {
+	policy := d.resolvePolicy(registry)
+	delay := policy.RetryDelay
+	if delay == 0 {
+		delay = DefaultResolveRetryDelay
+	}
+	for attempt := 0; ; attempt++ {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if policy.Timeout > 0 {
+			attemptCtx, cancel = context.WithTimeout(ctx, policy.Timeout)
+		}
+		attemptCtx, status := withRegistryStatus(attemptCtx)
+		name, desc, err := resolver.Resolve(attemptCtx, imageRef)
+		err = status.wrap(err)
+		cancel()
+		if err == nil {
+			return name, desc, nil
+		}
+		if attempt >= policy.Retries || ctx.Err() != nil || errdefs.IsNotFound(err) || isAuthFailure(err) {
+			if attemptCtx.Err() == context.DeadlineExceeded && ctx.Err() == nil {
+				err = errors.Wrapf(err, "the attempt exceeded the timeout of %v for registry '%s'", policy.Timeout, registry)
+			}
+			return "", ocispec.Descriptor{}, err
+		}
+		util.Debugf("Failed to resolve '%s', retrying in %v (%d/%d): %v\n", imageRef, delay, attempt+1, policy.Retries, err)
+		select {
+		case <-ctx.Done():
+			return "", ocispec.Descriptor{}, err
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,182 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/images"
+)
+
+// failingRegistry fails the first failures requests for manifests with 503 Service Unavailable,
+// or delays them by delay, before serving them from the registry.
+type failingRegistry struct {
+	registry *fakeRegistry
+	failures int32
+	delay    time.Duration
+	requests int32
+}
+
+func (r *failingRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if strings.Contains(req.URL.Path, "/manifests/") && atomic.AddInt32(&r.requests, 1) <= r.failures {
+		if r.delay == 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		select {
+		case <-req.Context().Done():
+		case <-time.After(r.delay):
+		}
+	}
+	r.registry.ServeHTTP(w, req)
+}
+
+// start starts serving the registry and returns its host and a function to stop it.
+func (r *failingRegistry) start() (string, func()) {
+	server := httptest.NewServer(r)
+	return strings.TrimPrefix(server.URL, "http://"), server.Close
+}
+
+func newFailingRegistry(failures int32, delay time.Duration) *failingRegistry {
+	registry := newFakeRegistry()
+	registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	return &failingRegistry{registry: registry, failures: failures, delay: delay}
+}
+
+func TestRemoteDigest_RegistryResolvePolicies(t *testing.T) {
+	flaky := newFailingRegistry(2, 0)
+	flakyHost, stopFlaky := flaky.start()
+	defer stopFlaky()
+	strict := newFailingRegistry(1, 0)
+	strictHost, stopStrict := strict.start()
+	defer stopStrict()
+
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		RegistryResolvePolicies: map[string]*ResolvePolicy{
+			flakyHost: {Retries: 2, RetryDelay: time.Millisecond},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+
+	ref := &image.Reference{Registry: flakyHost, Repository: "library/hello", Tag: "v1", Reference: flakyHost + "/library/hello:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Expected the flaky registry to be retried, but got: %v", err)
+	}
+	if ref.Digest == "" {
+		t.Error("Expected the digest to be populated after retrying")
+	}
+
+	// The registry without an override isn't retried.
+	ref = &image.Reference{Registry: strictHost, Repository: "library/hello", Tag: "v1", Reference: strictHost + "/library/hello:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err == nil {
+		t.Error("Expected the registry without an override not to be retried")
+	}
+	if requests := atomic.LoadInt32(&strict.requests); requests != 1 {
+		t.Errorf("Expected a single request for the registry without an override, but got %d", requests)
+	}
+}
+
+func TestRemoteDigest_ResolvePolicyTimeout(t *testing.T) {
+	slow := newFailingRegistry(1, 10*time.Second)
+	host, stop := slow.start()
+	defer stop()
+
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		ResolvePolicy: ResolvePolicy{Timeout: 100 * time.Millisecond, Retries: 1, RetryDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+	start := time.Now()
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Expected the attempt which timed out to be retried, but got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the slow attempt to time out after 100ms, but resolving took %v", elapsed)
+	}
+}
+
+func TestRemoteDigest_ResolvePolicyNotFound(t *testing.T) {
+	registry := newFailingRegistry(0, 0)
+	host, stop := registry.start()
+	defer stop()
+
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{ResolvePolicy: ResolvePolicy{Retries: 3, RetryDelay: time.Millisecond}})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+	ref := &image.Reference{Registry: host, Repository: "library/missing", Tag: "v1", Reference: host + "/library/missing:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err == nil {
+		t.Fatal("Expected an error resolving a reference which doesn't exist")
+	}
+	if requests := atomic.LoadInt32(&registry.requests); requests > 2 {
+		t.Errorf("Expected a reference which doesn't exist not to be retried, but got %d requests", requests)
+	}
+}
+
+func TestResolvePolicyMatching(t *testing.T) {
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		ResolvePolicy: ResolvePolicy{Retries: 1},
+		RegistryResolvePolicies: map[string]*ResolvePolicy{
+			"*.docker.io":         {Retries: 5},
+			"mirror.docker.io":    {Retries: 2},
+			"internal.azurecr.io": {Timeout: time.Second},
+			"*.external.example":  {Retries: 3, Timeout: time.Minute},
+			"*.azurecr.io":        {Retries: 4},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to create remote digest: %v", err)
+	}
+
+	tests := []struct {
+		registry string
+		expected ResolvePolicy
+	}{
+		{"registry-1.docker.io", ResolvePolicy{Retries: 5}},
+		{"MIRROR.docker.io", ResolvePolicy{Retries: 2}},
+		{"internal.azurecr.io", ResolvePolicy{Timeout: time.Second}},
+		{"other.azurecr.io", ResolvePolicy{Retries: 4}},
+		{"cdn.external.example", ResolvePolicy{Retries: 3, Timeout: time.Minute}},
+		{"gcr.io", ResolvePolicy{Retries: 1}},
+	}
+	for _, test := range tests {
+		if actual := d.resolvePolicy(test.registry); actual != test.expected {
+			t.Errorf("Expected the policy %+v for %s, but got %+v", test.expected, test.registry, actual)
+		}
+	}
+}
+
+func TestParseResolvePolicies(t *testing.T) {
+	policies, err := ParseResolvePolicies([]string{"*.docker.io;30s;3", "myregistry.azurecr.io;5s;0"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p := policies["*.docker.io"]; p == nil || p.Timeout != 30*time.Second || p.Retries != 3 {
+		t.Errorf("Unexpected policy for *.docker.io: %+v", p)
+	}
+	if p := policies["myregistry.azurecr.io"]; p == nil || p.Timeout != 5*time.Second || p.Retries != 0 {
+		t.Errorf("Unexpected policy for myregistry.azurecr.io: %+v", p)
+	}
+
+	for _, value := range []string{"docker.io;30s", ";30s;3", "docker.io;soon;3", "docker.io;30s;-1", "docker.io;-1s;3"} {
+		if _, err := ParseResolvePolicies([]string{value}); err == nil {
+			t.Errorf("Expected an error parsing %q", value)
+		}
+	}
+
+	if _, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{ResolvePolicy: ResolvePolicy{Retries: -1}}); err == nil {
+		t.Error("Expected an error for a negative number of retries")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/pkg/errors"
+)
+
+const (
+	// RewriteRulePrefix replaces the prefix of a reference.
+	RewriteRulePrefix = "prefix"
+	// RewriteRuleRegex replaces the matches of a regular expression in a reference.
+	RewriteRuleRegex = "regex"
+)
+
+// RewriteRule rewrites image references matching From, e.g. to migrate from one registry to another.
+type RewriteRule struct {
+	// Type is either RewriteRulePrefix or RewriteRuleRegex.
+	Type string
+	// From is the prefix or regular expression to match.
+	From string
+	// To is the replacement. Regex replacements can use capture groups, e.g. $1.
+	To string
+}
+
+// String returns the rule in the format parsed by ParseRewriteRules.
+func (r RewriteRule) String() string {
+	return r.Type + ";" + r.From + ";" + r.To
+}
+
+// ReferenceRewriter rewrites image references using a set of rules.
+// Prefix rules take precedence over regex rules, and the longest matching prefix wins.
+// Regex rules are tried in the order they were specified.
+type ReferenceRewriter struct {
+	rules       []RewriteRule
+	prefixRules []RewriteRule
+	regexRules  []*regexp.Regexp
+	regexTo     []string
+}
+
+// NewReferenceRewriter creates a ReferenceRewriter from the rules.
+func NewReferenceRewriter(rules []RewriteRule) (*ReferenceRewriter, error) {
+	r := &ReferenceRewriter{rules: rules}
+	for _, rule := range rules {
+		if rule.From == "" {
+			return nil, errors.New("rewrite rules must match a non-empty pattern")
+		}
+		switch rule.Type {
+		case RewriteRulePrefix:
+			r.prefixRules = append(r.prefixRules, rule)
+		case RewriteRuleRegex:
+			re, err := regexp.Compile(rule.From)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid rewrite rule regex '%s'", rule.From)
+			}
+			r.regexRules = append(r.regexRules, re)
+			r.regexTo = append(r.regexTo, rule.To)
+		default:
+			return nil, fmt.Errorf("invalid rewrite rule type '%s', expected %s or %s", rule.Type, RewriteRulePrefix, RewriteRuleRegex)
+		}
+	}
+	return r, nil
+}
+
+// ParseRewriteRules parses rewrite rules in the format of 'type;from;to', e.g. 'prefix;docker.io/;myregistry.azurecr.io/'.
+func ParseRewriteRules(values []string) ([]RewriteRule, error) {
+	var rules []RewriteRule
+	for _, value := range values {
+		parts := strings.SplitN(value, ";", 3)
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("invalid rewrite rule '%s', expected the format 'type;from;to'", value)
+		}
+		rules = append(rules, RewriteRule{Type: parts[0], From: parts[1], To: parts[2]})
+	}
+	return rules, nil
+}
+
+// Rewrite returns the rewritten reference and whether any rule matched.
+func (r *ReferenceRewriter) Rewrite(ref string) (string, bool) {
+	var best *RewriteRule
+	for i := range r.prefixRules {
+		rule := &r.prefixRules[i]
+		if strings.HasPrefix(ref, rule.From) && (best == nil || len(rule.From) > len(best.From)) {
+			best = rule
+		}
+	}
+	if best != nil {
+		return best.To + strings.TrimPrefix(ref, best.From), true
+	}
+
+	for i, re := range r.regexRules {
+		if re.MatchString(ref) {
+			return re.ReplaceAllString(ref, r.regexTo[i]), true
+		}
+	}
+	return ref, false
+}
+
+// rewriteDigest is a DigestHelper which rewrites references before another DigestHelper populates their digests.
+type rewriteDigest struct {
+	helper   DigestHelper
+	rewriter *ReferenceRewriter
+}
+
+// NewRewriteDigest creates a DigestHelper which rewrites references using rewriter before populating their digests.
+// Rewritten references keep the original reference in OriginalReference.
+func NewRewriteDigest(helper DigestHelper, rewriter *ReferenceRewriter) DigestHelper {
+	return &rewriteDigest{
+		helper:   helper,
+		rewriter: rewriter,
+	}
+}
+
+var _ DigestHelper = &rewriteDigest{}
+
+func (d *rewriteDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	// References which were already rewritten, e.g. when their Dockerfile was pinned, aren't rewritten again.
+	if ref == nil || IsNoBaseImage(ref) || ref.OriginalReference != "" {
+		return d.helper.PopulateDigest(ctx, ref)
+	}
+	rewritten, ok := d.rewriter.Rewrite(ref.Reference)
+	if !ok {
+		return d.helper.PopulateDigest(ctx, ref)
+	}
+
+	rewrittenRef, err := scan.NewImageReference(rewritten)
+	if err != nil {
+		return errors.Wrapf(err, "failed to rewrite the reference '%s'", ref.Reference)
+	}
+	log.Printf("Rewrote the reference '%s' to '%s'\n", ref.Reference, rewrittenRef.Reference)
+	rewrittenRef.OriginalReference = ref.Reference
+	// The rewritten reference is expected to serve the same content, e.g. from a mirror.
+	rewrittenRef.FallbackDigest = ref.FallbackDigest
+	originalRegistry := ref.Registry
+	*ref = *rewrittenRef
+	if err := d.helper.PopulateDigest(ctx, ref); err != nil {
+		return err
+	}
+	if ref.Provenance != nil && ref.Provenance.Mirror == "" && ref.Registry != originalRegistry {
+		ref.Provenance.Mirror = ref.Registry
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+)
+
+func TestReferenceRewriter_Rewrite(t *testing.T) {
+	rewriter, err := NewReferenceRewriter([]RewriteRule{
+		{Type: RewriteRuleRegex, From: `^([^/.]+)(:.*)?$`, To: "mirror.azurecr.io/library/$1$2"},
+		{Type: RewriteRulePrefix, From: "old.azurecr.io/", To: "new.azurecr.io/"},
+		{Type: RewriteRulePrefix, From: "old.azurecr.io/team/", To: "team.azurecr.io/"},
+		{Type: RewriteRuleRegex, From: `^old\.azurecr\.io`, To: "unused.azurecr.io"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	tests := []struct {
+		ref      string
+		expected string
+		ok       bool
+	}{
+		{"old.azurecr.io/app:v1", "new.azurecr.io/app:v1", true},
+		// The longest prefix wins.
+		{"old.azurecr.io/team/app:v1", "team.azurecr.io/app:v1", true},
+		{"golang:1.19", "mirror.azurecr.io/library/golang:1.19", true},
+		{"other.azurecr.io/app:v1", "other.azurecr.io/app:v1", false},
+	}
+
+	for _, test := range tests {
+		actual, ok := rewriter.Rewrite(test.ref)
+		if actual != test.expected || ok != test.ok {
+			t.Errorf("Expected %s to be rewritten to %s (%v), but got %s (%v)", test.ref, test.expected, test.ok, actual, ok)
+		}
+	}
+}
+
+func TestNewReferenceRewriter_Invalid(t *testing.T) {
+	tests := [][]RewriteRule{
+		{{Type: "glob", From: "a", To: "b"}},
+		{{Type: RewriteRuleRegex, From: "(", To: "b"}},
+		{{Type: RewriteRulePrefix, From: "", To: "b"}},
+	}
+	for _, rules := range tests {
+		if _, err := NewReferenceRewriter(rules); err == nil {
+			t.Errorf("Expected %v to be invalid, but it wasn't", rules)
+		}
+	}
+}
+
+func TestParseRewriteRules(t *testing.T) {
+	rules, err := ParseRewriteRules([]string{"prefix;old.azurecr.io/;new.azurecr.io/", "regex;^a;b;c"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []RewriteRule{
+		{Type: RewriteRulePrefix, From: "old.azurecr.io/", To: "new.azurecr.io/"},
+		{Type: RewriteRuleRegex, From: "^a", To: "b;c"},
+	}
+	if len(rules) != len(expected) || rules[0] != expected[0] || rules[1] != expected[1] {
+		t.Errorf("Expected %v, but got %v", expected, rules)
+	}
+	if _, err := ParseRewriteRules([]string{"prefix;old.azurecr.io/"}); err == nil {
+		t.Error("Expected an error for a rule without a replacement, but got none")
+	}
+}
+
+func TestRewriteDigest_PopulateDigest(t *testing.T) {
+	rewriter, err := NewReferenceRewriter([]RewriteRule{{Type: RewriteRulePrefix, From: "old.azurecr.io/", To: "new.azurecr.io/"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	helper := NewRewriteDigest(&staticDigest{digest: mutableTagTestDigest}, rewriter)
+
+	ref := &image.Reference{Registry: "old.azurecr.io", Repository: "app", Tag: "v1", Reference: "old.azurecr.io/app:v1"}
+	if err := helper.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := &image.Reference{
+		Registry:          "new.azurecr.io",
+		Repository:        "app",
+		Tag:               "v1",
+		Digest:            mutableTagTestDigest,
+		Reference:         "new.azurecr.io/app:v1",
+		OriginalReference: "old.azurecr.io/app:v1",
+	}
+	if !image.Equals(ref, expected) {
+		t.Errorf("Expected %v, but got %v", expected, ref)
+	}
+}
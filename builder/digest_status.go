@@ -0,0 +1,101 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"net/http"
+	"sync"
+
+	remoteerrors "github.com/containerd/containerd/remotes/errors"
+	"github.com/pkg/errors"
+)
+
+// registryStatusKey is the context key of the registryStatus which records the responses of a request to a registry.
+type registryStatusKey struct{}
+
+// registryStatus records the status of the last response a registry returned while a reference was resolved,
+// since containerd's resolver only reports the status which failed a resolve in the text of its error.
+type registryStatus struct {
+	mu   sync.Mutex
+	code int
+}
+
+// withRegistryStatus returns a copy of ctx whose requests to registries record their status in the returned registryStatus.
+func withRegistryStatus(ctx context.Context) (context.Context, *registryStatus) {
+	status := &registryStatus{}
+	return context.WithValue(ctx, registryStatusKey{}, status), status
+}
+
+// wrap returns err annotated with the status of the registry's last response, if it was an error status.
+func (s *registryStatus) wrap(err error) error {
+	if err == nil {
+		return nil
+	}
+	s.mu.Lock()
+	code := s.code
+	s.mu.Unlock()
+	if code < http.StatusBadRequest {
+		return err
+	}
+	return &registryStatusError{StatusCode: code, err: err}
+}
+
+// registryStatusError is an error caused by a registry responding with an error status, e.g. a 401.
+type registryStatusError struct {
+	StatusCode int
+	err        error
+}
+
+func (e *registryStatusError) Error() string {
+	return e.err.Error()
+}
+
+func (e *registryStatusError) Unwrap() error {
+	return e.err
+}
+
+// registryStatusCode returns the status of the registry's response which caused err, or 0 if err wasn't caused
+// by a registry responding with an error status, e.g. because the registry couldn't be reached.
+func registryStatusCode(err error) int {
+	var statusErr *registryStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.StatusCode
+	}
+	var unexpected remoteerrors.ErrUnexpectedStatus
+	if errors.As(err, &unexpected) {
+		return unexpected.StatusCode
+	}
+	return 0
+}
+
+// registryStatusTransport records the status of each response in the registryStatus of its request's context, if any.
+// Requests which fail without a response reset the status, so it's only reported for the error it caused.
+type registryStatusTransport struct {
+	next http.RoundTripper
+}
+
+func (t *registryStatusTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if status, ok := req.Context().Value(registryStatusKey{}).(*registryStatus); ok {
+		status.mu.Lock()
+		status.code = 0
+		if err == nil {
+			status.code = resp.StatusCode
+		}
+		status.mu.Unlock()
+	}
+	return resp, err
+}
+
+// withRegistryStatusRecording returns a copy of client which records the status of its responses, see withRegistryStatus.
+func withRegistryStatusRecording(client *http.Client) *http.Client {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	recording := *client
+	recording.Transport = &registryStatusTransport{next: next}
+	return &recording
+}
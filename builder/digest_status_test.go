@@ -0,0 +1,62 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/remotes/docker"
+	remoteerrors "github.com/containerd/containerd/remotes/errors"
+)
+
+func TestIsAuthFailure(t *testing.T) {
+	tests := []struct {
+		name         string
+		err          error
+		authFailure  bool
+		unauthorized bool
+	}{
+		{"invalid authorization", fmt.Errorf("pull access denied: %w", docker.ErrInvalidAuthorization), true, true},
+		{"401", &registryStatusError{StatusCode: http.StatusUnauthorized, err: errors.New("failed")}, true, true},
+		{"403", &registryStatusError{StatusCode: http.StatusForbidden, err: errors.New("failed")}, true, false},
+		{"token 401", fmt.Errorf("failed to fetch oauth token: %w", remoteerrors.ErrUnexpectedStatus{StatusCode: http.StatusUnauthorized}), true, true},
+		{"503", &registryStatusError{StatusCode: http.StatusServiceUnavailable, err: errors.New("failed")}, false, false},
+		// Only the status is matched, not text which happens to look like one, e.g. in a repository's name.
+		{"status text", errors.New("failed to resolve myregistry.azurecr.io/401-unauthorized:v1: 401 Unauthorized"), false, false},
+	}
+	for _, test := range tests {
+		if actual := isAuthFailure(test.err); actual != test.authFailure {
+			t.Errorf("%s: expected an auth failure: %v, but got %v", test.name, test.authFailure, actual)
+		}
+		if actual := isUnauthorized(test.err); actual != test.unauthorized {
+			t.Errorf("%s: expected unauthorized: %v, but got %v", test.name, test.unauthorized, actual)
+		}
+	}
+}
+
+func TestRemoteDigest_RegistryStatus(t *testing.T) {
+	for _, status := range []int{http.StatusForbidden, http.StatusServiceUnavailable} {
+		status := status
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(status)
+		}))
+		host := strings.TrimPrefix(server.URL, "http://")
+		ref := &image.Reference{Registry: host, Repository: "app", Tag: "v1", Reference: host + "/app:v1"}
+		err := NewRemoteDigest(nil).PopulateDigest(context.Background(), ref)
+		server.Close()
+		if actual := registryStatusCode(err); actual != status {
+			t.Errorf("Expected the status %d to be recorded, but got %d (%v)", status, actual, err)
+		}
+		if actual := isAuthFailure(err); actual != (status == http.StatusForbidden) {
+			t.Errorf("Expected the %d to be an auth failure: %v, but got %v", status, status == http.StatusForbidden, actual)
+		}
+	}
+}
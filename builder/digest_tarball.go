@@ -0,0 +1,239 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// tarballIndexFile is the OCI image layout's index of the images in a tarball.
+	tarballIndexFile = "index.json"
+
+	// tarballManifestFile is docker save's list of the images in a tarball, along with their tags.
+	tarballManifestFile = "manifest.json"
+
+	// containerdImageNameAnnotation records the full name of an image in the index of a tarball saved by
+	// Docker or containerd, e.g. docker.io/library/alpine:3.18.
+	containerdImageNameAnnotation = "io.containerd.image.name"
+)
+
+// tarballManifest is an entry of docker save's manifest.json.
+type tarballManifest struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+}
+
+// tarballDigest is a DigestHelper which populates the digests of the images saved in tarballs, e.g. by
+// docker save, for fully offline builds. Images which aren't in any of the tarballs fail with an error
+// matching errdefs.ErrNotFound, so it can be chained with another DigestHelper using NewFallbackDigest.
+type tarballDigest struct {
+	// digests maps the canonical name of each image in the tarballs to its digest.
+	digests map[string]string
+}
+
+var _ DigestHelper = &tarballDigest{}
+
+// NewTarballDigest creates a DigestHelper which populates digests from the image tarballs at the paths,
+// which may be gzip compressed. Each tarball must be an OCI image layout, such as the tarballs saved by
+// docker save since Docker 25, whose index.json records the digest of each image's manifest. The images are
+// named by the annotations of the index, as well as by the RepoTags of docker save's manifest.json.
+// If an image is in several tarballs, the first tarball takes precedence.
+func NewTarballDigest(paths ...string) (*tarballDigest, error) {
+	d := &tarballDigest{digests: make(map[string]string)}
+	for _, p := range paths {
+		digests, err := readTarballDigests(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to index the image tarball %s", p)
+		}
+		for name, dgst := range digests {
+			if _, ok := d.digests[name]; !ok {
+				d.digests[name] = dgst
+			}
+		}
+		util.Debugf("Indexed %d images in the image tarball %s\n", len(digests), p)
+	}
+	return d, nil
+}
+
+// PopulateDigest populates the reference's digest if its image is in one of the tarballs.
+func (d *tarballDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	if ref == nil || ref.Digest != "" || IsNoBaseImage(ref) {
+		return nil
+	}
+	name, err := CanonicalName(ref)
+	if err != nil {
+		return err
+	}
+	dgst, ok := d.digests[name]
+	if !ok {
+		return errors.Wrapf(errdefs.ErrNotFound, "the image %s isn't in any of the image tarballs", name)
+	}
+	ref.Digest = dgst
+	ref.Provenance = image.NewProvenance(image.SourceImageTarball)
+	util.Debugf("Resolved '%s' to %s from the image tarballs\n", ref.Reference, dgst)
+	return nil
+}
+
+// readTarballDigests returns the digest of each image in the tarball at p, keyed by its canonical name.
+func readTarballDigests(p string) (map[string]string, error) {
+	var index *ocispec.Index
+	var manifests []tarballManifest
+	err := walkTarball(p, func(name string, r io.Reader) (bool, error) {
+		switch name {
+		case tarballIndexFile:
+			index = &ocispec.Index{}
+			return false, decodeTarballFile(r, name, index)
+		case tarballManifestFile:
+			return false, decodeTarballFile(r, name, &manifests)
+		}
+		return false, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if index == nil {
+		if manifests != nil {
+			return nil, errors.New("the tarball has no index.json, which records the digests of its images, save it with Docker 25 or later or as an OCI image layout")
+		}
+		return nil, errors.New("the tarball isn't an image tarball, it has no index.json")
+	}
+
+	digests := make(map[string]string)
+	add := func(name string, dgst digest.Digest) {
+		canonical, err := CanonicalizeReference(name, "")
+		if err != nil {
+			util.Debugf("Ignoring the image name '%s' in the tarball: %v\n", name, err)
+			return
+		}
+		if _, ok := digests[canonical]; !ok {
+			digests[canonical] = dgst.String()
+		}
+	}
+	for _, desc := range index.Manifests {
+		if name := desc.Annotations[containerdImageNameAnnotation]; name != "" {
+			add(name, desc.Digest)
+		}
+		// The ref name may only be a tag, e.g. 3.18, in which case the image is named by manifest.json.
+		if name := desc.Annotations[ocispec.AnnotationRefName]; strings.ContainsAny(name, ":/") {
+			add(name, desc.Digest)
+		}
+	}
+	if len(manifests) == 0 {
+		return digests, nil
+	}
+
+	// docker save names its images in manifest.json by their configs, which are referenced by their manifests.
+	repoTags := make(map[digest.Digest][]string, len(manifests))
+	for _, m := range manifests {
+		if config, ok := tarballConfigDigest(m.Config); ok {
+			repoTags[config] = append(repoTags[config], m.RepoTags...)
+		}
+	}
+	blobs := make(map[string]digest.Digest)
+	for _, desc := range index.Manifests {
+		if !isIndexMediaType(desc.MediaType) {
+			blobs[path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded())] = desc.Digest
+		}
+	}
+	err = walkTarball(p, func(name string, r io.Reader) (bool, error) {
+		dgst, ok := blobs[name]
+		if !ok {
+			return false, nil
+		}
+		var manifest ocispec.Manifest
+		if err := decodeTarballFile(r, name, &manifest); err != nil {
+			return false, err
+		}
+		for _, tag := range repoTags[manifest.Config.Digest] {
+			add(tag, dgst)
+		}
+		delete(blobs, name)
+		return len(blobs) == 0, nil
+	})
+	return digests, err
+}
+
+// tarballConfigDigest returns the digest of the config at the path in docker save's manifest.json, which is
+// either blobs/sha256/<hex> in an OCI image layout or <hex>.json in tarballs saved by Docker before 25.
+func tarballConfigDigest(config string) (digest.Digest, bool) {
+	var dgst digest.Digest
+	if parts := strings.Split(config, "/"); len(parts) == 3 && parts[0] == "blobs" {
+		dgst = digest.NewDigestFromEncoded(digest.Algorithm(parts[1]), parts[2])
+	} else {
+		dgst = digest.NewDigestFromEncoded(digest.SHA256, strings.TrimSuffix(config, ".json"))
+	}
+	return dgst, dgst.Validate() == nil
+}
+
+// decodeTarballFile decodes the JSON file of a tarball into v, failing if it exceeds the maximum manifest size.
+func decodeTarballFile(r io.Reader, name string, v interface{}) error {
+	data, err := ioutil.ReadAll(io.LimitReader(r, DefaultMaxManifestSize+1))
+	if err != nil {
+		return errors.Wrapf(err, "failed to read %s", name)
+	}
+	if len(data) > DefaultMaxManifestSize {
+		return fmt.Errorf("%s exceeds the maximum manifest size of %d bytes", name, DefaultMaxManifestSize)
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.Wrapf(err, "failed to decode %s", name)
+	}
+	return nil
+}
+
+// walkTarball calls fn with the name and content of each regular file in the tarball at p, which may be
+// gzip compressed, until fn fails or returns true.
+func walkTarball(p string, fn func(name string, r io.Reader) (bool, error)) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	br := bufio.NewReader(f)
+	var r io.Reader = br
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return errors.Wrap(err, "failed to decompress the tarball")
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "failed to read the tarball")
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		done, err := fn(path.Clean(strings.TrimPrefix(hdr.Name, "./")), tr)
+		if err != nil || done {
+			return err
+		}
+	}
+}
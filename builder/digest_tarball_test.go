@@ -0,0 +1,242 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// savedImage is an image in a tarball written by writeImageTarball.
+type savedImage struct {
+	// annotations of the image's entry in index.json.
+	annotations map[string]string
+	// repoTags of the image's entry in manifest.json, which is only written if an image has any.
+	repoTags []string
+}
+
+// writeImageTarball writes a tarball like docker save's, with an empty layer per image, to a file in dir,
+// gzip compressed if compress is set. It returns the path of the tarball and the digest of each image's manifest.
+func writeImageTarball(t *testing.T, dir string, name string, compress bool, images ...savedImage) (string, []digest.Digest) {
+	files := make(map[string][]byte)
+	var order []string
+	addFile := func(name string, content []byte) {
+		if _, ok := files[name]; !ok {
+			order = append(order, name)
+		}
+		files[name] = content
+	}
+	addBlob := func(content []byte) ocispec.Descriptor {
+		dgst := digest.FromBytes(content)
+		addFile("blobs/sha256/"+dgst.Encoded(), content)
+		return ocispec.Descriptor{Digest: dgst, Size: int64(len(content))}
+	}
+
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex}
+	index.SchemaVersion = 2
+	var manifests []tarballManifest
+	var digests []digest.Digest
+	for i, img := range images {
+		layer := addBlob([]byte{})
+		layer.MediaType = ocispec.MediaTypeImageLayer
+		config := addBlob([]byte(`{"architecture":"amd64","os":"linux","created":"` + strings.Repeat("1", i+1) + `"}`))
+		config.MediaType = ocispec.MediaTypeImageConfig
+		manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest, Config: config, Layers: []ocispec.Descriptor{layer}}
+		manifest.SchemaVersion = 2
+		content, err := json.Marshal(manifest)
+		if err != nil {
+			t.Fatalf("Failed to marshal the manifest: %v", err)
+		}
+		desc := addBlob(content)
+		desc.MediaType = ocispec.MediaTypeImageManifest
+		desc.Annotations = img.annotations
+		index.Manifests = append(index.Manifests, desc)
+		digests = append(digests, desc.Digest)
+		if len(img.repoTags) > 0 {
+			manifests = append(manifests, tarballManifest{Config: "blobs/sha256/" + config.Digest.Encoded(), RepoTags: img.repoTags})
+		}
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		t.Fatalf("Failed to marshal the index: %v", err)
+	}
+	addFile("index.json", content)
+	addFile("oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`))
+	if len(manifests) > 0 {
+		content, err := json.Marshal(manifests)
+		if err != nil {
+			t.Fatalf("Failed to marshal manifest.json: %v", err)
+		}
+		addFile("manifest.json", content)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range order {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatalf("Failed to write the tarball: %v", err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatalf("Failed to write the tarball: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Failed to write the tarball: %v", err)
+	}
+	data := buf.Bytes()
+	if compress {
+		var gz bytes.Buffer
+		zw := gzip.NewWriter(&gz)
+		if _, err := zw.Write(data); err != nil {
+			t.Fatalf("Failed to compress the tarball: %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("Failed to compress the tarball: %v", err)
+		}
+		data = gz.Bytes()
+	}
+	p := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(p, data, 0644); err != nil {
+		t.Fatalf("Failed to write the tarball: %v", err)
+	}
+	return p, digests
+}
+
+func TestTarballDigest_PopulateDigest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarball")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Saved by docker save, naming the images by annotations and by manifest.json.
+	saved, savedDigests := writeImageTarball(t, dir, "saved.tar", false,
+		savedImage{annotations: map[string]string{containerdImageNameAnnotation: "docker.io/library/alpine:3.18", ocispec.AnnotationRefName: "3.18"}, repoTags: []string{"alpine:3.18"}},
+		savedImage{repoTags: []string{"myregistry.azurecr.io/base:v1", "myregistry.azurecr.io/base:stable"}})
+	// An OCI image layout naming its image by its ref name, which is gzip compressed.
+	layout, layoutDigests := writeImageTarball(t, dir, "layout.tar.gz", true,
+		savedImage{annotations: map[string]string{ocispec.AnnotationRefName: "mcr.microsoft.com/dotnet/runtime:8.0"}},
+		savedImage{annotations: map[string]string{ocispec.AnnotationRefName: "docker.io/library/alpine:3.18"}})
+
+	d, err := NewTarballDigest(saved, layout)
+	if err != nil {
+		t.Fatalf("Failed to index the tarballs: %v", err)
+	}
+
+	tests := []struct {
+		reference string
+		expected  string
+	}{
+		{"alpine:3.18", savedDigests[0].String()},
+		{"docker.io/library/alpine:3.18", savedDigests[0].String()},
+		{"myregistry.azurecr.io/base:v1", savedDigests[1].String()},
+		{"myregistry.azurecr.io/base:stable", savedDigests[1].String()},
+		{"mcr.microsoft.com/dotnet/runtime:8.0", layoutDigests[0].String()},
+	}
+	for _, test := range tests {
+		ref, err := scan.NewImageReference(test.reference)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", test.reference, err)
+		}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Fatalf("Unexpected error for %s: %v", test.reference, err)
+		}
+		if ref.Digest != test.expected {
+			t.Errorf("Expected digest %s for %s, but got %s", test.expected, test.reference, ref.Digest)
+		}
+	}
+
+	for _, missing := range []string{"alpine:3.19", "myregistry.azurecr.io/other:v1", "3.18"} {
+		ref, err := scan.NewImageReference(missing)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", missing, err)
+		}
+		if err := d.PopulateDigest(context.Background(), ref); err == nil || !errdefs.IsNotFound(err) {
+			t.Errorf("Expected a not found error for %s, but got %v", missing, err)
+		}
+	}
+
+	// Images which aren't in the tarballs are resolved by the next DigestHelper.
+	ref := &image.Reference{Registry: "myregistry.azurecr.io", Repository: "other", Tag: "v1", Reference: "myregistry.azurecr.io/other:v1"}
+	if err := NewFallbackDigest(d, &staticDigest{digest: "sha256:remote"}).PopulateDigest(context.Background(), ref); err != nil || ref.Digest != "sha256:remote" {
+		t.Errorf("Expected the fallback to resolve %s, but got %s, %v", ref.Reference, ref.Digest, err)
+	}
+}
+
+func TestNewTarballDigest_Invalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tarball")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Saved by Docker before 25, without an index.json.
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	manifest := []byte(`[{"Config":"0123.json","RepoTags":["alpine:3.18"],"Layers":[]}]`)
+	if err := tw.WriteHeader(&tar.Header{Name: "manifest.json", Mode: 0644, Size: int64(len(manifest)), Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tw.Write(manifest); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	legacy := filepath.Join(dir, "legacy.tar")
+	if err := ioutil.WriteFile(legacy, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	notTar := filepath.Join(dir, "image.txt")
+	if err := ioutil.WriteFile(notTar, []byte("not a tarball"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path     string
+		errorMsg string
+	}{
+		{legacy, "save it with Docker 25 or later"},
+		{notTar, "failed to read the tarball"},
+		{filepath.Join(dir, "missing.tar"), "no such file"},
+	}
+	for _, test := range tests {
+		if _, err := NewTarballDigest(test.path); err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+			t.Errorf("Expected an error containing %q for %s, but got %v", test.errorMsg, test.path, err)
+		}
+	}
+}
+
+func TestTarballConfigDigest(t *testing.T) {
+	hex := strings.Repeat("a", 64)
+	tests := []struct {
+		config   string
+		expected string
+		ok       bool
+	}{
+		{"blobs/sha256/" + hex, "sha256:" + hex, true},
+		{hex + ".json", "sha256:" + hex, true},
+		{"config.json", "", false},
+	}
+	for _, test := range tests {
+		dgst, ok := tarballConfigDigest(test.config)
+		if ok != test.ok || (ok && dgst.String() != test.expected) {
+			t.Errorf("Expected %s, %v for %s, but got %s, %v", test.expected, test.ok, test.config, dgst, ok)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/images"
+)
+
+func TestIsNoBaseImage(t *testing.T) {
+	tests := []struct {
+		ref      string
+		expected bool
+	}{
+		// As written in FROM scratch, and after the default tag is appended.
+		{"scratch", true},
+		{NoBaseImageSpecifierLatest, true},
+		{"docker.io/library/scratch", true},
+		{"registry.hub.docker.com/library/scratch:latest", true},
+		{"alpine", false},
+		{"scratch:v1", false},
+		{"myregistry.azurecr.io/scratch", false},
+		{"myuser/scratch", false},
+		{"scratch@sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef", false},
+	}
+	for _, test := range tests {
+		ref, err := scan.NewImageReference(test.ref)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", test.ref, err)
+		}
+		if actual := IsNoBaseImage(ref); actual != test.expected {
+			t.Errorf("Expected IsNoBaseImage of %s to be %v, but got %v", test.ref, test.expected, actual)
+		}
+		normalized, err := scan.NewImageReference(util.NormalizeImageTag(test.ref))
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", util.NormalizeImageTag(test.ref), err)
+		}
+		if actual := IsNoBaseImage(normalized); actual != test.expected {
+			t.Errorf("Expected IsNoBaseImage of %s to be %v, but got %v", normalized.Reference, test.expected, actual)
+		}
+	}
+	if IsNoBaseImage(nil) {
+		t.Error("Expected a nil reference not to be scratch")
+	}
+}
+
+func TestRemoteDigest_SkipsNoBaseImage(t *testing.T) {
+	registry := newFakeRegistry()
+	manifestDigest := registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	d := NewRemoteDigest(nil)
+	for _, value := range []string{"scratch", NoBaseImageSpecifierLatest, "docker.io/library/scratch"} {
+		ref, err := scan.NewImageReference(value)
+		if err != nil {
+			t.Fatalf("Failed to parse %s: %v", value, err)
+		}
+		if err := d.PopulateDigest(context.Background(), ref); err != nil {
+			t.Errorf("Expected resolving %s to be skipped, but got: %v", value, err)
+		}
+		if ref.Digest != "" {
+			t.Errorf("Expected no digest for %s, but got %s", value, ref.Digest)
+		}
+	}
+
+	ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+	if err := d.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != manifestDigest.String() {
+		t.Errorf("Expected digest %s, but got %s", manifestDigest, ref.Digest)
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ClientCertificate is a PEM encoded TLS client certificate and private key, either
+// read from files or provided in memory.
+type ClientCertificate struct {
+	CertFile string
+	KeyFile  string
+
+	// CertPEM and KeyPEM are used instead of CertFile and KeyFile if set.
+	CertPEM []byte
+	KeyPEM  []byte
+}
+
+// load loads and validates the certificate and private key pair.
+func (c *ClientCertificate) load() (tls.Certificate, error) {
+	if c == nil {
+		return tls.Certificate{}, errors.New("client certificate can't be nil")
+	}
+	if len(c.CertPEM) > 0 || len(c.KeyPEM) > 0 {
+		return tls.X509KeyPair(c.CertPEM, c.KeyPEM)
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return tls.Certificate{}, errors.New("both a certificate and a key are required")
+	}
+	return tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+}
+
+// ParseClientCertificates parses client certificates in the format of 'registry;certFile;keyFile'
+// and validates each certificate and key pair.
+func ParseClientCertificates(values []string) (map[string]*ClientCertificate, error) {
+	certs := make(map[string]*ClientCertificate, len(values))
+	for _, value := range values {
+		parts := strings.Split(value, ";")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid client certificate '%s', expected the format 'registry;certFile;keyFile'", value)
+		}
+		cert := &ClientCertificate{CertFile: parts[1], KeyFile: parts[2]}
+		if _, err := cert.load(); err != nil {
+			return nil, errors.Wrapf(err, "invalid client certificate for registry '%s'", parts[0])
+		}
+		certs[parts[0]] = cert
+	}
+	return certs, nil
+}
+
+// newClientCertificateClient creates a copy of client which presents the client certificate during TLS handshakes.
+func newClientCertificateClient(client *http.Client, cert *ClientCertificate) (*http.Client, error) {
+	certificate, err := cert.load()
+	if err != nil {
+		return nil, err
+	}
+
+	var transport *http.Transport
+	switch t := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = t.Clone()
+	default:
+		return nil, fmt.Errorf("client certificates require an *http.Transport, but the client uses %T", client.Transport)
+	}
+	if transport.TLSClientConfig == nil {
+		transport.TLSClientConfig = &tls.Config{}
+	}
+	transport.TLSClientConfig.Certificates = []tls.Certificate{certificate}
+
+	return &http.Client{
+		Transport:     transport,
+		CheckRedirect: client.CheckRedirect,
+		Jar:           client.Jar,
+		Timeout:       client.Timeout,
+	}, nil
+}
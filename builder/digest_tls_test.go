@@ -0,0 +1,138 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/images"
+)
+
+// newTestClientCertificate creates a self-signed client certificate and returns it PEM encoded.
+func newTestClientCertificate(t *testing.T) ([]byte, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acb-test-client"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+}
+
+func TestRemoteDigest_ClientCertificate(t *testing.T) {
+	certPEM, keyPEM := newTestClientCertificate(t)
+	clientCAs := x509.NewCertPool()
+	if !clientCAs.AppendCertsFromPEM(certPEM) {
+		t.Fatal("Failed to add the client certificate to the pool")
+	}
+
+	registry := newFakeRegistry()
+	manifestDigest := registry.addManifest("library/secure", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	server := httptest.NewUnstartedServer(registry)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: clientCAs}
+	server.StartTLS()
+	defer server.Close()
+	host := strings.TrimPrefix(server.URL, "https://")
+
+	tests := []struct {
+		certs map[string]*ClientCertificate
+		ok    bool
+	}{
+		{map[string]*ClientCertificate{host: {CertPEM: certPEM, KeyPEM: keyPEM}}, true},
+		{map[string]*ClientCertificate{"other.azurecr.io": {CertPEM: certPEM, KeyPEM: keyPEM}}, false},
+		{nil, false},
+	}
+
+	for i, test := range tests {
+		// The server's client trusts the server's certificate.
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{Client: server.Client(), ClientCertificates: test.certs})
+		if err != nil {
+			t.Fatalf("Test %d: failed to create remote digest: %v", i, err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/secure", Tag: "v1", Reference: host + "/library/secure:v1"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Test %d: expected an error without a client certificate, but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Test %d: unexpected error: %v", i, err)
+		}
+		if ref.Digest != manifestDigest.String() {
+			t.Errorf("Test %d: expected digest %s, but got %s", i, manifestDigest, ref.Digest)
+		}
+	}
+}
+
+func TestParseClientCertificates(t *testing.T) {
+	certPEM, keyPEM := newTestClientCertificate(t)
+	otherCertPEM, _ := newTestClientCertificate(t)
+	dir, err := ioutil.TempDir("", "certs")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string][]byte{"client.crt": certPEM, "client.key": keyPEM, "other.crt": otherCertPEM}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+	}
+	certFile, keyFile, otherCertFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), filepath.Join(dir, "other.crt")
+
+	tests := []struct {
+		value string
+		ok    bool
+	}{
+		{"myregistry.azurecr.io;" + certFile + ";" + keyFile, true},
+		{"myregistry.azurecr.io;" + otherCertFile + ";" + keyFile, false},
+		{"myregistry.azurecr.io;" + certFile + ";" + filepath.Join(dir, "missing.key"), false},
+		{"myregistry.azurecr.io;" + certFile, false},
+	}
+
+	for _, test := range tests {
+		certs, err := ParseClientCertificates([]string{test.value})
+		if test.ok != (err == nil) {
+			t.Errorf("Expected ok to be %v for %s, but got err: %v", test.ok, test.value, err)
+			continue
+		}
+		if test.ok && certs["myregistry.azurecr.io"] == nil {
+			t.Errorf("Expected a certificate for myregistry.azurecr.io, but got %v", certs)
+		}
+	}
+}
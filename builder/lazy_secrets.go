@@ -0,0 +1,50 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/pkg/errors"
+)
+
+// SetLazySecretResolver sets the resolver of the secrets whose placeholders were rendered into the Task
+// instead of their values, which are resolved the first time a step using them is about to run.
+func (b *Builder) SetLazySecretResolver(resolver *secretmgmt.LazySecretResolver) {
+	b.lazySecrets = resolver
+}
+
+// resolveStepSecrets replaces the placeholders of secrets in the step's properties with their values.
+func (b *Builder) resolveStepSecrets(ctx context.Context, step *graph.Step) error {
+	if b.lazySecrets == nil {
+		return nil
+	}
+	// The lists are copied since they may share their arrays with other steps, e.g. the Task's default envs.
+	// The tags and build args were parsed from the build command while it still contained the placeholders,
+	// so they're expanded as well.
+	step.Envs = append([]string(nil), step.Envs...)
+	step.SecretFiles = append([]string(nil), step.SecretFiles...)
+	step.CACertificates = append([]string(nil), step.CACertificates...)
+	step.Push = append([]string(nil), step.Push...)
+	step.Tags = append([]string(nil), step.Tags...)
+	step.BuildArgs = append([]string(nil), step.BuildArgs...)
+	step.FileBuildArgs = append([]string(nil), step.FileBuildArgs...)
+	fields := []*string{&step.Cmd, &step.Build, &step.WorkingDirectory, &step.EntryPoint, &step.Script, &step.User, &step.Image}
+	for _, values := range [][]string{step.Envs, step.SecretFiles, step.CACertificates, step.Push, step.Tags, step.BuildArgs, step.FileBuildArgs} {
+		for i := range values {
+			fields = append(fields, &values[i])
+		}
+	}
+	for _, field := range fields {
+		expanded, err := b.lazySecrets.Expand(ctx, *field)
+		if err != nil {
+			return errors.Wrapf(err, "failed to resolve the secrets of step ID: %s", step.ID)
+		}
+		*field = expanded
+	}
+	b.logStreamer.AddSecrets(b.lazySecrets.ResolvedValues())
+	return nil
+}
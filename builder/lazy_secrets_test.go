@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/secretmgmt"
+)
+
+func TestResolveStepSecrets(t *testing.T) {
+	resolveSecret := func(ctx context.Context, secret *secretmgmt.Secret, errorChan chan error) {
+		secret.ResolvedValue = "value-of-" + secret.ID
+		secret.ResolvedChan <- true
+	}
+	resolver, err := secretmgmt.NewLazySecretResolver([]*secretmgmt.Secret{{ID: "token", Source: "test://token"}}, resolveSecret, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create the lazy secret resolver: %v", err)
+	}
+	b := &Builder{}
+	b.SetLazySecretResolver(resolver)
+
+	defaultEnvs := []string{"TOKEN=" + secretmgmt.Placeholder("token"), "OTHER=value"}
+	step := &graph.Step{
+		ID:   "login",
+		Cmd:  "bash -c 'login " + secretmgmt.Placeholder("token") + "'",
+		Envs: defaultEnvs,
+		Push: []string{"myregistry.azurecr.io/app:v1"},
+	}
+	if err := b.resolveStepSecrets(context.Background(), step); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "bash -c 'login value-of-token'"; step.Cmd != expected {
+		t.Errorf("Expected the cmd %s but got %s", expected, step.Cmd)
+	}
+	if expected := []string{"TOKEN=value-of-token", "OTHER=value"}; !reflect.DeepEqual(step.Envs, expected) {
+		t.Errorf("Expected the envs %v but got %v", expected, step.Envs)
+	}
+	if defaultEnvs[0] != "TOKEN="+secretmgmt.Placeholder("token") {
+		t.Errorf("Expected envs shared with other steps not to be modified, but got %v", defaultEnvs)
+	}
+	if step.SecretFiles != nil {
+		t.Errorf("Expected the step to still have no secret files, but got %v", step.SecretFiles)
+	}
+
+	build := &graph.Step{
+		ID:        "build",
+		Build:     "-t app:v1 --build-arg TOKEN=" + secretmgmt.Placeholder("token") + " .",
+		Tags:      []string{"app:v1"},
+		BuildArgs: []string{"TOKEN=" + secretmgmt.Placeholder("token")},
+	}
+	if err := b.resolveStepSecrets(context.Background(), build); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "-t app:v1 --build-arg TOKEN=value-of-token ."; build.Build != expected {
+		t.Errorf("Expected the build %s but got %s", expected, build.Build)
+	}
+	if expected := []string{"TOKEN=value-of-token"}; !reflect.DeepEqual(build.BuildArgs, expected) {
+		t.Errorf("Expected the build args %v but got %v", expected, build.BuildArgs)
+	}
+
+	undefined := &graph.Step{ID: "undefined", Cmd: "echo " + secretmgmt.Placeholder("undefined")}
+	if err := b.resolveStepSecrets(context.Background(), undefined); err == nil {
+		t.Error("Expected an error for a step using a secret which isn't defined")
+	}
+}
@@ -0,0 +1,139 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/platforms"
+	"github.com/pkg/errors"
+)
+
+const lockFileVersion = "v1"
+
+// LockFile pins base image references to their resolved digests.
+type LockFile struct {
+	Version string       `json:"version"`
+	Images  []*LockEntry `json:"images"`
+}
+
+// LockEntry pins a base image reference to a digest for a platform.
+type LockEntry struct {
+	Reference string `json:"reference"`
+	Digest    string `json:"digest"`
+	Platform  string `json:"platform"`
+
+	// Provenance describes how the digest was obtained, e.g. the class of credential used to resolve it
+	// and when, if known. It's informational, lock files are consumed regardless.
+	Provenance *image.Provenance `json:"provenance,omitempty"`
+}
+
+// String returns the entry, without its provenance, in the format parsed by ParseLockEntries.
+func (e *LockEntry) String() string {
+	return e.Reference + ";" + e.Platform + ";" + e.Digest
+}
+
+// ParseLockEntries creates a LockFile from entries in the format of 'reference;platform;digest'.
+func ParseLockEntries(values []string) (*LockFile, error) {
+	lock := &LockFile{Version: lockFileVersion, Images: []*LockEntry{}}
+	for _, value := range values {
+		parts := strings.Split(value, ";")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			return nil, fmt.Errorf("invalid lock entry '%s', expected the format 'reference;platform;digest'", value)
+		}
+		lock.Images = append(lock.Images, &LockEntry{Reference: parts[0], Platform: parts[1], Digest: parts[2]})
+	}
+	return lock, nil
+}
+
+// lockKey identifies a LockEntry regardless of its provenance.
+type lockKey struct {
+	reference, digest, platform string
+}
+
+// NewLockFile creates a LockFile from the runtime and buildtime dependencies which have a digest.
+// Entries are sorted by reference and platform, and dependencies without a known platform
+// are recorded with the platform of the host. Each entry records the provenance of its digest,
+// if known, taken from the first dependency with the entry's reference, digest and platform.
+func NewLockFile(dependencies []*image.Dependencies) *LockFile {
+	seen := make(map[lockKey]bool)
+	lock := &LockFile{Version: lockFileVersion, Images: []*LockEntry{}}
+	add := func(ref *image.Reference) {
+		if ref == nil || ref.Digest == "" || IsNoBaseImage(ref) {
+			return
+		}
+		entry := LockEntry{Reference: ref.Reference, Digest: ref.Digest, Platform: ref.Platform}
+		if ref.OriginalReference != "" {
+			entry.Reference = ref.OriginalReference
+		}
+		if entry.Platform == "" {
+			entry.Platform = platforms.DefaultString()
+		}
+		key := lockKey{entry.Reference, entry.Digest, entry.Platform}
+		if seen[key] {
+			return
+		}
+		seen[key] = true
+		if ref.Provenance != nil {
+			provenance := *ref.Provenance
+			entry.Provenance = &provenance
+		}
+		lock.Images = append(lock.Images, &entry)
+	}
+
+	for _, dep := range dependencies {
+		if dep == nil {
+			continue
+		}
+		add(dep.Runtime)
+		for _, buildtime := range dep.Buildtime {
+			add(buildtime)
+		}
+	}
+
+	sort.Slice(lock.Images, func(i, j int) bool {
+		if lock.Images[i].Reference != lock.Images[j].Reference {
+			return lock.Images[i].Reference < lock.Images[j].Reference
+		}
+		if lock.Images[i].Platform != lock.Images[j].Platform {
+			return lock.Images[i].Platform < lock.Images[j].Platform
+		}
+		return lock.Images[i].Digest < lock.Images[j].Digest
+	})
+	return lock
+}
+
+// Write writes the lock file to the specified path.
+func (l *LockFile) Write(path string) error {
+	data, err := json.MarshalIndent(l, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal lock file")
+	}
+	if err := ioutil.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return errors.Wrapf(err, "failed to write lock file to %s", path)
+	}
+	return nil
+}
+
+// LoadLockFile loads a lock file from the specified path. Fields which aren't known, e.g. the metadata
+// added by later versions of acb, are ignored, so newer lock files of the same version can be consumed.
+func LoadLockFile(path string) (*LockFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read lock file %s", path)
+	}
+	var lock LockFile
+	if err := json.Unmarshal(data, &lock); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse lock file %s", path)
+	}
+	if lock.Version != lockFileVersion {
+		return nil, errors.Errorf("unsupported lock file version '%s', expected '%s'", lock.Version, lockFileVersion)
+	}
+	return &lock, nil
+}
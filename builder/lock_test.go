@@ -0,0 +1,166 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/platforms"
+)
+
+const (
+	lockTestDigest1 = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	lockTestDigest2 = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+)
+
+func TestNewLockFile(t *testing.T) {
+	deps := []*image.Dependencies{
+		{
+			Image:   &image.Reference{Reference: "myregistry.azurecr.io/app:v1", Digest: lockTestDigest1},
+			Runtime: &image.Reference{Reference: "golang:1.19", Digest: lockTestDigest1, Platform: "linux/arm64"},
+			Buildtime: []*image.Reference{
+				{Reference: "alpine:3.17", Digest: lockTestDigest2},
+				{Reference: NoBaseImageSpecifierLatest},
+				{Reference: "node:18"},
+			},
+		},
+		{
+			Runtime: &image.Reference{Reference: "new.azurecr.io/alpine:3.17", OriginalReference: "alpine:3.17", Digest: lockTestDigest2},
+		},
+	}
+
+	expected := &LockFile{
+		Version: lockFileVersion,
+		Images: []*LockEntry{
+			{Reference: "alpine:3.17", Digest: lockTestDigest2, Platform: platforms.DefaultString()},
+			{Reference: "golang:1.19", Digest: lockTestDigest1, Platform: "linux/arm64"},
+		},
+	}
+	if actual := NewLockFile(deps); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %+v, but got %+v", expected, actual)
+	}
+}
+
+func TestLockFile_WriteAndLoad(t *testing.T) {
+	dir, err := ioutil.TempDir("", "lock")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "acb.lock.json")
+
+	lock := NewLockFile([]*image.Dependencies{{Runtime: &image.Reference{Reference: "golang:1.19", Digest: lockTestDigest1, Platform: "linux/amd64"}}})
+	if err := lock.Write(path); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	loaded, err := LoadLockFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load lock file: %v", err)
+	}
+	if !reflect.DeepEqual(lock, loaded) {
+		t.Errorf("Expected %+v, but got %+v", lock, loaded)
+	}
+
+	if err := ioutil.WriteFile(path, []byte(`{"version":"v0","images":[]}`), 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	if _, err := LoadLockFile(path); err == nil {
+		t.Error("Expected an error for an unsupported version, but got none")
+	}
+}
+
+func TestNewLockFile_Provenance(t *testing.T) {
+	resolvedAt := time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC)
+	provenance := &image.Provenance{Source: image.SourceRegistry, Credential: "msi", ResolvedAt: resolvedAt, Mirror: "mycache.azurecr.io"}
+	deps := []*image.Dependencies{
+		{
+			Runtime:   &image.Reference{Reference: "node:18", Digest: lockTestDigest1, Platform: "linux/amd64", Provenance: provenance},
+			Buildtime: []*image.Reference{{Reference: "node:18", Digest: lockTestDigest1, Platform: "linux/amd64"}},
+		},
+		{
+			Runtime: &image.Reference{Reference: "alpine:3.17", Digest: lockTestDigest2, Platform: "linux/amd64"},
+		},
+	}
+
+	lock := NewLockFile(deps)
+	if len(lock.Images) != 2 {
+		t.Fatalf("Expected 2 entries, but got %+v", lock.Images)
+	}
+	if lock.Images[0].Provenance != nil {
+		t.Errorf("Expected alpine:3.17 to have no provenance, but got %+v", lock.Images[0].Provenance)
+	}
+	if !reflect.DeepEqual(lock.Images[1].Provenance, provenance) {
+		t.Errorf("Expected the provenance %+v, but got %+v", provenance, lock.Images[1].Provenance)
+	}
+	provenance.Credential = "opaque"
+	if lock.Images[1].Provenance.Credential != "msi" {
+		t.Error("Expected the lock file to copy the provenance")
+	}
+}
+
+func TestLockFile_WriteProvenance(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acb.lock.json")
+	lock := &LockFile{Version: lockFileVersion, Images: []*LockEntry{{
+		Reference:  "node:18",
+		Digest:     lockTestDigest1,
+		Platform:   "linux/amd64",
+		Provenance: &image.Provenance{Source: image.SourceRegistry, Credential: "anonymous", ResolvedAt: time.Date(2026, 10, 14, 8, 0, 0, 0, time.UTC), Fallback: true},
+	}}}
+	if err := lock.Write(path); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read lock file: %v", err)
+	}
+	expected := `      "provenance": {
+        "source": "registry",
+        "credential": "anonymous",
+        "resolvedAt": "2026-10-14T08:00:00Z",
+        "fallback": true
+      }`
+	if !strings.Contains(string(data), expected) {
+		t.Errorf("Expected the lock file to contain %s, but got %s", expected, data)
+	}
+}
+
+func TestLoadLockFile_IgnoresUnknownFields(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acb.lock.json")
+	data := `{"version":"v1","generator":"acb v2","images":[{"reference":"node:18","digest":"` + lockTestDigest1 + `","platform":"linux/amd64",` +
+		`"provenance":{"source":"registry","resolvedAt":"2026-10-14T08:00:00Z","signer":"someone"},"annotations":{"team":"build"}}]}`
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatalf("Failed to write lock file: %v", err)
+	}
+	lock, err := LoadLockFile(path)
+	if err != nil {
+		t.Fatalf("Failed to load lock file: %v", err)
+	}
+	if len(lock.Images) != 1 || lock.Images[0].Digest != lockTestDigest1 || lock.Images[0].Provenance.Source != image.SourceRegistry {
+		t.Errorf("Expected the known fields to be loaded, but got %+v", lock.Images)
+	}
+}
+
+func TestParseLockEntries(t *testing.T) {
+	entry := &LockEntry{Reference: "golang:1.19", Platform: "linux/amd64", Digest: lockTestDigest1}
+	lock, err := ParseLockEntries([]string{entry.String()})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if lock.Version != lockFileVersion || len(lock.Images) != 1 || *lock.Images[0] != *entry {
+		t.Errorf("Expected the entry %+v, but got %+v", entry, lock.Images)
+	}
+
+	for _, value := range []string{"golang:1.19", "golang:1.19;linux/amd64", ";linux/amd64;" + lockTestDigest1} {
+		if _, err := ParseLockEntries([]string{value}); err == nil {
+			t.Errorf("Expected an error for the lock entry %q", value)
+		}
+	}
+}
@@ -0,0 +1,433 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DefaultLogSinkBufferSize is the number of log events buffered for a sink before events are dropped.
+	DefaultLogSinkBufferSize = 1000
+
+	// LogStreamStdout and LogStreamStderr are the streams of the events of a step's output, and
+	// LogStreamLog is the stream of the events logged by acb itself.
+	LogStreamStdout = "stdout"
+	LogStreamStderr = "stderr"
+	LogStreamLog    = "log"
+
+	logSinkBatchSize     = 100
+	logSinkFlushInterval = time.Second
+	logSinkRetries       = 3
+	logSinkTimeout       = 10 * time.Second
+
+	// scrubbedSecret replaces the secrets in the events sent to a sink.
+	scrubbedSecret = "***"
+
+	// syslogFacilityUser is the syslog facility of the messages sent to a syslog sink, i.e. user-level messages.
+	syslogFacilityUser = 1
+	syslogSeverityInfo = 6
+	syslogSeverityErr  = 3
+)
+
+// LogEvent is a line of output streamed to a log sink. It's sent as a JSON object.
+type LogEvent struct {
+	Time    time.Time `json:"time"`
+	Step    string    `json:"step,omitempty"`
+	Stream  string    `json:"stream"`
+	Message string    `json:"message"`
+}
+
+// logSink sends batches of log events to a remote endpoint.
+type logSink interface {
+	send(ctx context.Context, events []LogEvent) error
+	close() error
+}
+
+// LogStreamer streams log events to a sink in the background while a Task runs. Events are buffered
+// and, if the sink can't keep up and the buffer is full, dropped rather than stalling the Task.
+// Batches the sink fails to accept are retried, and if they still fail the sink is abandoned and the
+// output is only logged locally. A nil LogStreamer streams nothing.
+type LogStreamer struct {
+	sink   logSink
+	events chan LogEvent
+	done   chan struct{}
+
+	// mu guards secrets, and closed so that no event is emitted once the events channel is closed.
+	mu           sync.RWMutex
+	secretValues []string
+	secrets      *strings.Replacer
+	closed       bool
+
+	dropped int64
+	failed  int64
+}
+
+// NewLogStreamer creates a LogStreamer which streams log events to the sink at sinkURL, buffering up to
+// bufferSize events. The sink is either an HTTP endpoint, i.e. an http:// or https:// URL, to which batches
+// of events are POSTed as newline delimited JSON, or a syslog server, i.e. a syslog:// (UDP) or
+// syslog+tcp:// URL, to which each event is sent as an RFC 5424 message.
+func NewLogStreamer(sinkURL string, bufferSize int) (*LogStreamer, error) {
+	if bufferSize <= 0 {
+		return nil, fmt.Errorf("invalid log sink buffer size %d, it must be positive", bufferSize)
+	}
+	sink, err := newLogSink(sinkURL)
+	if err != nil {
+		return nil, err
+	}
+	s := &LogStreamer{
+		sink:    sink,
+		events:  make(chan LogEvent, bufferSize),
+		done:    make(chan struct{}),
+		secrets: strings.NewReplacer(),
+	}
+	go s.run()
+	return s, nil
+}
+
+// newLogSink creates the sink for the URL.
+func newLogSink(sinkURL string) (logSink, error) {
+	u, err := url.Parse(sinkURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid log sink '%s', expected an http://, https://, syslog:// or syslog+tcp:// URL", sinkURL)
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "http", "https":
+		return &httpLogSink{url: sinkURL, client: &http.Client{Timeout: logSinkTimeout}}, nil
+	case "syslog", "syslog+udp":
+		return newSyslogSink("udp", u.Host), nil
+	case "syslog+tcp":
+		return newSyslogSink("tcp", u.Host), nil
+	default:
+		return nil, fmt.Errorf("unsupported log sink scheme '%s', expected http, https, syslog or syslog+tcp", u.Scheme)
+	}
+}
+
+// SetSecrets sets the secrets scrubbed from every event before it's sent.
+func (s *LogStreamer) SetSecrets(secrets []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.secretValues = nil
+	s.addSecrets(secrets)
+}
+
+// AddSecrets adds to the secrets scrubbed from every event before it's sent, e.g. once they've been resolved.
+func (s *LogStreamer) AddSecrets(secrets []string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addSecrets(secrets)
+}
+
+// addSecrets adds the secrets and rebuilds the replacer. s.mu must be held.
+// Since events are emitted line by line, each line of a multi-line secret, e.g. a PEM key, is a secret too.
+func (s *LogStreamer) addSecrets(secrets []string) {
+	for _, secret := range secrets {
+		if secret == "" {
+			continue
+		}
+		s.secretValues = append(s.secretValues, secret)
+		if !strings.Contains(secret, "\n") {
+			continue
+		}
+		for _, line := range strings.Split(secret, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				s.secretValues = append(s.secretValues, line)
+			}
+		}
+	}
+	s.secrets = secretReplacer(s.secretValues)
+}
+
+// secretReplacer returns a Replacer which scrubs the secrets, ignoring empty ones.
+func secretReplacer(secrets []string) *strings.Replacer {
+	oldnew := make([]string, 0, 2*len(secrets))
+	for _, secret := range secrets {
+		if secret != "" {
+			oldnew = append(oldnew, secret, scrubbedSecret)
+		}
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// taskSecrets returns the resolved values of the Task's secrets and of the passwords of its registry credentials.
+func taskSecrets(task *graph.Task) []string {
+	var secrets []string
+	for _, secret := range task.Secrets {
+		secrets = append(secrets, secret.ResolvedValue)
+	}
+	for _, cred := range task.RegistryLoginCredentials {
+		if cred != nil && cred.Password != nil {
+			secrets = append(secrets, cred.Password.ResolvedValue)
+		}
+	}
+	return secrets
+}
+
+// Emit queues the event to be sent, scrubbing its secrets. If the buffer is full, the event is dropped.
+func (s *LogStreamer) Emit(step string, stream string, message string) {
+	if s == nil {
+		return
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+	event := LogEvent{Time: time.Now().UTC(), Step: step, Stream: stream, Message: s.secrets.Replace(message)}
+	select {
+	case s.events <- event:
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+	}
+}
+
+// Writer returns a writer which writes to out and emits each complete line written to it as an event
+// of the step and stream, along with a function which must be called once the writer is no longer used
+// to emit the incomplete line, if any.
+func (s *LogStreamer) Writer(step string, stream string, out io.Writer) (io.Writer, func()) {
+	if s == nil {
+		return out, func() {}
+	}
+	w := &eventWriter{streamer: s, step: step, stream: stream}
+	return io.MultiWriter(out, w), w.flush
+}
+
+// Close stops accepting events and waits until the buffered events have been sent, or ctx is done.
+func (s *LogStreamer) Close(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.events)
+	}
+	s.mu.Unlock()
+
+	select {
+	case <-s.done:
+	case <-ctx.Done():
+		log.Printf("WARNING: timed out sending the remaining log events to the log sink\n")
+	}
+	if dropped := atomic.LoadInt64(&s.dropped); dropped > 0 {
+		log.Printf("WARNING: dropped %d log events because the log sink couldn't keep up\n", dropped)
+	}
+	if failed := atomic.LoadInt64(&s.failed); failed > 0 {
+		log.Printf("WARNING: failed to send %d log events to the log sink, they were only logged locally\n", failed)
+	}
+}
+
+// run sends the events in batches, flushing a partial batch every logSinkFlushInterval.
+func (s *LogStreamer) run() {
+	defer close(s.done)
+	defer func() { _ = s.sink.close() }()
+
+	ticker := time.NewTicker(logSinkFlushInterval)
+	defer ticker.Stop()
+	batch := make([]LogEvent, 0, logSinkBatchSize)
+	abandoned := false
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if abandoned {
+			atomic.AddInt64(&s.failed, int64(len(batch)))
+		} else if err := s.sendWithRetries(batch); err != nil {
+			// Local logging is the fallback, so the events aren't written anywhere else, and writing to
+			// the standard logger here would emit yet more events.
+			fmt.Fprintf(os.Stderr, "WARNING: failed to send log events to the log sink, falling back to local logging only: %v\n", err)
+			atomic.AddInt64(&s.failed, int64(len(batch)))
+			abandoned = true
+		}
+		batch = batch[:0]
+	}
+
+	for {
+		select {
+		case event, ok := <-s.events:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, event)
+			if len(batch) >= logSinkBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// sendWithRetries sends the batch, retrying with an exponential backoff if it fails.
+func (s *LogStreamer) sendWithRetries(batch []LogEvent) error {
+	var err error
+	for attempt := 0; attempt <= logSinkRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(util.GetExponentialBackoff(attempt))
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), logSinkTimeout)
+		err = s.sink.send(ctx, batch)
+		cancel()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// eventWriter emits each complete line written to it as an event, buffering incomplete lines.
+type eventWriter struct {
+	streamer *LogStreamer
+	step     string
+	stream   string
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *eventWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.streamer.Emit(w.step, w.stream, strings.TrimSuffix(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+	w.partial = append([]byte(nil), w.partial...)
+	return len(p), nil
+}
+
+// flush emits the incomplete line, if any.
+func (w *eventWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) > 0 {
+		w.streamer.Emit(w.step, w.stream, string(w.partial))
+		w.partial = nil
+	}
+}
+
+// httpLogSink POSTs batches of events to an HTTP endpoint as newline delimited JSON.
+type httpLogSink struct {
+	url    string
+	client *http.Client
+}
+
+func (h *httpLogSink) send(ctx context.Context, events []LogEvent) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, event := range events {
+		if err := encoder.Encode(event); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.Errorf("the log sink responded with %s", resp.Status)
+	}
+	return nil
+}
+
+func (h *httpLogSink) close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// syslogSink sends each event to a syslog server as an RFC 5424 message, whose structured message is the event's JSON.
+type syslogSink struct {
+	network  string
+	address  string
+	hostname string
+	conn     net.Conn
+}
+
+func newSyslogSink(network string, address string) *syslogSink {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	return &syslogSink{network: network, address: address, hostname: hostname}
+}
+
+func (s *syslogSink) send(ctx context.Context, events []LogEvent) error {
+	if s.conn == nil {
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, s.network, s.address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = s.conn.SetWriteDeadline(deadline)
+	}
+	for _, event := range events {
+		if _, err := s.conn.Write(s.format(event)); err != nil {
+			// Reconnect when the batch is retried.
+			_ = s.conn.Close()
+			s.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+// format formats the event as an RFC 5424 message, framed with its length over TCP as per RFC 6587.
+func (s *syslogSink) format(event LogEvent) []byte {
+	severity := syslogSeverityInfo
+	if event.Stream == LogStreamStderr {
+		severity = syslogSeverityErr
+	}
+	data, _ := json.Marshal(event)
+	msg := fmt.Sprintf("<%d>1 %s %s acb %d - - %s", syslogFacilityUser*8+severity, event.Time.Format(time.RFC3339Nano), s.hostname, os.Getpid(), data)
+	if s.network == "tcp" {
+		return []byte(fmt.Sprintf("%d %s", len(msg), msg))
+	}
+	return []byte(msg)
+}
+
+func (s *syslogSink) close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
@@ -0,0 +1,34 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/util"
+)
+
+// runOnFailureSteps runs the steps which only run once the Task has failed, one at a time in the order
+// they're declared. Their failures are logged, since the Task has already failed.
+func (b *Builder) runOnFailureSteps(ctx context.Context, task *graph.Task) {
+	for _, step := range task.OnFailureSteps() {
+		if ctx.Err() != nil {
+			log.Printf("WARNING: skipping step ID: %s, which runs on failure: %v\n", step.ID, ctx.Err())
+			continue
+		}
+		util.Infof("The task failed, running step ID: %s\n", step.ID)
+		start := time.Now()
+		err := b.runStep(ctx, step, task.RegistryLoginCredentials, task.Credentials)
+		b.updateStep(step, func() {
+			err = completeStep(step, err)
+		})
+		if err != nil {
+			log.Printf("WARNING: %v\n", err)
+		}
+		b.tracer.Span(step.ID, step.ID, traceCategoryStep, start, map[string]interface{}{"status": b.stepStatus(step), "retries": step.Retries})
+	}
+}
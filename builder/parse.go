@@ -5,6 +5,7 @@ package builder
 
 import (
 	"regexp"
+	"runtime"
 	"strings"
 
 	"github.com/Azure/acr-builder/util"
@@ -33,18 +34,44 @@ func parseDockerBuildCmd(cmd string) (dockerfile string, target string, context
 		// trim quotes on all docker build command args
 		if prev == "-f" || prev == "--file" {
 			dockerfile = util.TrimQuotes(v)
+		} else if strings.HasPrefix(v, "-f=") || strings.HasPrefix(v, "--file=") {
+			dockerfile = util.TrimQuotes(v[strings.Index(v, "=")+1:])
+		} else if strings.HasPrefix(v, "--target=") {
+			target = util.TrimQuotes(strings.TrimPrefix(v, "--target="))
 		} else if prev == "--target" {
 			target = util.TrimQuotes(v)
 		} else if !strings.HasPrefix(prev, "-") && !strings.HasPrefix(v, "-") {
 			context = util.TrimQuotes(v)
 		}
 
-		prev = v
+		// Flags in the --flag=value form don't take the next field as their value.
+		if strings.HasPrefix(v, "-") && strings.Contains(v, "=") {
+			prev = ""
+		} else {
+			prev = v
+		}
 	}
 
 	return dockerfile, target, context
 }
 
+// getBuildArgFlags returns a --build-arg flag for each of the build args, followed by a space if there are any.
+// Each build arg is quoted, since it may contain whitespace or quotes.
+func getBuildArgFlags(buildArgs []string) string {
+	var sb strings.Builder
+	for _, buildArg := range buildArgs {
+		sb.WriteString("--build-arg ")
+		if runtime.GOOS == util.WindowsOS {
+			// Build commands are run by PowerShell on Windows.
+			sb.WriteString("'" + strings.ReplaceAll(buildArg, "'", "''") + "'")
+		} else {
+			sb.WriteString(shellQuote(buildArg))
+		}
+		sb.WriteString(" ")
+	}
+	return sb.String()
+}
+
 // replacePositionalContext parses the specified command for its positional context
 // and replaces it if one's found. Returns the modified command after replacement.
 func replacePositionalContext(runCmd string, replacement string) string {
@@ -62,6 +89,25 @@ func replacePositionalContext(runCmd string, replacement string) string {
 	return runCmd
 }
 
+// replaceDockerfile returns the build command with the Dockerfile it builds, i.e. the value of -f or --file,
+// including in their -f=path and --file=path forms, replaced, or with a -f flag added if it builds the default Dockerfile.
+func replaceDockerfile(runCmd string, dockerfile string) string {
+	fields := strings.Fields(runCmd)
+	for i := 0; i < len(fields); i++ {
+		if (fields[i] == "-f" || fields[i] == "--file") && i+1 < len(fields) {
+			fields[i+1] = dockerfile
+			return strings.Join(fields, " ")
+		}
+		for _, flag := range []string{"-f=", "--file="} {
+			if strings.HasPrefix(fields[i], flag) {
+				fields[i] = flag + dockerfile
+				return strings.Join(fields, " ")
+			}
+		}
+	}
+	return "-f " + dockerfile + " " + runCmd
+}
+
 func getContextFromGitURL(gitURL string) string {
 	lower := strings.ToLower(gitURL)
 	if httpPrefix.MatchString(gitURL) &&
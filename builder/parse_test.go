@@ -4,7 +4,10 @@
 package builder
 
 import (
+	"runtime"
 	"testing"
+
+	"github.com/Azure/acr-builder/util"
 )
 
 // TestParseDockerBuildCmd tests stripping out the positional Docker context and Dockerfile name from a build command.
@@ -24,6 +27,8 @@ func TestParseDockerBuildCmd(t *testing.T) {
 		{6, "-f src/Dockerfile .", "src/Dockerfile", "", "."},
 		{7, "-t foo https://github.com/Azure/acr-builder.git#:HelloWorld", "", "", "https://github.com/Azure/acr-builder.git#:HelloWorld"},
 		{8, "-t foo --target build https://github.com/Azure/acr-builder.git#:HelloWorld", "", "build", "https://github.com/Azure/acr-builder.git#:HelloWorld"},
+		{9, "--file=src/Dockerfile --target=build src", "src/Dockerfile", "build", "src"},
+		{10, "-f=src/Dockerfile -t foo:bar .", "src/Dockerfile", "", "."},
 	}
 
 	for _, test := range tests {
@@ -40,6 +45,27 @@ func TestParseDockerBuildCmd(t *testing.T) {
 	}
 }
 
+// TestGetBuildArgFlags tests quoting build args read from a file as --build-arg flags.
+func TestGetBuildArgFlags(t *testing.T) {
+	if runtime.GOOS == util.WindowsOS {
+		t.Skip("build commands are quoted for PowerShell on Windows")
+	}
+	tests := []struct {
+		buildArgs []string
+		expected  string
+	}{
+		{nil, ""},
+		{[]string{"VERSION=1.0"}, "--build-arg 'VERSION=1.0' "},
+		{[]string{"MESSAGE=hello world", "QUOTE=it's"}, `--build-arg 'MESSAGE=hello world' --build-arg 'QUOTE=it'\''s' `},
+	}
+
+	for _, test := range tests {
+		if actual := getBuildArgFlags(test.buildArgs); actual != test.expected {
+			t.Errorf("Failed to get the build arg flags of %v. Got %s, expected %s", test.buildArgs, actual, test.expected)
+		}
+	}
+}
+
 // TestReplacePositionalContext tests replacing the positional context parameter in a build command.
 func TestReplacePositionalContext(t *testing.T) {
 	tests := []struct {
@@ -63,6 +89,27 @@ func TestReplacePositionalContext(t *testing.T) {
 	}
 }
 
+// TestReplaceDockerfile tests replacing the Dockerfile in a build command.
+func TestReplaceDockerfile(t *testing.T) {
+	tests := []struct {
+		build      string
+		dockerfile string
+		expected   string
+	}{
+		{"-f Dockerfile -t blah:latest .", "Dockerfile.pinned", "-f Dockerfile.pinned -t blah:latest ."},
+		{"-t foo:bar --file src/Dockerfile src", "src/Dockerfile.pinned", "-t foo:bar --file src/Dockerfile.pinned src"},
+		{"-t foo:bar .", "Dockerfile.pinned", "-f Dockerfile.pinned -t foo:bar ."},
+		{"--file=src/Dockerfile -t foo:bar src", "src/Dockerfile.pinned", "--file=src/Dockerfile.pinned -t foo:bar src"},
+		{"-t foo:bar -f=Dockerfile .", "Dockerfile.pinned", "-t foo:bar -f=Dockerfile.pinned ."},
+	}
+
+	for _, test := range tests {
+		if actual := replaceDockerfile(test.build, test.dockerfile); actual != test.expected {
+			t.Errorf("Failed to replace the Dockerfile. Got %s, expected %s", actual, test.expected)
+		}
+	}
+}
+
 // TestGetContextFromGitURL tests getting context from a git URL.
 func TestGetContextFromGitURL(t *testing.T) {
 	tests := []struct {
@@ -0,0 +1,144 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+// PinnedBaseImagesPrefix prefixes the line of the scanner's output which reports the digests it pinned
+// the base images of a Dockerfile to, in the format of a lock file.
+const PinnedBaseImagesPrefix = "Pinned base images: "
+
+// shouldPinImage returns true if the step's images are pinned. Steps which set pinImage run their images
+// unpinned, with a warning, if digest resolution is disabled.
+func (b *Builder) shouldPinImage(step *graph.Step) bool {
+	if !step.PinImage {
+		return false
+	}
+	if b.skipDigests {
+		log.Printf("WARNING: step ID: %s sets pinImage, but its images aren't pinned since digest resolution is disabled\n", step.ID)
+		return false
+	}
+	return true
+}
+
+// requiresPinnedBaseImages returns true if the base images of every build step are pinned, even if it doesn't set
+// pinImage, because the digests it's built with must be those which are locked, verified or labeled, or pulled from
+// where they're rewritten to.
+// Otherwise the build would pull its base images by tag, which may have moved since their digests were resolved.
+func (b *Builder) requiresPinnedBaseImages() bool {
+	if b.skipDigests {
+		return false
+	}
+	return b.lockFile != nil || (b.rewriter != nil && len(b.rewriter.rules) > 0) || b.signaturePolicy != nil || b.baseImageLabels
+}
+
+// populatePinnedBaseImages populates the digests of the build step's base images with the digests its Dockerfile
+// was pinned to, subject to the Builder's base image policies, so the digests which are verified, labeled and
+// recorded are those of the images it's built from, without resolving them again. With a lock file, the
+// digests are populated from it, keeping their provenance, and must be those the Dockerfile was pinned to.
+func (b *Builder) populatePinnedBaseImages(ctx context.Context, step *graph.Step, pinned *LockFile) error {
+	var preferredPlatforms []string
+	if b.remoteDigestOptions != nil {
+		preferredPlatforms = b.remoteDigestOptions.platformPreference()
+	}
+	pinnedDigester, err := NewLockDigest(pinned, preferredPlatforms)
+	if err != nil {
+		return err
+	}
+	source := pinnedDigester
+	if b.lockFile != nil {
+		if source, err = NewLockDigest(b.lockFile, preferredPlatforms); err != nil {
+			return err
+		}
+	}
+	helper := b.withBaseImagePolicies(source)
+
+	for _, deps := range step.ImageDependencies {
+		refs := append([]*image.Reference{deps.Runtime}, deps.Buildtime...)
+		for _, ref := range refs {
+			if ref == nil || ref.Digest != "" || IsNoBaseImage(ref) {
+				continue
+			}
+			pinnedRef := *ref
+			if err := pinnedDigester.PopulateDigest(ctx, &pinnedRef); err != nil {
+				return errors.Wrapf(err, "the base image %s of step ID: %s wasn't pinned", ref.Reference, step.ID)
+			}
+			if err := helper.PopulateDigest(ctx, ref); err != nil {
+				return errors.Wrapf(err, "failed to populate the digest of the base image %s of step ID: %s", ref.Reference, step.ID)
+			}
+			if ref.Digest != pinnedRef.Digest {
+				return fmt.Errorf("the base image %s of step ID: %s was pinned to %s, but its digest is %s", pinnedRef.Reference, step.ID, pinnedRef.Digest, ref.Digest)
+			}
+		}
+	}
+	return nil
+}
+
+// pinStepImage pins the image the cmd step runs in to the digest it currently resolves to.
+func (b *Builder) pinStepImage(ctx context.Context, step *graph.Step, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) error {
+	// The image's manifest list is pinned, so Docker still selects the platform to run.
+	remoteDigester, err := NewRemoteDigestWithOptions(registryCreds, b.registryDigestOptions(credentials))
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(digestsTimeoutInSec) * time.Second
+	digestCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd, err := pinImage(digestCtx, step.Cmd, NewKnownDigestsDigest(remoteDigester, b.fallbackDigests))
+	if err != nil {
+		return errors.Wrapf(err, "failed to pin the image of step ID: %s", step.ID)
+	}
+	step.Cmd = cmd
+	return nil
+}
+
+// pinImage returns the cmd with its image, see util.ImageNameIndex, pinned to the digest populated by helper.
+// Images which already specify a digest are left as is.
+func pinImage(ctx context.Context, cmd string, helper DigestHelper) (string, error) {
+	start, end := util.ImageNameIndex(cmd)
+	if start < 0 {
+		return "", errors.New("the cmd doesn't specify an image to pin")
+	}
+	img := cmd[start:end]
+	ref, err := scan.NewImageReference(util.NormalizeImageTag(img))
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" {
+		return cmd, nil
+	}
+	if err := helper.PopulateDigest(ctx, ref); err != nil {
+		return "", err
+	}
+	if ref.Digest == "" {
+		return "", errors.Errorf("no digest was resolved for the image %s", img)
+	}
+	util.Infof("Pinned the image %s to %s\n", img, ref.Digest)
+	return cmd[:start] + img + "@" + ref.Digest + cmd[end:], nil
+}
+
+// pinnedDockerfile returns the path of the copy of a build step's Dockerfile whose base images were pinned
+// by the scanner, relative to the step's working directory like the Dockerfile itself.
+func pinnedDockerfile(dockerfile string, dockerContext string) string {
+	if dockerfile == "" {
+		dockerfile = defaultDockerfile
+		if util.IsLocalContext(dockerContext) {
+			dockerfile = path.Join(dockerContext, dockerfile)
+		}
+	}
+	return dockerfile + scan.PinnedDockerfileSuffix
+}
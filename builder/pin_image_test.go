@@ -0,0 +1,171 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/containerd/containerd/platforms"
+)
+
+func TestPinImage(t *testing.T) {
+	const dgst = "sha256:b5b2b2c507a0944348e0303114d8d93aaaa081732b86451d9bce1f432a537bc7"
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"node:18 npm test", "node:18@" + dgst + " npm test"},
+		{"bitnami/kubectl", "bitnami/kubectl@" + dgst},
+		// The flags of docker run before the image are kept.
+		{"--rm -e NAME=value node:18 npm test", "--rm -e NAME=value node:18@" + dgst + " npm test"},
+		// Images which already specify a digest aren't resolved again.
+		{"node@sha256:4a8e0d8a6e2b0ac5c2f4ec1d5c0f3f0de6d8a0e11f5e8b1f8c2d6e7a9b0c1d2e npm test", "node@sha256:4a8e0d8a6e2b0ac5c2f4ec1d5c0f3f0de6d8a0e11f5e8b1f8c2d6e7a9b0c1d2e npm test"},
+	}
+	for _, test := range tests {
+		cmd, err := pinImage(context.Background(), test.cmd, &staticDigest{digest: dgst})
+		if err != nil {
+			t.Errorf("Unexpected error pinning %s: %v", test.cmd, err)
+			continue
+		}
+		if cmd != test.expected {
+			t.Errorf("Expected %s to be pinned as %s, but got %s", test.cmd, test.expected, cmd)
+		}
+	}
+
+	if _, err := pinImage(context.Background(), "node:18 npm test", &staticDigest{}); err == nil {
+		t.Error("Expected an error when no digest is resolved")
+	}
+}
+
+func TestPinnedDockerfile(t *testing.T) {
+	tests := []struct {
+		dockerfile    string
+		dockerContext string
+		expected      string
+	}{
+		{"", ".", "Dockerfile.pinned"},
+		{"", "src", "src/Dockerfile.pinned"},
+		{"build/Dockerfile", "src", "build/Dockerfile.pinned"},
+		// Remote contexts are built from the directory they were downloaded to.
+		{"", "https://github.com/Azure/acr-builder.git", "Dockerfile.pinned"},
+		{"Windows.Dockerfile", "https://github.com/Azure/acr-builder.git", "Windows.Dockerfile.pinned"},
+	}
+	for _, test := range tests {
+		if actual := pinnedDockerfile(test.dockerfile, test.dockerContext); actual != test.expected {
+			t.Errorf("Expected the pinned Dockerfile of %q in %q to be %s, but got %s", test.dockerfile, test.dockerContext, test.expected, actual)
+		}
+	}
+}
+
+func TestRequiresPinnedBaseImages(t *testing.T) {
+	rewriter, err := NewReferenceRewriter([]RewriteRule{{Type: RewriteRulePrefix, From: "docker.io/", To: "mirror.azurecr.io/"}})
+	if err != nil {
+		t.Fatalf("Failed to create the rewriter: %v", err)
+	}
+	noRules, err := NewReferenceRewriter(nil)
+	if err != nil {
+		t.Fatalf("Failed to create the rewriter: %v", err)
+	}
+	tests := []struct {
+		name     string
+		setup    func(b *Builder)
+		expected bool
+	}{
+		{"default", func(b *Builder) {}, false},
+		{"lock file", func(b *Builder) { b.SetLockFile(&LockFile{}) }, true},
+		{"rewrite rules", func(b *Builder) { b.SetReferenceRewriter(rewriter) }, true},
+		{"no rewrite rules", func(b *Builder) { b.SetReferenceRewriter(noRules) }, false},
+		{"signature policy", func(b *Builder) { b.SetSignaturePolicy(&SignaturePolicy{}) }, true},
+		{"base image labels", func(b *Builder) { b.SetBaseImageLabels(true) }, true},
+		{"skip digests", func(b *Builder) { b.SetBaseImageLabels(true); b.skipDigests = true }, false},
+	}
+	for _, test := range tests {
+		b := NewBuilder(procmanager.NewProcManager(true), false, "")
+		test.setup(b)
+		if actual := b.requiresPinnedBaseImages(); actual != test.expected {
+			t.Errorf("%s: expected %v, but got %v", test.name, test.expected, actual)
+		}
+	}
+}
+
+func TestPopulatePinnedBaseImages(t *testing.T) {
+	const (
+		pinnedDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		lockedDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+		fixedDigest  = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+	)
+	platform := platforms.DefaultString()
+	pinned := &LockFile{Images: []*LockEntry{{Reference: "node:18", Digest: pinnedDigest, Platform: platform}}}
+	newStep := func() *graph.Step {
+		return &graph.Step{ID: "build", ImageDependencies: []*image.Dependencies{{
+			Runtime:   &image.Reference{Registry: DockerHubRegistry, Repository: "library/node", Tag: "18", Reference: "node:18"},
+			Buildtime: []*image.Reference{{Registry: DockerHubRegistry, Repository: "library/golang", Digest: fixedDigest, Reference: "golang@" + fixedDigest}},
+		}}}
+	}
+
+	// The digests are those the Dockerfile was pinned to, and references which specify a digest keep it.
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetMutableTagPolicy(MutableTagPolicyOff)
+	step := newStep()
+	if err := b.populatePinnedBaseImages(context.Background(), step, pinned); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if actual := step.ImageDependencies[0].Runtime.Digest; actual != pinnedDigest {
+		t.Errorf("Expected the pinned digest %s, but got %s", pinnedDigest, actual)
+	}
+	if actual := step.ImageDependencies[0].Buildtime[0].Digest; actual != fixedDigest {
+		t.Errorf("Expected the digest %s to be kept, but got %s", fixedDigest, actual)
+	}
+
+	// With a lock file, the Dockerfile must have been pinned to the locked digests.
+	b.SetLockFile(&LockFile{Images: []*LockEntry{{Reference: "node:18", Digest: lockedDigest, Platform: platform}}})
+	err := b.populatePinnedBaseImages(context.Background(), newStep(), pinned)
+	if err == nil || !strings.Contains(err.Error(), "was pinned to "+pinnedDigest+", but its digest is "+lockedDigest) {
+		t.Errorf("Expected the mismatch with the lock file to fail, but got %v", err)
+	}
+	provenance := &image.Provenance{Source: image.SourceRegistry, Credential: "msi"}
+	b.SetLockFile(&LockFile{Images: []*LockEntry{{Reference: "node:18", Digest: pinnedDigest, Platform: platform, Provenance: provenance}}})
+	step = newStep()
+	if err := b.populatePinnedBaseImages(context.Background(), step, pinned); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if actual := step.ImageDependencies[0].Runtime.Provenance; actual == nil || actual.Credential != "msi" {
+		t.Errorf("Expected the locked provenance to be kept, but got %+v", actual)
+	}
+
+	// Base images the scanner didn't pin fail.
+	b.SetLockFile(nil)
+	err = b.populatePinnedBaseImages(context.Background(), newStep(), &LockFile{})
+	if err == nil || !strings.Contains(err.Error(), "wasn't pinned") {
+		t.Errorf("Expected an error for a base image which wasn't pinned, but got %v", err)
+	}
+}
+
+func TestPopulatePinnedBaseImages_Rewritten(t *testing.T) {
+	const dgst = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	rewriter, err := NewReferenceRewriter([]RewriteRule{{Type: RewriteRulePrefix, From: "node:", To: "mirror.azurecr.io/node:"}})
+	if err != nil {
+		t.Fatalf("Failed to create the rewriter: %v", err)
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetMutableTagPolicy(MutableTagPolicyOff)
+	b.SetReferenceRewriter(rewriter)
+	// The scanner locks rewritten references by the reference they were rewritten from.
+	pinned := &LockFile{Images: []*LockEntry{{Reference: "node:18", Digest: dgst, Platform: platforms.DefaultString()}}}
+	step := &graph.Step{ID: "build", ImageDependencies: []*image.Dependencies{{
+		Runtime: &image.Reference{Registry: DockerHubRegistry, Repository: "library/node", Tag: "18", Reference: "node:18"},
+	}}}
+	if err := b.populatePinnedBaseImages(context.Background(), step, pinned); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	runtime := step.ImageDependencies[0].Runtime
+	if runtime.Digest != dgst || runtime.Reference != "mirror.azurecr.io/node:18" || runtime.OriginalReference != "node:18" {
+		t.Errorf("Expected the rewritten reference to be pinned, but got %+v", runtime)
+	}
+}
@@ -0,0 +1,316 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/remotes/docker"
+	"github.com/pkg/errors"
+)
+
+// precheckTimeoutInSec limits how long checking access to each registry takes.
+const precheckTimeoutInSec = 30
+
+// RegistryCheck is the result of checking access to a registry referenced by a Task.
+type RegistryCheck struct {
+	// Registry is the referenced registry.
+	Registry string
+
+	// CheckedRegistry is the registry which was accessed. It's the proxy cache's registry
+	// if the referenced registry is accessed through a proxy cache, and Registry otherwise.
+	CheckedRegistry string
+
+	// Err is why the registry couldn't be accessed, nil if it could.
+	Err error
+
+	// Elapsed is how long the check took.
+	Elapsed time.Duration
+
+	// Coverage describes the credentials used to access the registry.
+	Coverage *CredentialCoverage
+}
+
+// PrecheckRegistries verifies that every registry referenced by the Task can be accessed using the
+// Task's credentials, without resolving any references. The registries are checked concurrently and
+// the results are returned sorted by registry.
+func PrecheckRegistries(ctx context.Context, task *graph.Task, opts *RemoteDigestOptions) ([]*RegistryCheck, error) {
+	digestOpts := RemoteDigestOptions{}
+	if opts != nil {
+		digestOpts = *opts
+	}
+	digestOpts.CredentialSources = mergeCredentialSources(digestOpts.CredentialSources, NewCredentialSources(task.Credentials))
+	d, err := NewRemoteDigestWithOptions(task.RegistryLoginCredentials, &digestOpts)
+	if err != nil {
+		return nil, err
+	}
+	// The coverage is of the same registries, in the same order.
+	coverage, err := TaskCredentialCoverage(task, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	checks := make([]*RegistryCheck, len(coverage))
+	var wg sync.WaitGroup
+	for i, c := range coverage {
+		check := &RegistryCheck{
+			Registry:        c.Registry,
+			CheckedRegistry: c.AccessedRegistry,
+			Coverage:        c,
+		}
+		checks[i] = check
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, time.Duration(precheckTimeoutInSec)*time.Second)
+			defer cancel()
+			start := time.Now()
+			check.Err = d.CheckRegistryAuth(checkCtx, check.CheckedRegistry)
+			check.Elapsed = time.Since(start)
+		}()
+	}
+	wg.Wait()
+	return checks, nil
+}
+
+// ReferencedRegistries returns the distinct registries referenced by the Task, i.e. the registries of
+// its credentials, the images run by its steps and the images its steps build and push. Wildcard and
+// default credentials aren't included since they don't name a registry.
+func ReferencedRegistries(task *graph.Task) ([]string, error) {
+	registries := make(map[string]bool)
+	for registry := range task.RegistryLoginCredentials {
+		if !graph.IsRegistryPattern(registry) {
+			registries[registry] = true
+		}
+	}
+	for _, step := range task.Steps {
+		var images []string
+		switch {
+		case step.IsBuildStep():
+			images = step.Tags
+		case step.IsPushStep():
+			images = step.Push
+		case step.IsCmdStep():
+			images = []string{util.ParseImageName(step.Cmd)}
+		}
+		for _, img := range images {
+			ref, err := scan.NewImageReference(util.NormalizeImageTag(img))
+			if err != nil {
+				return nil, errors.Wrapf(err, "failed to get the registry of the image referenced by step ID: %s", step.ID)
+			}
+			registries[ref.Registry] = true
+		}
+	}
+
+	sorted := make([]string, 0, len(registries))
+	for registry := range registries {
+		sorted = append(sorted, registry)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// CheckRegistryAuth verifies that the registry can be accessed using the credentials configured for it
+// by making an authenticated request to the root of its API, without resolving any references. If the
+// registry has credential sources, they're tried in order until one is accepted by the registry.
+func (d *remoteDigest) CheckRegistryAuth(ctx context.Context, registry string) error {
+	if err := d.registryAllowlist.Check(registry); err != nil {
+		return err
+	}
+	var sources []*CredentialSource
+	if key, ok := d.matchCredentialSources(registry); ok {
+		sources = d.credentialSources[key]
+	}
+	if len(sources) == 0 {
+		var credentials func(string) (string, string, error)
+		if cred, ok := d.registryCreds.GetCredential(registry); ok {
+			var err error
+			if credentials, err = resolvedCredentials(registry, cred); err != nil {
+				return err
+			}
+		} else if d.requireCredentials && !d.publicRegistries[strings.ToLower(registry)] {
+			return fmt.Errorf("no credentials are configured for registry '%s', and anonymous access is only allowed for public registries", registry)
+		}
+		return d.pingRegistry(ctx, registry, credentials)
+	}
+
+	var failures []string
+	for _, source := range sources {
+		username, password, err := source.Credentials(ctx)
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: failed to get credentials: %v", source.Name, err))
+			continue
+		}
+		err = d.pingRegistry(ctx, registry, staticCredentials(username, password))
+		if err == nil {
+			return nil
+		}
+		if !isAuthFailure(err) {
+			return errors.Wrapf(err, "using %s", source.Name)
+		}
+		failures = append(failures, fmt.Sprintf("%s: %v", source.Name, err))
+	}
+	return fmt.Errorf("failed to access registry '%s' using any of the %d credential sources: [%s]", registry, len(sources), strings.Join(failures, "; "))
+}
+
+// pingRegistry requests the root of the registry's API, i.e. /v2/, authenticating with the
+// resolver's authorizer if the registry challenges the request.
+func (d *remoteDigest) pingRegistry(ctx context.Context, registry string, credentials func(string) (string, string, error)) error {
+	hosts, err := d.registryHosts(registry, credentials)(registry)
+	if err != nil {
+		return errors.Wrapf(err, "failed to configure registry '%s'", registry)
+	}
+	if len(hosts) == 0 {
+		return fmt.Errorf("no hosts are configured for registry '%s'", registry)
+	}
+	host := hosts[0]
+	url := host.Scheme + "://" + host.Host + host.Path + "/"
+
+	resp, err := doPing(ctx, host, url)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		// Authorizers which can't handle the challenge, e.g. of a bearer token, leave the request rejected.
+		if err := host.Authorizer.AddResponses(ctx, []*http.Response{resp}); err == nil {
+			if resp, err = doPing(ctx, host, url); err != nil {
+				return err
+			}
+		} else if !errdefs.IsNotImplemented(err) {
+			return errors.Wrapf(err, "failed to authenticate to registry '%s'", registry)
+		}
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &registryStatusError{StatusCode: resp.StatusCode, err: fmt.Errorf("registry '%s' rejected the credentials: %s", registry, resp.Status)}
+	default:
+		return &registryStatusError{StatusCode: resp.StatusCode, err: fmt.Errorf("unexpected response from registry '%s': %s", registry, resp.Status)}
+	}
+}
+
+// doPing makes an authorized GET request to url. The response's body is drained and closed,
+// so only its status and headers can be used.
+func doPing(ctx context.Context, host docker.RegistryHost, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create the request")
+	}
+	if err := host.Authorizer.Authorize(ctx, req); err != nil {
+		return nil, errors.Wrap(err, "failed to authorize the request")
+	}
+	resp, err := host.Client.Do(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request %s", url)
+	}
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp, nil
+}
+
+// anonymousCredential is the credential type of registries which are accessed without credentials.
+const anonymousCredential = "anonymous"
+
+// CredentialCoverage describes the credentials which would be used to access a registry referenced by
+// a Task, without resolving them or revealing any secrets.
+type CredentialCoverage struct {
+	// Registry is the referenced registry.
+	Registry string
+
+	// AccessedRegistry is the registry whose credentials apply. It's the proxy cache's registry if the
+	// referenced registry is accessed through a proxy cache, and Registry otherwise.
+	AccessedRegistry string
+
+	// Pattern is the registry of the credentials which apply, e.g. *.azurecr.io, empty if none apply.
+	Pattern string
+
+	// Types are the types of the credentials which would be tried, in order, e.g. msi or opaque,
+	// or anonymous if no credentials apply.
+	Types []string
+
+	// Gap is why the registry couldn't be accessed with its credentials, nil if there's no gap.
+	Gap error
+}
+
+// String describes the coverage, e.g. "myregistry.azurecr.io: msi (*.azurecr.io)".
+func (c *CredentialCoverage) String() string {
+	registry := c.Registry
+	if c.AccessedRegistry != c.Registry {
+		registry = fmt.Sprintf("%s (through %s)", c.Registry, c.AccessedRegistry)
+	}
+	desc := fmt.Sprintf("%s: %s", registry, strings.Join(c.Types, ", "))
+	if c.Pattern != "" && c.Pattern != c.AccessedRegistry {
+		desc += fmt.Sprintf(" (%s)", c.Pattern)
+	}
+	if c.Gap != nil {
+		desc += fmt.Sprintf(", GAP: %v", c.Gap)
+	}
+	return desc
+}
+
+// TaskCredentialCoverage returns which types of credentials would be used to access each registry
+// referenced by the Task, see ReferencedRegistries, sorted by registry. Registries without credentials
+// are accessed anonymously, which is a gap if credentials are required and the registry isn't public.
+// Credentials aren't resolved and no registries are accessed.
+func TaskCredentialCoverage(task *graph.Task, opts *RemoteDigestOptions) ([]*CredentialCoverage, error) {
+	digestOpts := RemoteDigestOptions{}
+	if opts != nil {
+		digestOpts = *opts
+	}
+	d, err := NewRemoteDigestWithOptions(nil, &digestOpts)
+	if err != nil {
+		return nil, err
+	}
+	registries, err := ReferencedRegistries(task)
+	if err != nil {
+		return nil, err
+	}
+
+	var patterns []string
+	credsByPattern := make(map[string][]*graph.RegistryCredential)
+	for _, cred := range task.Credentials {
+		if cred == nil {
+			continue
+		}
+		if _, ok := credsByPattern[cred.Registry]; !ok {
+			patterns = append(patterns, cred.Registry)
+		}
+		credsByPattern[cred.Registry] = append(credsByPattern[cred.Registry], cred)
+	}
+
+	coverage := make([]*CredentialCoverage, 0, len(registries))
+	for _, registry := range registries {
+		c := &CredentialCoverage{
+			Registry:         registry,
+			AccessedRegistry: d.accessedRegistry(registry),
+		}
+		if pattern, ok := graph.MatchRegistry(c.AccessedRegistry, patterns); ok {
+			c.Pattern = pattern
+			for _, cred := range credsByPattern[pattern] {
+				c.Types = append(c.Types, cred.Type())
+			}
+		} else {
+			c.Types = []string{anonymousCredential}
+			if d.requireCredentials && !d.publicRegistries[strings.ToLower(c.AccessedRegistry)] {
+				c.Gap = fmt.Errorf("no credentials are configured for registry '%s', and anonymous access is only allowed for public registries", c.AccessedRegistry)
+			}
+		}
+		coverage = append(coverage, c)
+	}
+	return coverage, nil
+}
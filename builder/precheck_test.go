@@ -0,0 +1,168 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/secretmgmt"
+)
+
+func TestReferencedRegistries(t *testing.T) {
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `steps:
+  - build: -t myregistry.azurecr.io/app:v1 -t otherregistry.azurecr.io/app:v1 .
+  - push: ["myregistry.azurecr.io/app:v1"]
+  - cmd: mcr.microsoft.com/acr/acb version
+  - cmd: bash echo hello`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to unmarshal the task: %v", err)
+	}
+	task.RegistryLoginCredentials = graph.RegistryLoginCredentials{
+		"credregistry.azurecr.io": {},
+		"*.azurecr.io":            {},
+	}
+
+	registries, err := ReferencedRegistries(task)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"credregistry.azurecr.io", "mcr.microsoft.com", "myregistry.azurecr.io", "otherregistry.azurecr.io", "registry.hub.docker.com"}
+	if !reflect.DeepEqual(registries, expected) {
+		t.Errorf("Expected %v, but got %v", expected, registries)
+	}
+}
+
+func TestTaskCredentialCoverage(t *testing.T) {
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `steps:
+  - build: -t myregistry.azurecr.io/app:v1 -t thirdparty.example.com/app:v1 .
+  - cmd: mcr.microsoft.com/acr/acb version
+  - cmd: library/bash echo hello`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to unmarshal the task: %v", err)
+	}
+	task.Credentials = []*graph.RegistryCredential{
+		{Registry: "*.azurecr.io", Identity: "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86", AadResourceID: "https://management.azure.com/"},
+		{Registry: "thirdparty.example.com", Username: "user", UsernameType: graph.Opaque, Password: "p@ssw0rd", PasswordType: graph.Opaque},
+		{Registry: "thirdparty.example.com", Username: "https://myvault.vault.azure.net/secrets/user", UsernameType: graph.VaultSecret, Password: "https://myvault.vault.azure.net/secrets/password", PasswordType: graph.VaultSecret, Identity: "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86"},
+	}
+
+	coverage, err := TaskCredentialCoverage(task, &RemoteDigestOptions{
+		RequireCredentials: true,
+		PublicRegistries:   []string{"mcr.microsoft.com"},
+		ProxyCaches:        []*ProxyCache{{Upstream: "docker.io", Registry: "mycache.azurecr.io"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{
+		"mcr.microsoft.com: anonymous",
+		"myregistry.azurecr.io: msi (*.azurecr.io)",
+		"registry.hub.docker.com (through mycache.azurecr.io): msi (*.azurecr.io)",
+		"thirdparty.example.com: opaque, vaultsecret",
+	}
+	var actual []string
+	for _, c := range coverage {
+		if c.Gap != nil {
+			t.Errorf("Unexpected gap for %s: %v", c.Registry, c.Gap)
+		}
+		actual = append(actual, c.String())
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, but got %v", expected, actual)
+	}
+	for _, c := range actual {
+		if strings.Contains(c, "p@ssw0rd") || strings.Contains(c, "myvault") {
+			t.Errorf("Expected the coverage not to reveal secrets, but got %s", c)
+		}
+	}
+
+	// Without the credentials, the registries which aren't public are gaps.
+	task.Credentials = nil
+	coverage, err = TaskCredentialCoverage(task, &RemoteDigestOptions{RequireCredentials: true, PublicRegistries: []string{"mcr.microsoft.com"}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, c := range coverage {
+		if (c.Registry == "mcr.microsoft.com") != (c.Gap == nil) {
+			t.Errorf("Unexpected gap for %s: %v", c.Registry, c.Gap)
+		}
+	}
+}
+
+func TestRemoteDigest_CheckRegistryAuth(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "secret"
+	host, stop := registry.start()
+	defer stop()
+
+	credentials := func(username, password string) graph.RegistryLoginCredentials {
+		return graph.RegistryLoginCredentials{
+			host: {
+				Username: &secretmgmt.Secret{ResolvedValue: username},
+				Password: &secretmgmt.Secret{ResolvedValue: password},
+			},
+		}
+	}
+
+	if err := NewRemoteDigest(credentials("user", "secret")).CheckRegistryAuth(context.Background(), host); err != nil {
+		t.Errorf("Unexpected error with valid credentials: %v", err)
+	}
+	if err := NewRemoteDigest(credentials("user", "wrong")).CheckRegistryAuth(context.Background(), host); err == nil || !strings.Contains(err.Error(), "rejected the credentials") {
+		t.Errorf("Expected the credentials to be rejected, but got %v", err)
+	}
+	if err := NewRemoteDigest(nil).CheckRegistryAuth(context.Background(), host); err == nil {
+		t.Error("Expected anonymous access to be rejected")
+	}
+
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{RequireCredentials: true})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := d.CheckRegistryAuth(context.Background(), host); err == nil || !strings.Contains(err.Error(), "no credentials are configured") {
+		t.Errorf("Expected an error for missing credentials, but got %v", err)
+	}
+}
+
+func TestRemoteDigest_CheckRegistryAuth_CredentialSources(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "secret"
+	host, stop := registry.start()
+	defer stop()
+
+	source := func(name, username, password string, err error) *CredentialSource {
+		return &CredentialSource{
+			Name: name,
+			Credentials: func(context.Context) (string, string, error) {
+				return username, password, err
+			},
+		}
+	}
+
+	d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{
+		CredentialSources: map[string][]*CredentialSource{
+			host: {
+				source("unavailable", "", "", errors.New("identity not found")),
+				source("stale", "user", "old", nil),
+				source("current", "user", "secret", nil),
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := d.CheckRegistryAuth(context.Background(), host); err != nil {
+		t.Errorf("Expected the last credential source to be accepted, but got %v", err)
+	}
+
+	d.credentialSources[host] = d.credentialSources[host][:2]
+	err = d.CheckRegistryAuth(context.Background(), host)
+	if err == nil || !strings.Contains(err.Error(), "unavailable: failed to get credentials") || !strings.Contains(err.Error(), "stale:") {
+		t.Errorf("Expected an error listing each credential source, but got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/util"
+)
+
+// shellSpecialChars are the characters which make an arg need quoting to be pasted into a shell.
+const shellSpecialChars = " \t\n'\"\\$`|&;<>()*?[]{}#~!"
+
+// printStepCommands logs the commands which the step would run, with the Task's secrets redacted,
+// and marks the step as skipped, see SetPrintCommands.
+func (b *Builder) printStepCommands(step *graph.Step, commands ...[]string) {
+	replacer := b.commandRedactor()
+	for _, args := range commands {
+		log.Printf("Step ID: %s would run: %s\n", step.ID, formatCommand(args, replacer))
+	}
+	b.updateStep(step, func() {
+		step.StepStatus = graph.Skipped
+	})
+}
+
+// commandRedactor returns the replacer which redacts the Task's secrets, including the lazy secrets resolved so far.
+func (b *Builder) commandRedactor() *strings.Replacer {
+	secrets := append([]string(nil), b.commandSecrets...)
+	if b.lazySecrets != nil {
+		secrets = append(secrets, b.lazySecrets.ResolvedValues()...)
+	}
+	// Longer secrets are redacted first, so a secret containing another is redacted as a whole.
+	sort.SliceStable(secrets, func(i, j int) bool { return len(secrets[i]) > len(secrets[j]) })
+	var oldnew []string
+	for _, secret := range secrets {
+		if secret != "" {
+			oldnew = append(oldnew, secret, util.Redact(secret))
+		}
+	}
+	return strings.NewReplacer(oldnew...)
+}
+
+// formatCommand returns the command as it would be typed in a shell, with its args redacted by the replacer.
+func formatCommand(args []string, replacer *strings.Replacer) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, quoteArg(replacer.Replace(arg)))
+	}
+	return strings.Join(quoted, " ")
+}
+
+// quoteArg single quotes the arg if it's empty or contains characters which a shell would interpret.
+func quoteArg(arg string) string {
+	if arg != "" && !strings.ContainsAny(arg, shellSpecialChars) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
+// placeholderVolumeName returns the name of the volume with the prefix which the printed commands mount,
+// since volumes holding secrets aren't created when the commands are only printed.
+func placeholderVolumeName(prefix string) string {
+	return prefix + "_<volume>"
+}
@@ -0,0 +1,88 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/Azure/acr-builder/secretmgmt"
+)
+
+func TestRunTask_PrintCommands(t *testing.T) {
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `
+steps:
+  - id: run
+    cmd: allowed.azurecr.io/app --token hunter2
+    env: ["PASSWORD=hunter2"]
+  - id: push
+    push: ["allowed.azurecr.io/app:v1"]
+`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	task.Secrets = []*secretmgmt.Secret{{ID: "password", ResolvedValue: "hunter2"}}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetSkipDigests(true)
+	b.SetPrintCommands(true)
+	if err := b.RunTask(context.Background(), task); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	for _, step := range task.Steps {
+		if step.StepStatus != graph.Skipped {
+			t.Errorf("Expected step ID: %s to be skipped, but got %s", step.ID, step.StepStatus)
+		}
+	}
+	output := buf.String()
+	if strings.Contains(output, "hunter2") {
+		t.Errorf("Expected the secret to be redacted, but got %s", output)
+	}
+	for _, expected := range []string{
+		"Step ID: run would run: ",
+		"docker run --rm --network acb_default_network --name run ",
+		"--env PASSWORD=<redacted> ",
+		"allowed.azurecr.io/app --token <redacted>",
+		"Step ID: push would run: docker run ",
+		"push allowed.azurecr.io/app:v1",
+	} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Expected the output to contain %q, but got %s", expected, output)
+		}
+	}
+	// The ProcManager is a dry run, so nothing is run either way, but the commands aren't passed to it.
+	if strings.Count(output, "--name run ") != 1 {
+		t.Errorf("Expected the step's command not to be run, but got %s", output)
+	}
+}
+
+func TestFormatCommand(t *testing.T) {
+	replacer := strings.NewReplacer("s3cret", "<redacted>")
+	tests := []struct {
+		args     []string
+		expected string
+	}{
+		{[]string{"docker", "run", "--rm", "alpine"}, "docker run --rm alpine"},
+		{[]string{"sh", "-c", "echo hello"}, "sh -c 'echo hello'"},
+		{[]string{"echo", "it's"}, `echo 'it'\''s'`},
+		{[]string{"echo", ""}, "echo ''"},
+		{[]string{"--env", "TOKEN=s3cret"}, "--env 'TOKEN=<redacted>'"},
+	}
+	for _, test := range tests {
+		if actual := formatCommand(test.args, replacer); actual != test.expected {
+			t.Errorf("Expected %v to be formatted as %s, but got %s", test.args, test.expected, actual)
+		}
+	}
+}
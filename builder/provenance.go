@@ -0,0 +1,368 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/version"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// ProvenanceStatementType is the type of the in-toto statement, v1, which a provenance is.
+	ProvenanceStatementType = "https://in-toto.io/Statement/v1"
+
+	// ProvenancePredicateType is the type of the predicate of a provenance, SLSA provenance v1.0.
+	ProvenancePredicateType = "https://slsa.dev/provenance/v1"
+
+	// ProvenanceBuildType describes how the builds recorded by a provenance are run, i.e. by executing a Task's steps.
+	ProvenanceBuildType = "https://github.com/Azure/acr-builder/task@v1"
+
+	// ProvenanceBuilderID identifies acb as the builder of the images recorded by a provenance.
+	ProvenanceBuilderID = "https://github.com/Azure/acr-builder"
+
+	// ProvenanceMediaType is the artifact type of a provenance pushed as an OCI referrer, and the media type of its single layer.
+	ProvenanceMediaType = "application/vnd.in-toto+json"
+
+	// emptyConfigMediaType is the media type of the empty config of a provenance pushed as an OCI referrer.
+	emptyConfigMediaType = "application/vnd.oci.empty.v1+json"
+
+	// predicateTypeAnnotation records the predicate type of a provenance pushed as an OCI referrer.
+	predicateTypeAnnotation = "in-toto.io/predicate-type"
+)
+
+// ProvenanceOptions configures the provenance generated once a Task's images are built.
+type ProvenanceOptions struct {
+	// Output is the path the provenance is written to, if any.
+	Output string
+
+	// Push pushes the provenance as an OCI referrer of each image it describes.
+	Push bool
+
+	// InvocationID identifies the run, e.g. its build ID.
+	InvocationID string
+}
+
+// ProvenanceStatement is an in-toto statement whose predicate is a SLSA provenance, describing how its subjects were built.
+type ProvenanceStatement struct {
+	Type          string                `json:"_type"`
+	Subject       []*ResourceDescriptor `json:"subject"`
+	PredicateType string                `json:"predicateType"`
+	Predicate     *ProvenancePredicate  `json:"predicate"`
+}
+
+// ResourceDescriptor describes an image or source, either built or used to build, by its name and digests.
+type ResourceDescriptor struct {
+	Name        string            `json:"name,omitempty"`
+	URI         string            `json:"uri,omitempty"`
+	Digest      map[string]string `json:"digest"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+// ProvenancePredicate is a SLSA provenance v1.0 predicate.
+type ProvenancePredicate struct {
+	BuildDefinition *ProvenanceBuildDefinition `json:"buildDefinition"`
+	RunDetails      *ProvenanceRunDetails      `json:"runDetails"`
+}
+
+// ProvenanceBuildDefinition describes the steps which were executed and the materials they used.
+type ProvenanceBuildDefinition struct {
+	BuildType            string                `json:"buildType"`
+	ExternalParameters   *ProvenanceParameters `json:"externalParameters"`
+	ResolvedDependencies []*ResourceDescriptor `json:"resolvedDependencies"`
+}
+
+// ProvenanceParameters are the parameters of the build, the Task's steps.
+type ProvenanceParameters struct {
+	Steps []*ProvenanceStep `json:"steps"`
+}
+
+// ProvenanceStep describes a step of the Task, with its secrets scrubbed. Only the names of its
+// environment variables are recorded, since their values may be sensitive.
+type ProvenanceStep struct {
+	ID     string   `json:"id"`
+	Cmd    string   `json:"cmd,omitempty"`
+	Build  string   `json:"build,omitempty"`
+	Push   []string `json:"push,omitempty"`
+	Env    []string `json:"env,omitempty"`
+	Status string   `json:"status"`
+}
+
+// ProvenanceRunDetails describes the builder and the run.
+type ProvenanceRunDetails struct {
+	Builder  *ProvenanceBuilder  `json:"builder"`
+	Metadata *ProvenanceMetadata `json:"metadata"`
+}
+
+// ProvenanceBuilder identifies the builder.
+type ProvenanceBuilder struct {
+	ID      string            `json:"id"`
+	Version map[string]string `json:"version"`
+}
+
+// ProvenanceMetadata describes when the run started and finished.
+type ProvenanceMetadata struct {
+	InvocationID string     `json:"invocationId,omitempty"`
+	StartedOn    *time.Time `json:"startedOn,omitempty"`
+	FinishedOn   *time.Time `json:"finishedOn,omitempty"`
+}
+
+// referrerManifest is an OCI image manifest with an artifact type, which the vendored image spec doesn't define.
+type referrerManifest struct {
+	ocispec.Manifest
+	ArtifactType string `json:"artifactType,omitempty"`
+}
+
+// NewProvenance creates the provenance of the images built by the Task, i.e. the images of the dependencies
+// whose digests are known because they were pushed, listing the Task's steps and the base images and source
+// they were built from, by their resolved digests. The secrets are scrubbed from the steps.
+func NewProvenance(task *graph.Task, dependencies []*image.Dependencies, invocationID string, secrets []string) *ProvenanceStatement {
+	scrubber := secretReplacer(secrets)
+	steps := make([]*ProvenanceStep, 0, len(task.Steps))
+	var startedOn, finishedOn time.Time
+	for _, s := range task.Steps {
+		step := &ProvenanceStep{
+			ID:     s.ID,
+			Cmd:    scrubber.Replace(s.Cmd),
+			Build:  scrubber.Replace(s.Build),
+			Status: string(s.StepStatus),
+		}
+		for _, push := range s.Push {
+			step.Push = append(step.Push, scrubber.Replace(push))
+		}
+		for _, env := range s.Envs {
+			step.Env = append(step.Env, strings.SplitN(env, "=", 2)[0])
+		}
+		steps = append(steps, step)
+
+		if !s.StartTime.IsZero() && (startedOn.IsZero() || s.StartTime.Before(startedOn)) {
+			startedOn = s.StartTime
+		}
+		if s.EndTime.After(finishedOn) {
+			finishedOn = s.EndTime
+		}
+	}
+
+	subjects := []*ResourceDescriptor{}
+	materials := []*ResourceDescriptor{}
+	seenSubjects := make(map[string]bool)
+	seenMaterials := make(map[string]bool)
+	addMaterial := func(m *ResourceDescriptor) {
+		key := m.Name + "@" + m.URI
+		for algorithm, value := range m.Digest {
+			key += "@" + algorithm + ":" + value
+		}
+		if !seenMaterials[key] {
+			seenMaterials[key] = true
+			materials = append(materials, m)
+		}
+	}
+	addImage := func(ref *image.Reference) {
+		if ref == nil || ref.Digest == "" || IsNoBaseImage(ref) {
+			return
+		}
+		m := &ResourceDescriptor{Name: ref.Reference, Digest: digestSet(ref.Digest)}
+		if ref.OriginalReference != "" {
+			m.Name = ref.OriginalReference
+		}
+		if ref.Platform != "" {
+			m.Annotations = map[string]string{"platform": ref.Platform}
+		}
+		addMaterial(m)
+	}
+	for _, dep := range dependencies {
+		if dep == nil {
+			continue
+		}
+		if img := dep.Image; img != nil && img.Digest != "" {
+			name, err := image.NewReference(img.Registry, img.Repository, "", "")
+			if err != nil {
+				log.Printf("WARNING: %s isn't a subject of the provenance: %v\n", img.Reference, err)
+			} else if !seenSubjects[name.Reference+"@"+img.Digest] {
+				seenSubjects[name.Reference+"@"+img.Digest] = true
+				subjects = append(subjects, &ResourceDescriptor{Name: name.Reference, Digest: digestSet(img.Digest)})
+			}
+		}
+		addImage(dep.Runtime)
+		for _, buildtime := range dep.Buildtime {
+			addImage(buildtime)
+		}
+		if dep.Git != nil && dep.Git.GitHeadRev != "" {
+			addMaterial(&ResourceDescriptor{Name: "git", Digest: map[string]string{"gitCommit": dep.Git.GitHeadRev}})
+		}
+	}
+	sort.SliceStable(subjects, func(i, j int) bool { return subjects[i].Name < subjects[j].Name })
+	sort.SliceStable(materials, func(i, j int) bool { return materials[i].Name < materials[j].Name })
+
+	metadata := &ProvenanceMetadata{InvocationID: invocationID}
+	if !startedOn.IsZero() {
+		startedOn = startedOn.UTC()
+		metadata.StartedOn = &startedOn
+	}
+	if !finishedOn.IsZero() {
+		finishedOn = finishedOn.UTC()
+		metadata.FinishedOn = &finishedOn
+	}
+	return &ProvenanceStatement{
+		Type:          ProvenanceStatementType,
+		Subject:       subjects,
+		PredicateType: ProvenancePredicateType,
+		Predicate: &ProvenancePredicate{
+			BuildDefinition: &ProvenanceBuildDefinition{
+				BuildType:            ProvenanceBuildType,
+				ExternalParameters:   &ProvenanceParameters{Steps: steps},
+				ResolvedDependencies: materials,
+			},
+			RunDetails: &ProvenanceRunDetails{
+				Builder:  &ProvenanceBuilder{ID: ProvenanceBuilderID, Version: map[string]string{"acb": version.Version}},
+				Metadata: metadata,
+			},
+		},
+	}
+}
+
+// digestSet returns the digest, e.g. sha256:abc, as a digest set, e.g. {"sha256": "abc"}.
+func digestSet(dgst string) map[string]string {
+	if i := strings.Index(dgst, ":"); i >= 0 {
+		return map[string]string{dgst[:i]: dgst[i+1:]}
+	}
+	return map[string]string{string(digest.Canonical): dgst}
+}
+
+// SetProvenance sets the options of the provenance generated once the Task's images are built. Nil doesn't generate one.
+func (b *Builder) SetProvenance(opts *ProvenanceOptions) {
+	b.provenance = opts
+}
+
+// writeProvenance generates the provenance of the images built by the Task, writing it to the provenance's
+// output and pushing it as an OCI referrer of each image, as configured.
+func (b *Builder) writeProvenance(ctx context.Context, task *graph.Task, dependencies []*image.Dependencies) error {
+	if b.provenance == nil {
+		return nil
+	}
+	secrets := taskSecrets(task)
+	if b.lazySecrets != nil {
+		secrets = append(secrets, b.lazySecrets.ResolvedValues()...)
+	}
+	statement := NewProvenance(task, dependencies, b.provenance.InvocationID, secrets)
+	data, err := json.MarshalIndent(statement, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the provenance")
+	}
+
+	if b.provenance.Output != "" {
+		if err := ioutil.WriteFile(b.provenance.Output, data, 0644); err != nil {
+			return errors.Wrap(err, "failed to write the provenance")
+		}
+		log.Printf("Wrote provenance to %s\n", b.provenance.Output)
+	}
+	if !b.provenance.Push {
+		return nil
+	}
+	if len(statement.Subject) == 0 {
+		log.Printf("WARNING: no pushed images to attach the provenance to\n")
+		return nil
+	}
+	store, err := b.newArtifactStore(task.RegistryLoginCredentials, task.Credentials)
+	if err != nil {
+		return err
+	}
+	for _, subject := range statement.Subject {
+		var ref string
+		for algorithm, value := range subject.Digest {
+			ref = subject.Name + "@" + algorithm + ":" + value
+		}
+		pushCtx, cancel := context.WithTimeout(ctx, time.Duration(artifactTimeoutInSec)*time.Second)
+		dgst, err := pushProvenance(pushCtx, store, ref, data)
+		cancel()
+		if err != nil {
+			return errors.Wrapf(err, "failed to push the provenance of %s", ref)
+		}
+		log.Printf("Pushed the provenance of %s (digest: %s)\n", ref, dgst)
+	}
+	return nil
+}
+
+// pushProvenance pushes the provenance as an OCI referrer of the image ref, which must include its digest, and
+// returns the digest of the provenance's manifest. The manifest has the ProvenanceMediaType as its artifact type,
+// an empty config, and the provenance as its single layer.
+func pushProvenance(ctx context.Context, d *remoteDigest, ref string, provenance []byte) (digest.Digest, error) {
+	imgRef, imageRef, err := parseArtifactRef(ref)
+	if err != nil {
+		return "", err
+	}
+	if err := d.registryAllowlist.Check(imgRef.Registry); err != nil {
+		return "", err
+	}
+	release, err := d.limiter.acquire(ctx, imgRef.Registry)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	// The referrer's subject is the image's manifest or index, as resolved by its digest.
+	resolver, _, subject, err := d.resolve(ctx, imgRef, imageRef)
+	if err != nil {
+		return "", err
+	}
+	pusher, err := resolver.Pusher(ctx, imageRef)
+	if err != nil {
+		return "", errors.Wrap(err, "failed to create a pusher")
+	}
+
+	layer := ocispec.Descriptor{
+		MediaType: ProvenanceMediaType,
+		Digest:    digest.FromBytes(provenance),
+		Size:      int64(len(provenance)),
+	}
+	config := ocispec.Descriptor{
+		MediaType: emptyConfigMediaType,
+		Digest:    digest.FromBytes(artifactConfig),
+		Size:      int64(len(artifactConfig)),
+	}
+	manifest, err := json.Marshal(referrerManifest{
+		Manifest: ocispec.Manifest{
+			Versioned:   specs.Versioned{SchemaVersion: 2},
+			MediaType:   ocispec.MediaTypeImageManifest,
+			Config:      config,
+			Layers:      []ocispec.Descriptor{layer},
+			Subject:     &ocispec.Descriptor{MediaType: subject.MediaType, Digest: subject.Digest, Size: subject.Size},
+			Annotations: map[string]string{predicateTypeAnnotation: ProvenancePredicateType},
+		},
+		ArtifactType: ProvenanceMediaType,
+	})
+	if err != nil {
+		return "", err
+	}
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifest),
+		Size:      int64(len(manifest)),
+	}
+
+	// The blobs are pushed before the manifest referencing them.
+	if err := pushContent(ctx, pusher, config, bytes.NewReader(artifactConfig)); err != nil {
+		return "", errors.Wrap(err, "failed to push the provenance's config")
+	}
+	if err := pushContent(ctx, pusher, layer, bytes.NewReader(provenance)); err != nil {
+		return "", errors.Wrap(err, "failed to push the provenance")
+	}
+	if err := pushContent(ctx, pusher, manifestDesc, bytes.NewReader(manifest)); err != nil {
+		return "", errors.Wrap(err, "failed to push the provenance's manifest")
+	}
+	return manifestDesc.Digest, nil
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/images"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	testImageDigest   = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	testRuntimeDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	testBuildDigest   = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+)
+
+func TestNewProvenance(t *testing.T) {
+	task := &graph.Task{Steps: []*graph.Step{
+		{ID: "build", Build: "-t myregistry.azurecr.io/app:v1 --build-arg TOKEN=s3cr3t .", Envs: []string{"TOKEN=s3cr3t", "DEBUG"}, StepStatus: graph.Successful},
+		{ID: "push", Push: []string{"myregistry.azurecr.io/app:v1"}, StepStatus: graph.Successful},
+	}}
+	deps := []*image.Dependencies{
+		{
+			Image:   &image.Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: "v1", Digest: testImageDigest, Reference: "myregistry.azurecr.io/app:v1"},
+			Runtime: &image.Reference{Registry: DockerHubRegistry, Repository: "library/alpine", Tag: "3.18", Digest: testRuntimeDigest, Reference: "alpine:3.18", Platform: "linux/amd64"},
+			Buildtime: []*image.Reference{
+				{Registry: DockerHubRegistry, Repository: "library/golang", Tag: "1.21", Digest: testBuildDigest, Reference: "golang:1.21"},
+				{Registry: DockerHubRegistry, Repository: "library/scratch", Reference: "scratch"},
+			},
+			Git: &image.GitReference{GitHeadRev: "abc123"},
+		},
+		// Images which weren't pushed have no digest, so they aren't subjects.
+		{Image: &image.Reference{Registry: "myregistry.azurecr.io", Repository: "local", Tag: "v1", Reference: "myregistry.azurecr.io/local:v1"}},
+	}
+
+	statement := NewProvenance(task, deps, "run-1", []string{"s3cr3t"})
+	if statement.Type != ProvenanceStatementType || statement.PredicateType != ProvenancePredicateType {
+		t.Errorf("Expected an in-toto statement of a SLSA provenance, but got %s of %s", statement.Type, statement.PredicateType)
+	}
+	expectedSubjects := []*ResourceDescriptor{{Name: "myregistry.azurecr.io/app", Digest: map[string]string{"sha256": strings.TrimPrefix(testImageDigest, "sha256:")}}}
+	if !reflect.DeepEqual(statement.Subject, expectedSubjects) {
+		t.Errorf("Expected subjects %+v, but got %+v", expectedSubjects, statement.Subject)
+	}
+
+	expectedMaterials := []*ResourceDescriptor{
+		{Name: "alpine:3.18", Digest: map[string]string{"sha256": strings.TrimPrefix(testRuntimeDigest, "sha256:")}, Annotations: map[string]string{"platform": "linux/amd64"}},
+		{Name: "git", Digest: map[string]string{"gitCommit": "abc123"}},
+		{Name: "golang:1.21", Digest: map[string]string{"sha256": strings.TrimPrefix(testBuildDigest, "sha256:")}},
+	}
+	if actual := statement.Predicate.BuildDefinition.ResolvedDependencies; !reflect.DeepEqual(actual, expectedMaterials) {
+		t.Errorf("Expected resolved dependencies %+v, but got %+v", expectedMaterials, actual)
+	}
+
+	steps := statement.Predicate.BuildDefinition.ExternalParameters.Steps
+	if len(steps) != 2 {
+		t.Fatalf("Expected 2 steps, but got %d", len(steps))
+	}
+	if steps[0].Build != "-t myregistry.azurecr.io/app:v1 --build-arg TOKEN=*** ." {
+		t.Errorf("Expected the secret to be scrubbed from the build, but got %s", steps[0].Build)
+	}
+	if !reflect.DeepEqual(steps[0].Env, []string{"TOKEN", "DEBUG"}) {
+		t.Errorf("Expected only the names of the environment variables, but got %v", steps[0].Env)
+	}
+	if steps[1].Status != string(graph.Successful) || !reflect.DeepEqual(steps[1].Push, []string{"myregistry.azurecr.io/app:v1"}) {
+		t.Errorf("Unexpected push step %+v", steps[1])
+	}
+	if id := statement.Predicate.RunDetails.Metadata.InvocationID; id != "run-1" {
+		t.Errorf("Expected the invocation ID run-1, but got %s", id)
+	}
+
+	data, err := json.Marshal(statement)
+	if err != nil {
+		t.Fatalf("Failed to marshal the provenance: %v", err)
+	}
+	if strings.Contains(string(data), "s3cr3t") {
+		t.Errorf("Expected the provenance not to contain the secret, but got %s", data)
+	}
+	for _, field := range []string{`"_type":"https://in-toto.io/Statement/v1"`, `"buildType":"` + ProvenanceBuildType + `"`, `"builder":{"id":"` + ProvenanceBuilderID + `"`} {
+		if !strings.Contains(string(data), field) {
+			t.Errorf("Expected the provenance to contain %s, but got %s", field, data)
+		}
+	}
+}
+
+func TestPushProvenance(t *testing.T) {
+	registry := newFakeRegistry()
+	imageManifest := []byte(`{"schemaVersion":2}`)
+	imageDigest := registry.addManifest("app", "v1", images.MediaTypeDockerSchema2Manifest, imageManifest)
+	host, stop := registry.start()
+	defer stop()
+
+	provenance := []byte(`{"_type":"https://in-toto.io/Statement/v1"}`)
+	dgst, err := pushProvenance(context.Background(), NewRemoteDigest(nil), host+"/app@"+imageDigest.String(), provenance)
+	if err != nil {
+		t.Fatalf("Unexpected error pushing the provenance: %v", err)
+	}
+
+	pushed, ok := registry.manifests["app@"+dgst.String()]
+	if !ok {
+		t.Fatalf("Expected the provenance's manifest %s to be pushed", dgst)
+	}
+	var manifest referrerManifest
+	if err := json.Unmarshal(pushed.content, &manifest); err != nil {
+		t.Fatalf("Failed to decode the pushed manifest: %v", err)
+	}
+	if manifest.ArtifactType != ProvenanceMediaType || manifest.Config.MediaType != emptyConfigMediaType {
+		t.Errorf("Expected a %s artifact with an empty config, but got %+v", ProvenanceMediaType, manifest)
+	}
+	expectedSubject := &ocispec.Descriptor{MediaType: images.MediaTypeDockerSchema2Manifest, Digest: imageDigest, Size: int64(len(imageManifest))}
+	if !reflect.DeepEqual(manifest.Subject, expectedSubject) {
+		t.Errorf("Expected the subject %+v, but got %+v", expectedSubject, manifest.Subject)
+	}
+	if len(manifest.Layers) != 1 || manifest.Layers[0].Digest != digest.FromBytes(provenance) {
+		t.Errorf("Expected the provenance as the single layer, but got %+v", manifest.Layers)
+	}
+	if string(registry.blobs["app@"+digest.FromBytes(provenance).String()]) != string(provenance) {
+		t.Error("Expected the provenance to be pushed as a blob")
+	}
+	// The image's tag still refers to the image, only the subject refers to it.
+	if registry.manifests["app:v1"].mediaType != images.MediaTypeDockerSchema2Manifest {
+		t.Error("Expected pushing the provenance not to retag the image")
+	}
+}
@@ -4,58 +4,152 @@
 package builder
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"io"
 	"log"
-	"os"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/Azure/acr-builder/scan"
 	"github.com/Azure/acr-builder/util"
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
 )
 
 const (
 	maxPushRetries = 3
+
+	// DefaultPushConcurrency is the default maximum number of images a push step pushes concurrently.
+	DefaultPushConcurrency = 4
 )
 
-func (b *Builder) pushWithRetries(ctx context.Context, images []string) error {
+// pushRetryBackoff returns how long to wait after a failed attempt to push an image.
+var pushRetryBackoff = util.GetExponentialBackoff
+
+// pushFunc pushes the image once, writing the push's output to stdout and stderr.
+type pushFunc func(ctx context.Context, img string, stdout io.Writer, stderr io.Writer) error
+
+// SetPushConcurrency sets the maximum number of images a push step pushes concurrently, 1 to push them
+// one after the other. If it isn't positive, DefaultPushConcurrency is used.
+func (b *Builder) SetPushConcurrency(concurrency int) {
+	b.pushConcurrency = concurrency
+}
+
+func (b *Builder) pushWithRetries(ctx context.Context, images []string, stdout io.Writer, stderr io.Writer) error {
+	return b.pushImages(ctx, images, stdout, stderr, func(ctx context.Context, img string, stdout io.Writer, stderr io.Writer) error {
+		return b.procManager.Run(ctx, pushArgs(img), nil, stdout, stderr, "")
+	})
+}
+
+// pushImages pushes the images with retries, up to the push concurrency at once. Tags of the same image
+// share its content, which the Docker daemon uploads once even if the tags are pushed concurrently.
+// Every image is pushed even if another fails, and the failures are returned together.
+// Each push attempt is throttled by the registry limiter of the image's registry, if any.
+func (b *Builder) pushImages(ctx context.Context, images []string, stdout io.Writer, stderr io.Writer, push pushFunc) error {
 	if len(images) == 0 {
 		return nil
 	}
+	concurrency := b.pushConcurrency
+	if concurrency <= 0 {
+		concurrency = DefaultPushConcurrency
+	}
+	if concurrency > len(images) {
+		concurrency = len(images)
+	}
 
-	for _, img := range images {
-		args := []string{
-			"docker",
-			"run",
-			"--name", fmt.Sprintf("acb_docker_push_%s", uuid.New()),
-			"--rm",
-
-			// Mount home
-			"--volume", util.DockerSocketVolumeMapping,
-			"--volume", homeVol + ":" + homeWorkDir,
-			"--env", homeEnv,
+	slots := semaphore.NewWeighted(int64(concurrency))
+	errs := make([]error, len(images))
+	var outputMu sync.Mutex
+	var wg sync.WaitGroup
+	for i, img := range images {
+		if err := slots.Acquire(ctx, 1); err != nil {
+			errs[i] = err
+			continue
+		}
+		wg.Add(1)
+		go func(i int, img string) {
+			defer wg.Done()
+			defer slots.Release(1)
+			if concurrency == 1 {
+				errs[i] = b.pushImageWithRetries(ctx, img, stdout, stderr, push)
+				return
+			}
+			// The output of concurrent pushes is written once each completes, so their progress doesn't interleave.
+			var pushStdout, pushStderr bytes.Buffer
+			errs[i] = b.pushImageWithRetries(ctx, img, &pushStdout, &pushStderr, push)
+			outputMu.Lock()
+			defer outputMu.Unlock()
+			_, _ = stdout.Write(pushStdout.Bytes())
+			_, _ = stderr.Write(pushStderr.Bytes())
+		}(i, img)
+	}
+	wg.Wait()
 
-			dockerCLIImageName,
-			"push",
-			img,
+	var failures []string
+	for i, err := range errs {
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", images[i], err))
 		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to push %d of %d images successfully: [%s]", len(failures), len(images), strings.Join(failures, "; "))
+	}
+	return nil
+}
 
-		attempt := 0
-		for attempt < maxPushRetries {
-			log.Printf("Pushing image: %s, attempt %d\n", img, attempt+1)
-			if err := b.procManager.Run(ctx, args, nil, os.Stdout, os.Stderr, ""); err != nil {
-				time.Sleep(util.GetExponentialBackoff(attempt))
-				attempt++
-			} else {
-				log.Printf("Successfully pushed image: %s\n", img)
-				break
+// pushImageWithRetries pushes the image, retrying up to maxPushRetries times with an exponential backoff.
+// Each attempt waits for the rate limit of the registry, see RegistryLimiter.
+func (b *Builder) pushImageWithRetries(ctx context.Context, img string, stdout io.Writer, stderr io.Writer, push pushFunc) error {
+	var limiter *RegistryLimiter
+	if b.remoteDigestOptions != nil {
+		limiter = b.remoteDigestOptions.Limiter
+	}
+	registry := img
+	if ref, err := scan.NewImageReference(img); err == nil {
+		registry = ref.Registry
+	}
+
+	var err error
+	for attempt := 0; attempt < maxPushRetries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-ctx.Done():
+				return errors.Wrapf(ctx.Err(), "gave up retrying the push, the last attempt failed with: %v", err)
+			case <-time.After(pushRetryBackoff(attempt - 1)):
 			}
 		}
-
-		if attempt == maxPushRetries {
-			return fmt.Errorf("failed to push images successfully")
+		if limitErr := limiter.wait(ctx, registry); limitErr != nil {
+			return limitErr
+		}
+		log.Printf("Pushing image: %s, attempt %d\n", img, attempt+1)
+		err = push(ctx, img, stdout, stderr)
+		if err == nil {
+			log.Printf("Successfully pushed image: %s\n", img)
+			return nil
 		}
 	}
+	return err
+}
 
-	return nil
+// pushArgs returns the args to push the image.
+func pushArgs(img string) []string {
+	return []string{
+		"docker",
+		"run",
+		"--name", fmt.Sprintf("acb_docker_push_%s", uuid.New()),
+		"--rm",
+
+		// Mount home
+		"--volume", util.DockerSocketVolumeMapping,
+		"--volume", homeVol + ":" + homeWorkDir,
+		"--env", homeEnv,
+
+		dockerCLIImageName,
+		"push",
+		img,
+	}
 }
@@ -0,0 +1,60 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+)
+
+// checkExistingTags checks whether the tag of each image pushed by the push step already exists in its
+// registry, using the Task's credentials, and returns the images to push according to the step's ifTagExists or skipIfExists.
+func (b *Builder) checkExistingTags(ctx context.Context, step *graph.Step, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) ([]string, error) {
+	policy := step.TagExistsPolicy()
+	if policy == graph.TagExistsProceed {
+		return step.Push, nil
+	}
+	remoteDigester, err := b.newPushRemoteDigest(registryCreds, credentials)
+	if err != nil {
+		return nil, err
+	}
+	return filterExistingTags(ctx, step.Push, policy, remoteDigester)
+}
+
+// filterExistingTags returns the images to push, resolving each image's tag using remote: images whose tag
+// doesn't exist are always pushed, whereas images whose tag exists are pushed, skipped or fail the push
+// according to policy. An error other than the tag not being found fails the push, since whether the
+// tag exists is unknown.
+func filterExistingTags(ctx context.Context, images []string, policy string, remote DigestHelper) ([]string, error) {
+	var push []string
+	for _, img := range images {
+		ref, err := scan.NewImageReference(util.NormalizeImageTag(img))
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to parse the image %s", img)
+		}
+		ref.Digest = ""
+		if err := remote.PopulateDigest(ctx, ref); err != nil {
+			if errdefs.IsNotFound(err) {
+				push = append(push, img)
+				continue
+			}
+			return nil, errors.Wrapf(err, "failed to check whether the tag of %s already exists", img)
+		}
+		switch policy {
+		case graph.TagExistsSkip:
+			util.Infof("Skipping the push of %s, its tag already exists (digest: %s)\n", img, ref.Digest)
+		case graph.TagExistsFail:
+			return nil, fmt.Errorf("the tag of %s already exists in its registry (digest: %s), and the step fails if a tag exists; nothing was pushed", img, ref.Digest)
+		default:
+			push = append(push, img)
+		}
+	}
+	return push, nil
+}
@@ -0,0 +1,86 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/images"
+)
+
+func TestFilterExistingTags(t *testing.T) {
+	registry := newFakeRegistry()
+	existingDigest := registry.addManifest("library/app", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+	existing, absent := host+"/library/app:v1", host+"/library/app:v2"
+
+	tests := []struct {
+		policy   string
+		expected []string
+		errorMsg string
+	}{
+		{graph.TagExistsProceed, []string{existing, absent}, ""},
+		{graph.TagExistsSkip, []string{absent}, ""},
+		{graph.TagExistsFail, nil, "the tag of " + existing + " already exists in its registry (digest: " + existingDigest.String() + ")"},
+	}
+
+	for _, test := range tests {
+		push, err := filterExistingTags(context.Background(), []string{existing, absent}, test.policy, NewRemoteDigest(nil))
+		if test.errorMsg != "" {
+			if err == nil || !strings.Contains(err.Error(), test.errorMsg) {
+				t.Errorf("Expected an error containing %q for %s, but got %v", test.errorMsg, test.policy, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", test.policy, err)
+		}
+		if !util.StringSequenceEquals(push, test.expected) {
+			t.Errorf("Expected to push %v for %s, but got %v", test.expected, test.policy, push)
+		}
+	}
+}
+
+func TestFilterExistingTags_AbsentTags(t *testing.T) {
+	registry := newFakeRegistry()
+	host, stop := registry.start()
+	defer stop()
+	absent := []string{host + "/library/app:v1", host + "/library/other:v1"}
+
+	for _, policy := range []string{graph.TagExistsSkip, graph.TagExistsFail} {
+		push, err := filterExistingTags(context.Background(), absent, policy, NewRemoteDigest(nil))
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", policy, err)
+		}
+		if !util.StringSequenceEquals(push, absent) {
+			t.Errorf("Expected to push every absent tag for %s, but got %v", policy, push)
+		}
+	}
+}
+
+func TestFilterExistingTags_ResolveError(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "password"
+	host, stop := registry.start()
+	defer stop()
+
+	_, err := filterExistingTags(context.Background(), []string{host + "/library/app:v1"}, graph.TagExistsSkip, NewRemoteDigest(nil))
+	if err == nil || !strings.Contains(err.Error(), "failed to check whether the tag of") {
+		t.Errorf("Expected an error other than not found to fail the check, but got %v", err)
+	}
+}
+
+func TestCheckExistingTags_Proceed(t *testing.T) {
+	b := &Builder{}
+	step := &graph.Step{ID: "push", Push: []string{"unreachable.invalid/app:v1"}}
+	push, err := b.checkExistingTags(context.Background(), step, nil, nil)
+	if err != nil || !util.StringSequenceEquals(push, step.Push) {
+		t.Errorf("Expected the tags not to be checked without ifTagExists, but got %v, %v", push, err)
+	}
+}
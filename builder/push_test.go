@@ -0,0 +1,179 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/pkg/procmanager"
+)
+
+// fakePusher records the images pushed and the most pushes in flight at once, per registry and overall.
+type fakePusher struct {
+	mu          sync.Mutex
+	pushed      []string
+	inFlight    map[string]int
+	maxInFlight map[string]int
+	total       int
+	maxTotal    int
+	fail        map[string]bool
+}
+
+func newFakePusher() *fakePusher {
+	return &fakePusher{inFlight: map[string]int{}, maxInFlight: map[string]int{}, fail: map[string]bool{}}
+}
+
+func (p *fakePusher) push(ctx context.Context, img string, stdout io.Writer, stderr io.Writer) error {
+	registry := strings.SplitN(img, "/", 2)[0]
+	p.mu.Lock()
+	p.inFlight[registry]++
+	p.total++
+	if p.inFlight[registry] > p.maxInFlight[registry] {
+		p.maxInFlight[registry] = p.inFlight[registry]
+	}
+	if p.total > p.maxTotal {
+		p.maxTotal = p.total
+	}
+	p.mu.Unlock()
+
+	fmt.Fprintf(stdout, "pushing %s\n", img)
+	time.Sleep(20 * time.Millisecond)
+	fmt.Fprintf(stdout, "pushed %s\n", img)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight[registry]--
+	p.total--
+	if p.fail[img] {
+		return errors.New("denied")
+	}
+	p.pushed = append(p.pushed, img)
+	return nil
+}
+
+func TestPushImages_Concurrent(t *testing.T) {
+	images := []string{
+		"myregistry.azurecr.io/app:v1",
+		"myregistry.azurecr.io/app:v1.2",
+		"myregistry.azurecr.io/app:latest",
+		"other.azurecr.io/app:v1",
+		"other.azurecr.io/app:latest",
+	}
+	tests := []struct {
+		name                   string
+		concurrency            int
+		registryMaxConcurrency int
+		expectedMaxTotal       int
+		expectedMaxPerRegistry int
+	}{
+		{"sequential", 1, 0, 1, 1},
+		{"concurrent", 0, 0, DefaultPushConcurrency, 3},
+		// Pushes don't take the slots of resolves.
+		{"registry max concurrency", 5, 1, 5, 3},
+	}
+	for _, test := range tests {
+		b := NewBuilder(procmanager.NewProcManager(true), false, "")
+		b.SetPushConcurrency(test.concurrency)
+		limiter, err := NewRegistryLimiter(RegistryLimits{MaxConcurrency: test.registryMaxConcurrency})
+		if err != nil {
+			t.Fatalf("Failed to create the limiter: %v", err)
+		}
+		b.SetRemoteDigestOptions(&RemoteDigestOptions{Limiter: limiter})
+
+		pusher := newFakePusher()
+		var stdout bytes.Buffer
+		if err := b.pushImages(context.Background(), images, &stdout, io.Discard, pusher.push); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+
+		pushed := append([]string(nil), pusher.pushed...)
+		expected := append([]string(nil), images...)
+		sort.Strings(pushed)
+		sort.Strings(expected)
+		if strings.Join(pushed, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected all the tags to be pushed, but got %v", test.name, pusher.pushed)
+		}
+		if pusher.maxTotal != test.expectedMaxTotal {
+			t.Errorf("%s: expected at most %d pushes at once, but got %d", test.name, test.expectedMaxTotal, pusher.maxTotal)
+		}
+		for registry, max := range pusher.maxInFlight {
+			if max > test.expectedMaxPerRegistry {
+				t.Errorf("%s: expected at most %d pushes at once to %s, but got %d", test.name, test.expectedMaxPerRegistry, registry, max)
+			}
+		}
+		// Each push's output is written whole.
+		for _, img := range images {
+			if !strings.Contains(stdout.String(), "pushing "+img+"\npushed "+img+"\n") {
+				t.Errorf("%s: expected the output of %s not to be interleaved, but got %s", test.name, img, stdout.String())
+			}
+		}
+	}
+}
+
+func TestPushImages_AggregatesFailures(t *testing.T) {
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	pusher := newFakePusher()
+	pusher.fail["myregistry.azurecr.io/app:v1"] = true
+	images := []string{"myregistry.azurecr.io/app:v1", "myregistry.azurecr.io/app:latest"}
+
+	err := b.pushImages(context.Background(), images, io.Discard, io.Discard, pusher.push)
+	if err == nil || !strings.Contains(err.Error(), "failed to push 1 of 2 images") || !strings.Contains(err.Error(), "myregistry.azurecr.io/app:v1: denied") {
+		t.Errorf("Expected the failed image to be reported, but got %v", err)
+	}
+	// The other image is still pushed.
+	if len(pusher.pushed) != 1 || pusher.pushed[0] != "myregistry.azurecr.io/app:latest" {
+		t.Errorf("Expected the other image to be pushed, but got %v", pusher.pushed)
+	}
+}
+
+func TestPushImages_RateLimit(t *testing.T) {
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	limiter, err := NewRegistryLimiter(RegistryLimits{RequestsPerSecond: 20})
+	if err != nil {
+		t.Fatalf("Failed to create the limiter: %v", err)
+	}
+	b.SetRemoteDigestOptions(&RemoteDigestOptions{Limiter: limiter})
+	images := []string{"myregistry.azurecr.io/app:v1", "myregistry.azurecr.io/app:v2", "myregistry.azurecr.io/app:v3"}
+
+	start := time.Now()
+	if err := b.pushImages(context.Background(), images, io.Discard, io.Discard, newFakePusher().push); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The first push is allowed immediately, and each of the others 50ms after the previous one.
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("Expected the pushes to be rate limited, but they took %v", elapsed)
+	}
+}
+
+func TestPushImageWithRetries_Cancelled(t *testing.T) {
+	defer func(backoff func(int) time.Duration) { pushRetryBackoff = backoff }(pushRetryBackoff)
+	pushRetryBackoff = func(int) time.Duration { return time.Hour }
+
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	push := func(ctx context.Context, img string, stdout io.Writer, stderr io.Writer) error {
+		attempts++
+		cancel()
+		return errors.New("denied")
+	}
+
+	// The backoff before the retry ends as soon as the context is done.
+	err := b.pushImageWithRetries(ctx, "myregistry.azurecr.io/app:v1", io.Discard, io.Discard, push)
+	if !errors.Is(err, context.Canceled) || !strings.Contains(err.Error(), "denied") {
+		t.Errorf("Expected the push to stop retrying with its last error, but got %v", err)
+	}
+	if attempts != 1 {
+		t.Errorf("Expected a single attempt, but got %d", attempts)
+	}
+}
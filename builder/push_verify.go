@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/pkg/errors"
+)
+
+const (
+	maxPushVerifyAttempts = 5
+)
+
+// pushVerifyBackoff returns how long to wait after a failed attempt to verify a pushed image.
+var pushVerifyBackoff = util.GetExponentialBackoff
+
+// verifyPushedImages verifies that each pushed image resolves in its registry, using the Task's credentials.
+func (b *Builder) verifyPushedImages(ctx context.Context, images []string, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) error {
+	remoteDigester, err := b.newPushRemoteDigest(registryCreds, credentials)
+	if err != nil {
+		return err
+	}
+	return verifyPushedImages(ctx, images, NewDockerStoreDigest(b.procManager, b.debug), remoteDigester)
+}
+
+// newPushRemoteDigest creates the remoteDigest which resolves the references pushed by push steps,
+// using the Task's credentials.
+func (b *Builder) newPushRemoteDigest(registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) (*remoteDigest, error) {
+	return NewRemoteDigestWithOptions(registryCreds, b.registryDigestOptions(credentials))
+}
+
+// verifyPushedImages verifies that each image resolves using remote to the digest local reports for it.
+// If local doesn't know the image's digest, the image only has to resolve. Registries may take a moment
+// to serve a manifest after it's pushed, so an image which isn't found or resolves to another digest is
+// retried with backoff, whereas any other error fails the verification immediately.
+func verifyPushedImages(ctx context.Context, images []string, local DigestHelper, remote DigestHelper) error {
+	for _, img := range images {
+		pushed, err := scan.NewImageReference(util.NormalizeImageTag(img))
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse the pushed image %s", img)
+		}
+		if err := local.PopulateDigest(ctx, pushed); err != nil {
+			return errors.Wrapf(err, "failed to get the digest of the pushed image %s", img)
+		}
+
+		var notFound bool
+		var resolved string
+		for attempt := 0; attempt < maxPushVerifyAttempts; attempt++ {
+			if attempt > 0 {
+				select {
+				case <-ctx.Done():
+					return errors.Wrapf(ctx.Err(), "failed to verify the pushed image %s", img)
+				case <-time.After(pushVerifyBackoff(attempt - 1)):
+				}
+			}
+
+			ref := *pushed
+			ref.Digest = ""
+			err := remote.PopulateDigest(ctx, &ref)
+			if err != nil && !errdefs.IsNotFound(err) {
+				return errors.Wrapf(err, "failed to verify the pushed image %s", img)
+			}
+			notFound = err != nil
+			resolved = ref.Digest
+			if !notFound && (pushed.Digest == "" || resolved == pushed.Digest) {
+				util.Infof("Verified the pushed image: %s (digest: %s)\n", img, resolved)
+				break
+			}
+			if notFound {
+				util.Infof("Pushed image %s isn't available yet, attempt %d\n", img, attempt+1)
+			} else {
+				util.Infof("Pushed image %s resolves to %s instead of %s, attempt %d\n", img, resolved, pushed.Digest, attempt+1)
+			}
+			if attempt == maxPushVerifyAttempts-1 {
+				if notFound {
+					return fmt.Errorf("pushed image %s is absent from the registry after %d attempts", img, maxPushVerifyAttempts)
+				}
+				return fmt.Errorf("pushed image %s resolves to %s instead of the pushed digest %s after %d attempts", img, resolved, pushed.Digest, maxPushVerifyAttempts)
+			}
+		}
+	}
+	return nil
+}
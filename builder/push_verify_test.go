@@ -0,0 +1,155 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+)
+
+// sequenceDigest is a DigestHelper which populates the digests in order, one per call.
+// An empty digest fails the call with a not found error.
+type sequenceDigest struct {
+	digests []string
+	calls   int
+}
+
+func (d *sequenceDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	dgst := d.digests[d.calls]
+	d.calls++
+	if dgst == "" {
+		return fmt.Errorf("%s: %w", ref.Reference, errdefs.ErrNotFound)
+	}
+	ref.Digest = dgst
+	return nil
+}
+
+func TestVerifyPushedImages(t *testing.T) {
+	defer func(backoff func(int) time.Duration) { pushVerifyBackoff = backoff }(pushVerifyBackoff)
+	pushVerifyBackoff = func(int) time.Duration { return time.Millisecond }
+
+	tests := []struct {
+		name     string
+		local    string
+		remote   []string
+		calls    int
+		errorMsg string
+	}{
+		{"resolves immediately", "sha256:a", []string{"sha256:a"}, 1, ""},
+		{"unknown local digest", "", []string{"sha256:b"}, 1, ""},
+		{"eventually consistent", "sha256:a", []string{"", "sha256:old", "sha256:a"}, 3, ""},
+		{"absent", "sha256:a", []string{"", "", "", "", ""}, 5, "is absent from the registry after 5 attempts"},
+		{"mismatch", "sha256:a", []string{"sha256:old", "sha256:old", "sha256:old", "sha256:old", "sha256:old"}, 5, "instead of the pushed digest sha256:a"},
+	}
+
+	for _, test := range tests {
+		remote := &sequenceDigest{digests: test.remote}
+		err := verifyPushedImages(context.Background(), []string{"example.azurecr.io/app:v1"}, &staticDigest{digest: test.local}, remote)
+		if test.errorMsg == "" && err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if test.errorMsg != "" && (err == nil || !strings.Contains(err.Error(), test.errorMsg)) {
+			t.Errorf("%s: expected an error containing %q, but got %v", test.name, test.errorMsg, err)
+		}
+		if remote.calls != test.calls {
+			t.Errorf("%s: expected %d attempts, but got %d", test.name, test.calls, remote.calls)
+		}
+	}
+}
+
+func TestVerifyPushedImages_RemoteDigest(t *testing.T) {
+	defer func(backoff func(int) time.Duration) { pushVerifyBackoff = backoff }(pushVerifyBackoff)
+	pushVerifyBackoff = func(int) time.Duration { return time.Millisecond }
+
+	registry := newFakeRegistry()
+	registry.username, registry.password = "user", "secret"
+	dgst := registry.addManifest("app", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	credentials := func(password string) graph.RegistryLoginCredentials {
+		return graph.RegistryLoginCredentials{
+			host: {
+				Username: &secretmgmt.Secret{ResolvedValue: "user"},
+				Password: &secretmgmt.Secret{ResolvedValue: password},
+			},
+		}
+	}
+	local := &staticDigest{digest: dgst.String()}
+
+	if err := verifyPushedImages(context.Background(), []string{host + "/app:v1"}, local, NewRemoteDigest(credentials("secret"))); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	err := verifyPushedImages(context.Background(), []string{host + "/app:v2"}, local, NewRemoteDigest(credentials("secret")))
+	if err == nil || !strings.Contains(err.Error(), "is absent from the registry") {
+		t.Errorf("Expected the missing image to be absent, but got %v", err)
+	}
+	err = verifyPushedImages(context.Background(), []string{host + "/app:v1"}, local, NewRemoteDigest(credentials("wrong")))
+	if err == nil || strings.Contains(err.Error(), "attempts") {
+		t.Errorf("Expected rejected credentials to fail without retrying, but got %v", err)
+	}
+}
+
+func TestNewPushRemoteDigest_ResolvesAsIs(t *testing.T) {
+	registry := newFakeRegistry()
+	dgst := registry.addManifest("app", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	// The options which only apply to base images don't affect the pushed references.
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetRemoteDigestOptions(&RemoteDigestOptions{
+		PreferredPlatforms:  []string{"linux/arm64"},
+		ReferenceMutator:    func(ref *image.Reference) { ref.Repository = "team/" + ref.Repository },
+		ProxyCaches:         []*ProxyCache{{Upstream: host, Registry: "cache.invalid"}},
+		PreferOCIMediaTypes: true,
+	})
+	remote, err := b.newPushRemoteDigest(nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	ref := &image.Reference{Reference: host + "/app:v1", Registry: host, Repository: "app", Tag: "v1"}
+	if err := remote.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if ref.Digest != dgst.String() {
+		t.Errorf("Expected the digest %s but got %s", dgst, ref.Digest)
+	}
+}
+
+func TestNewPushRemoteDigest_AccessOptions(t *testing.T) {
+	limiter, err := NewRegistryLimiter(RegistryLimits{MaxConcurrency: 1})
+	if err != nil {
+		t.Fatalf("Failed to create the limiter: %v", err)
+	}
+	allowlist, err := NewRegistryAllowlist([]string{"*.azurecr.io"})
+	if err != nil {
+		t.Fatalf("Failed to create the allowlist: %v", err)
+	}
+	client := NewRemoteDigestClient(nil)
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetRemoteDigestOptions(&RemoteDigestOptions{
+		Client:             client,
+		RequireCredentials: true,
+		Limiter:            limiter,
+		RegistryAllowlist:  allowlist,
+	})
+	remote, err := b.newPushRemoteDigest(nil, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if remote.client != client || !remote.requireCredentials || remote.limiter != limiter || remote.registryAllowlist != allowlist {
+		t.Errorf("Expected the pushed references to be resolved with the builder's client, credential requirement, limiter and allowlist")
+	}
+}
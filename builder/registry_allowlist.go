@@ -0,0 +1,122 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+// RegistryAllowlist is the set of registries which may be contacted, to resolve digests, pull, push, or log in.
+type RegistryAllowlist struct {
+	patterns []string
+}
+
+// NewRegistryAllowlist creates a RegistryAllowlist from the registries, e.g. myregistry.azurecr.io, which may be
+// wildcards such as *.azurecr.io, or * for all registries. Docker Hub can be allowed by any of its names, e.g. docker.io.
+func NewRegistryAllowlist(registries []string) (*RegistryAllowlist, error) {
+	a := &RegistryAllowlist{patterns: make([]string, 0, len(registries))}
+	for _, registry := range registries {
+		pattern := normalizeAllowedRegistry(registry)
+		if pattern == "" || strings.ContainsAny(pattern, "/ ") || (pattern != "*" && strings.Contains(strings.TrimPrefix(pattern, "*."), "*")) {
+			return nil, fmt.Errorf("invalid allowed registry '%s', expected a registry such as myregistry.azurecr.io, a wildcard such as *.azurecr.io, or *", registry)
+		}
+		a.patterns = append(a.patterns, pattern)
+	}
+	return a, nil
+}
+
+// normalizeAllowedRegistry lowercases the registry and normalizes Docker Hub's names to DockerHubRegistry.
+func normalizeAllowedRegistry(registry string) string {
+	registry = strings.ToLower(strings.TrimSpace(registry))
+	if image.IsDockerHubRegistry(registry) {
+		return DockerHubRegistry
+	}
+	return registry
+}
+
+// Check returns a policy violation error naming the registry if it may not be contacted.
+// A nil RegistryAllowlist allows every registry.
+func (a *RegistryAllowlist) Check(registry string) error {
+	if a == nil {
+		return nil
+	}
+	if _, ok := graph.MatchRegistry(normalizeAllowedRegistry(registry), a.patterns); !ok {
+		return fmt.Errorf("policy violation: registry '%s' isn't in the allowlist of registries which may be contacted", registry)
+	}
+	return nil
+}
+
+// CheckImage is like Check for the registry of the image, e.g. myregistry.azurecr.io/app:v1.
+func (a *RegistryAllowlist) CheckImage(img string) error {
+	if a == nil {
+		return nil
+	}
+	ref, err := scan.NewImageReference(util.NormalizeImageTag(img))
+	if err != nil {
+		return errors.Wrapf(err, "failed to get the registry of image %s", img)
+	}
+	if IsNoBaseImage(ref) {
+		return nil
+	}
+	if err := a.Check(ref.Registry); err != nil {
+		return errors.Wrapf(err, "image %s can't be used", img)
+	}
+	return nil
+}
+
+// registryAllowlist returns the allowlist of registries the Builder may contact, if any.
+func (b *Builder) registryAllowlist() *RegistryAllowlist {
+	if b.remoteDigestOptions == nil {
+		return nil
+	}
+	return b.remoteDigestOptions.RegistryAllowlist
+}
+
+// checkStepRegistries verifies that the images the step runs and pushes are in allowed registries.
+func (b *Builder) checkStepRegistries(step *graph.Step) error {
+	allowlist := b.registryAllowlist()
+	if allowlist == nil {
+		return nil
+	}
+	var images []string
+	switch {
+	case step.IsCmdStep():
+		images = []string{util.ParseImageName(step.Cmd)}
+	case step.IsPushStep():
+		images = step.Push
+	}
+	for _, img := range images {
+		if err := allowlist.CheckImage(img); err != nil {
+			return errors.Wrapf(err, "step ID: %s", step.ID)
+		}
+	}
+	return nil
+}
+
+// checkDependencyRegistries verifies that the base images of the images built by a step are in allowed
+// registries, before the images are built and their base images are pulled.
+func (b *Builder) checkDependencyRegistries(step *graph.Step) error {
+	allowlist := b.registryAllowlist()
+	if allowlist == nil {
+		return nil
+	}
+	for _, deps := range step.ImageDependencies {
+		for _, ref := range append([]*image.Reference{deps.Runtime}, deps.Buildtime...) {
+			if ref == nil || IsNoBaseImage(ref) {
+				continue
+			}
+			if err := allowlist.Check(ref.Registry); err != nil {
+				return errors.Wrapf(err, "the base image %s of step ID: %s can't be used", ref.Reference, step.ID)
+			}
+		}
+	}
+	return nil
+}
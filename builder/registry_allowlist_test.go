@@ -0,0 +1,154 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/containerd/containerd/images"
+)
+
+func TestRegistryAllowlist_Check(t *testing.T) {
+	tests := []struct {
+		allowed  []string
+		registry string
+		expected bool
+	}{
+		{[]string{"myregistry.azurecr.io"}, "myregistry.azurecr.io", true},
+		{[]string{"myregistry.azurecr.io"}, "MyRegistry.azurecr.io", true},
+		{[]string{"myregistry.azurecr.io"}, "other.azurecr.io", false},
+		{[]string{"*.azurecr.io"}, "myregistry.azurecr.io", true},
+		{[]string{"*.azurecr.io"}, "azurecr.io", false},
+		{[]string{"*.azurecr.io"}, "myregistry.azurecr.io.example.com", false},
+		{[]string{"*"}, "example.com", true},
+		{[]string{"docker.io"}, DockerHubRegistry, true},
+		{[]string{DockerHubRegistry}, "index.docker.io", true},
+		{[]string{"localhost:5000"}, "localhost:5000", true},
+		{[]string{"localhost:5000"}, "localhost:5001", false},
+		{[]string{}, "myregistry.azurecr.io", false},
+	}
+	for _, test := range tests {
+		a, err := NewRegistryAllowlist(test.allowed)
+		if err != nil {
+			t.Fatalf("Unexpected error creating the allowlist %v: %v", test.allowed, err)
+		}
+		err = a.Check(test.registry)
+		if actual := err == nil; actual != test.expected {
+			t.Errorf("Expected %s to be allowed by %v: %v, but got %v", test.registry, test.allowed, test.expected, actual)
+		}
+		if err != nil && (!strings.Contains(err.Error(), "policy violation") || !strings.Contains(err.Error(), test.registry)) {
+			t.Errorf("Expected a policy violation naming %s, but got: %v", test.registry, err)
+		}
+	}
+}
+
+func TestRegistryAllowlist_Nil(t *testing.T) {
+	var a *RegistryAllowlist
+	if err := a.Check("myregistry.azurecr.io"); err != nil {
+		t.Errorf("Expected a nil allowlist to allow every registry, but got: %v", err)
+	}
+	if err := a.CheckImage("myregistry.azurecr.io/app:v1"); err != nil {
+		t.Errorf("Expected a nil allowlist to allow every image, but got: %v", err)
+	}
+}
+
+func TestNewRegistryAllowlist_Invalid(t *testing.T) {
+	for _, registry := range []string{"", " ", "myregistry.azurecr.io/app", "my*.azurecr.io", "*.*.azurecr.io", "my registry"} {
+		if _, err := NewRegistryAllowlist([]string{registry}); err == nil {
+			t.Errorf("Expected an error for the allowed registry '%s'", registry)
+		}
+	}
+}
+
+func TestRegistryAllowlist_CheckImage(t *testing.T) {
+	a, err := NewRegistryAllowlist([]string{"*.azurecr.io", "docker.io"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating the allowlist: %v", err)
+	}
+	tests := []struct {
+		image    string
+		expected bool
+	}{
+		{"myregistry.azurecr.io/app:v1", true},
+		{"golang:1.21", true},
+		{"bitnami/redis", true},
+		{"scratch", true},
+		{"gcr.io/distroless/base", false},
+		{"localhost:5000/app", false},
+	}
+	for _, test := range tests {
+		err := a.CheckImage(test.image)
+		if actual := err == nil; actual != test.expected {
+			t.Errorf("Expected %s to be allowed: %v, but got %v (%v)", test.image, test.expected, actual, err)
+		}
+	}
+}
+
+func TestRemoteDigest_RegistryAllowlist(t *testing.T) {
+	registry := newFakeRegistry()
+	registry.addManifest("library/hello", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	tests := []struct {
+		allowed  []string
+		expected bool
+	}{
+		{[]string{host}, true},
+		{[]string{"*"}, true},
+		{[]string{"*.azurecr.io"}, false},
+	}
+	for _, test := range tests {
+		allowlist, err := NewRegistryAllowlist(test.allowed)
+		if err != nil {
+			t.Fatalf("Unexpected error creating the allowlist %v: %v", test.allowed, err)
+		}
+		transport := &countingTransport{}
+		d, err := NewRemoteDigestWithOptions(nil, &RemoteDigestOptions{Client: &http.Client{Transport: transport}, RegistryAllowlist: allowlist})
+		if err != nil {
+			t.Fatalf("Failed to create remote digest: %v", err)
+		}
+		ref := &image.Reference{Registry: host, Repository: "library/hello", Tag: "v1", Reference: host + "/library/hello:v1"}
+		err = d.PopulateDigest(context.Background(), ref)
+		if actual := err == nil; actual != test.expected {
+			t.Errorf("Expected %s to be resolved with the allowlist %v: %v, but got %v (%v)", host, test.allowed, test.expected, actual, err)
+		}
+		if !test.expected && transport.requests != 0 {
+			t.Errorf("Expected no requests to %s, which isn't allowed, but got %d", host, transport.requests)
+		}
+	}
+}
+
+func TestCheckStepRegistries(t *testing.T) {
+	allowlist, err := NewRegistryAllowlist([]string{"myregistry.azurecr.io"})
+	if err != nil {
+		t.Fatalf("Unexpected error creating the allowlist: %v", err)
+	}
+	b := &Builder{remoteDigestOptions: &RemoteDigestOptions{RegistryAllowlist: allowlist}}
+	tests := []struct {
+		step     *graph.Step
+		expected bool
+	}{
+		{&graph.Step{ID: "cmd", Cmd: "myregistry.azurecr.io/app:v1 --flag"}, true},
+		{&graph.Step{ID: "cmd", Cmd: "gcr.io/app:v1"}, false},
+		{&graph.Step{ID: "push", Push: []string{"myregistry.azurecr.io/app:v1"}}, true},
+		{&graph.Step{ID: "push", Push: []string{"myregistry.azurecr.io/app:v1", "other.azurecr.io/app:v1"}}, false},
+	}
+	for _, test := range tests {
+		err := b.checkStepRegistries(test.step)
+		if actual := err == nil; actual != test.expected {
+			t.Errorf("Expected step %v to be allowed: %v, but got %v (%v)", test.step, test.expected, actual, err)
+		}
+	}
+
+	b = &Builder{}
+	if err := b.checkStepRegistries(&graph.Step{ID: "cmd", Cmd: "gcr.io/app:v1"}); err != nil {
+		t.Errorf("Expected every registry to be allowed without an allowlist, but got: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"runtime"
+	"strings"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// defaultScriptShell is the shell used to run a script step if it doesn't specify one.
+	defaultScriptShell = "bash"
+
+	// scriptPreamble makes a script fail on the first failing command, unset variable or failing pipeline.
+	scriptPreamble = "set -euo pipefail\n"
+)
+
+// getScriptEntryPointAndCmd returns the entrypoint and command which run the step's script
+// in the image specified by its cmd, using the step's shell.
+func getScriptEntryPointAndCmd(step *graph.Step) (string, string, error) {
+	if runtime.GOOS == util.WindowsOS {
+		return "", "", errors.New("script steps are only supported on Linux")
+	}
+	shell := step.Shell
+	if shell == "" {
+		shell = defaultScriptShell
+	}
+	return shell, step.Cmd + " -c " + shellQuote(scriptPreamble+step.Script), nil
+}
+
+// shellQuote quotes s so that it's passed as a single argument by a POSIX shell,
+// without expanding any variables or escape sequences in it.
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
@@ -0,0 +1,95 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"os/exec"
+	"reflect"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/util"
+)
+
+func TestGetScriptEntryPointAndCmd(t *testing.T) {
+	if runtime.GOOS == util.WindowsOS {
+		t.Skip("script steps are only supported on Linux")
+	}
+
+	script := `greeting="hello 'world'"
+echo "$greeting from $NAME"
+for i in 1 2; do
+  echo "line $i: \$literal"
+done
+`
+	tests := []struct {
+		step               *graph.Step
+		expectedEntryPoint string
+	}{
+		{&graph.Step{ID: "a", Cmd: "ubuntu", Script: script}, "bash"},
+		{&graph.Step{ID: "a", Cmd: "ubuntu", Script: script, Shell: "/bin/zsh"}, "/bin/zsh"},
+	}
+
+	for _, test := range tests {
+		entryPoint, cmd, err := getScriptEntryPointAndCmd(test.step)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if entryPoint != test.expectedEntryPoint {
+			t.Errorf("Expected entrypoint %s but got %s", test.expectedEntryPoint, entryPoint)
+		}
+
+		// The command is appended to docker run, which is run by /bin/sh, so it must be
+		// split into the image, -c and the unmodified script.
+		out, err := exec.Command("/bin/sh", "-c", "set -- "+cmd+`; for arg in "$@"; do printf '%s\000' "$arg"; done`).Output()
+		if err != nil {
+			t.Fatalf("Failed to split the command: %v", err)
+		}
+		args := strings.Split(strings.TrimSuffix(string(out), "\x00"), "\x00")
+		expected := []string{"ubuntu", "-c", scriptPreamble + script}
+		if !reflect.DeepEqual(args, expected) {
+			t.Errorf("Expected the command to be split into %q, but got %q", expected, args)
+		}
+	}
+}
+
+func TestScriptStep_RunsMultiLineScript(t *testing.T) {
+	if runtime.GOOS == util.WindowsOS {
+		t.Skip("script steps are only supported on Linux")
+	}
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash isn't available")
+	}
+
+	step := &graph.Step{ID: "a", Cmd: "ubuntu", Script: `greeting="hello 'world'"
+echo "$greeting from $NAME"
+for i in 1 2; do
+  echo "line $i: \$literal"
+done
+`}
+	entryPoint, cmd, err := getScriptEntryPointAndCmd(step)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Replace the image with the entrypoint to run the script the way the container would.
+	run := exec.Command("/bin/sh", "-c", entryPoint+strings.TrimPrefix(cmd, step.Cmd))
+	run.Env = []string{"NAME=acb", "PATH=/usr/bin:/bin"}
+	out, err := run.CombinedOutput()
+	if err != nil {
+		t.Fatalf("Failed to run the script: %v, output: %s", err, out)
+	}
+	expected := "hello 'world' from acb\nline 1: $literal\nline 2: $literal\n"
+	if string(out) != expected {
+		t.Errorf("Expected output %q but got %q", expected, out)
+	}
+
+	// Unset variables fail the script.
+	run = exec.Command("/bin/sh", "-c", entryPoint+strings.TrimPrefix(cmd, step.Cmd))
+	run.Env = []string{"PATH=/usr/bin:/bin"}
+	if out, err := run.CombinedOutput(); err == nil {
+		t.Errorf("Expected the script to fail without NAME set, but got %q", out)
+	}
+}
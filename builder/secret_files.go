@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/volume"
+	"github.com/Azure/acr-builder/util"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// secretFilesMountPath is where a step's secret files are mounted.
+	secretFilesMountPath = "/run/acb/secrets"
+
+	// secretFilesVolumePrefix prefixes the names of the volumes holding secret files.
+	secretFilesVolumePrefix = "acb_secrets"
+
+	// secretFileEnvSuffix is appended to the name of a secret file to get the name
+	// of the environment variable containing its path.
+	secretFileEnvSuffix = "_FILE"
+
+	// secretFileMode is the mode of secret files, which are read-only, and readable by any user since the step's
+	// container may not run as root, the files' owner. Only the step's container mounts them.
+	secretFileMode os.FileMode = 0444
+)
+
+// createSecretFilesVolume creates an in-memory tmpfs volume containing a file for each of the step's
+// secret files and returns the name of the volume. The secrets are written through stdin so that
+// they're never passed as arguments or environment variables.
+func (b *Builder) createSecretFilesVolume(ctx context.Context, step *graph.Step) (string, error) {
+	if runtime.GOOS == util.WindowsOS {
+		return "", errors.New("secretFiles require a tmpfs volume and are only supported on Linux")
+	}
+	return b.createFilesVolume(ctx, secretFilesVolumePrefix, "secret file", secretFilesMountPath, secretFileMode, step.GetSecretFiles())
+}
+
+// createFilesVolume creates an in-memory tmpfs volume, named with the prefix, containing the files, which are
+// mapped from their names to their contents, and returns the name of the volume. The files are written
+// through stdin, by a container mounting the volume at mountPath, with the mode, while kind describes them in errors.
+func (b *Builder) createFilesVolume(ctx context.Context, prefix string, kind string, mountPath string, mode os.FileMode, files map[string]string) (string, error) {
+	volName := fmt.Sprintf("%s_%s", prefix, uuid.New())
+	args := []string{"docker", "volume", "create", "--driver", "local", "--opt", "type=tmpfs", "--opt", "device=tmpfs", "--opt", "o=mode=0700", volName}
+	var buf bytes.Buffer
+	if err := b.procManager.Run(ctx, args, nil, &buf, &buf, ""); err != nil {
+		return "", errors.Wrapf(err, "failed to create the %ss volume, %s", kind, buf.String())
+	}
+
+	for _, name := range sortedSecretFileNames(files) {
+		args := []string{"docker", "run", "--rm", "-i", "--volume", volName + ":" + mountPath, configImageName, "-c", writeFileCommand(path.Join(mountPath, name), mode)}
+		buf.Reset()
+		if err := b.procManager.Run(ctx, args, strings.NewReader(files[name]), &buf, &buf, ""); err != nil {
+			b.deleteFilesVolume(ctx, volName)
+			return "", errors.Wrapf(err, "failed to write the %s %s, %s", kind, name, buf.String())
+		}
+	}
+	return volName, nil
+}
+
+// writeFileCommand returns the shell command writing its stdin to the file with the mode. The file is created
+// only readable by its owner, so it's never more accessible than the mode while it's written.
+func writeFileCommand(file string, mode os.FileMode) string {
+	return fmt.Sprintf("umask 077 && cat > %s && chmod %04o %s", shellQuote(file), mode.Perm(), shellQuote(file))
+}
+
+// deleteFilesVolume deletes a volume created by createFilesVolume.
+func (b *Builder) deleteFilesVolume(ctx context.Context, volName string) {
+	args := []string{"docker", "volume", "rm", "--force", volName}
+	var buf bytes.Buffer
+	if err := b.procManager.Run(ctx, args, nil, &buf, &buf, ""); err != nil {
+		log.Printf("Failed to delete the volume %s, %s. Err: %v\n", volName, buf.String(), err)
+	}
+}
+
+// getSecretFileEnvs returns an environment variable containing the path of each of the step's secret files,
+// e.g. DB_PASSWORD_FILE=/run/acb/secrets/DB_PASSWORD.
+func getSecretFileEnvs(step *graph.Step) []string {
+	var envs []string
+	for _, name := range sortedSecretFileNames(step.GetSecretFiles()) {
+		envs = append(envs, name+secretFileEnvSuffix+"="+path.Join(secretFilesMountPath, name))
+	}
+	return envs
+}
+
+// withSecretFiles returns a copy of the step which mounts the secret files volume read-only
+// and exposes the path of each secret file through an environment variable.
+func withSecretFiles(step *graph.Step, volName string) *graph.Step {
+	s := *step
+	s.Mounts = append(append([]*volume.Mount{}, step.Mounts...), &volume.Mount{Name: volName, MountPath: secretFilesMountPath + ":ro"})
+	s.Envs = append(append([]string{}, step.Envs...), getSecretFileEnvs(step)...)
+	return &s
+}
+
+func sortedSecretFileNames(secretFiles map[string]string) []string {
+	names := make([]string, 0, len(secretFiles))
+	for name := range secretFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/volume"
+)
+
+func TestWithSecretFiles(t *testing.T) {
+	step := &graph.Step{
+		ID:          "a",
+		Cmd:         "bash",
+		Envs:        []string{"FOO=bar"},
+		Mounts:      []*volume.Mount{{Name: "data", MountPath: "/data"}},
+		SecretFiles: []string{"TOKEN=abc", "DB_PASSWORD=def"},
+	}
+
+	actual := withSecretFiles(step, "acb_secrets_1")
+
+	expectedEnvs := []string{
+		"FOO=bar",
+		"DB_PASSWORD_FILE=/run/acb/secrets/DB_PASSWORD",
+		"TOKEN_FILE=/run/acb/secrets/TOKEN",
+	}
+	if !reflect.DeepEqual(actual.Envs, expectedEnvs) {
+		t.Errorf("Expected envs %v but got %v", expectedEnvs, actual.Envs)
+	}
+	expectedMounts := []*volume.Mount{
+		{Name: "data", MountPath: "/data"},
+		{Name: "acb_secrets_1", MountPath: "/run/acb/secrets:ro"},
+	}
+	if !reflect.DeepEqual(actual.Mounts, expectedMounts) {
+		t.Errorf("Expected mounts %v but got %v", expectedMounts, actual.Mounts)
+	}
+
+	// The original step must be left untouched, since it's shared with the task.
+	if len(step.Envs) != 1 || len(step.Mounts) != 1 {
+		t.Errorf("Expected the original step to be unchanged but got envs %v and mounts %v", step.Envs, step.Mounts)
+	}
+}
+
+func TestWriteFileCommand(t *testing.T) {
+	expected := "umask 077 && cat > '/run/acb/secrets/TOKEN' && chmod 0444 '/run/acb/secrets/TOKEN'"
+	if actual := writeFileCommand("/run/acb/secrets/TOKEN", secretFileMode); actual != expected {
+		t.Errorf("Expected the command %s but got %s", expected, actual)
+	}
+}
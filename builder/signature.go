@@ -0,0 +1,650 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/util"
+	"github.com/containerd/containerd/errdefs"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+)
+
+const (
+	// cosignSignatureTagSuffix suffixes the tag cosign stores the signatures of a digest under, e.g. sha256-<hex>.sig.
+	cosignSignatureTagSuffix = ".sig"
+
+	// cosignSignatureMediaType is the media type of the layers of a signature manifest, each a signed payload.
+	cosignSignatureMediaType = "application/vnd.dev.cosign.simplesigning.v1+json"
+
+	// cosignSignatureType is the type of the payloads signing container images.
+	cosignSignatureType = "cosign container image signature"
+
+	// The annotations of a signature layer, with the base64 encoded signature of its payload and,
+	// for keyless signatures, the PEM encoded signing certificate, its chain and the Rekor bundle.
+	cosignSignatureAnnotation   = "dev.cosignproject.cosign/signature"
+	cosignCertificateAnnotation = "dev.sigstore.cosign/certificate"
+	cosignChainAnnotation       = "dev.sigstore.cosign/chain"
+	cosignBundleAnnotation      = "dev.sigstore.cosign/bundle"
+
+	// rekorHashedRekordKind is the kind of the Rekor entries logging the signature of a hashed payload.
+	rekorHashedRekordKind = "hashedrekord"
+)
+
+var (
+	// fulcioIssuerOID and fulcioIssuerV2OID are the extensions of Fulcio certificates recording the OIDC issuer
+	// which authenticated the signer, as a raw string or a DER encoded UTF8String respectively.
+	fulcioIssuerOID   = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 1}
+	fulcioIssuerV2OID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 57264, 1, 8}
+)
+
+// KeylessIdentity is a signer trusted to sign base images with a keyless signature, i.e. using a short-lived
+// certificate issued by Fulcio after the signer authenticated to Issuer.
+type KeylessIdentity struct {
+	// Issuer is the OIDC issuer the signer authenticated to, e.g. https://token.actions.githubusercontent.com.
+	Issuer string
+
+	// Identity is the email address or URI of the signer, e.g. the workflow which signed the image.
+	Identity string
+}
+
+// ParseKeylessIdentity parses a KeylessIdentity in the format of 'issuer;identity'.
+func ParseKeylessIdentity(value string) (*KeylessIdentity, error) {
+	parts := strings.Split(value, ";")
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" || strings.TrimSpace(parts[1]) == "" {
+		return nil, fmt.Errorf("invalid keyless identity '%s', expected the format 'issuer;identity'", value)
+	}
+	return &KeylessIdentity{Issuer: strings.TrimSpace(parts[0]), Identity: strings.TrimSpace(parts[1])}, nil
+}
+
+func (i *KeylessIdentity) String() string {
+	return fmt.Sprintf("%s (issued by %s)", i.Identity, i.Issuer)
+}
+
+// SignaturePolicy is what the cosign signatures of base images are verified against. A base image is trusted
+// if it has a signature either made with one of Keys, or made keylessly by one of Identities with a certificate
+// chaining to Roots, whose signing time is proven by a Rekor entry signed with RekorPublicKey.
+type SignaturePolicy struct {
+	// Keys are the public keys trusted to sign base images, which are ECDSA, RSA or Ed25519 keys.
+	Keys []crypto.PublicKey
+
+	// Identities are the signers trusted to sign base images keylessly.
+	Identities []*KeylessIdentity
+
+	// Roots are the root CAs issuing the certificates of keyless signatures, e.g. Fulcio's.
+	Roots *x509.CertPool
+
+	// Intermediates are the intermediate CAs the certificates of keyless signatures may chain through.
+	Intermediates []*x509.Certificate
+
+	// RekorPublicKey is the public key of the Rekor transparency log, which signs the entries proving when
+	// keyless signatures were made.
+	RekorPublicKey crypto.PublicKey
+}
+
+// NewSignaturePolicy creates a SignaturePolicy trusting the PEM encoded public keys at keyPaths and the keyless
+// identities, each in the format of 'issuer;identity'. Keyless identities require the PEM encoded certificates
+// of the CAs at rootsPath, in which self-signed certificates are roots and the others intermediates, and the PEM
+// encoded public key of Rekor at rekorKeyPath. If neither keys nor identities are specified, nil is returned,
+// i.e. signatures aren't verified.
+func NewSignaturePolicy(keyPaths []string, identities []string, rootsPath string, rekorKeyPath string) (*SignaturePolicy, error) {
+	if len(keyPaths) == 0 && len(identities) == 0 {
+		if rootsPath != "" || rekorKeyPath != "" {
+			return nil, errors.New("the signature roots and the Rekor public key are only used to verify keyless signatures, which require a keyless identity")
+		}
+		return nil, nil
+	}
+	policy := &SignaturePolicy{}
+	for _, p := range keyPaths {
+		key, err := loadPublicKey(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid signature key %s", p)
+		}
+		policy.Keys = append(policy.Keys, key)
+	}
+	if len(identities) == 0 {
+		return policy, nil
+	}
+
+	for _, value := range identities {
+		identity, err := ParseKeylessIdentity(value)
+		if err != nil {
+			return nil, err
+		}
+		policy.Identities = append(policy.Identities, identity)
+	}
+	if rootsPath == "" || rekorKeyPath == "" {
+		return nil, errors.New("keyless identities require the signature roots and the Rekor public key")
+	}
+	data, err := ioutil.ReadFile(rootsPath)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read the signature roots")
+	}
+	certs, err := parsePEMCertificates(data)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid signature roots %s", rootsPath)
+	}
+	policy.Roots = x509.NewCertPool()
+	for _, cert := range certs {
+		if bytes.Equal(cert.RawIssuer, cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil {
+			policy.Roots.AddCert(cert)
+		} else {
+			policy.Intermediates = append(policy.Intermediates, cert)
+		}
+	}
+	if policy.RekorPublicKey, err = loadPublicKey(rekorKeyPath); err != nil {
+		return nil, errors.Wrapf(err, "invalid Rekor public key %s", rekorKeyPath)
+	}
+	return policy, nil
+}
+
+// loadPublicKey loads the PEM encoded public key at p.
+func loadPublicKey(p string) (crypto.PublicKey, error) {
+	data, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	return parsePublicKey(data)
+}
+
+// parsePublicKey parses a PEM encoded PKIX public key, which must be an ECDSA, RSA or Ed25519 key.
+func parsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PUBLIC KEY" {
+		return nil, errors.New("expected a PEM encoded PUBLIC KEY")
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to parse the public key")
+	}
+	switch key.(type) {
+	case *ecdsa.PublicKey, *rsa.PublicKey, ed25519.PublicKey:
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported public key type %T, expected an ECDSA, RSA or Ed25519 key", key)
+}
+
+// parsePEMCertificates parses each of the PEM encoded certificates in data, which must contain at least one.
+func parsePEMCertificates(data []byte) ([]*x509.Certificate, error) {
+	blocks, err := parseCACertificates(data)
+	if err != nil {
+		return nil, err
+	}
+	certs := make([]*x509.Certificate, 0, len(blocks))
+	for _, b := range blocks {
+		block, _ := pem.Decode(b)
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to parse the certificate")
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// cosignSignature is a signature of a cosign signature manifest.
+type cosignSignature struct {
+	// payload is the signed simple signing payload.
+	payload []byte
+
+	// signature, certificate, chain and bundle are the annotations of the payload's layer.
+	signature   string
+	certificate string
+	chain       string
+	bundle      string
+}
+
+// simpleSigningPayload is the payload signed by cosign, which identifies the signed image by its digest.
+type simpleSigningPayload struct {
+	Critical struct {
+		Image struct {
+			DockerManifestDigest string `json:"docker-manifest-digest"`
+		} `json:"image"`
+		Type string `json:"type"`
+	} `json:"critical"`
+}
+
+// rekorBundle is the Rekor entry proving when a keyless signature was made, signed by Rekor.
+type rekorBundle struct {
+	SignedEntryTimestamp []byte `json:"SignedEntryTimestamp"`
+	Payload              struct {
+		Body           string `json:"body"`
+		IntegratedTime int64  `json:"integratedTime"`
+		LogIndex       int64  `json:"logIndex"`
+		LogID          string `json:"logID"`
+	} `json:"Payload"`
+}
+
+// hashedRekord is the body of a hashedrekord Rekor entry, which logs a signature of a payload's hash.
+type hashedRekord struct {
+	Kind string `json:"kind"`
+	Spec struct {
+		Data struct {
+			Hash struct {
+				Algorithm string `json:"algorithm"`
+				Value     string `json:"value"`
+			} `json:"hash"`
+		} `json:"data"`
+		Signature struct {
+			Content string `json:"content"`
+		} `json:"signature"`
+	} `json:"spec"`
+}
+
+// verify verifies the signature signs dgst and is trusted by the policy.
+func (p *SignaturePolicy) verify(sig *cosignSignature, dgst digest.Digest) error {
+	var payload simpleSigningPayload
+	if err := json.Unmarshal(sig.payload, &payload); err != nil {
+		return errors.Wrap(err, "failed to decode the signed payload")
+	}
+	if payload.Critical.Type != cosignSignatureType {
+		return fmt.Errorf("the signed payload has type '%s', expected '%s'", payload.Critical.Type, cosignSignatureType)
+	}
+	if payload.Critical.Image.DockerManifestDigest != dgst.String() {
+		return fmt.Errorf("the signed payload is for %s", payload.Critical.Image.DockerManifestDigest)
+	}
+	rawSig, err := base64.StdEncoding.DecodeString(sig.signature)
+	if err != nil {
+		return errors.Wrap(err, "failed to decode the signature")
+	}
+
+	if sig.certificate != "" {
+		return p.verifyKeyless(sig, rawSig)
+	}
+	for _, key := range p.Keys {
+		if verifySignature(key, sig.payload, rawSig) == nil {
+			return nil
+		}
+	}
+	return errors.New("the signature isn't made with any of the trusted keys")
+}
+
+// verifyKeyless verifies the keyless signature was made by one of the trusted identities, with a certificate
+// chaining to the trusted roots which was valid when Rekor logged the signature.
+func (p *SignaturePolicy) verifyKeyless(sig *cosignSignature, rawSig []byte) error {
+	if len(p.Identities) == 0 {
+		return errors.New("the signature is keyless, but no keyless identities are trusted")
+	}
+	certs, err := parsePEMCertificates([]byte(sig.certificate))
+	if err != nil {
+		return errors.Wrap(err, "invalid signing certificate")
+	}
+	cert := certs[0]
+	integratedTime, err := p.verifyBundle(sig, rawSig)
+	if err != nil {
+		return err
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range p.Intermediates {
+		intermediates.AddCert(c)
+	}
+	if sig.chain != "" {
+		chain, err := parsePEMCertificates([]byte(sig.chain))
+		if err != nil {
+			return errors.Wrap(err, "invalid certificate chain")
+		}
+		for _, c := range chain {
+			intermediates.AddCert(c)
+		}
+	}
+	// Fulcio certificates are only valid for minutes, so they're verified as of when the signature was logged.
+	if _, err := cert.Verify(x509.VerifyOptions{
+		Roots:         p.Roots,
+		Intermediates: intermediates,
+		CurrentTime:   integratedTime,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+	}); err != nil {
+		return errors.Wrap(err, "the signing certificate isn't trusted")
+	}
+
+	issuer := fulcioIssuer(cert)
+	var identities []string
+	identities = append(identities, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identities = append(identities, uri.String())
+	}
+	trusted := false
+	for _, identity := range p.Identities {
+		for _, id := range identities {
+			if identity.Issuer == issuer && identity.Identity == id {
+				trusted = true
+			}
+		}
+	}
+	if !trusted {
+		return fmt.Errorf("the signature is made by %s (issued by %s), which isn't a trusted identity", strings.Join(identities, ", "), issuer)
+	}
+	if err := verifySignature(cert.PublicKey, sig.payload, rawSig); err != nil {
+		return errors.Wrap(err, "the signature doesn't match the signing certificate")
+	}
+	return nil
+}
+
+// verifyBundle verifies the signature's Rekor bundle is signed by Rekor and logs the signature of the payload,
+// returning when it was logged.
+func (p *SignaturePolicy) verifyBundle(sig *cosignSignature, rawSig []byte) (time.Time, error) {
+	if sig.bundle == "" {
+		return time.Time{}, errors.New("the keyless signature has no Rekor bundle proving when it was made")
+	}
+	var bundle rekorBundle
+	if err := json.Unmarshal([]byte(sig.bundle), &bundle); err != nil {
+		return time.Time{}, errors.Wrap(err, "failed to decode the Rekor bundle")
+	}
+	// The entry is signed in its canonical JSON form, whose keys are sorted like the keys of a marshaled map.
+	canonical, err := json.Marshal(map[string]interface{}{
+		"body":           bundle.Payload.Body,
+		"integratedTime": bundle.Payload.IntegratedTime,
+		"logIndex":       bundle.Payload.LogIndex,
+		"logID":          bundle.Payload.LogID,
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	if err := verifySignature(p.RekorPublicKey, canonical, bundle.SignedEntryTimestamp); err != nil {
+		return time.Time{}, errors.Wrap(err, "the Rekor bundle isn't signed by Rekor")
+	}
+
+	body, err := base64.StdEncoding.DecodeString(bundle.Payload.Body)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "failed to decode the Rekor entry")
+	}
+	var entry hashedRekord
+	if err := json.Unmarshal(body, &entry); err != nil {
+		return time.Time{}, errors.Wrap(err, "failed to decode the Rekor entry")
+	}
+	if entry.Kind != rekorHashedRekordKind {
+		return time.Time{}, fmt.Errorf("unsupported Rekor entry kind '%s', expected '%s'", entry.Kind, rekorHashedRekordKind)
+	}
+	hash := sha256.Sum256(sig.payload)
+	loggedSig, err := base64.StdEncoding.DecodeString(entry.Spec.Signature.Content)
+	if err != nil || !bytes.Equal(loggedSig, rawSig) || entry.Spec.Data.Hash.Algorithm != "sha256" || entry.Spec.Data.Hash.Value != hex.EncodeToString(hash[:]) {
+		return time.Time{}, errors.New("the Rekor entry doesn't log the signature of the payload")
+	}
+	return time.Unix(bundle.Payload.IntegratedTime, 0), nil
+}
+
+// fulcioIssuer returns the OIDC issuer recorded by a Fulcio certificate, empty if it doesn't record one.
+func fulcioIssuer(cert *x509.Certificate) string {
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerV2OID) {
+			var issuer string
+			if _, err := asn1.UnmarshalWithParams(ext.Value, &issuer, "utf8"); err == nil {
+				return issuer
+			}
+		}
+	}
+	for _, ext := range cert.Extensions {
+		if ext.Id.Equal(fulcioIssuerOID) {
+			return string(ext.Value)
+		}
+	}
+	return ""
+}
+
+// verifySignature verifies sig is the signature of message with key, using SHA-256 for ECDSA and RSA keys,
+// like cosign.
+func verifySignature(key crypto.PublicKey, message []byte, sig []byte) error {
+	hash := sha256.Sum256(message)
+	switch k := key.(type) {
+	case *ecdsa.PublicKey:
+		if !ecdsa.VerifyASN1(k, hash[:], sig) {
+			return errors.New("invalid ECDSA signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		return rsa.VerifyPKCS1v15(k, crypto.SHA256, hash[:], sig)
+	case ed25519.PublicKey:
+		if !ed25519.Verify(k, message, sig) {
+			return errors.New("invalid Ed25519 signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported public key type %T", key)
+}
+
+// cosignSignatures fetches the cosign signatures of dgst in ref's repository, which cosign stores in a manifest
+// tagged after the digest, e.g. sha256-<hex>.sig. It returns no signatures if the digest isn't signed.
+func (d *remoteDigest) cosignSignatures(ctx context.Context, ref *image.Reference, dgst digest.Digest) ([]*cosignSignature, error) {
+	sigRef := *ref
+	sigRef.Tag = dgst.Algorithm().String() + "-" + dgst.Encoded() + cosignSignatureTagSuffix
+	sigRef.Digest = ""
+	mutated := d.mutateReference(&sigRef)
+	if err := d.registryAllowlist.Check(mutated.Registry); err != nil {
+		return nil, err
+	}
+	resolveRef := d.throughProxyCache(mutated)
+	imageRef, err := getReferencePathWithDefaultTag(resolveRef, d.defaultTag)
+	if err != nil {
+		return nil, err
+	}
+	release, err := d.limiter.acquire(ctx, resolveRef.Registry)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resolver, name, desc, err := d.resolve(ctx, resolveRef, imageRef)
+	if err != nil {
+		if errdefs.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, errors.Wrapf(err, "failed to resolve the signatures of %s", dgst)
+	}
+	fetcher, err := resolver.Fetcher(ctx, name)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create a fetcher")
+	}
+	data, err := d.fetchVerified(ctx, fetcher.Fetch, desc)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to fetch the signature manifest %s", desc.Digest)
+	}
+	var manifest ocispec.Manifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode the signature manifest %s", desc.Digest)
+	}
+
+	var sigs []*cosignSignature
+	for _, layer := range manifest.Layers {
+		if layer.MediaType != cosignSignatureMediaType {
+			continue
+		}
+		payload, err := d.fetchVerified(ctx, fetcher.Fetch, layer)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to fetch the signed payload %s", layer.Digest)
+		}
+		sigs = append(sigs, &cosignSignature{
+			payload:     payload,
+			signature:   layer.Annotations[cosignSignatureAnnotation],
+			certificate: layer.Annotations[cosignCertificateAnnotation],
+			chain:       layer.Annotations[cosignChainAnnotation],
+			bundle:      layer.Annotations[cosignBundleAnnotation],
+		})
+	}
+	return sigs, nil
+}
+
+// fetchVerified fetches the content described by desc, up to the maximum manifest size, and verifies its digest.
+func (d *remoteDigest) fetchVerified(ctx context.Context, fetch func(context.Context, ocispec.Descriptor) (io.ReadCloser, error), desc ocispec.Descriptor) ([]byte, error) {
+	if desc.Size > d.maxManifestSize {
+		return nil, fmt.Errorf("%s is %d bytes, which exceeds the maximum manifest size of %d bytes", desc.Digest, desc.Size, d.maxManifestSize)
+	}
+	rc, err := fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(rc, d.maxManifestSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > d.maxManifestSize {
+		return nil, fmt.Errorf("%s exceeds the maximum manifest size of %d bytes", desc.Digest, d.maxManifestSize)
+	}
+	if err := desc.Digest.Validate(); err != nil || desc.Digest.Algorithm().FromBytes(data) != desc.Digest {
+		return nil, fmt.Errorf("the content doesn't match its digest %s", desc.Digest)
+	}
+	return data, nil
+}
+
+// indexOf returns the digest of the manifest list ref's tag resolves to, if it lists the platform manifest dgst,
+// so signatures of the manifest list, which cover its platform manifests, can be verified. Otherwise, it returns "".
+func (d *remoteDigest) indexOf(ctx context.Context, ref *image.Reference, dgst digest.Digest) (digest.Digest, error) {
+	tagged := *ref
+	tagged.Digest = ""
+	resolveRef := d.throughProxyCache(d.mutateReference(&tagged))
+	imageRef, err := getReferencePathWithDefaultTag(resolveRef, d.defaultTag)
+	if err != nil {
+		return "", err
+	}
+	release, err := d.limiter.acquire(ctx, resolveRef.Registry)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	resolver, name, desc, err := d.resolve(ctx, resolveRef, imageRef)
+	if err != nil {
+		return "", err
+	}
+	if !isIndexMediaType(desc.MediaType) || desc.Digest == dgst {
+		return "", nil
+	}
+	index, err := d.fetchIndex(ctx, resolver, name, desc)
+	if err != nil {
+		return "", err
+	}
+	for _, m := range index.Manifests {
+		if m.Digest == dgst {
+			return desc.Digest, nil
+		}
+	}
+	return "", nil
+}
+
+// verifyImageSignature verifies the image, whose digest is populated, has a signature trusted by the policy.
+// A platform manifest selected from a manifest list is also trusted if the manifest list has a trusted signature.
+func verifyImageSignature(ctx context.Context, policy *SignaturePolicy, remote *remoteDigest, ref *image.Reference) error {
+	dgst, err := digest.Parse(ref.Digest)
+	if err != nil {
+		return errors.Wrapf(err, "invalid digest %s", ref.Digest)
+	}
+	var problems []string
+	verified, err := verifyDigestSignatures(ctx, policy, remote, ref, dgst, &problems)
+	if err != nil || verified {
+		return err
+	}
+	if ref.Tag != "" {
+		index, err := remote.indexOf(ctx, ref, dgst)
+		if err != nil {
+			return errors.Wrap(err, "failed to resolve the manifest list of the platform manifest")
+		}
+		if index != "" {
+			if verified, err = verifyDigestSignatures(ctx, policy, remote, ref, index, &problems); err != nil || verified {
+				return err
+			}
+		}
+	}
+	if len(problems) == 0 {
+		return fmt.Errorf("%s isn't signed", dgst)
+	}
+	return fmt.Errorf("none of the signatures of %s is trusted: %s", dgst, strings.Join(problems, "; "))
+}
+
+// verifyDigestSignatures returns whether dgst has a signature trusted by the policy, adding the problems with
+// its untrusted signatures to problems.
+func verifyDigestSignatures(ctx context.Context, policy *SignaturePolicy, remote *remoteDigest, ref *image.Reference, dgst digest.Digest, problems *[]string) (bool, error) {
+	sigs, err := remote.cosignSignatures(ctx, ref, dgst)
+	if err != nil {
+		return false, err
+	}
+	for _, sig := range sigs {
+		if err := policy.verify(sig, dgst); err != nil {
+			*problems = append(*problems, err.Error())
+			continue
+		}
+		util.Debugf("Verified a signature of %s\n", dgst)
+		return true, nil
+	}
+	return false, nil
+}
+
+// SetSignaturePolicy sets the policy the cosign signatures of the base images of each build step are verified
+// against before building. A build step fails if any of its base images, other than scratch, has no signature
+// trusted by the policy. If nil, signatures aren't verified.
+func (b *Builder) SetSignaturePolicy(policy *SignaturePolicy) {
+	b.signaturePolicy = policy
+}
+
+// verifyBaseImageSignatures verifies that the base images of the build step's dependencies are signed as required
+// by the signature policy, if any. Their digests are those the step's Dockerfile was pinned to, see
+// populatePinnedBaseImages, so the images verified are the images built, and they aren't resolved again.
+func (b *Builder) verifyBaseImageSignatures(ctx context.Context, step *graph.Step, registryCreds graph.RegistryLoginCredentials, credentials []*graph.RegistryCredential) error {
+	if b.signaturePolicy == nil {
+		return nil
+	}
+	if b.skipDigests {
+		return fmt.Errorf("the signatures of the base images of step ID: %s can't be verified since digest resolution is disabled", step.ID)
+	}
+	helper, err := b.newBaseImageDigester(NewDockerStoreDigest(b.procManager, b.debug), true, registryCreds, credentials)
+	if err != nil {
+		return err
+	}
+	// Signatures are resolved like the base images they sign, through the reference mutator and proxy caches,
+	// but by digest, so there's no platform to select.
+	opts := RemoteDigestOptions{}
+	if b.remoteDigestOptions != nil {
+		opts = *b.remoteDigestOptions
+	}
+	opts.PreferredPlatforms = nil
+	opts.DefaultToHostPlatform = false
+	opts.CredentialSources = mergeCredentialSources(opts.CredentialSources, NewCredentialSources(credentials))
+	remote, err := NewRemoteDigestWithOptions(registryCreds, &opts)
+	if err != nil {
+		return err
+	}
+
+	timeout := time.Duration(digestsTimeoutInSec) * time.Second
+	verifyCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	baseImages, names, err := distinctBaseImages(step.ImageDependencies)
+	if err != nil {
+		return err
+	}
+	for i, baseImage := range baseImages {
+		resolved := *baseImage
+		if err := helper.PopulateDigest(verifyCtx, &resolved); err != nil {
+			return err
+		}
+		if resolved.Digest == "" {
+			return fmt.Errorf("the signature of the base image %s of step ID: %s can't be verified since its digest isn't known", names[i], step.ID)
+		}
+		if err := verifyImageSignature(verifyCtx, b.signaturePolicy, remote, &resolved); err != nil {
+			return errors.Wrapf(err, "failed to verify the signature of the base image %s of step ID: %s", names[i], step.ID)
+		}
+		util.Infof("Verified the signature of the base image %s@%s of step ID: %s\n", names[i], resolved.Digest, step.ID)
+	}
+	return nil
+}
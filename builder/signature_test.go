@@ -0,0 +1,408 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// newTestPayload returns a cosign payload signing dgst.
+func newTestPayload(dgst digest.Digest) []byte {
+	return []byte(fmt.Sprintf(`{"critical":{"identity":{"docker-reference":"example.com/app"},"image":{"docker-manifest-digest":"%s"},"type":"cosign container image signature"},"optional":null}`, dgst))
+}
+
+// signTestPayload signs the payload with the key like cosign.
+func signTestPayload(t *testing.T, key crypto.Signer, payload []byte) []byte {
+	var sig []byte
+	var err error
+	if _, ok := key.(ed25519.PrivateKey); ok {
+		sig, err = key.Sign(rand.Reader, payload, crypto.Hash(0))
+	} else {
+		hash := sha256.Sum256(payload)
+		sig, err = key.Sign(rand.Reader, hash[:], crypto.SHA256)
+	}
+	if err != nil {
+		t.Fatalf("Failed to sign the payload: %v", err)
+	}
+	return sig
+}
+
+func newTestECDSAKey(t *testing.T) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return key
+}
+
+// testFulcio issues keyless signing certificates, and logs their signatures in a Rekor bundle.
+type testFulcio struct {
+	root     *x509.Certificate
+	rootPEM  []byte
+	rootKey  *ecdsa.PrivateKey
+	rekorKey *ecdsa.PrivateKey
+}
+
+func newTestFulcio(t *testing.T) *testFulcio {
+	f := &testFulcio{rootKey: newTestECDSAKey(t), rekorKey: newTestECDSAKey(t)}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "acb-test-fulcio"},
+		NotBefore:             time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &f.rootKey.PublicKey, f.rootKey)
+	if err != nil {
+		t.Fatalf("Failed to create the root certificate: %v", err)
+	}
+	if f.root, err = x509.ParseCertificate(der); err != nil {
+		t.Fatalf("Failed to parse the root certificate: %v", err)
+	}
+	f.rootPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	return f
+}
+
+func (f *testFulcio) policy(identities ...*KeylessIdentity) *SignaturePolicy {
+	roots := x509.NewCertPool()
+	roots.AddCert(f.root)
+	return &SignaturePolicy{Identities: identities, Roots: roots, RekorPublicKey: &f.rekorKey.PublicKey}
+}
+
+// sign signs the payload keylessly as email, authenticated by issuer, with a certificate valid for 10 minutes
+// from issuedAt, and logs the signature at loggedAt.
+func (f *testFulcio) sign(t *testing.T, payload []byte, email string, issuer string, issuedAt time.Time, loggedAt time.Time) *cosignSignature {
+	key := newTestECDSAKey(t)
+	issuerValue, err := asn1.MarshalWithParams(issuer, "utf8")
+	if err != nil {
+		t.Fatalf("Failed to marshal the issuer: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		NotBefore:       issuedAt,
+		NotAfter:        issuedAt.Add(10 * time.Minute),
+		KeyUsage:        x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning},
+		EmailAddresses:  []string{email},
+		ExtraExtensions: []pkix.Extension{{Id: fulcioIssuerV2OID, Value: issuerValue}},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, f.root, &key.PublicKey, f.rootKey)
+	if err != nil {
+		t.Fatalf("Failed to create the signing certificate: %v", err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	sig := signTestPayload(t, key, payload)
+
+	hash := sha256.Sum256(payload)
+	body := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf(
+		`{"apiVersion":"0.0.1","kind":"hashedrekord","spec":{"data":{"hash":{"algorithm":"sha256","value":"%s"}},"signature":{"content":"%s","publicKey":{"content":"%s"}}}}`,
+		hex.EncodeToString(hash[:]), base64.StdEncoding.EncodeToString(sig), base64.StdEncoding.EncodeToString(certPEM))))
+	var bundle rekorBundle
+	bundle.Payload.Body = body
+	bundle.Payload.IntegratedTime = loggedAt.Unix()
+	bundle.Payload.LogIndex = 42
+	bundle.Payload.LogID = "c0d23d6ad406973f9559f3ba2d1ca01f84147d8ffc5b8445c224f98b9591801d"
+	canonical := fmt.Sprintf(`{"body":"%s","integratedTime":%d,"logID":"%s","logIndex":%d}`, body, bundle.Payload.IntegratedTime, bundle.Payload.LogID, bundle.Payload.LogIndex)
+	bundle.SignedEntryTimestamp = signTestPayload(t, f.rekorKey, []byte(canonical))
+	bundleJSON, err := json.Marshal(bundle)
+	if err != nil {
+		t.Fatalf("Failed to marshal the bundle: %v", err)
+	}
+
+	return &cosignSignature{
+		payload:     payload,
+		signature:   base64.StdEncoding.EncodeToString(sig),
+		certificate: string(certPEM),
+		bundle:      string(bundleJSON),
+	}
+}
+
+func TestSignaturePolicy_VerifyKey(t *testing.T) {
+	dgst := digest.FromString("image")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	untrusted := newTestECDSAKey(t)
+
+	for _, key := range []crypto.Signer{newTestECDSAKey(t), rsaKey, ed25519Key} {
+		policy := &SignaturePolicy{Keys: []crypto.PublicKey{untrusted.Public(), key.Public()}}
+		payload := newTestPayload(dgst)
+		sig := base64.StdEncoding.EncodeToString(signTestPayload(t, key, payload))
+
+		if err := policy.verify(&cosignSignature{payload: payload, signature: sig}, dgst); err != nil {
+			t.Errorf("%T: unexpected error verifying a signature made with a trusted key: %v", key, err)
+		}
+		if err := policy.verify(&cosignSignature{payload: payload, signature: sig}, digest.FromString("other")); err == nil || !strings.Contains(err.Error(), "the signed payload is for "+dgst.String()) {
+			t.Errorf("%T: expected a signature of another digest to fail, but got %v", key, err)
+		}
+		tampered := []byte(strings.Replace(string(payload), "example.com/app", "example.com/evil", 1))
+		if err := policy.verify(&cosignSignature{payload: tampered, signature: sig}, dgst); err == nil {
+			t.Errorf("%T: expected a signature of a tampered payload to fail", key)
+		}
+		untrustedPolicy := &SignaturePolicy{Keys: []crypto.PublicKey{untrusted.Public()}}
+		if err := untrustedPolicy.verify(&cosignSignature{payload: payload, signature: sig}, dgst); err == nil || !strings.Contains(err.Error(), "trusted keys") {
+			t.Errorf("%T: expected a signature made with an untrusted key to fail, but got %v", key, err)
+		}
+	}
+}
+
+func TestSignaturePolicy_VerifyKeyless(t *testing.T) {
+	dgst := digest.FromString("image")
+	payload := newTestPayload(dgst)
+	fulcio := newTestFulcio(t)
+	otherFulcio := newTestFulcio(t)
+	issuer := "https://token.actions.githubusercontent.com"
+	trusted := &KeylessIdentity{Issuer: issuer, Identity: "release@example.com"}
+	// Signing certificates are only valid for minutes, so they're verified as of when they're logged.
+	issuedAt := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	loggedAt := issuedAt.Add(time.Minute)
+
+	noBundle := fulcio.sign(t, payload, "release@example.com", issuer, issuedAt, loggedAt)
+	noBundle.bundle = ""
+	otherRekor := fulcio.policy(trusted)
+	otherRekor.RekorPublicKey = &otherFulcio.rekorKey.PublicKey
+
+	tests := []struct {
+		name     string
+		policy   *SignaturePolicy
+		sig      *cosignSignature
+		expected string
+	}{
+		{"trusted", fulcio.policy(trusted), fulcio.sign(t, payload, "release@example.com", issuer, issuedAt, loggedAt), ""},
+		{"untrusted identity", fulcio.policy(trusted), fulcio.sign(t, payload, "someone@example.com", issuer, issuedAt, loggedAt), "someone@example.com (issued by " + issuer + "), which isn't a trusted identity"},
+		{"untrusted issuer", fulcio.policy(trusted), fulcio.sign(t, payload, "release@example.com", "https://accounts.example.com", issuedAt, loggedAt), "which isn't a trusted identity"},
+		{"untrusted root", fulcio.policy(trusted), otherFulcio.sign(t, payload, "release@example.com", issuer, issuedAt, loggedAt), "isn't signed by Rekor"},
+		{"bundle signed by another Rekor", otherRekor, fulcio.sign(t, payload, "release@example.com", issuer, issuedAt, loggedAt), "isn't signed by Rekor"},
+		{"logged after the certificate expired", fulcio.policy(trusted), fulcio.sign(t, payload, "release@example.com", issuer, issuedAt, issuedAt.Add(time.Hour)), "the signing certificate isn't trusted"},
+		{"no bundle", fulcio.policy(trusted), noBundle, "no Rekor bundle"},
+		{"no trusted identities", &SignaturePolicy{}, fulcio.sign(t, payload, "release@example.com", issuer, issuedAt, loggedAt), "no keyless identities are trusted"},
+	}
+	for _, test := range tests {
+		err := test.policy.verify(test.sig, dgst)
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, but got %v", test.name, test.expected, err)
+		}
+	}
+
+	// The signature of another root is rejected by the certificate chain even if its bundle is trusted.
+	mixed := fulcio.policy(trusted)
+	mixed.RekorPublicKey = &otherFulcio.rekorKey.PublicKey
+	err := mixed.verify(otherFulcio.sign(t, payload, "release@example.com", issuer, issuedAt, loggedAt), dgst)
+	if err == nil || !strings.Contains(err.Error(), "the signing certificate isn't trusted") {
+		t.Errorf("Expected a certificate of an untrusted root to fail, but got %v", err)
+	}
+}
+
+// addTestSignatures adds a cosign signature manifest for dgst to the registry's repository.
+func addTestSignatures(t *testing.T, r *fakeRegistry, repository string, dgst digest.Digest, sigs ...*cosignSignature) {
+	manifest := ocispec.Manifest{MediaType: ocispec.MediaTypeImageManifest}
+	manifest.SchemaVersion = 2
+	config := []byte("{}")
+	manifest.Config = ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: digest.FromBytes(config), Size: int64(len(config))}
+	r.mu.Lock()
+	r.blobs[repository+"@"+manifest.Config.Digest.String()] = config
+	for _, sig := range sigs {
+		layer := ocispec.Descriptor{
+			MediaType:   cosignSignatureMediaType,
+			Digest:      digest.FromBytes(sig.payload),
+			Size:        int64(len(sig.payload)),
+			Annotations: map[string]string{cosignSignatureAnnotation: sig.signature},
+		}
+		if sig.certificate != "" {
+			layer.Annotations[cosignCertificateAnnotation] = sig.certificate
+			layer.Annotations[cosignBundleAnnotation] = sig.bundle
+		}
+		manifest.Layers = append(manifest.Layers, layer)
+		r.blobs[repository+"@"+layer.Digest.String()] = sig.payload
+	}
+	r.mu.Unlock()
+	content, err := json.Marshal(manifest)
+	if err != nil {
+		t.Fatalf("Failed to marshal the signature manifest: %v", err)
+	}
+	r.addManifest(repository, dgst.Algorithm().String()+"-"+dgst.Encoded()+cosignSignatureTagSuffix, ocispec.MediaTypeImageManifest, content)
+}
+
+func TestVerifyImageSignature(t *testing.T) {
+	trustedKey := newTestECDSAKey(t)
+	untrustedKey := newTestECDSAKey(t)
+	policy := &SignaturePolicy{Keys: []crypto.PublicKey{trustedKey.Public()}}
+	sign := func(key crypto.Signer, dgst digest.Digest) *cosignSignature {
+		payload := newTestPayload(dgst)
+		return &cosignSignature{payload: payload, signature: base64.StdEncoding.EncodeToString(signTestPayload(t, key, payload))}
+	}
+
+	registry := newFakeRegistry()
+	signed := registry.addManifest("library/signed", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"name":"signed"}`))
+	addTestSignatures(t, registry, "library/signed", signed, sign(untrustedKey, signed), sign(trustedKey, signed))
+	unsigned := registry.addManifest("library/unsigned", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"name":"unsigned"}`))
+	untrusted := registry.addManifest("library/untrusted", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"name":"untrusted"}`))
+	addTestSignatures(t, registry, "library/untrusted", untrusted, sign(untrustedKey, untrusted))
+	index, platformDigests := registry.addIndex(t, "library/multi", "v1", ocispec.Platform{OS: "linux", Architecture: "amd64"})
+	addTestSignatures(t, registry, "library/multi", index, sign(trustedKey, index))
+	host, stop := registry.start()
+	defer stop()
+
+	tests := []struct {
+		repository string
+		digest     digest.Digest
+		expected   string
+	}{
+		{"library/signed", signed, ""},
+		{"library/unsigned", unsigned, unsigned.String() + " isn't signed"},
+		{"library/untrusted", untrusted, "none of the signatures of " + untrusted.String() + " is trusted: the signature isn't made with any of the trusted keys"},
+		// A platform manifest is covered by the signature of its manifest list.
+		{"library/multi", platformDigests["linux/amd64"], ""},
+	}
+	remote := NewRemoteDigest(nil)
+	for _, test := range tests {
+		ref := &image.Reference{Registry: host, Repository: test.repository, Tag: "v1", Digest: test.digest.String(), Reference: host + "/" + test.repository + ":v1"}
+		err := verifyImageSignature(context.Background(), policy, remote, ref)
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.repository, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, but got %v", test.repository, test.expected, err)
+		}
+	}
+}
+
+func TestVerifyBaseImageSignatures_Pinned(t *testing.T) {
+	key := newTestECDSAKey(t)
+	registry := newFakeRegistry()
+	signed := registry.addManifest("library/app", "v0", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"name":"signed"}`))
+	payload := newTestPayload(signed)
+	addTestSignatures(t, registry, "library/app", signed, &cosignSignature{payload: payload, signature: base64.StdEncoding.EncodeToString(signTestPayload(t, key, payload))})
+	// The tag has moved to an unsigned image since the Dockerfile was pinned.
+	registry.addManifest("library/app", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2,"name":"unsigned"}`))
+	host, stop := registry.start()
+	defer stop()
+
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetSignaturePolicy(&SignaturePolicy{Keys: []crypto.PublicKey{key.Public()}})
+	newStep := func(dgst string) *graph.Step {
+		return &graph.Step{ID: "build", ImageDependencies: []*image.Dependencies{{
+			Runtime: &image.Reference{Registry: host, Repository: "library/app", Tag: "v1", Digest: dgst, Reference: host + "/library/app:v1"},
+		}}}
+	}
+
+	// The digest the Dockerfile was pinned to is verified, rather than whatever the tag resolves to now.
+	if err := b.verifyBaseImageSignatures(context.Background(), newStep(signed.String()), nil, nil); err != nil {
+		t.Errorf("Expected the pinned digest to be verified, but got %v", err)
+	}
+	if err := b.verifyBaseImageSignatures(context.Background(), newStep(""), nil, nil); err == nil || !strings.Contains(err.Error(), "isn't signed") {
+		t.Errorf("Expected the unpinned tag's image to fail verification, but got %v", err)
+	}
+}
+
+func TestNewSignaturePolicy(t *testing.T) {
+	dir := t.TempDir()
+	writeFile := func(name string, data []byte) string {
+		p := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(p, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", name, err)
+		}
+		return p
+	}
+	writeKey := func(name string, key crypto.PublicKey) string {
+		der, err := x509.MarshalPKIXPublicKey(key)
+		if err != nil {
+			t.Fatalf("Failed to marshal the key: %v", err)
+		}
+		return writeFile(name, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	}
+	fulcio := newTestFulcio(t)
+	keyPath := writeKey("cosign.pub", newTestECDSAKey(t).Public())
+	rekorPath := writeKey("rekor.pub", fulcio.rekorKey.Public())
+	rootsPath := writeFile("fulcio.pem", fulcio.rootPEM)
+	invalidKeyPath := writeFile("invalid.pub", fulcio.rootPEM)
+	identity := "https://token.actions.githubusercontent.com;https://github.com/org/repo/.github/workflows/release.yml@refs/heads/main"
+
+	policy, err := NewSignaturePolicy([]string{keyPath}, []string{identity}, rootsPath, rekorPath)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(policy.Keys) != 1 || len(policy.Identities) != 1 || policy.RekorPublicKey == nil || len(policy.Intermediates) != 0 {
+		t.Errorf("Expected a key, an identity, the Rekor key and a root, but got %+v", policy)
+	}
+	if policy.Identities[0].Issuer != "https://token.actions.githubusercontent.com" || policy.Identities[0].Identity != "https://github.com/org/repo/.github/workflows/release.yml@refs/heads/main" {
+		t.Errorf("Unexpected identity %v", policy.Identities[0])
+	}
+	if policy, err := NewSignaturePolicy(nil, nil, "", ""); policy != nil || err != nil {
+		t.Errorf("Expected no policy without keys and identities, but got %v, %v", policy, err)
+	}
+
+	tests := []struct {
+		name       string
+		keys       []string
+		identities []string
+		roots      string
+		rekor      string
+		expected   string
+	}{
+		{"identity without roots", nil, []string{identity}, "", rekorPath, "require the signature roots and the Rekor public key"},
+		{"identity without rekor", nil, []string{identity}, rootsPath, "", "require the signature roots and the Rekor public key"},
+		{"invalid identity", nil, []string{"release@example.com"}, rootsPath, rekorPath, "expected the format 'issuer;identity'"},
+		{"roots without identities", []string{keyPath}, nil, rootsPath, rekorPath, ""},
+		{"roots only", nil, nil, rootsPath, "", "require a keyless identity"},
+		{"invalid key", []string{invalidKeyPath}, nil, "", "", "expected a PEM encoded PUBLIC KEY"},
+		{"missing key", []string{filepath.Join(dir, "missing.pub")}, nil, "", "", "invalid signature key"},
+	}
+	for _, test := range tests {
+		_, err := NewSignaturePolicy(test.keys, test.identities, test.roots, test.rekor)
+		if test.expected == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", test.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, but got %v", test.name, test.expected, err)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// StepOutputRaw writes the output of steps as is, so the output of parallel steps interleaves.
+	StepOutputRaw = "raw"
+
+	// StepOutputPrefixed prefixes each line of a step's output with the step's ID as soon as the line is complete.
+	StepOutputPrefixed = "prefixed"
+
+	// StepOutputGrouped writes each step's complete output, prefixed with the step's ID, once the step completes.
+	StepOutputGrouped = "grouped"
+)
+
+// stepOutputColors are the ANSI colors of the step ID prefixes, assigned to steps in the order they start.
+var stepOutputColors = []string{"36", "33", "32", "35", "34", "31"}
+
+// StepOutput writes the output of the steps run by a Builder in one of the step output modes.
+type StepOutput struct {
+	mode   string
+	color  bool
+	stdout io.Writer
+	stderr io.Writer
+
+	// mu serializes writes, so the lines of parallel steps don't interleave.
+	mu     sync.Mutex
+	colors map[string]string
+}
+
+// NewStepOutput creates a StepOutput for the mode, i.e. raw, prefixed or grouped, which writes to stdout and stderr.
+// If color is true, the step ID prefixes are colored.
+func NewStepOutput(mode string, color bool, stdout io.Writer, stderr io.Writer) (*StepOutput, error) {
+	switch m := strings.ToLower(mode); m {
+	case StepOutputRaw, StepOutputPrefixed, StepOutputGrouped:
+		return &StepOutput{mode: m, color: color, stdout: stdout, stderr: stderr, colors: make(map[string]string)}, nil
+	default:
+		return nil, fmt.Errorf("invalid step output mode '%s', must be one of %s, %s or %s", mode, StepOutputRaw, StepOutputPrefixed, StepOutputGrouped)
+	}
+}
+
+// writers returns the writers of the step's standard output and error, and a function which must be
+// called once the step completes to write any of its output which hasn't been written yet.
+// A nil StepOutput writes the raw output to os.Stdout and os.Stderr.
+func (o *StepOutput) writers(id string) (stdout io.Writer, stderr io.Writer, flush func()) {
+	if o == nil {
+		return os.Stdout, os.Stderr, func() {}
+	}
+	switch o.mode {
+	case StepOutputPrefixed:
+		prefix := o.prefix(id)
+		stdoutLines := &lineWriter{output: o, out: o.stdout, prefix: prefix}
+		stderrLines := &lineWriter{output: o, out: o.stderr, prefix: prefix}
+		return stdoutLines, stderrLines, func() {
+			stdoutLines.flush()
+			stderrLines.flush()
+		}
+	case StepOutputGrouped:
+		// Both streams are buffered together so the order of their lines is kept.
+		group := &groupWriter{prefix: o.prefix(id)}
+		return group, group, func() {
+			o.mu.Lock()
+			defer o.mu.Unlock()
+			_, _ = o.stdout.Write(group.bytes())
+		}
+	default:
+		return o.stdout, o.stderr, func() {}
+	}
+}
+
+// prefix returns the prefix of each line of the step's output.
+func (o *StepOutput) prefix(id string) string {
+	if !o.color {
+		return "[" + id + "] "
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	color, ok := o.colors[id]
+	if !ok {
+		color = stepOutputColors[len(o.colors)%len(stepOutputColors)]
+		o.colors[id] = color
+	}
+	return "\x1b[" + color + "m[" + id + "]\x1b[0m "
+}
+
+// lineWriter writes each complete line written to it to out with the prefix, buffering incomplete lines.
+type lineWriter struct {
+	output *StepOutput
+	out    io.Writer
+	prefix string
+
+	mu      sync.Mutex
+	partial []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	i := bytes.LastIndexByte(w.partial, '\n')
+	if i < 0 {
+		return len(p), nil
+	}
+	lines := prefixLines(w.prefix, w.partial[:i+1])
+	w.partial = append(w.partial[:0], w.partial[i+1:]...)
+	if err := w.write(lines); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// flush writes the incomplete line, if any.
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.partial) == 0 {
+		return
+	}
+	_ = w.write(prefixLines(w.prefix, append(w.partial, '\n')))
+	w.partial = nil
+}
+
+func (w *lineWriter) write(lines []byte) error {
+	w.output.mu.Lock()
+	defer w.output.mu.Unlock()
+	_, err := w.out.Write(lines)
+	return err
+}
+
+// groupWriter buffers everything written to it until the step completes.
+type groupWriter struct {
+	prefix string
+
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (w *groupWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.buf.Write(p)
+}
+
+// bytes returns the buffered output with each line prefixed.
+func (w *groupWriter) bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	data := w.buf.Bytes()
+	if len(data) == 0 {
+		return nil
+	}
+	if data[len(data)-1] != '\n' {
+		data = append(data, '\n')
+	}
+	return prefixLines(w.prefix, data)
+}
+
+// prefixLines prefixes each line of data, which must end with a newline.
+func prefixLines(prefix string, data []byte) []byte {
+	var prefixed bytes.Buffer
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\n')
+		prefixed.WriteString(prefix)
+		prefixed.Write(data[:i+1])
+		data = data[i+1:]
+	}
+	return prefixed.Bytes()
+}
@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"os"
+	"testing"
+)
+
+func TestNewStepOutput(t *testing.T) {
+	for _, mode := range []string{"raw", "Prefixed", "GROUPED"} {
+		if _, err := NewStepOutput(mode, false, &bytes.Buffer{}, &bytes.Buffer{}); err != nil {
+			t.Errorf("Unexpected error for %s: %v", mode, err)
+		}
+	}
+	if _, err := NewStepOutput("interleaved", false, &bytes.Buffer{}, &bytes.Buffer{}); err == nil {
+		t.Error("Expected an error for an invalid mode")
+	}
+}
+
+func TestStepOutput_Prefixed(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	output, err := NewStepOutput(StepOutputPrefixed, false, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	buildOut, buildErr, flushBuild := output.writers("build")
+	testOut, _, flushTest := output.writers("test")
+	_, _ = buildOut.Write([]byte("Step 1/2"))
+	_, _ = testOut.Write([]byte("running\npass"))
+	_, _ = buildOut.Write([]byte(" : FROM alpine\nStep 2/2\n"))
+	_, _ = buildErr.Write([]byte("warning\n"))
+	if expected := "[test] running\n[build] Step 1/2 : FROM alpine\n[build] Step 2/2\n"; stdout.String() != expected {
+		t.Errorf("Expected the complete lines %q, but got %q", expected, stdout.String())
+	}
+	flushTest()
+	flushBuild()
+
+	if expected := "[test] running\n[build] Step 1/2 : FROM alpine\n[build] Step 2/2\n[test] pass\n"; stdout.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, stdout.String())
+	}
+	if expected := "[build] warning\n"; stderr.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, stderr.String())
+	}
+}
+
+func TestStepOutput_Grouped(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	output, err := NewStepOutput(StepOutputGrouped, false, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	buildOut, buildErr, flushBuild := output.writers("build")
+	testOut, _, flushTest := output.writers("test")
+	_, _ = buildOut.Write([]byte("Step 1/2\n"))
+	_, _ = testOut.Write([]byte("running\n"))
+	_, _ = buildErr.Write([]byte("warning\n"))
+	_, _ = buildOut.Write([]byte("Step 2/2"))
+	if stdout.Len() != 0 {
+		t.Errorf("Expected no output until the steps complete, but got %q", stdout.String())
+	}
+	flushTest()
+	flushBuild()
+
+	if expected := "[test] running\n[build] Step 1/2\n[build] warning\n[build] Step 2/2\n"; stdout.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, stdout.String())
+	}
+	if stderr.Len() != 0 {
+		t.Errorf("Expected standard error to be grouped with standard output, but got %q", stderr.String())
+	}
+}
+
+func TestStepOutput_Raw(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	output, err := NewStepOutput(StepOutputRaw, true, &stdout, &stderr)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	out, errOut, flush := output.writers("build")
+	_, _ = out.Write([]byte("Step 1/2"))
+	_, _ = errOut.Write([]byte("warning\n"))
+	flush()
+	if stdout.String() != "Step 1/2" || stderr.String() != "warning\n" {
+		t.Errorf("Expected the raw output, but got %q and %q", stdout.String(), stderr.String())
+	}
+
+	var nilOutput *StepOutput
+	if out, errOut, _ := nilOutput.writers("build"); out != os.Stdout || errOut != os.Stderr {
+		t.Error("Expected a nil StepOutput to write the raw output to os.Stdout and os.Stderr")
+	}
+}
+
+func TestStepOutput_Color(t *testing.T) {
+	var stdout bytes.Buffer
+	output, err := NewStepOutput(StepOutputPrefixed, true, &stdout, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	build, test := output.prefix("build"), output.prefix("test")
+	if build == test {
+		t.Errorf("Expected steps to be given different colors, but both got %q", build)
+	}
+	if again := output.prefix("build"); again != build {
+		t.Errorf("Expected a step to keep its color, but got %q and %q", build, again)
+	}
+	if expected := "\x1b[36m[build]\x1b[0m "; build != expected {
+		t.Errorf("Expected %q, but got %q", expected, build)
+	}
+}
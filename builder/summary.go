@@ -0,0 +1,259 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/pkg/errors"
+)
+
+const (
+	// SummaryFormatText logs the status of each step, grouped by stage if the Task uses stages.
+	SummaryFormatText = "text"
+
+	// SummaryFormatJSON writes the status of each step as a JSON object.
+	SummaryFormatJSON = "json"
+
+	// SummaryFormatJUnit writes each step as a JUnit XML test case, so CI systems can show the result of each step.
+	SummaryFormatJUnit = "junit"
+
+	// junitSuiteName names the test suite of a Task without a name.
+	junitSuiteName = "acb"
+)
+
+// SummaryFormatter writes the summary of a Task's steps at the end of a run.
+type SummaryFormatter interface {
+	Format(w io.Writer, task *graph.Task) error
+}
+
+// NewSummaryFormatter returns the built-in SummaryFormatter for the format, i.e. text, json or junit.
+func NewSummaryFormatter(format string) (SummaryFormatter, error) {
+	switch strings.ToLower(format) {
+	case "", SummaryFormatText:
+		return &textSummary{}, nil
+	case SummaryFormatJSON:
+		return &jsonSummary{}, nil
+	case SummaryFormatJUnit:
+		return &junitSummary{}, nil
+	default:
+		return nil, fmt.Errorf("invalid summary format '%s', must be one of %s, %s or %s", format, SummaryFormatText, SummaryFormatJSON, SummaryFormatJUnit)
+	}
+}
+
+// writeSummary writes the summary of the Task using the Builder's formatter, to the summary output if set
+// and to the log's output otherwise.
+func (b *Builder) writeSummary(task *graph.Task) {
+	formatter := b.summaryFormatter
+	if formatter == nil {
+		formatter = &textSummary{}
+	}
+	if b.summaryOutput == "" {
+		if err := formatter.Format(log.Writer(), task); err != nil {
+			log.Printf("Failed to write the summary: %v\n", err)
+		}
+		return
+	}
+
+	f, err := os.Create(b.summaryOutput)
+	if err != nil {
+		log.Printf("Failed to create the summary output: %v\n", err)
+		return
+	}
+	defer f.Close()
+	if err := formatter.Format(f, task); err != nil {
+		log.Printf("Failed to write the summary to %s: %v\n", b.summaryOutput, err)
+		return
+	}
+	log.Printf("Wrote summary to %s\n", b.summaryOutput)
+}
+
+// stepElapsed returns how long the step ran, zero if it never started.
+func stepElapsed(step *graph.Step) time.Duration {
+	if step.StartTime.IsZero() || step.EndTime.Before(step.StartTime) {
+		return 0
+	}
+	return step.EndTime.Sub(step.StartTime)
+}
+
+// textSummary logs the status of each stage in the Task followed by the status of its steps,
+// or the status of each step if the Task doesn't use stages.
+type textSummary struct{}
+
+func (s *textSummary) Format(w io.Writer, task *graph.Task) error {
+	logger := log.New(w, log.Prefix(), log.Flags())
+	if !task.UsesStages() {
+		for _, step := range task.Steps {
+			logStepSummary(logger, step, "")
+		}
+		return nil
+	}
+
+	// A stage is failed if any of its steps failed, skipped if any of its steps were skipped, and
+	// successful otherwise. Steps which are allowed to fail don't fail their stage.
+	for _, stage := range task.Stages() {
+		status := graph.Successful
+		var steps []*graph.Step
+		for _, step := range task.Steps {
+			if step.Stage != stage {
+				continue
+			}
+			steps = append(steps, step)
+			if step.StepStatus == graph.Failed || step.StepStatus == graph.TimedOut {
+				status = graph.Failed
+			} else if step.StepStatus != graph.Successful && step.StepStatus != graph.AllowedFailure && status != graph.Failed {
+				status = graph.Skipped
+			}
+		}
+		logger.Printf("Stage: %v marked as %v\n", stage, status)
+		for _, step := range steps {
+			logStepSummary(logger, step, "  ")
+		}
+	}
+	return nil
+}
+
+func logStepSummary(logger *log.Logger, step *graph.Step, indent string) {
+	logger.Printf("%sStep ID: %v marked as %v (elapsed time in seconds: %f)\n", indent, step.ID, step.StepStatus, step.EndTime.Sub(step.StartTime).Seconds())
+	if step.StepStatus == graph.AllowedFailure {
+		logger.Printf("%s  Step ID: %v is allowed to fail, error: %s\n", indent, step.ID, step.FailureMessage)
+	} else if step.StepStatus == graph.TimedOut {
+		logger.Printf("%s  Step ID: %v was killed: %s\n", indent, step.ID, step.FailureMessage)
+	}
+}
+
+// jsonStep is the summary of a step in the JSON format.
+type jsonStep struct {
+	ID             string           `json:"id"`
+	Stage          string           `json:"stage,omitempty"`
+	Status         graph.StepStatus `json:"status"`
+	StartTime      *time.Time       `json:"startTime,omitempty"`
+	EndTime        *time.Time       `json:"endTime,omitempty"`
+	ElapsedSeconds float64          `json:"elapsedSeconds"`
+	Error          string           `json:"error,omitempty"`
+}
+
+// jsonSummary writes the status of each step as a JSON object.
+type jsonSummary struct{}
+
+func (s *jsonSummary) Format(w io.Writer, task *graph.Task) error {
+	steps := make([]jsonStep, 0, len(task.Steps))
+	for _, step := range task.Steps {
+		summary := jsonStep{
+			ID:             step.ID,
+			Stage:          step.Stage,
+			Status:         step.StepStatus,
+			ElapsedSeconds: stepElapsed(step).Seconds(),
+			Error:          step.FailureMessage,
+		}
+		if !step.StartTime.IsZero() {
+			start, end := step.StartTime, step.EndTime
+			summary.StartTime, summary.EndTime = &start, &end
+		}
+		steps = append(steps, summary)
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(struct {
+		Steps []jsonStep `json:"steps"`
+	}{steps}); err != nil {
+		return errors.Wrap(err, "failed to marshal the summary")
+	}
+	return nil
+}
+
+// junitTestSuites is the root element of a JUnit XML report.
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *struct{}     `xml:"skipped,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// junitSummary writes a JUnit XML report with a test case for each step, named after the step's ID
+// and classed by its stage.
+type junitSummary struct{}
+
+func (s *junitSummary) Format(w io.Writer, task *graph.Task) error {
+	name := task.TaskName
+	if name == "" {
+		name = junitSuiteName
+	}
+	suite := junitTestSuite{Name: name, Tests: len(task.Steps)}
+	var total time.Duration
+	for _, step := range task.Steps {
+		elapsed := stepElapsed(step)
+		total += elapsed
+		className := name
+		if step.Stage != "" {
+			className = name + "." + step.Stage
+		}
+		testCase := junitTestCase{
+			Name:      step.ID,
+			ClassName: className,
+			Time:      junitSeconds(elapsed),
+		}
+		switch step.StepStatus {
+		case graph.Successful:
+		case graph.AllowedFailure:
+			// JUnit has no notion of an allowed failure, so the step passes and its error is reported as output.
+			testCase.SystemErr = step.FailureMessage
+		case graph.Failed, graph.TimedOut:
+			suite.Failures++
+			message := step.FailureMessage
+			if message == "" {
+				message = fmt.Sprintf("step ID: %s failed", step.ID)
+			}
+			testCase.Failure = &junitFailure{Message: message, Text: message}
+		default:
+			suite.Skipped++
+			testCase.Skipped = &struct{}{}
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Time = junitSeconds(total)
+
+	data, err := xml.MarshalIndent(junitTestSuites{Suites: []junitTestSuite{suite}}, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the summary")
+	}
+	if _, err := io.WriteString(w, xml.Header+string(data)+"\n"); err != nil {
+		return errors.Wrap(err, "failed to write the summary")
+	}
+	return nil
+}
+
+// junitSeconds formats the duration in seconds, as JUnit XML times are.
+func junitSeconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
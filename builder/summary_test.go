@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+)
+
+func newSummaryTask() *graph.Task {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	return &graph.Task{
+		TaskName: "ci",
+		Steps: []*graph.Step{
+			{ID: "build", Stage: "build", StepStatus: graph.Successful, StartTime: start, EndTime: start.Add(2 * time.Second)},
+			{ID: "test", Stage: "test", StepStatus: graph.Failed, StartTime: start, EndTime: start.Add(time.Second), FailureMessage: "exit status 1"},
+			{ID: "push", Stage: "push", StepStatus: graph.Skipped},
+			{ID: "warm", Stage: "build", StepStatus: graph.AllowedFailure, StartTime: start, EndTime: start.Add(time.Second), FailureMessage: "cache miss"},
+		},
+	}
+}
+
+func TestNewSummaryFormatter(t *testing.T) {
+	for _, format := range []string{"", "text", "JSON", "junit"} {
+		if _, err := NewSummaryFormatter(format); err != nil {
+			t.Errorf("Unexpected error for format %q: %v", format, err)
+		}
+	}
+	if _, err := NewSummaryFormatter("yaml"); err == nil {
+		t.Error("Expected an error for an unknown format")
+	}
+}
+
+func TestTextSummary(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (&textSummary{}).Format(&buf, newSummaryTask()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, expected := range []string{
+		"Stage: build marked as successful",
+		"  Step ID: build marked as successful (elapsed time in seconds: 2.000000)",
+		"Stage: test marked as failed",
+		"Stage: push marked as skipped",
+		"  Step ID: warm marked as allowedfailure",
+		"Step ID: warm is allowed to fail, error: cache miss",
+	} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Expected the summary to contain %q, but got:\n%s", expected, buf.String())
+		}
+	}
+}
+
+func TestJSONSummary(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (&jsonSummary{}).Format(&buf, newSummaryTask()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var summary struct {
+		Steps []jsonStep `json:"steps"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &summary); err != nil {
+		t.Fatalf("Failed to parse the summary: %v", err)
+	}
+	if len(summary.Steps) != 4 {
+		t.Fatalf("Expected 4 steps, but got %d", len(summary.Steps))
+	}
+	if step := summary.Steps[1]; step.ID != "test" || step.Status != graph.Failed || step.Error != "exit status 1" || step.ElapsedSeconds != 1 {
+		t.Errorf("Unexpected summary of the failed step: %+v", step)
+	}
+	if step := summary.Steps[2]; step.StartTime != nil || step.ElapsedSeconds != 0 {
+		t.Errorf("Expected the skipped step not to have started, but got %+v", step)
+	}
+	if step := summary.Steps[3]; step.Status != graph.AllowedFailure || step.Error != "cache miss" {
+		t.Errorf("Unexpected summary of the step allowed to fail: %+v", step)
+	}
+}
+
+func TestJUnitSummary(t *testing.T) {
+	var buf bytes.Buffer
+	if err := (&junitSummary{}).Format(&buf, newSummaryTask()); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var report junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &report); err != nil {
+		t.Fatalf("Failed to parse the report: %v", err)
+	}
+	if len(report.Suites) != 1 {
+		t.Fatalf("Expected 1 test suite, but got %d", len(report.Suites))
+	}
+	suite := report.Suites[0]
+	if suite.Name != "ci" || suite.Tests != 4 || suite.Failures != 1 || suite.Skipped != 1 || suite.Time != "4.000" {
+		t.Errorf("Unexpected test suite: %+v", suite)
+	}
+	if c := suite.Cases[0]; c.Name != "build" || c.ClassName != "ci.build" || c.Time != "2.000" || c.Failure != nil || c.Skipped != nil {
+		t.Errorf("Unexpected test case for the successful step: %+v", c)
+	}
+	if c := suite.Cases[1]; c.Failure == nil || c.Failure.Message != "exit status 1" {
+		t.Errorf("Expected the failed step to have a failure, but got %+v", c)
+	}
+	if c := suite.Cases[2]; c.Skipped == nil {
+		t.Errorf("Expected the skipped step to be skipped, but got %+v", c)
+	}
+	if c := suite.Cases[3]; c.Failure != nil || c.Skipped != nil || c.SystemErr != "cache miss" {
+		t.Errorf("Expected the step allowed to fail to pass with its error as output, but got %+v", c)
+	}
+}
@@ -0,0 +1,93 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/pkg/errors"
+)
+
+// timedOutStepsPollInterval is how often the steps killed by the Task's total timeout are checked for completion.
+const timedOutStepsPollInterval = 100 * time.Millisecond
+
+// totalTimeoutExceeded returns true if ctx, the context of the Task, expired because the Task exceeded its total timeout.
+func totalTimeoutExceeded(ctx context.Context, task *graph.Task) bool {
+	return task.TotalTimeout > 0 && ctx.Err() == context.DeadlineExceeded
+}
+
+// totalTimeoutMessage describes the Task exceeding its total timeout.
+func totalTimeoutMessage(task *graph.Task) string {
+	return fmt.Sprintf("the task exceeded its total timeout of %d seconds", task.TotalTimeout)
+}
+
+// timeOutStep marks the step, which failed with err because the Task exceeded its total timeout, as timed out.
+// The step fails the Task even if it ignores errors or is allowed to fail.
+func timeOutStep(step *graph.Step, task *graph.Task, err error) error {
+	step.StepStatus = graph.TimedOut
+	step.FailureMessage = totalTimeoutMessage(task)
+	return errors.Wrapf(err, "step ID: %s timed out", step.ID)
+}
+
+// addActiveSteps adds delta to the number of steps which are running or waiting to run.
+func (b *Builder) addActiveSteps(delta int) {
+	b.stepsMu.Lock()
+	defer b.stepsMu.Unlock()
+	b.activeSteps += delta
+}
+
+func (b *Builder) activeStepCount() int {
+	b.stepsMu.Lock()
+	defer b.stepsMu.Unlock()
+	return b.activeSteps
+}
+
+// updateStep updates the step's status, failure message or times, which the Task reads once it has timed out.
+// The steps of a timed out Task are no longer updated, see timeOutTask, except for the steps which run on failure.
+func (b *Builder) updateStep(step *graph.Step, update func()) {
+	b.stepsMu.Lock()
+	defer b.stepsMu.Unlock()
+	if b.stepsTimedOut && !step.OnFailure {
+		return
+	}
+	update()
+}
+
+// stepStatus returns the step's status, see updateStep.
+func (b *Builder) stepStatus(step *graph.Step) graph.StepStatus {
+	b.stepsMu.Lock()
+	defer b.stepsMu.Unlock()
+	return step.StepStatus
+}
+
+// timeOutTask fails the Task, which exceeded its total timeout. The steps which were running are
+// killed along with the Task's context, and are given a bounded grace period to complete so they're
+// marked as timed out in the summary. Steps which still haven't completed by then are marked as timed
+// out regardless, and their containers are removed when the Task is cleaned. The steps which run on
+// failure then run with a grace period of their own, since the Task's context has already expired.
+func (b *Builder) timeOutTask(task *graph.Task, grace time.Duration, onFailureGrace time.Duration) error {
+	deadline := time.Now().Add(grace)
+	for b.activeStepCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(timedOutStepsPollInterval)
+	}
+	b.stepsMu.Lock()
+	for _, step := range task.Steps {
+		if step.StepStatus == graph.InProgress {
+			step.StepStatus = graph.TimedOut
+			step.FailureMessage = totalTimeoutMessage(task)
+		}
+	}
+	// Steps completing after the grace period don't update the summary.
+	b.stepsTimedOut = true
+	b.stepsMu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), onFailureGrace)
+	defer cancel()
+	b.runOnFailureSteps(ctx, task)
+	b.writeSummary(task)
+	return errors.New(totalTimeoutMessage(task))
+}
@@ -0,0 +1,144 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+)
+
+func TestTotalTimeoutExceeded(t *testing.T) {
+	expired, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	cancelled, cancelNow := context.WithCancel(context.Background())
+	cancelNow()
+
+	tests := []struct {
+		ctx          context.Context
+		totalTimeout int
+		expected     bool
+	}{
+		{expired, 60, true},
+		{expired, 0, false},
+		{cancelled, 60, false},
+		{context.Background(), 60, false},
+	}
+
+	for i, test := range tests {
+		if actual := totalTimeoutExceeded(test.ctx, &graph.Task{TotalTimeout: test.totalTimeout}); actual != test.expected {
+			t.Errorf("Test %d: expected %t, but got %t", i, test.expected, actual)
+		}
+	}
+}
+
+func TestTimeOutStep(t *testing.T) {
+	step := &graph.Step{ID: "build", StepStatus: graph.InProgress, IgnoreErrors: true}
+	err := timeOutStep(step, &graph.Task{TotalTimeout: 60}, errors.New("signal: killed"))
+	if err == nil || !strings.Contains(err.Error(), "step ID: build timed out") {
+		t.Errorf("Expected the step to fail the task, even though it ignores errors, but got %v", err)
+	}
+	if step.StepStatus != graph.TimedOut {
+		t.Errorf("Expected the step to be marked as %s, but got %s", graph.TimedOut, step.StepStatus)
+	}
+	if expected := "the task exceeded its total timeout of 60 seconds"; step.FailureMessage != expected {
+		t.Errorf("Expected the failure message %q, but got %q", expected, step.FailureMessage)
+	}
+}
+
+func TestTimeOutTask(t *testing.T) {
+	task := &graph.Task{
+		TotalTimeout: 60,
+		Steps: []*graph.Step{
+			{ID: "build", StepStatus: graph.Successful},
+			{ID: "test", StepStatus: graph.InProgress},
+			{ID: "hung", StepStatus: graph.InProgress},
+			{ID: "push", StepStatus: graph.Skipped},
+			{ID: "cleanup", Cmd: "alpine echo cleanup", Timeout: 60, OnFailure: true, StepStatus: graph.Skipped},
+		},
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	summaryOutput := filepath.Join(t.TempDir(), "summary.json")
+	b.SetSummaryOutput(summaryOutput)
+	formatter, err := NewSummaryFormatter(SummaryFormatJSON)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	b.SetSummaryFormatter(formatter)
+
+	// The killed test step completes within the grace period, while the hung step only does once the task timed out.
+	b.addActiveSteps(2)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.updateStep(task.Steps[1], func() {
+			_ = timeOutStep(task.Steps[1], task, errors.New("signal: killed"))
+		})
+		b.addActiveSteps(-1)
+	}()
+	hungDone := make(chan struct{})
+	go func() {
+		defer close(hungDone)
+		time.Sleep(400 * time.Millisecond)
+		b.updateStep(task.Steps[2], func() {
+			task.Steps[2].StepStatus = graph.Successful
+		})
+	}()
+	start := time.Now()
+	err = b.timeOutTask(task, 300*time.Millisecond, time.Minute)
+	if err == nil || err.Error() != "the task exceeded its total timeout of 60 seconds" {
+		t.Errorf("Expected the task to fail with its total timeout, but got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the grace period to bound waiting for the hung step, but waited %v", elapsed)
+	}
+
+	data, err := ioutil.ReadFile(summaryOutput)
+	if err != nil {
+		t.Fatalf("Failed to read the summary: %v", err)
+	}
+	var summary struct {
+		Steps []jsonStep `json:"steps"`
+	}
+	if err := json.Unmarshal(data, &summary); err != nil {
+		t.Fatalf("Failed to unmarshal the summary: %v", err)
+	}
+	// The step which runs on failure still runs, even though the task's context expired.
+	expected := []graph.StepStatus{graph.Successful, graph.TimedOut, graph.TimedOut, graph.Skipped, graph.Successful}
+	for i, step := range summary.Steps {
+		if step.Status != expected[i] {
+			t.Errorf("Expected step ID: %s to be marked as %s, but got %s", step.ID, expected[i], step.Status)
+		}
+	}
+
+	// The hung step completing late doesn't change its status.
+	<-hungDone
+	if status := b.stepStatus(task.Steps[2]); status != graph.TimedOut {
+		t.Errorf("Expected the hung step to stay marked as %s, but got %s", graph.TimedOut, status)
+	}
+}
+
+func TestTimeOutTask_OnFailureGrace(t *testing.T) {
+	task := &graph.Task{
+		TotalTimeout: 60,
+		Steps: []*graph.Step{
+			{ID: "cleanup", Cmd: "alpine echo cleanup", Timeout: 60, OnFailure: true, StepStatus: graph.Skipped},
+		},
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetSummaryOutput(filepath.Join(t.TempDir(), "summary.txt"))
+
+	// The steps which run on failure don't run once their grace period is over.
+	_ = b.timeOutTask(task, 0, 0)
+	if status := b.stepStatus(task.Steps[0]); status != graph.Skipped {
+		t.Errorf("Expected the step to be skipped, but got %s", status)
+	}
+}
@@ -0,0 +1,172 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/pkg/errors"
+)
+
+const (
+	traceCategoryStep   = "step"
+	traceCategoryTry    = "attempt"
+	traceCategoryDigest = "digest"
+
+	// traceTaskLane is the lane of spans which don't belong to a step.
+	traceTaskLane = "task"
+)
+
+// traceEvent is an event in the Chrome trace event format, viewable in chrome://tracing or Perfetto.
+// See https://docs.google.com/document/d/1CvAClvFfyA5R-PhYUmn5OOQtYMH4h6I0nSsKchNAySU
+type traceEvent struct {
+	Name     string                 `json:"name"`
+	Category string                 `json:"cat,omitempty"`
+	Phase    string                 `json:"ph"`
+	Time     int64                  `json:"ts"`
+	Duration int64                  `json:"dur,omitempty"`
+	PID      int                    `json:"pid"`
+	TID      int                    `json:"tid"`
+	Args     map[string]interface{} `json:"args,omitempty"`
+}
+
+// traceFile is the JSON object format of a Chrome trace.
+type traceFile struct {
+	TraceEvents     []traceEvent `json:"traceEvents"`
+	DisplayTimeUnit string       `json:"displayTimeUnit"`
+}
+
+// Tracer records when each step of a Task started and ended, along with the attempts of each step
+// and the resolution of base image digests, as a Chrome trace. Each step is shown on its own lane,
+// so steps which ran in parallel are shown side by side. A nil Tracer records nothing.
+type Tracer struct {
+	mu     sync.Mutex
+	start  time.Time
+	lanes  map[string]int
+	events []traceEvent
+}
+
+// NewTracer creates a Tracer whose timestamps are relative to now.
+func NewTracer() *Tracer {
+	return &Tracer{
+		start: time.Now(),
+		lanes: make(map[string]int),
+	}
+}
+
+// Span records a span named name on the lane, e.g. a step ID, from start until now.
+func (t *Tracer) Span(lane string, name string, category string, start time.Time, args map[string]interface{}) {
+	if t == nil {
+		return
+	}
+	end := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, traceEvent{
+		Name:     name,
+		Category: category,
+		Phase:    "X",
+		Time:     start.Sub(t.start).Microseconds(),
+		Duration: end.Sub(start).Microseconds(),
+		PID:      1,
+		TID:      t.lane(lane),
+		Args:     args,
+	})
+}
+
+// lane returns the thread ID used for the lane, naming the thread after the lane the first time it's used.
+// The caller must hold t.mu.
+func (t *Tracer) lane(name string) int {
+	if tid, ok := t.lanes[name]; ok {
+		return tid
+	}
+	tid := len(t.lanes) + 1
+	t.lanes[name] = tid
+	t.events = append(t.events, traceEvent{
+		Name:  "thread_name",
+		Phase: "M",
+		PID:   1,
+		TID:   tid,
+		Args:  map[string]interface{}{"name": name},
+	})
+	return tid
+}
+
+// ObserveAttempt records an attempt to run a step's container. It's a procmanager.AttemptObserver.
+func (t *Tracer) ObserveAttempt(containerName string, attempt int, start time.Time, err error) {
+	args := map[string]interface{}{"attempt": attempt}
+	if err != nil {
+		args["error"] = err.Error()
+	}
+	t.Span(containerName, "attempt", traceCategoryTry, start, args)
+}
+
+// ObserveRateLimit records the rate limit reported by a registry as a counter of its remaining requests.
+// It's a RateLimitObserver.
+func (t *Tracer) ObserveRateLimit(limit *RateLimit) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.events = append(t.events, traceEvent{
+		Name:     "rate limit " + limit.Registry,
+		Category: traceCategoryDigest,
+		Phase:    "C",
+		Time:     time.Since(t.start).Microseconds(),
+		PID:      1,
+		Args:     map[string]interface{}{"remaining": limit.Remaining},
+	})
+}
+
+// Write writes the trace to the file at path.
+func (t *Tracer) Write(path string) error {
+	t.mu.Lock()
+	data, err := json.MarshalIndent(traceFile{TraceEvents: t.events, DisplayTimeUnit: "ms"}, "", "  ")
+	t.mu.Unlock()
+	if err != nil {
+		return errors.Wrap(err, "failed to marshal the trace")
+	}
+	if err := ioutil.WriteFile(path, data, 0644); err != nil {
+		return errors.Wrap(err, "failed to write the trace")
+	}
+	return nil
+}
+
+// traceDigest is a DigestHelper which records how long populating each digest took.
+type traceDigest struct {
+	helper DigestHelper
+	tracer *Tracer
+	lane   string
+}
+
+// NewTraceDigest creates a DigestHelper which records a span on the lane of tracer for each digest populated by helper.
+func NewTraceDigest(helper DigestHelper, tracer *Tracer, lane string) DigestHelper {
+	if tracer == nil {
+		return helper
+	}
+	return &traceDigest{helper: helper, tracer: tracer, lane: lane}
+}
+
+var _ DigestHelper = &traceDigest{}
+
+func (d *traceDigest) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	if ref == nil {
+		return d.helper.PopulateDigest(ctx, ref)
+	}
+	start := time.Now()
+	reference := ref.Reference
+	err := d.helper.PopulateDigest(ctx, ref)
+	args := map[string]interface{}{"digest": ref.Digest}
+	if err != nil {
+		args["error"] = err.Error()
+	}
+	d.tracer.Span(d.lane, reference, traceCategoryDigest, start, args)
+	return err
+}
@@ -0,0 +1,103 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Azure/acr-builder/pkg/image"
+)
+
+func TestTracer(t *testing.T) {
+	tracer := NewTracer()
+	start := time.Now()
+	tracer.Span("build", "build", traceCategoryStep, start, map[string]interface{}{"status": "Successful"})
+	tracer.ObserveAttempt("test", 1, start, errors.New("exit status 1"))
+	tracer.ObserveAttempt("test", 2, start, nil)
+	tracer.ObserveRateLimit(&RateLimit{Registry: "docker.io", Limit: 100, Remaining: 76})
+
+	dir, err := ioutil.TempDir("", "trace")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "trace.json")
+	if err := tracer.Write(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read the trace: %v", err)
+	}
+	var trace traceFile
+	if err := json.Unmarshal(data, &trace); err != nil {
+		t.Fatalf("Failed to parse the trace: %v", err)
+	}
+
+	lanes := make(map[int]string)
+	var spans, counters []traceEvent
+	for _, event := range trace.TraceEvents {
+		switch event.Phase {
+		case "M":
+			lanes[event.TID] = event.Args["name"].(string)
+		case "X":
+			spans = append(spans, event)
+		case "C":
+			counters = append(counters, event)
+		default:
+			t.Errorf("Unexpected event phase %s", event.Phase)
+		}
+	}
+	if len(lanes) != 2 {
+		t.Fatalf("Expected 2 lanes, but got %v", lanes)
+	}
+	if len(spans) != 3 {
+		t.Fatalf("Expected 3 spans, but got %d", len(spans))
+	}
+	if lanes[spans[0].TID] != "build" || spans[0].Category != traceCategoryStep {
+		t.Errorf("Expected the build step on the build lane, but got %+v", spans[0])
+	}
+	for _, span := range spans[1:] {
+		if lanes[span.TID] != "test" || span.Category != traceCategoryTry {
+			t.Errorf("Expected an attempt on the test lane, but got %+v", span)
+		}
+	}
+	if spans[1].Args["error"] != "exit status 1" || spans[2].Args["error"] != nil {
+		t.Errorf("Expected only the first attempt to have failed, but got %v and %v", spans[1].Args, spans[2].Args)
+	}
+	if len(counters) != 1 || counters[0].Name != "rate limit docker.io" || counters[0].Args["remaining"] != float64(76) {
+		t.Errorf("Expected a counter of the remaining requests of docker.io, but got %+v", counters)
+	}
+}
+
+func TestTraceDigest(t *testing.T) {
+	if helper := NewTraceDigest(&staticDigest{}, nil, "build"); helper == nil {
+		t.Fatal("Expected the helper to be returned without a tracer")
+	}
+
+	tracer := NewTracer()
+	helper := NewTraceDigest(&staticDigest{digest: "sha256:abc"}, tracer, "build")
+	ref := &image.Reference{Reference: "node:18"}
+	if err := helper.PopulateDigest(context.Background(), ref); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	var span *traceEvent
+	for i := range tracer.events {
+		if tracer.events[i].Phase == "X" {
+			span = &tracer.events[i]
+		}
+	}
+	if span == nil || span.Name != "node:18" || span.Category != traceCategoryDigest || span.Args["digest"] != "sha256:abc" {
+		t.Errorf("Expected a digest span for node:18, but got %+v", span)
+	}
+}
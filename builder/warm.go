@@ -0,0 +1,210 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/scan"
+	"github.com/Azure/acr-builder/util"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"golang.org/x/sync/semaphore"
+)
+
+// DefaultWarmConcurrency is the default number of images warmed at once.
+const DefaultWarmConcurrency = 4
+
+// warmTimeoutInSec limits how long resolving and pulling each image takes.
+const warmTimeoutInSec = 600
+
+// WarmResult is the result of warming an image referenced by a Task.
+type WarmResult struct {
+	// Image is the referenced image.
+	Image string
+
+	// Digest is the image's resolved digest, empty if it couldn't be resolved.
+	Digest string
+
+	// Err is why the image couldn't be warmed, nil if it was.
+	Err error
+
+	// Elapsed is how long resolving and pulling the image took.
+	Elapsed time.Duration
+}
+
+// WarmImageReferences returns the distinct base images of the Task, sorted, i.e. the images run by its
+// steps and the base images of the Dockerfiles its steps build. Only the Dockerfiles of local contexts
+// are read, relative to acb's working directory and the step's working directory, and a Dockerfile
+// which can't be read is skipped with a warning. Images built by the Task and scratch aren't included,
+// since they can't be pulled.
+func WarmImageReferences(task *graph.Task) ([]string, error) {
+	built := make(map[string]bool)
+	for _, step := range task.Steps {
+		if step.IsBuildStep() {
+			for _, tag := range step.Tags {
+				built[util.NormalizeImageTag(tag)] = true
+			}
+		}
+	}
+
+	images := make(map[string]bool)
+	add := func(step *graph.Step, img string) error {
+		if img == "" {
+			return nil
+		}
+		img = util.NormalizeImageTag(img)
+		if built[img] {
+			return nil
+		}
+		ref, err := scan.NewImageReference(img)
+		if err != nil {
+			return errors.Wrapf(err, "failed to parse the image referenced by step ID: %s", step.ID)
+		}
+		if !IsNoBaseImage(ref) {
+			images[img] = true
+		}
+		return nil
+	}
+	for _, step := range task.Steps {
+		switch {
+		case step.IsCmdStep():
+			if err := add(step, util.ParseImageName(step.Cmd)); err != nil {
+				return nil, err
+			}
+		case step.IsBuildStep():
+			dockerfile, target, dockerContext := parseDockerBuildCmd(step.Build)
+			if !util.IsLocalContext(dockerContext) {
+				util.Debugf("Skipping the base images of step ID: %s, its context isn't local\n", step.ID)
+				continue
+			}
+			if dockerfile != "" && !path.IsAbs(dockerfile) {
+				dockerfile = path.Join(step.WorkingDirectory, dockerfile)
+			}
+			runtime, buildtime, err := scan.DockerfileBaseImages(dockerContext, step.WorkingDirectory, dockerfile, step.BuildArgs, target)
+			if err != nil {
+				log.Printf("WARNING: skipping the base images of step ID: %s: %v\n", step.ID, err)
+				continue
+			}
+			for _, img := range append([]string{runtime}, buildtime...) {
+				if err := add(step, img); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	sorted := make([]string, 0, len(images))
+	for img := range images {
+		sorted = append(sorted, img)
+	}
+	sort.Strings(sorted)
+	return sorted, nil
+}
+
+// WarmImages pulls the base images of the Task, see WarmImageReferences, into the local image store ahead
+// of running it, so the pulls are off the Task's critical path. It logs in to the Task's registries, then
+// concurrently resolves the digest of each image and pulls it by digest, tagging it with its reference so
+// steps using the reference don't pull it again. At most concurrency images are warmed at once, and
+// resolving digests respects the Builder's registry limits, allowlists and lock file. The results are sorted by image.
+func (b *Builder) WarmImages(ctx context.Context, task *graph.Task, concurrency int) ([]*WarmResult, error) {
+	if concurrency <= 0 {
+		return nil, fmt.Errorf("invalid concurrency %d, it must be positive", concurrency)
+	}
+	images, err := WarmImageReferences(task)
+	if err != nil {
+		return nil, err
+	}
+	// Digests are resolved like the base images of the Task, e.g. from its lock file.
+	d, err := b.BaseImageDigester(task.RegistryLoginCredentials, task.Credentials)
+	if err != nil {
+		return nil, err
+	}
+	if err := b.setupDockerConfig(ctx, task); err != nil {
+		return nil, err
+	}
+
+	results := make([]*WarmResult, len(images))
+	slots := semaphore.NewWeighted(int64(concurrency))
+	var wg sync.WaitGroup
+	for i, img := range images {
+		result := &WarmResult{Image: img}
+		results[i] = result
+		if err := slots.Acquire(ctx, 1); err != nil {
+			result.Err = err
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer slots.Release(1)
+			warmCtx, cancel := context.WithTimeout(ctx, time.Duration(warmTimeoutInSec)*time.Second)
+			defer cancel()
+			start := time.Now()
+			result.Digest, result.Err = b.warmImage(warmCtx, d, result.Image)
+			result.Elapsed = time.Since(start)
+		}()
+	}
+	wg.Wait()
+	return results, nil
+}
+
+// warmImage resolves the digest of the image, pulls it by digest and tags it with its reference,
+// returning the digest.
+func (b *Builder) warmImage(ctx context.Context, d DigestHelper, img string) (string, error) {
+	ref, err := scan.NewImageReference(img)
+	if err != nil {
+		return "", err
+	}
+	if err := d.PopulateDigest(ctx, ref); err != nil {
+		return "", err
+	}
+	if ref.Digest == "" {
+		return "", fmt.Errorf("failed to resolve the digest of %s", img)
+	}
+	name := img
+	if i := strings.Index(img, "@"); i >= 0 {
+		name = img[:i]
+	} else if ref.Tag != "" {
+		name = strings.TrimSuffix(img, ":"+ref.Tag)
+	}
+	pinned := name + "@" + ref.Digest
+
+	var buf bytes.Buffer
+	args := []string{
+		"docker",
+		"run",
+		"--name", fmt.Sprintf("acb_docker_pull_%s", uuid.New()),
+		"--rm",
+
+		// Mount home
+		"--volume", util.DockerSocketVolumeMapping,
+		"--volume", homeVol + ":" + homeWorkDir,
+		"--env", homeEnv,
+
+		dockerCLIImageName,
+		"pull",
+		pinned,
+	}
+	if err := b.procManager.Run(ctx, args, nil, &buf, &buf, ""); err != nil {
+		return ref.Digest, errors.Wrapf(err, "failed to pull %s: %s", pinned, buf.String())
+	}
+	if pinned == img {
+		return ref.Digest, nil
+	}
+	buf.Reset()
+	if err := b.procManager.Run(ctx, []string{"docker", "tag", pinned, img}, nil, &buf, &buf, ""); err != nil {
+		return ref.Digest, errors.Wrapf(err, "failed to tag %s as %s: %s", pinned, img, buf.String())
+	}
+	return ref.Digest, nil
+}
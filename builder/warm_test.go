@@ -0,0 +1,102 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package builder
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/procmanager"
+	"github.com/containerd/containerd/images"
+)
+
+func TestWarmImageReferences(t *testing.T) {
+	dir := t.TempDir()
+	dockerfile := filepath.ToSlash(filepath.Join(dir, "Dockerfile"))
+	if err := os.WriteFile(dockerfile, []byte("FROM golang:1.21 AS build\nFROM alpine:3.18\nCOPY --from=build /app /app\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the Dockerfile: %v", err)
+	}
+	scratchDockerfile := filepath.ToSlash(filepath.Join(dir, "Dockerfile.scratch"))
+	if err := os.WriteFile(scratchDockerfile, []byte("FROM scratch\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the Dockerfile: %v", err)
+	}
+
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `
+steps:
+  - id: build
+    build: -t myregistry.azurecr.io/app:v1 -f `+dockerfile+` .
+  - id: scratch
+    build: -t myregistry.azurecr.io/scratch:v1 -f `+scratchDockerfile+` .
+  - id: test
+    cmd: myregistry.azurecr.io/app:v1 test
+  - id: lint
+    cmd: ubuntu echo lint
+  - id: remote
+    build: -t myregistry.azurecr.io/remote:v1 https://github.com/Azure/acr-builder.git
+  - id: missing
+    build: -t myregistry.azurecr.io/missing:v1 -f `+dir+`/missing/Dockerfile .
+`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+
+	actual, err := WarmImageReferences(task)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The image built by the task, scratch, the remote context and the missing Dockerfile aren't warmed.
+	expected := []string{"alpine:3.18", "golang:1.21", "ubuntu:latest"}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected images %v, but got %v", expected, actual)
+	}
+}
+
+func TestWarmImages(t *testing.T) {
+	registry := newFakeRegistry()
+	dgst := registry.addManifest("app", "v1", images.MediaTypeDockerSchema2Manifest, []byte(`{"schemaVersion":2}`))
+	host, stop := registry.start()
+	defer stop()
+
+	task, err := graph.UnmarshalTaskFromString(context.Background(), `
+steps:
+  - cmd: `+host+`/app:v1
+  - cmd: `+host+`/missing:v1
+  - cmd: other.azurecr.io/app:v1
+`, &graph.TaskOptions{})
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	allowlist, err := NewRegistryAllowlist([]string{host})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	b := NewBuilder(procmanager.NewProcManager(true), false, "")
+	b.SetRemoteDigestOptions(&RemoteDigestOptions{RegistryAllowlist: allowlist})
+
+	if _, err := b.WarmImages(context.Background(), task, 0); err == nil {
+		t.Error("Expected an error for a concurrency of 0")
+	}
+
+	results, err := b.WarmImages(context.Background(), task, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, but got %d", len(results))
+	}
+	if r := results[0]; r.Image != host+"/app:v1" || r.Err != nil || r.Digest != dgst.String() {
+		t.Errorf("Expected %s/app:v1 to be warmed with digest %s, but got %+v", host, dgst, r)
+	}
+	if r := results[1]; r.Image != host+"/missing:v1" || r.Err == nil || r.Digest != "" {
+		t.Errorf("Expected %s/missing:v1 to fail to resolve, but got %+v", host, r)
+	}
+	if r := results[2]; r.Image != "other.azurecr.io/app:v1" || r.Err == nil || !strings.Contains(r.Err.Error(), "other.azurecr.io") {
+		t.Errorf("Expected other.azurecr.io/app:v1 to be rejected by the allowlist, but got %+v", r)
+	}
+}
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"github.com/Azure/acr-builder/builder"
+	"github.com/Azure/acr-builder/cmd/acb/commands/digestflags"
 	"github.com/Azure/acr-builder/graph"
 	"github.com/Azure/acr-builder/pkg/procmanager"
 	"github.com/Azure/acr-builder/pkg/volume"
@@ -33,7 +34,7 @@ var Command = cli.Command{
 	Name:      "build",
 	Usage:     "build container images",
 	ArgsUsage: "[path|url]",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		// Build options
 		cli.StringFlag{
 			Name:  "file,f",
@@ -76,6 +77,12 @@ var Command = cli.Command{
 			Name:  "credential",
 			Usage: "login credentials for custom registry",
 		},
+		cli.StringFlag{
+			Name:   "credential-provider",
+			Usage:  "the credential provider tried first for registries with several credentials, either ordered, auto, msi or opaque, where auto prefers msi if the environment indicates a managed identity",
+			Value:  graph.ProviderOrdered,
+			EnvVar: "ACB_CREDENTIAL_PROVIDER",
+		},
 		cli.BoolFlag{
 			Name:  "pull",
 			Usage: "attempt to pull a newer version of the base image during build",
@@ -92,10 +99,77 @@ var Command = cli.Command{
 			Name:  "dry-run",
 			Usage: "evaluates the command, but doesn't execute it",
 		},
+		cli.BoolFlag{
+			Name:  "print-commands",
+			Usage: "print the docker command of each step, with secrets redacted, and skip the step instead of running it. Digests are still resolved, combine with --dry-run to run nothing",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "enables diagnostic logging",
 		},
+		cli.StringFlag{
+			Name:  "verbosity",
+			Usage: "how much is logged, either quiet, normal or debug. --debug implies debug",
+			Value: "normal",
+		},
+		cli.StringFlag{
+			Name:  "summary-format",
+			Usage: "the format of the summary written once the steps complete, either text, json or junit",
+			Value: builder.SummaryFormatText,
+		},
+		cli.StringFlag{
+			Name:  "summary-output",
+			Usage: "the path to write the summary to instead of the log",
+		},
+		cli.StringFlag{
+			Name:  "trace-output",
+			Usage: "the path to write a Chrome trace of when each step, its attempts and the resolution of its digests started and ended",
+		},
+		cli.StringFlag{
+			Name:  "lock-file-output",
+			Usage: "the path to write a lock file pinning each base image to its resolved digest",
+		},
+		cli.StringFlag{
+			Name:  "provenance-output",
+			Usage: "the path to write a SLSA provenance of the pushed images to, recording their resolved base image digests and the executed steps",
+		},
+		cli.BoolFlag{
+			Name:  "provenance-push",
+			Usage: "pushes a SLSA provenance as an OCI referrer of each pushed image",
+		},
+		cli.BoolFlag{
+			Name:  "update-lock",
+			Usage: "resolves base image digests and refreshes the lock file specified by --lock-file",
+		},
+		cli.BoolFlag{
+			Name:  "skip-digests",
+			Usage: "skip resolving base image digests, for fast local iteration where reproducibility doesn't matter",
+		},
+		cli.BoolFlag{
+			Name:  "label-base-images",
+			Usage: "resolve the digests of the base images of build steps before building, and label the images built with them, e.g. base.image.0=<reference>@<digest>",
+		},
+		cli.StringSliceFlag{
+			Name:  "signature-key",
+			Usage: "the path of a PEM encoded public key trusted to sign the base images with cosign, which are verified before building (use --signature-key multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "signature-identity",
+			Usage: "a signer trusted to sign the base images keylessly with cosign in the format of 'issuer;identity', e.g. 'https://accounts.google.com;release@example.com' (use --signature-identity multiple times)",
+		},
+		cli.StringFlag{
+			Name:  "signature-roots",
+			Usage: "the path of the PEM encoded certificates of the CAs issuing the certificates of keyless signatures, e.g. Fulcio's root and intermediate",
+		},
+		cli.StringFlag{
+			Name:  "rekor-public-key",
+			Usage: "the path of the PEM encoded public key of the Rekor transparency log, which proves when keyless signatures were made",
+		},
+		cli.IntFlag{
+			Name:  "push-concurrency",
+			Usage: "the maximum number of images pushed concurrently by each push step, 1 to push them one after the other",
+			Value: builder.DefaultPushConcurrency,
+		},
 
 		// Rendering options
 		cli.StringFlag{
@@ -146,7 +220,7 @@ var Command = cli.Command{
 			Name:  "set",
 			Usage: "set values on the command line (use --set multiple times or use commas: key1=val1,key2=val2)",
 		},
-	},
+	}, digestflags.Flags...),
 	Action: func(context *cli.Context) error {
 		var (
 			// Build options
@@ -161,11 +235,28 @@ var Command = cli.Command{
 			secretBuildArgs         = context.StringSlice("secret-build-arg")
 			labels                  = context.StringSlice("label")
 			creds                   = context.StringSlice("credential")
+			credentialProvider      = context.String("credential-provider")
 			pull                    = context.Bool("pull")
 			noCache                 = context.Bool("no-cache")
 			push                    = context.Bool("push")
 			dryRun                  = context.Bool("dry-run")
+			printCommands           = context.Bool("print-commands")
 			debug                   = context.Bool("debug")
+			verbosity               = context.String("verbosity")
+			lockFileOutput          = context.String("lock-file-output")
+			provenanceOutput        = context.String("provenance-output")
+			provenancePush          = context.Bool("provenance-push")
+			traceOutput             = context.String("trace-output")
+			summaryFormat           = context.String("summary-format")
+			summaryOutput           = context.String("summary-output")
+			updateLock              = context.Bool("update-lock")
+			skipDigests             = context.Bool("skip-digests")
+			labelBaseImages         = context.Bool("label-base-images")
+			signatureKeys           = context.StringSlice("signature-key")
+			signatureIdentities     = context.StringSlice("signature-identity")
+			signatureRoots          = context.String("signature-roots")
+			rekorPublicKey          = context.String("rekor-public-key")
+			pushConcurrency         = context.Int("push-concurrency")
 
 			// Rendering options
 			values        = context.String("values")
@@ -182,6 +273,17 @@ var Command = cli.Command{
 			setVals       = context.StringSlice("set")
 		)
 
+		verbosityLevel, err := util.ParseVerbosity(verbosity)
+		if err != nil {
+			return err
+		}
+		if debug {
+			verbosityLevel = util.VerbosityDebug
+		} else if verbosityLevel == util.VerbosityDebug {
+			debug = true
+		}
+		util.SetVerbosity(verbosityLevel)
+
 		if buildContext == "" {
 			return errors.New("build requires exactly 1 argument, see build --help")
 		}
@@ -226,6 +328,7 @@ var Command = cli.Command{
 			OSVersion:               osVersion,
 			Architecture:            runtime.GOARCH,
 		}
+		renderOpts.PopulateBuildMetadata(ctx, ".")
 
 		task, err := createBuildTask(
 			ctx,
@@ -245,14 +348,63 @@ var Command = cli.Command{
 			registry,
 			push,
 			creds,
+			credentialProvider,
 			defaultWorkingDirectory)
 		if err != nil {
 			return err
 		}
 
+		signaturePolicy, err := builder.NewSignaturePolicy(signatureKeys, signatureIdentities, signatureRoots, rekorPublicKey)
+		if err != nil {
+			return err
+		}
+		digestOpts, err := digestflags.Parse(ctx, context, updateLock)
+		if err != nil {
+			return err
+		}
+		if skipDigests && (digestOpts.LockFile != "" || lockFileOutput != "" || digestOpts.Allowlist != nil || provenanceOutput != "" || provenancePush || labelBaseImages || signaturePolicy != nil) {
+			return errors.New("--skip-digests can't be combined with --lock-file, --lock-file-output, --digest-allowlist, --provenance-output, --provenance-push, --label-base-images, --signature-key or --signature-identity, which require digests")
+		}
+		if updateLock {
+			if digestOpts.LockFile == "" {
+				return errors.New("--update-lock requires --lock-file")
+			}
+			lockFileOutput = digestOpts.LockFile
+		}
+		summaryFormatter, err := builder.NewSummaryFormatter(summaryFormat)
+		if err != nil {
+			return err
+		}
+		var tracer *builder.Tracer
+		if traceOutput != "" {
+			tracer = builder.NewTracer()
+		}
+		var provenance *builder.ProvenanceOptions
+		if provenanceOutput != "" || provenancePush {
+			provenance = &builder.ProvenanceOptions{Output: provenanceOutput, Push: provenancePush, InvocationID: renderOpts.ID}
+		}
 		builder := builder.NewBuilder(pm, debug, homevol)
+		builder.SetTracer(tracer)
+		digestOpts.Apply(builder)
+		builder.SetLockFileOutput(lockFileOutput)
+		builder.SetProvenance(provenance)
+		builder.SetSkipDigests(skipDigests)
+		builder.SetBaseImageLabels(labelBaseImages)
+		builder.SetSignaturePolicy(signaturePolicy)
+		builder.SetSummaryFormatter(summaryFormatter)
+		builder.SetSummaryOutput(summaryOutput)
+		builder.SetPrintCommands(printCommands)
+		builder.SetPushConcurrency(pushConcurrency)
 		defer builder.CleanTask(gocontext.Background(), task) // Use a separate context since the other may have expired.
-		return builder.RunTask(gocontext.Background(), task)
+		err = builder.RunTask(gocontext.Background(), task)
+		if tracer != nil {
+			if traceErr := tracer.Write(traceOutput); traceErr != nil {
+				log.Printf("Failed to write the trace to %s: %v\n", traceOutput, traceErr)
+			} else {
+				log.Printf("Wrote trace to %s\n", traceOutput)
+			}
+		}
+		return err
 	},
 }
 
@@ -274,6 +426,7 @@ func createBuildTask(
 	registry string,
 	push bool,
 	creds []string,
+	credentialProvider string,
 	workingDirectory string,
 ) (*graph.Task, error) {
 	// Create the run command to be used in the template
@@ -324,14 +477,15 @@ func createBuildTask(
 		log.Println(rendered)
 	}
 
-	var credentials []*graph.RegistryCredential
+	credentials, err := templating.RenderRegistryCredentials(creds, renderOpts)
+	if err != nil {
+		return nil, err
+	}
+	if credentials, err = graph.ApplyCredentialProvider(credentials, credentialProvider); err != nil {
+		return nil, err
+	}
 	allKnownRegistries := []string{registry}
-	for _, credString := range creds {
-		cred, err := graph.CreateRegistryCredentialFromString(credString)
-		if err != nil {
-			return nil, err
-		}
-		credentials = append(credentials, cred)
+	for _, cred := range credentials {
 		allKnownRegistries = append(allKnownRegistries, cred.Registry)
 	}
 
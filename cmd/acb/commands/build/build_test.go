@@ -53,6 +53,7 @@ func TestCreateBuildTask(t *testing.T) {
 		registry,
 		push,
 		creds,
+		graph.ProviderOrdered,
 		workingDir)
 	if err != nil {
 		t.Fatalf("failed to create build task, err: %v", err)
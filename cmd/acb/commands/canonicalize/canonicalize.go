@@ -0,0 +1,44 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package canonicalize
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/Azure/acr-builder/builder"
+	"github.com/urfave/cli"
+)
+
+// Command prints the canonical form of image references.
+var Command = cli.Command{
+	Name:      "canonicalize",
+	Usage:     "print the canonical form of image references, normalized like the references whose digests are resolved, without contacting any registry",
+	ArgsUsage: "<reference> [reference...]",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "default-tag",
+			Usage: "the tag of references without a tag or digest",
+			Value: builder.DefaultTag,
+		},
+	},
+	Action: func(context *cli.Context) error {
+		var (
+			refs       = context.Args()
+			defaultTag = context.String("default-tag")
+		)
+		if len(refs) == 0 {
+			return errors.New("canonicalize requires at least one reference, see canonicalize --help")
+		}
+
+		for _, ref := range refs {
+			canonical, err := builder.CanonicalizeReference(ref, defaultTag)
+			if err != nil {
+				return err
+			}
+			fmt.Println(canonical)
+		}
+		return nil
+	},
+}
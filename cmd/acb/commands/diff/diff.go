@@ -0,0 +1,211 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package diff
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/Azure/acr-builder/templating"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	textFormat = "text"
+	jsonFormat = "json"
+)
+
+// Command renders and expands two task files and prints how their steps differ.
+var Command = cli.Command{
+	Name:      "diff",
+	Usage:     "render and expand two task files and print how their steps differ",
+	ArgsUsage: "<old> <new>, each the path to a task file or <revision>:<path> for a task file as of a git revision",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "the format of the diff, either text or json",
+			Value: textFormat,
+		},
+
+		// Rendering options
+		cli.StringFlag{
+			Name:  "values",
+			Usage: "the path to the values file to use for rendering",
+		},
+		cli.StringFlag{
+			Name:  "encoded-values",
+			Usage: "a base64 encoded values file to use for rendering",
+		},
+		cli.StringFlag{
+			Name:  "id",
+			Usage: "the unique run identifier",
+		},
+		cli.StringFlag{
+			Name:  "commit,c",
+			Usage: "the commit SHA that triggered the run",
+		},
+		cli.StringFlag{
+			Name:  "repository",
+			Usage: "the run's repository",
+		},
+		cli.StringFlag{
+			Name:  "branch",
+			Usage: "the git branch",
+		},
+		cli.StringFlag{
+			Name:  "triggered-by",
+			Usage: "describes what the run was triggered by",
+		},
+		cli.StringFlag{
+			Name:  "git-tag",
+			Usage: "the git tag that triggered the run",
+		},
+		cli.StringFlag{
+			Name:  "registry,r",
+			Usage: "the fully qualified name of the registry",
+		},
+		cli.StringFlag{
+			Name:  "os-version",
+			Usage: "the version of the OS",
+		},
+		cli.StringSliceFlag{
+			Name:  "set",
+			Usage: "set values on the command line (use --set multiple times or use commas: key1=val1,key2=val2)",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "the name of the task",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		var (
+			format = context.String("format")
+
+			// Rendering options
+			values        = context.String("values")
+			encodedValues = context.String("encoded-values")
+			id            = context.String("id")
+			commit        = context.String("commit")
+			repository    = context.String("repository")
+			branch        = context.String("branch")
+			triggeredBy   = context.String("triggered-by")
+			tag           = context.String("git-tag")
+			registry      = context.String("registry")
+			osVersion     = context.String("os-version")
+			setVals       = context.StringSlice("set")
+			taskName      = context.String("name")
+		)
+
+		if context.NArg() != 2 {
+			return errors.New("two task files are required, e.g. acb diff HEAD~1:acb.yaml acb.yaml")
+		}
+		if format != textFormat && format != jsonFormat {
+			return fmt.Errorf("invalid format '%s', expected %s or %s", format, textFormat, jsonFormat)
+		}
+
+		ctx := gocontext.Background()
+		// Both task files are rendered with the same metadata, so only changes to the files are reported.
+		// Secrets aren't resolved, their placeholders are rendered instead.
+		renderOpts := &templating.BaseRenderOptions{
+			ValuesFile:              values,
+			Base64EncodedValuesFile: encodedValues,
+			TemplateValues:          setVals,
+			ID:                      id,
+			Commit:                  commit,
+			Repository:              repository,
+			Branch:                  branch,
+			TriggeredBy:             triggeredBy,
+			GitTag:                  tag,
+			Registry:                registry,
+			Date:                    time.Now().UTC(),
+			OS:                      runtime.GOOS,
+			OSVersion:               osVersion,
+			Architecture:            runtime.GOARCH,
+			SecretResolveTimeout:    secretmgmt.DefaultSecretResolveTimeout,
+			TaskName:                taskName,
+			LazySecrets:             true,
+		}
+		renderOpts.PopulateBuildMetadata(ctx, ".")
+
+		before, err := loadTask(ctx, context.Args().Get(0), renderOpts)
+		if err != nil {
+			return err
+		}
+		after, err := loadTask(ctx, context.Args().Get(1), renderOpts)
+		if err != nil {
+			return err
+		}
+		taskDiff, err := graph.DiffTasks(before, after)
+		if err != nil {
+			return err
+		}
+
+		if format == jsonFormat {
+			bytes, err := json.MarshalIndent(taskDiff, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal the diff")
+			}
+			fmt.Println(string(bytes))
+			return nil
+		}
+		fmt.Println(taskDiff)
+		return nil
+	},
+}
+
+// loadTask renders and expands the task file at path, or, if path is in the format of <revision>:<path>
+// and isn't an existing file, the task file as of the git revision.
+func loadTask(ctx gocontext.Context, path string, renderOpts *templating.BaseRenderOptions) (*graph.Task, error) {
+	var template *templating.Template
+	var err error
+	if _, statErr := os.Stat(path); statErr != nil && strings.Contains(path, ":") {
+		i := strings.Index(path, ":")
+		if template, err = templating.LoadTemplateAtRevision(ctx, ".", path[:i], path[i+1:]); err != nil {
+			return nil, err
+		}
+	} else if template, err = templating.LoadTemplate(path); err != nil {
+		return nil, err
+	}
+
+	var alias *graph.Alias
+	shouldIncludeAlias := graph.FindVersion(template.GetData()) >= "v1.1.0"
+	if shouldIncludeAlias {
+		aliasData, taskData := graph.SeparateAliasFromRest(template.GetData())
+		renderedAlias, err := templating.LoadAndRenderSteps(ctx, templating.NewTemplate("aliasData", aliasData), renderOpts)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to render alias data of %s", path)
+		}
+		processedTask, processedAlias, err := graph.SearchReplaceAlias(template.GetData(), []byte(renderedAlias), taskData)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to search/replace aliases in %s", path)
+		}
+		alias = processedAlias
+		template.Data = processedTask
+	}
+
+	rendered, err := templating.LoadAndRenderSteps(ctx, template, renderOpts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to render %s", path)
+	}
+	task, err := graph.UnmarshalTaskFromString(ctx, rendered, &graph.TaskOptions{
+		TaskName: renderOpts.TaskName,
+		Registry: renderOpts.Registry,
+		TaskFile: path,
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to unmarshal %s", path)
+	}
+	if shouldIncludeAlias {
+		graph.ExpandCommandAliases(alias, task)
+	}
+	return task, nil
+}
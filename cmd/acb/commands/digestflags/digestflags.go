@@ -0,0 +1,211 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+// Package digestflags defines the flags of the commands which resolve base image digests.
+package digestflags
+
+import (
+	gocontext "context"
+
+	"github.com/Azure/acr-builder/builder"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+// Flags configure how base image digests are resolved, see Parse.
+var Flags = []cli.Flag{
+	cli.StringSliceFlag{
+		Name:  "platform-preference",
+		Usage: "the ordered list of platforms used to select a manifest when a base image is a manifest list (use --platform-preference multiple times)",
+	},
+	cli.BoolFlag{
+		Name:  "prefer-host-platform",
+		Usage: "select the host's platform when a base image is a manifest list and no --platform-preference is specified, instead of using the manifest list's digest",
+	},
+	cli.BoolFlag{
+		Name:  "prefer-oci-media-types",
+		Usage: "prefer the OCI variant of base images which registries serve as both OCI and Docker manifests, which can change their resolved digests",
+	},
+	cli.StringFlag{
+		Name:  "digest-allowlist",
+		Usage: "the path or URL of a file listing the approved base image digests, one per line",
+	},
+	cli.StringFlag{
+		Name:  "mutable-tag-policy",
+		Usage: "what to do when a base image is referenced by a mutable tag without a digest: warn, error, or off",
+		Value: string(builder.MutableTagPolicyWarn),
+	},
+	cli.BoolFlag{
+		Name:  "require-credentials",
+		Usage: "fails instead of anonymously resolving base image digests from registries without credentials",
+	},
+	cli.StringSliceFlag{
+		Name:  "allowed-registry",
+		Usage: "a registry which may be contacted, e.g. myregistry.azurecr.io or *.azurecr.io, all others are rejected (use --allowed-registry multiple times)",
+	},
+	cli.StringSliceFlag{
+		Name:  "public-registry",
+		Usage: "a registry which can be accessed anonymously when --require-credentials is set (use --public-registry multiple times)",
+	},
+	cli.BoolFlag{
+		Name:  "anonymous-first",
+		Usage: "resolves base image digests anonymously first, and only uses the registry's credentials if the anonymous request is refused",
+	},
+	cli.StringSliceFlag{
+		Name:  "rewrite-rule",
+		Usage: "rewrites base image references before resolving their digests in the format of 'prefix;from;to' or 'regex;pattern;replacement' (use --rewrite-rule multiple times)",
+	},
+	cli.StringFlag{
+		Name:  "default-tag",
+		Usage: "the tag whose digest is resolved from registries for base images which don't specify a tag or digest",
+		Value: builder.DefaultTag,
+	},
+	cli.StringFlag{
+		Name:  "lock-file",
+		Usage: "the path to a lock file which base image digests are read from instead of resolving them",
+	},
+	cli.Float64Flag{
+		Name:  "registry-rate-limit",
+		Usage: "the maximum number of base image digests resolved, and image push attempts, per second against each registry, 0 for no limit",
+	},
+	cli.IntFlag{
+		Name:  "registry-max-concurrency",
+		Usage: "the maximum number of base image digests resolved concurrently against each registry, 0 for no limit",
+	},
+	cli.StringSliceFlag{
+		Name:  "client-certificate",
+		Usage: "a TLS client certificate used to resolve base image digests in the format of 'registry;certFile;keyFile' (use --client-certificate multiple times)",
+	},
+	cli.StringFlag{
+		Name:  "proxy-username",
+		Usage: "the username used to authenticate to the forward proxy, e.g. HTTPS_PROXY, when resolving base image digests",
+	},
+	cli.StringFlag{
+		Name:  "proxy-password",
+		Usage: "the password used to authenticate to the forward proxy when resolving base image digests",
+	},
+	cli.BoolFlag{
+		Name:  "disable-http2",
+		Usage: "resolves base image digests over HTTP/1.1 only, for registries or proxies which break under HTTP/2",
+	},
+	cli.StringSliceFlag{
+		Name:  "proxy-cache",
+		Usage: "resolves base image digests from an upstream registry through a pull-through cache in the format of 'upstream;cacheRegistry[/prefix]', images are still pulled from the upstream registry (use --proxy-cache multiple times)",
+	},
+	cli.Int64Flag{
+		Name:  "max-manifest-size",
+		Usage: "the maximum size in bytes of a base image's manifest list fetched to select a platform",
+		Value: builder.DefaultMaxManifestSize,
+	},
+	cli.DurationFlag{
+		Name:  "resolve-timeout",
+		Usage: "the timeout of each attempt to resolve a base image digest, e.g. 30s, 0 for no timeout",
+	},
+	cli.IntFlag{
+		Name:  "resolve-retries",
+		Usage: "the number of times resolving a base image digest is retried after it fails",
+	},
+	cli.StringSliceFlag{
+		Name:  "registry-resolve-policy",
+		Usage: "overrides --resolve-timeout and --resolve-retries for a registry, which may be a wildcard such as *.docker.io, in the format of 'registry;timeout;retries' (use --registry-resolve-policy multiple times)",
+	},
+}
+
+// Options configure how base image digests are resolved, parsed from the Flags.
+type Options struct {
+	Remote           *builder.RemoteDigestOptions
+	Allowlist        *builder.DigestAllowlist
+	MutableTagPolicy builder.MutableTagPolicy
+	Rewriter         *builder.ReferenceRewriter
+
+	// LockFile is the path of the lock file, and Lock the lock file read from it, if it isn't being refreshed.
+	LockFile string
+	Lock     *builder.LockFile
+}
+
+// Parse parses the Flags of the command. The lock file isn't read if updateLock is set, since it's refreshed instead.
+func Parse(ctx gocontext.Context, context *cli.Context, updateLock bool) (*Options, error) {
+	opts := &Options{LockFile: context.String("lock-file")}
+	var err error
+	if digestAllowlist := context.String("digest-allowlist"); digestAllowlist != "" {
+		if opts.Allowlist, err = builder.LoadDigestAllowlist(ctx, digestAllowlist); err != nil {
+			return nil, err
+		}
+	}
+	if opts.MutableTagPolicy, err = builder.ParseMutableTagPolicy(context.String("mutable-tag-policy")); err != nil {
+		return nil, err
+	}
+	clientCerts, err := builder.ParseClientCertificates(context.StringSlice("client-certificate"))
+	if err != nil {
+		return nil, err
+	}
+	resolveTimeout, resolveRetries := context.Duration("resolve-timeout"), context.Int("resolve-retries")
+	if resolveTimeout < 0 || resolveRetries < 0 {
+		return nil, errors.New("--resolve-timeout and --resolve-retries can't be negative")
+	}
+	registryResolvePolicies, err := builder.ParseResolvePolicies(context.StringSlice("registry-resolve-policy"))
+	if err != nil {
+		return nil, err
+	}
+	var proxyCreds *builder.ProxyCredentials
+	if proxyUsername, proxyPassword := context.String("proxy-username"), context.String("proxy-password"); proxyUsername != "" || proxyPassword != "" {
+		proxyCreds = &builder.ProxyCredentials{Username: proxyUsername, Password: proxyPassword}
+	}
+	proxyCaches, err := builder.ParseProxyCaches(context.StringSlice("proxy-cache"))
+	if err != nil {
+		return nil, err
+	}
+	limiter, err := builder.NewRegistryLimiter(builder.RegistryLimits{
+		RequestsPerSecond: context.Float64("registry-rate-limit"),
+		MaxConcurrency:    context.Int("registry-max-concurrency"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if opts.LockFile != "" && !updateLock {
+		if opts.Lock, err = builder.LoadLockFile(opts.LockFile); err != nil {
+			return nil, err
+		}
+	}
+	rules, err := builder.ParseRewriteRules(context.StringSlice("rewrite-rule"))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Rewriter, err = builder.NewReferenceRewriter(rules); err != nil {
+		return nil, err
+	}
+	var registryAllowlist *builder.RegistryAllowlist
+	if allowedRegistries := context.StringSlice("allowed-registry"); len(allowedRegistries) > 0 {
+		if registryAllowlist, err = builder.NewRegistryAllowlist(allowedRegistries); err != nil {
+			return nil, err
+		}
+	}
+	opts.Remote = &builder.RemoteDigestOptions{
+		PreferredPlatforms:      context.StringSlice("platform-preference"),
+		DefaultToHostPlatform:   context.Bool("prefer-host-platform"),
+		PreferOCIMediaTypes:     context.Bool("prefer-oci-media-types"),
+		RequireCredentials:      context.Bool("require-credentials"),
+		PublicRegistries:        context.StringSlice("public-registry"),
+		AnonymousFirst:          context.Bool("anonymous-first"),
+		ClientCertificates:      clientCerts,
+		ProxyCredentials:        proxyCreds,
+		DisableHTTP2:            context.Bool("disable-http2"),
+		ProxyCaches:             proxyCaches,
+		MaxManifestSize:         context.Int64("max-manifest-size"),
+		DefaultTag:              context.String("default-tag"),
+		Limiter:                 limiter,
+		ResolvePolicy:           builder.ResolvePolicy{Timeout: resolveTimeout, Retries: resolveRetries},
+		RegistryResolvePolicies: registryResolvePolicies,
+		RegistryAllowlist:       registryAllowlist,
+	}
+	return opts, nil
+}
+
+// Apply configures the builder to resolve base image digests with the options.
+func (o *Options) Apply(b *builder.Builder) {
+	b.SetRemoteDigestOptions(o.Remote)
+	b.SetDigestAllowlist(o.Allowlist)
+	b.SetMutableTagPolicy(o.MutableTagPolicy)
+	b.SetReferenceRewriter(o.Rewriter)
+	b.SetLockFile(o.Lock)
+}
@@ -7,15 +7,19 @@ import (
 	gocontext "context"
 	"fmt"
 	"log"
+	"os"
 	"runtime"
+	"strings"
 	"time"
 
 	"github.com/Azure/acr-builder/builder"
+	"github.com/Azure/acr-builder/cmd/acb/commands/digestflags"
 	"github.com/Azure/acr-builder/graph"
 	"github.com/Azure/acr-builder/pkg/procmanager"
 	"github.com/Azure/acr-builder/pkg/volume"
 	"github.com/Azure/acr-builder/secretmgmt"
 	"github.com/Azure/acr-builder/templating"
+	"github.com/Azure/acr-builder/util"
 	"github.com/google/uuid"
 	"github.com/pkg/errors"
 	"github.com/urfave/cli"
@@ -23,22 +27,29 @@ import (
 
 const (
 	defaultTaskFile = "acb.yaml"
+
+	// logSinkCloseTimeout is how long the remaining log events are sent to the log sink for once the task completes.
+	logSinkCloseTimeout = 30 * time.Second
 )
 
 // Command executes a task file.
 var Command = cli.Command{
 	Name:  "exec",
 	Usage: "execute a task file",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		// Task options
 		cli.StringFlag{
 			Name:  "file,f",
-			Usage: "the path to the task file",
+			Usage: "the path to the task file, or - to read it from stdin",
 		},
 		cli.StringFlag{
 			Name:  "encoded-file",
 			Usage: "a base64 encoded task file",
 		},
+		cli.StringFlag{
+			Name:  "bundle",
+			Usage: "the path to a bundle containing the task file, values and credentials, or - to read it from stdin",
+		},
 		cli.StringFlag{
 			Name:  "working-directory",
 			Usage: "the default working directory to use if the underlying Task doesn't have one specified",
@@ -55,14 +66,159 @@ var Command = cli.Command{
 			Name:  "credential",
 			Usage: "login credentials for custom registry",
 		},
+		cli.StringFlag{
+			Name:   "credential-provider",
+			Usage:  "the credential provider tried first for registries with several credentials, either ordered, auto, msi or opaque, where auto prefers msi if the environment indicates a managed identity",
+			Value:  graph.ProviderOrdered,
+			EnvVar: "ACB_CREDENTIAL_PROVIDER",
+		},
+		cli.BoolFlag{
+			Name:  "lazy-secrets",
+			Usage: "resolve each secret the first time a step using it is about to run, rather than all of them before the task runs, so the secrets of steps which don't run are never fetched",
+		},
 		cli.BoolFlag{
 			Name:  "dry-run",
 			Usage: "evaluates the command, but doesn't execute it",
 		},
+		cli.BoolFlag{
+			Name:  "print-commands",
+			Usage: "print the docker command of each step, with secrets redacted, and skip the step instead of running it. Digests are still resolved, combine with --dry-run to run nothing",
+		},
 		cli.BoolFlag{
 			Name:  "debug",
 			Usage: "enables diagnostic logging",
 		},
+		cli.StringFlag{
+			Name:  "verbosity",
+			Usage: "how much is logged, either quiet, normal or debug. --debug implies debug",
+			Value: "normal",
+		},
+		cli.StringSliceFlag{
+			Name:  "warm-registry",
+			Usage: "a registry to connect to, along with its auth service, right before the steps run, whose connection is then reused to resolve base image digests (use --warm-registry multiple times)",
+		},
+		cli.IntFlag{
+			Name:  "max-parallel",
+			Usage: "the maximum number of steps run at once, regardless of their dependencies, 0 for no limit",
+			Value: builder.DefaultMaxParallel(),
+		},
+		cli.BoolFlag{
+			Name:  "keep-going",
+			Usage: "keep running the steps which don't depend on a failed step instead of failing fast, skipping the steps which do",
+		},
+		cli.StringFlag{
+			Name:  "cancel-file",
+			Usage: "the path to a file listing the IDs of steps to cancel, one per line, read each time acb receives SIGUSR1",
+		},
+		cli.StringFlag{
+			Name:  "summary-format",
+			Usage: "the format of the summary written once the steps complete, either text, json or junit",
+			Value: builder.SummaryFormatText,
+		},
+		cli.StringFlag{
+			Name:  "summary-output",
+			Usage: "the path to write the summary to instead of the log",
+		},
+		cli.StringFlag{
+			Name:  "containerd-address",
+			Usage: "the address of the containerd socket, e.g. " + builder.DefaultContainerdAddress + ", whose image store base image digests are populated from before resolving them from their registries",
+		},
+		cli.StringFlag{
+			Name:  "containerd-namespace",
+			Usage: "the containerd namespace of the images used by --containerd-address",
+			Value: builder.DefaultContainerdNamespace,
+		},
+		cli.StringSliceFlag{
+			Name:  "image-tarball",
+			Usage: "the path of an image tarball, e.g. saved by docker save, which base image digests are populated from before any other source (use --image-tarball multiple times)",
+		},
+		cli.StringFlag{
+			Name:  "step-output",
+			Usage: "how the output of steps is written, either prefixed, which prefixes each line with the step's ID, grouped, which writes each step's output once it completes, or raw",
+			Value: builder.StepOutputPrefixed,
+		},
+		cli.BoolFlag{
+			Name:  "step-output-color",
+			Usage: "color the step ID prefixes of the step output",
+		},
+		cli.StringFlag{
+			Name:  "trace-output",
+			Usage: "the path to write a Chrome trace of when each step, its attempts and the resolution of its digests started and ended, along with the rate limits registries report",
+		},
+		cli.StringFlag{
+			Name:  "log-sink",
+			Usage: "stream the output of steps and the log, with secrets scrubbed, to an http(s):// endpoint as newline delimited JSON events, or to a syslog:// (UDP) or syslog+tcp:// server",
+		},
+		cli.IntFlag{
+			Name:  "log-sink-buffer",
+			Usage: "the number of log events buffered for --log-sink, beyond which events are dropped rather than stalling the task",
+			Value: builder.DefaultLogSinkBufferSize,
+		},
+		cli.StringFlag{
+			Name:  "lock-file-output",
+			Usage: "the path to write a lock file pinning each base image to its resolved digest",
+		},
+		cli.StringFlag{
+			Name:  "provenance-output",
+			Usage: "the path to write a SLSA provenance of the pushed images to, recording their resolved base image digests and the executed steps",
+		},
+		cli.BoolFlag{
+			Name:  "provenance-push",
+			Usage: "pushes a SLSA provenance as an OCI referrer of each pushed image",
+		},
+		cli.BoolFlag{
+			Name:  "update-lock",
+			Usage: "resolves base image digests and refreshes the lock file specified by --lock-file",
+		},
+		cli.BoolFlag{
+			Name:  "skip-digests",
+			Usage: "skip resolving base image digests, for fast local iteration where reproducibility doesn't matter",
+		},
+		cli.BoolFlag{
+			Name:  "label-base-images",
+			Usage: "resolve the digests of the base images of build steps before building, and label the images built with them, e.g. base.image.0=<reference>@<digest>",
+		},
+		cli.StringSliceFlag{
+			Name:  "signature-key",
+			Usage: "the path of a PEM encoded public key trusted to sign the base images of build steps with cosign, which are verified before building (use --signature-key multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "signature-identity",
+			Usage: "a signer trusted to sign the base images of build steps keylessly with cosign in the format of 'issuer;identity', e.g. 'https://accounts.google.com;release@example.com' (use --signature-identity multiple times)",
+		},
+		cli.StringFlag{
+			Name:  "signature-roots",
+			Usage: "the path of the PEM encoded certificates of the CAs issuing the certificates of keyless signatures, e.g. Fulcio's root and intermediate",
+		},
+		cli.StringFlag{
+			Name:  "rekor-public-key",
+			Usage: "the path of the PEM encoded public key of the Rekor transparency log, which proves when keyless signatures were made",
+		},
+		cli.IntFlag{
+			Name:  "push-concurrency",
+			Usage: "the maximum number of images pushed concurrently by each push step, 1 to push them one after the other",
+			Value: builder.DefaultPushConcurrency,
+		},
+		cli.StringSliceFlag{
+			Name:  "only",
+			Usage: "only runs the specified step IDs and the steps they depend on (use --only multiple times or use commas: step1,step2)",
+		},
+		cli.StringSliceFlag{
+			Name:  "skip",
+			Usage: "skips the specified step IDs and the steps which only depend on them (use --skip multiple times or use commas: step1,step2)",
+		},
+		cli.BoolFlag{
+			Name:  "dump-graph",
+			Usage: "prints the task's steps and their dependencies as JSON, but doesn't execute the task",
+		},
+		cli.BoolFlag{
+			Name:  "explain",
+			Usage: "explains why each step will run or be blocked, but doesn't execute the task",
+		},
+		cli.StringSliceFlag{
+			Name:  "simulate-failure",
+			Usage: "when used with --explain, simulates a failure of the specified step ID (use --simulate-failure multiple times for multiple steps)",
+		},
 
 		// Rendering options
 		cli.StringFlag{
@@ -117,18 +273,53 @@ var Command = cli.Command{
 			Name:  "name",
 			Usage: "the name of the task",
 		},
-	},
+	}, digestflags.Flags...),
 	Action: func(context *cli.Context) error {
 		var (
 			// Task options
 			taskFile                = context.String("file")
 			encodedTaskFile         = context.String("encoded-file")
+			bundlePath              = context.String("bundle")
 			defaultWorkingDirectory = context.String("working-directory")
 			defaultNetwork          = context.String("network")
 			defaultEnvs             = context.StringSlice("env")
 			creds                   = context.StringSlice("credential")
+			credentialProvider      = context.String("credential-provider")
 			dryRun                  = context.Bool("dry-run")
+			printCommands           = context.Bool("print-commands")
+			lazySecrets             = context.Bool("lazy-secrets")
 			debug                   = context.Bool("debug")
+			verbosity               = context.String("verbosity")
+			warmRegistries          = context.StringSlice("warm-registry")
+			lockFileOutput          = context.String("lock-file-output")
+			provenanceOutput        = context.String("provenance-output")
+			provenancePush          = context.Bool("provenance-push")
+			traceOutput             = context.String("trace-output")
+			logSink                 = context.String("log-sink")
+			logSinkBuffer           = context.Int("log-sink-buffer")
+			cancelFile              = context.String("cancel-file")
+			maxParallel             = context.Int("max-parallel")
+			keepGoing               = context.Bool("keep-going")
+			summaryFormat           = context.String("summary-format")
+			summaryOutput           = context.String("summary-output")
+			stepOutputMode          = context.String("step-output")
+			containerdAddress       = context.String("containerd-address")
+			containerdNamespace     = context.String("containerd-namespace")
+			imageTarballs           = context.StringSlice("image-tarball")
+			stepOutputColor         = context.Bool("step-output-color")
+			updateLock              = context.Bool("update-lock")
+			skipDigests             = context.Bool("skip-digests")
+			labelBaseImages         = context.Bool("label-base-images")
+			signatureKeys           = context.StringSlice("signature-key")
+			signatureIdentities     = context.StringSlice("signature-identity")
+			signatureRoots          = context.String("signature-roots")
+			rekorPublicKey          = context.String("rekor-public-key")
+			pushConcurrency         = context.Int("push-concurrency")
+			explain                 = context.Bool("explain")
+			simulatedFailures       = context.StringSlice("simulate-failure")
+			dumpGraph               = context.Bool("dump-graph")
+			onlySteps               = splitStepIDs(context.StringSlice("only"))
+			skipSteps               = splitStepIDs(context.StringSlice("skip"))
 
 			// Rendering options
 			values        = context.String("values")
@@ -146,15 +337,48 @@ var Command = cli.Command{
 			taskName      = context.String("name")
 		)
 
-		if taskFile == "" && encodedTaskFile == "" {
+		verbosityLevel, err := util.ParseVerbosity(verbosity)
+		if err != nil {
+			return err
+		}
+		if debug {
+			verbosityLevel = util.VerbosityDebug
+		} else if verbosityLevel == util.VerbosityDebug {
+			debug = true
+		}
+		util.SetVerbosity(verbosityLevel)
+
+		var bundle *templating.Bundle
+		if bundlePath != "" {
+			if taskFile != "" || encodedTaskFile != "" {
+				return errors.New("--bundle can't be used with --file or --encoded-file")
+			}
+			if bundle, err = templating.LoadBundle(bundlePath); err != nil {
+				return err
+			}
+			if bundle.Values != "" {
+				if values != "" || encodedValues != "" {
+					return errors.New("--values and --encoded-values can't be used with a bundle which contains values")
+				}
+				encodedValues = bundle.EncodedValues()
+			}
+			bundleCreds, err := bundle.CredentialStrings()
+			if err != nil {
+				return err
+			}
+			// Credentials passed with --credential are added to the bundle's.
+			creds = append(bundleCreds, creds...)
+		} else if taskFile == "" && encodedTaskFile == "" {
 			taskFile = defaultTaskFile
 		}
 
 		ctx := gocontext.Background()
 		pm := procmanager.NewProcManager(dryRun)
+		// Cancelling a step kills its process group, so each step needs its own.
+		pm.SetProcessGroups(cancelFile != "")
 
 		if homevol == "" {
-			if !dryRun {
+			if !dryRun && !explain && !dumpGraph {
 				homevol = fmt.Sprintf("%s%s", volume.DockerVolumeHelperPrefix, uuid.New())
 				v := volume.NewDockerVolumeHelper(homevol, pm)
 				if msg, err := v.Create(ctx); err != nil {
@@ -186,11 +410,15 @@ var Command = cli.Command{
 			Architecture:            runtime.GOARCH,
 			SecretResolveTimeout:    secretmgmt.DefaultSecretResolveTimeout,
 			TaskName:                taskName,
+			LazySecrets:             lazySecrets,
 		}
+		// Metadata not passed in is computed once, so the task renders the same values everywhere.
+		renderOpts.PopulateBuildMetadata(ctx, ".")
 
 		var template *templating.Template
-		var err error
-		if taskFile == "" {
+		if bundle != nil {
+			template = bundle.Template()
+		} else if taskFile == "" {
 			if template, err = templating.DecodeTemplate(encodedTaskFile); err != nil {
 				return err
 			}
@@ -201,10 +429,13 @@ var Command = cli.Command{
 		}
 
 		// Add all creds provided by the user in the --credential flag
-		credentials, err := graph.CreateRegistryCredentialFromList(creds)
+		credentials, err := templating.RenderRegistryCredentials(creds, renderOpts)
 		if err != nil {
 			return errors.Wrap(err, "error creating registry credentials from given list")
 		}
+		if credentials, err = graph.ApplyCredentialProvider(credentials, credentialProvider); err != nil {
+			return err
+		}
 
 		var task *graph.Task
 		var alias *graph.Alias
@@ -250,6 +481,7 @@ var Command = cli.Command{
 			Credentials:       credentials,
 			TaskName:          taskName,
 			Registry:          registry,
+			TaskFile:          taskFile,
 		})
 		if errUnmarshal != nil {
 			return errors.Wrap(errUnmarshal, "failed to unmarshal task before running")
@@ -259,8 +491,157 @@ var Command = cli.Command{
 			graph.ExpandCommandAliases(alias, task)
 		}
 
+		if explain {
+			explanations, err := task.Explain(simulatedFailures)
+			if err != nil {
+				return err
+			}
+			for _, e := range explanations {
+				log.Println(e)
+			}
+			return nil
+		}
+
+		if err := task.SelectSteps(onlySteps, skipSteps); err != nil {
+			return err
+		}
+
+		if dumpGraph {
+			graphBytes, err := task.MarshalGraph()
+			if err != nil {
+				return err
+			}
+			fmt.Println(string(graphBytes))
+			return nil
+		}
+
+		signaturePolicy, err := builder.NewSignaturePolicy(signatureKeys, signatureIdentities, signatureRoots, rekorPublicKey)
+		if err != nil {
+			return err
+		}
+		digestOpts, err := digestflags.Parse(ctx, context, updateLock)
+		if err != nil {
+			return err
+		}
+		if skipDigests && (digestOpts.LockFile != "" || lockFileOutput != "" || digestOpts.Allowlist != nil || provenanceOutput != "" || provenancePush || labelBaseImages || signaturePolicy != nil) {
+			return errors.New("--skip-digests can't be combined with --lock-file, --lock-file-output, --digest-allowlist, --provenance-output, --provenance-push, --label-base-images, --signature-key or --signature-identity, which require digests")
+		}
+		if updateLock {
+			if digestOpts.LockFile == "" {
+				return errors.New("--update-lock requires --lock-file")
+			}
+			lockFileOutput = digestOpts.LockFile
+		}
+		digestOpts.Remote.ConnectionPool = builder.NewRegistryConnectionPool()
+		if dryRun {
+			coverage, err := builder.TaskCredentialCoverage(task, digestOpts.Remote)
+			if err != nil {
+				return err
+			}
+			log.Println("Credential coverage:")
+			for _, c := range coverage {
+				if c.Gap != nil {
+					log.Printf("WARNING: %s\n", c)
+				} else {
+					log.Println(c)
+				}
+			}
+		}
+		if maxParallel < 0 {
+			return fmt.Errorf("invalid maximum number of parallel steps %d, it can't be negative", maxParallel)
+		}
+		summaryFormatter, err := builder.NewSummaryFormatter(summaryFormat)
+		if err != nil {
+			return err
+		}
+		stepOutput, err := builder.NewStepOutput(stepOutputMode, stepOutputColor, os.Stdout, os.Stderr)
+		if err != nil {
+			return err
+		}
+		var tracer *builder.Tracer
+		if traceOutput != "" {
+			tracer = builder.NewTracer()
+		}
+		var logStreamer *builder.LogStreamer
+		if logSink != "" {
+			if logStreamer, err = builder.NewLogStreamer(logSink, logSinkBuffer); err != nil {
+				return err
+			}
+			logOutput, flushLog := logStreamer.Writer("", builder.LogStreamLog, os.Stderr)
+			log.SetOutput(logOutput)
+			defer func() {
+				flushLog()
+				log.SetOutput(os.Stderr)
+				closeCtx, cancel := gocontext.WithTimeout(gocontext.Background(), logSinkCloseTimeout)
+				defer cancel()
+				logStreamer.Close(closeCtx)
+			}()
+		}
+		var tarballDigest builder.DigestHelper
+		if len(imageTarballs) > 0 {
+			if tarballDigest, err = builder.NewTarballDigest(imageTarballs...); err != nil {
+				return err
+			}
+		}
+		var provenance *builder.ProvenanceOptions
+		if provenanceOutput != "" || provenancePush {
+			provenance = &builder.ProvenanceOptions{Output: provenanceOutput, Push: provenancePush, InvocationID: renderOpts.ID}
+		}
 		builder := builder.NewBuilder(pm, debug, homevol)
+		builder.SetTracer(tracer)
+		builder.SetLogStreamer(logStreamer)
+		if lazySecrets {
+			secretResolver, err := secretmgmt.NewLazySecretResolver(task.Secrets, nil, secretmgmt.DefaultSecretResolveTimeout)
+			if err != nil {
+				return err
+			}
+			builder.SetLazySecretResolver(secretResolver)
+		}
+		digestOpts.Apply(builder)
+		builder.SetLockFileOutput(lockFileOutput)
+		builder.SetProvenance(provenance)
+		builder.SetSkipDigests(skipDigests)
+		builder.SetBaseImageLabels(labelBaseImages)
+		builder.SetSignaturePolicy(signaturePolicy)
+		builder.SetSummaryFormatter(summaryFormatter)
+		builder.SetSummaryOutput(summaryOutput)
+		builder.SetStepOutput(stepOutput)
+		builder.SetContainerdImageStore(containerdAddress, containerdNamespace)
+		builder.SetImageTarballDigest(tarballDigest)
+		builder.SetMaxParallel(maxParallel)
+		builder.SetKeepGoing(keepGoing)
+		builder.SetPrintCommands(printCommands)
+		builder.SetPushConcurrency(pushConcurrency)
+		builder.SetWarmRegistries(warmRegistries)
 		defer builder.CleanTask(gocontext.Background(), task) // Use a separate context since the other may have expired.
-		return builder.RunTask(gocontext.Background(), task)
+		if cancelFile != "" {
+			stopWatching, err := builder.WatchCancelSignal(cancelFile)
+			if err != nil {
+				return err
+			}
+			defer stopWatching()
+		}
+		err = builder.RunTask(gocontext.Background(), task)
+		if tracer != nil {
+			if traceErr := tracer.Write(traceOutput); traceErr != nil {
+				log.Printf("Failed to write the trace to %s: %v\n", traceOutput, traceErr)
+			} else {
+				log.Printf("Wrote trace to %s\n", traceOutput)
+			}
+		}
+		return err
 	},
 }
+
+// splitStepIDs splits comma separated step IDs.
+func splitStepIDs(values []string) []string {
+	var ids []string
+	for _, value := range values {
+		for _, id := range strings.Split(value, ",") {
+			if id = strings.TrimSpace(id); id != "" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
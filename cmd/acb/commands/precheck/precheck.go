@@ -0,0 +1,294 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package precheck
+
+import (
+	gocontext "context"
+	"fmt"
+	"log"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/builder"
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/Azure/acr-builder/templating"
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultTaskFile = "acb.yaml"
+)
+
+// Command verifies that every registry referenced by a task file can be accessed with the configured credentials.
+var Command = cli.Command{
+	Name:  "precheck",
+	Usage: "verify that every registry referenced by a task file can be accessed with the configured credentials",
+	Flags: []cli.Flag{
+		// Task options
+		cli.StringFlag{
+			Name:  "file,f",
+			Usage: "the path to the task file, or - to read it from stdin",
+		},
+		cli.StringFlag{
+			Name:  "encoded-file",
+			Usage: "a base64 encoded task file",
+		},
+		cli.StringSliceFlag{
+			Name:  "credential",
+			Usage: "login credentials for custom registry",
+		},
+		cli.StringFlag{
+			Name:   "credential-provider",
+			Usage:  "the credential provider tried first for registries with several credentials, either ordered, auto, msi or opaque, where auto prefers msi if the environment indicates a managed identity",
+			Value:  graph.ProviderOrdered,
+			EnvVar: "ACB_CREDENTIAL_PROVIDER",
+		},
+		cli.BoolFlag{
+			Name:  "debug",
+			Usage: "enables diagnostic logging",
+		},
+		cli.StringFlag{
+			Name:  "verbosity",
+			Usage: "how much is logged, either quiet, normal or debug. --debug implies debug",
+			Value: "normal",
+		},
+		cli.BoolFlag{
+			Name:  "require-credentials",
+			Usage: "fails registries without credentials instead of accessing them anonymously",
+		},
+		cli.StringSliceFlag{
+			Name:  "allowed-registry",
+			Usage: "a registry which may be contacted, e.g. myregistry.azurecr.io or *.azurecr.io, all others are rejected (use --allowed-registry multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "public-registry",
+			Usage: "a registry which can be accessed anonymously when --require-credentials is set (use --public-registry multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "client-certificate",
+			Usage: "a TLS client certificate used to access a registry in the format of 'registry;certFile;keyFile' (use --client-certificate multiple times)",
+		},
+		cli.StringSliceFlag{
+			Name:  "proxy-cache",
+			Usage: "accesses an upstream registry through a pull-through cache in the format of 'upstream;cacheRegistry[/prefix]' (use --proxy-cache multiple times)",
+		},
+
+		// Rendering options
+		cli.StringFlag{
+			Name:  "values",
+			Usage: "the path to the values file to use for rendering",
+		},
+		cli.StringFlag{
+			Name:  "encoded-values",
+			Usage: "a base64 encoded values file to use for rendering",
+		},
+		cli.StringFlag{
+			Name:  "id",
+			Usage: "the unique run identifier",
+		},
+		cli.StringFlag{
+			Name:  "commit,c",
+			Usage: "the commit SHA that triggered the run",
+		},
+		cli.StringFlag{
+			Name:  "repository",
+			Usage: "the run's repository",
+		},
+		cli.StringFlag{
+			Name:  "branch",
+			Usage: "the git branch",
+		},
+		cli.StringFlag{
+			Name:  "triggered-by",
+			Usage: "describes what the run was triggered by",
+		},
+		cli.StringFlag{
+			Name:  "git-tag",
+			Usage: "the git tag that triggered the run",
+		},
+		cli.StringFlag{
+			Name:  "registry,r",
+			Usage: "the fully qualified name of the registry",
+		},
+		cli.StringFlag{
+			Name:  "os-version",
+			Usage: "the version of the OS",
+		},
+		cli.StringSliceFlag{
+			Name:  "set",
+			Usage: "set values on the command line (use --set multiple times or use commas: key1=val1,key2=val2)",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "the name of the task",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		var (
+			taskFile           = context.String("file")
+			encodedTaskFile    = context.String("encoded-file")
+			creds              = context.StringSlice("credential")
+			credentialProvider = context.String("credential-provider")
+			debug              = context.Bool("debug")
+			verbosity          = context.String("verbosity")
+			requireCredentials = context.Bool("require-credentials")
+			publicRegistries   = context.StringSlice("public-registry")
+			allowedRegistries  = context.StringSlice("allowed-registry")
+			clientCertificates = context.StringSlice("client-certificate")
+			proxyCacheValues   = context.StringSlice("proxy-cache")
+
+			// Rendering options
+			values        = context.String("values")
+			encodedValues = context.String("encoded-values")
+			id            = context.String("id")
+			commit        = context.String("commit")
+			repository    = context.String("repository")
+			branch        = context.String("branch")
+			triggeredBy   = context.String("triggered-by")
+			tag           = context.String("git-tag")
+			registry      = context.String("registry")
+			osVersion     = context.String("os-version")
+			setVals       = context.StringSlice("set")
+			taskName      = context.String("name")
+		)
+
+		verbosityLevel, err := util.ParseVerbosity(verbosity)
+		if err != nil {
+			return err
+		}
+		if debug {
+			verbosityLevel = util.VerbosityDebug
+		}
+		util.SetVerbosity(verbosityLevel)
+
+		if taskFile == "" && encodedTaskFile == "" {
+			taskFile = defaultTaskFile
+		}
+
+		ctx := gocontext.Background()
+		renderOpts := &templating.BaseRenderOptions{
+			TaskFile:                taskFile,
+			Base64EncodedTaskFile:   encodedTaskFile,
+			ValuesFile:              values,
+			Base64EncodedValuesFile: encodedValues,
+			TemplateValues:          setVals,
+			ID:                      id,
+			Commit:                  commit,
+			Repository:              repository,
+			Branch:                  branch,
+			TriggeredBy:             triggeredBy,
+			GitTag:                  tag,
+			Registry:                registry,
+			Date:                    time.Now().UTC(),
+			OS:                      runtime.GOOS,
+			OSVersion:               osVersion,
+			Architecture:            runtime.GOARCH,
+			SecretResolveTimeout:    secretmgmt.DefaultSecretResolveTimeout,
+			TaskName:                taskName,
+		}
+		renderOpts.PopulateBuildMetadata(ctx, ".")
+
+		var template *templating.Template
+		if taskFile == "" {
+			if template, err = templating.DecodeTemplate(encodedTaskFile); err != nil {
+				return err
+			}
+		} else {
+			if template, err = templating.LoadTemplate(taskFile); err != nil {
+				return err
+			}
+		}
+
+		credentials, err := templating.RenderRegistryCredentials(creds, renderOpts)
+		if err != nil {
+			return errors.Wrap(err, "error creating registry credentials from given list")
+		}
+		if credentials, err = graph.ApplyCredentialProvider(credentials, credentialProvider); err != nil {
+			return err
+		}
+
+		var alias *graph.Alias
+		shouldIncludeAlias := graph.FindVersion(template.GetData()) >= "v1.1.0"
+		if shouldIncludeAlias {
+			aliasData, taskData := graph.SeparateAliasFromRest(template.GetData())
+			renderedAlias, err := templating.LoadAndRenderSteps(ctx, templating.NewTemplate("aliasData", aliasData), renderOpts)
+			if err != nil {
+				return errors.Wrap(err, "unable to render alias data")
+			}
+			processedTask, processedAlias, err := graph.SearchReplaceAlias(template.GetData(), []byte(renderedAlias), taskData)
+			if err != nil {
+				return errors.Wrap(err, "unable to search/replace aliases in task")
+			}
+			alias = processedAlias
+			template.Data = processedTask
+		}
+
+		rendered, err := templating.LoadAndRenderSteps(ctx, template, renderOpts)
+		if err != nil {
+			return errors.Wrap(err, "unable to render task")
+		}
+
+		task, err := graph.UnmarshalTaskFromString(ctx, rendered, &graph.TaskOptions{
+			Credentials: credentials,
+			TaskName:    taskName,
+			Registry:    registry,
+			TaskFile:    taskFile,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to unmarshal task")
+		}
+		if shouldIncludeAlias {
+			graph.ExpandCommandAliases(alias, task)
+		}
+
+		clientCerts, err := builder.ParseClientCertificates(clientCertificates)
+		if err != nil {
+			return err
+		}
+		proxyCaches, err := builder.ParseProxyCaches(proxyCacheValues)
+		if err != nil {
+			return err
+		}
+		var registryAllowlist *builder.RegistryAllowlist
+		if len(allowedRegistries) > 0 {
+			if registryAllowlist, err = builder.NewRegistryAllowlist(allowedRegistries); err != nil {
+				return err
+			}
+		}
+		checks, err := builder.PrecheckRegistries(ctx, task, &builder.RemoteDigestOptions{
+			RequireCredentials: requireCredentials,
+			PublicRegistries:   publicRegistries,
+			ClientCertificates: clientCerts,
+			ProxyCaches:        proxyCaches,
+			RegistryAllowlist:  registryAllowlist,
+		})
+		if err != nil {
+			return err
+		}
+
+		failed := 0
+		for _, check := range checks {
+			registry := check.Registry
+			if check.CheckedRegistry != check.Registry {
+				registry = fmt.Sprintf("%s (through %s)", check.Registry, check.CheckedRegistry)
+			}
+			credentials := strings.Join(check.Coverage.Types, ", ")
+			if check.Err != nil {
+				failed++
+				log.Printf("Registry: %s FAILED (credentials: %s, elapsed time in seconds: %f): %v\n", registry, credentials, check.Elapsed.Seconds(), check.Err)
+			} else {
+				log.Printf("Registry: %s OK (credentials: %s, elapsed time in seconds: %f)\n", registry, credentials, check.Elapsed.Seconds())
+			}
+		}
+		if failed > 0 {
+			return fmt.Errorf("%d of %d registries failed the precheck", failed, len(checks))
+		}
+		log.Printf("All %d registries passed the precheck\n", len(checks))
+		return nil
+	},
+}
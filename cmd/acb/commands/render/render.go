@@ -23,7 +23,7 @@ var Command = cli.Command{
 		// Task options
 		cli.StringFlag{
 			Name:  "file,f",
-			Usage: "the path to the task file",
+			Usage: "the path to the task file, or - to read it from stdin",
 		},
 		cli.StringFlag{
 			Name:  "encoded-file",
@@ -125,6 +125,7 @@ var Command = cli.Command{
 		if taskFile == "" && encodedTaskFile == "" {
 			return errors.New("a task file or base64 encoded task file is required")
 		}
+		renderOpts.PopulateBuildMetadata(gocontext.Background(), ".")
 
 		var template *templating.Template
 		var err error
@@ -10,7 +10,10 @@ import (
 	"os"
 	"time"
 
+	"github.com/Azure/acr-builder/builder"
+	"github.com/Azure/acr-builder/cmd/acb/commands/digestflags"
 	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/pkg/image"
 	"github.com/Azure/acr-builder/pkg/procmanager"
 	"github.com/Azure/acr-builder/scan"
 	"github.com/Azure/acr-builder/util"
@@ -23,7 +26,7 @@ var Command = cli.Command{
 	Name:      "scan",
 	Usage:     "scan a Dockerfile for dependencies",
 	ArgsUsage: "[path|url]",
-	Flags: []cli.Flag{
+	Flags: append([]cli.Flag{
 		cli.BoolFlag{
 			Name:  "dry-run",
 			Usage: "evaluates the command, but doesn't execute it",
@@ -63,7 +66,15 @@ var Command = cli.Command{
 			Name:  "credential",
 			Usage: "login credentials for custom registry",
 		},
-	},
+		cli.BoolFlag{
+			Name:  "pin-base-images",
+			Usage: "write a copy of the Dockerfile, with the .pinned suffix, whose base images are pinned to their digests",
+		},
+		cli.StringSliceFlag{
+			Name:  "lock-entry",
+			Usage: "pins a base image to the digest locked for it in the format of 'reference;platform;digest', like an entry of --lock-file (use --lock-entry multiple times)",
+		},
+	}, digestflags.Flags...),
 	Action: func(context *cli.Context) error {
 		var (
 			downloadCtx = context.Args().First()
@@ -76,6 +87,8 @@ var Command = cli.Command{
 			target      = context.String("target")
 			timeout     = time.Duration(context.Int64("timeout")) * time.Second
 			creds       = context.StringSlice("credential")
+			pin         = context.Bool("pin-base-images")
+			lockEntries = context.StringSlice("lock-entry")
 		)
 
 		if downloadCtx == "" {
@@ -99,7 +112,7 @@ var Command = cli.Command{
 			return err
 		}
 		registryLoginCredentials := make(graph.RegistryLoginCredentials)
-		if util.IsRegistryArtifact(downloadCtx) {
+		if util.IsRegistryArtifact(downloadCtx) || pin {
 			registryLoginCredentials, err = graph.ResolveCustomRegistryCredentials(ctx, credentials)
 			if err != nil {
 				return err
@@ -111,11 +124,45 @@ var Command = cli.Command{
 			return err
 		}
 
+		var pinned *pinnedBaseImages
+		if pin {
+			// Base images are pinned to the digests exec and build would resolve for them.
+			digestOpts, err := digestflags.Parse(ctx, context, false)
+			if err != nil {
+				return err
+			}
+			if len(lockEntries) > 0 {
+				if digestOpts.LockFile != "" {
+					return errors.New("--lock-entry can't be combined with --lock-file")
+				}
+				if digestOpts.Lock, err = builder.ParseLockEntries(lockEntries); err != nil {
+					return err
+				}
+			}
+			b := builder.NewBuilder(pm, false, "")
+			digestOpts.Apply(b)
+			digester, err := b.BaseImageDigester(registryLoginCredentials, credentials)
+			if err != nil {
+				return err
+			}
+			pinned = &pinnedBaseImages{helper: digester}
+			scanner.SetBaseImagePinner(pinned)
+		}
+
 		deps, err := scanner.Scan(ctx)
 		if err != nil {
 			return err
 		}
 
+		if pinned != nil {
+			// The digests the Dockerfile was pinned to are reported like a lock file, see builder.PinnedBaseImagesPrefix.
+			lockBytes, err := json.Marshal(builder.NewLockFile([]*image.Dependencies{{Buildtime: pinned.refs}}))
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal the pinned base images")
+			}
+			log.Println(builder.PinnedBaseImagesPrefix + string(lockBytes))
+		}
+
 		bytes, err := json.Marshal(deps)
 		if err != nil {
 			return errors.Wrap(err, "failed to unmarshal image dependencies")
@@ -126,3 +173,18 @@ var Command = cli.Command{
 		return nil
 	},
 }
+
+// pinnedBaseImages records the base images whose digests helper populates to pin them.
+type pinnedBaseImages struct {
+	helper builder.DigestHelper
+	refs   []*image.Reference
+}
+
+func (p *pinnedBaseImages) PopulateDigest(ctx gocontext.Context, ref *image.Reference) error {
+	if err := p.helper.PopulateDigest(ctx, ref); err != nil {
+		return err
+	}
+	pinned := *ref
+	p.refs = append(p.refs, &pinned)
+	return nil
+}
@@ -0,0 +1,228 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package secrets
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"fmt"
+	"runtime"
+	"time"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/Azure/acr-builder/templating"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli"
+)
+
+const (
+	defaultTaskFile = "acb.yaml"
+	textFormat      = "text"
+	jsonFormat      = "json"
+)
+
+// Command lists the secrets which a task file and its credentials access, without resolving them.
+var Command = cli.Command{
+	Name:  "secrets",
+	Usage: "list the secrets which a task file and its credentials access, without resolving them",
+	Flags: []cli.Flag{
+		cli.StringFlag{
+			Name:  "format",
+			Usage: "the format of the list, either text or json",
+			Value: textFormat,
+		},
+
+		// Task options
+		cli.StringFlag{
+			Name:  "file,f",
+			Usage: "the path to the task file, or - to read it from stdin",
+		},
+		cli.StringFlag{
+			Name:  "encoded-file",
+			Usage: "a base64 encoded task file",
+		},
+		cli.StringSliceFlag{
+			Name:  "credential",
+			Usage: "login credentials for custom registry",
+		},
+
+		// Rendering options
+		cli.StringFlag{
+			Name:  "values",
+			Usage: "the path to the values file to use for rendering",
+		},
+		cli.StringFlag{
+			Name:  "encoded-values",
+			Usage: "a base64 encoded values file to use for rendering",
+		},
+		cli.StringFlag{
+			Name:  "id",
+			Usage: "the unique run identifier",
+		},
+		cli.StringFlag{
+			Name:  "commit,c",
+			Usage: "the commit SHA that triggered the run",
+		},
+		cli.StringFlag{
+			Name:  "repository",
+			Usage: "the run's repository",
+		},
+		cli.StringFlag{
+			Name:  "branch",
+			Usage: "the git branch",
+		},
+		cli.StringFlag{
+			Name:  "triggered-by",
+			Usage: "describes what the run was triggered by",
+		},
+		cli.StringFlag{
+			Name:  "git-tag",
+			Usage: "the git tag that triggered the run",
+		},
+		cli.StringFlag{
+			Name:  "registry,r",
+			Usage: "the fully qualified name of the registry",
+		},
+		cli.StringFlag{
+			Name:  "os-version",
+			Usage: "the version of the OS",
+		},
+		cli.StringSliceFlag{
+			Name:  "set",
+			Usage: "set values on the command line (use --set multiple times or use commas: key1=val1,key2=val2)",
+		},
+		cli.StringFlag{
+			Name:  "name",
+			Usage: "the name of the task",
+		},
+	},
+	Action: func(context *cli.Context) error {
+		var (
+			format          = context.String("format")
+			taskFile        = context.String("file")
+			encodedTaskFile = context.String("encoded-file")
+			creds           = context.StringSlice("credential")
+
+			// Rendering options
+			values        = context.String("values")
+			encodedValues = context.String("encoded-values")
+			id            = context.String("id")
+			commit        = context.String("commit")
+			repository    = context.String("repository")
+			branch        = context.String("branch")
+			triggeredBy   = context.String("triggered-by")
+			tag           = context.String("git-tag")
+			registry      = context.String("registry")
+			osVersion     = context.String("os-version")
+			setVals       = context.StringSlice("set")
+			taskName      = context.String("name")
+		)
+
+		if format != textFormat && format != jsonFormat {
+			return fmt.Errorf("invalid format '%s', expected %s or %s", format, textFormat, jsonFormat)
+		}
+		if taskFile == "" && encodedTaskFile == "" {
+			taskFile = defaultTaskFile
+		}
+
+		ctx := gocontext.Background()
+		// Secrets aren't resolved, their placeholders are rendered instead, so no secret store is contacted
+		// and the steps using each secret can be found by its placeholder.
+		renderOpts := &templating.BaseRenderOptions{
+			TaskFile:                taskFile,
+			Base64EncodedTaskFile:   encodedTaskFile,
+			ValuesFile:              values,
+			Base64EncodedValuesFile: encodedValues,
+			TemplateValues:          setVals,
+			ID:                      id,
+			Commit:                  commit,
+			Repository:              repository,
+			Branch:                  branch,
+			TriggeredBy:             triggeredBy,
+			GitTag:                  tag,
+			Registry:                registry,
+			Date:                    time.Now().UTC(),
+			OS:                      runtime.GOOS,
+			OSVersion:               osVersion,
+			Architecture:            runtime.GOARCH,
+			SecretResolveTimeout:    secretmgmt.DefaultSecretResolveTimeout,
+			TaskName:                taskName,
+			LazySecrets:             true,
+		}
+		renderOpts.PopulateBuildMetadata(ctx, ".")
+
+		var template *templating.Template
+		var err error
+		if taskFile == "" {
+			if template, err = templating.DecodeTemplate(encodedTaskFile); err != nil {
+				return err
+			}
+		} else {
+			if template, err = templating.LoadTemplate(taskFile); err != nil {
+				return err
+			}
+		}
+
+		credentials, err := templating.RenderRegistryCredentials(creds, renderOpts)
+		if err != nil {
+			return errors.Wrap(err, "error creating registry credentials from given list")
+		}
+
+		var alias *graph.Alias
+		shouldIncludeAlias := graph.FindVersion(template.GetData()) >= "v1.1.0"
+		if shouldIncludeAlias {
+			aliasData, taskData := graph.SeparateAliasFromRest(template.GetData())
+			renderedAlias, err := templating.LoadAndRenderSteps(ctx, templating.NewTemplate("aliasData", aliasData), renderOpts)
+			if err != nil {
+				return errors.Wrap(err, "unable to render alias data")
+			}
+			processedTask, processedAlias, err := graph.SearchReplaceAlias(template.GetData(), []byte(renderedAlias), taskData)
+			if err != nil {
+				return errors.Wrap(err, "unable to search/replace aliases in task")
+			}
+			alias = processedAlias
+			template.Data = processedTask
+		}
+
+		rendered, err := templating.LoadAndRenderSteps(ctx, template, renderOpts)
+		if err != nil {
+			return errors.Wrap(err, "unable to render task")
+		}
+
+		// The credentials aren't passed to the task, since it would resolve them.
+		task, err := graph.UnmarshalTaskFromString(ctx, rendered, &graph.TaskOptions{
+			TaskName: taskName,
+			Registry: registry,
+			TaskFile: taskFile,
+		})
+		if err != nil {
+			return errors.Wrap(err, "failed to unmarshal task")
+		}
+		if shouldIncludeAlias {
+			graph.ExpandCommandAliases(alias, task)
+		}
+
+		references, err := graph.SecretReferences(task, credentials)
+		if err != nil {
+			return err
+		}
+
+		if format == jsonFormat {
+			if references == nil {
+				references = []*graph.SecretReference{}
+			}
+			bytes, err := json.MarshalIndent(references, "", "  ")
+			if err != nil {
+				return errors.Wrap(err, "failed to marshal the secrets")
+			}
+			fmt.Println(string(bytes))
+			return nil
+		}
+		for _, reference := range references {
+			fmt.Println(reference)
+		}
+		return nil
+	},
+}
@@ -10,12 +10,17 @@ import (
 	"strings"
 
 	buildCmd "github.com/Azure/acr-builder/cmd/acb/commands/build"
+	canonicalizeCmd "github.com/Azure/acr-builder/cmd/acb/commands/canonicalize"
+	diffCmd "github.com/Azure/acr-builder/cmd/acb/commands/diff"
 	downloadCmd "github.com/Azure/acr-builder/cmd/acb/commands/download"
 	execCmd "github.com/Azure/acr-builder/cmd/acb/commands/exec"
 	getsecretCmd "github.com/Azure/acr-builder/cmd/acb/commands/getsecret"
+	precheckCmd "github.com/Azure/acr-builder/cmd/acb/commands/precheck"
 	renderCmd "github.com/Azure/acr-builder/cmd/acb/commands/render"
 	scanCmd "github.com/Azure/acr-builder/cmd/acb/commands/scan"
+	secretsCmd "github.com/Azure/acr-builder/cmd/acb/commands/secrets"
 	versionCmd "github.com/Azure/acr-builder/cmd/acb/commands/version"
+	warmCmd "github.com/Azure/acr-builder/cmd/acb/commands/warm"
 	"github.com/Azure/acr-builder/version"
 	"github.com/urfave/cli"
 )
@@ -36,11 +41,16 @@ func New() *cli.App {
 	app.Version = version.Version
 	app.Commands = []cli.Command{
 		buildCmd.Command,
+		canonicalizeCmd.Command,
+		diffCmd.Command,
 		downloadCmd.Command,
 		execCmd.Command,
+		precheckCmd.Command,
 		renderCmd.Command,
 		scanCmd.Command,
+		secretsCmd.Command,
 		versionCmd.Command,
+		warmCmd.Command,
 		getsecretCmd.Command,
 	}
 	return app
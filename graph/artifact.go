@@ -0,0 +1,60 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	errInvalidArtifactsUse = errors.New("uploadArtifacts and downloadArtifacts can only be used with cmd or build steps")
+	errInvalidUploadDetach = errors.New("uploadArtifacts can't be used with detached steps, which may still be writing them")
+)
+
+// Artifact is a file in a step's working directory which is stored in a registry as an OCI artifact,
+// so later steps or runs can retrieve it.
+type Artifact struct {
+	// Path is the path of the file, relative to the step's working directory.
+	Path string `yaml:"path"`
+
+	// Ref is the reference the artifact is stored as, e.g. myregistry.azurecr.io/acb-artifacts/app:v1.
+	Ref string `yaml:"ref"`
+}
+
+// Validate validates the artifact. Artifacts which are uploaded must be referenced by a tag,
+// since the digest of the uploaded artifact isn't known beforehand.
+func (a *Artifact) Validate(upload bool) error {
+	if a == nil {
+		return errors.New("an artifact must specify a path and a ref")
+	}
+	if a.Path == "" || a.Ref == "" {
+		return fmt.Errorf("the artifact '%s' must specify a path and a ref", a.Ref)
+	}
+	if cleaned := path.Clean(a.Path); path.IsAbs(cleaned) || cleaned == "." || cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return fmt.Errorf("the path '%s' of the artifact '%s' must be a file in the step's working directory", a.Path, a.Ref)
+	}
+	if err := validateImageReference(a.Ref); err != nil {
+		return errors.Wrapf(err, "invalid artifact ref")
+	}
+	if upload && strings.Contains(a.Ref, "@") {
+		return fmt.Errorf("the uploaded artifact '%s' must be referenced by a tag rather than a digest", a.Ref)
+	}
+	return nil
+}
+
+func artifactsEqual(a []*Artifact, b []*Artifact) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if (a[i] == nil) != (b[i] == nil) || (a[i] != nil && *a[i] != *b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,143 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/util"
+)
+
+// The credential providers preferred when a registry has several credentials, see OrderCredentials.
+const (
+	// ProviderOrdered tries the credentials of a registry in the order they were specified.
+	ProviderOrdered = "ordered"
+	// ProviderAuto prefers msi credentials if a managed identity acb can get tokens from is available,
+	// see DetectCredentialProvider, and opaque credentials otherwise.
+	ProviderAuto = "auto"
+)
+
+const (
+	// msiEndpointEnv is the environment variable of the endpoint acb requests msi tokens from instead of
+	// the instance metadata service.
+	msiEndpointEnv = "MSI_ENDPOINT"
+
+	// imdsInstanceURL is the instance metadata service of Azure VMs, which acb requests msi tokens from
+	// unless MSI_ENDPOINT is set.
+	imdsInstanceURL = "http://169.254.169.254/metadata/instance?api-version=2021-02-01"
+
+	// imdsProbeTimeout limits how long the instance metadata service is waited for, since it's never
+	// reachable outside of Azure VMs.
+	imdsProbeTimeout = time.Second
+)
+
+// ProbeIMDS returns true if the instance metadata service of Azure VMs responds, false otherwise.
+// It's requested directly, since proxies can't reach it.
+func ProbeIMDS() bool {
+	client := &http.Client{Timeout: imdsProbeTimeout, Transport: &http.Transport{}}
+	req, err := http.NewRequest(http.MethodGet, imdsInstanceURL, nil)
+	if err != nil {
+		return false
+	}
+	req.Header.Set("Metadata", "true")
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+// ParseCredentialProvider parses the credential provider preferred when a registry has several credentials,
+// i.e. ordered, auto, msi or opaque. An empty provider is ordered.
+func ParseCredentialProvider(provider string) (string, error) {
+	switch p := strings.ToLower(strings.TrimSpace(provider)); p {
+	case "":
+		return ProviderOrdered, nil
+	case ProviderOrdered, ProviderAuto, MSI, Opaque:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid credential provider %q, expected %s, %s, %s or %s", provider, ProviderOrdered, ProviderAuto, MSI, Opaque)
+	}
+}
+
+// DetectCredentialProvider returns the credential provider preferred in the environment, along with why: msi if
+// acb can get msi tokens, i.e. if MSI_ENDPOINT, looked up using getenv, is set or if probeIMDS reports that the
+// instance metadata service of Azure VMs responds, and opaque otherwise. Other managed identities, e.g. workload
+// identity's federated tokens or App Service's IDENTITY_ENDPOINT, aren't detected since msi credentials can't use them.
+func DetectCredentialProvider(getenv func(string) string, probeIMDS func() bool) (string, string) {
+	if getenv(msiEndpointEnv) != "" {
+		return MSI, fmt.Sprintf("%s is set, indicating the MSI endpoint", msiEndpointEnv)
+	}
+	if probeIMDS() {
+		return MSI, "the instance metadata service responds, indicating an Azure VM"
+	}
+	return Opaque, "no managed identity acb can get tokens from is available"
+}
+
+// OrderCredentials returns the credentials ordered so that, for each registry with several credentials, which
+// are tried in order until one resolves, the credentials of the preferred provider are tried first. Otherwise,
+// credentials keep the order they were specified in, so the others remain fallbacks. The provider is msi, opaque
+// or ordered, which keeps every credential's order; auto must be detected first, see DetectCredentialProvider.
+func OrderCredentials(credentials []*RegistryCredential, provider string) []*RegistryCredential {
+	if provider != MSI && provider != Opaque {
+		return credentials
+	}
+	ordered := append([]*RegistryCredential(nil), credentials...)
+	// Only credentials of the same registry are reordered relative to each other, since the credentials
+	// of different registries are independent.
+	sorted := make(map[string][]*RegistryCredential)
+	for _, cred := range ordered {
+		if cred != nil {
+			sorted[cred.Registry] = append(sorted[cred.Registry], cred)
+		}
+	}
+	for _, creds := range sorted {
+		sort.SliceStable(creds, func(i, j int) bool {
+			return creds[i].Type() == provider && creds[j].Type() != provider
+		})
+	}
+	next := make(map[string]int)
+	for i, cred := range ordered {
+		if cred == nil {
+			continue
+		}
+		ordered[i] = sorted[cred.Registry][next[cred.Registry]]
+		next[cred.Registry]++
+	}
+	return ordered
+}
+
+// SelectCredentialProvider parses the preferred credential provider and, if it's auto, detects it in the
+// environment using getenv and probeIMDS. It returns the provider to order credentials by, along with why
+// it was selected.
+func SelectCredentialProvider(provider string, getenv func(string) string, probeIMDS func() bool) (string, string, error) {
+	parsed, err := ParseCredentialProvider(provider)
+	if err != nil {
+		return "", "", err
+	}
+	if parsed == ProviderAuto {
+		detected, reason := DetectCredentialProvider(getenv, probeIMDS)
+		return detected, reason, nil
+	}
+	return parsed, "it was specified", nil
+}
+
+// ApplyCredentialProvider orders the credentials by the preferred credential provider, detecting it in the
+// process's environment if it's auto, see SelectCredentialProvider and OrderCredentials.
+func ApplyCredentialProvider(credentials []*RegistryCredential, provider string) ([]*RegistryCredential, error) {
+	selected, reason, err := SelectCredentialProvider(provider, os.Getenv, ProbeIMDS)
+	if err != nil {
+		return nil, err
+	}
+	if selected != ProviderOrdered {
+		util.Infof("Preferring %s credentials for registries with several credentials, since %s\n", selected, reason)
+	}
+	return OrderCredentials(credentials, selected), nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSelectCredentialProvider(t *testing.T) {
+	tests := []struct {
+		provider    string
+		env         map[string]string
+		imds        bool
+		expected    string
+		shouldError bool
+	}{
+		{"", nil, true, ProviderOrdered, false},
+		{"ordered", map[string]string{"MSI_ENDPOINT": "http://localhost"}, false, ProviderOrdered, false},
+		{"MSI", nil, false, MSI, false},
+		{"opaque", map[string]string{"MSI_ENDPOINT": "http://localhost"}, true, Opaque, false},
+		{"auto", nil, false, Opaque, false},
+		{"auto", nil, true, MSI, false},
+		{"auto", map[string]string{"MSI_ENDPOINT": "http://localhost"}, false, MSI, false},
+		// Managed identities msi credentials can't get tokens from aren't detected.
+		{"auto", map[string]string{"AZURE_FEDERATED_TOKEN_FILE": "/var/run/secrets/token"}, false, Opaque, false},
+		{"auto", map[string]string{"IDENTITY_ENDPOINT": "http://localhost"}, false, Opaque, false},
+		{"auto", map[string]string{"AZURE_CLIENT_ID": "id"}, false, Opaque, false},
+		{"vault", nil, false, "", true},
+	}
+
+	for _, test := range tests {
+		getenv := func(key string) string { return test.env[key] }
+		probeIMDS := func() bool { return test.imds }
+		actual, reason, err := SelectCredentialProvider(test.provider, getenv, probeIMDS)
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected an error for the provider %q", test.provider)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for the provider %q: %v", test.provider, err)
+			continue
+		}
+		if actual != test.expected || reason == "" {
+			t.Errorf("Expected the provider %q with %v to select %s with a reason, but got %s (%q)", test.provider, test.env, test.expected, actual, reason)
+		}
+	}
+}
+
+func TestOrderCredentials(t *testing.T) {
+	opaqueA := &RegistryCredential{Registry: "a.azurecr.io", Username: "user", UsernameType: Opaque, Password: "pw", PasswordType: Opaque}
+	msiA := &RegistryCredential{Registry: "a.azurecr.io", Identity: "id", AadResourceID: "https://management.azure.com/"}
+	vaultA := &RegistryCredential{Registry: "a.azurecr.io", Username: "user", UsernameType: Opaque, Password: "https://vault/secret", PasswordType: VaultSecret, Identity: "id"}
+	opaqueB := &RegistryCredential{Registry: "b.azurecr.io", Username: "user", UsernameType: Opaque, Password: "pw", PasswordType: Opaque}
+	msiB := &RegistryCredential{Registry: "b.azurecr.io", Identity: "id", AadResourceID: "https://management.azure.com/"}
+	credentials := []*RegistryCredential{opaqueA, vaultA, opaqueB, msiA, msiB}
+
+	tests := []struct {
+		provider string
+		expected []*RegistryCredential
+	}{
+		{ProviderOrdered, credentials},
+		// Each registry's msi credential moves to the position of its first credential.
+		{MSI, []*RegistryCredential{msiA, opaqueA, msiB, vaultA, opaqueB}},
+		{Opaque, credentials},
+	}
+
+	for _, test := range tests {
+		actual := OrderCredentials(credentials, test.provider)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Expected %s to order the credentials as %v, but got %v", test.provider, test.expected, actual)
+		}
+	}
+	if !reflect.DeepEqual(credentials, []*RegistryCredential{opaqueA, vaultA, opaqueB, msiA, msiB}) {
+		t.Error("Expected the credentials not to be modified")
+	}
+
+	resolved := OrderCredentials([]*RegistryCredential{msiA, vaultA, opaqueA}, Opaque)
+	if !reflect.DeepEqual(resolved, []*RegistryCredential{opaqueA, msiA, vaultA}) {
+		t.Errorf("Expected the opaque credential to be tried first, but got %v", resolved)
+	}
+}
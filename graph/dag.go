@@ -4,6 +4,7 @@
 package graph
 
 import (
+	"encoding/json"
 	"fmt"
 	"sync"
 
@@ -14,6 +15,10 @@ const (
 	rootNodeID = "acb_root"
 )
 
+var (
+	errMixedStages = errors.New("either all steps or no steps must specify a stage")
+)
+
 // Node represents a vertex in a Dag.
 type Node struct {
 	Name     string
@@ -58,6 +63,10 @@ func NewDag() *Dag {
 
 // NewDagFromTask creates a new Dag based on the specified Task.
 func NewDagFromTask(t *Task) (*Dag, error) {
+	if t.UsesStages() {
+		return newStagedDagFromTask(t)
+	}
+
 	dag := NewDag()
 
 	var prevStep *Step
@@ -65,6 +74,13 @@ func NewDagFromTask(t *Task) (*Dag, error) {
 		if err := step.Validate(); err != nil {
 			return dag, err
 		}
+		// Steps which run on failure aren't part of the graph, they run once it has failed.
+		if step.OnFailure {
+			continue
+		}
+		if err := t.checkOnFailureDeps(step); err != nil {
+			return dag, err
+		}
 		if _, err := dag.AddVertex(step); err != nil {
 			return dag, err
 		}
@@ -100,6 +116,78 @@ func NewDagFromTask(t *Task) (*Dag, error) {
 	return dag, nil
 }
 
+// newStagedDagFromTask creates a new Dag for a Task whose steps are grouped into stages.
+// Every step in a stage depends on all the steps of the previous stage, so a failure in one
+// stage prevents any subsequent stage from starting. Steps within a stage without a when
+// clause execute in parallel; steps with a when clause additionally wait on their dependencies.
+func newStagedDagFromTask(t *Task) (*Dag, error) {
+	dag := NewDag()
+
+	seenStages := make(map[string]bool)
+	currentStage := ""
+	var prevStageSteps, currStageSteps []*Step
+	for _, step := range t.Steps {
+		if err := step.Validate(); err != nil {
+			return dag, err
+		}
+		if step.OnFailure {
+			continue
+		}
+		if err := t.checkOnFailureDeps(step); err != nil {
+			return dag, err
+		}
+		if !step.HasStage() {
+			return dag, errMixedStages
+		}
+		if step.Stage != currentStage {
+			if seenStages[step.Stage] {
+				return dag, fmt.Errorf("steps in stage %s must be declared contiguously", step.Stage)
+			}
+			seenStages[step.Stage] = true
+			currentStage = step.Stage
+			prevStageSteps = currStageSteps
+			currStageSteps = nil
+		}
+		if _, err := dag.AddVertex(step); err != nil {
+			return dag, err
+		}
+
+		deps := make(map[string]bool)
+		for _, prev := range prevStageSteps {
+			deps[prev.ID] = true
+		}
+		if !step.ShouldExecuteImmediately() {
+			for _, dep := range step.When {
+				deps[dep] = true
+			}
+		}
+		if len(deps) == 0 {
+			deps[rootNodeID] = true
+		}
+		for dep := range deps {
+			if err := dag.AddEdge(dep, step.ID); err != nil {
+				return dag, err
+			}
+		}
+
+		currStageSteps = append(currStageSteps, step)
+	}
+
+	return dag, nil
+}
+
+// checkOnFailureDeps returns an error if the step depends on a step which only runs on failure.
+func (t *Task) checkOnFailureDeps(step *Step) error {
+	for _, dep := range step.When {
+		for _, s := range t.Steps {
+			if s.OnFailure && s.ID == dep {
+				return fmt.Errorf("step ID: %s can't depend on step ID: %s, which only runs once the task has failed", step.ID, dep)
+			}
+		}
+	}
+	return nil
+}
+
 // AddVertex adds a vertex to the Dag with the specified name and value.
 func (d *Dag) AddVertex(value *Step) (*Node, error) {
 	if value.ID == rootNodeID {
@@ -190,3 +278,35 @@ func (d *Dag) validateFromAndTo(from string, to string) (fromNode *Node, toNode
 	}
 	return fromNode, toNode, nil
 }
+
+// GraphStep describes a step in the JSON representation of a Task's Dag.
+type GraphStep struct {
+	ID           string   `json:"id"`
+	GeneratedID  bool     `json:"generatedId"`
+	Dependencies []string `json:"dependencies"`
+}
+
+// MarshalGraph returns the JSON representation of the Task's Dag, listing the resolved ID of
+// each step along with the IDs of the steps it depends on, in the order they're declared.
+func (t *Task) MarshalGraph() ([]byte, error) {
+	if t.Dag == nil {
+		return nil, errors.New("task has no graph to marshal")
+	}
+	parents := t.Dag.parents()
+	steps := []*GraphStep{}
+	for _, step := range t.Steps {
+		if _, ok := t.Dag.Nodes[step.ID]; !ok {
+			continue
+		}
+		deps := parents[step.ID]
+		if deps == nil {
+			deps = []string{}
+		}
+		steps = append(steps, &GraphStep{ID: step.ID, GeneratedID: step.GeneratedID, Dependencies: deps})
+	}
+	bytes, err := json.MarshalIndent(steps, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to marshal the task graph")
+	}
+	return bytes, nil
+}
@@ -7,6 +7,7 @@ import (
 	gocontext "context"
 	"fmt"
 	"runtime"
+	"strings"
 	"testing"
 
 	"github.com/Azure/acr-builder/util"
@@ -284,3 +285,99 @@ func verifyChildren(expected map[string]*Step, actual []*Node) error {
 
 	return nil
 }
+
+func TestDagCreation_Stages(t *testing.T) {
+	steps := []*Step{
+		{ID: "build-a", Build: "-t a .", Stage: "build"},
+		{ID: "build-b", Build: "-t b .", Stage: "build"},
+		{ID: "unit", Cmd: "a test", Stage: "test"},
+		{ID: "lint", Cmd: "a lint", Stage: "test", When: []string{"build-a"}},
+		{ID: "push", Push: []string{"a"}, Stage: "push"},
+	}
+	task, err := NewTask(gocontext.Background(), steps, nil, "", nil, false, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+
+	expectedDegrees := map[string]int{
+		"build-a": 1,
+		"build-b": 1,
+		"unit":    2,
+		"lint":    2,
+		"push":    2,
+	}
+	for id, expected := range expectedDegrees {
+		if actual := task.Dag.Nodes[id].GetDegree(); actual != expected {
+			t.Errorf("Expected %s to have degree %d, but got %d", id, expected, actual)
+		}
+	}
+	if err := verifyChildren(map[string]*Step{"build-a": steps[0], "build-b": steps[1]}, task.Dag.Root.Children()); err != nil {
+		t.Error(err)
+	}
+
+	expectedStages := []string{"build", "test", "push"}
+	if !util.StringSequenceEquals(expectedStages, task.Stages()) {
+		t.Errorf("Expected stages %v, but got %v", expectedStages, task.Stages())
+	}
+}
+
+func TestDagCreation_OnFailure(t *testing.T) {
+	for _, stages := range [][]string{{"", ""}, {"build", "test"}} {
+		steps := []*Step{
+			{ID: "a", Cmd: "a", Stage: stages[0]},
+			{ID: "cleanup", Cmd: "cleanup", OnFailure: true},
+			{ID: "b", Cmd: "b", Stage: stages[1]},
+		}
+		task, err := NewTask(gocontext.Background(), steps, nil, "", nil, false, "", "")
+		if err != nil {
+			t.Fatalf("Failed to create task. Err: %v", err)
+		}
+		// The step which runs on failure isn't part of the graph, so b still depends on a.
+		if _, ok := task.Dag.Nodes["cleanup"]; ok {
+			t.Errorf("Expected the step which runs on failure not to be part of the graph")
+		}
+		if parents := task.Dag.parents()["b"]; len(parents) != 1 || parents[0] != "a" {
+			t.Errorf("Expected b to depend on a, but got %v", parents)
+		}
+		if onFailure := task.OnFailureSteps(); len(onFailure) != 1 || onFailure[0].ID != "cleanup" {
+			t.Errorf("Expected the step which runs on failure to be cleanup, but got %v", onFailure)
+		}
+	}
+
+	steps := []*Step{
+		{ID: "cleanup", Cmd: "cleanup", OnFailure: true},
+		{ID: "a", Cmd: "a", When: []string{"cleanup"}},
+	}
+	if _, err := NewTask(gocontext.Background(), steps, nil, "", nil, false, "", ""); err == nil || !strings.Contains(err.Error(), "can't depend on step ID: cleanup") {
+		t.Errorf("Expected depending on a step which runs on failure to fail, but got %v", err)
+	}
+}
+
+func TestDagCreation_InvalidStages(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []*Step
+	}{
+		{
+			"mixed",
+			[]*Step{
+				{ID: "a", Cmd: "a", Stage: "build"},
+				{ID: "b", Cmd: "b"},
+			},
+		},
+		{
+			"non-contiguous",
+			[]*Step{
+				{ID: "a", Cmd: "a", Stage: "build"},
+				{ID: "b", Cmd: "b", Stage: "test"},
+				{ID: "c", Cmd: "c", Stage: "build"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		if _, err := NewTask(gocontext.Background(), test.steps, nil, "", nil, false, "", ""); err == nil {
+			t.Errorf("Expected an error for %s stages, but got none", test.name)
+		}
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Azure/acr-builder/util"
+)
+
+// StepChange describes how a Step changed between two Tasks.
+type StepChange string
+
+const (
+	// StepAdded means the step only exists in the later Task.
+	StepAdded StepChange = "added"
+
+	// StepRemoved means the step only exists in the earlier Task.
+	StepRemoved StepChange = "removed"
+
+	// StepChanged means the step exists in both Tasks, but some of its fields differ.
+	StepChanged StepChange = "changed"
+)
+
+// FieldDiff describes a field of a Step whose values differ between two Tasks.
+type FieldDiff struct {
+	Field string   `json:"field"`
+	Old   []string `json:"old"`
+	New   []string `json:"new"`
+}
+
+// StepDiff describes how a Step differs between two Tasks.
+type StepDiff struct {
+	ID     string       `json:"id"`
+	Change StepChange   `json:"change"`
+	Fields []*FieldDiff `json:"fields"`
+}
+
+// TaskDiff describes how the steps of two expanded Tasks differ.
+type TaskDiff struct {
+	Steps []*StepDiff `json:"steps"`
+}
+
+// diffField is a field of a Step which is compared by DiffTasks.
+type diffField struct {
+	name string
+	// values returns the values of the field, which are compared regardless of their order if unordered.
+	values    func(s *Step) []string
+	unordered bool
+}
+
+// diffFields are the fields compared by DiffTasks, in the order they're reported.
+// The dependencies of each step are compared separately, using the Task's Dag.
+var diffFields = []diffField{
+	{name: "cmd", values: func(s *Step) []string { return nonEmpty(s.Cmd) }},
+	{name: "build", values: func(s *Step) []string { return nonEmpty(s.Build) }},
+	{name: "script", values: func(s *Step) []string { return nonEmpty(s.Script) }},
+	{name: "references", values: stepReferences, unordered: true},
+	{name: "env", values: func(s *Step) []string { return s.Envs }, unordered: true},
+	{name: "secretFiles", values: func(s *Step) []string { return s.SecretFiles }, unordered: true},
+	{name: "caCertificates", values: func(s *Step) []string { return s.CACertificates }, unordered: true},
+	{name: "workingDirectory", values: func(s *Step) []string { return nonEmpty(s.WorkingDirectory) }},
+	{name: "entryPoint", values: func(s *Step) []string { return nonEmpty(s.EntryPoint) }},
+	{name: "user", values: func(s *Step) []string { return nonEmpty(s.User) }},
+	{name: "network", values: func(s *Step) []string { return nonEmpty(s.Network) }},
+	{name: "isolation", values: func(s *Step) []string { return nonEmpty(s.Isolation) }},
+	{name: "timeout", values: func(s *Step) []string { return nonEmpty(strconv.Itoa(s.Timeout)) }},
+	{name: "retries", values: func(s *Step) []string { return nonEmpty(strconv.Itoa(s.Retries)) }},
+	{name: "repeat", values: func(s *Step) []string { return nonEmpty(strconv.Itoa(s.Repeat)) }},
+	{name: "detach", values: func(s *Step) []string { return nonEmpty(strconv.FormatBool(s.Detach)) }},
+	{name: "privileged", values: func(s *Step) []string { return nonEmpty(strconv.FormatBool(s.Privileged)) }},
+	{name: "ignoreErrors", values: func(s *Step) []string { return nonEmpty(strconv.FormatBool(s.IgnoreErrors)) }},
+	{name: "allowFailure", values: func(s *Step) []string { return nonEmpty(strconv.FormatBool(s.AllowFailure)) }},
+	{name: "target", values: func(s *Step) []string { return nonEmpty(strconv.FormatBool(s.Target)) }},
+}
+
+// dependenciesField is the name of the field describing the steps a Step depends on.
+const dependenciesField = "dependencies"
+
+// DiffTasks compares the expanded steps of two Tasks, matching them by ID, and returns the steps which were
+// added, removed or changed, along with the fields which changed, e.g. their commands, dependencies, the
+// images they reference and their environment variables. Removed steps are reported in the order they're
+// declared in before, followed by the added and changed steps in the order they're declared in after.
+func DiffTasks(before *Task, after *Task) (*TaskDiff, error) {
+	if before.Dag == nil || after.Dag == nil {
+		return nil, fmt.Errorf("task has no graph to diff")
+	}
+	oldParents, newParents := before.Dag.parents(), after.Dag.parents()
+	oldSteps := make(map[string]*Step, len(before.Steps))
+	for _, s := range before.Steps {
+		oldSteps[s.ID] = s
+	}
+	newSteps := make(map[string]*Step, len(after.Steps))
+	for _, s := range after.Steps {
+		newSteps[s.ID] = s
+	}
+
+	diff := &TaskDiff{Steps: []*StepDiff{}}
+	for _, s := range before.Steps {
+		if _, ok := newSteps[s.ID]; !ok {
+			diff.Steps = append(diff.Steps, &StepDiff{ID: s.ID, Change: StepRemoved, Fields: diffSteps(s, oldParents[s.ID], nil, nil)})
+		}
+	}
+	for _, s := range after.Steps {
+		o, ok := oldSteps[s.ID]
+		if !ok {
+			diff.Steps = append(diff.Steps, &StepDiff{ID: s.ID, Change: StepAdded, Fields: diffSteps(nil, nil, s, newParents[s.ID])})
+			continue
+		}
+		if fields := diffSteps(o, oldParents[s.ID], s, newParents[s.ID]); len(fields) > 0 {
+			diff.Steps = append(diff.Steps, &StepDiff{ID: s.ID, Change: StepChanged, Fields: fields})
+		}
+	}
+	return diff, nil
+}
+
+// diffSteps returns the fields of the steps, either of which may be nil, which differ.
+func diffSteps(before *Step, beforeDeps []string, after *Step, afterDeps []string) []*FieldDiff {
+	fields := []*FieldDiff{}
+	if f := diffValues(dependenciesField, beforeDeps, afterDeps, true); f != nil {
+		fields = append(fields, f)
+	}
+	for _, field := range diffFields {
+		var oldValues, newValues []string
+		if before != nil {
+			oldValues = field.values(before)
+		}
+		if after != nil {
+			newValues = field.values(after)
+		}
+		if f := diffValues(field.name, oldValues, newValues, field.unordered); f != nil {
+			fields = append(fields, f)
+		}
+	}
+	return fields
+}
+
+// diffValues returns a FieldDiff if the values differ, or nil if they're the same.
+func diffValues(name string, oldValues []string, newValues []string, unordered bool) *FieldDiff {
+	oldValues, newValues = copyValues(oldValues, unordered), copyValues(newValues, unordered)
+	if len(oldValues) == len(newValues) {
+		same := true
+		for i := range oldValues {
+			if oldValues[i] != newValues[i] {
+				same = false
+				break
+			}
+		}
+		if same {
+			return nil
+		}
+	}
+	return &FieldDiff{Field: name, Old: oldValues, New: newValues}
+}
+
+// copyValues copies the values, sorting them if they're unordered, so they can be compared and
+// marshaled as an empty array rather than null.
+func copyValues(values []string, unordered bool) []string {
+	copied := append([]string{}, values...)
+	if unordered {
+		sort.Strings(copied)
+	}
+	return copied
+}
+
+// nonEmpty returns the value as a single value, or no values if it's empty or zero.
+func nonEmpty(value string) []string {
+	if value == "" || value == "0" || value == "false" {
+		return nil
+	}
+	return []string{value}
+}
+
+// stepReferences returns the normalized references to the images the step runs, builds or pushes.
+func stepReferences(s *Step) []string {
+	var refs []string
+	switch {
+	case s.IsCmdStep():
+		if img := util.ParseImageName(s.Cmd); img != "" {
+			refs = []string{img}
+		}
+	case s.IsBuildStep():
+		refs = s.Tags
+	case s.IsPushStep():
+		refs = s.Push
+	}
+	normalized := make([]string, 0, len(refs))
+	for _, ref := range refs {
+		normalized = append(normalized, util.NormalizeImageTag(ref))
+	}
+	return normalized
+}
+
+// Empty returns true if the Tasks don't differ.
+func (d *TaskDiff) Empty() bool {
+	return len(d.Steps) == 0
+}
+
+// String returns a human readable representation of a TaskDiff, listing the values of each field which
+// were removed, prefixed by -, and added, prefixed by +.
+func (d *TaskDiff) String() string {
+	if d.Empty() {
+		return "No differences"
+	}
+	var b strings.Builder
+	for i, s := range d.Steps {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "Step ID: %s, %s\n", s.ID, s.Change)
+		for _, f := range s.Fields {
+			fmt.Fprintf(&b, "  %s:\n", f.Field)
+			removed, added := subtractValues(f.Old, f.New), subtractValues(f.New, f.Old)
+			if len(removed) == 0 && len(added) == 0 {
+				// The same values were reordered.
+				removed, added = f.Old, f.New
+			}
+			for _, v := range removed {
+				fmt.Fprintf(&b, "    - %s\n", v)
+			}
+			for _, v := range added {
+				fmt.Fprintf(&b, "    + %s\n", v)
+			}
+		}
+	}
+	return strings.TrimSuffix(b.String(), "\n")
+}
+
+// subtractValues returns the values which aren't in other.
+func subtractValues(values []string, other []string) []string {
+	counts := make(map[string]int, len(other))
+	for _, v := range other {
+		counts[v]++
+	}
+	var ret []string
+	for _, v := range values {
+		if counts[v] > 0 {
+			counts[v]--
+			continue
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
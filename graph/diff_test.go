@@ -0,0 +1,148 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	gocontext "context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffTasks(t *testing.T) {
+	before, err := NewTask(gocontext.Background(), []*Step{
+		{ID: "build", Build: "-t myregistry.azurecr.io/app:v1 .", Envs: []string{"A=1", "B=2"}},
+		{ID: "test", Cmd: "myregistry.azurecr.io/app:v1 test", When: []string{"build"}},
+		{ID: "lint", Cmd: "golangci-lint run", When: []string{"-"}},
+		{ID: "push", Push: []string{"myregistry.azurecr.io/app:v1"}, When: []string{"test"}},
+	}, nil, "", nil, false, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	after, err := NewTask(gocontext.Background(), []*Step{
+		{ID: "build", Build: "-t myregistry.azurecr.io/app:v1 .", Envs: []string{"B=2", "A=1"}},
+		{ID: "test", Cmd: "myregistry.azurecr.io/app:v2 test", When: []string{"build"}, Envs: []string{"C=3"}},
+		{ID: "scan", Cmd: "scanner myregistry.azurecr.io/app:v1", When: []string{"build"}},
+		{ID: "push", Push: []string{"myregistry.azurecr.io/app:v1"}, When: []string{"test", "scan"}},
+	}, nil, "", nil, false, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+
+	diff, err := DiffTasks(before, after)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	expected := []struct {
+		id     string
+		change StepChange
+		fields []string
+	}{
+		{"lint", StepRemoved, []string{"cmd", "references", "timeout", "network"}},
+		{"test", StepChanged, []string{"cmd", "references", "env"}},
+		{"scan", StepAdded, []string{"dependencies", "cmd", "references", "timeout", "network"}},
+		{"push", StepChanged, []string{"dependencies"}},
+	}
+	if len(diff.Steps) != len(expected) {
+		t.Fatalf("Expected %d steps to differ, but got %d:\n%s", len(expected), len(diff.Steps), diff)
+	}
+	for i, e := range expected {
+		s := diff.Steps[i]
+		if s.ID != e.id || s.Change != e.change {
+			t.Errorf("Expected step %s to be %s, but got step %s %s", e.id, e.change, s.ID, s.Change)
+			continue
+		}
+		var fields []string
+		for _, f := range s.Fields {
+			fields = append(fields, f.Field)
+		}
+		for _, field := range e.fields {
+			if !contains(fields, field) {
+				t.Errorf("Expected field %s of step %s to differ, but got %v", field, s.ID, fields)
+			}
+		}
+	}
+
+	test := diff.Steps[1]
+	if f := test.Fields[1]; f.Field != "references" || !reflect.DeepEqual(f.Old, []string{"myregistry.azurecr.io/app:v1"}) || !reflect.DeepEqual(f.New, []string{"myregistry.azurecr.io/app:v2"}) {
+		t.Errorf("Expected the references of step test to change from v1 to v2, but got %+v", f)
+	}
+	push := diff.Steps[3]
+	if f := push.Fields[0]; !reflect.DeepEqual(f.Old, []string{"test"}) || !reflect.DeepEqual(f.New, []string{"scan", "test"}) {
+		t.Errorf("Expected the dependencies of step push to change from [test] to [scan test], but got %+v", f)
+	}
+
+	text := diff.String()
+	for _, line := range []string{"Step ID: lint, removed", "Step ID: scan, added", "    - myregistry.azurecr.io/app:v1 test", "    + myregistry.azurecr.io/app:v2 test", "    + C=3", "    + scan"} {
+		if !strings.Contains(text, line) {
+			t.Errorf("Expected the diff to contain %q, but got:\n%s", line, text)
+		}
+	}
+	if strings.Contains(text, "Step ID: build") {
+		t.Errorf("Expected the reordered environment variables of step build not to differ, but got:\n%s", text)
+	}
+
+	bytes, err := json.Marshal(diff)
+	if err != nil {
+		t.Fatalf("Failed to marshal the diff: %v", err)
+	}
+	var unmarshaled TaskDiff
+	if err := json.Unmarshal(bytes, &unmarshaled); err != nil {
+		t.Fatalf("Failed to unmarshal the diff: %v", err)
+	}
+	if !reflect.DeepEqual(&unmarshaled, diff) {
+		t.Errorf("Expected the diff to round trip through JSON, but got %s", bytes)
+	}
+}
+
+func TestDiffTasks_Same(t *testing.T) {
+	newTask := func() *Task {
+		task, err := NewTask(gocontext.Background(), []*Step{{ID: "a", Cmd: "a"}, {ID: "b", Cmd: "b", When: []string{"a"}}}, nil, "", nil, false, "", "")
+		if err != nil {
+			t.Fatalf("Failed to create task. Err: %v", err)
+		}
+		return task
+	}
+	diff, err := DiffTasks(newTask(), newTask())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !diff.Empty() {
+		t.Errorf("Expected no differences, but got:\n%s", diff)
+	}
+	if diff.String() != "No differences" {
+		t.Errorf("Expected no differences to be reported, but got %s", diff)
+	}
+}
+
+func TestStepReferences(t *testing.T) {
+	tests := []struct {
+		step     *Step
+		expected []string
+	}{
+		{&Step{Cmd: "myregistry.azurecr.io/app:v1 echo hello"}, []string{"myregistry.azurecr.io/app:v1"}},
+		{&Step{Cmd: "  bash\t-c 'echo hello'"}, []string{"bash:latest"}},
+		{&Step{Cmd: "   "}, []string{}},
+		{&Step{Cmd: "--rm -e NAME=value --network host node:18 npm test"}, []string{"node:18"}},
+		{&Step{Cmd: "NAME=value bash"}, []string{"bash:latest"}},
+		{&Step{Build: "-t app:v1 .", Tags: []string{"app:v1"}}, []string{"app:v1"}},
+		{&Step{Push: []string{"app"}}, []string{"app:latest"}},
+	}
+	for _, test := range tests {
+		if actual := stepReferences(test.step); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Expected the references %v, but got %v", test.expected, actual)
+		}
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
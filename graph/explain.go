@@ -0,0 +1,137 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Outcome describes the simulated outcome of a Step.
+type Outcome string
+
+const (
+	// WillRun means the step's dependencies are satisfied and it will be executed.
+	WillRun Outcome = "run"
+
+	// WillFail means the step will be executed but has been simulated to fail.
+	WillFail Outcome = "fail"
+
+	// Blocked means the step won't be executed because one of its dependencies failed or is blocked.
+	Blocked Outcome = "blocked"
+)
+
+// StepExplanation describes whether or not a Step will run and why.
+type StepExplanation struct {
+	ID      string
+	Outcome Outcome
+	Reason  string
+}
+
+// String returns a human readable representation of a StepExplanation.
+func (e *StepExplanation) String() string {
+	return fmt.Sprintf("Step ID: %s, outcome: %s, reason: %s", e.ID, e.Outcome, e.Reason)
+}
+
+// Explain simulates the execution of the Task and explains, for each step, whether it will run
+// or be blocked. All steps are assumed to succeed except for the ones specified in failedSteps.
+// Steps are returned in the order they're declared in the Task.
+func (t *Task) Explain(failedSteps []string) ([]*StepExplanation, error) {
+	if t.Dag == nil {
+		return nil, fmt.Errorf("task has no graph to explain")
+	}
+
+	failed := make(map[string]bool, len(failedSteps))
+	for _, id := range failedSteps {
+		if _, ok := t.Dag.Nodes[id]; !ok {
+			return nil, fmt.Errorf("cannot simulate failure for step ID: %s, it does not exist", id)
+		}
+		failed[id] = true
+	}
+
+	parents := t.Dag.parents()
+	outcomes := make(map[string]Outcome, len(t.Steps))
+	var explanations, onFailure []*StepExplanation
+	taskFails := false
+	// Steps are always added to the graph after their dependencies, so the declaration order
+	// of the steps is a valid topological order.
+	for _, step := range t.Steps {
+		e := &StepExplanation{ID: step.ID}
+		explanations = append(explanations, e)
+		if step.OnFailure {
+			onFailure = append(onFailure, e)
+			continue
+		}
+		deps := parents[step.ID]
+
+		var failedDeps, blockedDeps []string
+		for _, dep := range deps {
+			switch outcomes[dep] {
+			case WillFail:
+				if s := t.Dag.Nodes[dep].Value; !s.IgnoreErrors && !s.AllowFailure {
+					failedDeps = append(failedDeps, dep)
+				}
+			case Blocked:
+				blockedDeps = append(blockedDeps, dep)
+			}
+		}
+
+		switch {
+		case len(failedDeps) > 0:
+			e.Outcome = Blocked
+			e.Reason = fmt.Sprintf("dependency %s failed", strings.Join(failedDeps, ", "))
+		case len(blockedDeps) > 0:
+			e.Outcome = Blocked
+			e.Reason = fmt.Sprintf("dependency %s is blocked", strings.Join(blockedDeps, ", "))
+		case failed[step.ID]:
+			e.Outcome = WillFail
+			e.Reason = "failure simulated"
+			if step.IgnoreErrors {
+				e.Reason += ", errors are ignored so dependents will still run"
+			} else if step.AllowFailure {
+				e.Reason += ", the step is allowed to fail so dependents will still run"
+			} else {
+				taskFails = true
+			}
+		case len(deps) == 0:
+			e.Outcome = WillRun
+			e.Reason = "no dependencies, runs immediately"
+		default:
+			e.Outcome = WillRun
+			e.Reason = fmt.Sprintf("dependency %s succeeded", strings.Join(deps, ", "))
+		}
+
+		outcomes[step.ID] = e.Outcome
+	}
+
+	for _, e := range onFailure {
+		if taskFails {
+			e.Outcome = WillRun
+			e.Reason = "the task fails"
+		} else {
+			e.Outcome = Blocked
+			e.Reason = "only runs if the task fails"
+		}
+	}
+
+	return explanations, nil
+}
+
+// parents returns a sorted list of dependencies for each vertex in the Dag, excluding the root.
+func (d *Dag) parents() map[string][]string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	parents := make(map[string][]string, len(d.Nodes))
+	for id, n := range d.Nodes {
+		for _, child := range n.Children() {
+			parents[child.Name] = append(parents[child.Name], id)
+		}
+	}
+	for _, deps := range parents {
+		sort.Strings(deps)
+	}
+	return parents
+}
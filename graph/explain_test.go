@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	gocontext "context"
+	"testing"
+)
+
+func TestExplain(t *testing.T) {
+	newSteps := func() []*Step {
+		return []*Step{
+			{ID: "a", Cmd: "a"},
+			{ID: "b", Cmd: "b", When: []string{ImmediateExecutionToken}, IgnoreErrors: true},
+			{ID: "c", Cmd: "c", When: []string{"a"}},
+			{ID: "d", Cmd: "d", When: []string{"b"}},
+			{ID: "e", Cmd: "e", When: []string{"c"}},
+			{ID: "f", Cmd: "f", When: []string{ImmediateExecutionToken}, AllowFailure: true},
+			{ID: "g", Cmd: "g", When: []string{"f"}},
+			{ID: "h", Cmd: "h", OnFailure: true},
+		}
+	}
+
+	tests := []struct {
+		failed   []string
+		expected map[string]Outcome
+	}{
+		{
+			nil,
+			map[string]Outcome{"a": WillRun, "b": WillRun, "c": WillRun, "d": WillRun, "e": WillRun, "f": WillRun, "g": WillRun, "h": Blocked},
+		},
+		{
+			[]string{"a"},
+			map[string]Outcome{"a": WillFail, "b": WillRun, "c": Blocked, "d": WillRun, "e": Blocked, "f": WillRun, "g": WillRun, "h": WillRun},
+		},
+		{
+			[]string{"f"},
+			map[string]Outcome{"a": WillRun, "b": WillRun, "c": WillRun, "d": WillRun, "e": WillRun, "f": WillFail, "g": WillRun, "h": Blocked},
+		},
+		{
+			[]string{"b", "c"},
+			map[string]Outcome{"a": WillRun, "b": WillFail, "c": WillFail, "d": WillRun, "e": Blocked, "f": WillRun, "g": WillRun, "h": WillRun},
+		},
+	}
+
+	for _, test := range tests {
+		task, err := NewTask(gocontext.Background(), newSteps(), nil, "", nil, false, "", "")
+		if err != nil {
+			t.Fatalf("Failed to create task. Err: %v", err)
+		}
+		explanations, err := task.Explain(test.failed)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(explanations) != len(test.expected) {
+			t.Fatalf("Expected %d explanations, but got %d", len(test.expected), len(explanations))
+		}
+		for _, e := range explanations {
+			if e.Outcome != test.expected[e.ID] {
+				t.Errorf("Expected %s to have outcome %s with failures %v, but got %s (%s)", e.ID, test.expected[e.ID], test.failed, e.Outcome, e.Reason)
+			}
+		}
+	}
+}
+
+func TestExplain_UnknownStep(t *testing.T) {
+	task, err := NewTask(gocontext.Background(), []*Step{{ID: "a", Cmd: "a"}}, nil, "", nil, false, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	if _, err := task.Explain([]string{"missing"}); err == nil {
+		t.Error("Expected an error when simulating a failure for an unknown step, but got none")
+	}
+}
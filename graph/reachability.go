@@ -0,0 +1,60 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import "log"
+
+// HasTargets returns true if any of the Task's steps is marked as a target, false otherwise.
+func (t *Task) HasTargets() bool {
+	for _, step := range t.Steps {
+		if step.Target {
+			return true
+		}
+	}
+	return false
+}
+
+// UnreachableSteps returns the IDs of the steps, in the order they're declared, which aren't targets
+// and which no target depends on, directly or transitively. These steps don't contribute to any of the
+// Task's targets, e.g. stale steps left behind after a target stopped depending on them.
+// If the Task doesn't mark any step as a target, every step is considered reachable.
+func (t *Task) UnreachableSteps() []string {
+	if t.Dag == nil || !t.HasTargets() {
+		return nil
+	}
+
+	parents := t.Dag.parents()
+	reachable := make(map[string]bool, len(t.Steps))
+	var visit func(id string)
+	visit = func(id string) {
+		if reachable[id] {
+			return
+		}
+		reachable[id] = true
+		for _, dep := range parents[id] {
+			visit(dep)
+		}
+	}
+	for _, step := range t.Steps {
+		if step.Target {
+			visit(step.ID)
+		}
+	}
+
+	var unreachable []string
+	for _, step := range t.Steps {
+		if !reachable[step.ID] && !step.OnFailure {
+			unreachable = append(unreachable, step.ID)
+		}
+	}
+	return unreachable
+}
+
+// warnUnreachableSteps logs a warning for each step which is unreachable from the Task's targets.
+// Unreachable steps still run, so existing tasks keep working while they're cleaned up.
+func (t *Task) warnUnreachableSteps() {
+	for _, id := range t.UnreachableSteps() {
+		log.Printf("WARNING: step ID: %s is unreachable, it isn't a target and no target depends on it\n", id)
+	}
+}
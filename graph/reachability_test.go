@@ -0,0 +1,67 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	gocontext "context"
+	"reflect"
+	"testing"
+)
+
+func TestUnreachableSteps(t *testing.T) {
+	tests := []struct {
+		name     string
+		steps    []*Step
+		expected []string
+	}{
+		{
+			"no targets",
+			[]*Step{
+				{ID: "a", Cmd: "a"},
+				{ID: "b", Cmd: "b", When: []string{ImmediateExecutionToken}},
+			},
+			nil,
+		},
+		{
+			"every step leads to the target",
+			[]*Step{
+				{ID: "a", Cmd: "a"},
+				{ID: "b", Cmd: "b", When: []string{ImmediateExecutionToken}},
+				{ID: "c", Cmd: "c", When: []string{"a", "b"}, Target: true},
+			},
+			nil,
+		},
+		{
+			"dead steps",
+			[]*Step{
+				{ID: "a", Cmd: "a"},
+				{ID: "b", Cmd: "b", When: []string{ImmediateExecutionToken}},
+				{ID: "c", Cmd: "c", When: []string{"b"}},
+				{ID: "d", Cmd: "d", When: []string{"a"}, Target: true},
+				// e has no dependents and isn't a target.
+				{ID: "e", Cmd: "e", When: []string{"d"}},
+			},
+			[]string{"b", "c", "e"},
+		},
+		{
+			"multiple targets",
+			[]*Step{
+				{ID: "a", Cmd: "a", Target: true},
+				{ID: "b", Cmd: "b", When: []string{ImmediateExecutionToken}},
+				{ID: "c", Cmd: "c", When: []string{"b"}, Target: true},
+			},
+			nil,
+		},
+	}
+
+	for _, test := range tests {
+		task, err := NewTask(gocontext.Background(), test.steps, nil, "", nil, false, "", "")
+		if err != nil {
+			t.Fatalf("%s: failed to create task. Err: %v", test.name, err)
+		}
+		if actual := task.UnreachableSteps(); !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: expected unreachable steps %v, but got %v", test.name, test.expected, actual)
+		}
+	}
+}
@@ -5,8 +5,11 @@ package graph
 
 import (
 	"encoding/json"
+	"fmt"
+	"net/url"
 	"strings"
 
+	"github.com/Azure/acr-builder/tokenutil"
 	"github.com/pkg/errors"
 )
 
@@ -16,7 +19,17 @@ var (
 	errInvalidPassword      = errors.New("password can't be empty")
 	errInvalidIdentity      = errors.New("identity can't be empty")
 	errInvalidAadResourceID = errors.New("aadResourceId can't be empty")
-	errCouldNotClassify     = errors.New("unable to classify credential into opaque, vault or msi")
+	errInvalidServiceKey    = errors.New("serviceAccountKey can't be empty")
+	errInvalidBearerToken   = errors.New("bearer token can't be empty")
+	errInvalidClientID      = errors.New("clientId can't be empty")
+	errCouldNotClassify     = errors.New("unable to classify credential into opaque, vault, msi, gar, bearer or devicecode")
+)
+
+const (
+	// DefaultRegistry is the registry of a credential used for any registry without a more specific credential.
+	DefaultRegistry = "*"
+
+	wildcardRegistryPrefix = "*."
 )
 
 const (
@@ -24,31 +37,130 @@ const (
 	Opaque = "opaque"
 	// VaultSecret means username/password are Azure KeyVault IDs
 	VaultSecret = "vaultsecret"
+	// GAR means the password is a Google access token obtained using a service account key
+	GAR = "gar"
+	// Bearer means the password is a registry bearer token which is sent as is, without a token exchange
+	Bearer = "bearer"
+	// MSI means the password is a token obtained using an Azure managed identity
+	MSI = "msi"
+	// DeviceCode means the password is a bearer token obtained by signing in interactively with the OAuth device code flow
+	DeviceCode = "devicecode"
 )
 
+// ClassificationError is returned when a credential can't be classified into opaque, vault, msi, gar, bearer or devicecode
+// based on its provider types. It matches errCouldNotClassify using errors.Is.
+type ClassificationError struct {
+	UsernameType string
+	PasswordType string
+}
+
+func (e *ClassificationError) Error() string {
+	return fmt.Sprintf("%v: got userNameProviderType %q and passwordProviderType %q, "+
+		"expected both to be %q, at least one to be %q (with an identity), passwordProviderType to be %q (with a serviceAccountKey), "+
+		"passwordProviderType to be %q (with the token as the password), passwordProviderType to be %q (with a clientId and endpoints), "+
+		"or neither to be set for msi (with an identity and aadResourceId)",
+		errCouldNotClassify, e.UsernameType, e.PasswordType, Opaque, VaultSecret, GAR, Bearer, DeviceCode)
+}
+
+// Is makes a ClassificationError match errCouldNotClassify.
+func (e *ClassificationError) Is(target error) bool {
+	return target == errCouldNotClassify
+}
+
+// CredentialError is a problem with one of a batch of serialized credentials, along with where it is.
+type CredentialError struct {
+	// Index is the 0-based index of the credential in the batch.
+	Index int
+
+	// Registry is the registry of the credential, empty if it couldn't be read.
+	Registry string
+
+	// Err is the problem.
+	Err error
+}
+
+func (e *CredentialError) Error() string {
+	if e.Registry == "" {
+		return fmt.Sprintf("credential %d: %v", e.Index, e.Err)
+	}
+	return fmt.Sprintf("credential %d (registry %s): %v", e.Index, e.Registry, e.Err)
+}
+
+// Unwrap returns the problem, so it can be matched using errors.Is and errors.As.
+func (e *CredentialError) Unwrap() error {
+	return e.Err
+}
+
+// CredentialErrors are all the problems found in a batch of serialized credentials, in the order of the batch.
+type CredentialErrors []*CredentialError
+
+// Error lists the problems, each on its own line.
+func (e CredentialErrors) Error() string {
+	problems := "problems"
+	if len(e) == 1 {
+		problems = "problem"
+	}
+	lines := []string{fmt.Sprintf("found %d %s in the credentials:", len(e), problems)}
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// NewCredentialError creates the CredentialError of the serialized credential at index of a batch, reading its
+// registry from the credential if possible.
+func NewCredentialError(index int, credString string, err error) *CredentialError {
+	var cred struct {
+		Registry string `json:"registry"`
+	}
+	_ = json.Unmarshal([]byte(credString), &cred)
+	return &CredentialError{Index: index, Registry: cred.Registry, Err: err}
+}
+
 // RegistryCredential defines a combination of registry, username and password.
 type RegistryCredential struct {
-	Registry      string `json:"registry"`
-	Username      string `json:"username,omitempty"`
-	UsernameType  string `json:"userNameProviderType,omitempty"`
-	Password      string `json:"password,omitempty"`
-	PasswordType  string `json:"passwordProviderType,omitempty"`
-	Identity      string `json:"identity,omitempty"`
+	Registry     string `json:"registry"`
+	Username     string `json:"username,omitempty"`
+	UsernameType string `json:"userNameProviderType,omitempty"`
+	Password     string `json:"password,omitempty"`
+	PasswordType string `json:"passwordProviderType,omitempty"`
+	// Identity is the client ID of the managed identity which msi and vaultsecret credentials authenticate as.
+	Identity string `json:"identity,omitempty"`
+	// AadResourceID is the AAD resource which msi credentials request a token for, e.g. https://management.azure.com/.
+	// It's an AAD resource URI rather than an ARM resource ID such as /subscriptions/.../resourceGroups/....
 	AadResourceID string `json:"aadResourceId,omitempty"`
+
+	// ServiceAccountKey is a Google service account JSON key, or the path of a file containing it, used by gar credentials.
+	ServiceAccountKey string `json:"serviceAccountKey,omitempty"`
+
+	// ClientID is the OAuth client which devicecode credentials sign in as.
+	ClientID string `json:"clientId,omitempty"`
+	// DeviceAuthorizationEndpoint is the URL which devicecode credentials request a device code from.
+	DeviceAuthorizationEndpoint string `json:"deviceAuthorizationEndpoint,omitempty"`
+	// TokenEndpoint is the URL which devicecode credentials request a token from.
+	TokenEndpoint string `json:"tokenEndpoint,omitempty"`
+	// Scope is the space separated scopes which devicecode credentials request, if any.
+	Scope string `json:"scope,omitempty"`
 }
 
 // CreateRegistryCredentialFromList creates a list of RegistryCredential
-// objects from list of serialized credentials.
+// objects from list of serialized credentials. Every credential is validated, and
+// if any is invalid, all the problems are returned together as CredentialErrors.
 func CreateRegistryCredentialFromList(creds []string) ([]*RegistryCredential, error) {
 	var credentials []*RegistryCredential
-	for _, credString := range creds {
+	var errs CredentialErrors
+	for i, credString := range creds {
 		var cred *RegistryCredential
 		cred, err := CreateRegistryCredentialFromString(credString)
 		if err != nil {
-			return nil, err
+			errs = append(errs, NewCredentialError(i, credString, err))
+			continue
 		}
 		credentials = append(credentials, cred)
 	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
 
 	return credentials, nil
 }
@@ -72,6 +184,9 @@ func CreateRegistryCredentialFromString(str string) (*RegistryCredential, error)
 	isOpaque := usernameType == Opaque && passwordType == Opaque
 	hasVaultSecret := usernameType == VaultSecret || passwordType == VaultSecret
 	isMSI := usernameType == "" && passwordType == ""
+	isGAR := passwordType == GAR && (usernameType == "" || usernameType == GAR)
+	isBearer := passwordType == Bearer && (usernameType == "" || usernameType == Bearer)
+	isDeviceCode := passwordType == DeviceCode && (usernameType == "" || usernameType == DeviceCode)
 
 	if isOpaque {
 		if cred.Username == "" {
@@ -105,7 +220,54 @@ func CreateRegistryCredentialFromString(str string) (*RegistryCredential, error)
 			PasswordType: passwordType,
 			Identity:     cred.Identity,
 		}
+	} else if isGAR {
+		if cred.ServiceAccountKey == "" {
+			return nil, errInvalidServiceKey
+		}
+		if _, err := tokenutil.LoadServiceAccountKey(cred.ServiceAccountKey); err != nil {
+			return nil, errors.Wrap(err, "invalid serviceAccountKey")
+		}
+		retVal = &RegistryCredential{
+			Registry:          cred.Registry,
+			UsernameType:      GAR,
+			PasswordType:      GAR,
+			ServiceAccountKey: cred.ServiceAccountKey,
+		}
+	} else if isBearer {
+		if strings.TrimSpace(cred.Password) == "" {
+			return nil, errInvalidBearerToken
+		}
+		retVal = &RegistryCredential{
+			Registry:     cred.Registry,
+			UsernameType: Bearer,
+			Password:     cred.Password,
+			PasswordType: Bearer,
+		}
+	} else if isDeviceCode {
+		if cred.ClientID == "" {
+			return nil, errInvalidClientID
+		}
+		for _, endpoint := range []struct{ name, value string }{
+			{"deviceAuthorizationEndpoint", cred.DeviceAuthorizationEndpoint},
+			{"tokenEndpoint", cred.TokenEndpoint},
+		} {
+			if err := validateEndpoint(endpoint.value); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", endpoint.name)
+			}
+		}
+		retVal = &RegistryCredential{
+			Registry:                    cred.Registry,
+			UsernameType:                DeviceCode,
+			PasswordType:                DeviceCode,
+			ClientID:                    cred.ClientID,
+			DeviceAuthorizationEndpoint: cred.DeviceAuthorizationEndpoint,
+			TokenEndpoint:               cred.TokenEndpoint,
+			Scope:                       cred.Scope,
+		}
 	} else if isMSI {
+		if IsRegistryPattern(cred.Registry) {
+			return nil, fmt.Errorf("msi credentials can't be used for the registry pattern %s, they require a specific registry", cred.Registry)
+		}
 		if cred.Identity == "" {
 			return nil, errInvalidIdentity
 		}
@@ -118,12 +280,27 @@ func CreateRegistryCredentialFromString(str string) (*RegistryCredential, error)
 			AadResourceID: cred.AadResourceID,
 		}
 	} else {
-		return nil, errCouldNotClassify
+		return nil, &ClassificationError{UsernameType: cred.UsernameType, PasswordType: cred.PasswordType}
 	}
 
 	return retVal, nil
 }
 
+// validateEndpoint checks the endpoint is an absolute http or https URL.
+func validateEndpoint(endpoint string) error {
+	if endpoint == "" {
+		return errors.New("the endpoint can't be empty")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("%s isn't an http or https URL", endpoint)
+	}
+	return nil
+}
+
 // Equals determines whether two RegistryCredentials are equal.
 func (s *RegistryCredential) Equals(t *RegistryCredential) bool {
 	if s == nil && t == nil {
@@ -139,7 +316,12 @@ func (s *RegistryCredential) Equals(t *RegistryCredential) bool {
 		s.Password == t.Password &&
 		s.PasswordType == t.PasswordType &&
 		s.Identity == t.Identity &&
-		s.AadResourceID == t.AadResourceID
+		s.AadResourceID == t.AadResourceID &&
+		s.ServiceAccountKey == t.ServiceAccountKey &&
+		s.ClientID == t.ClientID &&
+		s.DeviceAuthorizationEndpoint == t.DeviceAuthorizationEndpoint &&
+		s.TokenEndpoint == t.TokenEndpoint &&
+		s.Scope == t.Scope
 }
 
 // String serializes the RegistryCredential
@@ -151,3 +333,68 @@ func (s *RegistryCredential) String() (string, error) {
 
 	return string(bytes), nil
 }
+
+// Type returns the class of the credential, i.e. opaque, vaultsecret, msi, gar, bearer or devicecode.
+func (s *RegistryCredential) Type() string {
+	switch {
+	case s.PasswordType == GAR:
+		return GAR
+	case s.PasswordType == Bearer:
+		return Bearer
+	case s.PasswordType == DeviceCode:
+		return DeviceCode
+	case s.UsernameType == "" && s.PasswordType == "":
+		return MSI
+	case s.UsernameType == VaultSecret || s.PasswordType == VaultSecret:
+		return VaultSecret
+	default:
+		return Opaque
+	}
+}
+
+// ProviderName describes how the credential is provided, e.g. "msi (identity: <id>)".
+func (s *RegistryCredential) ProviderName() string {
+	switch credType := s.Type(); credType {
+	case MSI, VaultSecret:
+		return fmt.Sprintf("%s (identity: %s)", credType, s.Identity)
+	case Opaque:
+		return fmt.Sprintf("opaque (username: %s)", s.Username)
+	case DeviceCode:
+		return fmt.Sprintf("devicecode (clientId: %s)", s.ClientID)
+	default:
+		return credType
+	}
+}
+
+// IsRegistryPattern returns true if the registry is the DefaultRegistry or a wildcard such as *.azurecr.io,
+// rather than the name of a specific registry.
+func IsRegistryPattern(registry string) bool {
+	return registry == DefaultRegistry || strings.HasPrefix(registry, wildcardRegistryPrefix)
+}
+
+// MatchRegistry returns the pattern which applies to the registry. The registry itself is preferred,
+// followed by the longest matching wildcard, e.g. *.azurecr.io for myregistry.azurecr.io, followed by
+// the DefaultRegistry. Registries are compared case-insensitively.
+func MatchRegistry(registry string, patterns []string) (string, bool) {
+	registry = strings.ToLower(registry)
+	best, hasDefault := "", false
+	for _, pattern := range patterns {
+		lower := strings.ToLower(pattern)
+		switch {
+		case lower == registry:
+			return pattern, true
+		case lower == DefaultRegistry:
+			hasDefault = true
+		case strings.HasPrefix(lower, wildcardRegistryPrefix) &&
+			strings.HasSuffix(registry, lower[1:]) && len(pattern) > len(best):
+			best = pattern
+		}
+	}
+	if best != "" {
+		return best, true
+	}
+	if hasDefault {
+		return DefaultRegistry, true
+	}
+	return "", false
+}
@@ -3,7 +3,18 @@
 
 package graph
 
-import "testing"
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
 
 func TestCreateCredentialFromString(t *testing.T) {
 	tests := []struct {
@@ -36,6 +47,14 @@ func TestCreateCredentialFromString(t *testing.T) {
 			AadResourceID: "https://management.azure.com",
 		}},
 		{`{"registry": "", "username": "blah", "password": "something"}`, false, nil},
+		{`{"usernameProviderType":"opaque","passwordProviderType":"opaque","registry":"*","username":"u","password":"p"}`, true, &RegistryCredential{
+			Registry:     "*",
+			Username:     "u",
+			UsernameType: Opaque,
+			Password:     "p",
+			PasswordType: Opaque,
+		}},
+		{`{"registry":"*.azurecr.io","identity":"clientID", "aadResourceId": "https://management.azure.com"}`, false, nil},
 	}
 
 	for _, test := range tests {
@@ -59,6 +78,192 @@ func TestCreateCredentialFromString(t *testing.T) {
 	}
 }
 
+func TestCreateCredentialFromString_GAR(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a private key: %v", err)
+	}
+	key, err := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "builder@project.iam.gserviceaccount.com",
+		"private_key":  string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})),
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal the service account key: %v", err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key.json")
+	if err := ioutil.WriteFile(keyFile, key, 0600); err != nil {
+		t.Fatalf("Failed to write the service account key: %v", err)
+	}
+	credential := func(serviceAccountKey string) string {
+		cred, _ := json.Marshal(map[string]string{
+			"registry":             "us-docker.pkg.dev",
+			"passwordProviderType": "gar",
+			"serviceAccountKey":    serviceAccountKey,
+		})
+		return string(cred)
+	}
+
+	tests := []struct {
+		credential string
+		ok         bool
+	}{
+		{credential(string(key)), true},
+		{credential(keyFile), true},
+		{credential(""), false},
+		{credential(filepath.Join(t.TempDir(), "missing.json")), false},
+		{credential(`{"type":"authorized_user","client_email":"a@b.com"}`), false},
+		{credential(`{"type":"service_account","client_email":"a@b.com","private_key":"not a key"}`), false},
+	}
+
+	for _, test := range tests {
+		actual, err := CreateRegistryCredentialFromString(test.credential)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Expected %s to return an error but it didn't", test.credential)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", test.credential, err)
+		}
+		expected := &RegistryCredential{
+			Registry:          "us-docker.pkg.dev",
+			UsernameType:      GAR,
+			PasswordType:      GAR,
+			ServiceAccountKey: actual.ServiceAccountKey,
+		}
+		if !actual.Equals(expected) {
+			t.Fatalf("Expected %v but got %v", expected, actual)
+		}
+		if expected.ServiceAccountKey = "other"; actual.Equals(expected) {
+			t.Errorf("Expected credentials with different service account keys to differ")
+		}
+	}
+}
+
+func TestCreateCredentialFromString_Bearer(t *testing.T) {
+	tests := []struct {
+		credential string
+		ok         bool
+	}{
+		{`{"registry":"r","passwordProviderType":"bearer","password":"token"}`, true},
+		{`{"registry":"r","userNameProviderType":"bearer","passwordProviderType":"bearer","password":"token"}`, true},
+		{`{"registry":"r","passwordProviderType":"bearer"}`, false},
+		{`{"registry":"r","passwordProviderType":"bearer","password":"  "}`, false},
+	}
+
+	for _, test := range tests {
+		actual, err := CreateRegistryCredentialFromString(test.credential)
+		if !test.ok {
+			if err != errInvalidBearerToken {
+				t.Errorf("Expected %s to return errInvalidBearerToken but got %v", test.credential, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", test.credential, err)
+		}
+		expected := &RegistryCredential{Registry: "r", UsernameType: Bearer, Password: "token", PasswordType: Bearer}
+		if !actual.Equals(expected) {
+			t.Errorf("Expected %v but got %v", expected, actual)
+		}
+		if actual.ProviderName() != Bearer {
+			t.Errorf("Expected the provider name %s but got %s", Bearer, actual.ProviderName())
+		}
+	}
+}
+
+func TestCreateCredentialFromString_DeviceCode(t *testing.T) {
+	const endpoints = `"deviceAuthorizationEndpoint":"https://login.example.com/device","tokenEndpoint":"https://login.example.com/token"`
+	tests := []struct {
+		credential string
+		ok         bool
+	}{
+		{`{"registry":"r","passwordProviderType":"devicecode","clientId":"acb",` + endpoints + `,"scope":"registry"}`, true},
+		{`{"registry":"r","userNameProviderType":"devicecode","passwordProviderType":"devicecode","clientId":"acb",` + endpoints + `,"scope":"registry"}`, true},
+		{`{"registry":"r","passwordProviderType":"devicecode",` + endpoints + `}`, false},
+		{`{"registry":"r","passwordProviderType":"devicecode","clientId":"acb","tokenEndpoint":"https://login.example.com/token"}`, false},
+		{`{"registry":"r","passwordProviderType":"devicecode","clientId":"acb","deviceAuthorizationEndpoint":"login.example.com/device","tokenEndpoint":"https://login.example.com/token"}`, false},
+	}
+
+	for _, test := range tests {
+		actual, err := CreateRegistryCredentialFromString(test.credential)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Expected %s to fail but got %v", test.credential, actual)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", test.credential, err)
+		}
+		expected := &RegistryCredential{
+			Registry:                    "r",
+			UsernameType:                DeviceCode,
+			PasswordType:                DeviceCode,
+			ClientID:                    "acb",
+			DeviceAuthorizationEndpoint: "https://login.example.com/device",
+			TokenEndpoint:               "https://login.example.com/token",
+			Scope:                       "registry",
+		}
+		if !actual.Equals(expected) {
+			t.Errorf("Expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestRegistryCredentialType(t *testing.T) {
+	tests := []struct {
+		cred         *RegistryCredential
+		expectedType string
+		expectedName string
+	}{
+		{&RegistryCredential{Username: "user", UsernameType: Opaque, Password: "pw", PasswordType: Opaque}, Opaque, "opaque (username: user)"},
+		{&RegistryCredential{Username: "user", UsernameType: Opaque, Password: "id", PasswordType: VaultSecret, Identity: "client"}, VaultSecret, "vaultsecret (identity: client)"},
+		{&RegistryCredential{Identity: "client", AadResourceID: "https://management.azure.com/"}, MSI, "msi (identity: client)"},
+		{&RegistryCredential{UsernameType: GAR, PasswordType: GAR}, GAR, GAR},
+		{&RegistryCredential{Password: "token", PasswordType: Bearer}, Bearer, Bearer},
+		{&RegistryCredential{ClientID: "acb", UsernameType: DeviceCode, PasswordType: DeviceCode}, DeviceCode, "devicecode (clientId: acb)"},
+	}
+	for _, test := range tests {
+		if actual := test.cred.Type(); actual != test.expectedType {
+			t.Errorf("Expected the type %s but got %s", test.expectedType, actual)
+		}
+		if actual := test.cred.ProviderName(); actual != test.expectedName {
+			t.Errorf("Expected the provider name %s but got %s", test.expectedName, actual)
+		}
+	}
+}
+
+func TestCreateCredentialFromString_ClassificationError(t *testing.T) {
+	tests := []struct {
+		credential   string
+		usernameType string
+		passwordType string
+	}{
+		{`{"userNameProviderType":"opaque","registry":"r","username":"u","password":"p"}`, "opaque", ""},
+		{`{"userNameProviderType":"plaintext","passwordProviderType":"opaque","registry":"r","username":"u","password":"p"}`, "plaintext", "opaque"},
+	}
+
+	for _, test := range tests {
+		_, err := CreateRegistryCredentialFromString(test.credential)
+		if !errors.Is(err, errCouldNotClassify) {
+			t.Fatalf("Expected errCouldNotClassify for %s, but got %v", test.credential, err)
+		}
+		var classificationErr *ClassificationError
+		if !errors.As(err, &classificationErr) {
+			t.Fatalf("Expected a ClassificationError for %s, but got %T", test.credential, err)
+		}
+		if classificationErr.UsernameType != test.usernameType || classificationErr.PasswordType != test.passwordType {
+			t.Errorf("Expected types %q and %q, but got %q and %q", test.usernameType, test.passwordType, classificationErr.UsernameType, classificationErr.PasswordType)
+		}
+		if !strings.Contains(err.Error(), `"`+test.usernameType+`"`) || !strings.Contains(err.Error(), "msi") {
+			t.Errorf("Expected the error to report the observed types and the valid combinations, but got %v", err)
+		}
+	}
+}
+
 func TestCreateCredentialFromList(t *testing.T) {
 	tests := []struct {
 		credential []string
@@ -111,3 +316,50 @@ func TestCreateCredentialFromList(t *testing.T) {
 		}
 	}
 }
+
+func TestCreateCredentialFromList_AggregatesErrors(t *testing.T) {
+	creds := []string{
+		`{"userNameProviderType":"opaque","passwordProviderType":"opaque","registry":"valid.azurecr.io","username":"u","password":"p"}`,
+		`{"userNameProviderType":"opaque","passwordProviderType":"opaque","registry":"nouser.azurecr.io","password":"p"}`,
+		`{"userNameProviderType":"opaque","passwordProviderType":"opaque","username":"u","password":"p"}`,
+		`{"registry":`,
+		`{"userNameProviderType":"plaintext","passwordProviderType":"opaque","registry":"unclassified.azurecr.io","username":"u","password":"p"}`,
+	}
+
+	credentials, err := CreateRegistryCredentialFromList(creds)
+	if credentials != nil {
+		t.Errorf("Expected no credentials, but got %v", credentials)
+	}
+	var errs CredentialErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected CredentialErrors, but got %T: %v", err, err)
+	}
+	tests := []struct {
+		index    int
+		registry string
+		err      error
+	}{
+		{1, "nouser.azurecr.io", errInvalidUsername},
+		{2, "", errInvalidRegName},
+		{3, "", nil},
+		{4, "unclassified.azurecr.io", errCouldNotClassify},
+	}
+	if len(errs) != len(tests) {
+		t.Fatalf("Expected %d problems, but got %d: %v", len(tests), len(errs), err)
+	}
+	for i, test := range tests {
+		if errs[i].Index != test.index || errs[i].Registry != test.registry {
+			t.Errorf("Expected problem %d to be for credential %d of registry %q, but got credential %d of registry %q", i, test.index, test.registry, errs[i].Index, errs[i].Registry)
+		}
+		if test.err != nil && !errors.Is(errs[i], test.err) {
+			t.Errorf("Expected problem %d to match %v, but got %v", i, test.err, errs[i])
+		}
+	}
+
+	expected := "found 4 problems in the credentials:\n" +
+		"credential 1 (registry nouser.azurecr.io): username can't be empty\n" +
+		"credential 2: registry name can't be empty\n"
+	if !strings.HasPrefix(err.Error(), expected) {
+		t.Errorf("Expected the problems to be listed one per line, but got %q", err.Error())
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Azure/acr-builder/secretmgmt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// SecretReference is a secret which a Task accesses, identified without resolving it.
+type SecretReference struct {
+	// Name is the ID of the Task's secret, or the registry and the field of a credential, e.g. "myregistry.azurecr.io password".
+	Name string `json:"name"`
+
+	// Source is what the secret is resolved with, i.e. the scheme of its resolver such as keyvault or msi,
+	// or inline if its value is passed as is.
+	Source string `json:"source"`
+
+	// Identifier identifies the secret in its source, e.g. the URL of a key vault secret.
+	// It's empty for inline secrets, whose value is never reported.
+	Identifier string `json:"identifier,omitempty"`
+
+	// Identity is the client ID of the managed identity the secret is accessed as, if any.
+	Identity string `json:"identity,omitempty"`
+
+	// Steps are the IDs of the steps which use the secret.
+	Steps []string `json:"steps,omitempty"`
+}
+
+// InlineSource is the Source of secrets whose value is passed as is, e.g. the password of an opaque credential.
+const InlineSource = "inline"
+
+// String returns the reference as a single line, e.g. "mysecret keyvault https://myvault.vault.azure.net/secrets/mysecret (steps: build)".
+func (r *SecretReference) String() string {
+	var sb strings.Builder
+	sb.WriteString(r.Name + " " + r.Source)
+	if r.Identifier != "" {
+		sb.WriteString(" " + r.Identifier)
+	}
+	if r.Identity != "" {
+		sb.WriteString(" (identity: " + r.Identity + ")")
+	}
+	if len(r.Steps) > 0 {
+		sb.WriteString(" (steps: " + strings.Join(r.Steps, ", ") + ")")
+	}
+	return sb.String()
+}
+
+// SecretReferences returns the secrets which the Task and the credentials access, i.e. the Task's secrets,
+// in the order they're declared, followed by the secrets of each credential, without resolving any of them.
+// The Task is expected to be rendered with the placeholders of its secrets in place of their values, see
+// templating.BaseRenderOptions.LazySecrets, so the steps using each secret are found by their placeholders.
+// The values of inline secrets are never returned.
+func SecretReferences(task *Task, credentials []*RegistryCredential) ([]*SecretReference, error) {
+	var references []*SecretReference
+	if task != nil {
+		usedBy := make(map[string][]string)
+		for _, step := range task.Steps {
+			data, err := yaml.Marshal(step)
+			if err != nil {
+				return nil, fmt.Errorf("failed to marshal step %s: %v", step.ID, err)
+			}
+			for _, id := range secretmgmt.PlaceholderIDs(string(data)) {
+				usedBy[id] = append(usedBy[id], step.ID)
+			}
+		}
+		for _, secret := range task.Secrets {
+			if secret == nil {
+				continue
+			}
+			reference := &SecretReference{Name: secret.ID, Source: secret.Scheme(), Steps: usedBy[secret.ID]}
+			switch {
+			case secret.Source != "":
+				reference.Identifier = secret.Source
+			case secret.IsKeyVaultSecret():
+				reference.Identifier, reference.Identity = secret.KeyVault, secret.MsiClientID
+			case secret.IsMsiSecret():
+				reference.Identifier, reference.Identity = secret.AadResourceID, secret.MsiClientID
+			}
+			references = append(references, reference)
+		}
+	}
+	for _, cred := range credentials {
+		if cred != nil {
+			references = append(references, cred.secretReferences()...)
+		}
+	}
+	return references, nil
+}
+
+// secretReferences returns the secrets of the credential, mirroring how they're resolved.
+func (s *RegistryCredential) secretReferences() []*SecretReference {
+	switch s.Type() {
+	case MSI:
+		return []*SecretReference{{Name: s.Registry + " token", Source: secretmgmt.MSIScheme, Identifier: s.AadResourceID, Identity: s.Identity}}
+	case GAR:
+		reference := &SecretReference{Name: s.Registry + " serviceAccountKey", Source: secretmgmt.GoogleScheme}
+		// The key is either a file, whose path is reported, or the JSON key itself, which isn't.
+		if !strings.HasPrefix(strings.TrimSpace(s.ServiceAccountKey), "{") {
+			reference.Identifier = s.ServiceAccountKey
+		}
+		return []*SecretReference{reference}
+	case Bearer:
+		return []*SecretReference{{Name: s.Registry + " token", Source: InlineSource}}
+	case DeviceCode:
+		return []*SecretReference{{Name: s.Registry + " token", Source: secretmgmt.DeviceCodeScheme, Identifier: s.TokenEndpoint, Identity: s.ClientID}}
+	}
+
+	var references []*SecretReference
+	for _, field := range []struct {
+		name, value, valueType string
+	}{
+		{"username", s.Username, s.UsernameType},
+		{"password", s.Password, s.PasswordType},
+	} {
+		if field.valueType == VaultSecret {
+			references = append(references, &SecretReference{Name: s.Registry + " " + field.name, Source: secretmgmt.KeyVaultScheme, Identifier: field.value, Identity: s.Identity})
+		} else {
+			references = append(references, &SecretReference{Name: s.Registry + " " + field.name, Source: InlineSource})
+		}
+	}
+	return references
+}
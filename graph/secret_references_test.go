@@ -0,0 +1,83 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/Azure/acr-builder/secretmgmt"
+)
+
+func TestSecretReferences(t *testing.T) {
+	task, err := UnmarshalTaskFromString(context.Background(), `
+secrets:
+  - id: user
+    keyvault: https://myvault.vault.azure.net/secrets/user
+    clientID: c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86
+  - id: token
+    source: vault://secret/data/ci#token
+  - id: unused
+    keyvault: https://myvault.vault.azure.net/secrets/unused
+steps:
+  - id: login
+    cmd: docker login -u `+secretmgmt.Placeholder("user")+` -p `+secretmgmt.Placeholder("token")+`
+  - id: publish
+    cmd: publish
+    env: ["TOKEN=`+secretmgmt.Placeholder("token")+`"]
+    when: ["login"]
+`, &TaskOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	credentials := []*RegistryCredential{
+		{Registry: "msi.azurecr.io", Identity: "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86", AadResourceID: "https://management.azure.com/"},
+		{Registry: "vault.azurecr.io", Username: "user", UsernameType: Opaque, Password: "https://myvault.vault.azure.net/secrets/password", PasswordType: VaultSecret, Identity: "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86"},
+		{Registry: "opaque.azurecr.io", Username: "user", UsernameType: Opaque, Password: "hunter2", PasswordType: Opaque},
+		{Registry: "us-docker.pkg.dev", Username: "_json_key", UsernameType: GAR, PasswordType: GAR, ServiceAccountKey: "/keys/gar.json"},
+		{Registry: "eu-docker.pkg.dev", Username: "_json_key", UsernameType: GAR, PasswordType: GAR, ServiceAccountKey: `{"private_key":"secret"}`},
+	}
+
+	references, err := SecretReferences(task, credentials)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []*SecretReference{
+		{Name: "user", Source: "keyvault", Identifier: "https://myvault.vault.azure.net/secrets/user", Identity: "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86", Steps: []string{"login"}},
+		{Name: "token", Source: "vault", Identifier: "vault://secret/data/ci#token", Steps: []string{"login", "publish"}},
+		{Name: "unused", Source: "keyvault", Identifier: "https://myvault.vault.azure.net/secrets/unused"},
+		{Name: "msi.azurecr.io token", Source: "msi", Identifier: "https://management.azure.com/", Identity: "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86"},
+		{Name: "vault.azurecr.io username", Source: InlineSource},
+		{Name: "vault.azurecr.io password", Source: "keyvault", Identifier: "https://myvault.vault.azure.net/secrets/password", Identity: "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86"},
+		{Name: "opaque.azurecr.io username", Source: InlineSource},
+		{Name: "opaque.azurecr.io password", Source: InlineSource},
+		{Name: "us-docker.pkg.dev serviceAccountKey", Source: "google", Identifier: "/keys/gar.json"},
+		{Name: "eu-docker.pkg.dev serviceAccountKey", Source: "google"},
+	}
+	if len(references) != len(expected) {
+		t.Fatalf("Expected %d references, but got %d: %v", len(expected), len(references), references)
+	}
+	for i := range expected {
+		if !reflect.DeepEqual(references[i], expected[i]) {
+			t.Errorf("Expected reference %d to be %v, but got %v", i, expected[i], references[i])
+		}
+	}
+}
+
+func TestSecretReference_String(t *testing.T) {
+	tests := []struct {
+		reference *SecretReference
+		expected  string
+	}{
+		{&SecretReference{Name: "user", Source: "keyvault", Identifier: "https://myvault.vault.azure.net/secrets/user", Identity: "id", Steps: []string{"a", "b"}},
+			"user keyvault https://myvault.vault.azure.net/secrets/user (identity: id) (steps: a, b)"},
+		{&SecretReference{Name: "myregistry.azurecr.io password", Source: InlineSource}, "myregistry.azurecr.io password inline"},
+	}
+	for _, test := range tests {
+		if actual := test.reference.String(); actual != test.expected {
+			t.Errorf("Expected %s, but got %s", test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"fmt"
+)
+
+// SelectSteps restricts the Task to a subset of its steps. If only is specified, just those steps and
+// the steps they transitively depend on are kept. The steps in skip are then removed, along with any
+// step whose dependencies have all been removed. Removed steps are marked as Skipped and the Dag
+// is rebuilt from the remaining steps, keeping the dependencies between them.
+func (t *Task) SelectSteps(only []string, skip []string) error {
+	if len(only) == 0 && len(skip) == 0 {
+		return nil
+	}
+	if t.Dag == nil {
+		return fmt.Errorf("task has no graph to select steps from")
+	}
+	for _, id := range append(append([]string{}, only...), skip...) {
+		if _, ok := t.Dag.Nodes[id]; !ok {
+			return fmt.Errorf("cannot select step ID: %s, it does not exist", id)
+		}
+	}
+
+	parents := t.Dag.parents()
+	selected := make(map[string]bool, len(t.Steps))
+	if len(only) == 0 {
+		for _, step := range t.Steps {
+			selected[step.ID] = true
+		}
+	} else {
+		var selectDeps func(id string)
+		selectDeps = func(id string) {
+			if selected[id] {
+				return
+			}
+			selected[id] = true
+			for _, dep := range parents[id] {
+				selectDeps(dep)
+			}
+		}
+		for _, id := range only {
+			selectDeps(id)
+		}
+	}
+
+	skipped := make(map[string]bool, len(skip))
+	for _, id := range skip {
+		skipped[id] = true
+	}
+	// Steps are always added to the graph after their dependencies, so the declaration order
+	// of the steps is a valid topological order.
+	for _, step := range t.Steps {
+		deps := parents[step.ID]
+		if skipped[step.ID] || len(deps) == 0 {
+			continue
+		}
+		allSkipped := true
+		for _, dep := range deps {
+			if !skipped[dep] {
+				allSkipped = false
+				break
+			}
+		}
+		skipped[step.ID] = allSkipped
+	}
+
+	dag := NewDag()
+	for _, step := range t.Steps {
+		// Steps which run on failure aren't part of the graph, so they're kept regardless.
+		if step.OnFailure {
+			continue
+		}
+		if !selected[step.ID] || skipped[step.ID] {
+			step.StepStatus = Skipped
+			continue
+		}
+		if _, err := dag.AddVertex(step); err != nil {
+			return err
+		}
+		hasDeps := false
+		for _, dep := range parents[step.ID] {
+			if _, ok := dag.Nodes[dep]; !ok {
+				continue
+			}
+			if err := dag.AddEdge(dep, step.ID); err != nil {
+				return err
+			}
+			hasDeps = true
+		}
+		if !hasDeps {
+			if err := dag.AddEdge(rootNodeID, step.ID); err != nil {
+				return err
+			}
+		}
+	}
+	if len(dag.Nodes) == 0 {
+		return fmt.Errorf("no steps are left to run after applying the step selection")
+	}
+
+	t.Dag = dag
+	return nil
+}
@@ -0,0 +1,107 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	gocontext "context"
+	"reflect"
+	"testing"
+)
+
+func TestSelectSteps(t *testing.T) {
+	newSteps := func() []*Step {
+		return []*Step{
+			{ID: "a", Cmd: "a"},
+			{ID: "b", Cmd: "b", When: []string{ImmediateExecutionToken}},
+			{ID: "c", Cmd: "c", When: []string{"a"}},
+			{ID: "d", Cmd: "d", When: []string{"b", "c"}},
+			{ID: "e", Cmd: "e", When: []string{"c"}},
+			{ID: "f", Cmd: "f", When: []string{"e"}},
+		}
+	}
+
+	tests := []struct {
+		only     []string
+		skip     []string
+		expected map[string][]string
+	}{
+		{
+			nil,
+			nil,
+			map[string][]string{"a": nil, "b": nil, "c": {"a"}, "d": {"b", "c"}, "e": {"c"}, "f": {"e"}},
+		},
+		{
+			[]string{"e"},
+			nil,
+			map[string][]string{"a": nil, "c": {"a"}, "e": {"c"}},
+		},
+		{
+			[]string{"d", "b"},
+			nil,
+			map[string][]string{"a": nil, "b": nil, "c": {"a"}, "d": {"b", "c"}},
+		},
+		{
+			// Skipping c also skips e and f, which only depend on it, but not d which also depends on b.
+			nil,
+			[]string{"c"},
+			map[string][]string{"a": nil, "b": nil, "d": {"b"}},
+		},
+		{
+			[]string{"f"},
+			[]string{"a"},
+			map[string][]string{},
+		},
+		{
+			[]string{"d"},
+			[]string{"b"},
+			map[string][]string{"a": nil, "c": {"a"}, "d": {"c"}},
+		},
+	}
+
+	for _, test := range tests {
+		task, err := NewTask(gocontext.Background(), newSteps(), nil, "", nil, false, "", "")
+		if err != nil {
+			t.Fatalf("Failed to create task. Err: %v", err)
+		}
+		err = task.SelectSteps(test.only, test.skip)
+		if len(test.expected) == 0 {
+			if err == nil {
+				t.Errorf("Expected an error when no steps are selected with only %v and skip %v, but got none", test.only, test.skip)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+
+		actual := make(map[string][]string, len(task.Dag.Nodes))
+		for id := range task.Dag.Nodes {
+			actual[id] = nil
+		}
+		for id, deps := range task.Dag.parents() {
+			actual[id] = deps
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Expected %v with only %v and skip %v, but got %v", test.expected, test.only, test.skip, actual)
+		}
+		for _, step := range task.Steps {
+			if _, ok := test.expected[step.ID]; !ok && step.StepStatus != Skipped {
+				t.Errorf("Expected %s to be marked as skipped, but got %s", step.ID, step.StepStatus)
+			}
+		}
+	}
+}
+
+func TestSelectSteps_UnknownStep(t *testing.T) {
+	task, err := NewTask(gocontext.Background(), []*Step{{ID: "a", Cmd: "a"}}, nil, "", nil, false, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+	if err := task.SelectSteps([]string{"missing"}, nil); err == nil {
+		t.Error("Expected an error when selecting an unknown step, but got none")
+	}
+	if err := task.SelectSteps(nil, []string{"missing"}); err == nil {
+		t.Error("Expected an error when skipping an unknown step, but got none")
+	}
+}
@@ -5,14 +5,18 @@ package graph
 
 import (
 	"fmt"
+	"math"
+	"regexp"
 	"runtime"
 	"strings"
 	"time"
 
 	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/pkg/procmanager"
 	"github.com/Azure/acr-builder/pkg/volume"
 	"github.com/Azure/acr-builder/util"
 	"github.com/docker/distribution/reference"
+	units "github.com/docker/go-units"
 	"github.com/pkg/errors"
 )
 
@@ -24,18 +28,49 @@ const (
 	BUILDKIT_ENV_VAR        = "DOCKER_BUILDKIT=1"
 )
 
+// What a push step does with an image whose tag already exists in its registry, see Step.IfTagExists.
+const (
+	// TagExistsProceed pushes the image regardless, which is the default.
+	TagExistsProceed = "proceed"
+	// TagExistsSkip doesn't push the image, so rerunning the step is idempotent.
+	TagExistsSkip = "skip"
+	// TagExistsFail fails the step before anything is pushed, e.g. for registries enforcing immutable tags.
+	TagExistsFail = "fail"
+)
+
 var (
-	errMissingID         = errors.New("step is missing an ID")
-	errMissingProps      = errors.New("step is missing a cmd, build, or push property")
-	errIDContainsSpace   = errors.New("step ID cannot contain spaces")
-	errInvalidDeps       = errors.New("step cannot contain other IDs in when if the immediate execution token is specified")
-	errInvalidStepType   = errors.New("step must only contain a single build, cmd, or push property")
-	errInvalidRetries    = errors.New("step must specify retries >= 0")
-	errInvalidRepeat     = errors.New("step must specify repeat >= 0")
-	errInvalidCacheValue = errors.New("invalid value for cache property. Valid values are 'enabled', 'disabled'")
-	errInvalidMountsUse  = errors.New("invalid use of Mounts. Mounts must have unique container paths and only used for cmd or build steps")
+	errMissingID          = errors.New("step is missing an ID")
+	errMissingProps       = errors.New("step is missing a cmd, build, or push property")
+	errIDContainsSpace    = errors.New("step ID cannot contain spaces")
+	errInvalidDeps        = errors.New("step cannot contain other IDs in when if the immediate execution token is specified")
+	errInvalidStepType    = errors.New("step must only contain a single build, cmd, or push property")
+	errInvalidRetries     = errors.New("step must specify retries >= 0")
+	errInvalidRepeat      = errors.New("step must specify repeat >= 0")
+	errInvalidCacheValue  = errors.New("invalid value for cache property. Valid values are 'enabled', 'disabled'")
+	errInvalidMountsUse   = errors.New("invalid use of Mounts. Mounts must have unique container paths and only used for cmd or build steps")
+	errStageContainsSpace = errors.New("step stage cannot contain spaces")
+	errInvalidScriptUse   = errors.New("invalid use of script. script must be used with a cmd step specifying the image to run it in, and can't be used with entryPoint")
+	errInvalidShellUse    = errors.New("shell can only be used with script")
+	errInvalidSecretFiles = errors.New("invalid use of secretFiles. secretFiles must be unique NAME=value pairs, where NAME is a valid environment variable name, and only used for cmd steps")
+	errInvalidVerifyAfter = errors.New("verifyAfter can only be used with push steps")
+	errInvalidCACerts     = errors.New("caCertificates can only be used with cmd steps")
+	errInvalidTrustStore  = errors.New("updateTrustStore can only be used with caCertificates")
+	errInvalidTrustEntry  = errors.New("updateTrustStore requires an entryPoint or a script, the image's own entrypoint is replaced by sh")
+	errInvalidIfTagExists = errors.New("invalid value for ifTagExists property. Valid values are 'proceed', 'skip', 'fail', and it can only be used with push steps")
+	errInvalidSkipIfExist = errors.New("skipIfExists can only be used with push steps, and only with ifTagExists set to 'skip' if at all")
+	errInvalidImageUse    = errors.New("image can only be used with cmd steps")
+	errInvalidPinImage    = errors.New("pinImage can only be used with cmd and build steps")
+	errInvalidArgsFile    = errors.New("argsFile can only be used with build steps")
+	errInvalidAllowFail   = errors.New("allowFailure and ignoreErrors cannot both be set")
+	errInvalidExitCodes   = errors.New("retryOnExitCodes and neverRetryOnExitCodes cannot both be set")
+	errInvalidOOMFactor   = errors.New("oomMemoryFactor must be greater than 1 and can only be used with retryOnOOM and memory")
+	errInvalidMemoryUse   = errors.New("memory, retryOnOOM and oomMemoryFactor can only be used by cmd steps")
+	errInvalidOOMDetach   = errors.New("retryOnOOM can't be used with detach, the container of a detached step keeps running after the step")
+	errInvalidOnFailure   = errors.New("onFailure steps can't use when or stage, they run once the task has failed")
 )
 
+var secretFileNameRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
 type chanBool chan bool
 
 // MarshalYAML for chan bool's in step. Avoids having Marshall try to render chan bool values as these
@@ -57,14 +92,19 @@ type Step struct {
 	Build            string          `yaml:"build"`
 	WorkingDirectory string          `yaml:"workingDirectory"`
 	EntryPoint       string          `yaml:"entryPoint"`
+	Script           string          `yaml:"script"`
+	Shell            string          `yaml:"shell"`
 	User             string          `yaml:"user"`
 	Network          string          `yaml:"network"`
 	Isolation        string          `yaml:"isolation"`
 	CPUS             string          `yaml:"cpus"`
+	Memory           string          `yaml:"memory"`
 	Cache            string          `yaml:"cache"`
+	Stage            string          `yaml:"stage"`
 	Mounts           []*volume.Mount `yaml:"volumeMounts"`
 	Push             []string        `yaml:"push"`
 	Envs             []string        `yaml:"env"`
+	SecretFiles      []string        `yaml:"secretFiles"`
 	Expose           []string        `yaml:"expose"`
 	Ports            []string        `yaml:"ports"`
 	When             []string        `yaml:"when"`
@@ -79,6 +119,15 @@ type Step struct {
 	// Retries specifies how many times a Step will be retried if it fails after its initial execution.
 	Retries       int      `yaml:"retries"`
 	RetryOnErrors []string `yaml:"retryOnErrors"`
+	// RetryOnExitCodes only retries the step if it exits with one of the exit codes or ranges of exit codes, e.g. "75" or "100-110".
+	RetryOnExitCodes []string `yaml:"retryOnExitCodes"`
+	// NeverRetryOnExitCodes never retries the step if it exits with one of the exit codes or ranges of exit codes.
+	NeverRetryOnExitCodes []string `yaml:"neverRetryOnExitCodes"`
+	// RetryOnOOM retries the step if its container is killed for running out of memory, regardless of
+	// retryOnErrors, retryOnExitCodes and neverRetryOnExitCodes.
+	RetryOnOOM bool `yaml:"retryOnOOM"`
+	// OOMMemoryFactor multiplies the step's memory limit each time it's retried after running out of memory.
+	OOMMemoryFactor float64 `yaml:"oomMemoryFactor"`
 	// Repeat specifies how many times a Step will be repeated after its initial execution.
 	Repeat                          int  `yaml:"repeat"`
 	Keep                            bool `yaml:"keep"`
@@ -87,13 +136,52 @@ type Step struct {
 	IgnoreErrors                    bool `yaml:"ignoreErrors"`
 	DisableWorkingDirectoryOverride bool `yaml:"disableWorkingDirectoryOverride"`
 	Pull                            bool `yaml:"pull"`
+	// AllowFailure records the step's failure but, unlike IgnoreErrors, runs its dependents without marking it as successful.
+	AllowFailure bool `yaml:"allowFailure"`
+	// ArgsFile is the path to a .env style file whose KEY=VALUE lines are passed to a build step as build args.
+	ArgsFile string `yaml:"argsFile"`
+	// Image is the image a cmd step runs in, in which case cmd is only the command to run.
+	Image string `yaml:"image"`
+	// PinImage runs a cmd step's image by the digest it resolves to when the step starts, and builds
+	// a build step with the base images of all of its Dockerfile's stages pinned to their digests.
+	PinImage bool `yaml:"pinImage"`
+	// VerifyAfter verifies that each image pushed by a push step resolves to the pushed digest afterwards.
+	VerifyAfter bool `yaml:"verifyAfter"`
+	// CACertificates are additional CA certificates mounted into a cmd step, each a PEM encoded certificate,
+	// e.g. a rendered secret, or the path of a file containing PEM encoded certificates in the step's working directory.
+	CACertificates []string `yaml:"caCertificates"`
+	// UpdateTrustStore adds the CACertificates to the trust store of the step's container before its command runs.
+	UpdateTrustStore bool `yaml:"updateTrustStore"`
+	// IfTagExists is what a push step does with each image whose tag already exists in its registry,
+	// checked before pushing: proceed, skip pushing the image, or fail the step, see TagExistsProceed.
+	IfTagExists string `yaml:"ifTagExists"`
+	// SkipIfExists is shorthand for an IfTagExists of skip, so rerunning a push step is idempotent.
+	SkipIfExists bool `yaml:"skipIfExists"`
+	// DownloadArtifacts are downloaded into the working directory before the step runs.
+	DownloadArtifacts []*Artifact `yaml:"downloadArtifacts"`
+	// UploadArtifacts are uploaded from the working directory after the step succeeds.
+	UploadArtifacts []*Artifact `yaml:"uploadArtifacts"`
+	// Target marks the step as an outcome of the task. Steps which no target depends on are reported as unreachable.
+	Target bool `yaml:"target"`
+	// ConcurrencyGroup serializes the step with the other steps in the same group, which never run at the same time
+	// even if their dependencies allow it, e.g. steps sharing an external test database.
+	ConcurrencyGroup string `yaml:"concurrencyGroup"`
+	// OnFailure only runs the step once the Task has failed, after its other steps, e.g. to clean up external
+	// resources. Other steps can't depend on it, and it's given a grace period to run after the Task's total timeout.
+	OnFailure bool `yaml:"onFailure"`
 
 	UsesBuildkit bool
 
+	// GeneratedID is true if the step didn't specify an ID and one was generated from its index.
+	GeneratedID bool `yaml:"-"`
+
 	StartTime  time.Time
 	EndTime    time.Time
 	StepStatus StepStatus
 
+	// FailureMessage is the error the step failed with, if it failed.
+	FailureMessage string `yaml:"-"`
+
 	// CompletedChan can be used to signal to readers
 	// that the step has been processed.
 	CompletedChan chanBool
@@ -102,6 +190,9 @@ type Step struct {
 	Tags                 []string
 	BuildArgs            []string
 	DefaultBuildCacheTag string
+
+	// FileBuildArgs are the build args read from the ArgsFile, which the build args of the build command override.
+	FileBuildArgs []string `yaml:"-"`
 }
 
 // Validate validates the step and returns an error if the Step has problems.
@@ -118,15 +209,92 @@ func (s *Step) Validate() error {
 	if s.Repeat < 0 {
 		return errInvalidRepeat
 	}
+	if s.Image != "" {
+		if s.IsBuildStep() || s.IsPushStep() {
+			return errInvalidImageUse
+		}
+		if err := validateImageReference(s.Image); err != nil {
+			return err
+		}
+	}
 	if (s.IsCmdStep() && s.IsPushStep()) || (s.IsCmdStep() && s.IsBuildStep()) || (s.IsBuildStep() && s.IsPushStep()) {
 		return errInvalidStepType
 	}
 	if util.ContainsSpace(s.ID) {
 		return errIDContainsSpace
 	}
+	if util.ContainsSpace(s.Stage) {
+		return errStageContainsSpace
+	}
 	if !s.IsCmdStep() && !s.IsBuildStep() && !s.IsPushStep() {
 		return errMissingProps
 	}
+	if s.IsScriptStep() && (!s.IsCmdStep() || s.EntryPoint != "") {
+		return errInvalidScriptUse
+	}
+	if s.Shell != "" && !s.IsScriptStep() {
+		return errInvalidShellUse
+	}
+	if s.AllowFailure && s.IgnoreErrors {
+		return errInvalidAllowFail
+	}
+	if s.OnFailure && (len(s.When) > 0 || s.HasStage()) {
+		return errInvalidOnFailure
+	}
+	if len(s.RetryOnExitCodes) > 0 && len(s.NeverRetryOnExitCodes) > 0 {
+		return errInvalidExitCodes
+	}
+	if _, err := procmanager.ParseExitCodeRanges(s.RetryOnExitCodes); err != nil {
+		return errors.Wrap(err, "invalid retryOnExitCodes")
+	}
+	if _, err := procmanager.ParseExitCodeRanges(s.NeverRetryOnExitCodes); err != nil {
+		return errors.Wrap(err, "invalid neverRetryOnExitCodes")
+	}
+	if (s.Memory != "" || s.RetryOnOOM || s.OOMMemoryFactor != 0) && !s.IsCmdStep() {
+		return errInvalidMemoryUse
+	}
+	if s.RetryOnOOM && s.Detach {
+		return errInvalidOOMDetach
+	}
+	if s.Memory != "" {
+		if _, err := units.RAMInBytes(s.Memory); err != nil {
+			return errors.Wrap(err, "invalid memory")
+		}
+	}
+	if s.OOMMemoryFactor != 0 && (s.OOMMemoryFactor <= 1 || !s.RetryOnOOM || s.Memory == "") {
+		return errInvalidOOMFactor
+	}
+	if s.ArgsFile != "" && !s.IsBuildStep() {
+		return errInvalidArgsFile
+	}
+	if s.PinImage && !s.IsCmdStep() && !s.IsBuildStep() {
+		return errInvalidPinImage
+	}
+	if s.VerifyAfter && !s.IsPushStep() {
+		return errInvalidVerifyAfter
+	}
+	if len(s.CACertificates) > 0 && !s.IsCmdStep() {
+		return errInvalidCACerts
+	}
+	if s.UpdateTrustStore && len(s.CACertificates) == 0 {
+		return errInvalidTrustStore
+	}
+	if s.UpdateTrustStore && !s.IsScriptStep() && s.EntryPoint == "" {
+		return errInvalidTrustEntry
+	}
+	if s.IfTagExists != "" {
+		switch s.IfTagExists {
+		case TagExistsProceed, TagExistsSkip, TagExistsFail:
+		default:
+			return errInvalidIfTagExists
+		}
+		if !s.IsPushStep() {
+			return errInvalidIfTagExists
+		}
+	}
+	if s.SkipIfExists && (!s.IsPushStep() || s.IfTagExists != "" && s.IfTagExists != TagExistsSkip) {
+		return errInvalidSkipIfExist
+	}
 	if s.HasMounts() {
 		if !s.IsCmdStep() && !s.IsBuildStep() {
 			return errInvalidMountsUse
@@ -136,6 +304,37 @@ func (s *Step) Validate() error {
 			return valMounts
 		}
 	}
+	if len(s.DownloadArtifacts) > 0 || len(s.UploadArtifacts) > 0 {
+		if !s.IsCmdStep() && !s.IsBuildStep() {
+			return errInvalidArtifactsUse
+		}
+		if s.Detach && len(s.UploadArtifacts) > 0 {
+			return errInvalidUploadDetach
+		}
+		for _, artifact := range s.DownloadArtifacts {
+			if err := artifact.Validate(false); err != nil {
+				return err
+			}
+		}
+		for _, artifact := range s.UploadArtifacts {
+			if err := artifact.Validate(true); err != nil {
+				return err
+			}
+		}
+	}
+	if s.HasSecretFiles() {
+		if !s.IsCmdStep() {
+			return errInvalidSecretFiles
+		}
+		names := make(map[string]struct{}, len(s.SecretFiles))
+		for _, secretFile := range s.SecretFiles {
+			name, _ := splitSecretFile(secretFile)
+			if _, exists := names[name]; exists || !secretFileNameRegex.MatchString(name) || !strings.Contains(secretFile, "=") {
+				return errInvalidSecretFiles
+			}
+			names[name] = struct{}{}
+		}
+	}
 	for _, dep := range s.When {
 		if dep == ImmediateExecutionToken && len(s.When) > 1 {
 			return errInvalidDeps
@@ -206,9 +405,12 @@ func (s *Step) Equals(t *Step) bool {
 		util.StringSequenceEquals(s.Push, t.Push) &&
 		s.WorkingDirectory == t.WorkingDirectory &&
 		s.EntryPoint == t.EntryPoint &&
+		s.Script == t.Script &&
+		s.Shell == t.Shell &&
 		util.StringSequenceEquals(s.Ports, t.Ports) &&
 		util.StringSequenceEquals(s.Expose, t.Expose) &&
 		util.StringSequenceEquals(s.Envs, t.Envs) &&
+		util.StringSequenceEquals(s.SecretFiles, t.SecretFiles) &&
 		s.Timeout == t.Timeout &&
 		util.StringSequenceEquals(s.When, t.When) &&
 		util.IntSequenceEquals(s.ExitedWith, t.ExitedWith) &&
@@ -222,11 +424,31 @@ func (s *Step) Equals(t *Step) bool {
 		s.Network == t.Network &&
 		s.Isolation == t.Isolation &&
 		s.Cache == t.Cache &&
+		s.Stage == t.Stage &&
 		s.IgnoreErrors == t.IgnoreErrors &&
+		s.AllowFailure == t.AllowFailure &&
+		s.ConcurrencyGroup == t.ConcurrencyGroup &&
+		s.OnFailure == t.OnFailure &&
 		s.Retries == t.Retries &&
+		util.StringSequenceEquals(s.RetryOnExitCodes, t.RetryOnExitCodes) &&
+		util.StringSequenceEquals(s.NeverRetryOnExitCodes, t.NeverRetryOnExitCodes) &&
+		s.RetryOnOOM == t.RetryOnOOM &&
+		s.OOMMemoryFactor == t.OOMMemoryFactor &&
+		s.Memory == t.Memory &&
 		s.RetryDelayInSeconds == t.RetryDelayInSeconds &&
 		s.DisableWorkingDirectoryOverride == t.DisableWorkingDirectoryOverride &&
 		s.Pull == t.Pull &&
+		s.ArgsFile == t.ArgsFile &&
+		s.Image == t.Image &&
+		s.PinImage == t.PinImage &&
+		s.VerifyAfter == t.VerifyAfter &&
+		util.StringSequenceEquals(s.CACertificates, t.CACertificates) &&
+		s.UpdateTrustStore == t.UpdateTrustStore &&
+		s.IfTagExists == t.IfTagExists &&
+		s.SkipIfExists == t.SkipIfExists &&
+		artifactsEqual(s.DownloadArtifacts, t.DownloadArtifacts) &&
+		artifactsEqual(s.UploadArtifacts, t.UploadArtifacts) &&
+		s.Target == t.Target &&
 		s.Repeat == t.Repeat
 }
 
@@ -257,6 +479,99 @@ func (s *Step) HasMounts() bool {
 	return len(s.Mounts) > 0
 }
 
+// HasSecretFiles returns true if the Step materializes at least 1 secret as a file, false otherwise.
+func (s *Step) HasSecretFiles() bool {
+	if s == nil {
+		return false
+	}
+	return len(s.SecretFiles) > 0
+}
+
+// GetSecretFiles returns a map of each secret file's name to its value.
+func (s *Step) GetSecretFiles() map[string]string {
+	secretFiles := make(map[string]string, len(s.SecretFiles))
+	for _, secretFile := range s.SecretFiles {
+		name, value := splitSecretFile(secretFile)
+		secretFiles[name] = value
+	}
+	return secretFiles
+}
+
+func splitSecretFile(secretFile string) (string, string) {
+	parts := strings.SplitN(secretFile, "=", 2)
+	if len(parts) < 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+// HasStage returns true if the Step belongs to a stage, false otherwise.
+func (s *Step) HasStage() bool {
+	if s == nil {
+		return false
+	}
+	return s.Stage != ""
+}
+
+// applyImage prepends the step's image to its cmd, so the image is run like one specified by cmd.
+func (s *Step) applyImage() {
+	if s.Image != "" {
+		s.Cmd = strings.TrimSpace(s.Image + " " + s.Cmd)
+	}
+}
+
+// validateImageReference returns an error if img isn't a valid image reference.
+func validateImageReference(img string) error {
+	ipv6Registry, remainder, err := image.SplitIPv6Registry(img)
+	if err != nil {
+		return errors.Wrapf(err, "invalid image: %s", img)
+	}
+	parsePath := img
+	if ipv6Registry != "" {
+		parsePath = image.IPv6RegistryPlaceholder + remainder
+	}
+	if _, err := reference.Parse(parsePath); err != nil {
+		return errors.Wrapf(err, "invalid image: %s", img)
+	}
+	return nil
+}
+
+// TagExistsPolicy returns what the push step does with an image whose tag already exists, see IfTagExists,
+// which is skip if SkipIfExists is set.
+func (s *Step) TagExistsPolicy() string {
+	if s.SkipIfExists {
+		return TagExistsSkip
+	}
+	if s.IfTagExists == "" {
+		return TagExistsProceed
+	}
+	return s.IfTagExists
+}
+
+// ExitCodeRetryPolicy returns the policy deciding which exit codes the step is retried on,
+// or nil if the step can be retried on any exit code.
+func (s *Step) ExitCodeRetryPolicy() *procmanager.ExitCodeRetryPolicy {
+	if len(s.RetryOnExitCodes) == 0 && len(s.NeverRetryOnExitCodes) == 0 && !s.RetryOnOOM {
+		return nil
+	}
+	// The exit codes are parsed when the step is validated, so they're always valid here.
+	retryOn, _ := procmanager.ParseExitCodeRanges(s.RetryOnExitCodes)
+	neverRetryOn, _ := procmanager.ParseExitCodeRanges(s.NeverRetryOnExitCodes)
+	return &procmanager.ExitCodeRetryPolicy{RetryOn: retryOn, NeverRetryOn: neverRetryOn, RetryOnOOM: s.RetryOnOOM}
+}
+
+// OOMRetryMemory returns the memory limit, in bytes, to retry the step with after it has been killed for
+// running out of memory oomKills times, i.e. its memory limit multiplied by OOMMemoryFactor once per kill.
+// It returns the step's memory limit as is if it has no OOMMemoryFactor.
+func (s *Step) OOMRetryMemory(oomKills int) string {
+	if s.OOMMemoryFactor == 0 {
+		return s.Memory
+	}
+	// The memory limit is parsed when the step is validated, so it's always valid here.
+	memory, _ := units.RAMInBytes(s.Memory)
+	return fmt.Sprintf("%.0f", math.Ceil(float64(memory)*math.Pow(s.OOMMemoryFactor, float64(oomKills))))
+}
+
 // IsCmdStep returns true if the Step is a command step, false otherwise.
 func (s *Step) IsCmdStep() bool {
 	if s == nil {
@@ -265,6 +580,14 @@ func (s *Step) IsCmdStep() bool {
 	return s.Cmd != ""
 }
 
+// IsScriptStep returns true if the Step runs a script in the image specified by its cmd, false otherwise.
+func (s *Step) IsScriptStep() bool {
+	if s == nil {
+		return false
+	}
+	return s.Script != ""
+}
+
 // IsBuildStep returns true if the Step is a build step, false otherwise.
 func (s *Step) IsBuildStep() bool {
 	if s == nil {
@@ -348,15 +671,11 @@ func getDomainPath(s string) (string, string, error) {
 
 // addBuildCacheOptsToCmd appends the build cache options to the original Build command
 func addBuildCacheOptsToCmd(domain, path, tag, originalBuildCmd string) (string, error) {
-	named, err := reference.WithName(domain + "/" + path)
-	if err != nil {
-		return "", errors.Wrap(err, "failed to parse reference to be used for cache image")
-	}
-	cacheImage, err := reference.WithTag(named, tag)
+	cacheImage, err := image.NewReference(domain, path, tag, "")
 	if err != nil {
-		return "", errors.Wrap(err, "failed to attach cache ID tag to the repo for build cache")
+		return "", errors.Wrap(err, "failed to create the reference of the build cache image")
 	}
-	return fmt.Sprintf("--load --cache-to=type=registry,ref=%s,mode=max --cache-from=type=registry,ref=%s %s", cacheImage.String(), cacheImage.String(), originalBuildCmd), nil
+	return fmt.Sprintf("--load --cache-to=type=registry,ref=%s,mode=max --cache-from=type=registry,ref=%s %s", cacheImage.Reference, cacheImage.Reference, originalBuildCmd), nil
 }
 
 func invokesBuildkit(envs []string) bool {
@@ -18,4 +18,11 @@ const (
 
 	// Failed means the step failed because of an error.
 	Failed StepStatus = "failed"
+
+	// AllowedFailure means the step failed because of an error, but is allowed to fail,
+	// so its dependents still run and the task doesn't fail because of it.
+	AllowedFailure StepStatus = "allowedfailure"
+
+	// TimedOut means the step was running when the task exceeded its total timeout, so it was killed.
+	TimedOut StepStatus = "timedout"
 )
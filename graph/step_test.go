@@ -3,9 +3,11 @@
 package graph
 
 import (
+	"reflect"
 	"strings"
 	"testing"
 
+	"github.com/Azure/acr-builder/pkg/procmanager"
 	"github.com/Azure/acr-builder/pkg/volume"
 )
 
@@ -204,6 +206,133 @@ func TestValidate(t *testing.T) {
 			},
 			false,
 		},
+		{
+			&Step{ID: "a", Cmd: "ubuntu", Script: "echo $FOO\necho bar"},
+			false,
+		},
+		{
+			&Step{ID: "a", Cmd: "ubuntu", Script: "echo foo", Shell: "sh"},
+			false,
+		},
+		{
+			// A script needs an image to run in.
+			&Step{ID: "a", Build: "-f Dockerfile .", Script: "echo foo"},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "ubuntu", EntryPoint: "sh", Script: "echo foo"},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "ubuntu", Shell: "sh"},
+			true,
+		},
+		{
+			&Step{ID: "a", Push: []string{"example.azurecr.io/app:v1"}, VerifyAfter: true},
+			false,
+		},
+		{
+			&Step{ID: "a", Image: "node:18", Cmd: "node:18 npm test", PinImage: true},
+			false,
+		},
+		{
+			&Step{ID: "a", Image: "node:18", Build: "-t app ."},
+			true,
+		},
+		{
+			&Step{ID: "a", Image: "Node:18", Cmd: "Node:18 npm test"},
+			true,
+		},
+		{
+			&Step{ID: "a", Build: "-t app .", PinImage: true},
+			false,
+		},
+		{
+			// Only the images of cmd and build steps can be pinned.
+			&Step{ID: "a", Push: []string{"example.azurecr.io/app:v1"}, PinImage: true},
+			true,
+		},
+		{
+			// Only pushed images can be verified.
+			&Step{ID: "a", Build: "-t app .", VerifyAfter: true},
+			true,
+		},
+		{
+			&Step{ID: "a", Push: []string{"example.azurecr.io/app:v1"}, IfTagExists: TagExistsFail},
+			false,
+		},
+		{
+			&Step{ID: "a", Push: []string{"example.azurecr.io/app:v1"}, IfTagExists: "overwrite"},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "ubuntu https://internal", EntryPoint: "curl", CACertificates: []string{"certs/ca.pem"}, UpdateTrustStore: true},
+			false,
+		},
+		{
+			&Step{ID: "a", Cmd: "ubuntu", Script: "curl https://internal", CACertificates: []string{"certs/ca.pem"}, UpdateTrustStore: true},
+			false,
+		},
+		{
+			// The image's entrypoint is replaced by sh, so the command must specify its own.
+			&Step{ID: "a", Cmd: "ubuntu curl https://internal", CACertificates: []string{"certs/ca.pem"}, UpdateTrustStore: true},
+			true,
+		},
+		{
+			// Only cmd steps mount CA certificates.
+			&Step{ID: "a", Build: "-t app .", CACertificates: []string{"certs/ca.pem"}},
+			true,
+		},
+		{
+			// There must be CA certificates to add to the trust store.
+			&Step{ID: "a", Cmd: "ubuntu", UpdateTrustStore: true},
+			true,
+		},
+		{
+			// Only push steps check whether their tags exist.
+			&Step{ID: "a", Build: "-t app .", IfTagExists: TagExistsSkip},
+			true,
+		},
+		{
+			&Step{ID: "a", Push: []string{"example.azurecr.io/app:v1"}, SkipIfExists: true},
+			false,
+		},
+		{
+			&Step{ID: "a", Push: []string{"example.azurecr.io/app:v1"}, SkipIfExists: true, IfTagExists: TagExistsSkip},
+			false,
+		},
+		{
+			// skipIfExists can't contradict ifTagExists.
+			&Step{ID: "a", Push: []string{"example.azurecr.io/app:v1"}, SkipIfExists: true, IfTagExists: TagExistsFail},
+			true,
+		},
+		{
+			&Step{ID: "a", Build: "-t app .", SkipIfExists: true},
+			true,
+		},
+		{
+			// A step can't both ignore errors and be allowed to fail.
+			&Step{ID: "a", Cmd: "hello-world", IgnoreErrors: true, AllowFailure: true},
+			true,
+		},
+		{
+			// Only build steps read build args from a file.
+			&Step{ID: "a", Cmd: "hello-world", ArgsFile: "build.env"},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "hello-world", OnFailure: true},
+			false,
+		},
+		{
+			// Steps which run on failure don't depend on other steps, nor belong to a stage.
+			&Step{ID: "a", Cmd: "hello-world", OnFailure: true, When: []string{"b"}},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "hello-world", OnFailure: true, Stage: "test"},
+			true,
+		},
 	}
 
 	for _, test := range tests {
@@ -514,6 +643,217 @@ func TestHasMounts(t *testing.T) {
 		}
 	}
 }
+func TestValidateSecretFiles(t *testing.T) {
+	tests := []struct {
+		step        *Step
+		shouldError bool
+	}{
+		{
+			&Step{ID: "a", Cmd: "bash", SecretFiles: []string{"DB_PASSWORD=foo", "TOKEN=a=b"}},
+			false,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", SecretFiles: []string{"EMPTY="}},
+			false,
+		},
+		{
+			// The name must be a valid environment variable name.
+			&Step{ID: "a", Cmd: "bash", SecretFiles: []string{"1TOKEN=foo"}},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", SecretFiles: []string{"../TOKEN=foo"}},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", SecretFiles: []string{"TOKEN"}},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", SecretFiles: []string{"TOKEN=foo", "TOKEN=bar"}},
+			true,
+		},
+		{
+			// Only cmd steps can use secret files.
+			&Step{ID: "a", Build: "-f Dockerfile .", SecretFiles: []string{"TOKEN=foo"}},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.step.Validate()
+		if test.shouldError && err == nil {
+			t.Fatalf("Expected step: %v to error but it didn't", test.step)
+		}
+		if !test.shouldError && err != nil {
+			t.Fatalf("step: %v shouldn't have errored, but it did; err: %v", test.step, err)
+		}
+	}
+}
+
+func TestValidateArtifacts(t *testing.T) {
+	artifact := func(path, ref string) []*Artifact { return []*Artifact{{Path: path, Ref: ref}} }
+	tests := []struct {
+		step        *Step
+		shouldError bool
+	}{
+		{
+			&Step{ID: "a", Cmd: "bash", DownloadArtifacts: artifact("out/app", "myregistry.azurecr.io/acb-artifacts/app:v1"), UploadArtifacts: artifact("out/app", "myregistry.azurecr.io/acb-artifacts/app:v2")},
+			false,
+		},
+		{
+			&Step{ID: "a", Build: "-f Dockerfile .", UploadArtifacts: artifact("./app.tar", "myregistry.azurecr.io/acb-artifacts/app:v1")},
+			false,
+		},
+		{
+			// Downloaded artifacts can be referenced by digest.
+			&Step{ID: "a", Cmd: "bash", DownloadArtifacts: artifact("app", "myregistry.azurecr.io/acb-artifacts/app@sha256:ca7a0e5e0bb5a0b2a1b1a0c0e7f2af0c3b5c5f1a76d2c0a0d1c7a2a5c0b6e4d8")},
+			false,
+		},
+		{
+			// Uploaded artifacts can't be referenced by digest.
+			&Step{ID: "a", Cmd: "bash", UploadArtifacts: artifact("app", "myregistry.azurecr.io/acb-artifacts/app@sha256:ca7a0e5e0bb5a0b2a1b1a0c0e7f2af0c3b5c5f1a76d2c0a0d1c7a2a5c0b6e4d8")},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", UploadArtifacts: artifact("../app", "myregistry.azurecr.io/acb-artifacts/app:v1")},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", DownloadArtifacts: artifact("/etc/app", "myregistry.azurecr.io/acb-artifacts/app:v1")},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", DownloadArtifacts: artifact(".", "myregistry.azurecr.io/acb-artifacts/app:v1")},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", DownloadArtifacts: artifact("app", "")},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", DownloadArtifacts: artifact("app", "Invalid/App:v1")},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", DownloadArtifacts: []*Artifact{nil}},
+			true,
+		},
+		{
+			&Step{ID: "a", Cmd: "bash", Detach: true, UploadArtifacts: artifact("app", "myregistry.azurecr.io/acb-artifacts/app:v1")},
+			true,
+		},
+		{
+			// Push steps have no working directory to store artifacts in.
+			&Step{ID: "a", Push: []string{"myregistry.azurecr.io/app:v1"}, UploadArtifacts: artifact("app", "myregistry.azurecr.io/acb-artifacts/app:v1")},
+			true,
+		},
+	}
+
+	for _, test := range tests {
+		err := test.step.Validate()
+		if test.shouldError && err == nil {
+			t.Fatalf("Expected step: %v to error but it didn't", test.step)
+		}
+		if !test.shouldError && err != nil {
+			t.Fatalf("step: %v shouldn't have errored, but it did; err: %v", test.step, err)
+		}
+	}
+}
+
+func TestValidateRetryExitCodes(t *testing.T) {
+	tests := []struct {
+		step        *Step
+		shouldError bool
+	}{
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, RetryOnExitCodes: []string{"75", "100-110"}}, false},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, NeverRetryOnExitCodes: []string{"1"}}, false},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, RetryOnExitCodes: []string{"75"}, NeverRetryOnExitCodes: []string{"1"}}, true},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, RetryOnExitCodes: []string{"110-100"}}, true},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, NeverRetryOnExitCodes: []string{"300"}}, true},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, RetryOnOOM: true, Memory: "512m", OOMMemoryFactor: 1.5}, false},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, RetryOnOOM: true, RetryOnExitCodes: []string{"75"}}, false},
+		// The container of a detached step would be removed as soon as it's started.
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, RetryOnOOM: true, Detach: true}, true},
+		{&Step{ID: "a", Cmd: "bash", Memory: "1.5g"}, false},
+		{&Step{ID: "a", Cmd: "bash", Memory: "lots"}, true},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, RetryOnOOM: true, Memory: "512m", OOMMemoryFactor: 1}, true},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, RetryOnOOM: true, OOMMemoryFactor: 2}, true},
+		{&Step{ID: "a", Cmd: "bash", Retries: 2, Memory: "512m", OOMMemoryFactor: 2}, true},
+		{&Step{ID: "a", Build: "-t app .", Memory: "512m"}, true},
+		{&Step{ID: "a", Build: "-t app .", Retries: 2, RetryOnOOM: true}, true},
+		{&Step{ID: "a", Push: []string{"app"}, Retries: 2, RetryOnOOM: true, Memory: "512m", OOMMemoryFactor: 2}, true},
+	}
+
+	for _, test := range tests {
+		err := test.step.Validate()
+		if test.shouldError && err == nil {
+			t.Fatalf("Expected step: %v to error but it didn't", test.step)
+		}
+		if !test.shouldError && err != nil {
+			t.Fatalf("step: %v shouldn't have errored, but it did; err: %v", test.step, err)
+		}
+	}
+}
+
+func TestExitCodeRetryPolicy(t *testing.T) {
+	if policy := (&Step{}).ExitCodeRetryPolicy(); policy != nil {
+		t.Errorf("Expected no policy without exit codes, but got %+v", policy)
+	}
+
+	task, err := NewTaskFromString(`
+steps:
+  - cmd: make
+    retries: 2
+    retryOnExitCodes: [75, "100-110"]
+`)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	policy := task.Steps[0].ExitCodeRetryPolicy()
+	expected := &procmanager.ExitCodeRetryPolicy{RetryOn: []procmanager.ExitCodeRange{{Min: 75, Max: 75}, {Min: 100, Max: 110}}, NeverRetryOn: []procmanager.ExitCodeRange{}}
+	if !reflect.DeepEqual(policy, expected) {
+		t.Errorf("Expected policy %+v, but got %+v", expected, policy)
+	}
+
+	if policy := (&Step{RetryOnOOM: true}).ExitCodeRetryPolicy(); policy == nil || !policy.RetryOnOOM {
+		t.Errorf("Expected a policy retrying OOM kills, but got %+v", policy)
+	}
+}
+
+func TestOOMRetryMemory(t *testing.T) {
+	tests := []struct {
+		step     *Step
+		oomKills int
+		expected string
+	}{
+		{&Step{Memory: "512m"}, 1, "512m"},
+		{&Step{Memory: "512m", OOMMemoryFactor: 2}, 0, "536870912"},
+		{&Step{Memory: "512m", OOMMemoryFactor: 2}, 1, "1073741824"},
+		{&Step{Memory: "512m", OOMMemoryFactor: 2}, 2, "2147483648"},
+		{&Step{Memory: "1000", OOMMemoryFactor: 1.5}, 1, "1500"},
+		{&Step{Memory: "1001", OOMMemoryFactor: 1.5}, 1, "1502"},
+	}
+
+	for _, test := range tests {
+		if actual := test.step.OOMRetryMemory(test.oomKills); actual != test.expected {
+			t.Errorf("Expected %s after %d OOM kills of %+v, but got %s", test.expected, test.oomKills, test.step, actual)
+		}
+	}
+}
+
+func TestGetSecretFiles(t *testing.T) {
+	s := &Step{SecretFiles: []string{"DB_PASSWORD=foo", "TOKEN=a=b", "EMPTY="}}
+	expected := map[string]string{
+		"DB_PASSWORD": "foo",
+		"TOKEN":       "a=b",
+		"EMPTY":       "",
+	}
+	if actual := s.GetSecretFiles(); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v but got %v", expected, actual)
+	}
+}
+
 func TestUseBuildCache(t *testing.T) {
 	tests := []struct {
 		s        *Step
@@ -9,11 +9,15 @@ import (
 	"io/ioutil"
 	"log"
 	"runtime"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/Azure/acr-builder/pkg/volume"
 	"github.com/Azure/acr-builder/secretmgmt"
+	"github.com/Azure/acr-builder/tokenutil"
 	"github.com/Azure/acr-builder/util"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 	yaml "gopkg.in/yaml.v2"
 )
@@ -43,20 +47,59 @@ var (
 type ResolvedRegistryCred struct {
 	Username *secretmgmt.Secret
 	Password *secretmgmt.Secret
+
+	// BearerToken means the Password is a registry bearer token, which is used as is to resolve digests
+	// instead of being exchanged for a token, and the Username is empty.
+	BearerToken bool
+
+	// Type is the class of the credential which was resolved, e.g. msi, see RegistryCredential.Type.
+	Type string
 }
 
 // RegistryLoginCredentials is a map of registryName -> ResolvedRegistryCred
 type RegistryLoginCredentials map[string]*ResolvedRegistryCred
 
+// CredentialProvider provides the resolved credentials for registries.
+type CredentialProvider interface {
+	// GetCredential returns the credential for the registry, or false if there isn't one.
+	GetCredential(registry string) (*ResolvedRegistryCred, bool)
+}
+
+var _ CredentialProvider = RegistryLoginCredentials{}
+
+// GetCredential returns the credential for the registry, or false if there isn't one.
+// An exact match takes precedence over a wildcard match, which takes precedence over the default credential.
+func (r RegistryLoginCredentials) GetCredential(registry string) (*ResolvedRegistryCred, bool) {
+	pattern, ok := r.MatchRegistry(registry)
+	if !ok {
+		return nil, false
+	}
+	return r[pattern], true
+}
+
+// MatchRegistry returns the registry or registry pattern of the credential used for the registry.
+func (r RegistryLoginCredentials) MatchRegistry(registry string) (string, bool) {
+	if _, ok := r[registry]; ok {
+		return registry, true
+	}
+	patterns := make([]string, 0, len(r))
+	for pattern := range r {
+		patterns = append(patterns, pattern)
+	}
+	return MatchRegistry(registry, patterns)
+}
+
 // Task represents a task execution.
 type Task struct {
 	Steps                    []*Step              `yaml:"steps"`
 	StepTimeout              int                  `yaml:"stepTimeout,omitempty"`
+	TotalTimeout             int                  `yaml:"totalTimeout,omitempty"` // The maximum duration of the Task in seconds, 0 for no limit.
 	Secrets                  []*secretmgmt.Secret `yaml:"secrets,omitempty"`
 	Networks                 []*Network           `yaml:"networks,omitempty"`
 	Volumes                  []*volume.Volume     `yaml:"volumes,omitempty"`
 	Envs                     []string             `yaml:"env,omitempty"`
 	WorkingDirectory         string               `yaml:"workingDirectory,omitempty"`
+	FallbackDigests          map[string]string    `yaml:"fallbackDigests,omitempty"` // The digests used for references whose registry is unavailable.
 	Version                  string               `yaml:"version,omitempty"`
 	RegistryName             string
 	Registry                 string
@@ -93,12 +136,18 @@ type TaskOptions struct {
 
 	// GlobalAliases keeps track of all the Task native global aliases
 	GlobalAliases []byte
+
+	// TaskFile is the path of the file the Task was read from, used to report the positions of its problems
+	TaskFile string
 }
 
 // UnmarshalTaskFromString unmarshals a Task from a raw string.
 func UnmarshalTaskFromString(ctx context.Context, data string, opts *TaskOptions) (*Task, error) {
 	t, err := NewTaskFromString(data)
 	if err != nil {
+		if errs, ok := err.(TaskFileErrors); ok {
+			err = errs.WithPath(opts.TaskFile)
+		}
 		return t, errors.Wrap(err, "failed to deserialize task and validate")
 	}
 	err = t.AddTaskDefaults(ctx, opts)
@@ -154,6 +203,9 @@ func UnmarshalTaskFromFile(ctx context.Context, file string, opts *TaskOptions)
 	}
 	t, err := NewTaskFromBytes(data)
 	if err != nil {
+		if errs, ok := err.(TaskFileErrors); ok {
+			err = errs.WithPath(file)
+		}
 		return t, errors.Wrap(err, "failed to deserialize task and validate")
 	}
 
@@ -173,45 +225,95 @@ func NewTaskFromString(data string) (*Task, error) {
 }
 
 // NewTaskFromBytes unmarshals a Task from given bytes without any initialization.
+// Problems found in the Task are returned as TaskFileErrors, located in the given bytes.
 func NewTaskFromBytes(data []byte) (*Task, error) {
 	t := &Task{}
 	if err := yaml.Unmarshal(data, t); err != nil {
+		return t, newDecodeErrors(err)
+	}
+	if err := t.Validate(); err != nil {
+		if errs, ok := err.(TaskFileErrors); ok {
+			errs.locate(data)
+		}
 		return t, err
 	}
-	return t, t.Validate()
+	return t, nil
 }
 
-// Validate validates the task and returns an error if the Task has problems.
+// Validate validates the task and returns TaskFileErrors with all of the Task's problems, if any.
 func (t *Task) Validate() error {
+	var errs TaskFileErrors
+	addErr := func(section string, item int, err error) {
+		errs = append(errs, &TaskFileError{Message: err.Error(), section: section, item: item})
+	}
+
 	// Validate secrets if exists
 	idMap := make(map[string]struct{}, len(t.Secrets))
-	for _, secret := range t.Secrets {
+	for i, secret := range t.Secrets {
 		err := secret.Validate()
 		if err != nil {
-			if secret.ID == "" {
-				return err
+			if secret.ID != "" {
+				err = errors.Wrap(err, fmt.Sprintf("failed to validate secret with ID: %s", secret.ID))
 			}
-			return errors.Wrap(err, fmt.Sprintf("failed to validate secret with ID: %s", secret.ID))
+			addErr(secretsSection, i, err)
+			continue
 		}
 
 		if _, exists := idMap[secret.ID]; exists {
-			return fmt.Errorf("duplicate secret found with ID: %s", secret.ID)
+			addErr(secretsSection, i, fmt.Errorf("duplicate secret found with ID: %s", secret.ID))
+			continue
 		}
 
 		idMap[secret.ID] = struct{}{}
 	}
 
 	// Validate Volumes if exists
-	if err := ValidateVolumes(t.Volumes); err != nil {
-		return err
+	volumeNames := make(map[string]struct{}, len(t.Volumes))
+	for i, v := range t.Volumes {
+		if err := v.Validate(); err != nil {
+			addErr(volumesSection, i, err)
+			continue
+		}
+		if _, exists := volumeNames[v.Name]; exists {
+			addErr(volumesSection, i, errors.New("volume with duplicate name found"))
+			continue
+		}
+		volumeNames[v.Name] = struct{}{}
 	}
-	// Validate that mounts reference a volume that exists
-	for _, s := range t.Steps {
+
+	references := make([]string, 0, len(t.FallbackDigests))
+	for reference := range t.FallbackDigests {
+		references = append(references, reference)
+	}
+	sort.Strings(references)
+	for _, reference := range references {
+		if _, err := digest.Parse(t.FallbackDigests[reference]); err != nil {
+			errs = append(errs, &TaskFileError{Message: fmt.Sprintf("invalid fallback digest '%s' for reference '%s': %v", t.FallbackDigests[reference], reference, err)})
+		}
+	}
+
+	for i, s := range t.Steps {
+		if s == nil {
+			continue
+		}
+		// Validate the step as it'll be once the Task is initialized, without initializing it.
+		step := *s
+		if step.ID == "" {
+			step.ID = fmt.Sprintf("acb_step_%d", i)
+		}
+		step.applyImage()
+		if err := step.Validate(); err != nil {
+			addErr(stepsSection, i, errors.Wrapf(err, "step ID: %s", step.ID))
+		}
+		// Validate that mounts reference a volume that exists
 		if err := s.ValidateMountVolumeNames(t.Volumes); err != nil {
-			return err
+			addErr(stepsSection, i, errors.Wrapf(err, "step ID: %s", step.ID))
 		}
 	}
-	return nil
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
 }
 
 // NewTask returns a default Task object.
@@ -285,7 +387,11 @@ func (t *Task) initialize(ctx context.Context) error {
 	if t.StepTimeout <= 0 {
 		t.StepTimeout = defaultStepTimeoutInSeconds
 	}
+	if t.TotalTimeout < 0 {
+		return fmt.Errorf("invalid total timeout %d, it can't be negative", t.TotalTimeout)
+	}
 
+	stepIndexes := make(map[string]int, len(t.Steps))
 	for i, s := range t.Steps {
 		// If individual steps don't have step timeouts specified,
 		// stamp the global timeout on them.
@@ -307,9 +413,16 @@ func (t *Task) initialize(ctx context.Context) error {
 		}
 		s.Envs = newEnvs
 
+		s.applyImage()
+
 		if s.ID == "" {
 			s.ID = fmt.Sprintf("acb_step_%d", i)
+			s.GeneratedID = true
 		}
+		if j, exists := stepIndexes[s.ID]; exists {
+			return fmt.Errorf("duplicate step ID: %s is used by %s and %s", s.ID, describeStepID(j, t.Steps[j]), describeStepID(i, s))
+		}
+		stepIndexes[s.ID] = i
 
 		// Override the step's working directory to be the parent's working directory.
 		if s.WorkingDirectory == "" && t.WorkingDirectory != "" {
@@ -329,6 +442,13 @@ func (t *Task) initialize(ctx context.Context) error {
 				s.Tags = util.ParseTags(s.Build)
 			}
 			s.BuildArgs = util.ParseBuildArgs(s.Build)
+			if s.ArgsFile != "" {
+				if s.FileBuildArgs, err = readArgsFile(s.ArgsFile); err != nil {
+					return errors.Wrapf(err, "failed to read the args file of step ID: %s", s.ID)
+				}
+				// The build command's args are passed after the file's, so they take precedence.
+				s.BuildArgs = append(append([]string{}, s.FileBuildArgs...), s.BuildArgs...)
+			}
 
 			if s.UseBuildCacheForBuildStep() {
 				if runtime.GOOS == util.LinuxOS {
@@ -353,8 +473,28 @@ func (t *Task) initialize(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	t.Dag, err = NewDagFromTask(t)
-	return err
+	if t.Dag, err = NewDagFromTask(t); err != nil {
+		return err
+	}
+	t.warnUnreachableSteps()
+	return nil
+}
+
+// readArgsFile reads the build args from the .env style file at path.
+func readArgsFile(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return util.ParseEnvFile(string(data))
+}
+
+// describeStepID describes the step at index i and whether its ID was generated.
+func describeStepID(i int, s *Step) string {
+	if s.GeneratedID {
+		return fmt.Sprintf("step %d (generated ID)", i)
+	}
+	return fmt.Sprintf("step %d (explicit ID)", i)
 }
 
 // UsingRegistryCreds determines whether or not the Task is using registry creds.
@@ -362,6 +502,40 @@ func (t *Task) UsingRegistryCreds() bool {
 	return len(t.RegistryLoginCredentials) > 0
 }
 
+// UsesStages determines whether or not any of the Task's steps are grouped into stages.
+func (t *Task) UsesStages() bool {
+	for _, s := range t.Steps {
+		if s.HasStage() {
+			return true
+		}
+	}
+	return false
+}
+
+// OnFailureSteps returns the steps which only run once the Task has failed, in the order they're declared.
+func (t *Task) OnFailureSteps() []*Step {
+	var steps []*Step
+	for _, s := range t.Steps {
+		if s.OnFailure {
+			steps = append(steps, s)
+		}
+	}
+	return steps
+}
+
+// Stages returns the Task's stage names in the order they're declared.
+func (t *Task) Stages() []string {
+	var stages []string
+	seen := make(map[string]bool)
+	for _, s := range t.Steps {
+		if s.HasStage() && !seen[s.Stage] {
+			seen[s.Stage] = true
+			stages = append(stages, s.Stage)
+		}
+	}
+	return stages
+}
+
 // getNormalizedDockerImageNames normalizes the list of docker images
 // and removes any duplicates.
 func getNormalizedDockerImageNames(dockerImages []string) []string {
@@ -384,10 +558,14 @@ func getNormalizedDockerImageNames(dockerImages []string) []string {
 	return normalizedDockerImages
 }
 
-// mergeEnvs merges the src environment variables into dest.
+// mergeEnvs merges the src environment variables into dest. The merged environment variables are returned
+// in a new slice, so steps never share, and append to, each other's or the task's environment variables.
 func mergeEnvs(dest []string, src []string) ([]string, error) {
 	if len(src) < 1 {
-		return dest, nil
+		if dest == nil {
+			return nil, nil
+		}
+		return append(make([]string, 0, len(dest)), dest...), nil
 	}
 
 	var newEnvs []string
@@ -406,6 +584,8 @@ func mergeEnvs(dest []string, src []string) ([]string, error) {
 		stepmap[pair[0]] = pair[1]
 	}
 
+	merged := make([]string, 0, len(dest)+len(newEnvs))
+	merged = append(merged, dest...)
 	for _, env := range newEnvs {
 		pair := strings.SplitN(env, "=", 2)
 		if len(pair) != 2 {
@@ -413,11 +593,11 @@ func mergeEnvs(dest []string, src []string) ([]string, error) {
 			return dest, err
 		}
 		if _, ok := stepmap[pair[0]]; !ok {
-			dest = append(dest, pair[0]+"="+pair[1])
+			merged = append(merged, pair[0]+"="+pair[1])
 		}
 	}
 
-	return dest, nil
+	return merged, nil
 }
 
 // validateTaskVersion validates the specified version and returns an error if it isn't valid.
@@ -429,10 +609,68 @@ func validateTaskVersion(version string) error {
 	return nil
 }
 
-// ResolveCustomRegistryCredentials resolves all the registry login credentials
+// ResolveCustomRegistryCredentials resolves all the registry login credentials.
+// If multiple credentials are specified for the same registry, they are tried in
+// the order they were specified and the first one to resolve is used.
 func ResolveCustomRegistryCredentials(ctx context.Context, credentials []*RegistryCredential) (RegistryLoginCredentials, error) {
+	var registries []string
+	credsByRegistry := make(map[string][]*RegistryCredential)
+	for _, cred := range credentials {
+		if cred == nil {
+			continue
+		}
+		if _, ok := credsByRegistry[cred.Registry]; !ok {
+			registries = append(registries, cred.Registry)
+		}
+		credsByRegistry[cred.Registry] = append(credsByRegistry[cred.Registry], cred)
+	}
+
+	var singleCreds []*RegistryCredential
+	for _, registry := range registries {
+		if len(credsByRegistry[registry]) == 1 {
+			singleCreds = append(singleCreds, credsByRegistry[registry][0])
+		}
+	}
+	resolvedCreds, err := resolveRegistryCredentials(ctx, singleCreds)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, registry := range registries {
+		if len(credsByRegistry[registry]) == 1 {
+			continue
+		}
+		resolvedCred, err := resolveRegistryCredentialInOrder(ctx, registry, credsByRegistry[registry])
+		if err != nil {
+			return nil, err
+		}
+		resolvedCreds[registry] = resolvedCred
+	}
+
+	return resolvedCreds, nil
+}
+
+// resolveRegistryCredentialInOrder resolves the credentials of a registry one at a time
+// and returns the first one which resolves successfully.
+func resolveRegistryCredentialInOrder(ctx context.Context, registry string, credentials []*RegistryCredential) (*ResolvedRegistryCred, error) {
+	var failures []string
+	for _, cred := range credentials {
+		resolvedCreds, err := resolveRegistryCredentials(ctx, []*RegistryCredential{cred})
+		if err == nil {
+			return resolvedCreds[registry], nil
+		}
+		util.Debugf("Failed to resolve the %s credential for registry %s, trying the next one: %v\n", cred.ProviderName(), registry, err)
+		failures = append(failures, fmt.Sprintf("%s: %v", cred.ProviderName(), err))
+	}
+	return nil, errors.Errorf("failed to resolve credentials for registry %s using any of the %d providers: [%s]", registry, len(credentials), strings.Join(failures, "; "))
+}
+
+// resolveRegistryCredentials resolves the registry login credentials, expecting at most one per registry.
+func resolveRegistryCredentials(ctx context.Context, credentials []*RegistryCredential) (RegistryLoginCredentials, error) {
 	resolvedCreds := make(RegistryLoginCredentials)
-	var unresolvedCreds []*secretmgmt.Secret
+	// Signing in with a device code takes as long as the user does, rather than a round trip, so those
+	// secrets are resolved separately with a longer timeout.
+	var unresolvedCreds, deviceCodeCreds []*secretmgmt.Secret
 
 	for _, cred := range credentials {
 		if cred == nil {
@@ -445,8 +683,10 @@ func ResolveCustomRegistryCredentials(ctx context.Context, credentials []*Regist
 			Password: &secretmgmt.Secret{
 				ID: cred.Registry,
 			},
+			Type: cred.Type(),
 		}
 		isMSI := false
+		util.Debugf("Resolving the credential for registry %s classified as %s\n", cred.Registry, cred.ProviderName())
 
 		usernameSecretObject := resolvedCreds[cred.Registry].Username
 		passwordSecretObject := resolvedCreds[cred.Registry].Password
@@ -458,6 +698,10 @@ func ResolveCustomRegistryCredentials(ctx context.Context, credentials []*Regist
 			usernameSecretObject.KeyVault = cred.Username
 			usernameSecretObject.MsiClientID = cred.Identity
 			unresolvedCreds = append(unresolvedCreds, usernameSecretObject)
+		case GAR:
+			usernameSecretObject.ResolvedValue = tokenutil.GARUsername
+		case Bearer, DeviceCode:
+			resolvedCreds[cred.Registry].BearerToken = true
 		case "":
 			isMSI = true
 		}
@@ -469,6 +713,19 @@ func ResolveCustomRegistryCredentials(ctx context.Context, credentials []*Regist
 			passwordSecretObject.KeyVault = cred.Password
 			passwordSecretObject.MsiClientID = cred.Identity
 			unresolvedCreds = append(unresolvedCreds, passwordSecretObject)
+		case GAR:
+			passwordSecretObject.ServiceAccountKey = cred.ServiceAccountKey
+			unresolvedCreds = append(unresolvedCreds, passwordSecretObject)
+		case Bearer:
+			passwordSecretObject.ResolvedValue = cred.Password
+		case DeviceCode:
+			passwordSecretObject.DeviceCode = &tokenutil.DeviceCodeConfig{
+				ClientID:                    cred.ClientID,
+				DeviceAuthorizationEndpoint: cred.DeviceAuthorizationEndpoint,
+				TokenEndpoint:               cred.TokenEndpoint,
+				Scope:                       cred.Scope,
+			}
+			deviceCodeCreds = append(deviceCodeCreds, passwordSecretObject)
 		}
 
 		if isMSI {
@@ -479,17 +736,25 @@ func ResolveCustomRegistryCredentials(ctx context.Context, credentials []*Regist
 		}
 	}
 
-	secretResolver, err := secretmgmt.NewSecretResolver(nil, secretmgmt.DefaultSecretResolveTimeout)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to create secret resolver")
+	if err := resolveSecrets(ctx, unresolvedCreds, secretmgmt.DefaultSecretResolveTimeout); err != nil {
+		return nil, err
+	}
+	if err := resolveSecrets(ctx, deviceCodeCreds, tokenutil.DeviceCodeTimeout); err != nil {
+		return nil, err
 	}
+	return resolvedCreds, nil
+}
 
-	err = secretResolver.ResolveSecrets(ctx, unresolvedCreds)
+// resolveSecrets resolves the secrets, each within the timeout.
+func resolveSecrets(ctx context.Context, secrets []*secretmgmt.Secret, timeout time.Duration) error {
+	secretResolver, err := secretmgmt.NewSecretResolver(nil, timeout)
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to resolve secrets")
+		return errors.Wrap(err, "failed to create secret resolver")
 	}
-
-	return resolvedCreds, nil
+	if err := secretResolver.ResolveSecrets(ctx, secrets); err != nil {
+		return errors.Wrap(err, "failed to resolve secrets")
+	}
+	return nil
 }
 
 // ValidateVolumes checks each volume is well formed and each container path is unique
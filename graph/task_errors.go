@@ -0,0 +1,176 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The top-level sequences of a task file whose items problems are located in.
+const (
+	stepsSection   = "steps"
+	secretsSection = "secrets"
+	volumesSection = "volumes"
+)
+
+// yamlErrorLine matches the line number prefixing the errors of the YAML decoder.
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// TaskFileError is a problem found in a task file, along with its position, if known. Positions are
+// of the rendered task file, which match the task file unless rendering adds or removes lines.
+type TaskFileError struct {
+	// Path is the path of the task file, empty if unknown.
+	Path string
+
+	// Line is the 1-based line of the problem, 0 if unknown.
+	Line int
+
+	// Column is the 1-based column of the problem, 0 if unknown.
+	Column int
+
+	// Message describes the problem.
+	Message string
+
+	// section and item identify the item of a top-level sequence, e.g. the step, the problem was found in,
+	// so it can be located once the task file has been indexed.
+	section string
+	item    int
+}
+
+// Error returns the problem in the format of compiler diagnostics, e.g. acb.yaml:12:5: message,
+// so editors can jump to it. Unknown parts of the position are omitted.
+func (e *TaskFileError) Error() string {
+	var position []string
+	if e.Path != "" {
+		position = append(position, e.Path)
+	}
+	if e.Line > 0 {
+		position = append(position, strconv.Itoa(e.Line))
+		if e.Column > 0 {
+			position = append(position, strconv.Itoa(e.Column))
+		}
+	}
+	if len(position) == 0 {
+		return e.Message
+	}
+	return strings.Join(position, ":") + ": " + e.Message
+}
+
+// TaskFileErrors are all the problems found in a task file, sorted by position.
+type TaskFileErrors []*TaskFileError
+
+// Error lists the problems, each on its own line so editors can jump to each of them.
+func (e TaskFileErrors) Error() string {
+	problems := "problems"
+	if len(e) == 1 {
+		problems = "problem"
+	}
+	lines := []string{fmt.Sprintf("found %d %s in the task file:", len(e), problems)}
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// WithPath sets the path of each problem to the path of the task file.
+func (e TaskFileErrors) WithPath(path string) TaskFileErrors {
+	for _, err := range e {
+		err.Path = path
+	}
+	return e
+}
+
+// locate sets the positions of the problems found in items of the task file, then sorts the problems
+// by position. Problems without a position are sorted last.
+func (e TaskFileErrors) locate(data []byte) {
+	index := newTaskFileIndex(data)
+	for _, err := range e {
+		if err.section == "" || err.Line > 0 {
+			continue
+		}
+		if items := index[err.section]; err.item < len(items) {
+			err.Line, err.Column = items[err.item].line, items[err.item].column
+		}
+	}
+	sort.SliceStable(e, func(i, j int) bool {
+		if (e[i].Line == 0) != (e[j].Line == 0) {
+			return e[j].Line == 0
+		}
+		return e[i].Line < e[j].Line
+	})
+}
+
+// newDecodeErrors converts an error decoding a task file into TaskFileErrors, with the line of each
+// problem reported by the YAML decoder. The decoder reports every field it can't decode, but stops at
+// the first syntax error.
+func newDecodeErrors(err error) TaskFileErrors {
+	messages := []string{err.Error()}
+	if typeErr, ok := err.(*yaml.TypeError); ok {
+		messages = typeErr.Errors
+	}
+	errs := make(TaskFileErrors, 0, len(messages))
+	for _, message := range messages {
+		taskErr := &TaskFileError{Message: message}
+		if m := yamlErrorLine.FindStringSubmatch(message); m != nil {
+			taskErr.Line, _ = strconv.Atoi(m[1])
+			taskErr.Message = m[2]
+		}
+		errs = append(errs, taskErr)
+	}
+	return errs
+}
+
+// position is the 1-based line and column of an item in a task file.
+type position struct {
+	line   int
+	column int
+}
+
+// taskFileIndex maps each top-level sequence of a task file, e.g. steps, to the positions of its items.
+type taskFileIndex map[string][]position
+
+// newTaskFileIndex indexes the items of the top-level block sequences of the task file, e.g. each
+// "- id: build" of its steps. Flow sequences, e.g. steps: [...], aren't indexed, so problems in their
+// items have no position.
+func newTaskFileIndex(data []byte) taskFileIndex {
+	index := make(taskFileIndex)
+	section := ""
+	itemIndent := -1
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimRight(line, "\r")
+		trimmed := strings.TrimLeft(line, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		indent := len(line) - len(trimmed)
+		isItem := trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+		if indent == 0 && !isItem {
+			// A top-level key starts a block sequence if nothing follows it on its line.
+			section = ""
+			itemIndent = -1
+			if j := strings.Index(trimmed, ":"); j > 0 {
+				if rest := strings.TrimSpace(trimmed[j+1:]); rest == "" || strings.HasPrefix(rest, "#") {
+					section = strings.Trim(trimmed[:j], `"'`)
+				}
+			}
+			continue
+		}
+		if section == "" || !isItem {
+			continue
+		}
+		if itemIndent < 0 {
+			itemIndent = indent
+		}
+		if indent == itemIndent {
+			index[section] = append(index[section], position{line: i + 1, column: indent + 1})
+		}
+	}
+	return index
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package graph
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pkg/errors"
+)
+
+func TestNewTaskFromString_TaskFileErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		expected []string
+	}{
+		{
+			"validation problems of several steps, secrets and volumes",
+			`version: v1.1.0
+# The steps.
+steps:
+  - id: build
+    build: -t app .
+
+  - id: invalid
+    retries: -1
+    cmd: alpine
+  - cmd: alpine
+    push: ["app"]
+  -   id: mounts
+      cmd: alpine
+      volumeMounts:
+        - name: missing
+          mountPath: /run/test
+
+secrets:
+  - id: a
+    keyvault: https://myvault.vault.azure.net/secrets/a
+  - id: a
+    keyvault: https://myvault.vault.azure.net/secrets/a
+volumes:
+  - name: vol
+    secret:
+      b: dGVzdA==
+  - name: vol
+    secret:
+      b: dGVzdA==
+`,
+			[]string{
+				"acb.yaml:7:3: step ID: invalid: " + errInvalidRetries.Error(),
+				"acb.yaml:10:3: step ID: acb_step_2: " + errInvalidStepType.Error(),
+				"acb.yaml:12:3: step ID: mounts: mount name, missing, does not correspond to a volume",
+				"acb.yaml:21:3: duplicate secret found with ID: a",
+				"acb.yaml:27:3: volume with duplicate name found",
+			},
+		},
+		{
+			"problems decoding fields",
+			`stepTimeout: abc
+steps:
+  - id: a
+    retries: abc
+    cmd: alpine
+`,
+			[]string{
+				"acb.yaml:1: cannot unmarshal !!str `abc` into int",
+				"acb.yaml:4: cannot unmarshal !!str `abc` into int",
+			},
+		},
+		{
+			"syntax error",
+			`steps:
+  - id: a
+	cmd: alpine
+`,
+			[]string{
+				"acb.yaml:3: found a tab character that violates indentation",
+			},
+		},
+		{
+			"flow sequences aren't located",
+			`steps: [{id: a, retries: -1, cmd: alpine}]`,
+			[]string{
+				"acb.yaml: step ID: a: " + errInvalidRetries.Error(),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := UnmarshalTaskFromString(context.Background(), test.data, &TaskOptions{TaskFile: "acb.yaml"})
+			errs, ok := errors.Cause(err).(TaskFileErrors)
+			if !ok {
+				t.Fatalf("Expected TaskFileErrors, but got %v", err)
+			}
+			if len(errs) != len(test.expected) {
+				t.Fatalf("Expected %d problems, but got %d: %v", len(test.expected), len(errs), errs)
+			}
+			for i, expected := range test.expected {
+				if actual := errs[i].Error(); actual != expected {
+					t.Errorf("Expected problem %d to be %q, but got %q", i, expected, actual)
+				}
+			}
+		})
+	}
+}
+
+func TestTaskFileError_Error(t *testing.T) {
+	tests := []struct {
+		err      *TaskFileError
+		expected string
+	}{
+		{&TaskFileError{Path: "acb.yaml", Line: 3, Column: 5, Message: "msg"}, "acb.yaml:3:5: msg"},
+		{&TaskFileError{Path: "acb.yaml", Line: 3, Message: "msg"}, "acb.yaml:3: msg"},
+		{&TaskFileError{Path: "acb.yaml", Message: "msg"}, "acb.yaml: msg"},
+		{&TaskFileError{Line: 3, Column: 5, Message: "msg"}, "3:5: msg"},
+		{&TaskFileError{Message: "msg"}, "msg"},
+	}
+
+	for _, test := range tests {
+		if actual := test.err.Error(); actual != test.expected {
+			t.Errorf("Expected %q, but got %q", test.expected, actual)
+		}
+	}
+
+	errs := TaskFileErrors{{Path: "acb.yaml", Line: 1, Message: "a"}, {Path: "acb.yaml", Line: 2, Message: "b"}}
+	if expected, actual := "found 2 problems in the task file:\nacb.yaml:1: a\nacb.yaml:2: b", errs.Error(); actual != expected {
+		t.Errorf("Expected %q, but got %q", expected, actual)
+	}
+}
@@ -3,7 +3,14 @@ package graph
 import (
 	"context"
 	gocontext "context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/Azure/acr-builder/pkg/volume"
@@ -138,6 +145,160 @@ func TestInitializeTimeouts(t *testing.T) {
 	}
 }
 
+func TestInitializeTotalTimeout(t *testing.T) {
+	task := &Task{TotalTimeout: 3600}
+	if err := task.initialize(gocontext.Background()); err != nil {
+		t.Fatalf("Unexpected err during initialization: %v", err)
+	}
+	task = &Task{TotalTimeout: -1}
+	if err := task.initialize(gocontext.Background()); err == nil {
+		t.Fatal("Expected an error for a negative total timeout")
+	}
+}
+
+func TestInitializeStepIDs(t *testing.T) {
+	tests := []struct {
+		steps       []*Step
+		expected    []string
+		expectedErr string
+	}{
+		{
+			[]*Step{{Cmd: "a"}, {ID: "b", Cmd: "b"}, {Cmd: "c", When: []string{"acb_step_0"}}},
+			[]string{"acb_step_0", "b", "acb_step_2"},
+			"",
+		},
+		{
+			// An explicit ID colliding with a generated one.
+			[]*Step{{Cmd: "a"}, {ID: "acb_step_0", Cmd: "b"}},
+			nil,
+			"duplicate step ID: acb_step_0 is used by step 0 (generated ID) and step 1 (explicit ID)",
+		},
+		{
+			[]*Step{{ID: "acb_step_1", Cmd: "a"}, {Cmd: "b"}},
+			nil,
+			"duplicate step ID: acb_step_1 is used by step 0 (explicit ID) and step 1 (generated ID)",
+		},
+		{
+			[]*Step{{ID: "a", Cmd: "a"}, {ID: "a", Cmd: "b"}},
+			nil,
+			"duplicate step ID: a is used by step 0 (explicit ID) and step 1 (explicit ID)",
+		},
+	}
+
+	for _, test := range tests {
+		task, err := NewTask(gocontext.Background(), test.steps, nil, "", nil, false, "", "")
+		if test.expectedErr != "" {
+			if err == nil || err.Error() != test.expectedErr {
+				t.Errorf("Expected error %q but got %v", test.expectedErr, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		for i, s := range task.Steps {
+			if s.ID != test.expected[i] {
+				t.Errorf("Expected step %d to have ID %s but got %s", i, test.expected[i], s.ID)
+			}
+		}
+	}
+}
+
+func TestInitializeStepImages(t *testing.T) {
+	task, err := UnmarshalTaskFromString(gocontext.Background(), `steps:
+  - id: deploy
+    image: bitnami/kubectl:1.27
+    cmd: apply -f deploy.yaml
+  - id: test
+    image: node:18
+    script: npm test
+  - id: default
+    image: hello-world`, &TaskOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []string{"bitnami/kubectl:1.27 apply -f deploy.yaml", "node:18", "hello-world"}
+	for i, s := range task.Steps {
+		if s.Cmd != expected[i] {
+			t.Errorf("Expected step %s to run %q but got %q", s.ID, expected[i], s.Cmd)
+		}
+	}
+
+	if _, err := UnmarshalTaskFromString(gocontext.Background(), `steps:
+  - image: "Node:18"
+    cmd: npm test`, &TaskOptions{}); err == nil {
+		t.Error("Expected an error for an invalid image")
+	}
+}
+
+func TestInitializeArgsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "argsfile")
+	if err != nil {
+		t.Fatalf("Failed to create the temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	argsFile := filepath.Join(dir, "build.env")
+	if err := ioutil.WriteFile(argsFile, []byte("# Build args\nVERSION=1.0\nMESSAGE=\"hello world\"\n"), 0600); err != nil {
+		t.Fatalf("Failed to write the args file: %v", err)
+	}
+
+	task, err := UnmarshalTaskFromString(gocontext.Background(), `steps:
+  - build: -t app --build-arg VERSION=2.0 .
+    argsFile: `+argsFile, &TaskOptions{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	step := task.Steps[0]
+	if expected := []string{"VERSION=1.0", "MESSAGE=hello world"}; !reflect.DeepEqual(step.FileBuildArgs, expected) {
+		t.Errorf("Expected the file build args %v but got %v", expected, step.FileBuildArgs)
+	}
+	if expected := []string{"VERSION=1.0", "MESSAGE=hello world", "VERSION=2.0"}; !reflect.DeepEqual(step.BuildArgs, expected) {
+		t.Errorf("Expected the build args %v but got %v", expected, step.BuildArgs)
+	}
+
+	if _, err := UnmarshalTaskFromString(gocontext.Background(), `steps:
+  - build: -t app .
+    argsFile: `+filepath.Join(dir, "missing.env"), &TaskOptions{}); err == nil {
+		t.Error("Expected an error for a missing args file")
+	}
+}
+
+func TestMarshalGraph(t *testing.T) {
+	task, err := NewTask(gocontext.Background(), []*Step{
+		{Cmd: "a"},
+		{ID: "b", Cmd: "b", When: []string{ImmediateExecutionToken}},
+		{Cmd: "c", When: []string{"acb_step_0", "b"}},
+	}, nil, "", nil, false, "", "")
+	if err != nil {
+		t.Fatalf("Failed to create task. Err: %v", err)
+	}
+
+	actual, err := task.MarshalGraph()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	var steps []*GraphStep
+	if err := json.Unmarshal(actual, &steps); err != nil {
+		t.Fatalf("Failed to unmarshal the graph: %v", err)
+	}
+	expected := []*GraphStep{
+		{ID: "acb_step_0", GeneratedID: true, Dependencies: []string{}},
+		{ID: "b", Dependencies: []string{}},
+		{ID: "acb_step_2", GeneratedID: true, Dependencies: []string{"acb_step_0", "b"}},
+	}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("Expected %s but got %s", mustMarshal(t, expected), actual)
+	}
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		t.Fatalf("Failed to marshal %v: %v", v, err)
+	}
+	return bytes
+}
+
 func TestMergeEnvs(t *testing.T) {
 	tests := []struct {
 		taskEnvs     []string
@@ -353,6 +514,25 @@ func TestValidateVolumes(t *testing.T) {
 	}
 }
 
+func TestValidateFallbackDigests(t *testing.T) {
+	tests := []struct {
+		digests     map[string]string
+		shouldError bool
+	}{
+		{nil, false},
+		{map[string]string{"mcr.microsoft.com/dotnet/sdk:6.0": "sha256:1111111111111111111111111111111111111111111111111111111111111111"}, false},
+		{map[string]string{"mcr.microsoft.com/dotnet/sdk:6.0": "latest"}, true},
+		{map[string]string{"mcr.microsoft.com/dotnet/sdk:6.0": "sha256:1234"}, true},
+	}
+
+	for _, test := range tests {
+		task := &Task{FallbackDigests: test.digests}
+		if err := task.Validate(); test.shouldError != (err != nil) {
+			t.Errorf("Expected the fallback digests %v to fail validation: %v, but got %v", test.digests, test.shouldError, err)
+		}
+	}
+}
+
 func TestUnmarshalTaskFromString_Envs(t *testing.T) {
 	tests := []struct {
 		data           string
@@ -439,3 +619,138 @@ env: ["a=b", "c=d"]
 		}
 	}
 }
+
+func TestResolveCustomRegistryCredentials_PriorityOrder(t *testing.T) {
+	// The MSI endpoint refuses to issue tokens, so the MSI credential fails to resolve.
+	msiServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer msiServer.Close()
+	t.Setenv("MSI_ENDPOINT", msiServer.URL)
+	t.Setenv("MSI_SECRET", "")
+
+	invalidMSI := &RegistryCredential{
+		Registry:      "foo.azurecr.io",
+		Identity:      "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86",
+		AadResourceID: "https://management.azure.com/",
+	}
+	opaque := &RegistryCredential{
+		Registry:     "foo.azurecr.io",
+		Username:     "sp",
+		UsernameType: Opaque,
+		Password:     "secret",
+		PasswordType: Opaque,
+	}
+	other := &RegistryCredential{
+		Registry:     "bar.azurecr.io",
+		Username:     "user",
+		UsernameType: Opaque,
+		Password:     "password",
+		PasswordType: Opaque,
+	}
+
+	resolved, err := ResolveCustomRegistryCredentials(context.Background(), []*RegistryCredential{invalidMSI, opaque, other})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if actual := resolved["foo.azurecr.io"].Username.ResolvedValue; actual != "sp" {
+		t.Errorf("Expected the fallback credential to be used, but got username %s", actual)
+	}
+	if actual := resolved["bar.azurecr.io"].Username.ResolvedValue; actual != "user" {
+		t.Errorf("Expected username user, but got %s", actual)
+	}
+
+	_, err = ResolveCustomRegistryCredentials(context.Background(), []*RegistryCredential{invalidMSI, invalidMSI})
+	if err == nil {
+		t.Fatal("Expected an error when no credential resolves, but got none")
+	}
+	if !strings.Contains(err.Error(), "2 providers") || !strings.Contains(err.Error(), invalidMSI.ProviderName()) {
+		t.Errorf("Expected the error to summarize each provider's failure, but got %v", err)
+	}
+}
+
+func TestRegistryLoginCredentials_GetCredential(t *testing.T) {
+	newCred := func(username string) *ResolvedRegistryCred {
+		return &ResolvedRegistryCred{Username: &secretmgmt.Secret{ResolvedValue: username}}
+	}
+	creds := RegistryLoginCredentials{
+		"myregistry.azurecr.io":    newCred("exact"),
+		"*.azurecr.io":             newCred("wildcard"),
+		"*.westus.data.azurecr.io": newCred("longest-wildcard"),
+		DefaultRegistry:            newCred("default"),
+	}
+
+	tests := []struct {
+		registry string
+		expected string
+	}{
+		{"myregistry.azurecr.io", "exact"},
+		{"MyRegistry.azurecr.io", "exact"},
+		{"other.azurecr.io", "wildcard"},
+		{"other.westus.data.azurecr.io", "longest-wildcard"},
+		{"azurecr.io", "default"},
+		{"docker.io", "default"},
+	}
+
+	for _, test := range tests {
+		cred, ok := creds.GetCredential(test.registry)
+		if !ok {
+			t.Errorf("Expected a credential for %s, but got none", test.registry)
+			continue
+		}
+		if cred.Username.ResolvedValue != test.expected {
+			t.Errorf("Expected the %s credential for %s, but got %s", test.expected, test.registry, cred.Username.ResolvedValue)
+		}
+	}
+
+	delete(creds, DefaultRegistry)
+	if _, ok := creds.GetCredential("docker.io"); ok {
+		t.Error("Expected no credential for docker.io without a default credential")
+	}
+}
+
+func TestMergeEnvs_DoesNotShareArrays(t *testing.T) {
+	// Both steps start from the same environment variables with spare capacity, e.g. from a common default.
+	shared := make([]string, 1, 4)
+	shared[0] = "A=1"
+	taskEnvs := []string{"SHARED=1"}
+
+	first, err := mergeEnvs(shared, taskEnvs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	second, err := mergeEnvs(shared, taskEnvs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// A secret added to the environment of one step mustn't overwrite, or show up in, the other's.
+	first = append(first, "TOKEN=s3cr3t")
+	second = append(second, "OTHER=2")
+
+	if expected := []string{"A=1", "SHARED=1", "TOKEN=s3cr3t"}; !reflect.DeepEqual(first, expected) {
+		t.Errorf("expected %v but got %v", expected, first)
+	}
+	if expected := []string{"A=1", "SHARED=1", "OTHER=2"}; !reflect.DeepEqual(second, expected) {
+		t.Errorf("expected %v but got %v", expected, second)
+	}
+	if expected := []string{"A=1"}; !reflect.DeepEqual(shared, expected) {
+		t.Errorf("expected %v but got %v", expected, shared)
+	}
+
+	// Steps still get their own environment variables when there are none to merge into them.
+	third, err := mergeEnvs(shared, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	third = append(third, "TOKEN=s3cr3t")
+	fourth, err := mergeEnvs(shared, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"A=1"}; !reflect.DeepEqual(fourth, expected) {
+		t.Errorf("expected %v but got %v", expected, fourth)
+	}
+	if expected := []string{"A=1", "TOKEN=s3cr3t"}; !reflect.DeepEqual(third, expected) {
+		t.Errorf("expected %v but got %v", expected, third)
+	}
+}
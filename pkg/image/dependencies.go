@@ -5,12 +5,26 @@ package image
 
 import (
 	"fmt"
+	"time"
 )
 
 const (
 	defaultStringValue = "<nil>"
 )
 
+const (
+	// SourceRegistry means the digest was resolved from a registry.
+	SourceRegistry = "registry"
+	// SourceLockFile means the digest was read from a lock file.
+	SourceLockFile = "lock-file"
+	// SourceImageTarball means the digest was read from an image tarball.
+	SourceImageTarball = "image-tarball"
+	// SourceContainerd means the digest was read from containerd's image store.
+	SourceContainerd = "containerd"
+	// SourceDocker means the digest was read from the Docker daemon's image store.
+	SourceDocker = "docker"
+)
+
 // Dependencies denotes Docker image dependencies.
 type Dependencies struct {
 	Image     *Reference    `json:"image"`
@@ -26,6 +40,46 @@ type Reference struct {
 	Tag        string `json:"tag,omitempty"`
 	Digest     string `json:"digest"`
 	Reference  string `json:"reference"`
+
+	// OriginalReference is the reference before it was rewritten, if it was rewritten.
+	OriginalReference string `json:"original-reference,omitempty"`
+
+	// Platform is the platform, e.g. linux/amd64, whose manifest the digest was selected for, if known.
+	Platform string `json:"platform,omitempty"`
+
+	// FallbackDigest is the previously known digest of the reference, used as its digest if its live digest
+	// can't be resolved because its registry is unavailable. It's an input of resolution, not part of the image's dependencies,
+	// so it isn't serialized.
+	FallbackDigest string `json:"-"`
+
+	// Provenance describes how the digest was obtained, if known. It's recorded in lock files rather than
+	// the dependencies, and isn't compared by Equals since it describes the resolution rather than the reference.
+	Provenance *Provenance `json:"-"`
+}
+
+// Provenance describes how the digest of a reference was obtained.
+type Provenance struct {
+	// Source is where the digest was obtained from, e.g. registry.
+	Source string `json:"source"`
+
+	// Credential is the class of the credential used to resolve the digest from a registry,
+	// e.g. msi, or anonymous if none was used.
+	Credential string `json:"credential,omitempty"`
+
+	// ResolvedAt is when the digest was obtained, in UTC.
+	ResolvedAt time.Time `json:"resolvedAt"`
+
+	// Mirror is the registry which the digest was resolved from in place of the reference's own,
+	// e.g. a proxy cache, if any.
+	Mirror string `json:"mirror,omitempty"`
+
+	// Fallback means the digest is the reference's FallbackDigest, since its registry was unavailable.
+	Fallback bool `json:"fallback,omitempty"`
+}
+
+// NewProvenance creates the Provenance of a digest obtained from the source now.
+func NewProvenance(source string) *Provenance {
+	return &Provenance{Source: source, ResolvedAt: time.Now().UTC().Truncate(time.Second)}
 }
 
 // Equals determines if two image references are equal.
@@ -41,7 +95,10 @@ func Equals(img1 *Reference, img2 *Reference) bool {
 		img1.Repository == img2.Repository &&
 		img1.Tag == img2.Tag &&
 		img1.Digest == img2.Digest &&
-		img1.Reference == img2.Reference
+		img1.Reference == img2.Reference &&
+		img1.OriginalReference == img2.OriginalReference &&
+		img1.Platform == img2.Platform &&
+		img1.FallbackDigest == img2.FallbackDigest
 }
 
 // String returns a string representation of an ImageReference.
@@ -0,0 +1,100 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/docker/distribution/reference"
+	"github.com/opencontainers/go-digest"
+)
+
+const (
+	// DockerHubRegistry is the registry of Docker Hub images.
+	DockerHubRegistry = "registry.hub.docker.com"
+
+	dockerHubOfficialRepositoryPrefix = "library/"
+)
+
+// dockerHubRegistryAliases are the other names of Docker Hub, which are normalized to DockerHubRegistry.
+var dockerHubRegistryAliases = map[string]bool{
+	"docker.io":       true,
+	"index.docker.io": true,
+}
+
+// IsDockerHubRegistry returns true if the registry is Docker Hub, i.e. DockerHubRegistry or one of its aliases.
+func IsDockerHubRegistry(registry string) bool {
+	registry = strings.ToLower(registry)
+	return registry == DockerHubRegistry || dockerHubRegistryAliases[registry]
+}
+
+// NewReference validates the registry, repository, tag and digest of an image and returns its Reference.
+// The tag and digest are optional, but at least the registry and repository must be specified.
+// The registry is lowercased, Docker Hub's aliases, e.g. docker.io, are normalized to DockerHubRegistry,
+// and official Docker Hub repositories, e.g. golang, are prefixed with library/.
+func NewReference(registry string, repository string, tag string, digestValue string) (*Reference, error) {
+	registry = strings.ToLower(registry)
+	if registry == "" {
+		return nil, fmt.Errorf("invalid reference to repository '%s', the registry is empty", repository)
+	}
+	if dockerHubRegistryAliases[registry] {
+		registry = DockerHubRegistry
+	}
+	if repository == "" {
+		return nil, fmt.Errorf("invalid reference to registry '%s', the repository is empty", registry)
+	}
+	if registry == DockerHubRegistry && !strings.Contains(repository, "/") {
+		repository = dockerHubOfficialRepositoryPrefix + repository
+	}
+
+	// The reference parser doesn't support IPv6 literal registries, so validate the
+	// rest of the reference using a placeholder registry instead.
+	parseRegistry := registry
+	if strings.HasPrefix(registry, "[") {
+		ipv6Registry, remainder, err := SplitIPv6Registry(registry + "/" + repository)
+		if err != nil {
+			return nil, fmt.Errorf("invalid registry '%s': %v", registry, err)
+		}
+		if ipv6Registry != registry || remainder != "/"+repository {
+			return nil, fmt.Errorf("invalid registry '%s'", registry)
+		}
+		parseRegistry = IPv6RegistryPlaceholder
+	}
+
+	named, err := reference.WithName(parseRegistry + "/" + repository)
+	if err != nil {
+		return nil, fmt.Errorf("invalid repository '%s' of registry '%s': %v", repository, registry, err)
+	}
+	if reference.Domain(named) != parseRegistry {
+		return nil, fmt.Errorf("invalid registry '%s'", registry)
+	}
+	if reference.Path(named) != repository {
+		return nil, fmt.Errorf("invalid repository '%s' of registry '%s'", repository, registry)
+	}
+
+	ref := named.(reference.Reference)
+	if tag != "" {
+		if ref, err = reference.WithTag(named, tag); err != nil {
+			return nil, fmt.Errorf("invalid tag '%s' of repository '%s': %v", tag, repository, err)
+		}
+	}
+	if digestValue != "" {
+		dgst, err := digest.Parse(digestValue)
+		if err != nil {
+			return nil, fmt.Errorf("invalid digest '%s' of repository '%s': %v", digestValue, repository, err)
+		}
+		if ref, err = reference.WithDigest(ref.(reference.Named), dgst); err != nil {
+			return nil, fmt.Errorf("invalid digest '%s' of repository '%s': %v", digestValue, repository, err)
+		}
+	}
+
+	return &Reference{
+		Registry:   registry,
+		Repository: repository,
+		Tag:        tag,
+		Digest:     digestValue,
+		Reference:  registry + strings.TrimPrefix(ref.String(), parseRegistry),
+	}, nil
+}
@@ -0,0 +1,64 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package image
+
+import "testing"
+
+const testDigest = "sha256:0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+func TestNewReference(t *testing.T) {
+	tests := []struct {
+		registry   string
+		repository string
+		tag        string
+		digest     string
+		expected   *Reference
+	}{
+		{"myregistry.azurecr.io", "app", "v1", "", &Reference{Registry: "myregistry.azurecr.io", Repository: "app", Tag: "v1", Reference: "myregistry.azurecr.io/app:v1"}},
+		{"MyRegistry.azurecr.io", "team/app", "", testDigest, &Reference{Registry: "myregistry.azurecr.io", Repository: "team/app", Digest: testDigest, Reference: "myregistry.azurecr.io/team/app@" + testDigest}},
+		{"localhost:5000", "app", "v1", testDigest, &Reference{Registry: "localhost:5000", Repository: "app", Tag: "v1", Digest: testDigest, Reference: "localhost:5000/app:v1@" + testDigest}},
+		{"docker.io", "golang", "1.21", "", &Reference{Registry: DockerHubRegistry, Repository: "library/golang", Tag: "1.21", Reference: DockerHubRegistry + "/library/golang:1.21"}},
+		{DockerHubRegistry, "bitnami/redis", "", "", &Reference{Registry: DockerHubRegistry, Repository: "bitnami/redis", Reference: DockerHubRegistry + "/bitnami/redis"}},
+		{"[::1]:5000", "app", "v1", "", &Reference{Registry: "[::1]:5000", Repository: "app", Tag: "v1", Reference: "[::1]:5000/app:v1"}},
+	}
+	for _, test := range tests {
+		actual, err := NewReference(test.registry, test.repository, test.tag, test.digest)
+		if err != nil {
+			t.Errorf("Unexpected error creating the reference to %s/%s: %v", test.registry, test.repository, err)
+			continue
+		}
+		if !Equals(actual, test.expected) {
+			t.Errorf("Expected\n%s\nbut got\n%s", test.expected, actual)
+		}
+	}
+}
+
+func TestNewReference_Invalid(t *testing.T) {
+	tests := []struct {
+		name       string
+		registry   string
+		repository string
+		tag        string
+		digest     string
+	}{
+		{"empty registry", "", "app", "v1", ""},
+		{"registry with a path", "myregistry.azurecr.io/team", "app", "v1", ""},
+		{"registry with an invalid character", "my_registry.azurecr.io", "app", "v1", ""},
+		{"registry with an invalid port", "localhost:port", "app", "v1", ""},
+		{"invalid IPv6 registry", "[::1", "app", "v1", ""},
+		{"empty repository", "myregistry.azurecr.io", "", "v1", ""},
+		{"uppercase repository", "myregistry.azurecr.io", "App", "v1", ""},
+		{"repository with a tag", "myregistry.azurecr.io", "app:v1", "", ""},
+		{"repository with an empty component", "myregistry.azurecr.io", "team//app", "v1", ""},
+		{"invalid tag", "myregistry.azurecr.io", "app", "v1/latest", ""},
+		{"tag starting with a period", "myregistry.azurecr.io", "app", ".v1", ""},
+		{"digest without an algorithm", "myregistry.azurecr.io", "app", "v1", "0123456789abcdef"},
+		{"digest of the wrong length", "myregistry.azurecr.io", "app", "v1", "sha256:0123"},
+	}
+	for _, test := range tests {
+		if ref, err := NewReference(test.registry, test.repository, test.tag, test.digest); err == nil {
+			t.Errorf("Expected an error for the %s, but got %s", test.name, ref.Reference)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package image
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// IPv6RegistryPlaceholder is a valid registry name which can stand in for an IPv6 literal registry,
+// e.g. [::1]:5000, when parsing a reference since IPv6 literals aren't supported by the reference parser.
+const IPv6RegistryPlaceholder = "ipv6-registry.invalid"
+
+// SplitIPv6Registry splits a reference such as [::1]:5000/app:v1 into its IPv6 literal registry,
+// including the port if any, and the remainder of the reference starting with '/'.
+// If the reference doesn't start with an IPv6 literal, the registry is empty and the remainder is ref.
+func SplitIPv6Registry(ref string) (registry string, remainder string, err error) {
+	if !strings.HasPrefix(ref, "[") {
+		return "", ref, nil
+	}
+	end := strings.Index(ref, "]")
+	if end < 0 {
+		return "", "", fmt.Errorf("invalid IPv6 registry in reference %s: missing ']'", ref)
+	}
+	if ip := net.ParseIP(ref[1:end]); ip == nil || ip.To4() != nil {
+		return "", "", fmt.Errorf("invalid IPv6 registry in reference %s: %s is not an IPv6 address", ref, ref[1:end])
+	}
+
+	rest := ref[end+1:]
+	slash := strings.Index(rest, "/")
+	if slash < 0 {
+		return "", "", fmt.Errorf("invalid reference %s: missing repository", ref)
+	}
+	if port := rest[:slash]; port != "" {
+		if !strings.HasPrefix(port, ":") {
+			return "", "", fmt.Errorf("invalid IPv6 registry in reference %s: unexpected %s after the address", ref, port)
+		}
+		if _, err := strconv.ParseUint(port[1:], 10, 16); err != nil {
+			return "", "", fmt.Errorf("invalid IPv6 registry in reference %s: invalid port %s", ref, port[1:])
+		}
+	}
+	return ref[:end+1+slash], rest[slash:], nil
+}
@@ -0,0 +1,40 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package image
+
+import "testing"
+
+func TestSplitIPv6Registry(t *testing.T) {
+	tests := []struct {
+		ref               string
+		expectedRegistry  string
+		expectedRemainder string
+		shouldError       bool
+	}{
+		{"localhost:5000/app:v1", "", "localhost:5000/app:v1", false},
+		{"[::1]:5000/app:v1", "[::1]:5000", "/app:v1", false},
+		{"[fd00::1]/org/app@sha256:abc", "[fd00::1]", "/org/app@sha256:abc", false},
+		{"[::1:5000/app", "", "", true},
+		{"[127.0.0.1]:5000/app", "", "", true},
+		{"[::1]:port/app", "", "", true},
+		{"[::1]:5000", "", "", true},
+	}
+
+	for _, test := range tests {
+		registry, remainder, err := SplitIPv6Registry(test.ref)
+		if test.shouldError {
+			if err == nil {
+				t.Errorf("Expected %s to error, but it didn't", test.ref)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.ref, err)
+			continue
+		}
+		if registry != test.expectedRegistry || remainder != test.expectedRemainder {
+			t.Errorf("Expected %s to split into %s and %s, but got %s and %s", test.ref, test.expectedRegistry, test.expectedRemainder, registry, remainder)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package procmanager
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// OOMExitCode is the exit code of a process killed with SIGKILL, which is how the kernel's OOM killer
+// kills a container exceeding its cgroup's memory limit.
+const OOMExitCode = 137
+
+// ExitCodeRange is an inclusive range of process exit codes.
+type ExitCodeRange struct {
+	Min int
+	Max int
+}
+
+// Contains returns true if the exit code is in the range, false otherwise.
+func (r ExitCodeRange) Contains(code int) bool {
+	return code >= r.Min && code <= r.Max
+}
+
+// ParseExitCodeRanges parses exit code ranges, each either a single exit code, e.g. "75",
+// or an inclusive range of exit codes, e.g. "100-110". Exit codes must be between 0 and 255.
+func ParseExitCodeRanges(values []string) ([]ExitCodeRange, error) {
+	ranges := make([]ExitCodeRange, 0, len(values))
+	for _, value := range values {
+		minValue, maxValue := value, value
+		if i := strings.Index(value, "-"); i >= 0 {
+			minValue, maxValue = value[:i], value[i+1:]
+		}
+		min, minErr := parseExitCode(minValue)
+		max, maxErr := parseExitCode(maxValue)
+		if minErr != nil || maxErr != nil || min > max {
+			return nil, fmt.Errorf("invalid exit code range '%s', expected an exit code between 0 and 255 or a range such as 100-110", value)
+		}
+		ranges = append(ranges, ExitCodeRange{Min: min, Max: max})
+	}
+	return ranges, nil
+}
+
+func parseExitCode(value string) (int, error) {
+	code, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if code < 0 || code > 255 {
+		return 0, fmt.Errorf("exit code %d is out of range", code)
+	}
+	return code, nil
+}
+
+// ExitCodeRetryPolicy decides whether a failed run is retried based on the code the process exited with.
+type ExitCodeRetryPolicy struct {
+	// RetryOn, if not empty, only retries runs which exited with one of the exit codes.
+	// Runs which failed without exiting, e.g. because the process couldn't be started, aren't retried.
+	RetryOn []ExitCodeRange
+
+	// NeverRetryOn never retries runs which exited with one of the exit codes.
+	NeverRetryOn []ExitCodeRange
+
+	// RetryOnOOM retries runs which were killed for running out of memory, see IsOOM, regardless of
+	// RetryOn, NeverRetryOn and the errors the runs are otherwise retried on.
+	RetryOnOOM bool
+
+	// OOMArgs, if not nil, returns the args to retry a run which was killed for running out of memory with,
+	// e.g. with a higher memory limit, given how many runs have been killed so far.
+	OOMArgs func(oomKills int) []string
+
+	// InspectRun, if not nil, is called after each run with the error it failed with, or nil, e.g. to inspect and
+	// remove the run's container. It reports whether a failed run was killed for running out of memory in place
+	// of IsOOM, which only guesses from the exit code, since processes exit with 137 or are killed for other reasons too.
+	InspectRun func(err error) (oomKilled bool)
+}
+
+// IsOOM returns true if the run which failed with err was killed for running out of memory, i.e. it
+// exited with OOMExitCode or was killed with SIGKILL, false otherwise.
+func IsOOM(err error) bool {
+	var exitErr *exec.ExitError
+	if !errors.As(err, &exitErr) {
+		return false
+	}
+	if exitErr.ExitCode() == OOMExitCode {
+		return true
+	}
+	status, ok := exitErr.Sys().(syscall.WaitStatus)
+	return ok && status.Signaled() && status.Signal() == syscall.SIGKILL
+}
+
+// inspectRun inspects the run which failed with err, or succeeded if nil, and returns true if it failed because it
+// was killed for running out of memory, false otherwise.
+func (p *ExitCodeRetryPolicy) inspectRun(err error) bool {
+	if p == nil || p.InspectRun == nil {
+		return IsOOM(err)
+	}
+	return p.InspectRun(err) && err != nil
+}
+
+// retriesOOM returns true if the policy retries runs which were killed for running out of memory, false otherwise.
+func (p *ExitCodeRetryPolicy) retriesOOM() bool {
+	return p != nil && p.RetryOnOOM
+}
+
+// allowsRetry returns true if the run which failed with err may be retried, false otherwise.
+// A nil policy allows every failed run to be retried.
+func (p *ExitCodeRetryPolicy) allowsRetry(err error) bool {
+	if p == nil {
+		return true
+	}
+	var exitErr *exec.ExitError
+	exited := errors.As(err, &exitErr)
+	if len(p.RetryOn) > 0 && (!exited || !anyContains(p.RetryOn, exitErr.ExitCode())) {
+		return false
+	}
+	return !exited || !anyContains(p.NeverRetryOn, exitErr.ExitCode())
+}
+
+func anyContains(ranges []ExitCodeRange, code int) bool {
+	for _, r := range ranges {
+		if r.Contains(code) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,245 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package procmanager
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestParseExitCodeRanges(t *testing.T) {
+	tests := []struct {
+		values   []string
+		expected []ExitCodeRange
+		ok       bool
+	}{
+		{nil, []ExitCodeRange{}, true},
+		{[]string{"1", "100-110", " 75 "}, []ExitCodeRange{{1, 1}, {100, 110}, {75, 75}}, true},
+		{[]string{"0-255"}, []ExitCodeRange{{0, 255}}, true},
+		{[]string{"110-100"}, nil, false},
+		{[]string{"256"}, nil, false},
+		{[]string{"-1"}, nil, false},
+		{[]string{"1-"}, nil, false},
+		{[]string{"one"}, nil, false},
+		{[]string{""}, nil, false},
+	}
+
+	for _, test := range tests {
+		actual, err := ParseExitCodeRanges(test.values)
+		if !test.ok {
+			if err == nil {
+				t.Errorf("Expected an error parsing %v", test.values)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Unexpected error parsing %v: %v", test.values, err)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("Expected %v for %v, but got %v", test.expected, test.values, actual)
+		}
+	}
+}
+
+// exitError returns the error of a process which exited with the code.
+func exitError(t *testing.T, code int) error {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+	err := exec.Command("sh", "-c", "exit "+strconv.Itoa(code)).Run()
+	if err == nil {
+		t.Fatalf("Expected exiting with %d to fail", code)
+	}
+	return err
+}
+
+func TestExitCodeRetryPolicy(t *testing.T) {
+	retryOn := &ExitCodeRetryPolicy{RetryOn: []ExitCodeRange{{75, 75}, {100, 110}}}
+	neverRetryOn := &ExitCodeRetryPolicy{NeverRetryOn: []ExitCodeRange{{1, 2}}}
+	notStarted := errors.New("failed to start")
+
+	tests := []struct {
+		policy   *ExitCodeRetryPolicy
+		err      error
+		expected bool
+	}{
+		{nil, exitError(t, 1), true},
+		{nil, notStarted, true},
+		// Inclusion lists only retry the listed exit codes.
+		{retryOn, exitError(t, 75), true},
+		{retryOn, exitError(t, 105), true},
+		{retryOn, exitError(t, 110), true},
+		{retryOn, exitError(t, 1), false},
+		{retryOn, exitError(t, 111), false},
+		{retryOn, notStarted, false},
+		// Exclusion lists retry every exit code except the listed ones.
+		{neverRetryOn, exitError(t, 1), false},
+		{neverRetryOn, exitError(t, 2), false},
+		{neverRetryOn, exitError(t, 3), true},
+		{neverRetryOn, notStarted, true},
+	}
+
+	for i, test := range tests {
+		if actual := test.policy.allowsRetry(test.err); actual != test.expected {
+			t.Errorf("Test %d: expected %t for %v with %+v, but got %t", i, test.expected, test.err, test.policy, actual)
+		}
+	}
+}
+
+func TestRunWithRetries_ExitCodeRetryPolicy(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+	tests := []struct {
+		code     int
+		policy   *ExitCodeRetryPolicy
+		attempts int
+	}{
+		{3, nil, 3},
+		{3, &ExitCodeRetryPolicy{RetryOn: []ExitCodeRange{{3, 5}}}, 3},
+		{3, &ExitCodeRetryPolicy{RetryOn: []ExitCodeRange{{4, 5}}}, 1},
+		{3, &ExitCodeRetryPolicy{NeverRetryOn: []ExitCodeRange{{3, 3}}}, 1},
+		{3, &ExitCodeRetryPolicy{NeverRetryOn: []ExitCodeRange{{1, 2}}}, 3},
+	}
+
+	for _, test := range tests {
+		pm := NewProcManager(false)
+		attempts := 0
+		pm.SetAttemptObserver(func(containerName string, attempt int, start time.Time, err error) {
+			attempts = attempt
+		})
+		args := []string{"sh", "-c", "exit " + strconv.Itoa(test.code)}
+		if err := pm.RunWithRetries(context.Background(), args, nil, nil, nil, "", 2, nil, test.policy, 0, "step"); err == nil {
+			t.Fatalf("Expected exiting with %d to fail", test.code)
+		}
+		if attempts != test.attempts {
+			t.Errorf("Expected %d attempts exiting with %d using %+v, but got %d", test.attempts, test.code, test.policy, attempts)
+		}
+	}
+}
+
+func TestIsOOM(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+	killed := exec.Command("sh", "-c", "kill -9 $$").Run()
+
+	tests := []struct {
+		err      error
+		expected bool
+	}{
+		{exitError(t, OOMExitCode), true},
+		{killed, true},
+		{exitError(t, 1), false},
+		{exitError(t, 143), false},
+		{errors.New("failed to start"), false},
+		{nil, false},
+	}
+
+	for i, test := range tests {
+		if actual := IsOOM(test.err); actual != test.expected {
+			t.Errorf("Test %d: expected %t for %v, but got %t", i, test.expected, test.err, actual)
+		}
+	}
+}
+
+func TestRunWithRetries_OOM(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+	oom := []string{"sh", "-c", "exit 137"}
+	tests := []struct {
+		name          string
+		args          []string
+		policy        *ExitCodeRetryPolicy
+		retryOnErrors []string
+		attempts      int
+	}{
+		{"retried regardless of the exit codes", oom, &ExitCodeRetryPolicy{RetryOnOOM: true, RetryOn: []ExitCodeRange{{1, 1}}}, nil, 3},
+		{"retried regardless of the errors", oom, &ExitCodeRetryPolicy{RetryOnOOM: true}, []string{"timeout"}, 3},
+		{"not retried on the exit code", oom, &ExitCodeRetryPolicy{NeverRetryOn: []ExitCodeRange{{137, 137}}}, nil, 1},
+		{"not OOM follows the exit codes", []string{"sh", "-c", "exit 1"}, &ExitCodeRetryPolicy{RetryOnOOM: true, NeverRetryOn: []ExitCodeRange{{1, 1}}}, nil, 1},
+		{"not OOM is retried", []string{"sh", "-c", "exit 1"}, &ExitCodeRetryPolicy{RetryOnOOM: true}, nil, 3},
+	}
+
+	for _, test := range tests {
+		pm := NewProcManager(false)
+		attempts := 0
+		pm.SetAttemptObserver(func(containerName string, attempt int, start time.Time, err error) {
+			attempts = attempt
+		})
+		if err := pm.RunWithRetries(context.Background(), test.args, nil, nil, nil, "", 2, test.retryOnErrors, test.policy, 0, "step"); err == nil {
+			t.Fatalf("%s: expected the run to fail", test.name)
+		}
+		if attempts != test.attempts {
+			t.Errorf("%s: expected %d attempts, but got %d", test.name, test.attempts, attempts)
+		}
+	}
+}
+
+func TestRunWithRetries_OOMArgs(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+	var oomKills []int
+	policy := &ExitCodeRetryPolicy{
+		RetryOnOOM: true,
+		OOMArgs: func(n int) []string {
+			oomKills = append(oomKills, n)
+			// The run succeeds once it has been killed twice.
+			if n == 2 {
+				return []string{"sh", "-c", "exit 0"}
+			}
+			return []string{"sh", "-c", "exit 137"}
+		},
+	}
+
+	pm := NewProcManager(false)
+	if err := pm.RunWithRetries(context.Background(), []string{"sh", "-c", "exit 137"}, nil, nil, nil, "", 3, nil, policy, 0, "step"); err != nil {
+		t.Fatalf("Expected the run to succeed with the args of the OOM retries, but got %v", err)
+	}
+	if !reflect.DeepEqual(oomKills, []int{1, 2}) {
+		t.Errorf("Expected the args to be computed after each OOM kill, but got %v", oomKills)
+	}
+}
+
+func TestRunWithRetries_InspectRun(t *testing.T) {
+	if _, err := exec.LookPath("sh"); err != nil {
+		t.Skip("sh isn't installed")
+	}
+	tests := []struct {
+		name      string
+		code      int
+		oomKilled bool
+		attempts  int
+	}{
+		// Exiting with 137 isn't retried unless the inspection confirms the run ran out of memory.
+		{"confirmed", OOMExitCode, true, 3},
+		{"not confirmed", OOMExitCode, false, 1},
+		{"succeeded", 0, true, 1},
+	}
+
+	for _, test := range tests {
+		var inspected []error
+		policy := &ExitCodeRetryPolicy{
+			RetryOnOOM:   true,
+			NeverRetryOn: []ExitCodeRange{{OOMExitCode, OOMExitCode}},
+			InspectRun: func(err error) bool {
+				inspected = append(inspected, err)
+				return test.oomKilled
+			},
+		}
+		pm := NewProcManager(false)
+		_ = pm.RunWithRetries(context.Background(), []string{"sh", "-c", "exit " + strconv.Itoa(test.code)}, nil, nil, nil, "", 2, nil, policy, 0, "step")
+		// Every run is inspected, including the last and successful ones.
+		if len(inspected) != test.attempts {
+			t.Errorf("%s: expected %d runs to be inspected, but got %d", test.name, test.attempts, len(inspected))
+		}
+	}
+}
@@ -0,0 +1,20 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package procmanager
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup starts the command in a new process group whose ID is the command's PID.
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// killProcessGroup kills every process in the process's group.
+func killProcessGroup(process *os.Process) error {
+	return syscall.Kill(-process.Pid, syscall.SIGKILL)
+}
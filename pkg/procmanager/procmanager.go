@@ -18,11 +18,19 @@ import (
 	"github.com/Azure/acr-builder/pkg/util"
 )
 
+// AttemptObserver is notified when an attempt of RunWithRetries finishes, with the attempt's
+// 1-based number, when it started and the error it failed with, if any.
+type AttemptObserver func(containerName string, attempt int, start time.Time, err error)
+
 // ProcManager is a wrapper for os.Process.
 type ProcManager struct {
 	DryRun    bool
 	mu        sync.Mutex
 	processes map[int]*os.Process
+	observer  AttemptObserver
+
+	// processGroups runs each process in its own process group.
+	processGroups bool
 }
 
 // NewProcManager creates a new ProcManager.
@@ -34,6 +42,19 @@ func NewProcManager(dryRun bool) *ProcManager {
 	}
 }
 
+// SetAttemptObserver sets the observer notified of each attempt of RunWithRetries.
+// It must be set before running any processes.
+func (pm *ProcManager) SetAttemptObserver(observer AttemptObserver) {
+	pm.observer = observer
+}
+
+// SetProcessGroups sets whether each process runs in its own process group, which is killed as a whole
+// when the process's context is cancelled or the ProcManager is stopped, so any processes it started are
+// killed along with it. It must be set before running any processes.
+func (pm *ProcManager) SetProcessGroups(enabled bool) {
+	pm.processGroups = enabled
+}
+
 // RunRepeatWithRetries performs a Run multiple times with retries.
 // If any error occurs during the repetition, all errors will be aggregated and returned.
 func (pm *ProcManager) RunRepeatWithRetries(
@@ -45,13 +66,14 @@ func (pm *ProcManager) RunRepeatWithRetries(
 	cmdDir string,
 	retries int,
 	retryOnErrors []string,
+	exitCodePolicy *ExitCodeRetryPolicy,
 	retryDelay int,
 	containerName string,
 	repeat int,
 	ignoreErrors bool) error {
 	var aggErrors util.Errors
 	for i := 0; i <= repeat; i++ {
-		innerErr := pm.RunWithRetries(ctx, args, stdIn, stdOut, stdErr, cmdDir, retries, retryOnErrors, retryDelay, containerName)
+		innerErr := pm.RunWithRetries(ctx, args, stdIn, stdOut, stdErr, cmdDir, retries, retryOnErrors, exitCodePolicy, retryDelay, containerName)
 		if innerErr != nil {
 			aggErrors = append(aggErrors, innerErr)
 		}
@@ -62,7 +84,9 @@ func (pm *ProcManager) RunRepeatWithRetries(
 	return nil
 }
 
-// RunWithRetries performs Run with retries.
+// RunWithRetries performs Run with retries. A failed run is only retried if its output contains one of
+// the retryOnErrors, if any are specified, and exitCodePolicy, if not nil, allows its exit code to be retried,
+// unless it was killed for running out of memory and exitCodePolicy retries such runs.
 func (pm *ProcManager) RunWithRetries(
 	ctx context.Context,
 	args []string,
@@ -72,9 +96,10 @@ func (pm *ProcManager) RunWithRetries(
 	cmdDir string,
 	retries int,
 	retryOnErrors []string,
+	exitCodePolicy *ExitCodeRetryPolicy,
 	retryDelay int,
 	containerName string) error {
-	attempt := 0
+	attempt, oomKills := 0, 0
 	var err error
 	for attempt <= retries {
 		log.Printf("Launching container with name: %s\n", containerName)
@@ -92,13 +117,33 @@ func (pm *ProcManager) RunWithRetries(
 			stdErrWriter = stdErr
 		}
 
-		if err = pm.Run(ctx, args, stdIn, stdOutWriter, stdErrWriter, cmdDir); err == nil {
+		start := time.Now()
+		err = pm.Run(ctx, args, stdIn, stdOutWriter, stdErrWriter, cmdDir)
+		oomKilled := exitCodePolicy.inspectRun(err)
+		if pm.observer != nil {
+			pm.observer(containerName, attempt+1, start, err)
+		}
+		if err == nil {
 			log.Printf("Successfully executed container: %s\n", containerName)
 			break
 		} else {
 			attempt++
+			if ctx.Err() != nil {
+				// The context was cancelled or timed out, so retrying would fail immediately too.
+				log.Printf("Container failed during run: %s. Its context is done, not retrying.\n", containerName)
+				break
+			}
 			if attempt <= retries {
-				if !needToCheckError || containsAnyError(retryOnErrors, &stdOutBuf, &stdErrBuf) {
+				if oomKilled && exitCodePolicy.retriesOOM() {
+					oomKills++
+					if exitCodePolicy.OOMArgs != nil {
+						args = exitCodePolicy.OOMArgs(oomKills)
+					}
+					log.Printf("Container ran out of memory: %s, waiting %d seconds before retrying...\n", containerName, retryDelay)
+					time.Sleep(time.Duration(retryDelay) * time.Second)
+					continue
+				}
+				if (!needToCheckError || containsAnyError(retryOnErrors, &stdOutBuf, &stdErrBuf)) && exitCodePolicy.allowsRetry(err) {
 					log.Printf("Container failed during run: %s, waiting %d seconds before retrying...\n", containerName, retryDelay)
 					time.Sleep(time.Duration(retryDelay) * time.Second)
 					continue
@@ -138,6 +183,9 @@ func (pm *ProcManager) Run(
 	cmd.Stdin = stdIn
 	cmd.Stdout = stdOut
 	cmd.Stderr = stdErr
+	if pm.processGroups {
+		setProcessGroup(cmd)
+	}
 
 	if err := cmd.Start(); err != nil {
 		return err
@@ -161,7 +209,7 @@ func (pm *ProcManager) Run(
 
 	case <-ctx.Done():
 		go func() {
-			if err := cmd.Process.Kill(); err != nil {
+			if err := pm.kill(cmd.Process); err != nil {
 				log.Printf("Failed to kill process. Path: %s, Args: %v, Err: %v\n", cmd.Path, cmd.Args, err)
 			}
 		}()
@@ -186,7 +234,7 @@ func (pm *ProcManager) Stop() util.Errors {
 
 	var errs util.Errors
 	for pid, process := range pm.processes {
-		if err := process.Kill(); err != nil {
+		if err := pm.kill(process); err != nil {
 			errs = append(errs, err)
 		}
 		delete(pm.processes, pid)
@@ -194,6 +242,14 @@ func (pm *ProcManager) Stop() util.Errors {
 	return errs
 }
 
+// kill kills the process, along with its process group if processes run in their own process groups.
+func (pm *ProcManager) kill(process *os.Process) error {
+	if pm.processGroups {
+		return killProcessGroup(process)
+	}
+	return process.Kill()
+}
+
 func containsAnyError(errors []string, stdOutBuf, stdErrBuf *bytes.Buffer) bool {
 	stdOut := stdOutBuf.String()
 	stdErr := stdErrBuf.String()
@@ -7,6 +7,7 @@ import (
 	"bytes"
 	"context"
 	"testing"
+	"time"
 )
 
 func TestDryRun(t *testing.T) {
@@ -62,3 +63,23 @@ func TestContainsAnyError(t *testing.T) {
 		}
 	}
 }
+
+func TestRunWithRetries_AttemptObserver(t *testing.T) {
+	pm := NewProcManager(true)
+	var attempts []int
+	pm.SetAttemptObserver(func(containerName string, attempt int, start time.Time, err error) {
+		if containerName != "step" {
+			t.Errorf("Expected container name step, but got %s", containerName)
+		}
+		if start.IsZero() || err != nil {
+			t.Errorf("Unexpected start: %v, err: %v", start, err)
+		}
+		attempts = append(attempts, attempt)
+	})
+	if err := pm.RunWithRetries(context.Background(), []string{"docker", "run"}, nil, nil, nil, "", 2, nil, nil, 0, "step"); err != nil {
+		t.Fatalf("Unexpected err: %v", err)
+	}
+	if len(attempts) != 1 || attempts[0] != 1 {
+		t.Errorf("Expected a single attempt, but got %v", attempts)
+	}
+}
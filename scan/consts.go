@@ -3,7 +3,9 @@
 
 package scan
 
+import "github.com/Azure/acr-builder/pkg/image"
+
 const (
 	// DockerHubRegistry is the docker hub registry
-	DockerHubRegistry = "registry.hub.docker.com"
+	DockerHubRegistry = image.DockerHubRegistry
 )
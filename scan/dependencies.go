@@ -30,14 +30,7 @@ var (
 
 // ScanForDependencies scans for base image dependencies.
 func (s *Scanner) ScanForDependencies(context string, workingDir string, dockerfile string, buildArgs []string, pushTo []string, target string) (deps []*image.Dependencies, err error) {
-	dockerfilePath := createDockerfilePath(context, workingDir, dockerfile)
-	file, err := os.Open(dockerfilePath)
-	if err != nil {
-		return deps, fmt.Errorf("error opening dockerfile: %s, error: %v", dockerfilePath, err)
-	}
-	defer func() { _ = file.Close() }()
-
-	runtime, buildtime, err := resolveDockerfileDependencies(file, buildArgs, target)
+	runtime, buildtime, err := DockerfileBaseImages(context, workingDir, dockerfile, buildArgs, target)
 	if err != nil {
 		return deps, err
 	}
@@ -65,6 +58,19 @@ func (s *Scanner) ScanForDependencies(context string, workingDir string, dockerf
 	return deps, err
 }
 
+// DockerfileBaseImages returns the runtime image and the buildtime images of the Dockerfile built with
+// the context, working directory, build args and target, without resolving or pulling them.
+func DockerfileBaseImages(context string, workingDir string, dockerfile string, buildArgs []string, target string) (runtime string, buildtime []string, err error) {
+	dockerfilePath := createDockerfilePath(context, workingDir, dockerfile)
+	file, err := os.Open(dockerfilePath)
+	if err != nil {
+		return "", nil, fmt.Errorf("error opening dockerfile: %s, error: %v", dockerfilePath, err)
+	}
+	defer func() { _ = file.Close() }()
+
+	return resolveDockerfileDependencies(file, buildArgs, target)
+}
+
 // NewImageDependencies creates Dependencies with no references registered
 func (s *Scanner) NewImageDependencies(img string, runtime string, buildtimes []string) (*image.Dependencies, error) {
 	var dependencies *image.Dependencies
@@ -118,19 +124,34 @@ func (s *Scanner) NewImageDependencies(img string, runtime string, buildtimes []
 
 // NewImageReference parses a path of a image and creates a ImageReference object
 func NewImageReference(imagePath string) (*image.Reference, error) {
-	ref, err := reference.Parse(imagePath)
+	ipv6Registry, remainder, err := image.SplitIPv6Registry(imagePath)
+	if err != nil {
+		return nil, err
+	}
+	parsePath := imagePath
+	if ipv6Registry != "" {
+		parsePath = image.IPv6RegistryPlaceholder + remainder
+	}
+
+	ref, err := reference.Parse(parsePath)
 	if err != nil {
 		return nil, errors.Wrapf(err, "Failed to parse image reference, ensure tags have a valid format: %s", imagePath)
 	}
 	result := &image.Reference{
 		Reference: ref.String(),
 	}
+	if ipv6Registry != "" {
+		result.Reference = ipv6Registry + strings.TrimPrefix(result.Reference, image.IPv6RegistryPlaceholder)
+	}
 
 	if named, ok := ref.(reference.Named); ok {
 		result.Registry = reference.Domain(named)
 
-		if strings.Contains(result.Registry, ".") {
-			// The domain is the registry, eg, registryname.azurecr.io
+		if ipv6Registry != "" {
+			result.Registry = ipv6Registry
+			result.Repository = reference.Path(named)
+		} else if isRegistryDomain(result.Registry) {
+			// The domain is the registry, eg, registryname.azurecr.io or localhost:5000
 			result.Repository = reference.Path(named)
 		} else {
 			// DockerHub
@@ -153,6 +174,12 @@ func NewImageReference(imagePath string) (*image.Reference, error) {
 	return result, nil
 }
 
+// isRegistryDomain determines whether the domain of a reference is a registry rather than a DockerHub user name.
+// Like Docker, a domain is a registry if it contains a '.' or a port, or if it's localhost.
+func isRegistryDomain(domain string) bool {
+	return strings.ContainsAny(domain, ".:") || domain == "localhost"
+}
+
 // resolveDockerfileDependencies resolves dependencies given an io.Reader for a Dockerfile.
 func resolveDockerfileDependencies(r io.Reader, buildArgs []string, target string) (origin string, buildtimeDependencies []string, err error) {
 	scanner := bufio.NewScanner(r)
@@ -191,12 +218,13 @@ SCAN: // label for the scan loop
 					return "", nil, fmt.Errorf("unable to understand line %s", line)
 				}
 				// trim surrounds single and double quotes from the image reference
-				var imageToken = os.Expand(util.TrimQuotes(tokens[1]), func(key string) string {
-					return context[key]
-				})
+				var imageToken = expandBuildArgs(util.TrimQuotes(tokens[1]), context)
 				var found bool
 				origin, found = originLookup[imageToken]
 				if !found {
+					if err := validateBaseImage(imageToken, tokens[1]); err != nil {
+						return "", nil, err
+					}
 					allOrigins[imageToken] = true
 					origin = imageToken
 				}
@@ -219,21 +247,8 @@ SCAN: // label for the scan loop
 					}
 				}
 			case "ARG":
-				if len(tokens) < 2 {
-					return "", nil, fmt.Errorf("dockerfile syntax requires ARG directive to have exactly 1 argument. LINE: %s", line)
-				}
-				if strings.Contains(tokens[1], "=") {
-					varName, varValue, err := parseAssignment(tokens[1])
-					if err != nil {
-						return "", nil, fmt.Errorf("unable to parse assignment %s, error: %s", tokens[1], err)
-					}
-					// This line matches docker's behavior here
-					// 1. If build arg is passed in, the value will not override
-					// 2. It is actually allowed for same ARG to be specified more than once in a Dockerfile
-					//    However the subsequent value would be ignored instead of overriding the previous
-					if _, found := context[varName]; !found {
-						context[varName] = varValue
-					}
+				if err := addBuildArgDefault(tokens, line, context); err != nil {
+					return "", nil, err
 				}
 			}
 		}
@@ -253,6 +268,66 @@ SCAN: // label for the scan loop
 	return origin, buildtimeDependencies, nil
 }
 
+// addBuildArgDefault adds the default value of the build arg declared by the ARG instruction tokens to
+// the build args, unless it has been passed in.
+func addBuildArgDefault(tokens []string, line string, args map[string]string) error {
+	if len(tokens) < 2 {
+		return fmt.Errorf("dockerfile syntax requires ARG directive to have exactly 1 argument. LINE: %s", line)
+	}
+	if strings.Contains(tokens[1], "=") {
+		varName, varValue, err := parseAssignment(tokens[1])
+		if err != nil {
+			return fmt.Errorf("unable to parse assignment %s, error: %s", tokens[1], err)
+		}
+		// This line matches docker's behavior here
+		// 1. If build arg is passed in, the value will not override
+		// 2. It is actually allowed for same ARG to be specified more than once in a Dockerfile
+		//    However the subsequent value would be ignored instead of overriding the previous
+		if _, found := args[varName]; !found {
+			args[varName] = varValue
+		}
+	}
+	return nil
+}
+
+// expandBuildArgs substitutes the build args referenced in s, e.g. $BASE or ${BASE}. Like Docker,
+// ${ARG:-word} expands to word if ARG is empty or unset, and ${ARG:+word} expands to word only if ARG is set.
+func expandBuildArgs(s string, args map[string]string) string {
+	return os.Expand(s, func(key string) string {
+		if i := strings.Index(key, ":"); i > 0 && i+1 < len(key) {
+			name, modifier, word := key[:i], key[i+1], key[i+2:]
+			switch modifier {
+			case '-':
+				if value := args[name]; value != "" {
+					return value
+				}
+				return expandBuildArgs(word, args)
+			case '+':
+				if args[name] != "" {
+					return expandBuildArgs(word, args)
+				}
+				return ""
+			}
+		}
+		return args[key]
+	})
+}
+
+// validateBaseImage validates that the base image of a FROM instruction, after its build args
+// have been substituted, is a well-formed reference which can be resolved.
+func validateBaseImage(rendered string, original string) error {
+	if rendered == "" {
+		return fmt.Errorf("the base image '%s' is empty after substituting build args, ensure they're all set", original)
+	}
+	if strings.Contains(rendered, "{{") || strings.Contains(rendered, "}}") {
+		return fmt.Errorf("the base image '%s' contains a template expression which wasn't rendered", original)
+	}
+	if _, err := NewImageReference(util.NormalizeImageTag(rendered)); err != nil {
+		return errors.Wrapf(err, "the base image '%s' rendered from '%s' isn't a well-formed reference", rendered, original)
+	}
+	return nil
+}
+
 func parseBuildArgs(args []string) (map[string]string, error) {
 	result := map[string]string{}
 	for _, assignment := range args {
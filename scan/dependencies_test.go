@@ -6,6 +6,7 @@ package scan
 import (
 	"bytes"
 	"fmt"
+	"strings"
 	"testing"
 )
 
@@ -130,6 +131,52 @@ func TestResolveDockerfileDependencies_WithTarget(t *testing.T) {
 	}
 }
 
+func TestResolveDockerfileDependencies_BaseImageArgs(t *testing.T) {
+	df := `ARG BASE
+ARG VARIANT
+FROM ${BASE:-ubuntu:22.04}${VARIANT:+-$VARIANT}
+RUN ls`
+	tests := []struct {
+		buildArgs       []string
+		expectedRuntime string
+	}{
+		{nil, "ubuntu:22.04"},
+		{[]string{"BASE=golang:1.18"}, "golang:1.18"},
+		{[]string{"BASE=golang:1.18", "VARIANT=alpine"}, "golang:1.18-alpine"},
+		{[]string{"BASE="}, "ubuntu:22.04"},
+	}
+
+	for _, test := range tests {
+		runtimeDep, _, err := resolveDockerfileDependencies(strings.NewReader(df), test.buildArgs, "")
+		if err != nil {
+			t.Errorf("Failed to resolve dependencies with %v: %v", test.buildArgs, err)
+			continue
+		}
+		if runtimeDep != test.expectedRuntime {
+			t.Errorf("Unexpected runtime with %v. Got %s, expected %s", test.buildArgs, runtimeDep, test.expectedRuntime)
+		}
+	}
+}
+
+func TestResolveDockerfileDependencies_InvalidBaseImage(t *testing.T) {
+	tests := []struct {
+		dockerfile string
+		buildArgs  []string
+		errMsg     string
+	}{
+		{"ARG BASE\nFROM $BASE", nil, "is empty after substituting build args"},
+		{"FROM {{.Values.base}}", nil, "template expression which wasn't rendered"},
+		{"FROM $BASE", []string{"BASE=Ubuntu:latest"}, "isn't a well-formed reference"},
+	}
+
+	for _, test := range tests {
+		_, _, err := resolveDockerfileDependencies(strings.NewReader(test.dockerfile), test.buildArgs, "")
+		if err == nil || !strings.Contains(err.Error(), test.errMsg) {
+			t.Errorf("Expected an error containing %q for %q, but got %v", test.errMsg, test.dockerfile, err)
+		}
+	}
+}
+
 func TestCreateDockerfilePath(t *testing.T) {
 	tests := []struct {
 		context    string
@@ -155,3 +202,38 @@ func TestCreateDockerfilePath(t *testing.T) {
 		}
 	}
 }
+
+func TestNewImageReference(t *testing.T) {
+	tests := []struct {
+		imagePath  string
+		registry   string
+		repository string
+		tag        string
+		reference  string
+	}{
+		{"hello-world:latest", DockerHubRegistry, "library/hello-world", "latest", "hello-world:latest"},
+		{"myuser/app:v1", DockerHubRegistry, "myuser/app", "v1", "myuser/app:v1"},
+		{"myregistry.azurecr.io/org/app:v1", "myregistry.azurecr.io", "org/app", "v1", "myregistry.azurecr.io/org/app:v1"},
+		{"localhost:5000/app:v1", "localhost:5000", "app", "v1", "localhost:5000/app:v1"},
+		{"localhost/app:v1", "localhost", "app", "v1", "localhost/app:v1"},
+		{"myregistry:5000/org/app:v1", "myregistry:5000", "org/app", "v1", "myregistry:5000/org/app:v1"},
+		{"myregistry.azurecr.io:443/app:v1", "myregistry.azurecr.io:443", "app", "v1", "myregistry.azurecr.io:443/app:v1"},
+		{"[::1]:5000/app:v1", "[::1]:5000", "app", "v1", "[::1]:5000/app:v1"},
+		{"[fd00::1]/org/app:v1", "[fd00::1]", "org/app", "v1", "[fd00::1]/org/app:v1"},
+	}
+
+	for _, test := range tests {
+		ref, err := NewImageReference(test.imagePath)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.imagePath, err)
+			continue
+		}
+		if ref.Registry != test.registry || ref.Repository != test.repository || ref.Tag != test.tag || ref.Reference != test.reference {
+			t.Errorf("Unexpected reference for %s: %v", test.imagePath, ref)
+		}
+	}
+
+	if _, err := NewImageReference("[::1:5000/app:v1"); err == nil {
+		t.Error("Expected an invalid IPv6 registry to error, but it didn't")
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package scan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// PinnedDockerfileSuffix is appended to the path of a Dockerfile to name the copy whose base images are pinned.
+	PinnedDockerfileSuffix = ".pinned"
+
+	noBaseImage = "scratch:latest"
+)
+
+// DigestPopulator populates the digests of image references.
+type DigestPopulator interface {
+	PopulateDigest(ctx context.Context, ref *image.Reference) error
+}
+
+// SetBaseImagePinner makes Scan write a copy of the Dockerfile, named with PinnedDockerfileSuffix, whose
+// base images are pinned to the digests populated by helper.
+func (s *Scanner) SetBaseImagePinner(helper DigestPopulator) {
+	s.pinner = helper
+}
+
+// PinDockerfile writes a copy of the Dockerfile, next to it and named with PinnedDockerfileSuffix, in which
+// every external base image of every stage is pinned to the digest populated by helper.
+func PinDockerfile(ctx context.Context, sourceContext string, workingDir string, dockerfile string, buildArgs []string, helper DigestPopulator) (string, error) {
+	dockerfilePath := createDockerfilePath(sourceContext, workingDir, dockerfile)
+	data, err := os.ReadFile(dockerfilePath)
+	if err != nil {
+		return "", fmt.Errorf("error opening dockerfile: %s, error: %v", dockerfilePath, err)
+	}
+
+	var pinned bytes.Buffer
+	if err := pinBaseImages(ctx, bytes.NewReader(data), &pinned, buildArgs, helper); err != nil {
+		return "", err
+	}
+
+	pinnedPath := dockerfilePath + PinnedDockerfileSuffix
+	if err := os.WriteFile(pinnedPath, pinned.Bytes(), 0600); err != nil {
+		return "", errors.Wrapf(err, "failed to write the pinned dockerfile %s", pinnedPath)
+	}
+	return pinnedPath, nil
+}
+
+// pinBaseImages copies the Dockerfile read from r to w, replacing the base image of each FROM instruction
+// with the image, after its build args have been substituted, pinned to the digest populated by helper.
+// FROM instructions referencing an earlier stage by its name, or scratch, and base images which already
+// specify a digest are copied as is.
+func pinBaseImages(ctx context.Context, r io.Reader, w io.Writer, buildArgs []string, helper DigestPopulator) error {
+	scanner := bufio.NewScanner(r)
+	args, err := parseBuildArgs(buildArgs)
+	if err != nil {
+		return err
+	}
+	stages := map[string]bool{} // the names of the stages declared so far
+	pins := map[string]string{} // given a base image, look up its pinned reference
+	firstLine := true
+
+	for scanner.Scan() {
+		line := scanner.Text()
+		if firstLine {
+			line = string(bytes.TrimPrefix(scanner.Bytes(), utf8BOM))
+			firstLine = false
+		}
+
+		tokens := strings.Fields(strings.TrimSpace(line))
+		if len(tokens) > 0 && !strings.HasPrefix(tokens[0], dockerfileComment) {
+			switch strings.ToUpper(tokens[0]) {
+			case "FROM":
+				if len(tokens) < 2 {
+					return fmt.Errorf("unable to understand line %s", line)
+				}
+				img := expandBuildArgs(util.TrimQuotes(tokens[1]), args)
+				if !stages[img] {
+					pinned, ok := pins[img]
+					if !ok {
+						if pinned, err = pinBaseImage(ctx, img, tokens[1], helper); err != nil {
+							return err
+						}
+						pins[img] = pinned
+					}
+					line = strings.Replace(line, tokens[1], pinned, 1)
+				}
+				if len(tokens) > 3 && strings.EqualFold(tokens[2], "as") {
+					stages[tokens[3]] = true
+				}
+			case "ARG":
+				if err := addBuildArgDefault(tokens, line, args); err != nil {
+					return err
+				}
+			}
+		}
+
+		if _, err := io.WriteString(w, line+"\n"); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// pinBaseImage returns the base image, rendered from original, pinned to the digest populated by helper.
+// If helper rewrote the reference, e.g. to a mirror, the rewritten reference is pinned, so it's also pulled from there.
+func pinBaseImage(ctx context.Context, img string, original string, helper DigestPopulator) (string, error) {
+	if err := validateBaseImage(img, original); err != nil {
+		return "", err
+	}
+	ref, err := NewImageReference(util.NormalizeImageTag(img))
+	if err != nil {
+		return "", err
+	}
+	if ref.Digest != "" || ref.Reference == noBaseImage {
+		return img, nil
+	}
+	if err := helper.PopulateDigest(ctx, ref); err != nil {
+		return "", errors.Wrapf(err, "failed to pin the base image %s", img)
+	}
+	if ref.Digest == "" {
+		return "", errors.Errorf("no digest was resolved for the base image %s", img)
+	}
+	if ref.OriginalReference != "" {
+		log.Printf("Pinned the base image %s to %s@%s\n", img, ref.Reference, ref.Digest)
+		return ref.Reference + "@" + ref.Digest, nil
+	}
+	log.Printf("Pinned the base image %s to %s\n", img, ref.Digest)
+	return img + "@" + ref.Digest, nil
+}
@@ -0,0 +1,169 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package scan
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/pkg/image"
+	"github.com/pkg/errors"
+)
+
+// fakePopulator populates the digest of each reference from digests, by the reference's repository and tag.
+type fakePopulator struct {
+	digests  map[string]string
+	resolved []string
+}
+
+func (p *fakePopulator) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	name := ref.Repository + ":" + ref.Tag
+	p.resolved = append(p.resolved, name)
+	dgst, ok := p.digests[name]
+	if !ok {
+		return errors.Errorf("%s not found", name)
+	}
+	ref.Digest = dgst
+	return nil
+}
+
+// TestPinBaseImages tests pinning the external base images of every stage of a multi-stage Dockerfile.
+func TestPinBaseImages(t *testing.T) {
+	const (
+		golangDigest = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+		alpineDigest = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+		certDigest   = "sha256:3333333333333333333333333333333333333333333333333333333333333333"
+		pinnedDigest = "sha256:4444444444444444444444444444444444444444444444444444444444444444"
+	)
+	df := `# syntax=docker/dockerfile:1
+ARG GO_VERSION=1.20
+FROM golang:${GO_VERSION} AS builder
+RUN go build -o /app .
+
+FROM builder AS test
+RUN go test ./...
+
+FROM "imaginary/cert-generator:1.0" as certs
+FROM ubuntu@` + pinnedDigest + `
+FROM scratch AS empty
+
+FROM alpine
+COPY --from=builder /app /app
+COPY --from=certs /cert /cert
+
+FROM alpine AS debug
+`
+	expected := `# syntax=docker/dockerfile:1
+ARG GO_VERSION=1.20
+FROM golang:1.21@` + golangDigest + ` AS builder
+RUN go build -o /app .
+
+FROM builder AS test
+RUN go test ./...
+
+FROM imaginary/cert-generator:1.0@` + certDigest + ` as certs
+FROM ubuntu@` + pinnedDigest + `
+FROM scratch AS empty
+
+FROM alpine@` + alpineDigest + `
+COPY --from=builder /app /app
+COPY --from=certs /cert /cert
+
+FROM alpine@` + alpineDigest + ` AS debug
+`
+	helper := &fakePopulator{digests: map[string]string{
+		"library/golang:1.21":          golangDigest,
+		"library/alpine:latest":        alpineDigest,
+		"imaginary/cert-generator:1.0": certDigest,
+	}}
+
+	var out bytes.Buffer
+	if err := pinBaseImages(context.Background(), strings.NewReader(df), &out, []string{"GO_VERSION=1.21"}, helper); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if out.String() != expected {
+		t.Errorf("Expected the pinned Dockerfile\n%s\nbut got\n%s", expected, out.String())
+	}
+	// Named stages, scratch, and images which are already pinned aren't resolved, and each image is resolved once.
+	if expectedResolved := []string{"library/golang:1.21", "imaginary/cert-generator:1.0", "library/alpine:latest"}; strings.Join(helper.resolved, ",") != strings.Join(expectedResolved, ",") {
+		t.Errorf("Expected %v to be resolved, but got %v", expectedResolved, helper.resolved)
+	}
+}
+
+// rewritingPopulator rewrites each reference to the mirror registry before populating its digest.
+type rewritingPopulator struct {
+	digest string
+}
+
+func (p *rewritingPopulator) PopulateDigest(ctx context.Context, ref *image.Reference) error {
+	rewritten, err := NewImageReference("mirror.azurecr.io/" + ref.Repository + ":" + ref.Tag)
+	if err != nil {
+		return err
+	}
+	rewritten.OriginalReference = ref.Reference
+	rewritten.Digest = p.digest
+	*ref = *rewritten
+	return nil
+}
+
+// TestPinBaseImages_Rewritten tests that base images are pinned to the reference they were rewritten to.
+func TestPinBaseImages_Rewritten(t *testing.T) {
+	const dgst = "sha256:1111111111111111111111111111111111111111111111111111111111111111"
+	var out bytes.Buffer
+	if err := pinBaseImages(context.Background(), strings.NewReader("FROM golang:1.21 AS builder\n"), &out, nil, &rewritingPopulator{digest: dgst}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "FROM mirror.azurecr.io/library/golang:1.21@" + dgst + " AS builder\n"; out.String() != expected {
+		t.Errorf("Expected %q, but got %q", expected, out.String())
+	}
+}
+
+// TestPinBaseImages_Errors tests that the Dockerfile isn't pinned if a base image can't be pinned.
+func TestPinBaseImages_Errors(t *testing.T) {
+	tests := []struct {
+		df      string
+		digests map[string]string
+	}{
+		// The image can't be resolved.
+		{"FROM golang:1.21 AS builder\nFROM alpine\n", map[string]string{"library/golang:1.21": "sha256:1111111111111111111111111111111111111111111111111111111111111111"}},
+		// No digest is resolved.
+		{"FROM alpine\n", map[string]string{"library/alpine:latest": ""}},
+		// The build arg isn't set.
+		{"ARG BASE\nFROM $BASE\n", nil},
+	}
+	for _, test := range tests {
+		var out bytes.Buffer
+		if err := pinBaseImages(context.Background(), strings.NewReader(test.df), &out, nil, &fakePopulator{digests: test.digests}); err == nil {
+			t.Errorf("Expected an error pinning %q", test.df)
+		}
+	}
+}
+
+// TestPinDockerfile tests writing the pinned copy of a Dockerfile next to it.
+func TestPinDockerfile(t *testing.T) {
+	const dgst = "sha256:2222222222222222222222222222222222222222222222222222222222222222"
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "Dockerfile"), []byte("FROM alpine\nRUN echo hello\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	pinnedPath, err := PinDockerfile(context.Background(), "https://github.com/Azure/acr-builder.git", dir, "", nil, &fakePopulator{digests: map[string]string{"library/alpine:latest": dgst}})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := filepath.Join(dir, "Dockerfile") + PinnedDockerfileSuffix; pinnedPath != expected {
+		t.Errorf("Expected the pinned Dockerfile to be written to %s, but got %s", expected, pinnedPath)
+	}
+	pinned, err := os.ReadFile(pinnedPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "FROM alpine@" + dgst + "\nRUN echo hello\n"; string(pinned) != expected {
+		t.Errorf("Expected %q, but got %q", expected, string(pinned))
+	}
+}
@@ -23,6 +23,7 @@ type Scanner struct {
 	tags              []string
 	target            string
 	credentials       graph.RegistryLoginCredentials
+	pinner            DigestPopulator
 }
 
 // NewScanner creates a new Scanner.
@@ -60,6 +61,12 @@ func (s *Scanner) Scan(ctx context.Context) (deps []*image.Dependencies, err err
 		return deps, err
 	}
 
+	if s.pinner != nil {
+		if _, err := PinDockerfile(ctx, s.context, workingDir, s.dockerfile, s.buildArgs, s.pinner); err != nil {
+			return deps, err
+		}
+	}
+
 	for _, dep := range deps {
 		dep.Git = &image.GitReference{
 			GitHeadRev: sha,
@@ -0,0 +1,126 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package secretmgmt
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	placeholderPrefix = "__ACB_SECRET_"
+	placeholderSuffix = "__"
+)
+
+// placeholderRegex matches the placeholders of secrets, whose IDs are hex encoded so any ID can be used.
+var placeholderRegex = regexp.MustCompile(placeholderPrefix + `([0-9a-f]+)` + placeholderSuffix)
+
+// Placeholder returns the placeholder rendered in place of the secret's value when secrets are resolved lazily.
+func Placeholder(id string) string {
+	return placeholderPrefix + hex.EncodeToString([]byte(id)) + placeholderSuffix
+}
+
+// lazySecret is a secret which is resolved the first time it's used.
+type lazySecret struct {
+	mu       sync.Mutex
+	secret   *Secret
+	resolved bool
+}
+
+// LazySecretResolver resolves secrets the first time one of their placeholders is expanded,
+// rather than all of them upfront, and caches their values thereafter.
+type LazySecretResolver struct {
+	resolver *SecretResolver
+	secrets  map[string]*lazySecret
+}
+
+// NewLazySecretResolver creates a LazySecretResolver for the secrets, which are resolved using resolveFunc,
+// or the Resolver registered for their scheme if nil, in resolveTimeout.
+func NewLazySecretResolver(secrets []*Secret, resolveFunc ResolveSecretFunc, resolveTimeout time.Duration) (*LazySecretResolver, error) {
+	resolver, err := NewSecretResolver(resolveFunc, resolveTimeout)
+	if err != nil {
+		return nil, err
+	}
+	lazy := &LazySecretResolver{resolver: resolver, secrets: make(map[string]*lazySecret, len(secrets))}
+	for _, secret := range secrets {
+		if secret != nil {
+			lazy.secrets[secret.ID] = &lazySecret{secret: secret}
+		}
+	}
+	return lazy, nil
+}
+
+// Expand replaces the placeholders of secrets in value with their values, resolving the secrets
+// which haven't been resolved yet.
+func (l *LazySecretResolver) Expand(ctx context.Context, value string) (string, error) {
+	var expandErr error
+	expanded := placeholderRegex.ReplaceAllStringFunc(value, func(placeholder string) string {
+		if expandErr != nil {
+			return placeholder
+		}
+		id, err := hex.DecodeString(placeholderRegex.FindStringSubmatch(placeholder)[1])
+		if err != nil {
+			return placeholder
+		}
+		secretValue, err := l.resolve(ctx, string(id))
+		if err != nil {
+			expandErr = err
+			return placeholder
+		}
+		return secretValue
+	})
+	if expandErr != nil {
+		return "", expandErr
+	}
+	return expanded, nil
+}
+
+// resolve returns the value of the secret, resolving it if it hasn't been resolved yet.
+func (l *LazySecretResolver) resolve(ctx context.Context, id string) (string, error) {
+	lazy, ok := l.secrets[id]
+	if !ok {
+		return "", fmt.Errorf("secret '%s' isn't defined", id)
+	}
+	lazy.mu.Lock()
+	defer lazy.mu.Unlock()
+	if !lazy.resolved {
+		if err := l.resolver.ResolveSecrets(ctx, []*Secret{lazy.secret}); err != nil {
+			return "", fmt.Errorf("failed to resolve secret '%s': %v", id, err)
+		}
+		lazy.resolved = true
+	}
+	return lazy.secret.ResolvedValue, nil
+}
+
+// ResolvedValues returns the values of the secrets which have been resolved so far.
+func (l *LazySecretResolver) ResolvedValues() []string {
+	var values []string
+	for _, lazy := range l.secrets {
+		lazy.mu.Lock()
+		if lazy.resolved {
+			values = append(values, lazy.secret.ResolvedValue)
+		}
+		lazy.mu.Unlock()
+	}
+	return values
+}
+
+// PlaceholderIDs returns the IDs of the secrets whose placeholders are in value, in the order they first appear.
+func PlaceholderIDs(value string) []string {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, match := range placeholderRegex.FindAllStringSubmatch(value, -1) {
+		id, err := hex.DecodeString(match[1])
+		if err != nil || seen[string(id)] {
+			continue
+		}
+		seen[string(id)] = true
+		ids = append(ids, string(id))
+	}
+	return ids
+}
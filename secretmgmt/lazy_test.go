@@ -0,0 +1,84 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package secretmgmt
+
+import (
+	"context"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLazySecretResolver(t *testing.T) {
+	var resolved int32
+	countingResolve := func(ctx context.Context, secret *Secret, errorChan chan error) {
+		atomic.AddInt32(&resolved, 1)
+		MockResolveSecret(ctx, secret, errorChan)
+	}
+	secrets := []*Secret{
+		{ID: "mysecret", KeyVault: "https://myvault.vault.azure.net/secrets/mysecret"},
+		{ID: "unused", KeyVault: "https://myvault.vault.azure.net/secrets/unused"},
+		{ID: "unresolvable", Source: "unknown://secret"},
+	}
+	lazy, err := NewLazySecretResolver(secrets, countingResolve, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create the lazy secret resolver: %v", err)
+	}
+	if atomic.LoadInt32(&resolved) != 0 {
+		t.Fatal("Expected no secret to be resolved upfront")
+	}
+
+	ctx := context.Background()
+	for i := 0; i < 2; i++ {
+		actual, err := lazy.Expand(ctx, "login --password "+Placeholder("mysecret")+" && echo "+Placeholder("mysecret"))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if expected := "login --password vault-https://myvault.vault.azure.net/secrets/mysecret- && echo vault-https://myvault.vault.azure.net/secrets/mysecret-"; actual != expected {
+			t.Errorf("Expected %s but got %s", expected, actual)
+		}
+	}
+	if n := atomic.LoadInt32(&resolved); n != 1 {
+		t.Errorf("Expected the secret to be resolved once and cached, but it was resolved %d times", n)
+	}
+	if values := lazy.ResolvedValues(); len(values) != 1 || values[0] != "vault-https://myvault.vault.azure.net/secrets/mysecret-" {
+		t.Errorf("Expected only the used secret to be resolved, but got %v", values)
+	}
+
+	if actual, err := lazy.Expand(ctx, "no secrets"); err != nil || actual != "no secrets" {
+		t.Errorf("Expected a value without placeholders to be unchanged, but got %s, %v", actual, err)
+	}
+	if _, err := lazy.Expand(ctx, Placeholder("unresolvable")); err == nil || !strings.Contains(err.Error(), "unresolvable") {
+		t.Errorf("Expected an error resolving the unresolvable secret, but got %v", err)
+	}
+	if _, err := lazy.Expand(ctx, Placeholder("undefined")); err == nil {
+		t.Error("Expected an error for a secret which isn't defined")
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	for _, id := range []string{"mysecret", "run_1.secret-2", "ünïcode"} {
+		match := placeholderRegex.FindStringSubmatch("echo " + Placeholder(id) + ";")
+		if match == nil {
+			t.Errorf("Expected the placeholder of %s to be matched", id)
+			continue
+		}
+		if decoded, err := hex.DecodeString(match[1]); err != nil || string(decoded) != id {
+			t.Errorf("Expected the placeholder of %s to decode to its ID, but got %s", id, decoded)
+		}
+	}
+}
+
+func TestPlaceholderIDs(t *testing.T) {
+	value := "login -u " + Placeholder("user") + " -p " + Placeholder("password") + " && echo " + Placeholder("user")
+	if actual, expected := PlaceholderIDs(value), []string{"user", "password"}; !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %v, but got %v", expected, actual)
+	}
+	if actual := PlaceholderIDs("echo __ACB_SECRET_zz__"); actual != nil {
+		t.Errorf("Expected no IDs, but got %v", actual)
+	}
+}
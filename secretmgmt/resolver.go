@@ -0,0 +1,113 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package secretmgmt
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/Azure/acr-builder/tokenutil"
+	"github.com/Azure/acr-builder/vaults"
+	"github.com/pkg/errors"
+)
+
+const (
+	// KeyVaultScheme is the scheme of secrets resolved from an Azure Key Vault.
+	KeyVaultScheme = "keyvault"
+
+	// MSIScheme is the scheme of secrets resolved to a registry refresh token using a managed identity.
+	MSIScheme = "msi"
+
+	// GoogleScheme is the scheme of secrets resolved to a Google access token using a service account key.
+	GoogleScheme = "google"
+
+	// DeviceCodeScheme is the scheme of secrets resolved to an access token by signing in with the OAuth device code flow.
+	DeviceCodeScheme = "devicecode"
+)
+
+// Resolver resolves secrets of a scheme to their values.
+type Resolver interface {
+	// Resolve returns the value of the secret, or an error if it can't be resolved before ctx is done.
+	Resolve(ctx context.Context, secret *Secret) (string, error)
+}
+
+// ResolverFunc is a function which implements Resolver.
+type ResolverFunc func(ctx context.Context, secret *Secret) (string, error)
+
+// Resolve calls f(ctx, secret).
+func (f ResolverFunc) Resolve(ctx context.Context, secret *Secret) (string, error) {
+	return f(ctx, secret)
+}
+
+var (
+	resolversMu sync.RWMutex
+	resolvers   = map[string]Resolver{
+		KeyVaultScheme:   ResolverFunc(resolveKeyVaultSecret),
+		MSIScheme:        ResolverFunc(resolveMSISecret),
+		GoogleScheme:     ResolverFunc(resolveGoogleSecret),
+		DeviceCodeScheme: ResolverFunc(resolveDeviceCodeSecret),
+	}
+)
+
+// RegisterResolver registers the resolver of secrets whose source has the scheme, e.g. "mystore" for
+// secrets with the source "mystore://path/to/secret". Schemes are case insensitive and each can only be
+// registered once, including the built-in keyvault, msi and google schemes.
+func RegisterResolver(scheme string, resolver Resolver) error {
+	if scheme == "" {
+		return errors.New("the scheme of a secret resolver cannot be empty")
+	}
+	if resolver == nil {
+		return fmt.Errorf("the secret resolver for the scheme '%s' cannot be nil", scheme)
+	}
+	scheme = strings.ToLower(scheme)
+
+	resolversMu.Lock()
+	defer resolversMu.Unlock()
+	if _, ok := resolvers[scheme]; ok {
+		return fmt.Errorf("a secret resolver is already registered for the scheme '%s'", scheme)
+	}
+	resolvers[scheme] = resolver
+	return nil
+}
+
+// resolverFor returns the resolver registered for the secret's scheme.
+func resolverFor(secret *Secret) (Resolver, error) {
+	scheme := secret.Scheme()
+	if scheme == "" {
+		return nil, fmt.Errorf("cannot resolve secret with ID: %s", secret.ID)
+	}
+	resolversMu.RLock()
+	defer resolversMu.RUnlock()
+	resolver, ok := resolvers[scheme]
+	if !ok {
+		return nil, fmt.Errorf("no resolver is registered for the scheme '%s' of secret with ID: %s", scheme, secret.ID)
+	}
+	return resolver, nil
+}
+
+func resolveKeyVaultSecret(ctx context.Context, secret *Secret) (string, error) {
+	secretConfig, err := vaults.NewAKVSecretConfig(secret.KeyVault, secret.MsiClientID)
+	if err != nil {
+		return "", err
+	}
+	return secretConfig.GetValue(ctx)
+}
+
+func resolveMSISecret(ctx context.Context, secret *Secret) (string, error) {
+	return tokenutil.DefaultRegistryTokenCache.GetRegistryRefreshToken(ctx, secret.ID, secret.AadResourceID, secret.MsiClientID)
+}
+
+func resolveGoogleSecret(ctx context.Context, secret *Secret) (string, error) {
+	key, err := tokenutil.LoadServiceAccountKey(secret.ServiceAccountKey)
+	if err != nil {
+		return "", err
+	}
+	return tokenutil.GetGoogleAccessToken(ctx, key)
+}
+
+func resolveDeviceCodeSecret(ctx context.Context, secret *Secret) (string, error) {
+	return tokenutil.GetDeviceCodeToken(ctx, secret.DeviceCode)
+}
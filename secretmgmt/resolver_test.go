@@ -0,0 +1,77 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package secretmgmt
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSecretScheme(t *testing.T) {
+	tests := []struct {
+		secret *Secret
+		scheme string
+	}{
+		{nil, ""},
+		{&Secret{ID: "a"}, ""},
+		{&Secret{ID: "a", KeyVault: "https://myvault.vault.azure.net/secrets/mysecret"}, KeyVaultScheme},
+		{&Secret{ID: "a", AadResourceID: "https://management.azure.com/"}, MSIScheme},
+		{&Secret{ID: "a", ServiceAccountKey: "key.json"}, GoogleScheme},
+		{&Secret{ID: "a", Source: "MyStore://team/secret"}, "mystore"},
+		{&Secret{ID: "a", Source: "team/secret"}, ""},
+	}
+	for _, test := range tests {
+		if scheme := test.secret.Scheme(); scheme != test.scheme {
+			t.Errorf("Expected the scheme of %+v to be %q, but got %q", test.secret, test.scheme, scheme)
+		}
+	}
+
+	if err := (&Secret{ID: "a", Source: "mystore://team/secret"}).Validate(); err != nil {
+		t.Errorf("Expected a secret with a source to be valid, but got %v", err)
+	}
+	if err := (&Secret{ID: "a", Source: "team/secret"}).Validate(); err == nil {
+		t.Error("Expected a source without a scheme to be invalid")
+	}
+}
+
+func TestRegisterResolver(t *testing.T) {
+	resolver := ResolverFunc(func(ctx context.Context, secret *Secret) (string, error) {
+		return "value-of-" + strings.TrimPrefix(secret.Source, "teststore://"), nil
+	})
+
+	if err := RegisterResolver("", resolver); err == nil {
+		t.Error("Expected an error registering an empty scheme")
+	}
+	if err := RegisterResolver("teststore", nil); err == nil {
+		t.Error("Expected an error registering a nil resolver")
+	}
+	if err := RegisterResolver(KeyVaultScheme, resolver); err == nil {
+		t.Error("Expected an error registering a built-in scheme")
+	}
+	if err := RegisterResolver("TestStore", resolver); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := RegisterResolver("teststore", resolver); err == nil {
+		t.Error("Expected an error registering a scheme twice")
+	}
+
+	secretResolver, err := NewSecretResolver(nil, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create secret resolver. Err: %v", err)
+	}
+	secret := &Secret{ID: "custom", Source: "teststore://team/secret"}
+	if err := secretResolver.ResolveSecrets(context.Background(), []*Secret{secret}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if secret.ResolvedValue != "value-of-team/secret" {
+		t.Errorf("Expected the secret to be resolved by the registered resolver, but got %q", secret.ResolvedValue)
+	}
+
+	err = secretResolver.ResolveSecrets(context.Background(), []*Secret{{ID: "unknown", Source: "otherstore://secret"}})
+	if err == nil || !strings.Contains(err.Error(), "no resolver is registered for the scheme 'otherstore'") {
+		t.Errorf("Expected an error for an unregistered scheme, but got %v", err)
+	}
+}
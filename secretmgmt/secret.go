@@ -4,13 +4,17 @@
 package secretmgmt
 
 import (
+	"strings"
+
+	"github.com/Azure/acr-builder/tokenutil"
 	"github.com/Azure/acr-builder/util"
 	"github.com/pkg/errors"
 )
 
 var (
 	errMissingSecretIDs      = errors.New("secret is missing an ID as well as auto-generated ID")
-	errMissingSecretProps    = errors.New("secret should contain either keyvault property for vault secret, or msi clientID/aadResourceId for msi authentication")
+	errMissingSecretProps    = errors.New("secret should contain either keyvault property for vault secret, msi clientID/aadResourceId for msi authentication, or source for a registered resolver")
+	errInvalidSecretSource   = errors.New("secret source must be in the format of scheme://identifier")
 	errSecretIDContainsSpace = errors.New("secret ID cannot contain spaces")
 	errInvalidUUID           = errors.New("msi client ID is not a valid guid")
 )
@@ -21,12 +25,21 @@ type Secret struct {
 	KeyVault    string `yaml:"keyvault,omitempty"`
 	MsiClientID string `yaml:"clientID,omitempty"`
 
+	// Source identifies a secret resolved by the Resolver registered for its scheme, in the format of scheme://identifier.
+	Source string `yaml:"source,omitempty"`
+
 	// After the Secret is resolved, the value can be found here.
 	ResolvedValue string
 
 	// AadResourceID is used to fetch ARM token from a TokenServer for an identity
 	AadResourceID string
 
+	// ServiceAccountKey is used to fetch a Google access token, either the JSON key or the path of a file containing it
+	ServiceAccountKey string `yaml:"-"`
+
+	// DeviceCode configures how an access token is acquired by signing in with the OAuth device code flow
+	DeviceCode *tokenutil.DeviceCodeConfig `yaml:"-"`
+
 	// ResolvedChan is used to signal the callers
 	// that the secret has been resolved successfully to a value.
 	ResolvedChan chan bool
@@ -48,9 +61,12 @@ func (s *Secret) Validate() error {
 	if util.ContainsSpace(s.ID) {
 		return errSecretIDContainsSpace
 	}
-	if !s.IsKeyVaultSecret() && !s.IsMsiSecret() {
+	if !s.IsKeyVaultSecret() && !s.IsMsiSecret() && s.Source == "" {
 		return errMissingSecretProps
 	}
+	if s.Source != "" && sourceScheme(s.Source) == "" {
+		return errInvalidSecretSource
+	}
 	if s.MsiClientID != "" && !util.IsValidUUID(s.MsiClientID) {
 		return errInvalidUUID
 	}
@@ -74,6 +90,52 @@ func (s *Secret) IsMsiSecret() bool {
 	return s.AadResourceID != ""
 }
 
+// IsGoogleSecret returns true if a Secret is resolved using a Google service account key, false otherwise.
+func (s *Secret) IsGoogleSecret() bool {
+	if s == nil {
+		return false
+	}
+	return s.ServiceAccountKey != ""
+}
+
+// IsDeviceCodeSecret returns true if a Secret is resolved by signing in with the device code flow, false otherwise.
+func (s *Secret) IsDeviceCodeSecret() bool {
+	if s == nil {
+		return false
+	}
+	return s.DeviceCode != nil
+}
+
+// Scheme returns the scheme of the Resolver which resolves the Secret, i.e. the scheme of its source,
+// or keyvault, msi, google or devicecode for the built-in kinds of secrets. It's empty if the kind isn't known.
+func (s *Secret) Scheme() string {
+	switch {
+	case s == nil:
+		return ""
+	case s.Source != "":
+		return sourceScheme(s.Source)
+	case s.IsKeyVaultSecret():
+		return KeyVaultScheme
+	case s.IsMsiSecret():
+		return MSIScheme
+	case s.IsGoogleSecret():
+		return GoogleScheme
+	case s.IsDeviceCodeSecret():
+		return DeviceCodeScheme
+	default:
+		return ""
+	}
+}
+
+// sourceScheme returns the lowercase scheme of the source, empty if it doesn't have one.
+func sourceScheme(source string) string {
+	i := strings.Index(source, "://")
+	if i <= 0 {
+		return ""
+	}
+	return strings.ToLower(source[:i])
+}
+
 // Equals determines whether or not two secrets are equal.
 func (s *Secret) Equals(t *Secret) bool {
 	if s == nil && t == nil {
@@ -86,5 +148,9 @@ func (s *Secret) Equals(t *Secret) bool {
 	return s.ID == t.ID &&
 		s.KeyVault == t.KeyVault &&
 		s.MsiClientID == t.MsiClientID &&
-		s.AadResourceID == t.AadResourceID
+		s.Source == t.Source &&
+		s.AadResourceID == t.AadResourceID &&
+		s.ServiceAccountKey == t.ServiceAccountKey &&
+		(s.DeviceCode == nil) == (t.DeviceCode == nil) &&
+		(s.DeviceCode == nil || *s.DeviceCode == *t.DeviceCode)
 }
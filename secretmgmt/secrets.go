@@ -5,11 +5,8 @@ package secretmgmt
 
 import (
 	"context"
-	"fmt"
 	"time"
 
-	"github.com/Azure/acr-builder/tokenutil"
-	"github.com/Azure/acr-builder/vaults"
 	"github.com/pkg/errors"
 )
 
@@ -93,38 +90,23 @@ func (secretResolver *SecretResolver) ResolveSecrets(ctx context.Context, secret
 	return nil
 }
 
+// resolveSecret resolves the secret using the Resolver registered for its scheme.
 func resolveSecret(ctx context.Context, secret *Secret, errorChan chan error) {
 	if secret == nil {
 		errorChan <- errors.New("secret cannot be nil")
 		return
 	}
 
-	if secret.IsKeyVaultSecret() {
-		secretConfig, err := vaults.NewAKVSecretConfig(secret.KeyVault, secret.MsiClientID)
-		if err != nil {
-			errorChan <- err
-			return
-		}
-
-		secretValue, err := secretConfig.GetValue(ctx)
-		if err != nil {
-			errorChan <- err
-			return
-		}
-
-		secret.ResolvedValue = secretValue
-		secret.ResolvedChan <- true
+	resolver, err := resolverFor(secret)
+	if err != nil {
+		errorChan <- err
 		return
-	} else if secret.IsMsiSecret() {
-		secretValue, err := tokenutil.GetRegistryRefreshToken(secret.ID, secret.AadResourceID, secret.MsiClientID)
-		if err != nil {
-			errorChan <- err
-			return
-		}
-		secret.ResolvedValue = secretValue
-		secret.ResolvedChan <- true
+	}
+	secretValue, err := resolver.Resolve(ctx, secret)
+	if err != nil {
+		errorChan <- err
 		return
 	}
-
-	errorChan <- fmt.Errorf("cannot resolve secret with ID: %s", secret.ID)
+	secret.ResolvedValue = secretValue
+	secret.ResolvedChan <- true
 }
@@ -75,6 +75,10 @@ type BaseRenderOptions struct {
 	// SecretResolveTimeout is the timeout for resolving a secret during rendering.
 	SecretResolveTimeout time.Duration
 
+	// LazySecrets renders a placeholder in place of each secret's value instead of resolving the secrets,
+	// so they can be resolved by a secretmgmt.LazySecretResolver once a step using them runs.
+	LazySecrets bool
+
 	// TaskName is the name of the Task executing this run
 	TaskName string
 }
@@ -95,6 +99,8 @@ func OverrideValuesWithBuildInfo(c1 *Config, c2 *Config, opts *BaseRenderOptions
 			"Registry":     opts.Registry,
 			"RegistryName": parseRegistryName(opts.Registry),
 			"Date":         opts.Date.Format("20060102-150405z"), // yyyyMMdd-HHmmssz
+			"Time":         opts.Date,
+			"Timestamp":    opts.Date.Format(time.RFC3339),
 			"SharedVolume": opts.SharedVolume,
 			"OS":           opts.OS,
 			"OSVersion":    opts.OSVersion,
@@ -256,6 +262,13 @@ func renderAndResolveSecrets(
 		return result, nil
 	}
 
+	if opts.LazySecrets {
+		for _, s := range task.Secrets {
+			result[s.ID] = secretmgmt.Placeholder(s.ID)
+		}
+		return result, nil
+	}
+
 	secretResolver, err := secretmgmt.NewSecretResolver(resolveSecretFunc, opts.SecretResolveTimeout)
 	if err != nil {
 		return result, errors.Wrap(err, "failed to create secret resolver")
@@ -6,9 +6,11 @@ package templating
 import (
 	"context"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/Azure/acr-builder/graph"
 	"github.com/Azure/acr-builder/secretmgmt"
 	"github.com/pkg/errors"
 )
@@ -137,6 +139,31 @@ func TestLoadAndRenderSteps(t *testing.T) {
 	}
 }
 
+func TestLoadAndRenderSteps_ConditionalBaseImage(t *testing.T) {
+	task := []byte(`steps:
+  - build: -t app --build-arg BASE={{ if eq .Values.config "debug" }}{{ .Values.debugBase }}{{ else }}{{ .Values.releaseBase }}{{ end }} .`)
+	tests := []struct {
+		config   string
+		expected string
+	}{
+		{"debug", "--build-arg BASE=golang:1.18 ."},
+		{"release", "--build-arg BASE=gcr.io/distroless/static:nonroot ."},
+	}
+
+	for _, test := range tests {
+		opts := &BaseRenderOptions{
+			TemplateValues: []string{"config=" + test.config, "debugBase=golang:1.18", "releaseBase=gcr.io/distroless/static:nonroot"},
+		}
+		actual, err := LoadAndRenderSteps(context.Background(), NewTemplate("task", task), opts)
+		if err != nil {
+			t.Fatalf("Unexpected err: %v", err)
+		}
+		if !strings.HasSuffix(actual, test.expected) {
+			t.Errorf("Expected the %s build to end with %s, but got %s", test.config, test.expected, actual)
+		}
+	}
+}
+
 func TestLoadAndRenderBuildSteps(t *testing.T) {
 	opts := &BaseRenderOptions{
 		ValuesFile: "",
@@ -282,3 +309,80 @@ steps:
 
 	}
 }
+
+func TestRenderAndResolveSecrets_Lazy(t *testing.T) {
+	renderOpts := &BaseRenderOptions{
+		SecretResolveTimeout: time.Minute * 5,
+		LazySecrets:          true,
+	}
+	template := NewTemplate("job1", []byte(`
+secrets:
+  - id: mysecret
+    keyvault: https://myvault.vault.azure.net/secrets/mysecret
+steps:
+  - cmd: bash echo {{.Secrets.mysecret}}`))
+	resolveSecret := func(ctx context.Context, secret *secretmgmt.Secret, errorChan chan error) {
+		errorChan <- fmt.Errorf("expected secret %s not to be resolved", secret.ID)
+	}
+	secrets, err := renderAndResolveSecrets(context.Background(), template, NewEngine(), resolveSecret, renderOpts, Values{})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := secretmgmt.Placeholder("mysecret"); len(secrets) != 1 || secrets["mysecret"] != expected {
+		t.Errorf("Expected the placeholder %s for mysecret, but got %v", expected, secrets)
+	}
+}
+
+func TestLoadAndRenderSteps_LazySecretEncoded(t *testing.T) {
+	renderOpts := &BaseRenderOptions{
+		SecretResolveTimeout: time.Minute * 5,
+		LazySecrets:          true,
+	}
+	template := NewTemplate("job1", []byte(`
+secrets:
+  - id: mysecret
+    keyvault: https://myvault.vault.azure.net/secrets/mysecret
+steps:
+  - cmd: bash echo {{.Secrets.mysecret | b64enc}}`))
+	_, err := LoadAndRenderSteps(context.Background(), template, renderOpts)
+	if err == nil || !strings.Contains(err.Error(), "b64enc can't encode secrets which are resolved lazily") {
+		t.Errorf("Expected an error encoding the lazily resolved secret, but got %v", err)
+	}
+
+	// Values which aren't secrets are still encoded.
+	if rendered, err := NewEngine().RenderGoTemplate("t", "{{b64enc .}}", "value"); err != nil || rendered != "dmFsdWU=" {
+		t.Errorf("Expected the value to be encoded, but got %s (%v)", rendered, err)
+	}
+}
+
+func TestLoadAndRenderSteps_LazySecretReferences(t *testing.T) {
+	renderOpts := &BaseRenderOptions{
+		TemplateValues:       []string{"vault=myvault", "secret=mysecret"},
+		SecretResolveTimeout: time.Minute * 5,
+		LazySecrets:          true,
+	}
+	template := NewTemplate("job1", []byte(`
+secrets:
+  - id: {{.Values.secret}}
+    keyvault: https://{{.Values.vault}}.vault.azure.net/secrets/{{.Values.secret}}
+steps:
+  - id: echo
+    cmd: bash echo {{.Secrets.mysecret}}`))
+	rendered, err := LoadAndRenderSteps(context.Background(), template, renderOpts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	task, err := graph.NewTaskFromString(rendered)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	references, err := graph.SecretReferences(task, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// The templated identifier of the secret is reported as rendered.
+	expected := "mysecret keyvault https://myvault.vault.azure.net/secrets/mysecret (steps: echo)"
+	if len(references) != 1 || references[0].String() != expected {
+		t.Errorf("Expected the reference %s, but got %v", expected, references)
+	}
+}
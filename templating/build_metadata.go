@@ -0,0 +1,87 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package templating
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// buildIDTimeFormat formats the time of a generated build ID, so IDs generated later sort after earlier ones.
+	buildIDTimeFormat = "20060102150405"
+
+	// detachedHead is the branch git reports when a commit rather than a branch is checked out.
+	detachedHead = "HEAD"
+)
+
+// NewBuildID generates a unique build ID for a run at t, the UTC time of the run followed by a random suffix,
+// e.g. 20200102150405-3f2a9c1d, so the IDs of later runs sort after the IDs of earlier ones.
+func NewBuildID(t time.Time) string {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		// Fall back to the time's nanoseconds, which are unique enough for a single host.
+		return fmt.Sprintf("%s-%09d", t.UTC().Format(buildIDTimeFormat), t.Nanosecond())
+	}
+	return t.UTC().Format(buildIDTimeFormat) + "-" + hex.EncodeToString(suffix)
+}
+
+// PopulateBuildMetadata fills in the metadata of the run which wasn't specified, so the task doesn't need it passed in.
+// The date defaults to the current UTC time and the ID to a build ID generated from it. The commit and branch default
+// to the HEAD of the git repository containing dir, if any. If dir isn't in a git repository, git isn't installed or
+// HEAD is detached, the commit and branch which can't be detected are left empty.
+// The metadata is computed once, so every step of the run renders the same values.
+func (opts *BaseRenderOptions) PopulateBuildMetadata(ctx context.Context, dir string) {
+	if opts.Date.IsZero() {
+		opts.Date = time.Now().UTC()
+	}
+	if opts.ID == "" {
+		opts.ID = NewBuildID(opts.Date)
+	}
+	if opts.Commit == "" {
+		if commit, err := runGit(ctx, dir, "rev-parse", "--verify", "HEAD"); err == nil {
+			opts.Commit = commit
+		} else {
+			util.Debugf("Not detecting the commit of the run: %v\n", err)
+		}
+	}
+	if opts.Branch == "" {
+		if branch, err := runGit(ctx, dir, "rev-parse", "--abbrev-ref", "HEAD"); err == nil && branch != detachedHead {
+			opts.Branch = branch
+		}
+	}
+}
+
+// runGit runs git in dir and returns its trimmed output.
+func runGit(ctx context.Context, dir string, args ...string) (string, error) {
+	output, err := gitOutput(ctx, dir, args...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// gitOutput runs git in dir and returns its output.
+func gitOutput(ctx context.Context, dir string, args ...string) ([]byte, error) {
+	cmd := exec.CommandContext(ctx, "git", args...)
+	cmd.Dir = dir
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, errors.Wrap(err, msg)
+		}
+		return nil, err
+	}
+	return stdout.Bytes(), nil
+}
@@ -0,0 +1,100 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package templating
+
+import (
+	"context"
+	"os/exec"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewBuildID(t *testing.T) {
+	earlier := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	id := NewBuildID(earlier)
+	if !regexp.MustCompile(`^20200102150405-[0-9a-f]{8}$`).MatchString(id) {
+		t.Errorf("Unexpected build ID %s", id)
+	}
+	if other := NewBuildID(earlier); other == id {
+		t.Errorf("Expected build IDs generated at the same time to differ, got %s twice", id)
+	}
+	if later := NewBuildID(earlier.Add(time.Second)); later <= id {
+		t.Errorf("Expected the later build ID %s to sort after %s", later, id)
+	}
+}
+
+func TestPopulateBuildMetadata(t *testing.T) {
+	date := time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)
+	opts := &BaseRenderOptions{ID: "id", Commit: "abc", Branch: "main", Date: date}
+	opts.PopulateBuildMetadata(context.Background(), t.TempDir())
+	if opts.ID != "id" || opts.Commit != "abc" || opts.Branch != "main" || !opts.Date.Equal(date) {
+		t.Errorf("Expected the specified metadata to be kept, but got %+v", opts)
+	}
+
+	// A directory outside of a git repository has no commit or branch.
+	opts = &BaseRenderOptions{}
+	opts.PopulateBuildMetadata(context.Background(), t.TempDir())
+	if opts.Date.IsZero() || opts.Date.Location() != time.UTC {
+		t.Errorf("Expected the date to default to the current UTC time, but got %v", opts.Date)
+	}
+	if !strings.HasPrefix(opts.ID, opts.Date.Format(buildIDTimeFormat)) {
+		t.Errorf("Expected the ID to be generated from the date %v, but got %s", opts.Date, opts.ID)
+	}
+	if opts.Commit != "" || opts.Branch != "" {
+		t.Errorf("Expected no git metadata outside of a repository, but got commit %q and branch %q", opts.Commit, opts.Branch)
+	}
+}
+
+func TestPopulateBuildMetadata_Git(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := t.TempDir()
+	for _, args := range [][]string{
+		{"init", "-q"},
+		{"checkout", "-q", "-b", "feature"},
+		{"-c", "user.name=acb", "-c", "user.email=acb@example.com", "commit", "-q", "--allow-empty", "-m", "initial"},
+	} {
+		if _, err := runGit(context.Background(), dir, args...); err != nil {
+			t.Fatalf("Failed to run git %v: %v", args, err)
+		}
+	}
+	commit, err := runGit(context.Background(), dir, "rev-parse", "HEAD")
+	if err != nil {
+		t.Fatalf("Failed to get the commit: %v", err)
+	}
+
+	opts := &BaseRenderOptions{}
+	opts.PopulateBuildMetadata(context.Background(), dir)
+	if opts.Commit != commit || opts.Branch != "feature" {
+		t.Errorf("Expected commit %s on branch feature, but got commit %q and branch %q", commit, opts.Commit, opts.Branch)
+	}
+
+	// A detached HEAD has a commit but no branch.
+	if _, err := runGit(context.Background(), dir, "checkout", "-q", "--detach"); err != nil {
+		t.Fatalf("Failed to detach HEAD: %v", err)
+	}
+	opts = &BaseRenderOptions{}
+	opts.PopulateBuildMetadata(context.Background(), dir)
+	if opts.Commit != commit || opts.Branch != "" {
+		t.Errorf("Expected commit %s without a branch, but got commit %q and branch %q", commit, opts.Commit, opts.Branch)
+	}
+}
+
+func TestOverrideValuesWithBuildInfo_Time(t *testing.T) {
+	opts := &BaseRenderOptions{Date: time.Date(2020, 1, 2, 15, 4, 5, 0, time.UTC)}
+	vals, err := OverrideValuesWithBuildInfo(&Config{}, &Config{}, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	rendered, err := NewEngine().Render(NewTemplate("time", []byte(`{{.Run.Timestamp}} {{.Run.Time | date "2006-01-02"}} {{.Run.Time.Format "15:04"}}`)), vals)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if expected := "2020-01-02T15:04:05Z 2020-01-02 15:04"; rendered != expected {
+		t.Errorf("Expected %q but got %q", expected, rendered)
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package templating
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/pkg/errors"
+)
+
+const (
+	// BundleVersion is the version of the bundle layout.
+	BundleVersion = "v1"
+
+	bundleTemplateName = "bundle"
+)
+
+// Bundle is a single JSON document which carries a task, the values it's rendered with and the
+// registry credentials it runs with, so they can be delivered together instead of through separate flags.
+type Bundle struct {
+	// Version is the version of the bundle layout, which must be BundleVersion.
+	Version string `json:"version"`
+
+	// Task is the task file.
+	Task string `json:"task"`
+
+	// Values is the values file, if any.
+	Values string `json:"values,omitempty"`
+
+	// Credentials are the registry credentials, in the same format as the --credential flag.
+	Credentials []*graph.RegistryCredential `json:"credentials,omitempty"`
+}
+
+// LoadBundle loads a Bundle from the specified path, or from stdin if the path is StdinPath, and validates it.
+func LoadBundle(path string) (*Bundle, error) {
+	var data []byte
+	var err error
+	if path == StdinPath {
+		data, err = ioutil.ReadAll(stdin)
+	} else {
+		data, err = readFile(path)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load bundle at path %s", path)
+	}
+
+	return DecodeBundle(data)
+}
+
+// DecodeBundle decodes a Bundle from its JSON document and validates it.
+func DecodeBundle(data []byte) (*Bundle, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var b Bundle
+	if err := decoder.Decode(&b); err != nil {
+		return nil, errors.Wrap(err, "failed to decode bundle")
+	}
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Encode validates the bundle and encodes it as a JSON document.
+func (b *Bundle) Encode() ([]byte, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(b, "", "  ")
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to encode bundle")
+	}
+	return data, nil
+}
+
+// Validate validates the bundle's version, that it has a task and that each of its credentials is valid.
+func (b *Bundle) Validate() error {
+	if b.Version != BundleVersion {
+		return fmt.Errorf("unsupported bundle version '%s', expected %s", b.Version, BundleVersion)
+	}
+	if len(bytes.TrimSpace([]byte(b.Task))) == 0 {
+		return errors.New("the bundle doesn't contain a task")
+	}
+	if _, err := b.CredentialStrings(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// Template returns the bundle's task as a Template.
+func (b *Bundle) Template() *Template {
+	return NewTemplate(bundleTemplateName, []byte(b.Task))
+}
+
+// EncodedValues returns the bundle's values file Base64 encoded, or an empty string if it has none.
+func (b *Bundle) EncodedValues() string {
+	if b.Values == "" {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString([]byte(b.Values))
+}
+
+// CredentialStrings serializes the bundle's credentials in the format of the --credential flag,
+// validating each of them.
+func (b *Bundle) CredentialStrings() ([]string, error) {
+	creds := make([]string, 0, len(b.Credentials))
+	for i, cred := range b.Credentials {
+		if cred == nil {
+			return nil, fmt.Errorf("credential %d of the bundle is empty", i)
+		}
+		credString, err := cred.String()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := graph.CreateRegistryCredentialFromString(credString); err != nil {
+			return nil, errors.Wrapf(err, "credential %d of the bundle is invalid", i)
+		}
+		creds = append(creds, credString)
+	}
+	return creds, nil
+}
@@ -0,0 +1,121 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package templating
+
+import (
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+)
+
+func TestBundle_RoundTrip(t *testing.T) {
+	expected := &Bundle{
+		Version: BundleVersion,
+		Task:    "steps:\n  - build: -t {{.Values.image}} .\n",
+		Values:  "image: hello-world\n",
+		Credentials: []*graph.RegistryCredential{
+			{Registry: "foo.azurecr.io", Username: "user", UsernameType: graph.Opaque, Password: "secret", PasswordType: graph.Opaque},
+			{Registry: "{{.Run.Registry}}", Identity: "[system]", AadResourceID: "https://management.azure.com/"},
+		},
+	}
+	data, err := expected.Encode()
+	if err != nil {
+		t.Fatalf("Failed to encode the bundle: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "bundle.json")
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		t.Fatalf("Failed to write the bundle: %v", err)
+	}
+	actual, err := LoadBundle(path)
+	if err != nil {
+		t.Fatalf("Failed to load the bundle: %v", err)
+	}
+	if !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("Expected %+v, but got %+v", expected, actual)
+	}
+
+	if string(actual.Template().GetData()) != expected.Task {
+		t.Errorf("Expected the task %q, but got %q", expected.Task, actual.Template().GetData())
+	}
+	config, err := DecodeConfig(actual.EncodedValues())
+	if err != nil {
+		t.Fatalf("Failed to decode the values: %v", err)
+	}
+	if config.GetRawValue() != expected.Values {
+		t.Errorf("Expected the values %q, but got %q", expected.Values, config.GetRawValue())
+	}
+	creds, err := actual.CredentialStrings()
+	if err != nil {
+		t.Fatalf("Failed to serialize the credentials: %v", err)
+	}
+	for i, credString := range creds {
+		cred, err := graph.CreateRegistryCredentialFromString(credString)
+		if err != nil {
+			t.Fatalf("Failed to parse credential %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(cred, expected.Credentials[i]) {
+			t.Errorf("Expected credential %d to be %+v, but got %+v", i, expected.Credentials[i], cred)
+		}
+	}
+}
+
+func TestLoadBundle_Stdin(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(`{"version": "v1", "task": "steps:\n  - cmd: hello-world\n"}`)
+
+	b, err := LoadBundle(StdinPath)
+	if err != nil {
+		t.Fatalf("Failed to load the bundle from stdin: %v", err)
+	}
+	if b.EncodedValues() != "" {
+		t.Errorf("Expected no values, but got %s", b.EncodedValues())
+	}
+	if creds, err := b.CredentialStrings(); err != nil || len(creds) != 0 {
+		t.Errorf("Expected no credentials, but got %v, %v", creds, err)
+	}
+}
+
+func TestDecodeBundle_Invalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"not json", `steps:`},
+		{"missing version", `{"task": "steps: []"}`},
+		{"unsupported version", `{"version": "v2", "task": "steps: []"}`},
+		{"missing task", `{"version": "v1", "values": "image: hello-world"}`},
+		{"blank task", `{"version": "v1", "task": "  \n"}`},
+		{"unknown part", `{"version": "v1", "task": "steps: []", "secrets": "foo"}`},
+		{"empty credential", `{"version": "v1", "task": "steps: []", "credentials": [null]}`},
+		{"credential without registry", `{"version": "v1", "task": "steps: []", "credentials": [{"identity": "[system]"}]}`},
+		{"credential without password", `{"version": "v1", "task": "steps: []", "credentials": [{"registry": "foo.azurecr.io", "username": "user", "userNameProviderType": "opaque", "passwordProviderType": "opaque"}]}`},
+	}
+
+	for _, test := range tests {
+		if _, err := DecodeBundle([]byte(test.data)); err == nil {
+			t.Errorf("Expected an error decoding a bundle with %s", test.name)
+		}
+	}
+
+	if _, err := (&Bundle{Version: BundleVersion}).Encode(); err == nil {
+		t.Error("Expected an error encoding a bundle without a task")
+	}
+	if _, err := LoadBundle(filepath.Join(t.TempDir(), "missing.json")); err == nil {
+		t.Error("Expected an error loading a missing bundle")
+	}
+}
+
+func TestBundle_EncodedValues(t *testing.T) {
+	b := &Bundle{Version: BundleVersion, Task: "steps: []", Values: "a: b"}
+	if expected := base64.StdEncoding.EncodeToString([]byte("a: b")); b.EncodedValues() != expected {
+		t.Errorf("Expected %s, but got %s", expected, b.EncodedValues())
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package templating
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/Azure/acr-builder/graph"
+	"github.com/pkg/errors"
+)
+
+// RenderRegistryCredentials renders the template expressions in the registry, identity and aadResourceId
+// fields of each serialized credential and then creates the credentials, validating them.
+// The username and password are never rendered so that secrets can't leak through rendering errors.
+// If any credential is invalid, the problems with all of them are returned together as graph.CredentialErrors.
+func RenderRegistryCredentials(creds []string, opts *BaseRenderOptions) ([]*graph.RegistryCredential, error) {
+	var credentials []*graph.RegistryCredential
+	var errs graph.CredentialErrors
+	var vals Values
+	engine := NewEngine()
+
+CREDENTIALS:
+	for i, credString := range creds {
+		var cred graph.RegistryCredential
+		if err := json.Unmarshal([]byte(credString), &cred); err != nil {
+			errs = append(errs, graph.NewCredentialError(i, credString, errors.Wrap(err, "unable to unmarshal Credentials from string")))
+			continue
+		}
+
+		for field, value := range map[string]*string{
+			"registry":      &cred.Registry,
+			"identity":      &cred.Identity,
+			"aadResourceId": &cred.AadResourceID,
+		} {
+			if !strings.Contains(*value, "{{") {
+				continue
+			}
+			if vals == nil {
+				var err error
+				if vals, err = loadSteps(NewTemplate("credentials", []byte(credString)), opts); err != nil {
+					return nil, fmt.Errorf("error while loading values for credentials: %v", err)
+				}
+			}
+			rendered, err := engine.Render(NewTemplate(fmt.Sprintf("credential-%d-%s", i, field), []byte(*value)), vals)
+			if err != nil {
+				errs = append(errs, graph.NewCredentialError(i, credString, errors.Wrapf(err, "failed to render the %s", field)))
+				continue CREDENTIALS
+			}
+			*value = rendered
+		}
+
+		renderedString, err := cred.String()
+		if err != nil {
+			return nil, err
+		}
+		renderedCred, err := graph.CreateRegistryCredentialFromString(renderedString)
+		if err != nil {
+			errs = append(errs, graph.NewCredentialError(i, renderedString, err))
+			continue
+		}
+		credentials = append(credentials, renderedCred)
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return credentials, nil
+}
@@ -0,0 +1,102 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package templating
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/Azure/acr-builder/graph"
+)
+
+func TestRenderRegistryCredentials(t *testing.T) {
+	opts := &BaseRenderOptions{
+		TemplateValues: []string{"env=prod", "identity=c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86"},
+		ID:             "testid",
+	}
+	creds := []string{
+		`{"registry":"{{.Values.env}}.azurecr.io","identity":"{{.Values.identity}}","aadResourceId":"https://management.azure.com/"}`,
+		`{"registry":"static.azurecr.io","userNameProviderType":"opaque","username":"user","passwordProviderType":"opaque","password":"{{not-a-template}}"}`,
+	}
+
+	actual, err := RenderRegistryCredentials(creds, opts)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []*graph.RegistryCredential{
+		{Registry: "prod.azurecr.io", Identity: "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86", AadResourceID: "https://management.azure.com/"},
+		{Registry: "static.azurecr.io", Username: "user", UsernameType: graph.Opaque, Password: "{{not-a-template}}", PasswordType: graph.Opaque},
+	}
+	if len(actual) != len(expected) {
+		t.Fatalf("Expected %d credentials, but got %d", len(expected), len(actual))
+	}
+	for i := range expected {
+		if !expected[i].Equals(actual[i]) {
+			t.Errorf("Expected credential %v, but got %v", expected[i], actual[i])
+		}
+	}
+}
+
+func TestRenderRegistryCredentials_Invalid(t *testing.T) {
+	opts := &BaseRenderOptions{}
+	tests := []struct {
+		cred          string
+		expectedError string
+	}{
+		// Rendering to an empty registry fails validation.
+		{`{"registry":"{{.Values.missing}}","identity":"id","aadResourceId":"resource"}`, "registry name can't be empty"},
+		{`{"registry":"{{.Values.env","identity":"id","aadResourceId":"resource","password":"s3cr3t"}`, "credential 0 (registry {{.Values.env): failed to render the registry:"},
+	}
+
+	for _, test := range tests {
+		_, err := RenderRegistryCredentials([]string{test.cred}, opts)
+		if err == nil || !strings.Contains(err.Error(), test.expectedError) {
+			t.Errorf("Expected an error containing %q, but got %v", test.expectedError, err)
+			continue
+		}
+		if strings.Contains(err.Error(), "s3cr3t") {
+			t.Errorf("Expected the error not to contain the password, but got %v", err)
+		}
+	}
+}
+
+func TestRenderRegistryCredentials_AggregatesErrors(t *testing.T) {
+	opts := &BaseRenderOptions{TemplateValues: []string{"env=prod"}}
+	creds := []string{
+		`{"registry":"{{.Values.env}}.azurecr.io","identity":"id","aadResourceId":"resource"}`,
+		`{"registry":"{{.Values.env}}.azurecr.io","userNameProviderType":"opaque","passwordProviderType":"opaque","password":"s3cr3t"}`,
+		`not json`,
+		`{"registry":"{{.Values.env","identity":"id","aadResourceId":"resource"}`,
+	}
+
+	_, err := RenderRegistryCredentials(creds, opts)
+	errs, ok := err.(graph.CredentialErrors)
+	if !ok {
+		t.Fatalf("Expected graph.CredentialErrors, but got %T: %v", err, err)
+	}
+	expected := []struct {
+		index    int
+		registry string
+		message  string
+	}{
+		{1, "prod.azurecr.io", "username can't be empty"},
+		{2, "", "unable to unmarshal Credentials from string"},
+		{3, "{{.Values.env", "credential 3 (registry {{.Values.env): failed to render the registry:"},
+	}
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d problems, but got %d: %v", len(expected), len(errs), err)
+	}
+	for i, e := range expected {
+		if errs[i].Index != e.index || errs[i].Registry != e.registry || !strings.Contains(errs[i].Error(), e.message) {
+			t.Errorf("Expected problem %d to be for credential %d of registry %q containing %q, but got %v", i, e.index, e.registry, e.message, errs[i])
+		}
+	}
+	// The index of each credential is only reported once.
+	if strings.Count(err.Error(), "credential 3") != 1 {
+		t.Errorf("Expected the index of the credential to be reported once, but got %v", err)
+	}
+	if strings.Contains(err.Error(), "s3cr3t") {
+		t.Errorf("Expected the errors not to contain the password, but got %v", err)
+	}
+}
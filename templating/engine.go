@@ -13,6 +13,7 @@ import (
 	"strings"
 	"text/template"
 
+	"github.com/Azure/acr-builder/secretmgmt"
 	"github.com/Masterminds/sprig"
 )
 
@@ -38,11 +39,20 @@ func Base64Encode(v interface{}) string {
 	return base64.StdEncoding.EncodeToString([]byte(reflect.ValueOf(v).String()))
 }
 
+// base64EncodeValue is the b64enc function of templates. It fails to encode the placeholders of lazily resolved
+// secrets, since the placeholders couldn't be replaced by the secrets' values once they're encoded.
+func base64EncodeValue(v interface{}) (string, error) {
+	if v != nil && len(secretmgmt.PlaceholderIDs(reflect.ValueOf(v).String())) > 0 {
+		return "", errors.New("b64enc can't encode secrets which are resolved lazily, resolve them upfront instead")
+	}
+	return Base64Encode(v), nil
+}
+
 // FuncMap returns a FuncMap representing all of the functionality of the engine.
 func FuncMap() template.FuncMap {
 	// We are overriding the b64enc function with custom implementation
 	modMap := sprig.TxtFuncMap()
-	modMap["b64enc"] = Base64Encode
+	modMap["b64enc"] = base64EncodeValue
 	return modMap
 }
 
@@ -4,7 +4,10 @@
 package templating
 
 import (
+	"context"
 	"encoding/base64"
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -14,8 +17,15 @@ import (
 
 const (
 	decodedTemplateName = "decoded"
+	stdinTemplateName   = "stdin"
+
+	// StdinPath is the path which reads a template from stdin.
+	StdinPath = "-"
 )
 
+// stdin is where templates with the StdinPath are read from.
+var stdin io.Reader = os.Stdin
+
 // LoadConfig creates a Config from the specified path.
 func LoadConfig(path string) (*Config, error) {
 	data, err := readFile(path)
@@ -35,8 +45,16 @@ func DecodeConfig(encoded string) (*Config, error) {
 	return &Config{RawValue: string(decoded)}, nil
 }
 
-// LoadTemplate loads a Template from the specified path.
+// LoadTemplate loads a Template from the specified path, or from stdin if the path is StdinPath.
 func LoadTemplate(path string) (*Template, error) {
+	if path == StdinPath {
+		data, err := ioutil.ReadAll(stdin)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to load template from stdin")
+		}
+		return NewTemplate(stdinTemplateName, data), nil
+	}
+
 	data, err := readFile(path)
 	if err != nil {
 		return nil, errors.Wrapf(err, "failed to load template at path %s", path)
@@ -45,6 +63,20 @@ func LoadTemplate(path string) (*Template, error) {
 	return NewTemplate(path, data), nil
 }
 
+// LoadTemplateAtRevision loads a Template from the specified path, relative to dir, as of a revision
+// of the git repository containing dir, e.g. HEAD~1 or a branch.
+func LoadTemplateAtRevision(ctx context.Context, dir string, revision string, path string) (*Template, error) {
+	if filepath.IsAbs(path) {
+		return nil, fmt.Errorf("failed to load template at path %s as of revision %s, the path must be relative", path, revision)
+	}
+	// git resolves paths starting with ./ relative to dir rather than the root of the repository.
+	data, err := gitOutput(ctx, dir, "show", revision+":./"+filepath.ToSlash(filepath.Clean(path)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to load template at path %s as of revision %s", path, revision)
+	}
+	return NewTemplate(revision+":"+path, data), nil
+}
+
 // DecodeTemplate loads a Template from a Base64 encoded string.
 func DecodeTemplate(encoded string) (*Template, error) {
 	decoded, err := base64.StdEncoding.DecodeString(encoded)
@@ -4,6 +4,12 @@
 package templating
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"testing"
@@ -95,6 +101,22 @@ func TestLoadTemplate(t *testing.T) {
 	}
 }
 
+func TestLoadTemplate_Stdin(t *testing.T) {
+	defer func(r io.Reader) { stdin = r }(stdin)
+	stdin = strings.NewReader(expectedTemplate)
+
+	template, err := LoadTemplate(StdinPath)
+	if err != nil {
+		t.Fatalf("failed to load template from stdin. Err: %v", err)
+	}
+	if actual := string(template.GetData()); expectedTemplate != actual {
+		t.Fatalf("expected \n'%s'\n as the data but got \n'%s'\n", expectedTemplate, actual)
+	}
+	if template.GetName() != stdinTemplateName {
+		t.Fatalf("expected %s as the template's name but got %s", stdinTemplateName, template.GetName())
+	}
+}
+
 func TestLoadTemplate_Invalid(t *testing.T) {
 	_, err := LoadTemplate("")
 	if err == nil {
@@ -102,6 +124,54 @@ func TestLoadTemplate_Invalid(t *testing.T) {
 	}
 }
 
+func TestLoadTemplateAtRevision(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "tasks"), 0755); err != nil {
+		t.Fatalf("failed to create the tasks directory. Err: %v", err)
+	}
+	path := filepath.Join(dir, "tasks", "acb.yaml")
+	commit := func(content string) {
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatalf("failed to write the task. Err: %v", err)
+		}
+		for _, args := range [][]string{
+			{"add", "-A"},
+			{"-c", "user.name=acb", "-c", "user.email=acb@example.com", "commit", "-q", "-m", content},
+		} {
+			if _, err := runGit(context.Background(), dir, args...); err != nil {
+				t.Fatalf("failed to run git %v. Err: %v", args, err)
+			}
+		}
+	}
+	if _, err := runGit(context.Background(), dir, "init", "-q"); err != nil {
+		t.Fatalf("failed to initialize the repository. Err: %v", err)
+	}
+	commit("steps:\n  - cmd: v1")
+	commit("steps:\n  - cmd: v2")
+
+	// The path is relative to dir, rather than the root of the repository.
+	template, err := LoadTemplateAtRevision(context.Background(), filepath.Join(dir, "tasks"), "HEAD~1", "acb.yaml")
+	if err != nil {
+		t.Fatalf("failed to load the template as of HEAD~1. Err: %v", err)
+	}
+	if expected, actual := "steps:\n  - cmd: v1", string(template.GetData()); expected != actual {
+		t.Errorf("expected \n'%s'\n as the data but got \n'%s'\n", expected, actual)
+	}
+	if expectedName := "HEAD~1:acb.yaml"; template.GetName() != expectedName {
+		t.Errorf("expected %s as the template's name but got %s", expectedName, template.GetName())
+	}
+
+	if _, err := LoadTemplateAtRevision(context.Background(), dir, "HEAD", "missing.yaml"); err == nil {
+		t.Error("expected to fail loading a template which doesn't exist at the revision")
+	}
+	if _, err := LoadTemplateAtRevision(context.Background(), dir, "HEAD", path); err == nil {
+		t.Error("expected to fail loading a template at an absolute path")
+	}
+}
+
 func TestDecodeTemplate(t *testing.T) {
 	enc := "YXBpTmFtZTogInt7LlZhbHVlcy5hcGlOYW1lfX0iCgptZXRhZGF0YToKICAtIGJ1aWxkSWQ6ICJ7ey5SdW4uSUQgfCB1cHBlcn19IgogICAgY29tbWl0OiAie3suUnVuLkNvbW1pdCB8IGxvd2VyfX0iCiAgICB0YWc6ICJ7ey5SdW4uVGFnfX0iCiAgICByZXBvc2l0b3J5OiAie3suUnVuLlJlcG9zaXRvcnl9fSIKICAgIGJyYW5jaDogInt7LlJ1bi5CcmFuY2h9fSIKICAgIHRyaWdnZXJlZEJ5OiAie3suUnVuLlRyaWdnZXJlZEJ5fX0i"
 	template, err := DecodeTemplate(enc)
@@ -143,6 +143,7 @@ func TestOverrideValuesWithBuildInfo(t *testing.T) {
 	}
 
 	expectedTime := "20100520-131422z"
+	expectedTimestamp := "2010-05-20T13:14:22Z"
 
 	options := &BaseRenderOptions{
 		ID:           expectedID,
@@ -176,6 +177,8 @@ func TestOverrideValuesWithBuildInfo(t *testing.T) {
 		{"{{.Run.RegistryName}}", expectedRegistryName},
 		{"{{.Run.GitTag}}", expectedGitTag},
 		{"{{.Run.Date}}", expectedTime},
+		{"{{.Run.Timestamp}}", expectedTimestamp},
+		{`{{.Run.Time.Format "2006-01-02"}}`, "2010-05-20"},
 		{"{{.Run.SharedVolume}}", expectedSharedVolume},
 		{"{{.Run.OS}}", expectedOS},
 		{"{{.Run.OSVersion}}", expectedOSVersion},
@@ -205,6 +208,8 @@ func TestOverrideValuesWithBuildInfo(t *testing.T) {
 			"\",\"Repository\":\"" + expectedRepository +
 			"\",\"SharedVolume\":\"" + expectedSharedVolume +
 			"\",\"TaskName\":\"" + expectedTaskName +
+			"\",\"Time\":\"" + expectedTimestamp +
+			"\",\"Timestamp\":\"" + expectedTimestamp +
 			"\",\"TriggeredBy\":\"" + expectedTriggeredBy + "\"}'"},
 	}
 	for _, test := range tests {
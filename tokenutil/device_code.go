@@ -0,0 +1,325 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package tokenutil
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Azure/acr-builder/util"
+	"github.com/pkg/errors"
+)
+
+const (
+	// DeviceCodeTimeout is how long resolving a device code credential may take, including the time the user
+	// takes to sign in, unless the authorization server's device code expires sooner.
+	DeviceCodeTimeout = 15 * time.Minute
+
+	// envDeviceCodeCache is the environment variable overriding the path of the file caching device code tokens.
+	envDeviceCodeCache = "ACB_DEVICE_CODE_CACHE"
+
+	deviceCodeGrantType   = "urn:ietf:params:oauth:grant-type:device_code"
+	refreshTokenGrantType = "refresh_token"
+)
+
+var (
+	// defaultDeviceCodeInterval is how often the token endpoint is polled if the authorization server doesn't
+	// specify an interval, and deviceCodeSlowDown how much the interval grows when it asks to slow down.
+	defaultDeviceCodeInterval = 5 * time.Second
+	deviceCodeSlowDown        = 5 * time.Second
+
+	// deviceCodePrompt is where the user is told how to sign in.
+	deviceCodePrompt io.Writer = os.Stderr
+
+	// isInteractive determines whether acb runs in a terminal a user can sign in from, overridden by tests.
+	isInteractive = isTerminal
+
+	// deviceCodeMu serializes device code sign-ins, so the prompts of several credentials don't interleave
+	// and each can be cached once the other completes.
+	deviceCodeMu sync.Mutex
+)
+
+// DeviceCodeConfig configures how a token is acquired with the OAuth 2.0 device authorization grant, RFC 8628,
+// in which the user signs in from another device by entering a code at a verification URL.
+type DeviceCodeConfig struct {
+	// ClientID is the OAuth client acb signs in as.
+	ClientID string
+
+	// DeviceAuthorizationEndpoint is the URL which device codes are requested from.
+	DeviceAuthorizationEndpoint string
+
+	// TokenEndpoint is the URL which tokens are requested from.
+	TokenEndpoint string
+
+	// Scope is the space separated scopes requested, if any.
+	Scope string
+}
+
+// cacheKey identifies the tokens acquired with the config in the cache.
+func (c *DeviceCodeConfig) cacheKey() string {
+	return strings.Join([]string{c.TokenEndpoint, c.ClientID, c.Scope}, " ")
+}
+
+// deviceAuthorizationResponse is the response body from the device authorization endpoint.
+type deviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// oauthTokenResponse is the response body from the token endpoint, either a token or an error.
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	RefreshToken     string `json:"refresh_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// cachedDeviceCodeToken is a token cached on disk for subsequent runs.
+type cachedDeviceCodeToken struct {
+	AccessToken  string    `json:"accessToken"`
+	RefreshToken string    `json:"refreshToken,omitempty"`
+	ExpiresAt    time.Time `json:"expiresAt"`
+}
+
+// GetDeviceCodeToken returns an access token acquired with the device code flow. Tokens are cached on disk,
+// see DeviceCodeCachePath, so subsequent runs reuse the cached token until it expires, after which it's
+// refreshed with its refresh token, if any. Otherwise, the user is prompted on stderr to sign in by entering
+// a code at the verification URL, and the token endpoint is polled until they do. Since that requires a user,
+// it fails right away if acb doesn't run in a terminal, rather than waiting for a sign-in which never happens.
+func GetDeviceCodeToken(ctx context.Context, config *DeviceCodeConfig) (string, error) {
+	deviceCodeMu.Lock()
+	defer deviceCodeMu.Unlock()
+
+	path := DeviceCodeCachePath()
+	cache := loadDeviceCodeCache(path)
+	key := config.cacheKey()
+	if cached, ok := cache[key]; ok {
+		if time.Now().Add(registryTokenRefreshMargin).Before(cached.ExpiresAt) {
+			util.Debugf("Using the cached device code token for %s, which expires at %s\n", config.TokenEndpoint, cached.ExpiresAt.Format(time.RFC3339))
+			return cached.AccessToken, nil
+		}
+		if cached.RefreshToken != "" {
+			token, err := requestDeviceCodeToken(ctx, config, url.Values{
+				"grant_type":    {refreshTokenGrantType},
+				"refresh_token": {cached.RefreshToken},
+				"client_id":     {config.ClientID},
+			})
+			if err == nil && token.Error == "" {
+				if token.RefreshToken == "" {
+					token.RefreshToken = cached.RefreshToken
+				}
+				return cacheDeviceCodeToken(path, cache, key, token), nil
+			}
+			util.Debugf("Failed to refresh the cached device code token for %s, signing in again: %v\n", config.TokenEndpoint, describeTokenError(token, err))
+		}
+	}
+
+	if !isInteractive() {
+		return "", fmt.Errorf("signing in to %s with a device code requires an interactive terminal, but acb isn't running in one; "+
+			"run acb in a terminal once to cache a token, or use another credential", config.TokenEndpoint)
+	}
+	token, err := acquireDeviceCodeToken(ctx, config)
+	if err != nil {
+		return "", err
+	}
+	return cacheDeviceCodeToken(path, cache, key, token), nil
+}
+
+// acquireDeviceCodeToken requests a device code, prompts the user to sign in with it and polls
+// the token endpoint until they do, the device code expires, or ctx is done.
+func acquireDeviceCodeToken(ctx context.Context, config *DeviceCodeConfig) (*oauthTokenResponse, error) {
+	form := url.Values{"client_id": {config.ClientID}}
+	if config.Scope != "" {
+		form.Set("scope", config.Scope)
+	}
+	body, status, err := postForm(ctx, config.DeviceAuthorizationEndpoint, form)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to request a device code")
+	}
+	if status != http.StatusOK {
+		return nil, fmt.Errorf("failed to request a device code, device authorization API response code: %d", status)
+	}
+	var authorization deviceAuthorizationResponse
+	if err := json.Unmarshal(body, &authorization); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the response from the device authorization API")
+	}
+	if authorization.DeviceCode == "" || authorization.UserCode == "" || authorization.VerificationURI == "" {
+		return nil, errors.New("the device authorization API didn't return a device code, user code and verification URL")
+	}
+
+	fmt.Fprintf(deviceCodePrompt, "To sign in, open %s and enter the code %s\n", authorization.VerificationURI, authorization.UserCode)
+	if authorization.VerificationURIComplete != "" {
+		fmt.Fprintf(deviceCodePrompt, "Or open %s, which includes the code\n", authorization.VerificationURIComplete)
+	}
+
+	interval := defaultDeviceCodeInterval
+	if authorization.Interval > 0 {
+		interval = time.Duration(authorization.Interval) * time.Second
+	}
+	expiresIn := DeviceCodeTimeout
+	if authorization.ExpiresIn > 0 {
+		expiresIn = time.Duration(authorization.ExpiresIn) * time.Second
+	}
+	deadline := time.Now().Add(expiresIn)
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, errors.Wrap(ctx.Err(), "timed out waiting for the user to sign in with the device code")
+		case <-time.After(interval):
+		}
+		if time.Now().After(deadline) {
+			return nil, errors.New("the device code expired before the user signed in")
+		}
+		token, err := requestDeviceCodeToken(ctx, config, url.Values{
+			"grant_type":  {deviceCodeGrantType},
+			"device_code": {authorization.DeviceCode},
+			"client_id":   {config.ClientID},
+		})
+		if err != nil {
+			return nil, err
+		}
+		switch token.Error {
+		case "":
+			return token, nil
+		case "authorization_pending":
+		case "slow_down":
+			interval += deviceCodeSlowDown
+		default:
+			return nil, fmt.Errorf("failed to sign in with the device code: %v", describeTokenError(token, nil))
+		}
+	}
+}
+
+// requestDeviceCodeToken requests a token from the token endpoint. A response with an OAuth error, e.g.
+// authorization_pending while the user hasn't signed in yet, is returned with its Error set.
+func requestDeviceCodeToken(ctx context.Context, config *DeviceCodeConfig, form url.Values) (*oauthTokenResponse, error) {
+	body, status, err := postForm(ctx, config.TokenEndpoint, form)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to request a token")
+	}
+	var token oauthTokenResponse
+	if err := json.Unmarshal(body, &token); err != nil {
+		if status != http.StatusOK {
+			return nil, fmt.Errorf("failed to get a token, token API response code: %d", status)
+		}
+		return nil, errors.Wrap(err, "unable to parse the response from the token API")
+	}
+	if token.Error == "" && (status != http.StatusOK || token.AccessToken == "") {
+		return nil, fmt.Errorf("no access token was returned by the token API, response code: %d", status)
+	}
+	return &token, nil
+}
+
+// postForm POSTs the form to the URL and returns the response body and status.
+func postForm(ctx context.Context, endpoint string, form url.Values) ([]byte, int, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, 0, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer response.Body.Close()
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, 0, err
+	}
+	return body, response.StatusCode, nil
+}
+
+// describeTokenError describes why a token couldn't be acquired, either err or the OAuth error of the response.
+func describeTokenError(token *oauthTokenResponse, err error) error {
+	if err != nil || token == nil {
+		return err
+	}
+	if token.ErrorDescription != "" {
+		return fmt.Errorf("%s: %s", token.Error, token.ErrorDescription)
+	}
+	return errors.New(token.Error)
+}
+
+// cacheDeviceCodeToken caches the token under the key and writes the cache to path, returning the access token.
+// Failing to write the cache only means the user signs in again next time, so it's logged rather than returned.
+// The token expires after its expires_in, or its exp claim if it's a JWT, and isn't reused otherwise.
+func cacheDeviceCodeToken(path string, cache map[string]*cachedDeviceCodeToken, key string, token *oauthTokenResponse) string {
+	cached := &cachedDeviceCodeToken{AccessToken: token.AccessToken, RefreshToken: token.RefreshToken}
+	if token.ExpiresIn > 0 {
+		cached.ExpiresAt = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	} else if expiresAt, err := tokenExpiry(token.AccessToken); err == nil {
+		cached.ExpiresAt = expiresAt
+	}
+	cache[key] = cached
+	if err := writeDeviceCodeCache(path, cache); err != nil {
+		util.Infof("Failed to cache the device code token in %s: %v\n", path, err)
+	}
+	return token.AccessToken
+}
+
+// DeviceCodeCachePath returns the path of the file caching device code tokens, which is $ACB_DEVICE_CODE_CACHE
+// if set, and acb/device-code-tokens.json in the user's cache directory otherwise, e.g. ~/.cache on Linux.
+func DeviceCodeCachePath() string {
+	if path := os.Getenv(envDeviceCodeCache); path != "" {
+		return path
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	return filepath.Join(dir, "acb", "device-code-tokens.json")
+}
+
+// loadDeviceCodeCache reads the cached tokens from path. A cache which doesn't exist or can't be read is empty.
+func loadDeviceCodeCache(path string) map[string]*cachedDeviceCodeToken {
+	cache := make(map[string]*cachedDeviceCodeToken)
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return cache
+	}
+	if err := json.Unmarshal(data, &cache); err != nil {
+		util.Debugf("Ignoring the device code token cache %s, which can't be parsed: %v\n", path, err)
+		return make(map[string]*cachedDeviceCodeToken)
+	}
+	return cache
+}
+
+// writeDeviceCodeCache writes the cached tokens to path, which only the user can read.
+func writeDeviceCodeCache(path string, cache map[string]*cachedDeviceCodeToken) error {
+	data, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, data, 0600)
+}
+
+// isTerminal determines whether stdin and stderr are terminals, i.e. a user can see the prompt and sign in.
+func isTerminal() bool {
+	for _, f := range []*os.File{os.Stdin, os.Stderr} {
+		info, err := f.Stat()
+		if err != nil || info.Mode()&os.ModeCharDevice == 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,175 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package tokenutil
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAuthorizationServer is an OAuth server which issues device codes, and tokens once a device code
+// has been polled pendingPolls times, or deniedError if set.
+type fakeAuthorizationServer struct {
+	pendingPolls int
+	deniedError  string
+	polls        int
+	requests     []string
+}
+
+func (s *fakeAuthorizationServer) start(t *testing.T) (*DeviceCodeConfig, func()) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("client_id") != "acb" {
+			t.Errorf("Expected the client ID acb but got %s", r.FormValue("client_id"))
+		}
+		s.requests = append(s.requests, r.URL.Path+" "+r.FormValue("grant_type"))
+		switch r.URL.Path + " " + r.FormValue("grant_type") {
+		case "/device ":
+			if r.FormValue("scope") != "registry" {
+				t.Errorf("Expected the scope registry but got %s", r.FormValue("scope"))
+			}
+			_, _ = w.Write([]byte(`{"device_code":"device-code","user_code":"ABCD-EFGH","verification_uri":"https://login.example.com/device","expires_in":900}`))
+		case "/token " + deviceCodeGrantType:
+			if r.FormValue("device_code") != "device-code" {
+				t.Errorf("Expected the device code device-code but got %s", r.FormValue("device_code"))
+			}
+			s.polls++
+			if s.deniedError != "" {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"` + s.deniedError + `"}`))
+				return
+			}
+			if s.polls <= s.pendingPolls {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte(`{"error":"authorization_pending"}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"access_token":"token","refresh_token":"refresh-token","expires_in":3600}`))
+		case "/token " + refreshTokenGrantType:
+			if r.FormValue("refresh_token") != "refresh-token" {
+				t.Errorf("Expected the refresh token refresh-token but got %s", r.FormValue("refresh_token"))
+			}
+			_, _ = w.Write([]byte(`{"access_token":"refreshed-token","expires_in":3600}`))
+		default:
+			t.Errorf("Unexpected request %s %s", r.URL.Path, r.FormValue("grant_type"))
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	return &DeviceCodeConfig{
+		ClientID:                    "acb",
+		DeviceAuthorizationEndpoint: server.URL + "/device",
+		TokenEndpoint:               server.URL + "/token",
+		Scope:                       "registry",
+	}, server.Close
+}
+
+// setUpDeviceCode points the cache to a temporary file, records the prompt and polls quickly.
+func setUpDeviceCode(t *testing.T, interactive bool) (*bytes.Buffer, string) {
+	path := filepath.Join(t.TempDir(), "acb", "device-code-tokens.json")
+	t.Setenv(envDeviceCodeCache, path)
+	var prompt bytes.Buffer
+	oldPrompt, oldInteractive, oldInterval := deviceCodePrompt, isInteractive, defaultDeviceCodeInterval
+	deviceCodePrompt, isInteractive, defaultDeviceCodeInterval = &prompt, func() bool { return interactive }, time.Millisecond
+	t.Cleanup(func() {
+		deviceCodePrompt, isInteractive, defaultDeviceCodeInterval = oldPrompt, oldInteractive, oldInterval
+	})
+	return &prompt, path
+}
+
+func TestGetDeviceCodeToken(t *testing.T) {
+	prompt, path := setUpDeviceCode(t, true)
+	server := &fakeAuthorizationServer{pendingPolls: 2}
+	config, stop := server.start(t)
+	defer stop()
+
+	token, err := GetDeviceCodeToken(context.Background(), config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if token != "token" {
+		t.Errorf("Expected the token token but got %s", token)
+	}
+	if !strings.Contains(prompt.String(), "open https://login.example.com/device and enter the code ABCD-EFGH") {
+		t.Errorf("Expected the prompt to include the verification URL and code but got %s", prompt.String())
+	}
+	if server.polls != 3 {
+		t.Errorf("Expected the token endpoint to be polled 3 times but got %d", server.polls)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("Expected the token to be cached: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("Expected the cache to only be readable by the user but got %v", info.Mode().Perm())
+	}
+
+	// Subsequent runs use the cached token, even without a terminal.
+	isInteractive = func() bool { return false }
+	requests := len(server.requests)
+	if token, err = GetDeviceCodeToken(context.Background(), config); err != nil || token != "token" {
+		t.Errorf("Expected the cached token but got %s (%v)", token, err)
+	}
+	if len(server.requests) != requests {
+		t.Errorf("Expected no requests for the cached token but got %v", server.requests[requests:])
+	}
+
+	// Expired tokens are refreshed.
+	cache := loadDeviceCodeCache(path)
+	cache[config.cacheKey()].ExpiresAt = time.Now()
+	if err := writeDeviceCodeCache(path, cache); err != nil {
+		t.Fatalf("Failed to write the cache: %v", err)
+	}
+	if token, err = GetDeviceCodeToken(context.Background(), config); err != nil || token != "refreshed-token" {
+		t.Errorf("Expected the refreshed token but got %s (%v)", token, err)
+	}
+	if cached := loadDeviceCodeCache(path)[config.cacheKey()]; cached.RefreshToken != "refresh-token" {
+		t.Errorf("Expected the refresh token to be kept but got %s", cached.RefreshToken)
+	}
+}
+
+func TestGetDeviceCodeToken_NonInteractive(t *testing.T) {
+	prompt, _ := setUpDeviceCode(t, false)
+	server := &fakeAuthorizationServer{}
+	config, stop := server.start(t)
+	defer stop()
+
+	_, err := GetDeviceCodeToken(context.Background(), config)
+	if err == nil || !strings.Contains(err.Error(), "requires an interactive terminal") {
+		t.Errorf("Expected an error saying a terminal is required but got %v", err)
+	}
+	if len(server.requests) != 0 || prompt.Len() != 0 {
+		t.Errorf("Expected no sign-in without a terminal but got the requests %v and prompt %s", server.requests, prompt.String())
+	}
+}
+
+func TestGetDeviceCodeToken_Failures(t *testing.T) {
+	for _, deniedError := range []string{"access_denied", "expired_token"} {
+		setUpDeviceCode(t, true)
+		server := &fakeAuthorizationServer{deniedError: deniedError}
+		config, stop := server.start(t)
+		_, err := GetDeviceCodeToken(context.Background(), config)
+		if err == nil || !strings.Contains(err.Error(), deniedError) {
+			t.Errorf("Expected the error %s but got %v", deniedError, err)
+		}
+		stop()
+	}
+
+	// Signing in is bounded by the context.
+	setUpDeviceCode(t, true)
+	server := &fakeAuthorizationServer{pendingPolls: 1 << 30}
+	config, stop := server.start(t)
+	defer stop()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := GetDeviceCodeToken(ctx, config); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a timeout but got %v", err)
+	}
+}
@@ -0,0 +1,136 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package tokenutil
+
+import (
+	"context"
+	"crypto/rsa"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	// GARUsername is the username to use with a Google access token when logging into Google Artifact Registry.
+	GARUsername = "oauth2accesstoken"
+
+	googleServiceAccountKeyType = "service_account"
+	googleDefaultTokenURI       = "https://oauth2.googleapis.com/token"
+	googleCloudPlatformScope    = "https://www.googleapis.com/auth/cloud-platform"
+	googleJWTBearerGrantType    = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+	googleAssertionLifetime     = time.Hour
+)
+
+// ServiceAccountKey is a Google service account JSON key.
+type ServiceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+
+	signingKey *rsa.PrivateKey
+}
+
+// googleTokenResponse is the response body from Google's OAuth token endpoint
+type googleTokenResponse struct {
+	AccessToken string `json:"access_token"`
+}
+
+// LoadServiceAccountKey loads a Google service account key from either its JSON content or the path of a file containing it.
+func LoadServiceAccountKey(keyOrPath string) (*ServiceAccountKey, error) {
+	data := []byte(keyOrPath)
+	if !strings.HasPrefix(strings.TrimSpace(keyOrPath), "{") {
+		var err error
+		if data, err = ioutil.ReadFile(keyOrPath); err != nil {
+			return nil, errors.Wrap(err, "unable to read the service account key file")
+		}
+	}
+	return ParseServiceAccountKey(data)
+}
+
+// ParseServiceAccountKey parses and validates a Google service account JSON key.
+func ParseServiceAccountKey(data []byte) (*ServiceAccountKey, error) {
+	var key ServiceAccountKey
+	if err := json.Unmarshal(data, &key); err != nil {
+		return nil, errors.Wrap(err, "unable to parse the service account key")
+	}
+	if key.Type != googleServiceAccountKeyType {
+		return nil, fmt.Errorf("invalid service account key type %q, expected %q", key.Type, googleServiceAccountKeyType)
+	}
+	if key.ClientEmail == "" {
+		return nil, errors.New("service account key is missing client_email")
+	}
+	signingKey, err := jwt.ParseRSAPrivateKeyFromPEM([]byte(key.PrivateKey))
+	if err != nil {
+		return nil, errors.Wrap(err, "service account key has an invalid private_key")
+	}
+	key.signingKey = signingKey
+	if key.TokenURI == "" {
+		key.TokenURI = googleDefaultTokenURI
+	}
+	return &key, nil
+}
+
+// GetGoogleAccessToken exchanges a service account key for a Google access token using the JWT bearer flow.
+// Steps mentioned in detail below
+// https://developers.google.com/identity/protocols/oauth2/service-account#authorizingrequests
+func GetGoogleAccessToken(ctx context.Context, key *ServiceAccountKey) (string, error) {
+	now := time.Now()
+	assertion := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":   key.ClientEmail,
+		"scope": googleCloudPlatformScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(googleAssertionLifetime).Unix(),
+	})
+	if key.PrivateKeyID != "" {
+		assertion.Header["kid"] = key.PrivateKeyID
+	}
+	signedAssertion, err := assertion.SignedString(key.signingKey)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to sign the service account assertion")
+	}
+
+	v := url.Values{}
+	v.Set("grant_type", googleJWTBearerGrantType)
+	v.Set("assertion", signedAssertion)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", key.TokenURI, strings.NewReader(v.Encode()))
+	if err != nil {
+		return "", errors.Wrap(err, "unable to create the request to get Google access token")
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	response, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to send the request to get Google access token")
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to get Google access token, token API response code: %s", response.Status)
+	}
+
+	var token googleTokenResponse
+	jsonResponse, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return "", errors.Wrap(err, "unable to read the response from Google token API")
+	}
+	if err := json.Unmarshal(jsonResponse, &token); err != nil {
+		return "", errors.Wrap(err, "unable to parse the response from Google token API")
+	}
+	if token.AccessToken == "" {
+		return "", errors.New("no access token was returned by the Google token API")
+	}
+	return token.AccessToken, nil
+}
@@ -0,0 +1,71 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package tokenutil
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+func TestGetGoogleAccessToken(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate a private key: %v", err)
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if grantType := r.FormValue("grant_type"); grantType != googleJWTBearerGrantType {
+			t.Errorf("Expected grant type %s but got %s", googleJWTBearerGrantType, grantType)
+		}
+		assertion, err := jwt.Parse(r.FormValue("assertion"), func(*jwt.Token) (interface{}, error) {
+			return &privateKey.PublicKey, nil
+		})
+		if err != nil {
+			t.Errorf("Failed to verify the assertion: %v", err)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		claims := assertion.Claims.(jwt.MapClaims)
+		if claims["iss"] != "builder@project.iam.gserviceaccount.com" || claims["scope"] != googleCloudPlatformScope {
+			t.Errorf("Unexpected assertion claims: %v", claims)
+		}
+		if assertion.Header["kid"] != "key-id" {
+			t.Errorf("Expected the key id key-id but got %v", assertion.Header["kid"])
+		}
+		_, _ = w.Write([]byte(`{"access_token":"token","token_type":"Bearer","expires_in":3599}`))
+	}))
+	defer server.Close()
+
+	data, err := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "builder@project.iam.gserviceaccount.com",
+		"private_key_id": "key-id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})),
+		"token_uri":      server.URL,
+	})
+	if err != nil {
+		t.Fatalf("Failed to marshal the service account key: %v", err)
+	}
+	key, err := LoadServiceAccountKey(string(data))
+	if err != nil {
+		t.Fatalf("Failed to load the service account key: %v", err)
+	}
+
+	token, err := GetGoogleAccessToken(context.Background(), key)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if token != "token" {
+		t.Errorf("Expected the access token token but got %s", token)
+	}
+}
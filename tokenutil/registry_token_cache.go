@@ -0,0 +1,122 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package tokenutil
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/Azure/acr-builder/util"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pkg/errors"
+)
+
+// registryTokenRefreshMargin is how long before it expires a cached registry token is refreshed,
+// so a token is never used right as it expires.
+const registryTokenRefreshMargin = 5 * time.Minute
+
+// DefaultRegistryTokenCache is the cache of the registry refresh tokens which MSI credentials are resolved with.
+var DefaultRegistryTokenCache = NewRegistryTokenCache()
+
+// registryTokenKey identifies a registry token by the registry and the identity it was acquired for.
+type registryTokenKey struct {
+	registry   string
+	resourceID string
+	clientID   string
+}
+
+// cachedRegistryToken is a registry token and when it expires. Its mutex is held while the token is
+// acquired, so concurrent callers wait for a single token rather than each acquiring one.
+type cachedRegistryToken struct {
+	mu        sync.Mutex
+	token     string
+	expiresAt time.Time
+}
+
+// RegistryTokenCache caches the ACR refresh tokens acquired with an MSI identity, see GetRegistryRefreshToken,
+// per registry and identity for their lifetime, so resolving a reference doesn't request a token from the MSI
+// endpoint and the registry each time. Tokens are refreshed just before they expire. It's safe for concurrent use.
+type RegistryTokenCache struct {
+	mu     sync.Mutex
+	tokens map[registryTokenKey]*cachedRegistryToken
+
+	// getToken acquires a token, GetRegistryRefreshToken unless overridden by tests.
+	getToken func(ctx context.Context, registry, resourceID, clientID string) (string, error)
+	now      func() time.Time
+}
+
+// NewRegistryTokenCache creates an empty RegistryTokenCache.
+func NewRegistryTokenCache() *RegistryTokenCache {
+	return &RegistryTokenCache{
+		tokens:   make(map[registryTokenKey]*cachedRegistryToken),
+		getToken: GetRegistryRefreshToken,
+		now:      time.Now,
+	}
+}
+
+// GetRegistryRefreshToken returns the cached refresh token of the registry for the identity, acquiring a new one
+// with GetRegistryRefreshToken if none is cached or the cached one expires within registryTokenRefreshMargin.
+// The lifetime of a token is its exp claim, and a token whose expiry can't be parsed isn't cached.
+func (c *RegistryTokenCache) GetRegistryRefreshToken(ctx context.Context, registry, resourceID, clientID string) (string, error) {
+	key := registryTokenKey{registry: registry, resourceID: resourceID, clientID: clientID}
+	c.mu.Lock()
+	cached, ok := c.tokens[key]
+	if !ok {
+		cached = &cachedRegistryToken{}
+		c.tokens[key] = cached
+	}
+	c.mu.Unlock()
+
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+	if cached.token != "" && c.now().Add(registryTokenRefreshMargin).Before(cached.expiresAt) {
+		util.Debugf("Using the cached token for registry %s, which expires at %s\n", registry, cached.expiresAt.Format(time.RFC3339))
+		return cached.token, nil
+	}
+
+	token, err := c.getToken(ctx, registry, resourceID, clientID)
+	if err != nil {
+		return "", err
+	}
+	expiresAt, err := tokenExpiry(token)
+	if err != nil {
+		util.Debugf("Not caching the token for registry %s: %v\n", registry, err)
+		cached.token = ""
+		return token, nil
+	}
+	cached.token, cached.expiresAt = token, expiresAt
+	return token, nil
+}
+
+// Invalidate discards the cached token of the registry for the identity, e.g. after the registry rejected it
+// with a 401, so the next token is acquired anew.
+func (c *RegistryTokenCache) Invalidate(registry, resourceID, clientID string) {
+	key := registryTokenKey{registry: registry, resourceID: resourceID, clientID: clientID}
+	c.mu.Lock()
+	cached, ok := c.tokens[key]
+	c.mu.Unlock()
+	if !ok {
+		return
+	}
+	cached.mu.Lock()
+	defer cached.mu.Unlock()
+	if cached.token != "" {
+		util.Debugf("Invalidated the cached token for registry %s\n", registry)
+	}
+	cached.token = ""
+}
+
+// tokenExpiry returns when the JWT expires, parsing its exp claim without verifying its signature,
+// which the registry does.
+func tokenExpiry(token string) (time.Time, error) {
+	var claims jwt.RegisteredClaims
+	if _, _, err := jwt.NewParser().ParseUnverified(token, &claims); err != nil {
+		return time.Time{}, errors.Wrap(err, "unable to parse the token")
+	}
+	if claims.ExpiresAt == nil {
+		return time.Time{}, errors.New("the token has no expiry")
+	}
+	return claims.ExpiresAt.Time, nil
+}
@@ -0,0 +1,180 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package tokenutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// newRegistryToken returns a registry refresh token which expires at expiresAt.
+func newRegistryToken(t *testing.T, expiresAt time.Time) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(expiresAt)}).SignedString([]byte("secret"))
+	if err != nil {
+		t.Fatalf("Failed to sign the token: %v", err)
+	}
+	return token
+}
+
+// newExchangeServer starts a fake registry exchange API which responds with the token returned by token,
+// and points GetRegistryRefreshToken at it. It returns the registry and the server.
+func newExchangeServer(t *testing.T, token func() string) (string, *httptest.Server) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/oauth2/exchange" || r.FormValue("access_token") != "msi-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"refresh_token":"%s"}`, token())
+	}))
+	scheme := registryExchangeScheme
+	registryExchangeScheme = "http"
+	t.Cleanup(func() { registryExchangeScheme = scheme })
+	return strings.TrimPrefix(server.URL, "http://"), server
+}
+
+func TestRegistryTokenCache_FakeIMDS(t *testing.T) {
+	var msiRequests, exchanges int32
+	msiServer := newMSIServer(t, func() int {
+		atomic.AddInt32(&msiRequests, 1)
+		return http.StatusOK
+	})
+	defer msiServer.Close()
+	expiresAt := time.Now().Add(3 * time.Hour)
+	registry, exchangeServer := newExchangeServer(t, func() string {
+		atomic.AddInt32(&exchanges, 1)
+		return newRegistryToken(t, expiresAt)
+	})
+	defer exchangeServer.Close()
+
+	cache := NewRegistryTokenCache()
+	for i := 0; i < 3; i++ {
+		token, err := cache.GetRegistryRefreshToken(context.Background(), registry, "https://management.azure.com/", "")
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if expiry, err := tokenExpiry(token); err != nil || !expiry.Equal(expiresAt.Truncate(time.Second)) {
+			t.Errorf("Expected a token expiring at %s, but got %s (%v)", expiresAt, expiry, err)
+		}
+	}
+	if msiRequests != 1 || exchanges != 1 {
+		t.Errorf("Expected the token to be acquired once, but got %d MSI requests and %d exchanges", msiRequests, exchanges)
+	}
+
+	// Other identities don't share the token.
+	if _, err := cache.GetRegistryRefreshToken(context.Background(), registry, "https://management.azure.com/", "c72b2df0-b9d8-4ac6-9363-7c1eb06c1c86"); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if exchanges != 2 {
+		t.Errorf("Expected a token to be acquired for another identity, but got %d exchanges", exchanges)
+	}
+}
+
+func TestRegistryTokenCache_Expiry(t *testing.T) {
+	now := time.Now()
+	var acquired int32
+	cache := NewRegistryTokenCache()
+	cache.now = func() time.Time { return now }
+	cache.getToken = func(ctx context.Context, registry, resourceID, clientID string) (string, error) {
+		atomic.AddInt32(&acquired, 1)
+		return newRegistryToken(t, now.Add(time.Hour)), nil
+	}
+
+	tests := []struct {
+		name     string
+		elapsed  time.Duration
+		acquired int32
+	}{
+		{"cached", 0, 1},
+		{"still cached", 30 * time.Minute, 1},
+		{"refreshed just before it expires", time.Hour - registryTokenRefreshMargin + time.Second, 2},
+	}
+	start := now
+	for _, test := range tests {
+		now = start.Add(test.elapsed)
+		if _, err := cache.GetRegistryRefreshToken(context.Background(), "myregistry.azurecr.io", "https://management.azure.com/", ""); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		if acquired != test.acquired {
+			t.Errorf("%s: expected %d tokens to be acquired, but got %d", test.name, test.acquired, acquired)
+		}
+	}
+}
+
+func TestRegistryTokenCache_Invalidate(t *testing.T) {
+	var acquired int32
+	cache := NewRegistryTokenCache()
+	cache.getToken = func(ctx context.Context, registry, resourceID, clientID string) (string, error) {
+		atomic.AddInt32(&acquired, 1)
+		return newRegistryToken(t, time.Now().Add(time.Hour)), nil
+	}
+
+	get := func() {
+		if _, err := cache.GetRegistryRefreshToken(context.Background(), "myregistry.azurecr.io", "https://management.azure.com/", ""); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	get()
+	cache.Invalidate("myregistry.azurecr.io", "https://management.azure.com/", "")
+	cache.Invalidate("other.azurecr.io", "https://management.azure.com/", "")
+	get()
+	get()
+	if acquired != 2 {
+		t.Errorf("Expected a token to be acquired again once invalidated, but got %d", acquired)
+	}
+}
+
+func TestRegistryTokenCache_Concurrent(t *testing.T) {
+	var acquired int32
+	cache := NewRegistryTokenCache()
+	cache.getToken = func(ctx context.Context, registry, resourceID, clientID string) (string, error) {
+		atomic.AddInt32(&acquired, 1)
+		time.Sleep(10 * time.Millisecond)
+		return newRegistryToken(t, time.Now().Add(time.Hour)), nil
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(registry string) {
+			defer wg.Done()
+			if _, err := cache.GetRegistryRefreshToken(context.Background(), registry, "https://management.azure.com/", ""); err != nil {
+				t.Errorf("Unexpected error: %v", err)
+			}
+		}([]string{"myregistry.azurecr.io", "other.azurecr.io"}[i%2])
+	}
+	wg.Wait()
+	// Concurrent callers wait for the token being acquired for their registry instead of acquiring their own.
+	if acquired != 2 {
+		t.Errorf("Expected a single token to be acquired per registry, but got %d", acquired)
+	}
+}
+
+func TestRegistryTokenCache_NoExpiry(t *testing.T) {
+	var acquired int32
+	cache := NewRegistryTokenCache()
+	cache.getToken = func(ctx context.Context, registry, resourceID, clientID string) (string, error) {
+		atomic.AddInt32(&acquired, 1)
+		return "opaque-token", nil
+	}
+
+	for i := 0; i < 2; i++ {
+		token, err := cache.GetRegistryRefreshToken(context.Background(), "myregistry.azurecr.io", "https://management.azure.com/", "")
+		if err != nil || token != "opaque-token" {
+			t.Fatalf("Expected the token to be returned, but got %s (%v)", token, err)
+		}
+	}
+	if acquired != 2 {
+		t.Errorf("Expected a token whose expiry can't be parsed not to be cached, but got %d acquisitions", acquired)
+	}
+}
@@ -1,6 +1,7 @@
 package tokenutil
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/Azure/acr-builder/util"
 	"github.com/Azure/go-autorest/autorest"
 	"github.com/Azure/go-autorest/autorest/adal"
 	"github.com/Azure/go-autorest/autorest/azure/auth"
@@ -18,8 +20,14 @@ import (
 const (
 	// environment variable to override the default msi endpoint
 	envMsiEndpoint = "MSI_ENDPOINT"
+
+	// msiTokenMaxAttempts is the maximum number of attempts to acquire a token from the MSI endpoint
+	msiTokenMaxAttempts = 5
 )
 
+// registryExchangeScheme is the scheme the registry's exchange API is called with, only overridden by tests.
+var registryExchangeScheme = "https"
+
 // RegistryRefreshToken is the response body from ACR exchange API
 type RegistryRefreshToken struct {
 	RefreshToken string `json:"refresh_token"`
@@ -31,21 +39,21 @@ type RegistryRefreshToken struct {
 // Authentication: https://github.com/Azure/acr/blob/master/docs/AAD-OAuth.md#authenticating-to-a-registry-with-azure-cli
 // Exchange: https://github.com/Azure/acr/blob/master/docs/AAD-OAuth.md#calling-post-oauth2exchange-to-get-an-acr-refresh-token
 // Note, we don't need to do token challenge part.
-func GetRegistryRefreshToken(registry, resourceID, clientID string) (string, error) {
-	armToken, err := GetRefreshAuthToken(resourceID, clientID)
+func GetRegistryRefreshToken(ctx context.Context, registry, resourceID, clientID string) (string, error) {
+	armToken, err := GetRefreshAuthToken(ctx, resourceID, clientID)
 	if err != nil {
 		return "", errors.Wrap(err, "unable to get ARM token")
 	}
 
 	client := autorest.NewClientWithUserAgent("azure/acr/tasks")
-	exchangeURL := fmt.Sprintf("https://%s/oauth2/exchange", registry)
+	exchangeURL := fmt.Sprintf("%s://%s/oauth2/exchange", registryExchangeScheme, registry)
 
 	v := url.Values{}
 	v.Set("grant_type", "access_token")
 	v.Set("service", registry)
 	v.Set("access_token", armToken.AccessToken)
 
-	req, err := http.NewRequest("POST", exchangeURL, strings.NewReader(v.Encode()))
+	req, err := http.NewRequestWithContext(ctx, "POST", exchangeURL, strings.NewReader(v.Encode()))
 	if err != nil {
 		return "", errors.Wrap(err, "unable to create the request to get ACR refresh token")
 	}
@@ -74,20 +82,48 @@ func GetRegistryRefreshToken(registry, resourceID, clientID string) (string, err
 	return token.RefreshToken, nil
 }
 
-// GetRefreshAuthToken gets and refreshes an Auth token for the resourceID
-func GetRefreshAuthToken(resourceID, clientID string) (*adal.Token, error) {
+// GetRefreshAuthToken gets and refreshes an Auth token for the resourceID.
+// Transient failures to acquire the token from the MSI endpoint, i.e. errors, timeouts, throttling and
+// server errors, are retried with an exponential backoff until ctx is done, while other failures such as
+// 403 Forbidden fail immediately.
+func GetRefreshAuthToken(ctx context.Context, resourceID, clientID string) (*adal.Token, error) {
 	spToken, err := GetServicePrincipalToken(resourceID, clientID)
 	if err != nil {
 		return nil, err
 	}
+	spToken.MaxMSIRefreshAttempts = msiTokenMaxAttempts
+	spToken.SetSender(&msiAttemptLogger{sender: http.DefaultClient, resourceID: resourceID})
+
 	// try refresh
-	if err := spToken.EnsureFresh(); err != nil {
+	if err := spToken.EnsureFreshWithContext(ctx); err != nil {
 		return nil, err
 	}
 	token := spToken.Token()
 	return &token, nil
 }
 
+// msiAttemptLogger logs the outcome of each attempt to get a token from the MSI endpoint.
+// Only the status of the response is logged, never its body since it contains the token.
+type msiAttemptLogger struct {
+	sender     adal.Sender
+	resourceID string
+	attempt    int
+}
+
+// Do implements adal.Sender.
+func (l *msiAttemptLogger) Do(req *http.Request) (*http.Response, error) {
+	l.attempt++
+	resp, err := l.sender.Do(req)
+	if err != nil {
+		util.Infof("Attempt %d of %d to acquire an MSI token for resource %s failed: %v\n", l.attempt, msiTokenMaxAttempts, l.resourceID, err)
+	} else if resp.StatusCode != http.StatusOK {
+		util.Infof("Attempt %d of %d to acquire an MSI token for resource %s failed with status %s\n", l.attempt, msiTokenMaxAttempts, l.resourceID, resp.Status)
+	} else {
+		util.Debugf("Attempt %d to acquire an MSI token for resource %s succeeded\n", l.attempt, l.resourceID)
+	}
+	return resp, err
+}
+
 // GetServicePrincipalToken gets ServicePrincipal token
 // it is based on github.com/Azure/acr-builder/vendor/github.com/Azure/go-autorest/autorest/azure/auth/auth.go and allows overriding the msi endpont using environment variable
 func GetServicePrincipalToken(resourceID, clientID string) (*adal.ServicePrincipalToken, error) {
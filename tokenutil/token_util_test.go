@@ -0,0 +1,91 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package tokenutil
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestGetRefreshAuthToken(t *testing.T) {
+	tests := []struct {
+		name             string
+		statusCodes      []int
+		expectedAttempts int32
+		shouldError      bool
+	}{
+		{"succeeds on the first attempt", []int{http.StatusOK}, 1, false},
+		{"retries transient failures", []int{http.StatusServiceUnavailable, http.StatusOK}, 2, false},
+		{"doesn't retry forbidden", []int{http.StatusForbidden, http.StatusOK}, 1, true},
+		{"doesn't retry bad requests", []int{http.StatusBadRequest, http.StatusOK}, 1, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var attempts int32
+			server := newMSIServer(t, func() int {
+				attempt := atomic.AddInt32(&attempts, 1)
+				return test.statusCodes[attempt-1]
+			})
+			defer server.Close()
+
+			token, err := GetRefreshAuthToken(context.Background(), "https://management.azure.com/", "")
+			if test.shouldError && err == nil {
+				t.Fatalf("Expected an error but got token %v", token)
+			}
+			if !test.shouldError {
+				if err != nil {
+					t.Fatalf("Unexpected err: %v", err)
+				}
+				if token.AccessToken != "msi-token" {
+					t.Errorf("Expected access token msi-token but got %s", token.AccessToken)
+				}
+			}
+			if attempts != test.expectedAttempts {
+				t.Errorf("Expected %d attempts but got %d", test.expectedAttempts, attempts)
+			}
+		})
+	}
+}
+
+func TestGetRefreshAuthToken_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var attempts int32
+	server := newMSIServer(t, func() int {
+		atomic.AddInt32(&attempts, 1)
+		cancel()
+		return http.StatusServiceUnavailable
+	})
+	defer server.Close()
+
+	if _, err := GetRefreshAuthToken(ctx, "https://management.azure.com/", ""); err == nil {
+		t.Fatal("Expected an error after the context was cancelled")
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt but got %d", attempts)
+	}
+}
+
+// newMSIServer starts a fake MSI endpoint which responds with the status code returned by statusCode
+// and points MSI_ENDPOINT at it.
+func newMSIServer(t *testing.T, statusCode func() int) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		code := statusCode()
+		if code != http.StatusOK {
+			w.WriteHeader(code)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"access_token":"msi-token","expires_in":"3600","expires_on":"%d","resource":"https://management.azure.com/","token_type":"Bearer"}`,
+			time.Now().Add(time.Hour).Unix())
+	}))
+	t.Setenv(envMsiEndpoint, server.URL)
+	t.Setenv("MSI_SECRET", "")
+	return server
+}
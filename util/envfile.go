@@ -0,0 +1,92 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package util
+
+import (
+	"bufio"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var envFileKeyRegex = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// ParseEnvFile parses the KEY=VALUE lines of a .env style file into a list of KEY=VALUE assignments,
+// in the order they're declared. Blank lines and lines starting with # are ignored, and a line may
+// start with export. Values may be double quoted, in which case \", \\, \n and \t are unescaped, or
+// single quoted, in which case they're taken literally. Unquoted values are trimmed and end at a #
+// preceded by whitespace.
+func ParseEnvFile(data string) ([]string, error) {
+	var assignments []string
+	scanner := bufio.NewScanner(strings.NewReader(data))
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimPrefix(line, "export "))
+
+		i := strings.Index(line, "=")
+		if i < 0 {
+			return nil, fmt.Errorf("line %d: expected KEY=VALUE", lineNumber)
+		}
+		key := strings.TrimSpace(line[:i])
+		if !envFileKeyRegex.MatchString(key) {
+			return nil, fmt.Errorf("line %d: invalid key '%s'", lineNumber, key)
+		}
+		value, err := parseEnvFileValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNumber, err)
+		}
+		assignments = append(assignments, key+"="+value)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return assignments, nil
+}
+
+// parseEnvFileValue parses the value of an assignment in a .env style file.
+func parseEnvFileValue(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+	switch quote := value[0]; quote {
+	case '\'', '"':
+		var sb strings.Builder
+		for i := 1; i < len(value); i++ {
+			c := value[i]
+			if c == quote {
+				if rest := strings.TrimSpace(value[i+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+					return "", fmt.Errorf("unexpected characters after the closing quote: %s", rest)
+				}
+				return sb.String(), nil
+			}
+			if quote == '"' && c == '\\' && i+1 < len(value) {
+				i++
+				switch value[i] {
+				case 'n':
+					sb.WriteByte('\n')
+				case 't':
+					sb.WriteByte('\t')
+				case '"', '\\':
+					sb.WriteByte(value[i])
+				default:
+					sb.WriteByte('\\')
+					sb.WriteByte(value[i])
+				}
+				continue
+			}
+			sb.WriteByte(c)
+		}
+		return "", fmt.Errorf("missing the closing quote %c", quote)
+	default:
+		for i := 1; i < len(value); i++ {
+			if value[i] == '#' && (value[i-1] == ' ' || value[i-1] == '\t') {
+				return strings.TrimSpace(value[:i]), nil
+			}
+		}
+		return value, nil
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package util
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseEnvFile(t *testing.T) {
+	data := `# Common build args
+NODE_VERSION=18
+export REGISTRY = myregistry.azurecr.io
+
+GREETING="hello \"world\"\n"
+LITERAL='no $expansion \n here'
+COMMENTED=value # trailing comment
+HASH=a#b
+QUOTED_HASH="a # b" # comment
+EMPTY=
+`
+	expected := []string{
+		"NODE_VERSION=18",
+		"REGISTRY=myregistry.azurecr.io",
+		"GREETING=hello \"world\"\n",
+		`LITERAL=no $expansion \n here`,
+		"COMMENTED=value",
+		"HASH=a#b",
+		"QUOTED_HASH=a # b",
+		"EMPTY=",
+	}
+	actual, err := ParseEnvFile(data)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Expected %q but got %q", expected, actual)
+	}
+}
+
+func TestParseEnvFile_Invalid(t *testing.T) {
+	tests := []string{
+		"NOVALUE",
+		"1KEY=value",
+		"KEY WITH SPACE=value",
+		`KEY="unterminated`,
+		`KEY="quoted" trailing`,
+	}
+	for _, test := range tests {
+		if _, err := ParseEnvFile(test); err == nil {
+			t.Errorf("Expected %q to be invalid", test)
+		}
+	}
+}
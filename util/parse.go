@@ -3,11 +3,29 @@
 
 package util
 
-import "strings"
+import (
+	"regexp"
+	"strings"
+)
 
 var buildArgLookup = map[string]bool{"--build-arg": true}
 var tagLookup = map[string]bool{"-t": true, "--tag": true}
 
+// dockerRunBoolFlags are the flags of docker run which don't take a value, so the arg after them isn't skipped.
+var dockerRunBoolFlags = map[string]bool{
+	"-d": true, "--detach": true,
+	"-i": true, "--interactive": true,
+	"-t": true, "--tty": true,
+	"-P": true, "--publish-all": true,
+	"--rm": true, "--privileged": true, "--init": true, "--read-only": true,
+	"--no-healthcheck": true, "--oom-kill-disable": true,
+}
+
+// dockerRunBoolShortFlags are the letters of the short boolean flags of docker run, which can be combined, e.g. -it.
+const dockerRunBoolShortFlags = "ditP"
+
+var envAssignmentRegex = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*=`)
+
 // ParseTags parses tags off a command.
 func ParseTags(cmd string) []string {
 	return parseArgs(cmd, tagLookup)
@@ -18,6 +36,66 @@ func ParseBuildArgs(cmd string) []string {
 	return parseArgs(cmd, buildArgLookup)
 }
 
+// ParseImageName parses the name of the image a command step runs off its command, see ImageNameIndex.
+func ParseImageName(cmd string) string {
+	start, end := ImageNameIndex(cmd)
+	if start < 0 {
+		return ""
+	}
+	return cmd[start:end]
+}
+
+// ImageNameIndex returns the start and end index in a command step's command of the image it runs,
+// or -1 if there's none. The command is appended to docker run's args, so the image is its first
+// argument which isn't a flag of docker run, or the value of one, nor an environment variable
+// assignment, e.g. NAME=value.
+func ImageNameIndex(cmd string) (int, int) {
+	skipValue := false
+	for start := 0; start < len(cmd); {
+		if isSpace(cmd[start]) {
+			start++
+			continue
+		}
+		end := start
+		for end < len(cmd) && !isSpace(cmd[end]) {
+			end++
+		}
+		arg := cmd[start:end]
+		switch {
+		case skipValue:
+			skipValue = false
+		case strings.HasPrefix(arg, "-"):
+			// A flag's value is either part of it, e.g. --env=NAME=value, or the next arg.
+			skipValue = !strings.Contains(arg, "=") && !isDockerRunBoolFlag(arg)
+		case envAssignmentRegex.MatchString(arg):
+		default:
+			return start, end
+		}
+		start = end
+	}
+	return -1, -1
+}
+
+// isDockerRunBoolFlag returns true if the flag of docker run doesn't take a value.
+func isDockerRunBoolFlag(flag string) bool {
+	if dockerRunBoolFlags[flag] {
+		return true
+	}
+	if len(flag) < 2 || strings.HasPrefix(flag, "--") {
+		return false
+	}
+	for _, c := range flag[1:] {
+		if !strings.ContainsRune(dockerRunBoolShortFlags, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
 // parseArgs parses args off the specified command using the specified lookup.
 func parseArgs(cmd string, lookup map[string]bool) []string {
 	fields := strings.Fields(cmd)
@@ -45,3 +45,34 @@ func TestParseBuildArgs(t *testing.T) {
 		}
 	}
 }
+
+func TestParseImageName(t *testing.T) {
+	tests := []struct {
+		cmd      string
+		expected string
+	}{
+		{"bash", "bash"},
+		{"", ""},
+		{"   ", ""},
+		{"bash echo hello world", "bash"},
+		{"foo bar > qux &", "foo"},
+		{"foo    ", "foo"},
+		{"  foo bar", "foo"},
+		{"foo\tbar", "foo"},
+		// The flags of docker run and their values are skipped.
+		{"--rm -it bash echo", "bash"},
+		{"-dit bash", "bash"},
+		{"--network host bash", "bash"},
+		{"--network=host bash", "bash"},
+		{"-e NAME=value --privileged bash", "bash"},
+		{"-v /src:/src:ro -w /src golang go build", "golang"},
+		// So are environment variable assignments.
+		{"NAME=value OTHER=value bash", "bash"},
+		{"--rm", ""},
+	}
+	for _, test := range tests {
+		if actual := ParseImageName(test.cmd); actual != test.expected {
+			t.Errorf("Expected %s but got %s", test.expected, actual)
+		}
+	}
+}
@@ -44,9 +44,11 @@ func hasKnownRegistryPrefix(img string, allKnownRegistries []string) bool {
 }
 
 // NormalizeImageTag adds "latest" to the image if the specified image
-// has no tag and it's not referenced by digest.
+// has no tag and it's not referenced by digest. A port in the registry,
+// e.g. localhost:5000/hello-world, isn't mistaken for a tag.
 func NormalizeImageTag(img string) string {
-	if !strings.Contains(img, "@") && !strings.Contains(img, ":") {
+	name := img[strings.LastIndex(img, "/")+1:]
+	if !strings.Contains(img, "@") && !strings.Contains(name, ":") {
 		return fmt.Sprintf("%s:latest", img)
 	}
 	return img
@@ -110,6 +110,18 @@ func TestNormalizeImageTag(t *testing.T) {
 			img:      "hello-world@123456",
 			expected: "hello-world@123456",
 		},
+		{
+			img:      "localhost:5000/hello-world",
+			expected: "localhost:5000/hello-world:latest",
+		},
+		{
+			img:      "localhost:5000/hello-world:v1",
+			expected: "localhost:5000/hello-world:v1",
+		},
+		{
+			img:      "[::1]:5000/hello-world",
+			expected: "[::1]:5000/hello-world:latest",
+		},
 	}
 	for _, test := range tests {
 		actual := NormalizeImageTag(test.img)
@@ -0,0 +1,72 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package util
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync/atomic"
+)
+
+// Verbosity controls how much is logged.
+type Verbosity int32
+
+const (
+	// VerbosityQuiet only logs warnings, errors and the results of a run.
+	VerbosityQuiet Verbosity = iota
+	// VerbosityNormal additionally logs the progress of a run.
+	VerbosityNormal
+	// VerbosityDebug additionally logs diagnostic details, such as how credentials were classified
+	// and the requests made to registries. Secrets are never logged.
+	VerbosityDebug
+)
+
+var verbosity = int32(VerbosityNormal)
+
+// ParseVerbosity parses quiet, normal or debug into a Verbosity. An empty string is normal.
+func ParseVerbosity(value string) (Verbosity, error) {
+	switch strings.ToLower(value) {
+	case "quiet":
+		return VerbosityQuiet, nil
+	case "", "normal":
+		return VerbosityNormal, nil
+	case "debug":
+		return VerbosityDebug, nil
+	default:
+		return VerbosityNormal, fmt.Errorf("invalid verbosity '%s', expected quiet, normal or debug", value)
+	}
+}
+
+// SetVerbosity sets the verbosity used by Infof and Debugf.
+func SetVerbosity(v Verbosity) {
+	atomic.StoreInt32(&verbosity, int32(v))
+}
+
+// GetVerbosity returns the current verbosity.
+func GetVerbosity() Verbosity {
+	return Verbosity(atomic.LoadInt32(&verbosity))
+}
+
+// Infof logs the progress of a run unless the verbosity is quiet.
+func Infof(format string, v ...interface{}) {
+	if GetVerbosity() >= VerbosityNormal {
+		log.Printf(format, v...)
+	}
+}
+
+// Debugf logs diagnostic details if the verbosity is debug.
+func Debugf(format string, v ...interface{}) {
+	if GetVerbosity() >= VerbosityDebug {
+		log.Printf(format, v...)
+	}
+}
+
+// Redact describes whether a secret is set without revealing it.
+func Redact(secret string) string {
+	if secret == "" {
+		return "<empty>"
+	}
+	return "<redacted>"
+}
@@ -0,0 +1,75 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package util
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestParseVerbosity(t *testing.T) {
+	tests := []struct {
+		value       string
+		expected    Verbosity
+		shouldError bool
+	}{
+		{"", VerbosityNormal, false},
+		{"quiet", VerbosityQuiet, false},
+		{"normal", VerbosityNormal, false},
+		{"DEBUG", VerbosityDebug, false},
+		{"verbose", VerbosityNormal, true},
+	}
+
+	for _, test := range tests {
+		actual, err := ParseVerbosity(test.value)
+		if test.shouldError != (err != nil) {
+			t.Errorf("Expected error: %v for %q but got %v", test.shouldError, test.value, err)
+		}
+		if actual != test.expected {
+			t.Errorf("Expected %v for %q but got %v", test.expected, test.value, actual)
+		}
+	}
+}
+
+func TestInfofAndDebugf(t *testing.T) {
+	defer SetVerbosity(GetVerbosity())
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	tests := []struct {
+		verbosity Verbosity
+		info      bool
+		debug     bool
+	}{
+		{VerbosityQuiet, false, false},
+		{VerbosityNormal, true, false},
+		{VerbosityDebug, true, true},
+	}
+
+	for _, test := range tests {
+		SetVerbosity(test.verbosity)
+		buf.Reset()
+		Infof("info")
+		if logged := bytes.Contains(buf.Bytes(), []byte("info")); logged != test.info {
+			t.Errorf("Expected Infof to log: %v at verbosity %v", test.info, test.verbosity)
+		}
+		buf.Reset()
+		Debugf("debug")
+		if logged := bytes.Contains(buf.Bytes(), []byte("debug")); logged != test.debug {
+			t.Errorf("Expected Debugf to log: %v at verbosity %v", test.debug, test.verbosity)
+		}
+	}
+}
+
+func TestRedact(t *testing.T) {
+	if actual := Redact(""); actual != "<empty>" {
+		t.Errorf("Expected <empty> but got %s", actual)
+	}
+	if actual := Redact("hunter2"); actual != "<redacted>" {
+		t.Errorf("Expected <redacted> but got %s", actual)
+	}
+}
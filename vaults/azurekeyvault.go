@@ -116,7 +116,7 @@ func newKeyVaultClient(vaultURL, clientID, vaultAADResourceURL string) (*keyVaul
 		return nil, err
 	}
 	authorizer := autorest.NewBearerAuthorizer(spToken)
-	keyClient := keyvault.New()
+	keyClient := newBaseClient()
 	keyClient.Authorizer = authorizer
 
 	k := &keyVault{
@@ -127,12 +127,26 @@ func newKeyVaultClient(vaultURL, clientID, vaultAADResourceURL string) (*keyVaul
 	return k, nil
 }
 
-// getSecret retrieves a secret from keyvault
-func (k *keyVault) getSecret(ctx context.Context, secretName, secretVersion string) (string, error) {
-	secretBundle, err := k.client.GetSecret(ctx, k.vaultURL, secretName, secretVersion)
-	if err != nil {
-		return "", err
-	}
+// newBaseClient creates a keyvault client which doesn't retry failed requests itself, since fetches are
+// retried by getSecret, which distinguishes transient failures from permanent ones.
+func newBaseClient() keyvault.BaseClient {
+	client := keyvault.New()
+	client.RetryAttempts = 0
+	client.RetryDuration = 0
+	return client
+}
 
-	return *secretBundle.Value, nil
+// getSecret retrieves a secret from keyvault, retrying if the vault throttles or fails transiently.
+func (k *keyVault) getSecret(ctx context.Context, secretName, secretVersion string) (string, error) {
+	description := fmt.Sprintf("secret %s from vault %s", secretName, k.vaultURL)
+	return getWithRetries(ctx, description, func(ctx context.Context) (string, error) {
+		secretBundle, err := k.client.GetSecret(ctx, k.vaultURL, secretName, secretVersion)
+		if err != nil {
+			return "", err
+		}
+		if secretBundle.Value == nil {
+			return "", errors.Errorf("%s has no value", description)
+		}
+		return *secretBundle.Value, nil
+	})
 }
@@ -0,0 +1,109 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package vaults
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/acr-builder/util"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+const (
+	// secretRetries is the number of times fetching a secret is retried after a transient failure.
+	secretRetries = 5
+
+	// maxRetryAfter caps the delay requested by a vault's Retry-After header.
+	maxRetryAfter = time.Minute
+)
+
+// retryDelay returns the delay before retrying a fetch which failed without a Retry-After header.
+var retryDelay = util.GetExponentialBackoff
+
+// transientStatusCodes are the status codes of the responses to fetches which are worth retrying,
+// i.e. throttling, timeouts and server errors. Any other status, e.g. 403 Forbidden or 404 Not Found, is permanent.
+var transientStatusCodes = map[int]bool{
+	http.StatusRequestTimeout:      true,
+	http.StatusTooManyRequests:     true,
+	http.StatusInternalServerError: true,
+	http.StatusBadGateway:          true,
+	http.StatusServiceUnavailable:  true,
+	http.StatusGatewayTimeout:      true,
+}
+
+// getWithRetries fetches a secret, described by the name of the secret and its vault, using get, retrying
+// transient failures with an exponential backoff, or after the delay requested by the vault, until ctx is done.
+func getWithRetries(ctx context.Context, description string, get func(ctx context.Context) (string, error)) (string, error) {
+	for attempt := 0; ; attempt++ {
+		value, err := get(ctx)
+		if err == nil {
+			return value, nil
+		}
+		transient, retryAfter := classifyVaultError(err)
+		if !transient || attempt >= secretRetries || ctx.Err() != nil {
+			return "", err
+		}
+		delay := retryDelay(attempt)
+		if retryAfter > 0 {
+			delay = retryAfter
+		}
+		// The error only describes the request and its response, never the secret's value.
+		log.Printf("Failed to get %s (attempt %d/%d), retrying in %v: %v\n", description, attempt+1, secretRetries+1, delay, err)
+		select {
+		case <-ctx.Done():
+			return "", errors.Wrapf(err, "gave up getting %s", description)
+		case <-time.After(delay):
+		}
+	}
+}
+
+// classifyVaultError returns whether fetching a secret failed transiently and is worth retrying, along with
+// the delay requested by the vault's Retry-After header, if any. Requests which failed without a response,
+// e.g. because the connection was reset, are transient.
+func classifyVaultError(err error) (transient bool, retryAfter time.Duration) {
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false, 0
+	}
+	var detailed autorest.DetailedError
+	if errors.As(err, &detailed) {
+		if status, ok := detailed.StatusCode.(int); ok && status != 0 {
+			if !transientStatusCodes[status] {
+				return false, 0
+			}
+			if detailed.Response != nil {
+				retryAfter = parseRetryAfter(detailed.Response.Header.Get("Retry-After"))
+			}
+			return true, retryAfter
+		}
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr), 0
+}
+
+// parseRetryAfter parses a Retry-After header, either a number of seconds or an HTTP date, into a delay
+// capped at maxRetryAfter. It returns 0 if the header is empty or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	var delay time.Duration
+	if seconds, err := strconv.Atoi(value); err == nil {
+		delay = time.Duration(seconds) * time.Second
+	} else if date, err := http.ParseTime(value); err == nil {
+		delay = time.Until(date)
+	}
+	if delay <= 0 {
+		return 0
+	}
+	if delay > maxRetryAfter {
+		return maxRetryAfter
+	}
+	return delay
+}
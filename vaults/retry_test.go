@@ -0,0 +1,149 @@
+// Copyright (c) Microsoft Corporation. All rights reserved.
+// Licensed under the MIT License.
+
+package vaults
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/pkg/errors"
+)
+
+// newTestKeyVault returns a keyVault whose requests are served by handler, without retrying in autorest.
+func newTestKeyVault(t *testing.T, handler http.HandlerFunc) *keyVault {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	client := newBaseClient()
+	return &keyVault{client: &client, vaultURL: server.URL}
+}
+
+func withRetryDelay(t *testing.T, delay time.Duration) {
+	original := retryDelay
+	retryDelay = func(int) time.Duration { return delay }
+	t.Cleanup(func() { retryDelay = original })
+}
+
+func TestGetSecret_RetriesTransientFailures(t *testing.T) {
+	withRetryDelay(t, time.Millisecond)
+	var requests int32
+	k := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"value":"p@ssw0rd"}`))
+		}
+	})
+
+	value, err := k.getSecret(context.Background(), "password", "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if value != "p@ssw0rd" {
+		t.Errorf("Expected the secret's value, but got %s", value)
+	}
+	if requests != 3 {
+		t.Errorf("Expected 3 requests, but got %d", requests)
+	}
+}
+
+func TestGetSecret_PermanentFailures(t *testing.T) {
+	withRetryDelay(t, time.Millisecond)
+	for _, status := range []int{http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound} {
+		var requests int32
+		k := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.WriteHeader(status)
+		})
+		if _, err := k.getSecret(context.Background(), "password", ""); err == nil {
+			t.Errorf("Expected an error for status %d", status)
+		}
+		if requests != 1 {
+			t.Errorf("Expected status %d not to be retried, but got %d requests", status, requests)
+		}
+	}
+}
+
+func TestGetSecret_GivesUp(t *testing.T) {
+	withRetryDelay(t, time.Millisecond)
+	var requests int32
+	k := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	if _, err := k.getSecret(context.Background(), "password", ""); err == nil {
+		t.Error("Expected an error once the retries are exhausted")
+	}
+	if requests != secretRetries+1 {
+		t.Errorf("Expected %d requests, but got %d", secretRetries+1, requests)
+	}
+}
+
+func TestGetSecret_Cancelled(t *testing.T) {
+	withRetryDelay(t, time.Hour)
+	k := newTestKeyVault(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := k.getSecret(ctx, "password", ""); err == nil {
+		t.Error("Expected an error once the context is done")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected retrying to stop once the context is done, but it took %v", elapsed)
+	}
+}
+
+func TestClassifyVaultError(t *testing.T) {
+	throttled := &http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": []string{"7"}}}
+	tests := []struct {
+		err                error
+		expectedTransient  bool
+		expectedRetryAfter time.Duration
+	}{
+		{autorest.NewErrorWithError(errors.New("throttled"), "keyvault.BaseClient", "GetSecret", throttled, "Failure"), true, 7 * time.Second},
+		{autorest.DetailedError{StatusCode: http.StatusBadGateway}, true, 0},
+		{autorest.DetailedError{StatusCode: http.StatusForbidden}, false, 0},
+		{autorest.DetailedError{StatusCode: http.StatusNotFound}, false, 0},
+		{errors.Wrap(context.DeadlineExceeded, "failed"), false, 0},
+		{errors.New("invalid secret"), false, 0},
+	}
+	for _, test := range tests {
+		transient, retryAfter := classifyVaultError(test.err)
+		if transient != test.expectedTransient || retryAfter != test.expectedRetryAfter {
+			t.Errorf("Expected %v to be transient: %v, retry after: %v, but got %v, %v", test.err, test.expectedTransient, test.expectedRetryAfter, transient, retryAfter)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"", 0},
+		{"3", 3 * time.Second},
+		{"3600", maxRetryAfter},
+		{"-1", 0},
+		{"soon", 0},
+		{time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0},
+	}
+	for _, test := range tests {
+		if actual := parseRetryAfter(test.value); actual != test.expected {
+			t.Errorf("Expected %v for %q, but got %v", test.expected, test.value, actual)
+		}
+	}
+	if delay := parseRetryAfter(time.Now().Add(30 * time.Second).UTC().Format(http.TimeFormat)); delay <= 0 || delay > 30*time.Second {
+		t.Errorf("Expected a delay of up to 30s for a date, but got %v", delay)
+	}
+}